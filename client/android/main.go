@@ -3,47 +3,194 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/flynn/noise"
 	"github.com/gorilla/websocket"
 	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/vpnerr"
 )
 
+// maxMissedHealthChecks is how many unanswered health checks trigger a reconnect
+const maxMissedHealthChecks = 3
+
+// DozeKeepaliveSeconds is how often the app should call Keepalive while the
+// device is in Doze mode
+const DozeKeepaliveSeconds = 60
+
 // AndroidVPNClient represents the Android VPN client
 type AndroidVPNClient struct {
 	config       *ClientConfig
+	servers      *protocol.ServerList
+	serverURL    string // server of the current connection
+	done         chan struct{} // closed by Disconnect to stop reconnecting; guarded by runMu
+	running      bool          // between StartVPN and StopVPN; guarded by runMu
+	runMu        sync.Mutex
 	stealth      *protocol.StealthProtocol
 	encryption   *protocol.MultiLayerEncryption
+	compressor   *protocol.Compressor
 	conn         *websocket.Conn
+	transport    protocol.Transport
 	keyExchange  *protocol.KeyExchange
-	connected    bool
+	sessionToken []byte
+	resumeSecret []byte // issued with sessionToken
+	pskKey       []byte // pre-shared key material, for PSK proofs
+	clientCert   *tls.Certificate // nil unless client_cert_file is set
+	noiseKey     noise.DHKey // our long-term Noise key
+	noisePin     []byte // the server's Noise key, nil to accept any
+	batching     bool // the server reads batches of frames
+	cipher       string // negotiated in the key exchange, kept for resumed sessions
+	deadPeer     *protocol.DeadPeerDetector
 	vpnService   VPNService // Android VPN service interface
+	tunUp        bool       // the TUN interface outlives connections; guarded by tunMu
+	tunMu        sync.Mutex
+	pushedConfig *protocol.TunnelConfig // settings pushed by the server; guarded by tunMu
+	tunSettings  protocol.TunnelConfig  // what the TUN interface was created with; guarded by tunMu
+	sendQueue    *protocol.SendQueue // packets read from the TUN interface, waiting to be sent; guarded by tunMu
+	sendPolicy   protocol.QueuePolicy
+	sendDropped  atomic.Uint64 // packets the send queue policy dropped
+	
+	// connCtx is cancelled as soon as the current connection is lost
+	connMu       sync.Mutex
+	connCtx      context.Context
+	connCancel   context.CancelFunc
+	lastErr      error // why the last connect failed, nil once connected
+	connectedAt  time.Time
+	
+	// Traffic of the current connection, counted as framed on the wire
+	sent         protocol.ThroughputMeter
+	received     protocol.ThroughputMeter
+	
+	// Health check state, guarded by healthMu
+	healthMu           sync.Mutex
+	healthCheckPending int64 // timestamp of the unanswered health check, 0 if none
+	missedHealthChecks int
+	stats              protocol.SessionStats
+	healthReset        chan struct{} // restarts the health check interval
+	dozing             atomic.Bool   // the device is in Doze mode; health checks are paused
+	
+	// Status updates for the listener, queued under listenerMu and delivered
+	// in order by deliverStatus
+	listenerMu   sync.Mutex
+	listener     StatusListener
+	state        string // last state reported
+	statusQueue  []func()
+	statusReady  chan struct{}
 }
 
-// VPNService interface for Android VPN service
+// VPNService interface for Android VPN service. The TUN interface is created
+// once and kept across reconnects until ReadPacket fails or the VPN stops.
 type VPNService interface {
-	CreateTunInterface(ip string, dns []string) error
+	// CreateTunInterface may be called again while the interface is up, to
+	// replace it when the server pushes different settings. Routes are in
+	// CIDR notation.
+	CreateTunInterface(ip string, ip6 string, dns []string, routes []string) error
+	// AddAllowedApplication and AddDisallowedApplication name an app, by
+	// package name, to send through the tunnel or to leave out of it, as
+	// VpnService.Builder's methods of the same names do. They are called
+	// before each CreateTunInterface and apply to that interface only.
+	AddAllowedApplication(packageName string) error
+	AddDisallowedApplication(packageName string) error
 	WritePacket(data []byte) error
 	ReadPacket() ([]byte, error)
 	CloseTunInterface() error
 	IsConnected() bool
+	// Protect exempts a socket from the VPN's routes, as VpnService.protect
+	// does, so the connection to the server does not loop into the tunnel
+	Protect(fd int) bool
+	// WatchDoze registers a NetworkCallback and the device idle broadcast,
+	// telling handler when the device enters or leaves Doze mode and having
+	// it send a keepalive every DozeKeepaliveSeconds while it is in it. nil
+	// stops watching. Only called when doze_compatibility is set.
+	WatchDoze(handler DozeHandler) error
+}
+
+// DozeHandler is told about Doze mode by the VPNService. AndroidVPNClient
+// implements it.
+type DozeHandler interface {
+	// DozeChanged reports that the device entered or left Doze mode
+	DozeChanged(idle bool)
+	// Keepalive proves the connection alive, from a periodic task the
+	// system runs even in Doze mode
+	Keepalive() error
 }
 
 // ClientConfig holds Android client configuration
 type ClientConfig struct {
 	ServerURL           string   `json:"server_url"`
+	ServerURLs          []string `json:"server_urls"` // failover servers, tried after server_url
 	PreSharedKey        string   `json:"pre_shared_key"`
+	PreSharedKeyID      string   `json:"pre_shared_key_id"` // tells the server which key we hold during rotation
+	PassphraseKDF       *protocol.PassphraseKDF `json:"passphrase_kdf"` // treat the pre-shared key as a passphrase
 	DNSServers          []string `json:"dns_servers"`
 	LocalIP             string   `json:"local_ip"`
+	LocalIP6            string   `json:"local_ip6"`
 	AutoConnect         bool     `json:"auto_connect"`
 	ReconnectDelay      int      `json:"reconnect_delay"`
 	HealthCheckInterval int      `json:"health_check_interval"`
 	FakeDomainName      string   `json:"fake_domain_name"`
+	KeepaliveInterval   int      `json:"keepalive_interval"`
+	DeadPeerIntervals   int      `json:"dead_peer_intervals"`
+	Compression         protocol.CompressionAlgorithm `json:"compression"`
+	Transport           protocol.TransportType `json:"transport"`
+	UDPServerAddr       string   `json:"udp_server_addr"`
+	BatchIntervalMs     int      `json:"batch_interval_ms"` // 0 sends every packet on its own
+	BatchPackets        int      `json:"batch_packets"`
+	Username            string   `json:"username"` // for servers that require a login
+	Password            string   `json:"password"`
+	OTP                 string   `json:"otp"` // one-time code, for servers using TOTP
+	ClientCertFile      string   `json:"client_cert_file"` // for servers using certificate authentication
+	ClientKeyFile       string   `json:"client_key_file"`
+	UseNoise            bool     `json:"use_noise"` // Noise_XX handshake instead of the custom key exchange
+	NoisePrivateKey     string   `json:"noise_private_key"` // WireGuard format; a new key each run if empty
+	NoiseServerPublicKey string `json:"noise_server_public_key"` // reject servers with any other key
+	PaddingBuckets      []int    `json:"padding_buckets"` // frame sizes to pad to; defaults if empty
+	PaddingWeights      []float64 `json:"padding_weights"` // likelihood of each bucket
+	Jitter              *protocol.JitterProfile `json:"jitter"` // shape of the delays added to disguise timing; set disabled to turn them off
+	JitterMinMs         *int `json:"jitter_min_ms"` // shortest added delay; default 0
+	JitterMaxMs         *int `json:"jitter_max_ms"` // longest added delay; default 100, 0 turns the delays off
+	TLSMinVersion       string `json:"tls_min_version"` // "1.2" (default) or "1.3"; older versions only to match a fingerprint
+	TLSCipherSuites     []string `json:"tls_cipher_suites"` // IANA names of the TLS 1.2 suites to offer; modern AEAD suites if empty
+	SingleCipher        bool     `json:"single_cipher"` // encrypt with just the cipher fastest on this CPU, if the server allows
+	SendQueueSize       int      `json:"send_queue_size"` // packets from the TUN interface that may wait for the connection. Default 256
+	ParallelThreshold   int      `json:"parallel_threshold"` // payloads of at least this many bytes are encrypted in chunks on several cores. Default 0, never
+	SendQueuePolicy     string   `json:"send_queue_policy"` // what to do when the queue is full: drop-oldest (default), drop-newest or block
+	TCPNoDelay          *bool    `json:"tcp_nodelay"` // send small writes to the server at once; default true, false to coalesce them
+	SocketSendBuffer    int      `json:"socket_send_buffer"` // SO_SNDBUF of the TCP connection in bytes; system default if 0
+	SocketReceiveBuffer int      `json:"socket_receive_buffer"` // SO_RCVBUF of the TCP connection in bytes; system default if 0
+	UDPSendBuffer       int      `json:"udp_send_buffer"` // SO_SNDBUF of the udp transport's socket in bytes; system default if 0
+	UDPReceiveBuffer    int      `json:"udp_receive_buffer"` // SO_RCVBUF of the udp transport's socket in bytes; system default if 0
+	AllowedApplications []string `json:"allowed_applications"` // package names of the only apps to tunnel; all apps if empty
+	DisallowedApplications []string `json:"disallowed_applications"` // package names of apps to leave out of the tunnel
+	DozeCompatibility   bool     `json:"doze_compatibility"` // keep the connection alive through Doze mode with pings from a WorkManager task
+}
+
+// tcpSocketOptions returns the options for TCP connections to the server
+func tcpSocketOptions(config *ClientConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		NoDelay:     config.TCPNoDelay,
+		ReadBuffer:  config.SocketReceiveBuffer,
+		WriteBuffer: config.SocketSendBuffer,
+	}
+}
+
+// udpSocketOptions returns the options for the udp transport's socket
+func udpSocketOptions(config *ClientConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		ReadBuffer:  config.UDPReceiveBuffer,
+		WriteBuffer: config.UDPSendBuffer,
+	}
 }
 
 // NewAndroidVPNClient creates a new Android VPN client
@@ -55,70 +202,323 @@ func NewAndroidVPNClient(configJSON string, vpnService VPNService) (*AndroidVPNC
 	
 	stealth := protocol.NewStealthProtocol()
 	
+	// Shape frame sizes like the traffic being impersonated
+	if len(config.PaddingBuckets) > 0 {
+		if err := stealth.SetPaddingBuckets(config.PaddingBuckets, config.PaddingWeights); err != nil {
+			return nil, fmt.Errorf("invalid padding buckets: %v", err)
+		}
+	}
+	if config.Jitter != nil {
+		if err := stealth.SetJitterProfile(*config.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	if err := stealth.SetJitterBounds(protocol.JitterBoundsMs(config.JitterMinMs, config.JitterMaxMs)); err != nil {
+		return nil, err
+	}
+	if err := stealth.SetTLSPolicy(config.TLSMinVersion, config.TLSCipherSuites); err != nil {
+		return nil, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+	
 	// Initialize pre-shared key encryption
-	encryption, err := protocol.NewMultiLayerEncryption([]byte(config.PreSharedKey))
+	masterKey, err := protocol.MasterKey(config.PreSharedKey, config.PassphraseKDF)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := protocol.NewMultiLayerEncryption(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize encryption: %v", err)
 	}
 	
-	return &AndroidVPNClient{
-		config:     &config,
-		stealth:    stealth,
-		encryption: encryption,
-		connected:  false,
-		vpnService: vpnService,
-	}, nil
+	// Present a client certificate to servers that authenticate with one
+	var clientCert *tls.Certificate
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		clientCert = &cert
+	}
+	
+	noiseKey, noisePin, err := loadNoiseKeys(&config)
+	if err != nil {
+		return nil, err
+	}
+	
+	sendPolicy, err := protocol.ParseQueuePolicy(config.SendQueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.ParallelThreshold < 0 {
+		return nil, fmt.Errorf("parallel_threshold must not be negative")
+	}
+	if err := tcpSocketOptions(&config).Validate(); err != nil {
+		return nil, err
+	}
+	if err := udpSocketOptions(&config).Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateAppFilter(&config); err != nil {
+		return nil, err
+	}
+	if config.Transport == protocol.TransportWebRTC {
+		if err := webrtcAvailable(); err != nil {
+			return nil, err
+		}
+	}
+	
+	client := &AndroidVPNClient{
+		config:      &config,
+		servers:     newServerList(&config),
+		done:        make(chan struct{}),
+		stealth:     stealth,
+		encryption:  encryption,
+		pskKey:      masterKey,
+		clientCert:  clientCert,
+		sendPolicy:  sendPolicy,
+		noiseKey:    noiseKey,
+		noisePin:    noisePin,
+		vpnService:  vpnService,
+		statusReady: make(chan struct{}, 1),
+		healthReset: make(chan struct{}, 1),
+	}
+	go client.deliverStatus()
+	
+	return client, nil
+}
+
+// loadNoiseKeys returns the keys for the Noise handshake if it is enabled:
+// our long-term key, random unless configured, and the server key to pin
+func loadNoiseKeys(config *ClientConfig) (noise.DHKey, []byte, error) {
+	if !config.UseNoise {
+		return noise.DHKey{}, nil, nil
+	}
+	
+	static, err := protocol.NoiseStaticKey(config.NoisePrivateKey)
+	if err != nil {
+		return noise.DHKey{}, nil, fmt.Errorf("invalid noise_private_key: %v", err)
+	}
+	var serverKey []byte
+	if config.NoiseServerPublicKey != "" {
+		serverKey, err = protocol.DecodeNoisePublicKey(config.NoiseServerPublicKey)
+		if err != nil {
+			return noise.DHKey{}, nil, fmt.Errorf("invalid noise_server_public_key: %v", err)
+		}
+	}
+	return static, serverKey, nil
 }
 
 // Connect establishes connection to the VPN server
 func (c *AndroidVPNClient) Connect() error {
-	log.Println("Android VPN connecting to stealth server...")
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext establishes connection to the VPN server, giving up as soon
+// as ctx is done
+func (c *AndroidVPNClient) ConnectContext(ctx context.Context) (err error) {
+	defer func() {
+		// A cancelled attempt is reported as such, whatever step it interrupted
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		// Keep the failure, categorized, for the status report
+		c.setLastError(err)
+		// A cancelled attempt was stopped on purpose and is not an error
+		if err != nil && ctx.Err() == nil {
+			c.reportConnectFailure(err)
+		}
+	}()
 	
-	// Create TUN interface through Android VPN service
-	if err := c.vpnService.CreateTunInterface(c.config.LocalIP, c.config.DNSServers); err != nil {
-		return fmt.Errorf("failed to create TUN interface: %v", err)
+	slog.Info("Android VPN connecting to stealth server")
+	c.reportConnecting()
+	
+	// Reconnects reuse the TUN interface
+	if err := c.ensureTunInterface(ctx); err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryTunSetup, err)
 	}
 	
-	// Connect to server
-	if err := c.connectToServer(); err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+	// Connect to the first server that completes the handshake
+	if err := c.connectToAnyServer(ctx); err != nil {
+		return err
+	}
+	
+	// Send packets in batches if agreed in the key exchange
+	if c.batching {
+		c.transport = protocol.NewBatchWriter(c.transport,
+			time.Duration(c.config.BatchIntervalMs)*time.Millisecond, c.config.BatchPackets)
+	}
+	
+	// Count this connection's traffic from zero
+	c.sent.Reset()
+	c.received.Reset()
+	
+	// Detect a server that silently stops responding, and measure the
+	// round-trip time of the link with the same pings
+	var deadPeer *protocol.DeadPeerDetector
+	if c.conn != nil {
+		deadPeer = protocol.NewDeadPeerDetector(c.conn,
+			time.Duration(c.config.KeepaliveInterval)*time.Second, c.config.DeadPeerIntervals)
+		deadPeer.SetRTTObserver(c.pongReceived)
 	}
 	
-	// Perform key exchange
-	if err := c.performKeyExchange(); err != nil {
-		return fmt.Errorf("key exchange failed: %v", err)
+	// Everything tied to this connection stops when connCtx is cancelled
+	connCtx, connCancel := context.WithCancel(context.Background())
+	c.connMu.Lock()
+	if c.stopped() {
+		// Disconnect ran while the handshake finished and missed this
+		// connection
+		c.connMu.Unlock()
+		connCancel()
+		c.transport.Close()
+		return context.Canceled
 	}
+	c.connCtx, c.connCancel = connCtx, connCancel
+	c.connectedAt = time.Now()
+	c.deadPeer = deadPeer
+	c.connMu.Unlock()
+	slog.Info("Successfully connected to VPN server", "server", c.serverURL)
+	c.setState(StateConnected)
 	
-	c.connected = true
-	log.Println("Successfully connected to VPN server")
+	c.healthMu.Lock()
+	c.healthCheckPending = 0
+	c.missedHealthChecks = 0
+	c.healthMu.Unlock()
 	
-	// Start packet forwarding
-	go c.forwardPacketsToServer()
-	go c.forwardPacketsFromServer()
+	if deadPeer != nil {
+		deadPeer.Start()
+	}
+	
+	// Start packet forwarding; packets from the TUN interface are already
+	// being read and go out over whichever connection is current
+	go c.forwardPacketsFromServer(connCtx)
 	
 	// Start health check
 	if c.config.HealthCheckInterval > 0 {
-		go c.healthCheckRoutine()
+		go c.healthCheckRoutine(connCtx)
 	}
 	
+	// Push traffic counts to the listener
+	go c.reportBytesRoutine(connCtx)
+	
 	return nil
 }
 
-// connectToServer establishes WebSocket connection to server
-func (c *AndroidVPNClient) connectToServer() error {
+// setLastError records the outcome of a connect attempt
+func (c *AndroidVPNClient) setLastError(err error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.lastErr = err
+}
+
+// lastError returns why the last connect attempt failed, or nil
+func (c *AndroidVPNClient) lastError() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.lastErr
+}
+
+// connectionStart returns when the current connection was established, or
+// the zero time while disconnected
+func (c *AndroidVPNClient) connectionStart() time.Time {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.connCtx == nil || c.connCtx.Err() != nil {
+		return time.Time{}
+	}
+	return c.connectedAt
+}
+
+// connContext returns the context of the current connection, or nil before the first
+func (c *AndroidVPNClient) connContext() context.Context {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.connCtx
+}
+
+// isConnected reports whether the current connection is up
+func (c *AndroidVPNClient) isConnected() bool {
+	ctx := c.connContext()
+	return ctx != nil && ctx.Err() == nil
+}
+
+// newServerList returns the configured servers for the selected transport
+func newServerList(config *ClientConfig) *protocol.ServerList {
+	if config.Transport == protocol.TransportUDP {
+		return protocol.NewServerList([]string{config.UDPServerAddr})
+	}
+	return protocol.NewServerList(append([]string{config.ServerURL}, config.ServerURLs...))
+}
+
+// connectToAnyServer tries each server, preferring the fastest reachable one,
+// until one completes the handshake
+func (c *AndroidVPNClient) connectToAnyServer(ctx context.Context) error {
+	candidates := c.servers.Candidates()
+	if len(candidates) == 0 {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("no server configured"))
+	}
+	
+	var lastErr error
+	for _, server := range candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		
+		if err := c.connectToServer(ctx, server); err != nil {
+			// Giving up is not the server's fault
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			slog.Warn("Server unreachable", "server", server, "error", err)
+			c.servers.MarkFailure(server)
+			continue
+		}
+		
+		if err := c.performKeyExchange(ctx); err != nil {
+			if ctx.Err() != nil {
+				c.transport.Close()
+				return ctx.Err()
+			}
+			lastErr = err
+			slog.Warn("Key exchange failed", "server", server, "error", err)
+			c.transport.Close()
+			c.servers.MarkFailure(server)
+			continue
+		}
+		
+		c.servers.MarkSuccess(server, time.Since(start))
+		c.serverURL = server
+		return nil
+	}
+	
+	return lastErr
+}
+
+// connectToServer establishes the transport to the server
+func (c *AndroidVPNClient) connectToServer(ctx context.Context, server string) error {
+	if c.config.Transport == protocol.TransportUDP {
+		return c.connectToServerUDP(ctx, server)
+	}
+	
 	// Parse server URL
-	u, err := url.Parse(c.config.ServerURL)
+	u, err := url.Parse(server)
 	if err != nil {
-		return err
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
 	}
 	
 	// Create TLS config for stealth
 	tlsConfig := c.stealth.GetTLSConfig()
 	tlsConfig.ServerName = c.config.FakeDomainName
 	tlsConfig.InsecureSkipVerify = true // For testing - remove in production
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
 	
-	// Create WebSocket dialer
+	// Create WebSocket dialer; its socket must bypass the tunnel
+	netDialer := &net.Dialer{Control: c.protectSocket}
 	dialer := websocket.Dialer{
+		NetDialContext:   tcpSocketOptions(c.config).DialContext(netDialer),
 		TLSClientConfig:  tlsConfig,
 		HandshakeTimeout: 15 * time.Second,
 	}
@@ -130,216 +530,950 @@ func (c *AndroidVPNClient) connectToServer() error {
 	header.Set("Accept-Encoding", "gzip, deflate, br")
 	header.Set("Origin", fmt.Sprintf("https://%s", c.config.FakeDomainName))
 	header.Set("Sec-WebSocket-Protocol", "chat")
+	if c.config.Transport == protocol.TransportWebRTC {
+		header.Set(protocol.TransportHeader, string(protocol.TransportWebRTC))
+	}
+	
+	// Present the session token from the last connection for fast resumption
+	if c.sessionToken != nil {
+		header.Set("Cookie", fmt.Sprintf("%s=%s", protocol.SessionCookieName,
+			base64.RawURLEncoding.EncodeToString(c.sessionToken)))
+	}
 	
 	// Add timing jitter
 	c.stealth.AddTimingJitter()
 	
 	// Connect
-	conn, _, err := dialer.Dial(u.String(), header)
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
 	if err != nil {
-		return err
+		return vpnerr.FromDial(err, resp)
+	}
+	
+	if c.config.Transport == protocol.TransportWebRTC {
+		return c.switchToWebRTC(ctx, conn, u.String())
 	}
 	
 	c.conn = conn
-	log.Printf("Connected to server: %s", u.String())
+	c.transport = protocol.NewWebSocketTransport(conn)
+	slog.Info("Connected to server", "server", u.String())
 	return nil
 }
 
-// performKeyExchange performs X25519 key exchange with server
-func (c *AndroidVPNClient) performKeyExchange() error {
-	// Create key exchange
-	kx, err := protocol.NewKeyExchange()
+// connectToServerUDP opens the UDP datagram transport to the server
+func (c *AndroidVPNClient) connectToServerUDP(ctx context.Context, server string) error {
+	transport, err := protocol.DialUDPWithOptions(ctx, &net.Dialer{Control: c.protectSocket}, server, udpSocketOptions(c.config))
 	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	// Open the session, presenting the token from the last connection if any
+	hello := protocol.Message{Type: protocol.HelloType, Data: c.sessionToken}
+	if err := protocol.WriteJSON(transport, hello); err != nil {
+		transport.Close()
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	c.conn = nil
+	c.transport = transport
+	slog.Info("Connected to server over UDP", "server", server)
+	return nil
+}
+
+// protectSocket asks the VPN service to keep a socket to the server out of
+// the tunnel. It runs as a dialer's Control hook, after the socket is created
+// and before it connects, so no packet can reach the TUN interface first.
+func (c *AndroidVPNClient) protectSocket(network, address string, conn syscall.RawConn) error {
+	protected := false
+	if err := conn.Control(func(fd uintptr) {
+		protected = c.vpnService.Protect(int(fd))
+	}); err != nil {
 		return err
 	}
-	c.keyExchange = kx
 	
-	// Receive server's public key
-	var serverKeyMsg map[string]interface{}
-	if err := c.conn.ReadJSON(&serverKeyMsg); err != nil {
+	if !protected {
+		return fmt.Errorf("failed to protect socket to %s", address)
+	}
+	return nil
+}
+
+// performKeyExchange performs X25519 key exchange with server
+func (c *AndroidVPNClient) performKeyExchange(ctx context.Context) (err error) {
+	// Every failure from here on is a failed handshake
+	defer func() { err = vpnerr.Wrap(vpnerr.CategoryHandshake, err) }()
+	
+	// Bound the handshake by ctx's deadline, and fail any blocked read or
+	// write as soon as ctx is cancelled
+	deadline, _ := ctx.Deadline()
+	c.transport.SetReadDeadline(deadline)
+	c.transport.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		c.transport.SetReadDeadline(time.Now())
+		c.transport.SetWriteDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() && err == nil {
+			// Cancelled just as the handshake finished; the deadlines are spent
+			err = ctx.Err()
+		}
+		if err == nil {
+			c.transport.SetReadDeadline(time.Time{})
+			c.transport.SetWriteDeadline(time.Time{})
+		}
+	}()
+	
+	// Receive server's public key, kept raw to authenticate it in a Noise
+	// handshake
+	hello, err := c.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	var serverKeyMsg protocol.KeyExchangeMessage
+	if err := json.Unmarshal(hello, &serverKeyMsg); err != nil {
 		return err
 	}
+	if err := protocol.CheckProtocolVersion("server", serverKeyMsg.Version); err != nil {
+		return err
+	}
+	
+	// The server skips the key exchange when it accepted our session token
+	if serverKeyMsg.Type == protocol.SessionResumedType {
+		encryption, err := protocol.ResumedEncryption(c.resumeSecret, serverKeyMsg.ResumeNonce)
+		c.clearSessionToken()
+		if err != nil {
+			return err
+		}
+		if err := encryption.SetCipher(c.cipher); err != nil {
+			return err
+		}
+		encryption.SetParallelThreshold(c.config.ParallelThreshold)
+		c.encryption = encryption
+		slog.Info("Session resumed without key exchange")
+		return c.receiveSessionToken()
+	}
+	c.clearSessionToken()
 	
-	serverPublicKey, ok := serverKeyMsg["public_key"].([]byte)
-	if !ok {
+	if serverKeyMsg.Type != protocol.KeyExchangeType || len(serverKeyMsg.PublicKey) == 0 {
 		return fmt.Errorf("invalid server public key")
 	}
+	serverPublicKey := serverKeyMsg.PublicKey
+	if c.config.UseNoise && !serverKeyMsg.Noise {
+		return fmt.Errorf("server does not offer a Noise handshake")
+	}
+	
+	// Use our preferred compression only if the server offered it
+	compression := protocol.NegotiateCompression(serverKeyMsg.Compression, c.config.Compression)
+	compressor, err := protocol.NewCompressor(compression)
+	if err != nil {
+		return err
+	}
+	
+	// Batch packets over WebSocket if configured and the server can split
+	// batches; UDP datagrams stay one packet each
+	c.batching = serverKeyMsg.Batching && c.config.BatchIntervalMs > 0 && c.conn != nil
+	
+	// Drop to one cipher, the one this CPU runs fastest, if configured and
+	// the server allows. Phones without AES instructions get ChaCha20.
+	cipher := protocol.CipherLayered
+	if c.config.SingleCipher {
+		cipher = protocol.NegotiateCipher(serverKeyMsg.Ciphers, protocol.PreferredCipher())
+		slog.Info("Chose cipher", "cipher", cipher, "aes_hardware", protocol.HasAESHardware())
+	}
+	
+	// Send our public key, or ask for a Noise handshake, and the
+	// compression we picked
+	clientKeyMsg := protocol.KeyExchangeMessage{
+		Type:        protocol.KeyExchangeType,
+		Version:     protocol.ProtocolVersion,
+		Compression: []protocol.CompressionAlgorithm{compression},
+		Batching:    c.batching,
+		KeyID:       c.config.PreSharedKeyID,
+		Noise:       c.config.UseNoise,
+	}
+	if cipher != protocol.CipherLayered {
+		clientKeyMsg.Ciphers = []string{cipher}
+	}
+	var kx *protocol.KeyExchange
+	if !c.config.UseNoise {
+		kx, err = protocol.NewKeyExchange()
+		if err != nil {
+			return err
+		}
+		clientKeyMsg.PublicKey = kx.GetPublicKey()
+	}
+	c.keyExchange = kx
+	
+	reply, err := json.Marshal(clientKeyMsg)
+	if err != nil {
+		return err
+	}
+	if err := c.transport.WriteMessage(reply); err != nil {
+		return err
+	}
 	
-	// Send our public key
-	clientKeyMsg := map[string]interface{}{
-		"type":       "key_exchange",
-		"public_key": kx.GetPublicKey(),
+	var transcript []byte
+	if c.config.UseNoise {
+		// The prologue covers the options negotiated in the clear
+		noiseSession, err := protocol.NoiseHandshake(c.transport, true, c.noiseKey, c.noisePin, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return err
+		}
+		c.encryption, transcript = noiseSession.Encryption, noiseSession.Transcript
+	} else {
+		// Compute shared secret, bound to both messages of the handshake
+		sharedSecret, err := kx.ComputeSharedSecret(serverPublicKey, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return err
+		}
+		
+		// Create session encryption
+		sessionEncryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
+		if err != nil {
+			return err
+		}
+		c.encryption = sessionEncryption
+		transcript = protocol.HandshakeTranscript(serverPublicKey, kx.GetPublicKey())
 	}
 	
-	if err := c.conn.WriteJSON(clientKeyMsg); err != nil {
+	if err := c.encryption.SetCipher(cipher); err != nil {
 		return err
 	}
+	c.encryption.SetParallelThreshold(c.config.ParallelThreshold)
+	c.cipher = cipher
+	c.compressor = compressor
+	slog.Info("Key exchange completed successfully")
 	
-	// Compute shared secret
-	sharedSecret, err := kx.ComputeSharedSecret(serverPublicKey)
+	// Log in before the server starts the session
+	if serverKeyMsg.AuthRequired {
+		if err := c.login(transcript); err != nil {
+			return err
+		}
+	}
+	
+	if serverKeyMsg.SessionResumption {
+		return c.receiveSessionToken()
+	}
+	return nil
+}
+
+// login sends the client's credentials, encrypted with the session key, and
+// waits for the server to accept them. Which of them the server checks
+// depends on its configuration; the PSK proof covers transcript.
+func (c *AndroidVPNClient) login(transcript []byte) error {
+	credentials, err := json.Marshal(protocol.AuthRequest{
+		Type:     protocol.AuthType,
+		Username: c.config.Username,
+		Password: c.config.Password,
+		OTP:      c.config.OTP,
+		PSKProof: protocol.PSKProof(c.pskKey, transcript),
+	})
 	if err != nil {
 		return err
 	}
+	encrypted, err := c.encryption.Encrypt(credentials)
+	protocol.ZeroBytes(credentials)
+	if err != nil {
+		return err
+	}
+	
+	if err := protocol.WriteJSON(c.transport, protocol.Message{Type: protocol.AuthType, Data: encrypted}); err != nil {
+		return err
+	}
+	
+	var result protocol.Message
+	if err := protocol.ReadJSON(c.transport, &result); err != nil {
+		return err
+	}
+	if result.Type != protocol.AuthResultType {
+		return fmt.Errorf("unexpected message type: %s", result.Type)
+	}
+	if result.Error != "" {
+		return vpnerr.Wrap(vpnerr.CategoryAuth, fmt.Errorf("login rejected: %s", result.Error))
+	}
+	
+	slog.Info("Authenticated with the server")
+	return nil
+}
+
+// receiveSessionToken stores the single-use token the server issues for the next reconnect
+func (c *AndroidVPNClient) receiveSessionToken() error {
+	var tokenMsg protocol.Message
+	if err := protocol.ReadJSON(c.transport, &tokenMsg); err != nil {
+		return err
+	}
 	
-	// Create session encryption
-	sessionEncryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
+	if tokenMsg.Type != protocol.SessionTokenType {
+		return fmt.Errorf("unexpected message type: %s", tokenMsg.Type)
+	}
+	
+	plaintext, err := c.encryption.Decrypt(tokenMsg.Data)
 	if err != nil {
+		return fmt.Errorf("invalid session token: %v", err)
+	}
+	if len(plaintext) != protocol.SessionTokenSize+protocol.ResumeSecretSize {
+		protocol.ZeroBytes(plaintext)
+		return fmt.Errorf("invalid session token length %d", len(plaintext))
+	}
+	
+	c.sessionToken = plaintext[:protocol.SessionTokenSize]
+	c.resumeSecret = plaintext[protocol.SessionTokenSize:]
+	return nil
+}
+
+// clearSessionToken forgets the session token, which is single-use, and
+// wipes its resumption secret
+func (c *AndroidVPNClient) clearSessionToken() {
+	protocol.ZeroBytes(c.resumeSecret)
+	c.sessionToken = nil
+	c.resumeSecret = nil
+}
+
+// ensureTunInterface creates the TUN interface through the Android VPN
+// service unless it already exists, so that reconnecting keeps it and its routes
+func (c *AndroidVPNClient) ensureTunInterface(ctx context.Context) error {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 	
-	c.encryption = sessionEncryption
-	log.Println("Key exchange completed successfully")
+	if c.tunUp {
+		return nil
+	}
+	
+	if err := c.createTunInterface(); err != nil {
+		// Release anything the service established before failing
+		c.vpnService.CloseTunInterface()
+		return err
+	}
+	c.tunUp = true
+	
+	c.sendQueue = protocol.NewSendQueue(c.config.SendQueueSize, c.sendPolicy)
+	go c.forwardPacketsToServer(c.sendQueue)
+	go c.sendQueuedPackets(c.sendQueue)
 	return nil
 }
 
-// forwardPacketsToServer forwards packets from TUN to server
-func (c *AndroidVPNClient) forwardPacketsToServer() {
-	for c.connected {
+// closeTunInterface closes the TUN interface so the next connect recreates it
+func (c *AndroidVPNClient) closeTunInterface() {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	if c.tunUp {
+		c.vpnService.CloseTunInterface()
+		c.tunUp = false
+	}
+}
+
+// tunCurrent reports whether the TUN interface whose packets go to queue is
+// still up
+func (c *AndroidVPNClient) tunCurrent(queue *protocol.SendQueue) bool {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	return c.tunUp && c.sendQueue == queue
+}
+
+// forwardPacketsToServer queues packets from TUN for the current
+// connection for as long as the interface exists. The queue decouples
+// reading from a connection that may fall behind.
+func (c *AndroidVPNClient) forwardPacketsToServer(queue *protocol.SendQueue) {
+	defer queue.Close()
+	
+	for {
 		// Read packet from Android VPN service
 		packet, err := c.vpnService.ReadPacket()
-		if err != nil {
-			log.Printf("Error reading packet: %v", err)
-			continue
-		}
 		
-		// Encrypt packet
-		encrypted, err := c.encryption.Encrypt(packet)
+		// A reader outliving its interface, closed by StopVPN, leaves any
+		// new one to its own reader
+		if !c.tunCurrent(queue) {
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to encrypt packet: %v", err)
-			continue
+			// The interface is gone; the next connect creates a new one
+			slog.Error("Error reading packet", "error", err)
+			c.closeTunInterface()
+			if connCtx := c.connContext(); connCtx != nil {
+				go c.handleDisconnection(connCtx)
+			}
+			return
 		}
 		
-		// Obfuscate packet
-		obfuscated, err := c.stealth.ObfuscatePacket(encrypted)
-		if err != nil {
-			log.Printf("Failed to obfuscate packet: %v", err)
+		// Drop packets while reconnecting
+		if connCtx := c.connContext(); connCtx == nil || connCtx.Err() != nil {
 			continue
 		}
 		
-		// Add timing jitter
-		c.stealth.AddTimingJitter()
-		
-		// Send to server
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, obfuscated); err != nil {
-			log.Printf("Failed to send packet to server: %v", err)
-			c.handleDisconnection()
+		buf := protocol.GetPacketBuffer()
+		*buf = append((*buf)[:0], packet...)
+		c.sendDropped.Add(uint64(queue.Push(buf)))
+	}
+}
+
+// sendQueuedPackets sends the packets forwardPacketsToServer queued until
+// the queue is closed
+func (c *AndroidVPNClient) sendQueuedPackets(queue *protocol.SendQueue) {
+	for {
+		buf, ok := queue.Pop()
+		if !ok {
 			return
 		}
+		c.sendPacket(*buf)
+		protocol.PutPacketBuffer(buf)
+	}
+}
+
+// sendPacket compresses, encrypts and obfuscates a packet from TUN and
+// sends it over the current connection
+func (c *AndroidVPNClient) sendPacket(packet []byte) {
+	// Drop packets while reconnecting
+	connCtx := c.connContext()
+	if connCtx == nil || connCtx.Err() != nil {
+		return
+	}
+	
+	// Compress packet if negotiated
+	compressBuf := protocol.GetPacketBuffer()
+	compressed := c.compressor.Compress(*compressBuf, packet)
+	
+	// Encrypt packet into a pooled buffer
+	encryptBuf := protocol.GetPacketBuffer()
+	encrypted, err := c.encryption.EncryptTo(*encryptBuf, compressed)
+	protocol.PutPacketBuffer(compressBuf)
+	if err != nil {
+		slog.Error("Failed to encrypt packet", "error", err)
+		protocol.PutPacketBuffer(encryptBuf)
+		return
+	}
+	
+	// Obfuscate packet
+	obfuscateBuf := protocol.GetPacketBuffer()
+	obfuscated, err := c.stealth.ObfuscatePacketTo(*obfuscateBuf, encrypted)
+	protocol.PutPacketBuffer(encryptBuf)
+	if err != nil {
+		slog.Error("Failed to obfuscate packet", "error", err)
+		protocol.PutPacketBuffer(obfuscateBuf)
+		return
+	}
+	
+	// Add timing jitter
+	c.stealth.AddTimingJitter()
+	
+	// Send to server; the frame is copied out before WriteMessage returns
+	err = protocol.WriteMessageContext(connCtx, c.transport, obfuscated)
+	protocol.PutPacketBuffer(obfuscateBuf)
+	if err != nil {
+		slog.Warn("Failed to send packet to server", "error", err)
+		go c.handleDisconnection(connCtx)
+		return
 	}
+	c.sent.Add(len(obfuscated))
 }
 
 // forwardPacketsFromServer forwards packets from server to TUN
-func (c *AndroidVPNClient) forwardPacketsFromServer() {
-	for c.connected {
+func (c *AndroidVPNClient) forwardPacketsFromServer(connCtx context.Context) {
+	for connCtx.Err() == nil {
 		// Read message from server
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.transport.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from server: %v", err)
-			c.handleDisconnection()
+			slog.Warn("Error reading from server", "error", err)
+			c.handleDisconnection(connCtx)
 			return
 		}
+		c.received.Add(len(message))
+		
+		if c.deadPeer != nil {
+			c.deadPeer.MarkAlive()
+		}
 		
 		// Deobfuscate packet
 		deobfuscated, err := c.stealth.DeobfuscatePacket(message)
 		if err != nil {
-			log.Printf("Failed to deobfuscate packet: %v", err)
+			slog.Warn("Failed to deobfuscate packet", "error", err)
+			continue
+		}
+		
+		// Decrypt packet in place
+		decrypted, err := c.encryption.DecryptInPlace(deobfuscated)
+		if err != nil {
+			slog.Warn("Failed to decrypt packet", "error", err)
 			continue
 		}
 		
-		// Decrypt packet
-		decrypted, err := c.encryption.Decrypt(deobfuscated)
+		// Decompress packet
+		decompressed, err := c.compressor.Decompress(decrypted)
 		if err != nil {
-			log.Printf("Failed to decrypt packet: %v", err)
+			slog.Warn("Failed to decompress packet", "error", err)
+			continue
+		}
+		
+		// Health check acks are not IP packets
+		if protocol.IsControlMessage(decompressed) {
+			c.handleControlMessage(decompressed)
 			continue
 		}
 		
 		// Write to Android VPN service
-		if err := c.vpnService.WritePacket(decrypted); err != nil {
-			log.Printf("Failed to write packet: %v", err)
+		if err := c.vpnService.WritePacket(decompressed); err != nil {
+			slog.Warn("Failed to write packet", "error", err)
 			continue
 		}
 	}
 }
 
+// handleControlMessage dispatches a JSON message received inside the tunnel
+func (c *AndroidVPNClient) handleControlMessage(payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid control message from server", "error", err)
+		return
+	}
+	
+	switch msg.Type {
+	case protocol.HealthCheckAckType:
+		c.handleHealthCheckAck(payload)
+	case protocol.TunnelConfigType:
+		c.handleTunnelConfig(payload)
+	case protocol.QuotaExceededType:
+		// The server closes the session next; reconnects fail until the quota is reset
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	case protocol.SessionLimitType:
+		// Reconnects succeed once one of the user's other sessions ends
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	}
+}
+
+// handleTunnelConfig records the addresses, resolvers and routes the server
+// pushed, which replace the local ones. Android only takes them when the TUN
+// interface is established, so it is re-established if they changed.
+func (c *AndroidVPNClient) handleTunnelConfig(payload []byte) {
+	var config protocol.TunnelConfig
+	if err := json.Unmarshal(payload, &config); err != nil {
+		slog.Error("Invalid tunnel config from server", "error", err)
+		return
+	}
+	slog.Info("Server assigned tunnel addresses", "ipv4", config.IPv4, "ipv6", config.IPv6, "routes", config.Routes)
+	
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	c.pushedConfig = &config
+	if !c.tunUp || reflect.DeepEqual(c.tunnelSettings(), c.tunSettings) {
+		return
+	}
+	if err := c.createTunInterface(); err != nil {
+		// The old interface may be gone too, so reconnect and create it
+		// afresh rather than carry on without one
+		slog.Error("Failed to apply tunnel config", "error", err)
+		c.vpnService.CloseTunInterface()
+		c.tunUp = false
+		if connCtx := c.connContext(); connCtx != nil {
+			go c.handleDisconnection(connCtx)
+		}
+	}
+}
+
+// tunnelSettings returns the settings for the TUN interface: those the
+// server pushed, or the local ones until it has pushed any; tunMu must be held
+func (c *AndroidVPNClient) tunnelSettings() protocol.TunnelConfig {
+	return protocol.MergeTunnelConfig(c.pushedConfig, protocol.TunnelConfig{
+		IPv4: c.config.LocalIP,
+		IPv6: c.config.LocalIP6,
+		DNS:  c.config.DNSServers,
+	})
+}
+
+// createTunInterface establishes the TUN interface with the current
+// settings, replacing any existing one; tunMu must be held
+func (c *AndroidVPNClient) createTunInterface() error {
+	settings := c.tunnelSettings()
+	if err := c.applyAppFilter(); err != nil {
+		return err
+	}
+	if err := c.vpnService.CreateTunInterface(settings.IPv4, settings.IPv6, settings.DNS, settings.Routes); err != nil {
+		return fmt.Errorf("failed to create TUN interface: %v", err)
+	}
+	c.tunSettings = settings
+	return nil
+}
+
+// applyAppFilter tells the service which apps the next TUN interface is
+// for
+func (c *AndroidVPNClient) applyAppFilter() error {
+	for _, app := range c.config.AllowedApplications {
+		if err := c.vpnService.AddAllowedApplication(app); err != nil {
+			return fmt.Errorf("failed to tunnel app %s: %v", app, err)
+		}
+	}
+	for _, app := range c.config.DisallowedApplications {
+		if err := c.vpnService.AddDisallowedApplication(app); err != nil {
+			return fmt.Errorf("failed to exclude app %s: %v", app, err)
+		}
+	}
+	return nil
+}
+
+// validateAppFilter checks allowed_applications and
+// disallowed_applications. Android lets a VPN use one list or the other,
+// not both.
+func validateAppFilter(config *ClientConfig) error {
+	if len(config.AllowedApplications) > 0 && len(config.DisallowedApplications) > 0 {
+		return fmt.Errorf("allowed_applications and disallowed_applications cannot both be set")
+	}
+	for _, app := range append(config.AllowedApplications, config.DisallowedApplications...) {
+		if app == "" {
+			return fmt.Errorf("empty package name in allowed_applications or disallowed_applications")
+		}
+	}
+	return nil
+}
+
+// sendControl sends a JSON message to the server through the tunnel
+func (c *AndroidVPNClient) sendControl(msg interface{}) error {
+	connCtx := c.connContext()
+	if connCtx == nil {
+		return fmt.Errorf("not connected")
+	}
+	
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	
+	encrypted, err := c.encryption.Encrypt(c.compressor.Compress(nil, payload))
+	if err != nil {
+		return err
+	}
+	
+	obfuscated, err := c.stealth.ObfuscatePacket(encrypted)
+	if err != nil {
+		return err
+	}
+	
+	if err := protocol.WriteMessageContext(connCtx, c.transport, obfuscated); err != nil {
+		return err
+	}
+	c.sent.Add(len(obfuscated))
+	return nil
+}
+
 // healthCheckRoutine periodically checks connection health
-func (c *AndroidVPNClient) healthCheckRoutine() {
-	ticker := time.NewTicker(time.Duration(c.config.HealthCheckInterval) * time.Second)
+func (c *AndroidVPNClient) healthCheckRoutine(connCtx context.Context) {
+	interval := time.Duration(c.config.HealthCheckInterval) * time.Second
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	
-	for range ticker.C {
-		if !c.connected {
+	for {
+		select {
+		case <-connCtx.Done():
+			return
+		case <-c.healthReset:
+			ticker.Reset(interval)
 			continue
+		case <-ticker.C:
 		}
 		
-		// Send ping to server
-		ping := []byte("ping")
-		encrypted, err := c.encryption.Encrypt(ping)
-		if err != nil {
+		// The network is cut off in Doze mode, so checks would only time
+		// out; the keepalive pings prove the connection alive meanwhile
+		if c.dozing.Load() {
 			continue
 		}
 		
-		obfuscated, err := c.stealth.ObfuscatePacket(encrypted)
-		if err != nil {
-			continue
+		// A check still pending a full interval later has timed out
+		now := time.Now().UnixNano()
+		c.healthMu.Lock()
+		if c.healthCheckPending != 0 {
+			c.missedHealthChecks++
 		}
+		missed := c.missedHealthChecks
+		c.healthCheckPending = now
+		c.healthMu.Unlock()
 		
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, obfuscated); err != nil {
-			log.Println("Health check failed, attempting reconnection...")
-			c.handleDisconnection()
+		if missed >= maxMissedHealthChecks {
+			slog.Warn("Health checks timed out, attempting reconnection", "missed", missed)
+			c.handleDisconnection(connCtx)
+			return
+		}
+		
+		// Send health check to server
+		check := protocol.HealthCheck{Type: protocol.HealthCheckType, Timestamp: now}
+		if err := c.sendControl(check); err != nil {
+			slog.Warn("Health check failed, attempting reconnection")
+			c.handleDisconnection(connCtx)
+			return
 		}
 	}
 }
 
-// handleDisconnection handles connection loss and reconnection
-func (c *AndroidVPNClient) handleDisconnection() {
-	c.connected = false
+// handleHealthCheckAck records the round-trip time and the server's session stats
+func (c *AndroidVPNClient) handleHealthCheckAck(payload []byte) {
+	var ack protocol.HealthCheckAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		slog.Warn("Invalid health check ack", "error", err)
+		return
+	}
 	
-	if c.conn != nil {
-		c.conn.Close()
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	
+	// Ignore acks for checks that already timed out
+	if ack.Echo != c.healthCheckPending {
+		return
+	}
+	
+	rtt := time.Since(time.Unix(0, ack.Echo))
+	c.servers.MarkSuccess(c.serverURL, rtt)
+	c.stealth.ObserveRTT(rtt)
+	c.stats = ack.Stats
+	c.stats.LatencyMs = float64(rtt) / float64(time.Millisecond)
+	c.healthCheckPending = 0
+	c.missedHealthChecks = 0
+}
+
+// pongReceived takes the round-trip time of a keepalive ping. With Doze
+// compatibility, a pong counts as a passed health check, as in Doze mode
+// the keepalive pings are all that gets through.
+func (c *AndroidVPNClient) pongReceived(rtt time.Duration) {
+	c.stealth.ObserveRTT(rtt)
+	if c.config.DozeCompatibility {
+		c.resetHealthCheck()
+	}
+}
+
+// resetHealthCheck forgets unanswered health checks and restarts the
+// interval, so the next check is a full interval away
+func (c *AndroidVPNClient) resetHealthCheck() {
+	c.healthMu.Lock()
+	c.healthCheckPending = 0
+	c.missedHealthChecks = 0
+	c.healthMu.Unlock()
+	
+	select {
+	case c.healthReset <- struct{}{}:
+	default:
+	}
+}
+
+// DozeChanged pauses health checks while the device is in Doze mode
+// (called from Android). Checks sent before it entered Doze mode went
+// unanswered through no fault of the server, so they are forgotten on
+// leaving it and a keepalive tests the connection straight away.
+func (c *AndroidVPNClient) DozeChanged(idle bool) {
+	if c.dozing.Swap(idle) == idle {
+		return
+	}
+	slog.Info("Doze mode changed", "idle", idle)
+	
+	c.resetHealthCheck()
+	if !idle {
+		if err := c.Keepalive(); err != nil {
+			slog.Debug("Keepalive after Doze mode failed", "error", err)
+		}
+	}
+}
+
+// Keepalive sends a WebSocket ping to the server now (called from Android,
+// every DozeKeepaliveSeconds while in Doze mode). Its pong resets the
+// health checks. A connection that has stopped answering is noticed by the
+// dead peer detection as usual.
+func (c *AndroidVPNClient) Keepalive() error {
+	if !c.isConnected() {
+		return fmt.Errorf("not connected")
+	}
+	c.connMu.Lock()
+	deadPeer := c.deadPeer
+	c.connMu.Unlock()
+	
+	if deadPeer == nil {
+		return fmt.Errorf("keepalive pings need the websocket transport")
+	}
+	return deadPeer.Ping()
+}
+
+// handleDisconnection handles loss of the connection identified by connCtx
+// and reconnects. Only the first caller per connection does anything.
+func (c *AndroidVPNClient) handleDisconnection(connCtx context.Context) {
+	c.connMu.Lock()
+	if connCtx.Err() != nil {
+		c.connMu.Unlock()
+		return
+	}
+	c.connCancel()
+	c.connMu.Unlock()
+	
+	if c.deadPeer != nil {
+		c.deadPeer.Stop()
 	}
 	
+	if c.transport != nil {
+		c.transport.Close()
+	}
+	
+	// Disconnect may have closed the connection, and reports that itself
+	if c.stopped() {
+		return
+	}
 	if c.config.AutoConnect {
-		log.Printf("Reconnecting in %d seconds...", c.config.ReconnectDelay)
-		time.Sleep(time.Duration(c.config.ReconnectDelay) * time.Second)
+		c.setState(StateReconnecting)
+		c.reconnect()
+		return
+	}
+	c.setState(StateDisconnected)
+}
+
+// reconnect retries until connected or Disconnect is called. Each attempt
+// walks the whole server list, and the delay between attempts grows so that
+// an outage of every server does not turn into a reconnect storm.
+func (c *AndroidVPNClient) reconnect() {
+	backoff := protocol.NewBackoff(time.Duration(c.config.ReconnectDelay)*time.Second, protocol.MaxReconnectDelay)
+	
+	// Disconnect also interrupts an attempt in progress
+	ctx, cancel := c.doneContext()
+	defer cancel()
+	
+	for {
+		delay := backoff.Next()
+		slog.Info("Reconnecting", "delay", delay)
+		
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 		
-		if err := c.Connect(); err != nil {
-			log.Printf("Reconnection failed: %v", err)
+		if err := c.ConnectContext(ctx); err != nil {
+			slog.Warn("Reconnection failed", "error", err)
+			continue
 		}
+		return
+	}
+}
+
+// doneContext returns a context that is cancelled when Disconnect is called
+func (c *AndroidVPNClient) doneContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.runMu.Lock()
+	done := c.done
+	c.runMu.Unlock()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopped reports whether Disconnect was called since the VPN was started
+func (c *AndroidVPNClient) stopped() bool {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
 }
 
 // Disconnect closes the VPN connection
 func (c *AndroidVPNClient) Disconnect() {
-	c.connected = false
+	c.runMu.Lock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	c.runMu.Unlock()
 	
-	if c.conn != nil {
-		c.conn.Close()
+	c.connMu.Lock()
+	if c.connCancel != nil {
+		c.connCancel()
+	}
+	c.connMu.Unlock()
+	
+	if c.deadPeer != nil {
+		c.deadPeer.Stop()
+	}
+	
+	if c.transport != nil {
+		c.transport.Close()
 	}
 	
 	if c.vpnService != nil {
-		c.vpnService.CloseTunInterface()
+		c.closeTunInterface()
 	}
 	
-	log.Println("Disconnected from VPN server")
+	slog.Info("Disconnected from VPN server")
+	c.setState(StateDisconnected)
 }
 
 // IsConnected returns connection status
 func (c *AndroidVPNClient) IsConnected() bool {
-	return c.connected && c.vpnService.IsConnected()
+	return c.isConnected() && c.vpnService.IsConnected()
 }
 
 // GetStats returns connection statistics
 func (c *AndroidVPNClient) GetStats() string {
+	c.healthMu.Lock()
+	sessionStats := c.stats
+	c.healthMu.Unlock()
+	
 	stats := map[string]interface{}{
-		"connected":  c.connected,
-		"server_url": c.config.ServerURL,
-		"local_ip":   c.config.LocalIP,
+		"connected":      c.isConnected(),
+		"server_url":     c.serverURL,
+		"reachable_servers": c.servers.Reachable(),
+		"local_ip":       c.config.LocalIP,
+		"cipher":         c.cipher,
+		"aes_hardware":   protocol.HasAESHardware(),
+		"latency_ms":     sessionStats.LatencyMs,
+		"bytes_sent":     c.sent.Total(),
+		"bytes_received": c.received.Total(),
+		"send_rate_bps":  c.sent.Rate() * 8,
+		"receive_rate_bps": c.received.Rate() * 8,
+		"send_queue_dropped": c.sendDropped.Load(),
+	}
+	c.tunMu.Lock()
+	if c.sendQueue != nil {
+		stats["send_queue_depth"] = c.sendQueue.Len()
+	}
+	c.tunMu.Unlock()
+	if link, ok := c.linkQuality(); ok {
+		stats["links"] = []map[string]interface{}{{
+			"rtt_ms":     float64(link.RTT) / float64(time.Millisecond),
+			"rtt_var_ms": float64(link.RTTVar) / float64(time.Millisecond),
+			"loss":       link.Loss,
+		}}
+	}
+	
+	if connectedAt := c.connectionStart(); !connectedAt.IsZero() {
+		stats["connected_since"] = connectedAt
+		stats["connected_seconds"] = time.Since(connectedAt).Seconds()
+	}
+	
+	// Let the UI explain why the last attempt failed
+	if err := c.lastError(); err != nil {
+		stats["error"] = err.Error()
+		stats["error_category"] = vpnerr.CategoryOf(err)
 	}
 	
 	statsJSON, _ := json.Marshal(stats)
 	return string(statsJSON)
 }
 
+// linkQuality returns the round-trip time and loss measured on the
+// connection to the server, if there is one
+func (c *AndroidVPNClient) linkQuality() (protocol.LinkQuality, bool) {
+	c.connMu.Lock()
+	deadPeer := c.deadPeer
+	c.connMu.Unlock()
+	
+	if deadPeer == nil {
+		return protocol.LinkQuality{}, false
+	}
+	return deadPeer.Quality(), true
+}
+
 // SetConfig updates client configuration
 func (c *AndroidVPNClient) SetConfig(configJSON string) error {
 	var config ClientConfig
@@ -347,46 +1481,276 @@ func (c *AndroidVPNClient) SetConfig(configJSON string) error {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 	
+	if config.Transport == protocol.TransportWebRTC {
+		if err := webrtcAvailable(); err != nil {
+			return err
+		}
+	}
+	
 	c.config = &config
+	c.servers = newServerList(&config)
 	
 	// Reinitialize encryption with new key
-	encryption, err := protocol.NewMultiLayerEncryption([]byte(config.PreSharedKey))
+	masterKey, err := protocol.MasterKey(config.PreSharedKey, config.PassphraseKDF)
 	if err != nil {
 		return fmt.Errorf("failed to initialize encryption: %v", err)
 	}
+	encryption, err := protocol.NewMultiLayerEncryption(masterKey)
+	if err != nil {
+		return fmt.Errorf("failed to initialize encryption: %v", err)
+	}
+	
+	noiseKey, noisePin, err := loadNoiseKeys(&config)
+	if err != nil {
+		return err
+	}
 	
 	c.encryption = encryption
+	c.pskKey = masterKey
+	c.noiseKey, c.noisePin = noiseKey, noisePin
 	return nil
 }
 
-// StartVPN starts the VPN connection (called from Android)
+// StartVPN starts the VPN connection (called from Android). Calling it
+// while the VPN is started does nothing, so the service may call it on
+// every start command. If the connection fails, the VPN is left stopped
+// and may be started again.
 func (c *AndroidVPNClient) StartVPN() error {
-	return c.Connect()
+	return c.start(false)
 }
 
-// StopVPN stops the VPN connection (called from Android)
+// OnStartCommand starts the VPN when the system starts the service (called
+// from onStartCommand): at boot or when always-on VPN is turned on, and
+// again after the system killed the process, when the service creates a
+// new client with the config it saved. As nobody is waiting on the result,
+// a failed first connection is retried like a lost one when auto_connect is
+// set.
+func (c *AndroidVPNClient) OnStartCommand() error {
+	return c.start(c.config.AutoConnect)
+}
+
+// OnRevoke stops the VPN for good when Android revokes it (called from
+// onRevoke), as when the user turns it off in the system settings or
+// another app's VPN starts. It is not reconnected.
+func (c *AndroidVPNClient) OnRevoke() {
+	slog.Info("VPN revoked by the system")
+	c.StopVPN()
+}
+
+// start connects unless the VPN is already started. With retry, a failed
+// connection hands over to the reconnect loop instead of stopping the VPN.
+func (c *AndroidVPNClient) start(retry bool) error {
+	c.runMu.Lock()
+	if c.running {
+		c.runMu.Unlock()
+		slog.Debug("VPN already started")
+		return nil
+	}
+	// Allow reconnecting again after an earlier StopVPN
+	c.running = true
+	c.done = make(chan struct{})
+	done := c.done
+	c.runMu.Unlock()
+	
+	if c.config.DozeCompatibility {
+		if err := c.vpnService.WatchDoze(c); err != nil {
+			slog.Warn("Failed to watch for Doze mode", "error", err)
+		}
+	}
+	
+	// StopVPN cancels a connection attempt that is still in progress
+	ctx, cancel := c.doneContext()
+	defer cancel()
+	err := c.ConnectContext(ctx)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if retry {
+		c.setState(StateReconnecting)
+		go c.reconnect()
+		return nil
+	}
+	
+	// Stop unless StopVPN and StartVPN were called meanwhile
+	c.runMu.Lock()
+	ours := c.done == done
+	c.runMu.Unlock()
+	if ours {
+		c.StopVPN()
+	}
+	return err
+}
+
+// StopVPN stops the VPN connection (called from Android). Calling it while
+// the VPN is stopped does nothing.
 func (c *AndroidVPNClient) StopVPN() {
+	c.runMu.Lock()
+	running := c.running
+	c.running = false
+	c.runMu.Unlock()
+	if !running {
+		return
+	}
+	
+	if c.config.DozeCompatibility {
+		c.vpnService.WatchDoze(nil)
+		c.dozing.Store(false)
+	}
 	c.Disconnect()
 }
 
 // GetConnectionStatus returns connection status for Android UI
 func (c *AndroidVPNClient) GetConnectionStatus() string {
 	status := map[string]interface{}{
-		"connected":    c.connected,
+		"connected":    c.isConnected(),
 		"server_url":   c.config.ServerURL,
 		"local_ip":     c.config.LocalIP,
 		"fake_domain":  c.config.FakeDomainName,
 		"auto_connect": c.config.AutoConnect,
 	}
 	
+	// Let the UI tell an unreachable server from a rejected handshake
+	if err := c.lastError(); err != nil {
+		status["error"] = err.Error()
+		status["error_category"] = vpnerr.CategoryOf(err)
+	}
+	
 	statusJSON, _ := json.Marshal(status)
 	return string(statusJSON)
 }
 
+// Connection states reported to a StatusListener
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting" // the connection was lost and is being retried
+	StateDisconnected = "disconnected"
+)
+
+// StatusListener receives connection updates, so the app does not have to
+// poll GetConnectionStatus. gomobile binds it as a Java interface. Callbacks
+// are made one at a time, in order, from a goroutine of the client.
+type StatusListener interface {
+	OnStateChanged(state string)
+	// OnError reports why a connection attempt failed
+	OnError(msg string)
+	// OnBytes reports the bytes received and sent on the current connection
+	OnBytes(in, out int64)
+}
+
+// SetStatusListener registers the listener for connection updates, replacing
+// any earlier one; nil stops the updates. The new listener is told the
+// current state straight away.
+func (c *AndroidVPNClient) SetStatusListener(listener StatusListener) {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	
+	c.listener = listener
+	if c.state != "" {
+		state := c.state
+		c.queueStatusLocked(func(l StatusListener) { l.OnStateChanged(state) })
+	}
+}
+
+// setState reports a state change to the listener
+func (c *AndroidVPNClient) setState(state string) {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	c.setStateLocked(state)
+}
+
+// setStateLocked reports a state change; listenerMu must be held
+func (c *AndroidVPNClient) setStateLocked(state string) {
+	if state == c.state {
+		return
+	}
+	c.state = state
+	c.queueStatusLocked(func(l StatusListener) { l.OnStateChanged(state) })
+}
+
+// reportConnecting reports the start of a connection attempt. Attempts made
+// while reconnecting leave the state at reconnecting.
+func (c *AndroidVPNClient) reportConnecting() {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	if c.state != StateReconnecting {
+		c.setStateLocked(StateConnecting)
+	}
+}
+
+// reportConnectFailure reports a failed connection attempt. While
+// reconnecting another attempt follows, so the state stays reconnecting.
+func (c *AndroidVPNClient) reportConnectFailure(err error) {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	
+	msg := err.Error()
+	c.queueStatusLocked(func(l StatusListener) { l.OnError(msg) })
+	if c.state != StateReconnecting {
+		c.setStateLocked(StateDisconnected)
+	}
+}
+
+// reportBytesRoutine reports the connection's traffic every second while it
+// changes, until connCtx is cancelled
+func (c *AndroidVPNClient) reportBytesRoutine(connCtx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	
+	var lastIn, lastOut uint64
+	for {
+		select {
+		case <-connCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		
+		in, out := c.received.Total(), c.sent.Total()
+		if in == lastIn && out == lastOut {
+			continue
+		}
+		lastIn, lastOut = in, out
+		
+		c.listenerMu.Lock()
+		c.queueStatusLocked(func(l StatusListener) { l.OnBytes(int64(in), int64(out)) })
+		c.listenerMu.Unlock()
+	}
+}
+
+// queueStatusLocked queues a callback on the current listener, if any;
+// listenerMu must be held. Queueing never blocks, so a callback may call
+// back into the client.
+func (c *AndroidVPNClient) queueStatusLocked(callback func(StatusListener)) {
+	listener := c.listener
+	if listener == nil {
+		return
+	}
+	c.statusQueue = append(c.statusQueue, func() { callback(listener) })
+	
+	select {
+	case c.statusReady <- struct{}{}:
+	default:
+	}
+}
+
+// deliverStatus runs queued listener callbacks in order for the life of the client
+func (c *AndroidVPNClient) deliverStatus() {
+	for range c.statusReady {
+		c.listenerMu.Lock()
+		queued := c.statusQueue
+		c.statusQueue = nil
+		c.listenerMu.Unlock()
+		
+		for _, callback := range queued {
+			callback()
+		}
+	}
+}
+
 // Export for Android (gomobile)
 func init() {
 	// This will be called when the library is loaded
-	log.Println("StealthVPN Android client library loaded")
+	slog.Info("StealthVPN Android client library loaded")
 }
 
 // Example usage for Android integration:
@@ -394,5 +1758,5 @@ func init() {
 
 func main() {
 	// This is not used in mobile builds
-	log.Println("StealthVPN Android client")
+	slog.Info("StealthVPN Android client")
 } 
\ No newline at end of file
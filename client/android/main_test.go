@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/vpnerr"
+)
+
+// fakeVPNService stands in for the Android VpnService. Its TUN interface
+// has no packets and is readable until closed.
+type fakeVPNService struct {
+	mu         sync.Mutex
+	up         chan struct{} // closed when the interface closes; nil while there is none
+	creates    int
+	closes     int
+	failCreate error // returned by CreateTunInterface while set
+	dozeWatch  DozeHandler
+	refuse     bool                    // Protect fails while set
+	protected  []bool                  // for each Protect call, whether the socket was still unconnected
+	builder    []string                // app filter and create calls, in order
+	created    []protocol.TunnelConfig // the settings of each interface created
+}
+
+func (f *fakeVPNService) CreateTunInterface(ip string, ip6 string, dns []string, routes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failCreate != nil {
+		return f.failCreate
+	}
+	f.creates++
+	f.builder = append(f.builder, "create")
+	f.created = append(f.created, protocol.TunnelConfig{IPv4: ip, IPv6: ip6, DNS: dns, Routes: routes})
+	if f.up == nil {
+		f.up = make(chan struct{})
+	}
+	return nil
+}
+
+func (f *fakeVPNService) AddAllowedApplication(packageName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.builder = append(f.builder, "allow "+packageName)
+	return nil
+}
+
+func (f *fakeVPNService) AddDisallowedApplication(packageName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.builder = append(f.builder, "disallow "+packageName)
+	return nil
+}
+
+func (f *fakeVPNService) WritePacket(data []byte) error { return nil }
+func (f *fakeVPNService) Protect(fd int) bool {
+	unconnected := socketUnconnected(fd)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.protected = append(f.protected, unconnected)
+	return !f.refuse
+}
+
+func (f *fakeVPNService) ReadPacket() ([]byte, error) {
+	f.mu.Lock()
+	up := f.up
+	f.mu.Unlock()
+	if up == nil {
+		return nil, net.ErrClosed
+	}
+	<-up
+	return nil, net.ErrClosed
+}
+
+func (f *fakeVPNService) CloseTunInterface() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closes++
+	if f.up != nil {
+		close(f.up)
+		f.up = nil
+	}
+	return nil
+}
+
+func (f *fakeVPNService) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.up != nil
+}
+
+func (f *fakeVPNService) WatchDoze(handler DozeHandler) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dozeWatch = handler
+	return nil
+}
+
+// counts returns how many times the interface was created and closed
+func (f *fakeVPNService) counts() (creates, closes int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.creates, f.closes
+}
+
+// setFailCreate makes CreateTunInterface fail with err, or succeed if nil
+func (f *fakeVPNService) setFailCreate(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failCreate = err
+}
+
+// createdWith returns the settings of each interface created so far
+func (f *fakeVPNService) createdWith() []protocol.TunnelConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.created)
+}
+
+// builderCalls returns the app filter and create calls made so far
+func (f *fakeVPNService) builderCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.builder...)
+}
+
+// protectCalls returns, for each Protect call, whether the socket was
+// protected before it connected
+func (f *fakeVPNService) protectCalls() []bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]bool(nil), f.protected...)
+}
+
+// setRefuseProtect makes Protect fail while refuse is set
+func (f *fakeVPNService) setRefuseProtect(refuse bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refuse = refuse
+}
+
+// testClientConfig is a config that never reaches a server
+const testClientConfig = `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`
+
+// newTestClient returns a client on a fake VPN service
+func newTestClient(t *testing.T, configJSON string) (*AndroidVPNClient, *fakeVPNService) {
+	t.Helper()
+	service := &fakeVPNService{}
+	client, err := NewAndroidVPNClient(configJSON, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.closeTunInterface)
+	return client, service
+}
+
+func TestTunInterfaceKeptAcrossReconnects(t *testing.T) {
+	client, service := newTestClient(t, testClientConfig)
+
+	for i := 0; i < 2; i++ {
+		if err := client.ensureTunInterface(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if creates, _ := service.counts(); creates != 1 {
+		t.Fatalf("interface created %d times, want once", creates)
+	}
+}
+
+func TestTunInterfaceReleasedWhenCreateFails(t *testing.T) {
+	client, service := newTestClient(t, testClientConfig)
+	service.setFailCreate(errors.New("establish returned null"))
+
+	if err := client.ensureTunInterface(t.Context()); err == nil {
+		t.Fatal("connected without an interface")
+	}
+	if _, closes := service.counts(); closes != 1 || client.tunCurrent(client.sendQueue) {
+		t.Fatal("failed interface was kept")
+	}
+
+	// The reconnect tries again
+	service.setFailCreate(nil)
+	if err := client.ensureTunInterface(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if creates, _ := service.counts(); creates != 1 || !client.tunCurrent(client.sendQueue) {
+		t.Fatal("reconnect did not create the interface")
+	}
+}
+
+func TestTunnelConfigThatCannotBeAppliedDropsInterface(t *testing.T) {
+	client, service := newTestClient(t, testClientConfig)
+	if err := client.ensureTunInterface(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	service.setFailCreate(errors.New("establish returned null"))
+	client.handleTunnelConfig([]byte(`{"ipv4": "10.8.0.7", "routes": ["0.0.0.0/0"]}`))
+	if client.tunCurrent(client.sendQueue) {
+		t.Fatal("interface kept after the new settings could not be applied")
+	}
+
+	// The next connect creates it with the pushed settings
+	service.setFailCreate(nil)
+	if err := client.ensureTunInterface(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	client.tunMu.Lock()
+	ipv4 := client.tunSettings.IPv4
+	client.tunMu.Unlock()
+	if ipv4 != "10.8.0.7" {
+		t.Fatalf("interface created with %q, want the pushed address", ipv4)
+	}
+}
+
+func TestAppFilterAppliedToEachInterface(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"no filter", ``, []string{"create"}},
+		{"allowed", `, "allowed_applications": ["org.mozilla.firefox", "com.android.chrome"]`,
+			[]string{"allow org.mozilla.firefox", "allow com.android.chrome", "create"}},
+		{"disallowed", `, "disallowed_applications": ["com.example.bank"]`,
+			[]string{"disallow com.example.bank", "create"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, service := newTestClient(t, `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef"`+test.filter+`}`)
+			if err := client.ensureTunInterface(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+
+			// An interface replaced for pushed settings is a new builder,
+			// so the lists are given again
+			client.handleTunnelConfig([]byte(`{"ipv4": "10.8.0.7", "routes": ["0.0.0.0/0"]}`))
+			want := append(slices.Clone(test.want), test.want...)
+			if got := service.builderCalls(); !slices.Equal(got, want) {
+				t.Errorf("calls = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAppFilterValidated(t *testing.T) {
+	for _, filter := range []string{
+		`"allowed_applications": ["org.mozilla.firefox"], "disallowed_applications": ["com.example.bank"]`,
+		`"allowed_applications": [""]`,
+	} {
+		config := `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef", ` + filter + `}`
+		if _, err := NewAndroidVPNClient(config, &fakeVPNService{}); err == nil {
+			t.Errorf("NewAndroidVPNClient() accepted %s", filter)
+		}
+	}
+}
+
+// acceptOne reports on accepted whether a connection reached listener
+// within a second
+func acceptOne(listener net.Listener) <-chan bool {
+	accepted := make(chan bool, 1)
+	go func() {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err == nil
+	}()
+	return accepted
+}
+
+func TestSocketProtectedBeforeDial(t *testing.T) {
+	for _, transport := range []string{"websocket", "udp"} {
+		t.Run(transport, func(t *testing.T) {
+			var config, server string
+			if transport == "udp" {
+				listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				server = listener.LocalAddr().String()
+				config = `{"transport": "udp", "udp_server_addr": "` + server + `", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`
+			} else {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				acceptOne(listener)
+				server = "wss://" + listener.Addr().String() + "/ws"
+				config = `{"server_url": "` + server + `", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`
+			}
+			client, service := newTestClient(t, config)
+
+			// The TLS handshake fails against the bare listener; only the
+			// socket matters here
+			err := client.connectToServer(t.Context(), server)
+			if err == nil {
+				client.transport.Close()
+			}
+			if protected := service.protectCalls(); len(protected) != 1 || !protected[0] {
+				t.Errorf("Protect calls = %v, want one before the socket connected", protected)
+			}
+		})
+	}
+}
+
+func TestRefusedProtectAbortsConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := acceptOne(listener)
+	server := "wss://" + listener.Addr().String() + "/ws"
+	client, service := newTestClient(t, `{"server_url": "`+server+`", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`)
+	service.setRefuseProtect(true)
+
+	// A socket that cannot bypass the tunnel would loop into it
+	err = client.connectToServer(t.Context(), server)
+	if !errors.Is(err, vpnerr.ErrDial) {
+		t.Fatalf("connectToServer() error = %v, want a dial failure", err)
+	}
+	if <-accepted {
+		t.Error("unprotected socket connected to the server")
+	}
+	if protected := service.protectCalls(); len(protected) != 1 {
+		t.Errorf("Protect called %d times, want once", len(protected))
+	}
+}
+
+func TestPushedTunnelConfigApplied(t *testing.T) {
+	client, service := newTestClient(t, `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef", "local_ip": "10.8.0.2", "dns_servers": ["1.1.1.1"]}`)
+	if err := client.ensureTunInterface(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	// What the server sends once the session is registered
+	pushed := protocol.TunnelConfig{
+		Type:   protocol.TunnelConfigType,
+		IPv4:   "10.8.0.7",
+		IPv6:   "fd00:8::7",
+		DNS:    []string{"9.9.9.9", "2620:fe::fe"},
+		Routes: []string{"10.20.0.0/16", "fd00:20::/64"},
+	}
+	payload, err := json.Marshal(pushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.handleControlMessage(payload)
+
+	created := service.createdWith()
+	if len(created) != 2 {
+		t.Fatalf("interface created %d times, want again for the pushed settings", len(created))
+	}
+	if want := (protocol.TunnelConfig{IPv4: "10.8.0.2", DNS: []string{"1.1.1.1"}, Routes: protocol.DefaultTunnelRoutes}); !reflect.DeepEqual(created[0], want) {
+		t.Errorf("first interface = %+v, want the local settings %+v", created[0], want)
+	}
+	want := pushed
+	want.Type = ""
+	if !reflect.DeepEqual(created[1], want) {
+		t.Errorf("interface = %+v, want the pushed settings %+v", created[1], want)
+	}
+
+	// The same settings pushed again leave the interface alone
+	client.handleControlMessage(payload)
+	if created := service.createdWith(); len(created) != 2 {
+		t.Errorf("interface created %d times, want no more for unchanged settings", len(created))
+	}
+}
+
+func TestConnectFailsOverBetweenServers(t *testing.T) {
+	client, _ := newTestClient(t, `{"server_url": "wss://127.0.0.1:1/ws", "server_urls": ["wss://127.0.0.1:2/ws"], "pre_shared_key": "0123456789abcdef0123456789abcdef"}`)
+
+	err := client.connectToAnyServer(t.Context())
+	if !errors.Is(err, vpnerr.ErrDial) {
+		t.Fatalf("connectToAnyServer() error = %v, want a dial failure", err)
+	}
+	// Both were tried and failed, so the first to fail is retried first
+	want := []string{"wss://127.0.0.1:1/ws", "wss://127.0.0.1:2/ws"}
+	if got := client.servers.Candidates(); !slices.Equal(got, want) {
+		t.Errorf("candidates after both failed = %v, want %v", got, want)
+	}
+	if reachable := client.servers.Reachable(); len(reachable) != 0 {
+		t.Errorf("unreachable servers reported reachable: %v", reachable)
+	}
+}
+
+func TestConnectCategorizesFailures(t *testing.T) {
+	client, service := newTestClient(t, testClientConfig)
+	service.setFailCreate(errors.New("establish returned null"))
+
+	err := client.ConnectContext(t.Context())
+	if !errors.Is(err, vpnerr.ErrTunSetup) {
+		t.Fatalf("ConnectContext() error = %v, want a TUN setup failure", err)
+	}
+	if !errors.Is(client.lastError(), vpnerr.ErrTunSetup) {
+		t.Errorf("last error = %v, want the TUN setup failure", client.lastError())
+	}
+
+	// With the interface up, the unreachable server is the failure
+	service.setFailCreate(nil)
+	if err := client.ConnectContext(t.Context()); !errors.Is(err, vpnerr.ErrDial) {
+		t.Errorf("ConnectContext() error = %v, want a dial failure", err)
+	}
+}
+
+func TestConnectContextCancelledDuringHandshake(t *testing.T) {
+	// A server that takes the hello and never answers
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, _ := newTestClient(t, `{"transport": "udp", "udp_server_addr": "`+server.LocalAddr().String()+`", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := client.ConnectContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ConnectContext() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled connect returned after %v", elapsed)
+	}
+}
+
+// fakeServer is a WebSocket server that completes the key exchange, without
+// checking the client's key, and then holds the connection until the test
+// ends. With refuse set it closes every connection instead.
+func fakeServer(t *testing.T, refuse bool) string {
+	t.Helper()
+	// The client sends the Origin of the site it poses as
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if refuse {
+			return
+		}
+
+		kx, err := protocol.NewKeyExchange()
+		if err != nil {
+			return
+		}
+		hello, _ := json.Marshal(protocol.KeyExchangeMessage{
+			Type:      protocol.KeyExchangeType,
+			Version:   protocol.ProtocolVersion,
+			PublicKey: kx.GetPublicKey(),
+		})
+		if err := conn.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "wss://" + server.Listener.Addr().String() + "/ws"
+}
+
+// recordingListener records status updates as "state <state>" and
+// "error", sending each on events
+type recordingListener struct {
+	events chan string
+}
+
+func (l *recordingListener) OnStateChanged(state string) { l.events <- "state " + state }
+func (l *recordingListener) OnError(msg string)          { l.events <- "error" }
+func (l *recordingListener) OnBytes(in, out int64)       {}
+
+// expectEvents fails unless the listener reports want next, in order
+func (l *recordingListener) expectEvents(t *testing.T, want ...string) {
+	t.Helper()
+	var got []string
+	for range want {
+		select {
+		case event := <-l.events:
+			got = append(got, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("status updates = %q, want %q", got, want)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("status updates = %q, want %q", got, want)
+	}
+}
+
+func TestStatusListenerOrder(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		refuse bool
+		want   []string
+	}{
+		{"connected", false, []string{"state connecting", "state connected"}},
+		{"handshake fails", true, []string{"state connecting", "error", "state disconnected"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestClient(t, `{"server_url": "`+fakeServer(t, test.refuse)+`", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`)
+			listener := &recordingListener{events: make(chan string, 10)}
+			client.SetStatusListener(listener)
+
+			err := client.StartVPN()
+			if test.refuse != (err != nil) {
+				t.Fatalf("StartVPN() error = %v", err)
+			}
+			listener.expectEvents(t, test.want...)
+
+			if !test.refuse {
+				client.StopVPN()
+				listener.expectEvents(t, "state disconnected")
+			}
+			select {
+			case event := <-listener.events:
+				t.Errorf("unexpected status update %q", event)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestStatusListenerToldCurrentState(t *testing.T) {
+	client, _ := newTestClient(t, testClientConfig)
+	if err := client.StartVPN(); err == nil {
+		t.Fatal("connected to an unreachable server")
+	}
+
+	// A listener registered late learns the state without waiting for a change
+	listener := &recordingListener{events: make(chan string, 10)}
+	client.SetStatusListener(listener)
+	listener.expectEvents(t, "state disconnected")
+}
+
+// dozeWatcher returns the handler the service was last told to watch Doze
+// mode with
+func (f *fakeVPNService) dozeWatcher() DozeHandler {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dozeWatch
+}
+
+// healthState returns the unanswered health check and how many were missed
+func healthState(c *AndroidVPNClient) (pending int64, missed int) {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	return c.healthCheckPending, c.missedHealthChecks
+}
+
+// dozeTestClient returns a client with Doze compatibility connected to a
+// fake server, sending health checks every second
+func dozeTestClient(t *testing.T) (*AndroidVPNClient, *fakeVPNService) {
+	t.Helper()
+	client, service := newTestClient(t, `{"server_url": "`+fakeServer(t, false)+`", "pre_shared_key": "0123456789abcdef0123456789abcdef", "doze_compatibility": true, "health_check_interval": 1}`)
+	if err := client.StartVPN(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.StopVPN)
+	return client, service
+}
+
+func TestDozeWatchedWhileStarted(t *testing.T) {
+	client, service := dozeTestClient(t)
+	if service.dozeWatcher() != client {
+		t.Fatal("Doze mode not watched while the VPN runs")
+	}
+	client.DozeChanged(true)
+
+	client.StopVPN()
+	if service.dozeWatcher() != nil {
+		t.Error("Doze mode still watched after the VPN stopped")
+	}
+	if client.dozing.Load() {
+		t.Error("stopped VPN still thinks the device is dozing")
+	}
+
+	// Without doze_compatibility the service is not asked
+	other, otherService := newTestClient(t, `{"server_url": "`+fakeServer(t, false)+`", "pre_shared_key": "0123456789abcdef0123456789abcdef"}`)
+	if err := other.StartVPN(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.StopVPN()
+	if otherService.dozeWatcher() != nil {
+		t.Error("Doze mode watched without doze_compatibility")
+	}
+}
+
+func TestDozePausesHealthChecks(t *testing.T) {
+	client, _ := dozeTestClient(t)
+
+	// The fake server never answers health checks, so outside Doze mode
+	// one is soon pending
+	deadline := time.Now().Add(3 * time.Second)
+	for pending, _ := healthState(client); pending == 0; pending, _ = healthState(client) {
+		if time.Now().After(deadline) {
+			t.Fatal("no health check sent")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Entering Doze mode forgets it, and no more are sent
+	client.DozeChanged(true)
+	time.Sleep(1500 * time.Millisecond)
+	if pending, missed := healthState(client); pending != 0 || missed != 0 {
+		t.Fatalf("in Doze mode pending = %d, missed = %d; want checks paused", pending, missed)
+	}
+	if !client.isConnected() {
+		t.Fatal("connection dropped in Doze mode")
+	}
+}
+
+func TestDozeKeepalivePongResetsHealthChecks(t *testing.T) {
+	client, _ := dozeTestClient(t)
+	client.DozeChanged(true)
+
+	// Checks missed before the device went idle are forgiven once a
+	// keepalive ping is answered
+	client.healthMu.Lock()
+	client.healthCheckPending = time.Now().UnixNano()
+	client.missedHealthChecks = maxMissedHealthChecks - 1
+	client.healthMu.Unlock()
+	if err := client.Keepalive(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for _, missed := healthState(client); missed != 0; _, missed = healthState(client) {
+		if time.Now().After(deadline) {
+			t.Fatal("pong did not reset the health checks")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.StopVPN()
+	if err := client.Keepalive(); err == nil {
+		t.Error("keepalive sent while disconnected")
+	}
+}
+
+// runState returns whether the VPN is started and the state last reported
+func runState(c *AndroidVPNClient) (running bool, state string) {
+	c.runMu.Lock()
+	running = c.running
+	c.runMu.Unlock()
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	return running, c.state
+}
+
+func TestStartVPNFailureLeavesVPNStopped(t *testing.T) {
+	client, _ := newTestClient(t, testClientConfig)
+
+	// Each start after a failed one tries to connect again
+	for i := 0; i < 2; i++ {
+		if err := client.StartVPN(); !errors.Is(err, vpnerr.ErrDial) {
+			t.Fatalf("StartVPN() error = %v, want a dial failure", err)
+		}
+		if running, state := runState(client); running || state != StateDisconnected {
+			t.Fatalf("after a failed start running = %v, state %q, want stopped", running, state)
+		}
+	}
+}
+
+func TestOnStartCommandRetriesWithAutoConnect(t *testing.T) {
+	client, _ := newTestClient(t, `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef", "auto_connect": true}`)
+
+	// Nobody waits on a start by the system, so failing is left to the
+	// reconnect loop
+	if err := client.OnStartCommand(); err != nil {
+		t.Fatalf("OnStartCommand() error = %v, want the failure retried", err)
+	}
+	if running, state := runState(client); !running || state != StateReconnecting {
+		t.Fatalf("after a failed start running = %v, state %q, want reconnecting", running, state)
+	}
+	if err := client.OnStartCommand(); err != nil {
+		t.Errorf("OnStartCommand() while started = %v", err)
+	}
+
+	client.OnRevoke()
+	if running, state := runState(client); running || state != StateDisconnected || !client.stopped() {
+		t.Errorf("after revoke running = %v, state %q, want stopped", running, state)
+	}
+	client.StopVPN()
+}
+
+func TestOnStartCommandWithoutAutoConnect(t *testing.T) {
+	client, _ := newTestClient(t, testClientConfig)
+	if err := client.OnStartCommand(); !errors.Is(err, vpnerr.ErrDial) {
+		t.Fatalf("OnStartCommand() error = %v, want the dial failure without auto_connect", err)
+	}
+	if running, _ := runState(client); running {
+		t.Error("VPN left started after the failure")
+	}
+}
+
+func TestWebRTCRefusedWithoutBuildTag(t *testing.T) {
+	errNoWebRTC := webrtcAvailable()
+	if errNoWebRTC == nil {
+		t.Skip("built with the webrtc tag")
+	}
+	config := `{"server_url": "wss://127.0.0.1:1/ws", "pre_shared_key": "0123456789abcdef0123456789abcdef", "transport": "webrtc"}`
+	if _, err := NewAndroidVPNClient(config, &fakeVPNService{}); !errors.Is(err, errNoWebRTC) {
+		t.Errorf("NewAndroidVPNClient() error = %v, want %v", err, errNoWebRTC)
+	}
+	client, _ := newTestClient(t, testClientConfig)
+	if err := client.SetConfig(config); !errors.Is(err, errNoWebRTC) {
+		t.Errorf("SetConfig() error = %v, want %v", err, errNoWebRTC)
+	}
+}
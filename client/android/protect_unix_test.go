@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// socketUnconnected reports whether the socket fd has no peer yet
+func socketUnconnected(fd int) bool {
+	_, err := syscall.Getpeername(fd)
+	return errors.Is(err, syscall.ENOTCONN)
+}
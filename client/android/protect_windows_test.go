@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaENOTCONN is WSAENOTCONN, which the syscall package does not name
+const wsaENOTCONN = syscall.Errno(10057)
+
+// socketUnconnected reports whether the socket fd has no peer yet
+func socketUnconnected(fd int) bool {
+	_, err := syscall.Getpeername(syscall.Handle(fd))
+	return errors.Is(err, wsaENOTCONN)
+}
@@ -0,0 +1,46 @@
+//go:build webrtc
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/transport/webrtc"
+	"stealthvpn/pkg/vpnerr"
+)
+
+// The webrtc transport is only built with the webrtc tag. pion links
+// github.com/wlynxg/anet, which reaches into the net package's internals
+// and only links with -ldflags=-checklinkname=0.
+
+// webrtcAvailable reports that this build can use the webrtc transport
+func webrtcAvailable() error {
+	return nil
+}
+
+// switchToWebRTC answers the server's WebRTC offer on the WebSocket
+// connection and moves to the data channel, closing the WebSocket
+func (c *AndroidVPNClient) switchToWebRTC(ctx context.Context, conn *websocket.Conn, server string) error {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+
+	transport, err := webrtc.Dial(ctx, protocol.NewWebSocketTransport(conn), c.protectSocket)
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("WebRTC setup failed: %v", err))
+	}
+
+	c.conn = nil
+	c.transport = transport
+	slog.Info("Connected to server over WebRTC", "server", server)
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !webrtc
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"stealthvpn/pkg/vpnerr"
+)
+
+// errNoWebRTC is returned by builds without the webrtc tag, see webrtc.go
+var errNoWebRTC = errors.New(`transport "webrtc" not compiled in; build with -tags webrtc -ldflags=-checklinkname=0`)
+
+// webrtcAvailable fails, as this build cannot use the webrtc transport
+func webrtcAvailable() error {
+	return errNoWebRTC
+}
+
+// switchToWebRTC fails; configs asking for WebRTC are refused before a
+// connection is made
+func (c *AndroidVPNClient) switchToWebRTC(ctx context.Context, conn *websocket.Conn, server string) error {
+	conn.Close()
+	return vpnerr.Wrap(vpnerr.CategoryDial, errNoWebRTC)
+}
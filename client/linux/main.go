@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,7 +14,9 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/songgao/water"
+	"stealthvpn/pkg/logging"
 	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/routing"
 )
 
 type Client struct {
@@ -22,6 +24,9 @@ type Client struct {
 	presharedKey string
 	tunInterface *water.Interface
 	wsConn       *websocket.Conn
+
+	bypassCgroups []string // net_cls cgroups whose processes bypass the tunnel
+	router        *routing.PolicyRouter
 }
 
 func NewClient(serverURL, presharedKey string) *Client {
@@ -39,6 +44,9 @@ func (c *Client) configureTunInterface() error {
 		{"ip", "link", "set", name, "up"},
 		{"ip", "route", "add", "0.0.0.0/1", "dev", name},
 		{"ip", "route", "add", "128.0.0.0/1", "dev", name},
+		{"ip", "-6", "addr", "add", "fd00::2/64", "dev", name},
+		{"ip", "-6", "route", "add", "::/1", "dev", name},
+		{"ip", "-6", "route", "add", "8000::/1", "dev", name},
 	}
 
 	for _, cmd := range commands {
@@ -66,7 +74,19 @@ func (c *Client) Start() error {
 		return err
 	}
 
-	log.Printf("Created TUN interface: %s", iface.Name())
+	slog.Info("Created TUN interface", "name", iface.Name())
+
+	if len(c.bypassCgroups) > 0 {
+		router, err := routing.NewPolicyRouter(iface.Name(), routing.Config{BypassCgroups: c.bypassCgroups})
+		if err != nil {
+			return err
+		}
+		if err := router.Apply(); err != nil {
+			return fmt.Errorf("failed to set up split tunneling: %v", err)
+		}
+		c.router = router
+		slog.Info("Processes in cgroups bypass the tunnel", "cgroups", c.bypassCgroups)
+	}
 
 	u := url.URL{Scheme: "ws", Host: c.serverURL, Path: "/vpn"}
 	headers := http.Header{
@@ -90,7 +110,7 @@ func (c *Client) tunToWs() {
 	for {
 		n, err := c.tunInterface.Read(packet)
 		if err != nil {
-			log.Printf("Error reading from TUN: %v", err)
+			slog.Error("Error reading from TUN", "error", err)
 			continue
 		}
 
@@ -101,12 +121,12 @@ func (c *Client) tunToWs() {
 
 		data, err := json.Marshal(msg)
 		if err != nil {
-			log.Printf("Error marshaling packet: %v", err)
+			slog.Error("Error marshaling packet", "error", err)
 			continue
 		}
 
 		if err := c.wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Error writing to websocket: %v", err)
+			slog.Warn("Error writing to websocket", "error", err)
 			return
 		}
 	}
@@ -116,13 +136,13 @@ func (c *Client) wsToTun() {
 	for {
 		_, data, err := c.wsConn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from websocket: %v", err)
+			slog.Warn("Error reading from websocket", "error", err)
 			return
 		}
 
 		var msg protocol.Message
 		if err := json.Unmarshal(data, &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+			slog.Warn("Error unmarshaling message", "error", err)
 			continue
 		}
 
@@ -131,13 +151,18 @@ func (c *Client) wsToTun() {
 		}
 
 		if _, err := c.tunInterface.Write(msg.Data); err != nil {
-			log.Printf("Error writing to TUN: %v", err)
+			slog.Warn("Error writing to TUN", "error", err)
 			continue
 		}
 	}
 }
 
 func (c *Client) Stop() {
+	if c.router != nil {
+		if err := c.router.Close(); err != nil {
+			slog.Error("Error removing split tunneling rules", "error", err)
+		}
+	}
 	if c.wsConn != nil {
 		c.wsConn.Close()
 	}
@@ -148,29 +173,49 @@ func (c *Client) Stop() {
 
 func main() {
 	serverURL := flag.String("server", "", "VPN server URL (e.g. example.com:8080)")
-	presharedKey := flag.String("psk", "", "Pre-shared key")
+	presharedKey := flag.String("psk", "", "Pre-shared key (deprecated: visible to other users; use -psk-file or STEALTHVPN_PSK)")
+	pskFile := flag.String("psk-file", "", "File containing the pre-shared key")
+	var bypassCgroups []string
+	flag.Func("bypass-cgroup", "net_cls cgroup whose processes bypass the tunnel (repeatable)", func(name string) error {
+		bypassCgroups = append(bypassCgroups, name)
+		return nil
+	})
+	logLevel := flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log as text or json")
 	flag.Parse()
 
-	if *serverURL == "" || *presharedKey == "" {
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		logging.Fatal("Invalid logging flags", "error", err)
+	}
+	if *serverURL == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *presharedKey != "" {
+		slog.Warn("-psk exposes the key in the process list; use -psk-file or " + protocol.PSKEnvVar + " instead")
+	}
+
+	psk, err := protocol.ResolvePreSharedKey(*presharedKey, *pskFile)
+	if err != nil {
+		logging.Fatal("Invalid pre-shared key", "error", err)
+	}
 
-	client := NewClient(*serverURL, *presharedKey)
+	client := NewClient(*serverURL, psk)
+	client.bypassCgroups = bypassCgroups
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
-		log.Println("Shutting down...")
+		slog.Info("Shutting down")
 		client.Stop()
 		os.Exit(0)
 	}()
 
-	log.Printf("Connecting to %s...", *serverURL)
+	slog.Info("Connecting", "server", *serverURL)
 	if err := client.Start(); err != nil {
-		log.Fatalf("Error starting client: %v", err)
+		logging.Fatal("Error starting client", "error", err)
 	}
 
 	select {}
@@ -0,0 +1,581 @@
+// Package extension runs the StealthVPN tunnel inside a macOS Network
+// Extension, for builds distributed through the App Store. The system
+// creates the utun interface for a packet tunnel provider, so unlike the
+// command-line client it needs neither root nor a TUN driver.
+//
+// A NEPacketTunnelProvider subclass, written against the gomobile binding
+// (gomobile bind -target=macos), calls StartTunnel from startTunnel, applies
+// TunnelSettings with setTunnelNetworkSettings, and then moves packets
+// between its packetFlow and ReadPacket and WritePacket until stopTunnel
+// calls StopTunnel.
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// handshakeTimeout bounds connecting, the key exchange and waiting for
+	// the addresses the server assigns
+	handshakeTimeout = 30 * time.Second
+	// receiveQueueSize is how many packets from the server may wait for
+	// ReadPacket; more are dropped
+	receiveQueueSize = 256
+)
+
+// errNotRunning is returned when no tunnel is running
+var errNotRunning = errors.New("tunnel is not running")
+
+// Config is the JSON configuration StartTunnel takes, usually kept in the
+// providerConfiguration of the NETunnelProviderProtocol. Its keys match
+// those of the other clients.
+type Config struct {
+	ServerURL           string                        `json:"server_url"`
+	PreSharedKey        string                        `json:"pre_shared_key"`
+	PreSharedKeyID      string                        `json:"pre_shared_key_id"` // tells the server which key we hold during rotation
+	PassphraseKDF       *protocol.PassphraseKDF       `json:"passphrase_kdf"`    // treat the pre-shared key as a passphrase
+	FakeDomainName      string                        `json:"fake_domain_name"`
+	DNSServers          []string                      `json:"dns_servers"`
+	LocalIP             string                        `json:"local_ip"`
+	LocalIP6            string                        `json:"local_ip6"`
+	Compression         protocol.CompressionAlgorithm `json:"compression"`
+	SingleCipher        bool                          `json:"single_cipher"` // encrypt with just the cipher fastest on this CPU, if the server allows
+	Username            string                        `json:"username"`      // for servers that require a login
+	Password            string                        `json:"password"`
+	OTP                 string                        `json:"otp"`
+	SendQueueSize       int                           `json:"send_queue_size"`       // packets from WritePacket that may wait for the connection. Default 256
+	ParallelThreshold   int                           `json:"parallel_threshold"`    // payloads of at least this many bytes are encrypted in chunks on several cores. Default 0, never
+	SendQueuePolicy     string                        `json:"send_queue_policy"`     // what to do when the queue is full: drop-oldest (default), drop-newest or block
+	TCPNoDelay          *bool                         `json:"tcp_nodelay"`           // send small writes to the server at once; default true
+	SocketSendBuffer    int                           `json:"socket_send_buffer"`    // SO_SNDBUF of the connection in bytes; system default if 0
+	SocketReceiveBuffer int                           `json:"socket_receive_buffer"` // SO_RCVBUF of the connection in bytes; system default if 0
+}
+
+// socketOptions returns the options for the connection to the server
+func (c *Config) socketOptions() protocol.SocketOptions {
+	return protocol.SocketOptions{
+		NoDelay:     c.TCPNoDelay,
+		ReadBuffer:  c.SocketReceiveBuffer,
+		WriteBuffer: c.SocketSendBuffer,
+	}
+}
+
+// tunnel is a connection to the server carrying the extension's packets
+type tunnel struct {
+	config     *Config
+	stealth    *protocol.StealthProtocol
+	transport  protocol.Transport
+	encryption *protocol.MultiLayerEncryption
+	compressor *protocol.Compressor
+	pushed     *protocol.TunnelConfig // set once by the server, before configured is closed
+	configured chan struct{}
+	configOnce sync.Once
+	sendQueue  *protocol.SendQueue
+	received   chan []byte
+	ctx        context.Context // cancelled when the tunnel stops
+	cancel     context.CancelFunc
+
+	mu  sync.Mutex
+	err error // why the tunnel stopped, nil while it runs or if stopped on purpose
+}
+
+var (
+	mu      sync.Mutex
+	current *tunnel
+)
+
+// StartTunnel connects to the server with the JSON config and starts
+// carrying packets. It returns once the server has assigned the tunnel's
+// addresses, which TunnelSettings then reports.
+func StartTunnel(config string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil {
+		return errors.New("tunnel is already running")
+	}
+
+	t, err := newTunnel(config)
+	if err != nil {
+		return err
+	}
+	if err := t.start(); err != nil {
+		t.stop(nil)
+		return err
+	}
+	current = t
+	return nil
+}
+
+// StopTunnel disconnects from the server. ReadPacket returns nil from then
+// on.
+func StopTunnel() error {
+	mu.Lock()
+	t := current
+	current = nil
+	mu.Unlock()
+	if t == nil {
+		return errNotRunning
+	}
+	t.stop(nil)
+	return nil
+}
+
+// ReadPacket waits for the next IP packet from the server, for the
+// provider to write to its packetFlow. It returns nil once the tunnel has
+// stopped; TunnelError then tells why.
+func ReadPacket() []byte {
+	t := running()
+	if t == nil {
+		return nil
+	}
+	select {
+	case packet := <-t.received:
+		return packet
+	case <-t.ctx.Done():
+		return nil
+	}
+}
+
+// WritePacket sends an IP packet the provider read from its packetFlow
+func WritePacket(packet []byte) error {
+	t := running()
+	if t == nil {
+		return errNotRunning
+	}
+	if t.ctx.Err() != nil {
+		if err := t.stopErr(); err != nil {
+			return err
+		}
+		return errNotRunning
+	}
+	if len(packet) > protocol.PacketBufferSize {
+		return fmt.Errorf("packet of %d bytes is too large", len(packet))
+	}
+
+	// gomobile may reuse the memory behind packet once we return
+	buf := protocol.GetPacketBuffer()
+	*buf = append((*buf)[:0], packet...)
+	t.sendQueue.Push(buf)
+	return nil
+}
+
+// TunnelSettings returns the addresses, DNS servers and routes to apply
+// with setTunnelNetworkSettings, as the JSON of a protocol.TunnelConfig.
+// The server's assignments take precedence over the config's.
+func TunnelSettings() string {
+	t := running()
+	if t == nil {
+		return ""
+	}
+	var pushed *protocol.TunnelConfig
+	select {
+	case <-t.configured:
+		pushed = t.pushed
+	default:
+	}
+	settings := protocol.MergeTunnelConfig(pushed, protocol.TunnelConfig{
+		Type: protocol.TunnelConfigType,
+		IPv4: t.config.LocalIP,
+		IPv6: t.config.LocalIP6,
+		DNS:  t.config.DNSServers,
+	})
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// TunnelError returns why the tunnel stopped on its own, such as the
+// connection dropping, or an empty string. The provider should then cancel
+// the tunnel so the system can start it again.
+func TunnelError() string {
+	mu.Lock()
+	t := current
+	mu.Unlock()
+	if t == nil {
+		return ""
+	}
+	if err := t.stopErr(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// running returns the current tunnel, nil if none was started
+func running() *tunnel {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// newTunnel checks the config and prepares a tunnel
+func newTunnel(configJSON string) (*tunnel, error) {
+	var config Config
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if config.ServerURL == "" {
+		return nil, errors.New("server_url is required")
+	}
+	policy, err := protocol.ParseQueuePolicy(config.SendQueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.ParallelThreshold < 0 {
+		return nil, fmt.Errorf("parallel_threshold must not be negative")
+	}
+	if err := config.socketOptions().Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnel{
+		config:     &config,
+		stealth:    protocol.NewStealthProtocol(),
+		configured: make(chan struct{}),
+		sendQueue:  protocol.NewSendQueue(config.SendQueueSize, policy),
+		received:   make(chan []byte, receiveQueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
+}
+
+// start connects, performs the key exchange and waits for the server to
+// assign addresses
+func (t *tunnel) start() error {
+	ctx, cancel := context.WithTimeout(t.ctx, handshakeTimeout)
+	defer cancel()
+
+	if err := t.connect(ctx); err != nil {
+		return err
+	}
+	if err := t.performKeyExchange(ctx); err != nil {
+		return fmt.Errorf("key exchange failed: %v", err)
+	}
+
+	go t.forwardFromServer()
+	go t.forwardToServer()
+
+	// The server pushes the addresses first thing; without them the
+	// config's own are used
+	select {
+	case <-t.configured:
+	case <-ctx.Done():
+		if err := t.stopErr(); err != nil {
+			return err
+		}
+		slog.Warn("Server assigned no tunnel addresses; using the configured ones")
+	}
+	slog.Info("Tunnel started", "server", t.config.ServerURL)
+	return nil
+}
+
+// connect opens the WebSocket connection to the server. Sockets the
+// extension opens bypass its own tunnel, so none need protecting.
+func (t *tunnel) connect(ctx context.Context) error {
+	u, err := url.Parse(t.config.ServerURL)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := t.stealth.GetTLSConfig()
+	tlsConfig.ServerName = t.config.FakeDomainName
+	tlsConfig.InsecureSkipVerify = true // For testing - remove in production
+	dialer := websocket.Dialer{
+		NetDialContext:   t.config.socketOptions().DialContext(&net.Dialer{}),
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: 15 * time.Second,
+	}
+
+	// Look like Safari opening a WebSocket
+	header := make(http.Header)
+	header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15")
+	header.Set("Accept-Language", "en-US,en;q=0.9")
+	header.Set("Accept-Encoding", "gzip, deflate, br")
+	header.Set("Origin", fmt.Sprintf("https://%s", t.config.FakeDomainName))
+	header.Set("Sec-WebSocket-Protocol", "chat")
+
+	conn, _, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return err
+	}
+	t.transport = protocol.NewWebSocketTransport(conn)
+	return nil
+}
+
+// performKeyExchange agrees on session keys with an X25519 exchange, then
+// logs in and takes the session token if the server asks
+func (t *tunnel) performKeyExchange(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	t.transport.SetReadDeadline(deadline)
+	t.transport.SetWriteDeadline(deadline)
+	defer t.transport.SetReadDeadline(time.Time{})
+	defer t.transport.SetWriteDeadline(time.Time{})
+
+	// Both messages are kept, as the session key is bound to them
+	hello, err := t.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	var serverKeyMsg protocol.KeyExchangeMessage
+	if err := json.Unmarshal(hello, &serverKeyMsg); err != nil {
+		return err
+	}
+	if err := protocol.CheckProtocolVersion("server", serverKeyMsg.Version); err != nil {
+		return err
+	}
+	if serverKeyMsg.Type != protocol.KeyExchangeType || len(serverKeyMsg.PublicKey) == 0 {
+		return errors.New("invalid server public key")
+	}
+
+	compression := protocol.NegotiateCompression(serverKeyMsg.Compression, t.config.Compression)
+	compressor, err := protocol.NewCompressor(compression)
+	if err != nil {
+		return err
+	}
+	cipher := protocol.CipherLayered
+	if t.config.SingleCipher {
+		cipher = protocol.NegotiateCipher(serverKeyMsg.Ciphers, protocol.PreferredCipher())
+	}
+
+	kx, err := protocol.NewKeyExchange()
+	if err != nil {
+		return err
+	}
+	defer kx.Zeroize()
+	clientKeyMsg := protocol.KeyExchangeMessage{
+		Type:        protocol.KeyExchangeType,
+		Version:     protocol.ProtocolVersion,
+		PublicKey:   kx.GetPublicKey(),
+		Compression: []protocol.CompressionAlgorithm{compression},
+		KeyID:       t.config.PreSharedKeyID,
+	}
+	if cipher != protocol.CipherLayered {
+		clientKeyMsg.Ciphers = []string{cipher}
+	}
+	reply, err := json.Marshal(clientKeyMsg)
+	if err != nil {
+		return err
+	}
+	if err := t.transport.WriteMessage(reply); err != nil {
+		return err
+	}
+
+	sharedSecret, err := kx.ComputeSharedSecret(serverKeyMsg.PublicKey, protocol.KeyExchangeTranscript(hello, reply))
+	if err != nil {
+		return err
+	}
+	encryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
+	protocol.ZeroBytes(sharedSecret)
+	if err != nil {
+		return err
+	}
+	if err := encryption.SetCipher(cipher); err != nil {
+		return err
+	}
+	encryption.SetParallelThreshold(t.config.ParallelThreshold)
+	t.encryption, t.compressor = encryption, compressor
+	slog.Info("Key exchange completed", "cipher", cipher)
+
+	if serverKeyMsg.AuthRequired {
+		transcript := protocol.HandshakeTranscript(serverKeyMsg.PublicKey, kx.GetPublicKey())
+		if err := t.login(transcript); err != nil {
+			return err
+		}
+	}
+
+	// Extensions are started afresh, so the token for resuming is not kept
+	if serverKeyMsg.SessionResumption {
+		var tokenMsg protocol.Message
+		if err := protocol.ReadJSON(t.transport, &tokenMsg); err != nil {
+			return err
+		}
+		if tokenMsg.Type != protocol.SessionTokenType {
+			return fmt.Errorf("unexpected message type: %s", tokenMsg.Type)
+		}
+	}
+	return nil
+}
+
+// login proves we hold the pre-shared key and sends the user's credentials
+func (t *tunnel) login(transcript []byte) error {
+	masterKey, err := protocol.MasterKey(t.config.PreSharedKey, t.config.PassphraseKDF)
+	if err != nil {
+		return err
+	}
+	credentials, err := json.Marshal(protocol.AuthRequest{
+		Type:     protocol.AuthType,
+		Username: t.config.Username,
+		Password: t.config.Password,
+		OTP:      t.config.OTP,
+		PSKProof: protocol.PSKProof(masterKey, transcript),
+	})
+	if err != nil {
+		return err
+	}
+	encrypted, err := t.encryption.Encrypt(credentials)
+	protocol.ZeroBytes(credentials)
+	if err != nil {
+		return err
+	}
+	if err := protocol.WriteJSON(t.transport, protocol.Message{Type: protocol.AuthType, Data: encrypted}); err != nil {
+		return err
+	}
+
+	var result protocol.Message
+	if err := protocol.ReadJSON(t.transport, &result); err != nil {
+		return err
+	}
+	if result.Type != protocol.AuthResultType {
+		return fmt.Errorf("unexpected message type: %s", result.Type)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("login rejected: %s", result.Error)
+	}
+	return nil
+}
+
+// forwardToServer sends the packets WritePacket queued until the tunnel
+// stops
+func (t *tunnel) forwardToServer() {
+	for {
+		buf, ok := t.sendQueue.Pop()
+		if !ok {
+			return
+		}
+		err := t.send(*buf)
+		protocol.PutPacketBuffer(buf)
+		if err != nil {
+			t.stop(fmt.Errorf("failed to send to server: %v", err))
+			return
+		}
+	}
+}
+
+// send compresses, encrypts and obfuscates a packet and sends it
+func (t *tunnel) send(packet []byte) error {
+	compressBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(compressBuf)
+	compressed := t.compressor.Compress(*compressBuf, packet)
+
+	encryptBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(encryptBuf)
+	encrypted, err := t.encryption.EncryptTo(*encryptBuf, compressed)
+	if err != nil {
+		return err
+	}
+
+	obfuscateBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(obfuscateBuf)
+	obfuscated, err := t.stealth.ObfuscatePacketTo(*obfuscateBuf, encrypted)
+	if err != nil {
+		return err
+	}
+	t.stealth.AddTimingJitter()
+	return protocol.WriteMessageContext(t.ctx, t.transport, obfuscated)
+}
+
+// forwardFromServer queues the server's packets for ReadPacket and handles
+// its control messages until the connection ends
+func (t *tunnel) forwardFromServer() {
+	for {
+		message, err := t.transport.ReadMessage()
+		if err != nil {
+			t.stop(fmt.Errorf("connection to server lost: %v", err))
+			return
+		}
+
+		deobfuscated, err := t.stealth.DeobfuscatePacket(message)
+		if err != nil {
+			slog.Warn("Failed to deobfuscate packet", "error", err)
+			continue
+		}
+		decrypted, err := t.encryption.DecryptInPlace(deobfuscated)
+		if err != nil {
+			slog.Warn("Failed to decrypt packet", "error", err)
+			continue
+		}
+		payload, err := t.compressor.Decompress(decrypted)
+		if err != nil {
+			slog.Warn("Failed to decompress packet", "error", err)
+			continue
+		}
+
+		if protocol.IsControlMessage(payload) {
+			t.handleControlMessage(payload)
+			continue
+		}
+
+		// Drop packets the provider is too slow to read, as a full
+		// interface queue would
+		select {
+		case t.received <- append([]byte(nil), payload...):
+		default:
+		}
+	}
+}
+
+// handleControlMessage handles a JSON message received inside the tunnel
+func (t *tunnel) handleControlMessage(payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid control message from server", "error", err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.TunnelConfigType:
+		// Network settings are applied once, when the tunnel starts
+		t.configOnce.Do(func() {
+			var config protocol.TunnelConfig
+			if err := json.Unmarshal(payload, &config); err != nil {
+				slog.Error("Invalid tunnel config from server", "error", err)
+				return
+			}
+			t.pushed = &config
+			close(t.configured)
+		})
+	case protocol.QuotaExceededType:
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	case protocol.SessionLimitType:
+		// Reconnects succeed once one of the user's other sessions ends
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	}
+}
+
+// stop ends the tunnel, recording err as the reason unless it was stopped
+// already
+func (t *tunnel) stop(err error) {
+	t.mu.Lock()
+	if t.ctx.Err() == nil {
+		t.err = err
+		t.cancel()
+	}
+	t.mu.Unlock()
+
+	t.sendQueue.Close()
+	if t.transport != nil {
+		t.transport.Close()
+	}
+}
+
+// stopErr returns why the tunnel stopped on its own, nil if it is running
+// or was stopped with StopTunnel
+func (t *tunnel) stopErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
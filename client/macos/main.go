@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,6 +14,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/songgao/water"
+	"stealthvpn/pkg/logging"
 	"stealthvpn/pkg/protocol"
 )
 
@@ -41,6 +42,9 @@ func (c *Client) configureTunInterface() error {
 		{"ifconfig", name, "10.8.0.2", "10.8.0.1", "up"},
 		{"route", "add", "-net", "0.0.0.0/1", "-interface", name},
 		{"route", "add", "-net", "128.0.0.0/1", "-interface", name},
+		{"ifconfig", name, "inet6", "fd00::2", "fd00::1", "prefixlen", "64", "up"},
+		{"route", "add", "-inet6", "-net", "::/1", "-interface", name},
+		{"route", "add", "-inet6", "-net", "8000::/1", "-interface", name},
 	}
 
 	for _, cmd := range commands {
@@ -70,7 +74,7 @@ func (c *Client) Start() error {
 		return err
 	}
 
-	log.Printf("Created TUN interface: %s", iface.Name())
+	slog.Info("Created TUN interface", "name", iface.Name())
 
 	// Connect to server
 	u := url.URL{Scheme: "ws", Host: c.serverURL, Path: "/vpn"}
@@ -96,7 +100,7 @@ func (c *Client) tunToWs() {
 	for {
 		n, err := c.tunInterface.Read(packet)
 		if err != nil {
-			log.Printf("Error reading from TUN: %v", err)
+			slog.Error("Error reading from TUN", "error", err)
 			continue
 		}
 
@@ -107,12 +111,12 @@ func (c *Client) tunToWs() {
 
 		data, err := json.Marshal(msg)
 		if err != nil {
-			log.Printf("Error marshaling packet: %v", err)
+			slog.Error("Error marshaling packet", "error", err)
 			continue
 		}
 
 		if err := c.wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Error writing to websocket: %v", err)
+			slog.Warn("Error writing to websocket", "error", err)
 			return
 		}
 	}
@@ -122,13 +126,13 @@ func (c *Client) wsToTun() {
 	for {
 		_, data, err := c.wsConn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from websocket: %v", err)
+			slog.Warn("Error reading from websocket", "error", err)
 			return
 		}
 
 		var msg protocol.Message
 		if err := json.Unmarshal(data, &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+			slog.Warn("Error unmarshaling message", "error", err)
 			continue
 		}
 
@@ -137,7 +141,7 @@ func (c *Client) wsToTun() {
 		}
 
 		if _, err := c.tunInterface.Write(msg.Data); err != nil {
-			log.Printf("Error writing to TUN: %v", err)
+			slog.Warn("Error writing to TUN", "error", err)
 			continue
 		}
 	}
@@ -154,15 +158,29 @@ func (c *Client) Stop() {
 
 func main() {
 	serverURL := flag.String("server", "", "VPN server URL (e.g. example.com:8080)")
-	presharedKey := flag.String("psk", "", "Pre-shared key")
+	presharedKey := flag.String("psk", "", "Pre-shared key (deprecated: visible to other users; use -psk-file or STEALTHVPN_PSK)")
+	pskFile := flag.String("psk-file", "", "File containing the pre-shared key")
+	logLevel := flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log as text or json")
 	flag.Parse()
 
-	if *serverURL == "" || *presharedKey == "" {
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		logging.Fatal("Invalid logging flags", "error", err)
+	}
+	if *serverURL == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *presharedKey != "" {
+		slog.Warn("-psk exposes the key in the process list; use -psk-file or " + protocol.PSKEnvVar + " instead")
+	}
+
+	psk, err := protocol.ResolvePreSharedKey(*presharedKey, *pskFile)
+	if err != nil {
+		logging.Fatal("Invalid pre-shared key", "error", err)
+	}
 
-	client := NewClient(*serverURL, *presharedKey)
+	client := NewClient(*serverURL, psk)
 
 	// Handle interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -170,15 +188,15 @@ func main() {
 
 	go func() {
 		<-sigChan
-		log.Println("Shutting down...")
+		slog.Info("Shutting down")
 		client.Stop()
 		os.Exit(0)
 	}()
 
 	// Start client
-	log.Printf("Connecting to %s...", *serverURL)
+	slog.Info("Connecting", "server", *serverURL)
 	if err := client.Start(); err != nil {
-		log.Fatalf("Error starting client: %v", err)
+		logging.Fatal("Error starting client", "error", err)
 	}
 
 	// Keep running
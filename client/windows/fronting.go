@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/vpnerr"
+)
+
+// blockedBeforeRotating is how many connections in a row must look blocked
+// before the client moves on to the next fake domain
+const blockedBeforeRotating = 2
+
+// fakeDomains chooses the domain sent as the TLS server name and in the
+// Origin header. Censors that block by SNI reset or stall connections
+// naming a domain, so when connections keep failing that way the next
+// domain is tried. Domains that worked are preferred, as servers are.
+// With randomize_sni each connection names a random domain instead, among
+// those not found blocked.
+type fakeDomains struct {
+	list      *protocol.ServerList
+	randomize bool
+
+	mu      sync.Mutex
+	current string
+	blocked map[string]int  // connections in a row under each domain that looked blocked
+	failed  map[string]bool // domains given up on as blocked
+}
+
+// newFakeDomains returns fake_domain_name followed by fake_domain_names
+func newFakeDomains(config *ClientConfig) *fakeDomains {
+	list := protocol.NewServerList(append([]string{config.FakeDomainName}, config.FakeDomainNames...))
+	d := &fakeDomains{
+		list:      list,
+		randomize: config.RandomizeSNI,
+		blocked:   make(map[string]int),
+		failed:    make(map[string]bool),
+	}
+	if candidates := list.Candidates(); len(candidates) > 0 {
+		d.current = candidates[0]
+	}
+	return d
+}
+
+// Next returns the domain for the next connection
+func (d *fakeDomains) Next() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.randomize {
+		return d.current
+	}
+
+	candidates := d.list.Candidates()
+	var usable []string
+	for _, domain := range candidates {
+		if !d.failed[domain] {
+			usable = append(usable, domain)
+		}
+	}
+	switch {
+	case len(usable) > 0:
+		return usable[rand.IntN(len(usable))]
+	case len(candidates) > 0:
+		// All look blocked; try the one that failed longest ago
+		return candidates[0]
+	default:
+		return ""
+	}
+}
+
+// Succeeded records that a connection with domain got through
+func (d *fakeDomains) Succeeded(domain string, latency time.Duration) {
+	d.list.MarkSuccess(domain, latency)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.blocked, domain)
+	delete(d.failed, domain)
+}
+
+// Failed records a failed connection with domain, giving up on the domain
+// once too many in a row looked blocked
+func (d *fakeDomains) Failed(domain string, err error) {
+	if !looksBlocked(err) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blocked[domain]++
+	if d.blocked[domain] < blockedBeforeRotating {
+		return
+	}
+
+	d.list.MarkFailure(domain)
+	delete(d.blocked, domain)
+	d.failed[domain] = true
+	candidates := d.list.Candidates()
+	if domain != d.current || len(candidates) == 0 || candidates[0] == domain {
+		return
+	}
+	d.current = candidates[0]
+	if !d.randomize {
+		slog.Warn("Connections look blocked, switching fake domain", "from", domain, "to", d.current)
+	}
+}
+
+// looksBlocked reports whether a dial failure could be a censor cutting
+// off connections by their server name. Refused connections and failed DNS
+// lookups say nothing about the name sent, so they do not count.
+func looksBlocked(err error) bool {
+	if vpnerr.CategoryOf(err) != vpnerr.CategoryDial {
+		return false
+	}
+	var dnsErr *net.DNSError
+	return !errors.Is(err, syscall.ECONNREFUSED) && !errors.As(err, &dnsErr)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/vpnerr"
+)
+
+// errReset is how a censor cutting off a connection by SNI shows up
+var errReset = vpnerr.Wrap(vpnerr.CategoryDial, syscall.ECONNRESET)
+
+func TestFakeDomainsRotateWhenBlocked(t *testing.T) {
+	d := newFakeDomains(&ClientConfig{FakeDomainName: "a.example", FakeDomainNames: []string{"b.example", "c.example"}})
+	if got := d.Next(); got != "a.example" {
+		t.Fatalf("first domain %q, want fake_domain_name", got)
+	}
+
+	// Failures that say nothing about the server name do not count
+	for _, err := range []error{
+		vpnerr.Wrap(vpnerr.CategoryDial, syscall.ECONNREFUSED),
+		vpnerr.Wrap(vpnerr.CategoryDial, &net.DNSError{Err: "no such host"}),
+		vpnerr.Wrap(vpnerr.CategoryAuth, errors.New("rejected")),
+	} {
+		d.Failed("a.example", err)
+		d.Failed("a.example", err)
+	}
+	if got := d.Next(); got != "a.example" {
+		t.Fatalf("rotated to %q on failures that do not look blocked", got)
+	}
+
+	// A success in between resets the count
+	d.Failed("a.example", errReset)
+	d.Succeeded("a.example", 10*time.Millisecond)
+	d.Failed("a.example", errReset)
+	if got := d.Next(); got != "a.example" {
+		t.Fatalf("rotated to %q after one blocked connection", got)
+	}
+	d.Failed("a.example", errReset)
+	if got := d.Next(); got != "b.example" {
+		t.Errorf("domain after two blocked connections %q, want b.example", got)
+	}
+}
+
+func TestFakeDomainsRandomizeSkipsBlocked(t *testing.T) {
+	d := newFakeDomains(&ClientConfig{FakeDomainName: "a.example", FakeDomainNames: []string{"b.example"}, RandomizeSNI: true})
+	d.Failed("a.example", errReset)
+	d.Failed("a.example", errReset)
+	for i := 0; i < 20; i++ {
+		if got := d.Next(); got != "b.example" {
+			t.Fatalf("randomized to %q, which looks blocked", got)
+		}
+	}
+
+	// With every domain blocked, the one blocked longest ago is retried
+	time.Sleep(time.Millisecond)
+	d.Failed("b.example", errReset)
+	d.Failed("b.example", errReset)
+	if got := d.Next(); got != "a.example" {
+		t.Errorf("with all blocked chose %q, want a.example", got)
+	}
+}
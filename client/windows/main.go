@@ -1,389 +1,1901 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/flynn/noise"
 	"github.com/gorilla/websocket"
 	"github.com/songgao/water"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"stealthvpn/pkg/logging"
+	"stealthvpn/pkg/nat"
+	"stealthvpn/pkg/profiling"
 	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/transport/webrtc"
+	"stealthvpn/pkg/vpnerr"
 )
 
+// maxMissedHealthChecks is how many unanswered health checks trigger a reconnect
+const maxMissedHealthChecks = 3
+
 // ClientConfig holds client configuration
 type ClientConfig struct {
 	ServerURL        string   `json:"server_url"`
+	ServerURLs       []string `json:"server_urls"` // failover servers, tried after server_url
 	PreSharedKey     string   `json:"pre_shared_key"`
+	PreSharedKeyFile string   `json:"pre_shared_key_file"` // read instead of pre_shared_key; STEALTHVPN_PSK overrides both
+	PreSharedKeyID   string   `json:"pre_shared_key_id"` // tells the server which key we hold during rotation
+	PassphraseKDF    *protocol.PassphraseKDF `json:"passphrase_kdf"` // treat the pre-shared key as a passphrase
 	DNSServers       []string `json:"dns_servers"`
 	LocalIP          string   `json:"local_ip"`
+	LocalIP6         string   `json:"local_ip6"`
+	AllowedIPs       []string `json:"allowed_ips"`
 	AutoConnect      bool     `json:"auto_connect"`
 	ReconnectDelay   int      `json:"reconnect_delay"`
 	HealthCheckInterval int   `json:"health_check_interval"`
 	FakeDomainName   string   `json:"fake_domain_name"`
+	FakeDomainNames  []string `json:"fake_domain_names"` // tried in turn after fake_domain_name when connections look blocked
+	FrontedHost      string   `json:"fronted_host"` // Host header naming the real server to a CDN, while the TLS server name stays the fake domain
+	OTLPEndpoint     string   `json:"otlp_endpoint"`
+	KeepaliveInterval int     `json:"keepalive_interval"`
+	DeadPeerIntervals int     `json:"dead_peer_intervals"`
+	Compression      protocol.CompressionAlgorithm `json:"compression"`
+	Transport        protocol.TransportType `json:"transport"`
+	UDPServerAddr    string   `json:"udp_server_addr"`
+	MeekFrontDomain  string   `json:"meek_front_domain"` // CDN domain the meek transport connects to, e.g. ajax.aspnetcdn.com
+	DoHDomain        string   `json:"doh_domain"` // the server's doh_domain, for the doh transport
+	DoHQueriesPerSecond float64 `json:"doh_queries_per_second"` // cap on DoH queries; default 10
+	BatchIntervalMs  int      `json:"batch_interval_ms"` // 0 sends every packet on its own
+	BatchPackets     int      `json:"batch_packets"`
+	Username         string   `json:"username"` // for servers that require a login
+	Password         string   `json:"password"`
+	OTP              string   `json:"otp"` // one-time code, for servers using TOTP
+	ClientCertFile   string   `json:"client_cert_file"` // for servers using certificate authentication
+	ClientKeyFile    string   `json:"client_key_file"`
+	UseNoise         bool     `json:"use_noise"` // Noise_XX handshake instead of the custom key exchange
+	NoisePrivateKey  string   `json:"noise_private_key"` // WireGuard format; a new key each run if empty
+	NoiseServerPublicKey string `json:"noise_server_public_key"` // reject servers with any other key
+	PaddingBuckets   []int    `json:"padding_buckets"` // frame sizes to pad to; defaults if empty
+	PaddingWeights   []float64 `json:"padding_weights"` // likelihood of each bucket
+	Jitter           *protocol.JitterProfile `json:"jitter"` // shape of the delays added to disguise timing; set disabled to turn them off
+	JitterMinMs      *int `json:"jitter_min_ms"` // shortest added delay; default 0
+	JitterMaxMs      *int `json:"jitter_max_ms"` // longest added delay; default 100, 0 turns the delays off
+	TLSMinVersion    string `json:"tls_min_version"` // "1.2" (default) or "1.3"; older versions only to match a fingerprint
+	TLSCipherSuites  []string `json:"tls_cipher_suites"` // IANA names of the TLS 1.2 suites to offer; modern AEAD suites if empty
+	ALPN             []string `json:"alpn"` // TLS application protocols to offer. Default h2, http/1.1, as browsers do
+	RandomizeSNI     bool     `json:"randomize_sni"` // name a random one of the fake domains in each connection
+	MultipathPaths   int      `json:"multipath_paths"` // connections to bond into one session, if the server allows; 0 or 1 for one
+	MultipathLocalAddrs []string `json:"multipath_local_addrs"` // local address of each connection in turn, such as the Wi-Fi and cellular ones
+	UpstreamProxy    string   `json:"upstream_proxy"` // reach the server through http://[user:pass@]host:port or socks5://[user:pass@]host:port
+	SingleCipher     bool     `json:"single_cipher"` // encrypt with just the cipher fastest on this CPU, if the server allows
+	Cipher           string   `json:"cipher"` // with single_cipher, ask for aes-256-gcm or chacha20-poly1305 instead
+	RekeyBytes       int64    `json:"rekey_bytes"` // replace the session keys after this much traffic. Default 100 MB
+	RekeyInterval    int      `json:"rekey_interval"` // or after this many minutes. Default 60
+	EnableSOCKS5     bool     `json:"enable_socks5"` // run a local SOCKS5 proxy instead of a TUN interface, as -socks5 does
+	SOCKS5Port       int      `json:"socks5_port"` // loopback port of the enable_socks5 proxy. Default 1080
+	SendQueueSize    int      `json:"send_queue_size"` // packets from the TUN interface that may wait for the connection. Default 256
+	ParallelThreshold int     `json:"parallel_threshold"` // payloads of at least this many bytes are encrypted in chunks on several cores. Default 0, never
+	SendQueuePolicy  string   `json:"send_queue_policy"` // what to do when the queue is full: drop-oldest (default), drop-newest or block
+	TCPNoDelay       *bool    `json:"tcp_nodelay"` // send small writes to the server at once; default true, false to coalesce them
+	SocketSendBuffer int      `json:"socket_send_buffer"` // SO_SNDBUF of the TCP connection in bytes; system default if 0
+	SocketReceiveBuffer int   `json:"socket_receive_buffer"` // SO_RCVBUF of the TCP connection in bytes; system default if 0
+	UDPSendBuffer    int      `json:"udp_send_buffer"` // SO_SNDBUF of the udp transport's socket in bytes; system default if 0
+	UDPReceiveBuffer int      `json:"udp_receive_buffer"` // SO_RCVBUF of the udp transport's socket in bytes; system default if 0
+	TunDriver        string   `json:"tun_driver"` // Windows TUN driver: auto (default) for WinTUN if installed and TAP otherwise, wintun or tap
+	STUNServer       string   `json:"stun_server"` // host[:port] of a STUN server to learn our public address from, for the server; none if empty
 }
 
+// stunTimeout bounds how long discovering our public address may delay
+// connecting
+const stunTimeout = 5 * time.Second
+
 // VPNClient represents the stealth VPN client
 type VPNClient struct {
 	config       *ClientConfig
+	servers      *protocol.ServerList
+	fakeDomains  *fakeDomains
+	serverURL    string // server of the current connection
+	done         chan struct{} // closed by Disconnect to stop reconnecting
+	doneOnce     sync.Once
 	stealth      *protocol.StealthProtocol
 	encryption   *protocol.MultiLayerEncryption
+	compressor   *protocol.Compressor
 	conn         *websocket.Conn
-	tunInterface *water.Interface
+	transport    protocol.Transport
+	tunInterface *tunDevice // outlives connections; guarded by tunMu
+	tunMu        sync.Mutex
+	pushedConfig *protocol.TunnelConfig // settings pushed by the server; guarded by tunMu
+	appliedIPv4  string // the IPv4 address set on the TUN interface on Linux; guarded by tunMu
+	appliedIPv6  string // the IPv6 address set on the TUN interface; guarded by tunMu
+	appliedRoutes map[string]bool // route prefixes set on the TUN interface; guarded by tunMu
+	appliedDNS   []string // DNS servers in the NRPT rule on Windows; guarded by tunMu
+	sendQueue    *protocol.SendQueue // packets read from the TUN interface, waiting to be sent; guarded by tunMu
+	publicIP     net.IP // our public address as the STUN server saw it, nil if unknown
+	sendPolicy   protocol.QueuePolicy
+	sendDropped  atomic.Uint64 // packets the send queue policy dropped
 	keyExchange  *protocol.KeyExchange
-	connected    bool
+	sessionToken []byte
+	resumeSecret []byte // issued with sessionToken
+	pskKey       []byte // pre-shared key material, for PSK proofs
+	clientCert   *tls.Certificate // nil unless client_cert_file is set
+	upstreamProxy *url.URL // proxy to dial the server through, nil to dial directly
+	noiseKey     noise.DHKey // our long-term Noise key
+	noisePin     []byte // the server's Noise key, nil to accept any
+	batching     bool // the server reads batches of frames
+	multipath    bool // the server bonds our further connections into the session
+	cipher       string // negotiated in the key exchange, kept for resumed sessions
+	pathToken    []byte // joins a connection to the session
+	paths        *protocol.MultipathTransport // nil unless the connection is multipath
+	deadPeer     *protocol.DeadPeerDetector
+	socks        *socksProxy
+	chaos        *protocol.ChaosConfig // degrades connections on purpose; nil normally
+	
+	// connCtx is cancelled as soon as the current connection is lost
+	connMu       sync.Mutex
+	connCtx      context.Context
+	connCancel   context.CancelFunc
+	lastErr      error // why the last connect failed, nil once connected
+	connectedAt  time.Time
+	
+	// Traffic of the current connection, counted as framed on the wire
+	sent         protocol.ThroughputMeter
+	received     protocol.ThroughputMeter
+	
+	// Health check state, guarded by healthMu
+	healthMu           sync.Mutex
+	healthCheckPending int64 // timestamp of the unanswered health check, 0 if none
+	missedHealthChecks int
+	stats              protocol.SessionStats
 }
 
 // NewVPNClient creates a new stealth VPN client
 func NewVPNClient(config *ClientConfig) (*VPNClient, error) {
 	stealth := protocol.NewStealthProtocol()
 	
+	// Shape frame sizes like the traffic being impersonated
+	if len(config.PaddingBuckets) > 0 {
+		if err := stealth.SetPaddingBuckets(config.PaddingBuckets, config.PaddingWeights); err != nil {
+			return nil, fmt.Errorf("invalid padding buckets: %v", err)
+		}
+	}
+	if config.Jitter != nil {
+		if err := stealth.SetJitterProfile(*config.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	if err := stealth.SetJitterBounds(protocol.JitterBoundsMs(config.JitterMinMs, config.JitterMaxMs)); err != nil {
+		return nil, err
+	}
+	if err := stealth.SetTLSPolicy(config.TLSMinVersion, config.TLSCipherSuites); err != nil {
+		return nil, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+	alpn := config.ALPN
+	if len(alpn) == 0 {
+		alpn = protocol.DefaultClientALPN
+	}
+	if err := stealth.SetALPN(alpn); err != nil {
+		return nil, fmt.Errorf("invalid alpn: %v", err)
+	}
+	
 	// Initialize pre-shared key encryption
-	encryption, err := protocol.NewMultiLayerEncryption([]byte(config.PreSharedKey))
+	masterKey, err := protocol.MasterKey(config.PreSharedKey, config.PassphraseKDF)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := protocol.NewMultiLayerEncryption(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize encryption: %v", err)
 	}
 	
+	// Present a client certificate to servers that authenticate with one
+	var clientCert *tls.Certificate
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		clientCert = &cert
+	}
+	
+	noiseKey, noisePin, err := loadNoiseKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	
+	for _, addr := range config.MultipathLocalAddrs {
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid multipath_local_addrs entry %q", addr)
+		}
+	}
+	
+	upstreamProxy, err := parseUpstreamProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.STUNServer != "" && upstreamProxy != nil {
+		// The query would go around the proxy and give the address away
+		return nil, fmt.Errorf("stun_server cannot be used with upstream_proxy")
+	}
+	
+	sendPolicy, err := protocol.ParseQueuePolicy(config.SendQueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.ParallelThreshold < 0 {
+		return nil, fmt.Errorf("parallel_threshold must not be negative")
+	}
+	if err := tcpSocketOptions(config).Validate(); err != nil {
+		return nil, err
+	}
+	if err := udpSocketOptions(config).Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateTunDriver(config.TunDriver); err != nil {
+		return nil, err
+	}
+	
 	return &VPNClient{
 		config:     config,
+		servers:    newServerList(config),
+		fakeDomains: newFakeDomains(config),
+		done:       make(chan struct{}),
 		stealth:    stealth,
 		encryption: encryption,
-		connected:  false,
+		pskKey:     masterKey,
+		clientCert: clientCert,
+		upstreamProxy: upstreamProxy,
+		sendPolicy: sendPolicy,
+		noiseKey:   noiseKey,
+		noisePin:   noisePin,
 	}, nil
 }
 
+// tcpSocketOptions returns the options for TCP connections to the server
+func tcpSocketOptions(config *ClientConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		NoDelay:     config.TCPNoDelay,
+		ReadBuffer:  config.SocketReceiveBuffer,
+		WriteBuffer: config.SocketSendBuffer,
+	}
+}
+
+// udpSocketOptions returns the options for the udp transport's socket
+func udpSocketOptions(config *ClientConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		ReadBuffer:  config.UDPReceiveBuffer,
+		WriteBuffer: config.UDPSendBuffer,
+	}
+}
+
+// parseUpstreamProxy returns the proxy to reach the server through, or nil
+// if none is configured. Credentials go in the URL and are sent as HTTP
+// basic auth or SOCKS5 username and password.
+func parseUpstreamProxy(config *ClientConfig) (*url.URL, error) {
+	if config.UpstreamProxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(config.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream_proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid upstream_proxy scheme %q, want http or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream_proxy %q has no host", u.Redacted())
+	}
+	if config.Transport == protocol.TransportUDP {
+		return nil, fmt.Errorf("upstream_proxy cannot carry the UDP transport")
+	}
+	return u, nil
+}
+
+// loadNoiseKeys returns the keys for the Noise handshake if it is enabled:
+// our long-term key, random unless configured, and the server key to pin
+func loadNoiseKeys(config *ClientConfig) (noise.DHKey, []byte, error) {
+	if !config.UseNoise {
+		return noise.DHKey{}, nil, nil
+	}
+	
+	static, err := protocol.NoiseStaticKey(config.NoisePrivateKey)
+	if err != nil {
+		return noise.DHKey{}, nil, fmt.Errorf("invalid noise_private_key: %v", err)
+	}
+	var serverKey []byte
+	if config.NoiseServerPublicKey != "" {
+		serverKey, err = protocol.DecodeNoisePublicKey(config.NoiseServerPublicKey)
+		if err != nil {
+			return noise.DHKey{}, nil, fmt.Errorf("invalid noise_server_public_key: %v", err)
+		}
+	}
+	return static, serverKey, nil
+}
+
 // Connect establishes connection to the VPN server
 func (c *VPNClient) Connect() error {
-	log.Println("Connecting to stealth VPN server...")
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext establishes connection to the VPN server, giving up as soon
+// as ctx is done
+func (c *VPNClient) ConnectContext(ctx context.Context) (err error) {
+	defer func() {
+		// A cancelled attempt is reported as such, whatever step it interrupted
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		// Keep the failure, categorized, for the status report
+		c.setLastError(err)
+	}()
+	
+	slog.Info("Connecting to stealth VPN server")
+	
+	// Trace the attempt from dialing to the first packet from the server
+	ctx, span := protocol.Tracer().Start(ctx, "connect", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { protocol.EndSpan(span, err) }()
+	
+	// Learn our public address for the server, which may only see a CDN's
+	if c.config.STUNServer != "" {
+		c.discoverPublicIP(ctx)
+	}
+	
+	// Reconnects reuse the TUN interface; SOCKS5 mode has none at all
+	if c.socks == nil {
+		if err := c.ensureTunInterface(ctx); err != nil {
+			return vpnerr.Wrap(vpnerr.CategoryTunSetup, err)
+		}
+	}
+	
+	// Connect to the first server that completes the handshake
+	if err := c.connectToAnyServer(ctx); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("server.address", c.serverURL))
+	if traceID := protocol.TraceID(ctx); traceID != "" {
+		slog.Info("Connection traced", "server", c.serverURL, "trace_id", traceID)
+	}
+	
+	// Bond further connections into the session if agreed in the key exchange
+	var paths *protocol.MultipathTransport
+	var firstPath <-chan struct{}
+	if c.multipath {
+		if paths, firstPath, err = c.startMultipath(); err != nil {
+			c.transport.Close()
+			return err
+		}
+	}
+	
+	// Send packets in batches if agreed in the key exchange
+	if c.batching {
+		c.transport = protocol.NewBatchWriter(c.transport,
+			time.Duration(c.config.BatchIntervalMs)*time.Millisecond, c.config.BatchPackets)
+	}
+	
+	// Count this connection's traffic from zero
+	c.sent.Reset()
+	c.received.Reset()
+	
+	// Detect a server that silently stops responding, and measure the
+	// round-trip time of the link with the same pings
+	var deadPeer *protocol.DeadPeerDetector
+	if c.conn != nil && paths == nil {
+		deadPeer = protocol.NewDeadPeerDetector(c.conn,
+			time.Duration(c.config.KeepaliveInterval)*time.Second, c.config.DeadPeerIntervals)
+		deadPeer.SetRTTObserver(c.stealth.ObserveRTT)
+	}
+	
+	// Everything tied to this connection stops when connCtx is cancelled
+	connCtx, connCancel := context.WithCancel(context.Background())
+	c.connMu.Lock()
+	c.connCtx, c.connCancel = connCtx, connCancel
+	c.connectedAt = time.Now()
+	c.paths = paths
+	c.deadPeer = deadPeer
+	c.connMu.Unlock()
+	slog.Info("Successfully connected to VPN server", "server", c.serverURL)
+	
+	c.healthMu.Lock()
+	c.healthCheckPending = 0
+	c.missedHealthChecks = 0
+	c.healthMu.Unlock()
+	
+	if deadPeer != nil {
+		deadPeer.Start()
+	}
+	
+	// Start packet forwarding; packets from the TUN interface are already
+	// being read and go out over whichever connection is current
+	_, firstPacket := protocol.Tracer().Start(ctx, "first_packet")
+	go c.forwardPacketsFromServer(connCtx, firstPacket)
+	if paths != nil {
+		c.maintainPaths(connCtx, paths, firstPath)
+	}
+	
+	// Start health check
+	if c.config.HealthCheckInterval > 0 {
+		go c.healthCheckRoutine(connCtx)
+	}
+	
+	// Replace the session keys from time to time
+	go c.rekeyRoutine(connCtx)
+	
+	return nil
+}
+
+// setLastError records the outcome of a connect attempt
+func (c *VPNClient) setLastError(err error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.lastErr = err
+}
+
+// lastError returns why the last connect attempt failed, or nil
+func (c *VPNClient) lastError() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.lastErr
+}
+
+// connectionStart returns when the current connection was established, or
+// the zero time while disconnected
+func (c *VPNClient) connectionStart() time.Time {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.connCtx == nil || c.connCtx.Err() != nil {
+		return time.Time{}
+	}
+	return c.connectedAt
+}
+
+// connContext returns the context of the current connection, or nil before the first
+func (c *VPNClient) connContext() context.Context {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.connCtx
+}
+
+// isConnected reports whether the current connection is up
+func (c *VPNClient) isConnected() bool {
+	ctx := c.connContext()
+	return ctx != nil && ctx.Err() == nil
+}
+
+// discoverPublicIP asks the STUN server for our public address. Once the
+// TUN interface is up the query would go through the tunnel and come back
+// with the server's address, so reconnects keep the address found before.
+// Failing to find it only leaves the server without it.
+func (c *VPNClient) discoverPublicIP(ctx context.Context) {
+	if c.currentTunInterface() != nil {
+		return
+	}
+	
+	ctx, cancel := context.WithTimeout(ctx, stunTimeout)
+	defer cancel()
+	ip, err := nat.DiscoverPublicIP(ctx, c.config.STUNServer)
+	if err != nil {
+		slog.Warn("Failed to discover public address", "stun_server", c.config.STUNServer, "error", err)
+		return
+	}
+	slog.Info("Discovered public address", "address", ip.String())
+	c.publicIP = ip
+}
+
+// ensureTunInterface creates the TUN interface unless it already exists, so
+// that reconnecting keeps the adapter and its routes
+func (c *VPNClient) ensureTunInterface(ctx context.Context) error {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	if c.tunInterface != nil {
+		return nil
+	}
+	
+	if err := c.createTunInterface(ctx); err != nil {
+		return err
+	}
+	
+	c.sendQueue = protocol.NewSendQueue(c.config.SendQueueSize, c.sendPolicy)
+	go c.forwardPacketsToServer(c.tunInterface, c.sendQueue)
+	go c.sendQueuedPackets(c.sendQueue)
+	return nil
+}
+
+// currentTunInterface returns the TUN interface, or nil if there is none
+func (c *VPNClient) currentTunInterface() *tunDevice {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	return c.tunInterface
+}
+
+// closeTunInterface closes iface and forgets it if it is still current
+func (c *VPNClient) closeTunInterface(iface *tunDevice) {
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	iface.Close()
+	if c.tunInterface == iface {
+		c.forgetTunInterface()
+	}
+}
+
+// forgetTunInterface drops the TUN interface, so the next connect creates
+// a new one, and the DNS policy set for it; tunMu must be held
+func (c *VPNClient) forgetTunInterface() {
+	c.tunInterface = nil
+	// Queries would go nowhere without the tunnel
+	if c.appliedDNS != nil {
+		if err := removeNRPTRules(); err != nil {
+			slog.Warn("Failed to remove DNS policy", "error", err)
+		}
+		c.appliedDNS = nil
+	}
+}
+
+// openTun and configureTun create the TUN interface and apply the tunnel
+// settings to it. Variables so tests can stand in for the system.
+var (
+	openTun      = (*VPNClient).openTunDevice
+	configureTun = (*VPNClient).configureTunInterface
+)
+
+// openTunDevice creates the TUN interface, on Windows with the driver
+// tun_driver picks
+func (c *VPNClient) openTunDevice() (*tunDevice, error) {
+	if runtime.GOOS == "windows" && selectTunDriver(c.config.TunDriver, wintunAvailable) == tunDriverWinTUN {
+		slog.Info("Using the WinTUN driver")
+		return openWinTUN()
+	}
+	
+	// water opens the TAP driver in TUN mode on Windows
+	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		return nil, err
+	}
+	return newTunDevice(iface), nil
+}
+
+// createTunInterface creates and configures the TUN interface. An
+// interface that cannot be configured, or whose configuration ctx cancels,
+// is closed rather than kept for reconnects to reuse.
+func (c *VPNClient) createTunInterface(ctx context.Context) error {
+	iface, err := openTun(c)
+	if err != nil {
+		return err
+	}
+	
+	c.tunInterface = iface
+	c.appliedIPv4 = ""
+	c.appliedIPv6 = ""
+	c.appliedRoutes = make(map[string]bool)
+	c.appliedDNS = nil
+	
+	// Configure interface IP
+	if err := configureTun(c, ctx); err != nil {
+		iface.Close()
+		c.forgetTunInterface()
+		return err
+	}
+	
+	slog.Info("Created TUN interface", "name", iface.Name())
+	return nil
+}
+
+// configureTunInterface configures the TUN interface with IP settings
+func (c *VPNClient) configureTunInterface(ctx context.Context) error {
+	switch runtime.GOOS {
+	case "windows":
+		// Windows-specific configuration using netsh
+		return c.configureWindowsInterface(ctx)
+	case "linux":
+		return c.configureLinuxInterface(ctx)
+	}
+	
+	// Other Unix configuration would go here
+	return nil
+}
+
+// tunnelSettings returns the settings pushed by the server, or the local
+// ones until it has pushed any
+func (c *VPNClient) tunnelSettings() protocol.TunnelConfig {
+	return protocol.MergeTunnelConfig(c.pushedConfig, protocol.TunnelConfig{
+		IPv4:   c.config.LocalIP,
+		IPv6:   c.config.LocalIP6,
+		DNS:    c.config.DNSServers,
+		Routes: c.config.AllowedIPs,
+	})
+}
+
+// wantedRoutes returns the route prefixes the settings send through the
+// tunnel, leaving out IPv6 ones when the tunnel has no IPv6 address
+func wantedRoutes(settings protocol.TunnelConfig) map[string]bool {
+	wanted := make(map[string]bool)
+	for _, route := range settings.Routes {
+		for _, prefix := range routePrefixes(route) {
+			if strings.Contains(prefix, ":") && settings.IPv6 == "" {
+				continue
+			}
+			wanted[prefix] = true
+		}
+	}
+	return wanted
+}
+
+// configureLinuxInterface brings the interface up on Linux with the
+// tunnel settings. DNS is left to the system's resolver configuration.
+func (c *VPNClient) configureLinuxInterface(ctx context.Context) error {
+	settings := c.tunnelSettings()
+	name := c.tunInterface.Name()
+	ip := func(args ...string) error {
+		if err := exec.CommandContext(ctx, "ip", args...).Run(); err != nil {
+			return fmt.Errorf("failed to run ip %v: %v", args, err)
+		}
+		return nil
+	}
+	
+	if err := ip("link", "set", name, "up"); err != nil {
+		return err
+	}
+	
+	if settings.IPv4 != c.appliedIPv4 {
+		if c.appliedIPv4 != "" {
+			ip("-4", "addr", "del", c.appliedIPv4+"/24", "dev", name)
+		}
+		if settings.IPv4 != "" {
+			if err := ip("-4", "addr", "add", settings.IPv4+"/24", "dev", name); err != nil {
+				return err
+			}
+		}
+		c.appliedIPv4 = settings.IPv4
+	}
+	if settings.IPv6 != c.appliedIPv6 {
+		if c.appliedIPv6 != "" {
+			ip("-6", "addr", "del", c.appliedIPv6+"/64", "dev", name)
+		}
+		if settings.IPv6 != "" {
+			if err := ip("-6", "addr", "add", settings.IPv6+"/64", "dev", name); err != nil {
+				return err
+			}
+		}
+		c.appliedIPv6 = settings.IPv6
+	}
+	
+	// Install the wanted routes and drop any that are no longer wanted
+	wanted := wantedRoutes(settings)
+	for prefix := range c.appliedRoutes {
+		if !wanted[prefix] {
+			ip("route", "del", prefix, "dev", name)
+			delete(c.appliedRoutes, prefix)
+		}
+	}
+	for prefix := range wanted {
+		if c.appliedRoutes[prefix] {
+			continue
+		}
+		if err := ip("route", "replace", prefix, "dev", name); err != nil {
+			return err
+		}
+		c.appliedRoutes[prefix] = true
+	}
+	
+	return nil
+}
+
+// configureWindowsInterface configures the interface on Windows with the
+// tunnel settings
+func (c *VPNClient) configureWindowsInterface(ctx context.Context) error {
+	settings := c.tunnelSettings()
+	name := c.tunInterface.Name()
+	netsh := func(args ...string) error {
+		if err := exec.CommandContext(ctx, "netsh", args...).Run(); err != nil {
+			return fmt.Errorf("failed to run netsh %v: %v", args, err)
+		}
+		return nil
+	}
+	
+	if settings.IPv4 != "" {
+		if err := netsh("interface", "ipv4", "set", "address", "name="+name, "static", settings.IPv4, "255.255.255.0"); err != nil {
+			return err
+		}
+	}
+	
+	// IPv6 is configured too so the tunnel is dual-stack
+	if settings.IPv6 != c.appliedIPv6 {
+		if c.appliedIPv6 != "" {
+			netsh("interface", "ipv6", "delete", "address", name, c.appliedIPv6)
+		}
+		if settings.IPv6 != "" {
+			if err := netsh("interface", "ipv6", "add", "address", name, settings.IPv6+"/64"); err != nil {
+				return err
+			}
+		}
+		c.appliedIPv6 = settings.IPv6
+	}
+	
+	// Prefer the tunnel over the physical adapter, for DNS too
+	families := []string{"ipv4"}
+	if settings.IPv6 != "" {
+		families = append(families, "ipv6")
+	}
+	for _, family := range families {
+		if err := netsh("interface", family, "set", "interface", name, "metric=1"); err != nil {
+			slog.Warn("Failed to set interface metric", "error", err)
+		}
+	}
+	
+	// Install the wanted routes and drop any that are no longer wanted
+	wanted := wantedRoutes(settings)
+	for prefix := range c.appliedRoutes {
+		if !wanted[prefix] {
+			netsh("interface", routeFamily(prefix), "delete", "route", prefix, name)
+			delete(c.appliedRoutes, prefix)
+		}
+	}
+	for prefix := range wanted {
+		if c.appliedRoutes[prefix] {
+			continue
+		}
+		if err := netsh("interface", routeFamily(prefix), "add", "route", prefix, name); err != nil {
+			return err
+		}
+		c.appliedRoutes[prefix] = true
+	}
+	
+	// Use the first resolver of each family
+	configured := map[string]bool{}
+	for _, server := range settings.DNS {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			continue
+		}
+		family := "ipv6"
+		if ip.To4() != nil {
+			family = "ipv4"
+		}
+		if configured[family] {
+			continue
+		}
+		configured[family] = true
+		
+		if err := netsh("interface", family, "set", "dnsservers", name, "static", server, "primary"); err != nil {
+			slog.Warn("Failed to set DNS server", "dns_server", server, "error", err)
+			continue
+		}
+		slog.Info("Using DNS server", "dns_server", server)
+	}
+	
+	// Send every query to the tunnel's resolvers, not just those Windows
+	// would have asked on this adapter
+	var resolvers []string
+	for _, server := range settings.DNS {
+		if net.ParseIP(server) != nil {
+			resolvers = append(resolvers, server)
+		}
+	}
+	if !slices.Equal(resolvers, c.appliedDNS) {
+		var err error
+		if len(resolvers) > 0 {
+			err = setNRPTRules(ctx, resolvers)
+		} else {
+			err = removeNRPTRules()
+		}
+		if err != nil {
+			slog.Warn("Failed to set DNS policy, queries may leak outside the tunnel", "error", err)
+		} else {
+			c.appliedDNS = resolvers
+		}
+	}
+	
+	return nil
+}
+
+// routePrefixes splits a default route into two halves, which take
+// precedence over the system's default route without replacing it
+func routePrefixes(route string) []string {
+	switch route {
+	case "0.0.0.0/0":
+		return []string{"0.0.0.0/1", "128.0.0.0/1"}
+	case "::/0":
+		return []string{"::/1", "8000::/1"}
+	}
+	return []string{route}
+}
+
+// routeFamily returns the netsh context for a route prefix
+func routeFamily(prefix string) string {
+	if strings.Contains(prefix, ":") {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// newServerList returns the configured servers for the selected transport
+func newServerList(config *ClientConfig) *protocol.ServerList {
+	if config.Transport == protocol.TransportUDP {
+		return protocol.NewServerList([]string{config.UDPServerAddr})
+	}
+	return protocol.NewServerList(append([]string{config.ServerURL}, config.ServerURLs...))
+}
+
+// connectToAnyServer tries each server, preferring the fastest reachable one,
+// until one completes the handshake
+func (c *VPNClient) connectToAnyServer(ctx context.Context) error {
+	candidates := c.servers.Candidates()
+	if len(candidates) == 0 {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("no server configured"))
+	}
+	
+	var lastErr error
+	for _, server := range candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		
+		if err := c.connectToServer(ctx, server); err != nil {
+			// Giving up is not the server's fault
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			slog.Warn("Server unreachable", "server", server, "error", err)
+			c.servers.MarkFailure(server)
+			continue
+		}
+		
+		if err := c.performKeyExchange(ctx); err != nil {
+			if ctx.Err() != nil {
+				c.transport.Close()
+				return ctx.Err()
+			}
+			lastErr = err
+			slog.Warn("Key exchange failed", "server", server, "error", err)
+			c.transport.Close()
+			c.servers.MarkFailure(server)
+			continue
+		}
+		
+		c.servers.MarkSuccess(server, time.Since(start))
+		c.serverURL = server
+		return nil
+	}
+	
+	return lastErr
+}
+
+// connectToServer establishes the transport to the server
+func (c *VPNClient) connectToServer(ctx context.Context, server string) (err error) {
+	ctx, span := protocol.Tracer().Start(ctx, "dial", trace.WithAttributes(attribute.String("server.address", server)))
+	defer func() { protocol.EndSpan(span, err) }()
+	
+	if c.config.Transport == protocol.TransportUDP {
+		return c.connectToServerUDP(ctx, server)
+	}
+	if c.config.Transport == protocol.TransportMeek {
+		return c.connectToServerMeek(ctx, server)
+	}
+	if c.config.Transport == protocol.TransportDoH {
+		return c.connectToServerDoH(ctx, server)
+	}
+	
+	// Parse server URL
+	u, err := url.Parse(server)
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	// The first connection of a multipath session uses the first local address
+	domain := c.fakeDomains.Next()
+	dialer := c.webSocketDialer(c.pathLocalAddr(0), domain)
+	header := c.upgradeHeader(domain)
+	if c.config.Transport == protocol.TransportWebRTC {
+		header.Set(protocol.TransportHeader, string(protocol.TransportWebRTC))
+	}
+	
+	// Present the session token from the last connection for fast resumption
+	if c.sessionToken != nil {
+		header.Set("Cookie", fmt.Sprintf("%s=%s", protocol.SessionCookieName,
+			base64.RawURLEncoding.EncodeToString(c.sessionToken)))
+	}
+	
+	// Let the server continue the trace
+	protocol.InjectHTTPTraceContext(ctx, header)
+	
+	// Add timing jitter
+	c.stealth.AddTimingJitter()
+	
+	// Connect
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(protocol.WithTLSHandshakeSpan(ctx), u.String(), header)
+	if err != nil {
+		err = vpnerr.FromDial(err, resp)
+		if ctx.Err() == nil {
+			c.fakeDomains.Failed(domain, err)
+		}
+		return err
+	}
+	c.fakeDomains.Succeeded(domain, time.Since(start))
+	
+	if c.config.Transport == protocol.TransportWebRTC {
+		return c.switchToWebRTC(ctx, conn, u.String())
+	}
+	
+	c.conn = conn
+	c.transport = c.chaos.Wrap(protocol.NewWebSocketTransport(conn))
+	slog.Info("Connected to server", "server", u.String())
+	return nil
+}
+
+// webSocketDialer returns a dialer for connections to the server naming
+// serverName in TLS, made from localAddr unless it is empty
+func (c *VPNClient) webSocketDialer(localAddr, serverName string) *websocket.Dialer {
+	// Create TLS config for stealth
+	tlsConfig := c.stealth.GetTLSConfig()
+	tlsConfig.ServerName = serverName
+	tlsConfig.InsecureSkipVerify = true // For testing - remove in production
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	
+	dialer := &websocket.Dialer{
+		TLSClientConfig: tlsConfig,
+		HandshakeTimeout: 15 * time.Second,
+	}
+	netDialer := &net.Dialer{}
+	if localAddr != "" {
+		netDialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localAddr)}
+	}
+	dialer.NetDialContext = tcpSocketOptions(c.config).DialContext(netDialer)
+	// The proxy is dialed from localAddr, so multipath still spreads over
+	// the local links
+	if c.upstreamProxy != nil {
+		dialer.Proxy = http.ProxyURL(c.upstreamProxy)
+	}
+	return dialer
+}
+
+// upgradeHeader returns the headers of a browser's WebSocket upgrade request
+// from a page on domain
+func (c *VPNClient) upgradeHeader(domain string) http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	header.Set("Accept-Language", "en-US,en;q=0.9")
+	header.Set("Accept-Encoding", "gzip, deflate, br")
+	header.Set("Origin", fmt.Sprintf("https://%s", domain))
+	header.Set("Sec-WebSocket-Protocol", "chat")
+	if c.config.FrontedHost != "" {
+		header.Set("Host", c.config.FrontedHost)
+	}
+	return header
+}
+
+// switchToWebRTC answers the server's WebRTC offer on the WebSocket
+// connection and moves to the data channel, closing the WebSocket
+func (c *VPNClient) switchToWebRTC(ctx context.Context, conn *websocket.Conn, server string) error {
+	defer conn.Close()
+	
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	
+	transport, err := webrtc.Dial(ctx, protocol.NewWebSocketTransport(conn), nil)
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("WebRTC setup failed: %v", err))
+	}
+	
+	c.conn = nil
+	c.transport = c.chaos.Wrap(transport)
+	slog.Info("Connected to server over WebRTC", "server", server)
+	return nil
+}
+
+// connectToServerUDP opens the UDP datagram transport to the server
+func (c *VPNClient) connectToServerUDP(ctx context.Context, server string) error {
+	transport, err := protocol.DialUDPWithOptions(ctx, &net.Dialer{}, server, udpSocketOptions(c.config))
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	// Open the session, presenting the token from the last connection if any
+	hello := protocol.Message{Type: protocol.HelloType, Data: c.sessionToken}
+	if err := protocol.WriteJSON(transport, hello); err != nil {
+		transport.Close()
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	c.conn = nil
+	c.transport = c.chaos.Wrap(transport)
+	slog.Info("Connected to server over UDP", "server", server)
+	return nil
+}
+
+// connectToServerMeek starts the meek transport, which reaches the server
+// by posting to the front domain on its CDN with the server as Host
+func (c *VPNClient) connectToServerMeek(ctx context.Context, server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	if c.config.MeekFrontDomain == "" {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("meek transport needs meek_front_domain"))
+	}
+	front := url.URL{Scheme: "https", Host: c.config.MeekFrontDomain, Path: u.Path}
+	host := u.Host
+	if c.config.FrontedHost != "" {
+		host = c.config.FrontedHost
+	}
+	
+	// The TLS connection is to the CDN, so it is the CDN's name we send
+	transport, err := protocol.DialMeek(protocol.MeekConfig{
+		URL:    front.String(),
+		Host:   host,
+		Header: c.requestHeader(ctx),
+		Client: c.httpClient(front.Hostname()),
+	})
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	c.conn = nil
+	c.transport = c.chaos.Wrap(transport)
+	slog.Info("Connected to server over meek", "server", server, "front", c.config.MeekFrontDomain)
+	return nil
+}
+
+// connectToServerDoH starts the DoH transport, which reaches the server
+// with DNS-over-HTTPS queries for names under its doh_domain
+func (c *VPNClient) connectToServerDoH(ctx context.Context, server string) error {
+	if c.config.DoHDomain == "" {
+		return vpnerr.Wrap(vpnerr.CategoryDial, fmt.Errorf("doh transport needs doh_domain"))
+	}
+	transport, err := protocol.DialDoH(protocol.DoHConfig{
+		URL:              server,
+		Domain:           c.config.DoHDomain,
+		Header:           c.requestHeader(ctx),
+		Client:           c.httpClient(c.fakeDomains.Next()),
+		QueriesPerSecond: c.config.DoHQueriesPerSecond,
+	})
+	if err != nil {
+		return vpnerr.Wrap(vpnerr.CategoryDial, err)
+	}
+	
+	c.conn = nil
+	c.transport = c.chaos.Wrap(transport)
+	slog.Info("Connected to server over DoH", "server", server, "domain", c.config.DoHDomain)
+	return nil
+}
+
+// httpClient returns a client for the transports carried in HTTP
+// requests, sending serverName in its TLS handshakes
+func (c *VPNClient) httpClient(serverName string) *http.Client {
+	tlsConfig := c.stealth.GetTLSConfig()
+	tlsConfig.ServerName = serverName
+	tlsConfig.InsecureSkipVerify = true // For testing - remove in production
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(c.upstreamProxy), // direct if nil
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 15 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			// Speak HTTP/2 when offering it, or a server choosing it
+			// could not be understood
+			ForceAttemptHTTP2: slices.Contains(tlsConfig.NextProtos, "h2"),
+		},
+	}
+}
+
+// requestHeader returns the headers sent with every request of the
+// transports carried in HTTP requests. They carry the session token and
+// trace context, as the WebSocket upgrade does.
+func (c *VPNClient) requestHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	header.Set("Accept-Language", "en-US,en;q=0.9")
+	if c.sessionToken != nil {
+		header.Set("Cookie", fmt.Sprintf("%s=%s", protocol.SessionCookieName,
+			base64.RawURLEncoding.EncodeToString(c.sessionToken)))
+	}
+	protocol.InjectHTTPTraceContext(ctx, header)
+	return header
+}
+
+// performKeyExchange performs X25519 key exchange with server
+func (c *VPNClient) performKeyExchange(ctx context.Context) (err error) {
+	// Every failure from here on is a failed handshake
+	defer func() { err = vpnerr.Wrap(vpnerr.CategoryHandshake, err) }()
+	
+	// The span switches to key_confirmation once the keys are agreed
+	_, span := protocol.Tracer().Start(ctx, "key_exchange")
+	defer func() { protocol.EndSpan(span, err) }()
+	
+	// Bound the handshake by ctx's deadline, and fail any blocked read or
+	// write as soon as ctx is cancelled
+	deadline, _ := ctx.Deadline()
+	c.transport.SetReadDeadline(deadline)
+	c.transport.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		c.transport.SetReadDeadline(time.Now())
+		c.transport.SetWriteDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() && err == nil {
+			// Cancelled just as the handshake finished; the deadlines are spent
+			err = ctx.Err()
+		}
+		if err == nil {
+			c.transport.SetReadDeadline(time.Time{})
+			c.transport.SetWriteDeadline(time.Time{})
+		}
+	}()
+	
+	// Receive server's public key, kept raw to authenticate it in a Noise
+	// handshake
+	hello, err := c.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	var serverKeyMsg protocol.KeyExchangeMessage
+	if err := json.Unmarshal(hello, &serverKeyMsg); err != nil {
+		return err
+	}
+	if err := protocol.CheckProtocolVersion("server", serverKeyMsg.Version); err != nil {
+		return err
+	}
+	
+	// The server skips the key exchange when it accepted our session token
+	if serverKeyMsg.Type == protocol.SessionResumedType {
+		encryption, err := protocol.ResumedEncryption(c.resumeSecret, serverKeyMsg.ResumeNonce)
+		c.clearSessionToken()
+		if err != nil {
+			return err
+		}
+		if err := encryption.SetCipher(c.cipher); err != nil {
+			return err
+		}
+		encryption.SetParallelThreshold(c.config.ParallelThreshold)
+		c.encryption = encryption
+		slog.Info("Session resumed without key exchange")
+		span.SetAttributes(attribute.Bool("session.resumed", true))
+		span.End()
+		_, span = protocol.Tracer().Start(ctx, "key_confirmation")
+		if err := c.receiveSessionToken(); err != nil {
+			return err
+		}
+		return c.receivePathToken()
+	}
+	c.clearSessionToken()
 	
-	// Create TUN interface
-	config := water.Config{
-		DeviceType: water.TUN,
+	if serverKeyMsg.Type != protocol.KeyExchangeType || len(serverKeyMsg.PublicKey) == 0 {
+		return fmt.Errorf("invalid server public key")
+	}
+	serverPublicKey := serverKeyMsg.PublicKey
+	if c.config.UseNoise && !serverKeyMsg.Noise {
+		return fmt.Errorf("server does not offer a Noise handshake")
 	}
 	
-	iface, err := water.New(config)
+	// Use our preferred compression only if the server offered it
+	compression := protocol.NegotiateCompression(serverKeyMsg.Compression, c.config.Compression)
+	compressor, err := protocol.NewCompressor(compression)
 	if err != nil {
 		return err
 	}
 	
-	c.tunInterface = iface
-	
-	// Configure interface IP
-	if err := c.configureTunInterface(); err != nil {
-		return err
-	}
+	// Batch packets over WebSocket if configured and the server can split
+	// batches; UDP datagrams stay one packet each
+	c.batching = serverKeyMsg.Batching && c.config.BatchIntervalMs > 0 && c.conn != nil
 	
-	log.Printf("Created TUN interface: %s", iface.Name())
+	// Bond further WebSocket connections if configured and the server allows
+	c.multipath = serverKeyMsg.Multipath && c.config.MultipathPaths > 1 && c.conn != nil
 	
-	// Connect to server
-	if err := c.connectToServer(); err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+	// Drop to one cipher, the one this CPU runs fastest, if configured and
+	// the server allows
+	cipher := protocol.CipherLayered
+	if c.config.SingleCipher {
+		preferred := c.config.Cipher
+		if preferred == "" {
+			preferred = protocol.PreferredCipher()
+		}
+		cipher = protocol.NegotiateCipher(serverKeyMsg.Ciphers, preferred)
+		slog.Info("Chose cipher", "cipher", cipher, "aes_hardware", protocol.HasAESHardware())
 	}
 	
-	// Perform key exchange
-	if err := c.performKeyExchange(); err != nil {
-		return fmt.Errorf("key exchange failed: %v", err)
+	// Send our public key, or ask for a Noise handshake, and the
+	// compression we picked
+	clientKeyMsg := protocol.KeyExchangeMessage{
+		Type:        protocol.KeyExchangeType,
+		Version:     protocol.ProtocolVersion,
+		Compression: []protocol.CompressionAlgorithm{compression},
+		Batching:    c.batching,
+		Multipath:   c.multipath,
+		KeyID:       c.config.PreSharedKeyID,
+		Noise:       c.config.UseNoise,
 	}
-	
-	c.connected = true
-	log.Println("Successfully connected to VPN server")
-	
-	// Start packet forwarding
-	go c.forwardPacketsToServer()
-	go c.forwardPacketsFromServer()
-	
-	// Start health check
-	if c.config.HealthCheckInterval > 0 {
-		go c.healthCheckRoutine()
+	if c.publicIP != nil {
+		clientKeyMsg.PublicIP = c.publicIP.String()
 	}
-	
-	return nil
-}
-
-// createTunInterface creates and configures the TUN interface
-func (c *VPNClient) createTunInterface() error {
-	// Create TUN interface
-	config := water.Config{
-		DeviceType: water.TUN,
+	if cipher != protocol.CipherLayered {
+		clientKeyMsg.Ciphers = []string{cipher}
 	}
+	var kx *protocol.KeyExchange
+	if !c.config.UseNoise {
+		kx, err = protocol.NewKeyExchange()
+		if err != nil {
+			return err
+		}
+		clientKeyMsg.PublicKey = kx.GetPublicKey()
+	}
+	c.keyExchange = kx
 	
-	iface, err := water.New(config)
+	reply, err := json.Marshal(clientKeyMsg)
 	if err != nil {
 		return err
 	}
-	
-	c.tunInterface = iface
-	
-	// Configure interface IP
-	if err := c.configureTunInterface(); err != nil {
+	if err := c.transport.WriteMessage(reply); err != nil {
 		return err
 	}
 	
-	log.Printf("Created TUN interface: %s", iface.Name())
-	return nil
-}
-
-// configureTunInterface configures the TUN interface with IP settings
-func (c *VPNClient) configureTunInterface() error {
-	if runtime.GOOS == "windows" {
-		// Windows-specific configuration using netsh
-		return c.configureWindowsInterface()
+	var transcript []byte
+	if c.config.UseNoise {
+		// The prologue covers the options negotiated in the clear
+		noiseSession, err := protocol.NoiseHandshake(c.transport, true, c.noiseKey, c.noisePin, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return err
+		}
+		c.encryption, transcript = noiseSession.Encryption, noiseSession.Transcript
+	} else {
+		// Compute shared secret, bound to both messages of the handshake
+		sharedSecret, err := kx.ComputeSharedSecret(serverPublicKey, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return err
+		}
+		
+		// Create session encryption
+		sessionEncryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
+		if err != nil {
+			return err
+		}
+		c.encryption = sessionEncryption
+		transcript = protocol.HandshakeTranscript(serverPublicKey, kx.GetPublicKey())
 	}
 	
-	// Linux/Unix configuration would go here
-	return nil
-}
-
-// configureWindowsInterface configures the interface on Windows
-func (c *VPNClient) configureWindowsInterface() error {
-	// This would typically use Windows API calls or netsh commands
-	// For now, we'll provide instructions to the user
-	log.Printf("Please configure the network interface manually:")
-	log.Printf("IP Address: %s", c.config.LocalIP)
-	log.Printf("Subnet Mask: 255.255.255.0")
-	log.Printf("DNS Servers: %v", c.config.DNSServers)
-	
-	return nil
-}
-
-// connectToServer establishes WebSocket connection to server
-func (c *VPNClient) connectToServer() error {
-	// Parse server URL
-	u, err := url.Parse(c.config.ServerURL)
-	if err != nil {
+	if err := c.encryption.SetCipher(cipher); err != nil {
 		return err
 	}
+	c.encryption.SetParallelThreshold(c.config.ParallelThreshold)
+	c.cipher = cipher
+	c.compressor = compressor
+	slog.Info("Key exchange completed successfully")
 	
-	// Create TLS config for stealth
-	tlsConfig := c.stealth.GetTLSConfig()
-	tlsConfig.ServerName = c.config.FakeDomainName
-	tlsConfig.InsecureSkipVerify = true // For testing - remove in production
+	// The first encrypted messages prove both sides derived the same keys
+	span.End()
+	_, span = protocol.Tracer().Start(ctx, "key_confirmation")
 	
-	// Create WebSocket dialer
-	dialer := websocket.Dialer{
-		TLSClientConfig: tlsConfig,
-		HandshakeTimeout: 15 * time.Second,
+	// Log in before the server starts the session
+	if serverKeyMsg.AuthRequired {
+		if err := c.login(transcript); err != nil {
+			return err
+		}
 	}
 	
-	// Create fake WebSocket upgrade request
-	header := make(http.Header)
-	header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-	header.Set("Accept-Language", "en-US,en;q=0.9")
-	header.Set("Accept-Encoding", "gzip, deflate, br")
-	header.Set("Origin", fmt.Sprintf("https://%s", c.config.FakeDomainName))
-	header.Set("Sec-WebSocket-Protocol", "chat")
-	
-	// Add timing jitter
-	c.stealth.AddTimingJitter()
-	
-	// Connect
-	conn, _, err := dialer.Dial(u.String(), header)
-	if err != nil {
-		return err
+	if serverKeyMsg.SessionResumption {
+		if err := c.receiveSessionToken(); err != nil {
+			return err
+		}
 	}
-	
-	c.conn = conn
-	log.Printf("Connected to server: %s", u.String())
-	return nil
+	return c.receivePathToken()
 }
 
-// performKeyExchange performs X25519 key exchange with server
-func (c *VPNClient) performKeyExchange() error {
-	// Create key exchange
-	kx, err := protocol.NewKeyExchange()
+// login sends the client's credentials, encrypted with the session key, and
+// waits for the server to accept them. Which of them the server checks
+// depends on its configuration; the PSK proof covers transcript.
+func (c *VPNClient) login(transcript []byte) error {
+	credentials, err := json.Marshal(protocol.AuthRequest{
+		Type:     protocol.AuthType,
+		Username: c.config.Username,
+		Password: c.config.Password,
+		OTP:      c.config.OTP,
+		PSKProof: protocol.PSKProof(c.pskKey, transcript),
+	})
 	if err != nil {
 		return err
 	}
-	c.keyExchange = kx
-	
-	// Receive server's public key
-	var serverKeyMsg map[string]interface{}
-	if err := c.conn.ReadJSON(&serverKeyMsg); err != nil {
+	encrypted, err := c.encryption.Encrypt(credentials)
+	protocol.ZeroBytes(credentials)
+	if err != nil {
 		return err
 	}
 	
-	serverPublicKey, ok := serverKeyMsg["public_key"].([]byte)
-	if !ok {
-		return fmt.Errorf("invalid server public key")
+	if err := protocol.WriteJSON(c.transport, protocol.Message{Type: protocol.AuthType, Data: encrypted}); err != nil {
+		return err
 	}
 	
-	// Send our public key
-	clientKeyMsg := map[string]interface{}{
-		"type": "key_exchange",
-		"public_key": kx.GetPublicKey(),
+	var result protocol.Message
+	if err := protocol.ReadJSON(c.transport, &result); err != nil {
+		return err
+	}
+	if result.Type != protocol.AuthResultType {
+		return fmt.Errorf("unexpected message type: %s", result.Type)
+	}
+	if result.Error != "" {
+		return vpnerr.Wrap(vpnerr.CategoryAuth, fmt.Errorf("login rejected: %s", result.Error))
 	}
 	
-	if err := c.conn.WriteJSON(clientKeyMsg); err != nil {
+	slog.Info("Authenticated with the server")
+	return nil
+}
+
+// receiveSessionToken stores the single-use token the server issues for the next reconnect
+func (c *VPNClient) receiveSessionToken() error {
+	var tokenMsg protocol.Message
+	if err := protocol.ReadJSON(c.transport, &tokenMsg); err != nil {
 		return err
 	}
 	
-	// Compute shared secret
-	sharedSecret, err := kx.ComputeSharedSecret(serverPublicKey)
-	if err != nil {
-		return err
+	if tokenMsg.Type != protocol.SessionTokenType {
+		return fmt.Errorf("unexpected message type: %s", tokenMsg.Type)
 	}
 	
-	// Create session encryption
-	sessionEncryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
+	plaintext, err := c.encryption.Decrypt(tokenMsg.Data)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid session token: %v", err)
+	}
+	if len(plaintext) != protocol.SessionTokenSize+protocol.ResumeSecretSize {
+		protocol.ZeroBytes(plaintext)
+		return fmt.Errorf("invalid session token length %d", len(plaintext))
 	}
 	
-	c.encryption = sessionEncryption
-	log.Println("Key exchange completed successfully")
+	c.sessionToken = plaintext[:protocol.SessionTokenSize]
+	c.resumeSecret = plaintext[protocol.SessionTokenSize:]
 	return nil
 }
 
-// forwardPacketsToServer forwards packets from TUN to server
-func (c *VPNClient) forwardPacketsToServer() {
-	buffer := make([]byte, 1500) // Standard MTU
+// clearSessionToken forgets the session token, which is single-use, and
+// wipes its resumption secret
+func (c *VPNClient) clearSessionToken() {
+	protocol.ZeroBytes(c.resumeSecret)
+	c.sessionToken = nil
+	c.resumeSecret = nil
+}
+
+// forwardPacketsToServer queues packets from TUN for the current
+// connection for as long as the interface exists. The queue decouples
+// reading from a connection that may fall behind.
+func (c *VPNClient) forwardPacketsToServer(iface *tunDevice, queue *protocol.SendQueue) {
+	defer queue.Close()
 	
-	for c.connected {
+	for {
 		// Read packet from TUN interface
-		n, err := c.tunInterface.Read(buffer)
-		if err != nil {
-			log.Printf("Error reading from TUN: %v", err)
-			continue
-		}
-		
-		packet := make([]byte, n)
-		copy(packet, buffer[:n])
-		
-		// Encrypt packet
-		encrypted, err := c.encryption.Encrypt(packet)
+		buf := protocol.GetPacketBuffer()
+		n, err := iface.ReadPacket(*buf)
 		if err != nil {
-			log.Printf("Failed to encrypt packet: %v", err)
-			continue
+			// The interface is gone; the next connect creates a new one
+			protocol.PutPacketBuffer(buf)
+			slog.Error("Error reading from TUN", "error", err)
+			c.closeTunInterface(iface)
+			if connCtx := c.connContext(); connCtx != nil {
+				go c.handleDisconnection(connCtx)
+			}
+			return
 		}
 		
-		// Obfuscate packet
-		obfuscated, err := c.stealth.ObfuscatePacket(encrypted)
-		if err != nil {
-			log.Printf("Failed to obfuscate packet: %v", err)
+		// Drop packets while reconnecting
+		if connCtx := c.connContext(); connCtx == nil || connCtx.Err() != nil {
+			protocol.PutPacketBuffer(buf)
 			continue
 		}
 		
-		// Add timing jitter
-		c.stealth.AddTimingJitter()
-		
-		// Send to server
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, obfuscated); err != nil {
-			log.Printf("Failed to send packet to server: %v", err)
-			c.handleDisconnection()
+		*buf = (*buf)[:n]
+		c.sendDropped.Add(uint64(queue.Push(buf)))
+	}
+}
+
+// sendQueuedPackets sends the packets forwardPacketsToServer queued until
+// the queue is closed
+func (c *VPNClient) sendQueuedPackets(queue *protocol.SendQueue) {
+	for {
+		buf, ok := queue.Pop()
+		if !ok {
 			return
 		}
+		c.sendPacket(*buf)
+		protocol.PutPacketBuffer(buf)
+	}
+}
+
+// sendPacket compresses, encrypts and obfuscates a packet from TUN and
+// sends it over the current connection
+func (c *VPNClient) sendPacket(packet []byte) {
+	// Drop packets while reconnecting
+	connCtx := c.connContext()
+	if connCtx == nil || connCtx.Err() != nil {
+		return
+	}
+	
+	tracer := protocol.Tracer()
+	ctx, span := tracer.Start(connCtx, "forwardPacketsToServer")
+	
+	// Compress packet if negotiated
+	compressBuf := protocol.GetPacketBuffer()
+	compressed := c.compressor.Compress(*compressBuf, packet)
+	
+	// Encrypt packet into a pooled buffer
+	encryptBuf := protocol.GetPacketBuffer()
+	_, encryptSpan := tracer.Start(ctx, "MultiLayerEncryption.Encrypt")
+	encrypted, err := c.encryption.EncryptTo(*encryptBuf, compressed)
+	encryptSpan.End()
+	protocol.PutPacketBuffer(compressBuf)
+	if err != nil {
+		slog.Error("Failed to encrypt packet", "error", err)
+		protocol.PutPacketBuffer(encryptBuf)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
+	
+	// Obfuscate packet, carrying the trace context to the server
+	obfuscateBuf := protocol.GetPacketBuffer()
+	_, obfuscateSpan := tracer.Start(ctx, "ObfuscatePacket")
+	obfuscated, err := c.stealth.ObfuscatePacketWithTrace(ctx, *obfuscateBuf, encrypted)
+	obfuscateSpan.End()
+	protocol.PutPacketBuffer(encryptBuf)
+	if err != nil {
+		slog.Error("Failed to obfuscate packet", "error", err)
+		protocol.PutPacketBuffer(obfuscateBuf)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
 	}
+	
+	// Add timing jitter
+	c.stealth.AddTimingJitter()
+	
+	// Send to server; the frame is copied out before WriteMessage returns
+	_, sendSpan := tracer.Start(ctx, "WebSocket.WriteMessage")
+	err = protocol.WriteMessageContext(ctx, c.transport, obfuscated)
+	sendSpan.End()
+	protocol.PutPacketBuffer(obfuscateBuf)
+	if err != nil {
+		slog.Warn("Failed to send packet to server", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		go c.handleDisconnection(connCtx)
+		return
+	}
+	c.sent.Add(len(obfuscated))
+	
+	span.End()
 }
 
 // forwardPacketsFromServer forwards packets from server to TUN
-func (c *VPNClient) forwardPacketsFromServer() {
-	for c.connected {
+func (c *VPNClient) forwardPacketsFromServer(connCtx context.Context, firstPacket trace.Span) {
+	defer firstPacket.End()
+	
+	for connCtx.Err() == nil {
 		// Read message from server
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.transport.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from server: %v", err)
-			c.handleDisconnection()
+			slog.Warn("Error reading from server", "error", err)
+			protocol.EndSpan(firstPacket, err)
+			c.handleDisconnection(connCtx)
 			return
 		}
+		c.received.Add(len(message))
+		firstPacket.End()
+		
+		if c.deadPeer != nil {
+			c.deadPeer.MarkAlive()
+		}
 		
 		// Deobfuscate packet
 		deobfuscated, err := c.stealth.DeobfuscatePacket(message)
 		if err != nil {
-			log.Printf("Failed to deobfuscate packet: %v", err)
+			slog.Warn("Failed to deobfuscate packet", "error", err)
+			continue
+		}
+		
+		// Decrypt packet in place
+		decrypted, err := c.encryption.DecryptInPlace(deobfuscated)
+		if err != nil {
+			slog.Warn("Failed to decrypt packet", "error", err)
 			continue
 		}
 		
-		// Decrypt packet
-		decrypted, err := c.encryption.Decrypt(deobfuscated)
+		// Decompress packet
+		decompressed, err := c.compressor.Decompress(decrypted)
 		if err != nil {
-			log.Printf("Failed to decrypt packet: %v", err)
+			slog.Warn("Failed to decompress packet", "error", err)
+			continue
+		}
+		
+		// Health check acks and stream messages are not IP packets
+		if protocol.IsControlMessage(decompressed) {
+			c.handleControlMessage(decompressed)
+			continue
+		}
+		
+		iface := c.currentTunInterface()
+		if iface == nil {
 			continue
 		}
 		
 		// Write to TUN interface
-		if _, err := c.tunInterface.Write(decrypted); err != nil {
-			log.Printf("Failed to write to TUN: %v", err)
+		if err := iface.WritePacket(decompressed); err != nil {
+			slog.Warn("Failed to write to TUN", "error", err)
 			continue
 		}
 	}
 }
 
+// handleControlMessage dispatches a JSON message received inside the tunnel
+func (c *VPNClient) handleControlMessage(payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid control message from server", "error", err)
+		return
+	}
+	
+	switch msg.Type {
+	case protocol.HealthCheckAckType:
+		c.handleHealthCheckAck(payload)
+	case protocol.TunnelConfigType:
+		c.handleTunnelConfig(payload)
+	case protocol.RekeyType:
+		c.finishRekey(msg)
+	case protocol.QuotaExceededType:
+		// The server closes the session next; reconnects fail until the quota is reset
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	case protocol.SessionLimitType:
+		// Reconnects succeed once one of the user's other sessions ends
+		slog.Warn("Server ended the session", "reason", msg.Error)
+	default:
+		// Everything else belongs to the SOCKS5 proxy
+		if c.socks != nil {
+			c.socks.handleMessage(payload)
+		}
+	}
+}
+
+// handleTunnelConfig reconfigures the TUN interface with the addresses,
+// resolvers and routes the server pushed, which replace the local ones
+func (c *VPNClient) handleTunnelConfig(payload []byte) {
+	var config protocol.TunnelConfig
+	if err := json.Unmarshal(payload, &config); err != nil {
+		slog.Error("Invalid tunnel config from server", "error", err)
+		return
+	}
+	slog.Info("Server assigned tunnel addresses", "ipv4", config.IPv4, "ipv6", config.IPv6, "routes", config.Routes)
+	
+	c.tunMu.Lock()
+	defer c.tunMu.Unlock()
+	
+	c.pushedConfig = &config
+	if c.tunInterface == nil {
+		return
+	}
+	if err := c.configureTunInterface(context.Background()); err != nil {
+		slog.Error("Failed to apply tunnel config", "error", err)
+	}
+}
+
+// sendControl sends a JSON message to the server through the tunnel
+func (c *VPNClient) sendControl(msg interface{}) error {
+	connCtx := c.connContext()
+	if connCtx == nil {
+		return fmt.Errorf("not connected")
+	}
+	
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	
+	// Compress, encrypt and obfuscate into pooled buffers
+	compressBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(compressBuf)
+	compressed := c.compressor.Compress(*compressBuf, payload)
+	
+	encryptBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(encryptBuf)
+	encrypted, err := c.encryption.EncryptTo(*encryptBuf, compressed)
+	if err != nil {
+		return err
+	}
+	
+	obfuscateBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(obfuscateBuf)
+	obfuscated, err := c.stealth.ObfuscatePacketTo(*obfuscateBuf, encrypted)
+	if err != nil {
+		return err
+	}
+	
+	if err := protocol.WriteMessageContext(connCtx, c.transport, obfuscated); err != nil {
+		return err
+	}
+	c.sent.Add(len(obfuscated))
+	return nil
+}
+
 // healthCheckRoutine periodically checks connection health
-func (c *VPNClient) healthCheckRoutine() {
+func (c *VPNClient) healthCheckRoutine(connCtx context.Context) {
 	ticker := time.NewTicker(time.Duration(c.config.HealthCheckInterval) * time.Second)
 	defer ticker.Stop()
 	
-	for range ticker.C {
-		if !c.connected {
-			continue
+	for {
+		select {
+		case <-connCtx.Done():
+			return
+		case <-ticker.C:
 		}
 		
-		// Send ping to server
-		ping := []byte("ping")
-		encrypted, err := c.encryption.Encrypt(ping)
-		if err != nil {
-			continue
+		// A check still pending a full interval later has timed out
+		now := time.Now().UnixNano()
+		c.healthMu.Lock()
+		if c.healthCheckPending != 0 {
+			c.missedHealthChecks++
 		}
+		missed := c.missedHealthChecks
+		c.healthCheckPending = now
+		c.healthMu.Unlock()
 		
-		obfuscated, err := c.stealth.ObfuscatePacket(encrypted)
-		if err != nil {
-			continue
+		if missed >= maxMissedHealthChecks {
+			slog.Warn("Health checks timed out, attempting reconnection", "missed", missed)
+			c.handleDisconnection(connCtx)
+			return
 		}
 		
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, obfuscated); err != nil {
-			log.Println("Health check failed, attempting reconnection...")
-			c.handleDisconnection()
+		// Send health check to server
+		check := protocol.HealthCheck{Type: protocol.HealthCheckType, Timestamp: now}
+		if err := c.sendControl(check); err != nil {
+			slog.Warn("Health check failed, attempting reconnection")
+			c.handleDisconnection(connCtx)
+			return
 		}
 	}
 }
 
-// handleDisconnection handles connection loss and reconnection
-func (c *VPNClient) handleDisconnection() {
-	c.connected = false
+// handleHealthCheckAck records the round-trip time and the server's session stats
+func (c *VPNClient) handleHealthCheckAck(payload []byte) {
+	var ack protocol.HealthCheckAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		slog.Warn("Invalid health check ack", "error", err)
+		return
+	}
+	
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	
+	// Ignore acks for checks that already timed out
+	if ack.Echo != c.healthCheckPending {
+		return
+	}
+	
+	rtt := time.Since(time.Unix(0, ack.Echo))
+	c.servers.MarkSuccess(c.serverURL, rtt)
+	c.stealth.ObserveRTT(rtt)
+	c.stats = ack.Stats
+	c.stats.LatencyMs = float64(rtt) / float64(time.Millisecond)
+	c.healthCheckPending = 0
+	c.missedHealthChecks = 0
+}
+
+// handleDisconnection handles loss of the connection identified by connCtx
+// and reconnects. Only the first caller per connection does anything.
+func (c *VPNClient) handleDisconnection(connCtx context.Context) {
+	c.connMu.Lock()
+	if connCtx.Err() != nil {
+		c.connMu.Unlock()
+		return
+	}
+	c.connCancel()
+	c.connMu.Unlock()
+	
+	// The server drops its end of every stream with the tunnel
+	if c.socks != nil {
+		c.socks.reset()
+	}
+	
+	if c.deadPeer != nil {
+		c.deadPeer.Stop()
+	}
 	
-	if c.conn != nil {
-		c.conn.Close()
+	if c.transport != nil {
+		c.transport.Close()
 	}
 	
 	if c.config.AutoConnect {
-		log.Printf("Reconnecting in %d seconds...", c.config.ReconnectDelay)
-		time.Sleep(time.Duration(c.config.ReconnectDelay) * time.Second)
+		c.reconnect()
+	}
+}
+
+// reconnect retries until connected or Disconnect is called. Each attempt
+// walks the whole server list, and the delay between attempts grows so that
+// an outage of every server does not turn into a reconnect storm.
+func (c *VPNClient) reconnect() {
+	backoff := protocol.NewBackoff(time.Duration(c.config.ReconnectDelay)*time.Second, protocol.MaxReconnectDelay)
+	
+	// Disconnect also interrupts an attempt in progress
+	ctx, cancel := c.doneContext()
+	defer cancel()
+	
+	for {
+		delay := backoff.Next()
+		slog.Info("Reconnecting", "delay", delay)
+		
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 		
-		if err := c.Connect(); err != nil {
-			log.Printf("Reconnection failed: %v", err)
+		if err := c.ConnectContext(ctx); err != nil {
+			slog.Warn("Reconnection failed", "error", err)
+			continue
 		}
+		return
 	}
 }
 
+// doneContext returns a context that is cancelled when Disconnect is called
+func (c *VPNClient) doneContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := c.done
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // Disconnect closes the VPN connection
 func (c *VPNClient) Disconnect() {
-	c.connected = false
+	c.doneOnce.Do(func() { close(c.done) })
 	
-	if c.conn != nil {
-		c.conn.Close()
+	c.connMu.Lock()
+	if c.connCancel != nil {
+		c.connCancel()
 	}
+	c.connMu.Unlock()
 	
-	if c.tunInterface != nil {
-		c.tunInterface.Close()
+	if c.deadPeer != nil {
+		c.deadPeer.Stop()
 	}
 	
-	log.Println("Disconnected from VPN server")
+	if c.transport != nil {
+		c.transport.Close()
+	}
+	
+	if iface := c.currentTunInterface(); iface != nil {
+		c.closeTunInterface(iface)
+	}
+	
+	if c.socks != nil {
+		c.socks.Stop()
+	}
+	
+	slog.Info("Disconnected from VPN server")
 }
 
 // GetStats returns connection statistics
 func (c *VPNClient) GetStats() map[string]interface{} {
-	return map[string]interface{}{
-		"connected": c.connected,
-		"server_url": c.config.ServerURL,
+	c.healthMu.Lock()
+	stats := c.stats
+	c.healthMu.Unlock()
+	
+	result := map[string]interface{}{
+		"connected": c.isConnected(),
+		"server_url": c.serverURL,
+		"reachable_servers": c.servers.Reachable(),
 		"local_ip": c.config.LocalIP,
+		"cipher": c.cipher,
+		"aes_hardware": protocol.HasAESHardware(),
+		"latency_ms": stats.LatencyMs,
+		"bytes_sent": c.sent.Total(),
+		"bytes_received": c.received.Total(),
+		"send_rate_bps": c.sent.Rate() * 8,
+		"receive_rate_bps": c.received.Rate() * 8,
+		"send_queue_dropped": c.sendDropped.Load(),
+	}
+	c.tunMu.Lock()
+	if c.sendQueue != nil {
+		result["send_queue_depth"] = c.sendQueue.Len()
 	}
+	c.tunMu.Unlock()
+	if paths := c.currentPaths(); paths != nil {
+		result["paths"] = paths.Paths()
+	}
+	if links := c.linkQualities(); len(links) > 0 {
+		stats := make([]map[string]interface{}, len(links))
+		for i, link := range links {
+			stats[i] = map[string]interface{}{
+				"rtt_ms": float64(link.RTT) / float64(time.Millisecond),
+				"rtt_var_ms": float64(link.RTTVar) / float64(time.Millisecond),
+				"loss": link.Loss,
+			}
+		}
+		result["links"] = stats
+	}
+	if c.socks != nil {
+		result["socks5_flows"] = c.socks.Flows()
+	}
+	
+	if connectedAt := c.connectionStart(); !connectedAt.IsZero() {
+		result["connected_since"] = connectedAt
+		result["connected_seconds"] = time.Since(connectedAt).Seconds()
+	}
+	
+	// Let callers tell an unreachable server from a rejected handshake
+	if err := c.lastError(); err != nil {
+		result["error"] = err.Error()
+		result["error_category"] = vpnerr.CategoryOf(err)
+	}
+	
+	return result
+}
+
+// linkQualities returns the round-trip time and loss measured on each
+// connection to the server
+func (c *VPNClient) linkQualities() []protocol.LinkQuality {
+	c.connMu.Lock()
+	paths, deadPeer := c.paths, c.deadPeer
+	c.connMu.Unlock()
+	
+	if paths != nil {
+		return paths.LinkQualities()
+	}
+	if deadPeer != nil {
+		return []protocol.LinkQuality{deadPeer.Quality()}
+	}
+	return nil
+}
+
+// publishPipelineStats reports the load on the packet pipeline in the
+// profiling server's /debug/vars
+func (c *VPNClient) publishPipelineStats() {
+	profiling.Publish("tun_write_queue", func() interface{} {
+		c.tunMu.Lock()
+		defer c.tunMu.Unlock()
+		if c.tunInterface == nil {
+			return 0
+		}
+		return c.tunInterface.Queued()
+	})
+	profiling.Publish("queued_frames", func() interface{} {
+		if paths := c.currentPaths(); paths != nil {
+			return paths.QueueDepth()
+		}
+		return 0
+	})
 }
 
 // loadConfig loads client configuration from file
@@ -398,44 +1910,119 @@ func loadConfig(filename string) (*ClientConfig, error) {
 		return nil, err
 	}
 	
+	// Prefer a key kept out of the config file
+	config.PreSharedKey, err = protocol.ResolvePreSharedKey(config.PreSharedKey, config.PreSharedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if config.Cipher != "" && config.Cipher != protocol.CipherAESGCM && config.Cipher != protocol.CipherChaCha20 {
+		return nil, fmt.Errorf("unknown cipher %q", config.Cipher)
+	}
+	
 	return &config, nil
 }
 
 func main() {
+	// Subcommands come before the client's own flags
+	if len(os.Args) > 1 && os.Args[1] == "import-ovpn" {
+		if err := runImportOpenVPN(os.Args[2:]); err != nil {
+			logging.Fatal("import-ovpn failed", "error", err)
+		}
+		return
+	}
+	
 	var (
 		configFile = flag.String("config", "client-config.json", "Configuration file path")
 		serverURL  = flag.String("server", "", "VPN server URL (overrides config)")
 		gui        = flag.Bool("gui", false, "Start with GUI (Windows only)")
+		sampleRate = flag.Float64("trace-sample-rate", protocol.DefaultTraceSampleRate, "Fraction of packets to trace when an OTLP endpoint is configured")
+		socksAddr  = flag.String("socks5", "", "Run a local SOCKS5 proxy on this address instead of creating a TUN interface")
+		importWG   = flag.String("import-wg", "", "Convert a WireGuard config into the file given by -config and exit")
+		otp        = flag.String("otp", "", "One-time code for servers using TOTP authentication")
+		pprofAddr  = flag.String("pprof", "", "Serve pprof and expvar on this loopback address, such as 127.0.0.1:6060")
+		chaosSpec  = flag.String("chaos", "", "Drop, delay and corrupt frames sent to the server for testing, such as drop=0.05,delay=200ms,corrupt=0.01")
+		logLevel   = flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+		logFormat  = flag.String("log-format", "text", "Log as text or json")
 	)
 	flag.Parse()
 	
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		logging.Fatal("Invalid logging flags", "error", err)
+	}
+	
+	if *importWG != "" {
+		if err := importWireGuardConfig(*importWG, *configFile); err != nil {
+			logging.Fatal("Failed to import WireGuard config", "error", err)
+		}
+		slog.Info("Wrote configuration", "file", *configFile)
+		return
+	}
+	
 	// Load configuration
 	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		logging.Fatal("Failed to load config", "error", err)
 	}
+	slog.Debug("Loaded configuration", "file", *configFile, "config", logging.Redacted(config))
 	
 	// Override server URL if provided
 	if *serverURL != "" {
 		config.ServerURL = *serverURL
+		config.ServerURLs = nil
+	}
+	if *otp != "" {
+		config.OTP = *otp
+	}
+	
+	// Set up tracing
+	shutdownTracing, err := protocol.InitTracing(context.Background(), "stealthvpn-client", config.OTLPEndpoint, *sampleRate)
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
 	}
 	
 	// Create client
 	client, err := NewVPNClient(config)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		logging.Fatal("Failed to create client", "error", err)
+	}
+	
+	if *chaosSpec != "" {
+		client.chaos, err = protocol.ParseChaosConfig(*chaosSpec)
+		if err != nil {
+			logging.Fatal("Invalid -chaos", "error", err)
+		}
+		slog.Warn("Chaos mode: degrading connections", "chaos", *chaosSpec)
+	}
+	
+	// Let operators profile the client
+	if *pprofAddr != "" {
+		if err := profiling.Serve(*pprofAddr); err != nil {
+			logging.Fatal("Failed to start profiling", "error", err)
+		}
+		client.publishPipelineStats()
 	}
 	
 	// Start GUI if requested
 	if *gui && runtime.GOOS == "windows" {
-		log.Println("Starting GUI mode...")
+		slog.Info("Starting GUI mode")
 		// TODO: Implement Windows GUI
-		log.Println("GUI mode not implemented yet, falling back to CLI")
+		slog.Warn("GUI mode not implemented yet, falling back to CLI")
+	}
+	
+	if addr := socksListenAddr(*socksAddr, config); addr != "" {
+		client.socks = newSocksProxy(client, addr)
 	}
 	
 	// Connect to VPN
 	if err := client.Connect(); err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+		logging.Fatal("Failed to connect", "error", err)
+	}
+	
+	// Accept proxy clients once the tunnel is up
+	if client.socks != nil {
+		if err := client.socks.Start(); err != nil {
+			logging.Fatal("Failed to start SOCKS5 proxy", "error", err)
+		}
 	}
 	
 	// Handle graceful shutdown
@@ -444,12 +2031,13 @@ func main() {
 	
 	go func() {
 		<-sigChan
-		log.Println("Shutting down client...")
+		slog.Info("Shutting down client")
 		client.Disconnect()
+		shutdownTracing(context.Background())
 		os.Exit(0)
 	}()
 	
 	// Keep running
-	log.Println("VPN client is running. Press Ctrl+C to exit.")
+	slog.Info("VPN client is running. Press Ctrl+C to exit.")
 	select {}
 } 
\ No newline at end of file
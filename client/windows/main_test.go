@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// fakeTun is a TUN interface with no packets, readable until closed
+type fakeTun struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeTun() *fakeTun {
+	return &fakeTun{closed: make(chan struct{})}
+}
+
+func (f *fakeTun) ReadPacket(buf []byte) (int, error) {
+	<-f.closed
+	return 0, net.ErrClosed
+}
+
+func (f *fakeTun) WritePacket(packet []byte) error { return nil }
+func (f *fakeTun) Queued() int                     { return 0 }
+
+func (f *fakeTun) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeTun) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// stubTun replaces the system's TUN interfaces for the test with fakes
+// that configure runs on. It returns the interfaces opened so far.
+func stubTun(t *testing.T, configure func(c *VPNClient, ctx context.Context) error) func() []*fakeTun {
+	t.Helper()
+	var mu sync.Mutex
+	var opened []*fakeTun
+	savedOpen, savedConfigure := openTun, configureTun
+	openTun = func(c *VPNClient) (*tunDevice, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		tun := newFakeTun()
+		opened = append(opened, tun)
+		return &tunDevice{name: "faketun", iface: tun, packetQueue: tun}, nil
+	}
+	configureTun = configure
+	t.Cleanup(func() { openTun, configureTun = savedOpen, savedConfigure })
+
+	return func() []*fakeTun {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*fakeTun(nil), opened...)
+	}
+}
+
+// newTunTestClient returns a client that has not connected
+func newTunTestClient(t *testing.T) *VPNClient {
+	t.Helper()
+	c := &VPNClient{config: &ClientConfig{}, sendPolicy: protocol.QueueDropNewest}
+	t.Cleanup(func() {
+		if iface := c.currentTunInterface(); iface != nil {
+			c.closeTunInterface(iface)
+		}
+	})
+	return c
+}
+
+func TestTunInterfaceKeptAcrossReconnects(t *testing.T) {
+	opened := stubTun(t, func(*VPNClient, context.Context) error { return nil })
+	c := newTunTestClient(t)
+
+	if err := c.ensureTunInterface(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := c.currentTunInterface()
+	if err := c.ensureTunInterface(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.currentTunInterface() != first || len(opened()) != 1 {
+		t.Fatalf("reconnect created another interface: %d opened", len(opened()))
+	}
+
+	// Losing the interface makes the next connect create a new one
+	c.closeTunInterface(first)
+	if err := c.ensureTunInterface(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.currentTunInterface() == first || len(opened()) != 2 {
+		t.Fatalf("closed interface was reused: %d opened", len(opened()))
+	}
+}
+
+func TestTunInterfaceDroppedWhenConfigureFails(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	opened := stubTun(t, func(*VPNClient, context.Context) error {
+		if fail.Load() {
+			return errors.New("netsh failed")
+		}
+		return nil
+	})
+	c := newTunTestClient(t)
+
+	if err := c.ensureTunInterface(context.Background()); err == nil {
+		t.Fatal("connected with an unconfigured interface")
+	}
+	if c.currentTunInterface() != nil || !opened()[0].isClosed() {
+		t.Fatal("unconfigured interface was kept")
+	}
+
+	// The reconnect tries again instead of reusing the broken interface
+	fail.Store(false)
+	if err := c.ensureTunInterface(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.currentTunInterface() == nil || len(opened()) != 2 {
+		t.Fatalf("reconnect did not create a new interface: %d opened", len(opened()))
+	}
+}
+
+func TestTunInterfaceDroppedWhenConnectCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opened := stubTun(t, func(_ *VPNClient, ctx context.Context) error {
+		// As ConnectContext's caller giving up during the netsh calls
+		cancel()
+		return ctx.Err()
+	})
+	c := newTunTestClient(t)
+
+	if err := c.ensureTunInterface(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ensureTunInterface() error = %v, want %v", err, context.Canceled)
+	}
+	if c.currentTunInterface() != nil || !opened()[0].isClosed() {
+		t.Fatal("interface whose configuration was cancelled was kept")
+	}
+}
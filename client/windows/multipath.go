@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/vpnerr"
+)
+
+// receivePathToken stores the token for joining further connections to the
+// session, which the server sends when it agreed to multipath
+func (c *VPNClient) receivePathToken() error {
+	c.pathToken = nil
+	if !c.multipath {
+		return nil
+	}
+
+	var tokenMsg protocol.Message
+	if err := protocol.ReadJSON(c.transport, &tokenMsg); err != nil {
+		return err
+	}
+	if tokenMsg.Type != protocol.PathTokenType {
+		return fmt.Errorf("unexpected message type: %s", tokenMsg.Type)
+	}
+
+	token, err := c.encryption.Decrypt(tokenMsg.Data)
+	if err != nil {
+		return fmt.Errorf("invalid multipath token: %v", err)
+	}
+	if len(token) != protocol.PathTokenSize {
+		return fmt.Errorf("invalid multipath token length %d", len(token))
+	}
+	c.pathToken = token
+	return nil
+}
+
+// startMultipath moves the connection onto a multipath transport with the
+// current connection as its first path, whose drop channel it returns
+func (c *VPNClient) startMultipath() (*protocol.MultipathTransport, <-chan struct{}, error) {
+	paths := protocol.NewMultipathTransport(c.config.MultipathPaths)
+	paths.SetKeepalive(time.Duration(c.config.KeepaliveInterval)*time.Second, c.config.DeadPeerIntervals)
+	paths.SetRTTObserver(c.stealth.ObserveRTT)
+	first, err := paths.AddPath(c.transport)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.transport = paths
+	slog.Info("Bonding connections to the server", "paths", c.config.MultipathPaths)
+	return paths, first, nil
+}
+
+// maintainPaths keeps every path of the connection bonded. The first path,
+// already connected, is replaced once first is closed.
+func (c *VPNClient) maintainPaths(connCtx context.Context, paths *protocol.MultipathTransport, first <-chan struct{}) {
+	server, token := c.serverURL, c.pathToken
+	for slot := 0; slot < c.config.MultipathPaths; slot++ {
+		var dropped <-chan struct{}
+		if slot == 0 {
+			dropped = first
+		}
+		go c.maintainPath(connCtx, paths, server, token, slot, dropped)
+	}
+}
+
+// maintainPath keeps a connection from the slot's local address bonded into
+// the session, joining a new one whenever it drops, until connCtx is done
+func (c *VPNClient) maintainPath(connCtx context.Context, paths *protocol.MultipathTransport, server string, token []byte, slot int, dropped <-chan struct{}) {
+	backoff := protocol.NewBackoff(time.Second, protocol.MaxReconnectDelay)
+	for {
+		if dropped != nil {
+			select {
+			case <-dropped:
+				slog.Warn("Connection to the server dropped", "path", slot+1)
+			case <-connCtx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(backoff.Next()):
+		case <-connCtx.Done():
+			return
+		}
+
+		var err error
+		if dropped, err = c.joinPath(connCtx, paths, server, token, c.pathLocalAddr(slot)); err != nil {
+			if connCtx.Err() == nil {
+				slog.Warn("Failed to bond connection", "path", slot+1, "error", err)
+			}
+			continue
+		}
+		slog.Info("Bonded connection into the session", "path", slot+1)
+		backoff.Reset()
+	}
+}
+
+// joinPath opens a connection from localAddr that joins the session with
+// token, and adds it to paths. It returns the path's drop channel.
+func (c *VPNClient) joinPath(ctx context.Context, paths *protocol.MultipathTransport, server string, token []byte, localAddr string) (<-chan struct{}, error) {
+	domain := c.fakeDomains.Next()
+	header := c.upgradeHeader(domain)
+	header.Set("Cookie", fmt.Sprintf("%s=%s", protocol.PathCookieName,
+		base64.RawURLEncoding.EncodeToString(token)))
+
+	c.stealth.AddTimingJitter()
+	conn, resp, err := c.webSocketDialer(localAddr, domain).DialContext(ctx, server, header)
+	if err != nil {
+		return nil, vpnerr.FromDial(err, resp)
+	}
+	transport := c.chaos.Wrap(protocol.NewWebSocketTransport(conn))
+
+	// The server confirms the session exists before sending frames
+	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	var joined protocol.Message
+	if err := protocol.ReadJSON(transport, &joined); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if joined.Type != protocol.PathJoinedType {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected message type: %s", joined.Type)
+	}
+
+	done, err := paths.AddPath(transport)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return done, nil
+}
+
+// pathLocalAddr returns the local address for the connection in slot,
+// cycling through multipath_local_addrs; empty lets the system pick
+func (c *VPNClient) pathLocalAddr(slot int) string {
+	addrs := c.config.MultipathLocalAddrs
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[slot%len(addrs)]
+}
+
+// currentPaths returns the multipath transport of the current connection,
+// or nil if it has only one
+func (c *VPNClient) currentPaths() *protocol.MultipathTransport {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.paths
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// nrptComment marks the Name Resolution Policy Table rules the client
+	// creates, so it removes only its own, including any left by a crash
+	nrptComment = "stealthvpn"
+	// nrptTimeout bounds how long PowerShell may take to change the rules
+	nrptTimeout = 30 * time.Second
+)
+
+// powershell runs a PowerShell command
+func powershell(ctx context.Context, command string) error {
+	output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run PowerShell %q: %v: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// setNRPTRules sends every DNS query to servers with an NRPT rule for the
+// "." namespace. Windows otherwise asks the resolvers of every adapter at
+// once and takes the first answer, so queries leak through the physical
+// adapter even with the tunnel's DNS servers set.
+func setNRPTRules(ctx context.Context, servers []string) error {
+	ctx, cancel := context.WithTimeout(ctx, nrptTimeout)
+	defer cancel()
+
+	quoted := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid DNS server %q", server)
+		}
+		quoted = append(quoted, "'"+server+"'")
+	}
+	return powershell(ctx, nrptRemoveCommand+"; "+
+		fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.' -NameServers %s -Comment '%s'; ", strings.Join(quoted, ","), nrptComment)+
+		"Clear-DnsClientCache")
+}
+
+// removeNRPTRules removes the rules setNRPTRules created
+func removeNRPTRules() error {
+	ctx, cancel := context.WithTimeout(context.Background(), nrptTimeout)
+	defer cancel()
+	return powershell(ctx, nrptRemoveCommand+"; Clear-DnsClientCache")
+}
+
+// nrptRemoveCommand removes the client's NRPT rules
+var nrptRemoveCommand = fmt.Sprintf("Get-DnsClientNrptRule | Where-Object Comment -eq '%s' | Remove-DnsClientNrptRule -Force", nrptComment)
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"stealthvpn/pkg/config/openvpn"
+	"stealthvpn/pkg/protocol"
+)
+
+// openVPNCiphers maps OpenVPN data-channel ciphers to the single cipher
+// closest to them. Others, such as the CBC ones, have no equivalent and
+// leave both layers in use.
+var openVPNCiphers = map[string]string{
+	"AES-128-GCM":       protocol.CipherAESGCM,
+	"AES-192-GCM":       protocol.CipherAESGCM,
+	"AES-256-GCM":       protocol.CipherAESGCM,
+	"CHACHA20-POLY1305": protocol.CipherChaCha20,
+}
+
+// runImportOpenVPN is the import-ovpn subcommand
+func runImportOpenVPN(args []string) error {
+	flags := flag.NewFlagSet("import-ovpn", flag.ExitOnError)
+	input := flags.String("input", "", "OpenVPN config (.ovpn) to convert")
+	output := flags.String("output", "client-config.json", "Client config to write")
+	flags.Parse(args)
+
+	if *input == "" {
+		return errors.New("--input is required")
+	}
+	if err := importOpenVPNConfig(*input, *output); err != nil {
+		return err
+	}
+	slog.Info("Wrote configuration", "file", *output)
+	return nil
+}
+
+// importOpenVPNConfig converts an OpenVPN config into a client config and
+// writes it to output, with the client certificate and key, if any, in
+// files beside it. Directives with no equivalent are logged and dropped.
+func importOpenVPNConfig(path, output string) error {
+	ovpn, err := openvpn.ParseFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	config := convertOpenVPNConfig(ovpn)
+
+	for _, directive := range ovpn.Unsupported {
+		slog.Warn("OpenVPN directive has no StealthVPN equivalent", "file", path, "directive", directive)
+	}
+	if ovpn.CA != "" {
+		slog.Warn("The CA is not imported; the client does not check the server certificate against a CA", "file", path)
+	}
+	if ovpn.TLSAuth != "" {
+		slog.Warn("The tls-auth or tls-crypt key is not imported; the pre-shared key takes its place", "file", path)
+	}
+	if ovpn.AuthUserPass {
+		slog.Warn("The server asked for a username and password; set username and password if the StealthVPN server requires a login", "output", output)
+	}
+	slog.Warn("Set pre_shared_key or pre_shared_key_file, or STEALTHVPN_PSK, to the server's key", "output", output)
+
+	// The certificate and key go beside the config, as client_cert_file
+	// and client_key_file
+	if ovpn.Cert != "" && ovpn.Key != "" {
+		base := strings.TrimSuffix(output, filepath.Ext(output))
+		config.ClientCertFile, config.ClientKeyFile = base+".crt", base+".key"
+		if err := writeNewFile(config.ClientCertFile, []byte(ovpn.Cert)); err != nil {
+			return err
+		}
+		if err := writeNewFile(config.ClientKeyFile, []byte(ovpn.Key)); err != nil {
+			return err
+		}
+	}
+
+	return writeNewConfig(output, config)
+}
+
+// convertOpenVPNConfig maps the settings of an OpenVPN config onto a client
+// config
+func convertOpenVPNConfig(ovpn *openvpn.Config) *ClientConfig {
+	config := &ClientConfig{
+		DNSServers:          ovpn.DNS,
+		LocalIP:             ovpn.LocalIP,
+		AllowedIPs:          ovpn.AllowedIPs(),
+		AutoConnect:         true,
+		ReconnectDelay:      5,
+		HealthCheckInterval: 30,
+		FakeDomainName:      "api.cloudsync-enterprise.com",
+		KeepaliveInterval:   ovpn.KeepaliveInterval,
+		Transport:           protocol.TransportWebSocket,
+		UpstreamProxy:       ovpn.Proxy,
+	}
+
+	// The first remote is the server, the rest its failovers
+	for i, remote := range ovpn.Remotes {
+		addr := net.JoinHostPort(remote.Host, strconv.Itoa(remote.Port))
+		serverURL := fmt.Sprintf("wss://%s/ws", addr)
+		if i == 0 {
+			config.ServerURL = serverURL
+			if remote.Proto == "udp" {
+				config.UDPServerAddr = addr
+			}
+		} else {
+			config.ServerURLs = append(config.ServerURLs, serverURL)
+		}
+	}
+
+	if ovpn.KeepaliveInterval > 0 && ovpn.KeepaliveTimeout > 0 {
+		config.DeadPeerIntervals = (ovpn.KeepaliveTimeout + ovpn.KeepaliveInterval - 1) / ovpn.KeepaliveInterval
+	}
+
+	if ovpn.Cipher != "" {
+		if cipher, ok := openVPNCiphers[ovpn.Cipher]; ok {
+			config.SingleCipher, config.Cipher = true, cipher
+		} else {
+			slog.Warn("OpenVPN cipher has no StealthVPN equivalent; both encryption layers will be used", "cipher", ovpn.Cipher)
+		}
+	}
+
+	switch ovpn.Compression {
+	case "", "stub", "stub-v2":
+	case "lz4", "lz4-v2":
+		config.Compression = protocol.CompressionLZ4
+	default:
+		slog.Warn("OpenVPN compression has no StealthVPN equivalent; packets will be sent uncompressed", "compression", ovpn.Compression)
+	}
+
+	return config
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// echoServer is a TLS WebSocket server echoing each message back
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// mockProxy records what clients asked it for
+type mockProxy struct {
+	addr string
+
+	mu          sync.Mutex
+	targets     []string
+	credentials []string // user:pass of each connection, "" without
+}
+
+func (p *mockProxy) record(target, credentials string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = append(p.targets, target)
+	p.credentials = append(p.credentials, credentials)
+}
+
+func (p *mockProxy) seen() ([]string, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...), append([]string(nil), p.credentials...)
+}
+
+// startMockProxy accepts connections, handing each to handshake, which
+// returns where the client wants to go, then relays to there
+func startMockProxy(t *testing.T, handshake func(p *mockProxy, conn net.Conn, r *bufio.Reader) (string, error)) *mockProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := &mockProxy{addr: listener.Addr().String()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				target, err := handshake(p, conn, r)
+				if err != nil {
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, r)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return p
+}
+
+// httpConnect answers an HTTP CONNECT request
+func httpConnect(p *mockProxy, conn net.Conn, r *bufio.Reader) (string, error) {
+	request, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	credentials := ""
+	if auth, ok := strings.CutPrefix(request.Header.Get("Proxy-Authorization"), "Basic "); ok {
+		decoded, _ := base64.StdEncoding.DecodeString(auth)
+		credentials = string(decoded)
+	}
+	p.record(request.Host, credentials)
+	if request.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return "", io.EOF
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return request.Host, err
+}
+
+// socks5Connect answers a SOCKS5 CONNECT request, taking a username and
+// password if the client offers them (RFC 1929)
+func socks5Connect(p *mockProxy, conn net.Conn, r *bufio.Reader) (string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	credentials := ""
+	if strings.IndexByte(string(methods), 0x02) >= 0 {
+		conn.Write([]byte{0x05, 0x02})
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", err
+		}
+		user := make([]byte, header[1])
+		io.ReadFull(r, user)
+		passLen, _ := r.ReadByte()
+		pass := make([]byte, passLen)
+		if _, err := io.ReadFull(r, pass); err != nil {
+			return "", err
+		}
+		credentials = string(user) + ":" + string(pass)
+		conn.Write([]byte{0x01, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x00})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		length, _ := r.ReadByte()
+		name := make([]byte, length)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return "", io.EOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	p.record(target, credentials)
+	_, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return target, err
+}
+
+func TestDialThroughUpstreamProxy(t *testing.T) {
+	server := echoServer(t)
+	serverAddr := server.Listener.Addr().String()
+
+	for _, test := range []struct {
+		scheme    string
+		handshake func(p *mockProxy, conn net.Conn, r *bufio.Reader) (string, error)
+		userinfo  string
+	}{
+		{"http", httpConnect, ""},
+		{"http", httpConnect, "alice:s3cret"},
+		{"socks5", socks5Connect, ""},
+		{"socks5", socks5Connect, "alice:s3cret"},
+	} {
+		t.Run(test.scheme+"/"+test.userinfo, func(t *testing.T) {
+			proxy := startMockProxy(t, test.handshake)
+			proxyURL := test.scheme + "://" + proxy.addr
+			if test.userinfo != "" {
+				proxyURL = test.scheme + "://" + test.userinfo + "@" + proxy.addr
+			}
+			c, err := NewVPNClient(&ClientConfig{
+				PreSharedKey:  "0123456789abcdef0123456789abcdef",
+				UpstreamProxy: proxyURL,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, _, err := c.webSocketDialer("", "example.com").Dial("wss://"+serverAddr+"/ws", nil)
+			if err != nil {
+				t.Fatalf("dial through %s proxy: %v", test.scheme, err)
+			}
+			defer conn.Close()
+
+			// TLS and WebSocket framing run end to end through the tunnel
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+				t.Fatalf("echo through proxy = %q, %v", data, err)
+			}
+
+			targets, credentials := proxy.seen()
+			if len(targets) != 1 || targets[0] != serverAddr {
+				t.Errorf("proxy asked for %v, want [%s]", targets, serverAddr)
+			}
+			if len(credentials) != 1 || credentials[0] != test.userinfo {
+				t.Errorf("proxy given credentials %q, want %q", credentials, test.userinfo)
+			}
+		})
+	}
+}
+
+func TestDialWithoutProxyGoesDirect(t *testing.T) {
+	server := echoServer(t)
+	c, err := NewVPNClient(&ClientConfig{PreSharedKey: "0123456789abcdef0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := c.webSocketDialer("", "example.com").Dial("wss://"+server.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestParseUpstreamProxyRejects(t *testing.T) {
+	for _, config := range []*ClientConfig{
+		{UpstreamProxy: "ftp://proxy.example:21"},
+		{UpstreamProxy: "http://"},
+		{UpstreamProxy: "socks5://proxy.example:1080", Transport: protocol.TransportUDP},
+	} {
+		if _, err := parseUpstreamProxy(config); err == nil {
+			t.Errorf("parseUpstreamProxy(%q, transport %q) accepted", config.UpstreamProxy, config.Transport)
+		}
+	}
+}
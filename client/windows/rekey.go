@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// rekeyCheckInterval is how often the client checks whether the session
+// keys are due to be replaced
+const rekeyCheckInterval = 10 * time.Second
+
+// rekeyRoutine starts a rekey whenever the session keys have protected
+// rekey_bytes or been in use for rekey_interval minutes, until connCtx is
+// done. Servers that do not rekey never answer, and the keys stay.
+func (c *VPNClient) rekeyRoutine(connCtx context.Context) {
+	limit := uint64(protocol.DefaultRekeyBytes)
+	if c.config.RekeyBytes > 0 {
+		limit = uint64(c.config.RekeyBytes)
+	}
+	interval := protocol.DefaultRekeyInterval
+	if c.config.RekeyInterval > 0 {
+		interval = time.Duration(c.config.RekeyInterval) * time.Minute
+	}
+
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-connCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		encryption := c.encryption
+		if !encryption.RekeyDue(limit, interval) {
+			continue
+		}
+		publicKey, err := encryption.StartRekey()
+		if err != nil {
+			slog.Warn("Failed to start rekey", "error", err)
+			continue
+		}
+		if err := c.sendControl(protocol.Message{Type: protocol.RekeyType, Data: publicKey}); err != nil {
+			slog.Warn("Failed to start rekey", "error", err)
+		}
+	}
+}
+
+// finishRekey switches to the keys agreed with the server's answer and
+// confirms under them, so the server switches too
+func (c *VPNClient) finishRekey(msg protocol.Message) {
+	if err := c.encryption.FinishRekey(msg.Data); err != nil {
+		slog.Warn("Failed to rekey session", "error", err)
+		return
+	}
+	if err := c.sendControl(protocol.Message{Type: protocol.RekeyType}); err != nil {
+		slog.Warn("Failed to confirm rekey", "error", err)
+		return
+	}
+	slog.Info("Session rekeyed")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/socks5"
+)
+
+const (
+	// socksHandshakeTimeout bounds how long a local client may take to send its request
+	socksHandshakeTimeout = 30 * time.Second
+	// socksOpenTimeout bounds how long the server may take to open a stream
+	socksOpenTimeout = 30 * time.Second
+	// socksWriteTimeout bounds how long a slow local client may stall the tunnel
+	socksWriteTimeout = 30 * time.Second
+	// socksReadSize is how much local data is carried per stream message
+	socksReadSize = 16 * 1024
+	// defaultSOCKS5Port is where enable_socks5 listens without socks5_port
+	defaultSOCKS5Port = 1080
+)
+
+// errStreamClosed is returned when a stream ends before the server answered
+var errStreamClosed = errors.New("stream closed")
+
+// socksStream is a local SOCKS5 connection tunneled to the server
+type socksStream struct {
+	conn    net.Conn     // the CONNECT connection, or the control connection of a UDP association
+	udp     *net.UDPConn // local relay socket of a UDP association
+	opened  chan string  // receives the server's open result, empty on success
+	network string
+	target  string // empty for UDP associations, whose datagrams each name one
+	since   time.Time
+
+	sent     atomic.Uint64 // bytes from the local client into the tunnel
+	received atomic.Uint64 // bytes from the tunnel to the local client
+
+	peerMu sync.Mutex
+	peer   *net.UDPAddr // where the local client sends its datagrams from
+}
+
+// close releases the stream's local sockets
+func (s *socksStream) close() {
+	s.conn.Close()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// socksProxy serves SOCKS5 locally and carries each session through the VPN
+// link as a stream, so the server dials the target instead of routing IP
+// packets from a TUN interface
+type socksProxy struct {
+	client     *VPNClient
+	listenAddr string
+	listener   net.Listener
+
+	mu      sync.Mutex
+	streams map[uint32]*socksStream
+	nextID  uint32
+}
+
+// socksListenAddr returns where the SOCKS5 proxy should listen: the -socks5
+// flag if given, else the loopback port of enable_socks5, else "" for none
+func socksListenAddr(flagAddr string, config *ClientConfig) string {
+	if flagAddr != "" || !config.EnableSOCKS5 {
+		return flagAddr
+	}
+	port := config.SOCKS5Port
+	if port == 0 {
+		port = defaultSOCKS5Port
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// newSocksProxy creates a SOCKS5 front-end for client listening on listenAddr
+func newSocksProxy(client *VPNClient, listenAddr string) *socksProxy {
+	return &socksProxy{
+		client:     client,
+		listenAddr: listenAddr,
+		streams:    make(map[uint32]*socksStream),
+	}
+}
+
+// Start begins accepting SOCKS5 clients
+func (p *socksProxy) Start() error {
+	listener, err := net.Listen("tcp", p.listenAddr)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+
+	slog.Info("SOCKS5 proxy listening", "addr", listener.Addr())
+	go p.acceptLoop()
+	return nil
+}
+
+// Stop closes the listener and every open stream
+func (p *socksProxy) Stop() {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.reset()
+}
+
+// acceptLoop hands each local connection to its own goroutine
+func (p *socksProxy) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handleConn(conn)
+	}
+}
+
+// handleConn reads a SOCKS5 request and serves it
+func (p *socksProxy) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	request, err := socks5.Handshake(conn)
+	if err != nil {
+		slog.Warn("SOCKS5 handshake failed", "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch request.Command {
+	case socks5.CmdConnect:
+		p.handleConnect(conn, request.Target)
+	case socks5.CmdUDPAssociate:
+		p.handleUDPAssociate(conn)
+	default:
+		socks5.WriteReply(conn, socks5.ReplyCommandNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// handleConnect tunnels a TCP connection to target
+func (p *socksProxy) handleConnect(conn net.Conn, target string) {
+	stream := &socksStream{conn: conn, opened: make(chan string, 1)}
+	id, err := p.open(stream, "tcp", target)
+	if err != nil {
+		slog.Warn("SOCKS5 connect failed", "target", target, "error", err)
+		socks5.WriteReply(conn, socks5.ReplyHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+
+	if err := socks5.WriteReply(conn, socks5.ReplySucceeded, conn.LocalAddr()); err != nil {
+		p.closeStream(id, true)
+		return
+	}
+
+	buffer := make([]byte, socksReadSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+		msg := protocol.Message{Type: protocol.StreamDataType, StreamID: id, Data: buffer[:n]}
+		if err := p.client.sendControl(msg); err != nil {
+			break
+		}
+		stream.sent.Add(uint64(n))
+	}
+
+	p.closeStream(id, true)
+}
+
+// handleUDPAssociate relays datagrams for as long as the control connection stays open
+func (p *socksProxy) handleUDPAssociate(conn net.Conn) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socks5.WriteReply(conn, socks5.ReplyGeneralFailure, nil)
+		conn.Close()
+		return
+	}
+
+	stream := &socksStream{conn: conn, udp: udp, opened: make(chan string, 1)}
+	id, err := p.open(stream, "udp", "")
+	if err != nil {
+		slog.Warn("SOCKS5 UDP associate failed", "error", err)
+		socks5.WriteReply(conn, socks5.ReplyGeneralFailure, nil)
+		stream.close()
+		return
+	}
+
+	if err := socks5.WriteReply(conn, socks5.ReplySucceeded, udp.LocalAddr()); err != nil {
+		p.closeStream(id, true)
+		return
+	}
+
+	go p.relayDatagrams(id, stream, conn.RemoteAddr().(*net.TCPAddr).IP)
+
+	// The association ends when the client closes its control connection
+	io.Copy(io.Discard, conn)
+	p.closeStream(id, true)
+}
+
+// relayDatagrams sends datagrams from the local client through the tunnel
+func (p *socksProxy) relayDatagrams(id uint32, stream *socksStream, clientIP net.IP) {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := stream.udp.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// Only the client that opened the association may use it
+		if !addr.IP.Equal(clientIP) {
+			continue
+		}
+		stream.peerMu.Lock()
+		stream.peer = addr
+		stream.peerMu.Unlock()
+
+		target, payload, err := socks5.ParseUDPDatagram(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		msg := protocol.Message{Type: protocol.StreamDataType, StreamID: id, Target: target, Data: payload}
+		if err := p.client.sendControl(msg); err != nil {
+			return
+		}
+		stream.sent.Add(uint64(len(payload)))
+	}
+}
+
+// open registers a stream and waits for the server to open its end
+func (p *socksProxy) open(stream *socksStream, network, target string) (uint32, error) {
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	stream.network, stream.target, stream.since = network, target, time.Now()
+	p.streams[id] = stream
+	p.mu.Unlock()
+
+	msg := protocol.Message{Type: protocol.StreamOpenType, StreamID: id, Network: network, Target: target}
+	if err := p.client.sendControl(msg); err != nil {
+		p.remove(id)
+		return 0, err
+	}
+
+	select {
+	case result := <-stream.opened:
+		if result != "" {
+			p.remove(id)
+			return 0, errors.New(result)
+		}
+		return id, nil
+	case <-time.After(socksOpenTimeout):
+		p.closeStream(id, true)
+		return 0, errors.New("timed out waiting for the server")
+	}
+}
+
+// handleMessage processes a stream message received from the server
+func (p *socksProxy) handleMessage(payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid control message from server", "error", err)
+		return
+	}
+
+	p.mu.Lock()
+	stream := p.streams[msg.StreamID]
+	p.mu.Unlock()
+	if stream == nil {
+		return
+	}
+
+	switch msg.Type {
+	case protocol.StreamOpenedType:
+		select {
+		case stream.opened <- msg.Error:
+		default:
+		}
+	case protocol.StreamDataType:
+		if stream.udp != nil {
+			stream.peerMu.Lock()
+			peer := stream.peer
+			stream.peerMu.Unlock()
+			if peer == nil {
+				return
+			}
+			datagram, err := socks5.BuildUDPDatagram(msg.Target, msg.Data)
+			if err != nil {
+				return
+			}
+			if _, err := stream.udp.WriteToUDP(datagram, peer); err == nil {
+				stream.received.Add(uint64(len(msg.Data)))
+			}
+			return
+		}
+
+		stream.conn.SetWriteDeadline(time.Now().Add(socksWriteTimeout))
+		if _, err := stream.conn.Write(msg.Data); err != nil {
+			p.closeStream(msg.StreamID, true)
+			return
+		}
+		stream.received.Add(uint64(len(msg.Data)))
+	case protocol.StreamCloseType:
+		p.closeStream(msg.StreamID, false)
+	}
+}
+
+// remove unregisters a stream without closing it
+func (p *socksProxy) remove(id uint32) *socksStream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stream := p.streams[id]
+	delete(p.streams, id)
+	return stream
+}
+
+// closeStream closes a stream, telling the server if it is still open there
+func (p *socksProxy) closeStream(id uint32, notify bool) {
+	stream := p.remove(id)
+	if stream == nil {
+		return
+	}
+	stream.close()
+
+	if notify {
+		p.client.sendControl(protocol.Message{Type: protocol.StreamCloseType, StreamID: id})
+	}
+}
+
+// reset closes every stream; the server drops its end when the tunnel goes away
+func (p *socksProxy) reset() {
+	p.mu.Lock()
+	streams := p.streams
+	p.streams = make(map[uint32]*socksStream)
+	p.mu.Unlock()
+
+	for _, stream := range streams {
+		// Fail any open still waiting for the server
+		select {
+		case stream.opened <- errStreamClosed.Error():
+		default:
+		}
+		stream.close()
+	}
+}
+
+// Flows describes each open stream, for GetStats
+func (p *socksProxy) Flows() []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	flows := make([]map[string]interface{}, 0, len(p.streams))
+	for id, stream := range p.streams {
+		flows = append(flows, map[string]interface{}{
+			"id":             id,
+			"network":        stream.network,
+			"target":         stream.target,
+			"client":         stream.conn.RemoteAddr().String(),
+			"bytes_sent":     stream.sent.Load(),
+			"bytes_received": stream.received.Load(),
+			"open_seconds":   time.Since(stream.since).Seconds(),
+		})
+	}
+	return flows
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// TUN drivers the client can use on Windows, set with tun_driver
+const (
+	tunDriverAuto   = "auto"   // WinTUN if it is installed, TAP otherwise
+	tunDriverWinTUN = "wintun" // WireGuard's layer 3 driver, loaded from wintun.dll
+	tunDriverTAP    = "tap"    // OpenVPN's layer 2 TAP-Windows driver, tap0901
+)
+
+// validateTunDriver checks the tun_driver setting
+func validateTunDriver(driver string) error {
+	switch driver {
+	case "", tunDriverAuto, tunDriverWinTUN, tunDriverTAP:
+		return nil
+	}
+	return fmt.Errorf("invalid tun_driver %q: must be auto, wintun or tap", driver)
+}
+
+// selectTunDriver picks the driver for the configured tun_driver, given a
+// probe for WinTUN. WinTUN is preferred: it carries IP packets as they are,
+// where TAP emulates Ethernet around them, and it is faster. Without it the
+// client falls back to TAP, even if WinTUN was asked for.
+func selectTunDriver(configured string, wintunAvailable func() bool) string {
+	if configured == tunDriverTAP {
+		return tunDriverTAP
+	}
+	if wintunAvailable() {
+		return tunDriverWinTUN
+	}
+	if configured == tunDriverWinTUN {
+		slog.Warn("WinTUN is not installed, falling back to the TAP driver")
+	}
+	return tunDriverTAP
+}
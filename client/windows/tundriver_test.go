@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectTunDriver(t *testing.T) {
+	for _, tc := range []struct {
+		configured string
+		installed  bool
+		want       string
+	}{
+		{"", true, tunDriverWinTUN},
+		{tunDriverAuto, true, tunDriverWinTUN},
+		{tunDriverAuto, false, tunDriverTAP},
+		{tunDriverWinTUN, true, tunDriverWinTUN},
+		{tunDriverWinTUN, false, tunDriverTAP},
+		{tunDriverTAP, true, tunDriverTAP},
+	} {
+		probed := false
+		got := selectTunDriver(tc.configured, func() bool {
+			probed = true
+			return tc.installed
+		})
+		if got != tc.want {
+			t.Errorf("tun_driver %q with WinTUN installed %v selected %q, want %q", tc.configured, tc.installed, got, tc.want)
+		}
+		if tc.configured == tunDriverTAP && probed {
+			t.Error("WinTUN probed although TAP was configured")
+		}
+	}
+}
+
+func TestValidateTunDriver(t *testing.T) {
+	for _, driver := range []string{"", tunDriverAuto, tunDriverWinTUN, tunDriverTAP} {
+		if err := validateTunDriver(driver); err != nil {
+			t.Errorf("tun_driver %q rejected: %v", driver, err)
+		}
+	}
+	if err := validateTunDriver("tun"); err == nil {
+		t.Error("unknown tun_driver accepted")
+	}
+
+	config := &ClientConfig{ServerURL: "wss://127.0.0.1:1/ws", PreSharedKey: "0123456789abcdef0123456789abcdef", TunDriver: "WinTun"}
+	if _, err := NewVPNClient(config); err == nil || !strings.Contains(err.Error(), "tun_driver") {
+		t.Errorf("NewVPNClient() with an unknown tun_driver error = %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/songgao/water"
+)
+
+// errURingUnsupported means the platform has no io_uring
+var errURingUnsupported = errors.New("io_uring is only available on Linux")
+
+// packetQueue reads and writes whole packets on a TUN interface
+type packetQueue interface {
+	// ReadPacket reads the next packet into buf. Only one goroutine may read.
+	ReadPacket(buf []byte) (int, error)
+	// WritePacket writes a packet; the caller may reuse it once this returns
+	WritePacket(packet []byte) error
+	// Close stops the queue, leaving the interface itself open
+	Close() error
+	// Queued returns how many packets wait to be written
+	Queued() int
+}
+
+// tunDevice is a TUN interface and the queue its packets go through
+type tunDevice struct {
+	name  string
+	iface io.Closer
+	packetQueue
+}
+
+// newTunDevice wraps iface, batching its I/O through io_uring where the
+// kernel supports it and reading and writing it directly otherwise
+func newTunDevice(iface *water.Interface) *tunDevice {
+	queue, err := newURingQueue(iface)
+	if err != nil {
+		if err != errURingUnsupported {
+			slog.Info("io_uring unavailable, using blocking TUN I/O", "error", err)
+		}
+		queue = directQueue{iface}
+	}
+	return &tunDevice{name: iface.Name(), iface: iface, packetQueue: queue}
+}
+
+// Name returns the name of the interface
+func (d *tunDevice) Name() string {
+	return d.name
+}
+
+// Close stops the queue and closes the interface
+func (d *tunDevice) Close() error {
+	d.packetQueue.Close()
+	return d.iface.Close()
+}
+
+// directQueue does one read or write system call per packet
+type directQueue struct {
+	iface *water.Interface
+}
+
+func (q directQueue) ReadPacket(buf []byte) (int, error) {
+	return q.iface.Read(buf)
+}
+
+func (q directQueue) WritePacket(packet []byte) error {
+	_, err := q.iface.Write(packet)
+	return err
+}
+
+func (q directQueue) Close() error {
+	return nil
+}
+
+func (q directQueue) Queued() int {
+	return 0
+}
@@ -0,0 +1,318 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// uringReadDepth is how many reads are kept queued on the interface
+	uringReadDepth = 64
+	// uringWriteBatch is the most writes submitted at once
+	uringWriteBatch = 64
+	// uringPacketSize holds any packet under the interface MTU
+	uringPacketSize = 2048
+	// wakeRead is the user data of the read Close completes to interrupt
+	// a reader waiting for packets
+	wakeRead = uringReadDepth
+)
+
+// errWritesStopped means the writer hit an io_uring error and gave up
+var errWritesStopped = errors.New("TUN writes stopped")
+
+// uringQueue keeps reads queued on the TUN interface with io_uring and
+// submits writes in batches, so a burst of packets costs one system call
+// instead of one per packet. Reads and writes each have their own ring and
+// their own copy of the interface's descriptor, owned by the goroutine that
+// uses them.
+type uringQueue struct {
+	readMu     sync.Mutex // held by the reader, and by Close to release the read side
+	readFd     int
+	readRing   *uring
+	readBufs   [][]byte
+	readIovecs []unix.Iovec // one per buffer plus the wake read's
+	idle       []uint64     // buffers to queue reads on again
+	readClosed bool
+
+	writeFd     int
+	writeRing   *uring
+	writes      chan *[]byte // pooled copies of packets to write
+	writeFailed chan struct{}
+
+	wake      int // eventfd Close signals to complete the wake read
+	closed    atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newURingQueue sets up io_uring for iface. It fails where io_uring is
+// missing, as before Linux 5.1, or blocked, as in many containers.
+func newURingQueue(iface *water.Interface) (packetQueue, error) {
+	file, ok := iface.ReadWriteCloser.(*os.File)
+	if !ok {
+		return nil, errors.New("TUN interface is not a file")
+	}
+
+	q := &uringQueue{
+		readFd:      -1,
+		writeFd:     -1,
+		wake:        -1,
+		readBufs:    make([][]byte, uringReadDepth),
+		readIovecs:  make([]unix.Iovec, uringReadDepth+1),
+		writes:      make(chan *[]byte, uringWriteBatch),
+		writeFailed: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := q.open(file); err != nil {
+		q.release()
+		return nil, err
+	}
+
+	for i := range q.readBufs {
+		q.readBufs[i] = make([]byte, uringPacketSize)
+		q.idle = append(q.idle, uint64(i))
+	}
+	var wakeBuf [8]byte
+	q.readIovecs[wakeRead].Base = &wakeBuf[0]
+	q.readIovecs[wakeRead].SetLen(len(wakeBuf))
+	q.readRing.prepare(ioringOpReadv, q.wake, &q.readIovecs[wakeRead], wakeRead)
+	q.prepareReads()
+	if err := q.readRing.enter(0); err != nil {
+		q.release()
+		return nil, err
+	}
+
+	go q.writeLoop()
+	slog.Info("Using io_uring for TUN I/O")
+	return q, nil
+}
+
+// open creates the rings, the wake eventfd and the descriptor copies
+func (q *uringQueue) open(file *os.File) error {
+	var err error
+	if q.readRing, err = newURing(uringReadDepth + 1); err != nil {
+		return err
+	}
+	if q.writeRing, err = newURing(uringWriteBatch); err != nil {
+		return err
+	}
+	if q.wake, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		return os.NewSyscallError("eventfd", err)
+	}
+
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var dupErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// io_uring fails reads on a non-blocking file instead of waiting
+		// for a packet. The Go runtime stops reading the file after this.
+		if dupErr = unix.SetNonblock(int(fd), false); dupErr != nil {
+			return
+		}
+		if q.readFd, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0); dupErr != nil {
+			return
+		}
+		q.writeFd, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if err != nil || dupErr != nil {
+		return fmt.Errorf("failed to prepare TUN interface: %v", errors.Join(err, dupErr))
+	}
+	return nil
+}
+
+// release closes whatever open created, after a failure
+func (q *uringQueue) release() {
+	for _, r := range []*uring{q.readRing, q.writeRing} {
+		if r != nil {
+			r.close()
+		}
+	}
+	for _, fd := range []int{q.readFd, q.writeFd, q.wake} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// prepareReads queues a read on every idle buffer
+func (q *uringQueue) prepareReads() {
+	for _, index := range q.idle {
+		iov := &q.readIovecs[index]
+		iov.Base = &q.readBufs[index][0]
+		iov.SetLen(uringPacketSize)
+		q.readRing.prepare(ioringOpReadv, q.readFd, iov, index)
+	}
+	q.idle = q.idle[:0]
+}
+
+// ReadPacket returns the next completed read. Reads are queued again in
+// batches: with the wait for the next packet when none has completed, or
+// once half of the buffers are idle. The read ring is closed once this
+// fails, as the caller stops reading.
+func (q *uringQueue) ReadPacket(buf []byte) (int, error) {
+	q.readMu.Lock()
+	defer q.readMu.Unlock()
+	for {
+		if q.closed.Load() {
+			q.closeReads()
+			return 0, os.ErrClosed
+		}
+
+		if q.readRing.ready() == 0 {
+			q.prepareReads()
+			if err := q.readRing.enter(1); err != nil {
+				q.closeReads()
+				return 0, err
+			}
+			continue
+		}
+		if len(q.idle) >= uringReadDepth/2 {
+			q.prepareReads()
+			if err := q.readRing.enter(0); err != nil {
+				q.closeReads()
+				return 0, err
+			}
+		}
+
+		cqe, _ := q.readRing.complete()
+		if cqe.userData == wakeRead {
+			continue
+		}
+		q.idle = append(q.idle, cqe.userData)
+		if cqe.res < 0 {
+			errno := unix.Errno(-cqe.res)
+			if errno == unix.EINTR || errno == unix.EAGAIN {
+				continue
+			}
+			q.closeReads()
+			return 0, os.NewSyscallError("read", errno)
+		}
+		return copy(buf, q.readBufs[cqe.userData][:cqe.res]), nil
+	}
+}
+
+// closeReads closes the read ring, canceling the queued reads, and the
+// read descriptor. readMu must be held.
+func (q *uringQueue) closeReads() {
+	if !q.readClosed {
+		q.readClosed = true
+		q.readRing.close()
+		unix.Close(q.readFd)
+	}
+}
+
+// Queued returns how many packets wait for the next batch of writes
+func (q *uringQueue) Queued() int {
+	return len(q.writes)
+}
+
+// WritePacket queues a copy of packet to be written with the next batch
+func (q *uringQueue) WritePacket(packet []byte) error {
+	if q.closed.Load() {
+		return os.ErrClosed
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	buf := protocol.GetPacketBuffer()
+	if len(packet) > len(*buf) {
+		protocol.PutPacketBuffer(buf)
+		return fmt.Errorf("packet of %d bytes is too large", len(packet))
+	}
+	*buf = (*buf)[:copy(*buf, packet)]
+
+	select {
+	case q.writes <- buf:
+		return nil
+	case <-q.writeFailed:
+		protocol.PutPacketBuffer(buf)
+		return errWritesStopped
+	case <-q.done:
+		protocol.PutPacketBuffer(buf)
+		return os.ErrClosed
+	}
+}
+
+// writeLoop submits the queued writes, as many as are waiting at once, and
+// waits for them to complete before reusing their buffers
+func (q *uringQueue) writeLoop() {
+	defer unix.Close(q.writeFd)
+	defer q.writeRing.close()
+
+	batch := make([]*[]byte, 0, uringWriteBatch)
+	iovecs := make([]unix.Iovec, uringWriteBatch)
+	for {
+		select {
+		case buf := <-q.writes:
+			batch = append(batch, buf)
+		case <-q.done:
+			return
+		}
+	drain:
+		for len(batch) < uringWriteBatch {
+			select {
+			case buf := <-q.writes:
+				batch = append(batch, buf)
+			default:
+				break drain
+			}
+		}
+
+		for i, buf := range batch {
+			iovecs[i].Base = &(*buf)[0]
+			iovecs[i].SetLen(len(*buf))
+			q.writeRing.prepare(ioringOpWritev, q.writeFd, &iovecs[i], uint64(i))
+		}
+		if err := q.writeRing.enter(uint32(len(batch))); err != nil {
+			slog.Warn("Failed to write to TUN", "error", err)
+			close(q.writeFailed)
+			return
+		}
+		for {
+			cqe, ok := q.writeRing.complete()
+			if !ok {
+				break
+			}
+			if cqe.res < 0 {
+				slog.Warn("Failed to write to TUN", "error", unix.Errno(-cqe.res))
+			}
+		}
+
+		for _, buf := range batch {
+			protocol.PutPacketBuffer(buf)
+		}
+		batch = batch[:0]
+	}
+}
+
+// Close stops the queue. A waiting reader is woken and returns, after
+// which the read ring and descriptor are closed whether or not anyone was
+// reading; the writer closes its own.
+func (q *uringQueue) Close() error {
+	q.closeOnce.Do(func() {
+		q.closed.Store(true)
+		close(q.done)
+		var one [8]byte
+		one[0] = 1 // eventfd counters are host-endian; any nonzero value wakes
+		unix.Write(q.wake, one[:])
+
+		q.readMu.Lock()
+		q.closeReads()
+		q.readMu.Unlock()
+		unix.Close(q.wake)
+	})
+	return nil
+}
@@ -0,0 +1,233 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+)
+
+// socketpairTun returns an interface on one end of a packet socketpair,
+// which keeps packet boundaries as a TUN interface does, and the other end
+// for the test to play the network stack
+func socketpairTun(t testing.TB) (*water.Interface, *os.File) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetNonblock(fds[1], true); err != nil {
+		t.Fatal(err)
+	}
+	iface := &water.Interface{ReadWriteCloser: os.NewFile(uintptr(fds[0]), "tun")}
+	stack := os.NewFile(uintptr(fds[1]), "stack")
+	t.Cleanup(func() {
+		iface.Close()
+		stack.Close()
+	})
+	return iface, stack
+}
+
+// newTestURingQueue sets up io_uring on iface, skipping the test where the
+// kernel or sandbox does not allow it
+func newTestURingQueue(t testing.TB, iface *water.Interface) packetQueue {
+	t.Helper()
+	queue, err := newURingQueue(iface)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue
+}
+
+// readPacket reads what the queue wrote to the stack
+func readPacket(t *testing.T, stack *os.File) []byte {
+	t.Helper()
+	stack.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, uringPacketSize)
+	n, err := stack.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// waitForEOF fails unless every copy of the interface's descriptor is
+// closed, which the stack end sees as the end of the stream
+func waitForEOF(t *testing.T, stack *os.File) {
+	t.Helper()
+	stack.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := stack.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("stack end read %d bytes, %v; want EOF once the queue is closed", n, err)
+	}
+}
+
+func TestURingQueueRoundTrip(t *testing.T) {
+	iface, stack := socketpairTun(t)
+	queue := newTestURingQueue(t, iface)
+
+	// More packets than there are reads queued, so reads are queued again
+	buf := make([]byte, uringPacketSize)
+	for i := 0; i < 3*uringReadDepth; i++ {
+		packet := []byte(fmt.Sprintf("packet %d", i))
+		if _, err := stack.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+		n, err := queue.ReadPacket(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], packet) {
+			t.Fatalf("read %q, want %q", buf[:n], packet)
+		}
+	}
+
+	for i := 0; i < 3*uringWriteBatch; i++ {
+		packet := []byte(fmt.Sprintf("reply %d", i))
+		if err := queue.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+		if got := readPacket(t, stack); !bytes.Equal(got, packet) {
+			t.Fatalf("wrote %q, want %q", got, packet)
+		}
+	}
+}
+
+func TestURingQueueCloseWhileIdle(t *testing.T) {
+	iface, stack := socketpairTun(t)
+	queue := newTestURingQueue(t, iface)
+
+	// Nobody reads: Close still releases the read side's descriptor
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	iface.Close()
+	waitForEOF(t, stack)
+
+	if _, err := queue.ReadPacket(make([]byte, uringPacketSize)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadPacket() after Close error = %v, want %v", err, os.ErrClosed)
+	}
+	if err := queue.WritePacket([]byte("late")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("WritePacket() after Close error = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestURingQueueCloseWhileReading(t *testing.T) {
+	iface, stack := socketpairTun(t)
+	queue := newTestURingQueue(t, iface)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := queue.ReadPacket(make([]byte, uringPacketSize))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let the reader wait for a packet
+
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("ReadPacket() error = %v, want %v", err, os.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader not woken by Close")
+	}
+	iface.Close()
+	waitForEOF(t, stack)
+}
+
+// benchmarkFlows is how many flows the TUN benchmarks interleave
+const benchmarkFlows = 1000
+
+// flowPacket returns a small IPv4 UDP packet of one of the flows, carrying
+// when it was sent
+func flowPacket(flow int, sent time.Time) []byte {
+	packet := make([]byte, 64)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[9] = unix.IPPROTO_UDP
+	copy(packet[12:], []byte{10, 8, byte(flow >> 8), byte(flow)})
+	copy(packet[16:], []byte{10, 8, 0, 1})
+	binary.BigEndian.PutUint16(packet[20:], uint16(40000+flow))
+	binary.BigEndian.PutUint16(packet[22:], 443)
+	binary.BigEndian.PutUint64(packet[28:], uint64(sent.UnixNano()))
+	return packet
+}
+
+// benchmarkEcho sends small packets of many flows through queue, which
+// echoes them back, reporting the 99th percentile round trip
+func benchmarkEcho(b *testing.B, iface *water.Interface, stack *os.File, queue packetQueue) {
+	// The stack end blocks like a busy kernel would rather than failing
+	if err := unix.SetNonblock(int(stack.Fd()), false); err != nil {
+		b.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < b.N; i++ {
+			if _, err := stack.Write(flowPacket(i%benchmarkFlows, time.Now())); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	latencies := make([]time.Duration, 0, b.N)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, uringPacketSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := stack.Read(buf); err != nil {
+				b.Error(err)
+				return
+			}
+			latencies = append(latencies, time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(buf[28:])))))
+		}
+	}()
+
+	buf := make([]byte, uringPacketSize)
+	for i := 0; i < b.N; i++ {
+		n, err := queue.ReadPacket(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := queue.WritePacket(buf[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	}
+}
+
+// BenchmarkTunEcho1000Flows compares io_uring with a system call per
+// packet for small packets of 1000 interleaved flows. Compare CPU time with
+// go test -bench TunEcho -benchtime 200000x -cpuprofile.
+func BenchmarkTunEcho1000Flows(b *testing.B) {
+	b.Run("uring", func(b *testing.B) {
+		iface, stack := socketpairTun(b)
+		benchmarkEcho(b, iface, stack, newTestURingQueue(b, iface))
+	})
+	b.Run("direct", func(b *testing.B) {
+		iface, stack := socketpairTun(b)
+		benchmarkEcho(b, iface, stack, directQueue{iface})
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "github.com/songgao/water"
+
+func newURingQueue(iface *water.Interface) (packetQueue, error) {
+	return nil, errURingUnsupported
+}
@@ -0,0 +1,210 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal io_uring: just enough to queue vectored reads and writes. Each
+// ring belongs to one goroutine, so its queues need no locking.
+
+const (
+	ioringOpReadv        = 1
+	ioringOpWritev       = 2
+	ioringEnterGetEvents = 1
+	ioringOffSQRing      = 0
+	ioringOffCQRing      = 0x8000000
+	ioringOffSQEs        = 0x10000000
+)
+
+// ioUringParams is struct io_uring_params
+type ioUringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        ioSQRingOffsets
+	cqOff        ioCQRingOffsets
+}
+
+// ioSQRingOffsets is struct io_sqring_offsets
+type ioSQRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// ioCQRingOffsets is struct io_cqring_offsets
+type ioCQRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// ioUringSQE is struct io_uring_sqe
+type ioUringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+// ioUringCQE is struct io_uring_cqe
+type ioUringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance and its queues mapped from the kernel
+type uring struct {
+	fd                    int
+	sqRing, cqRing, sqMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqArray        []uint32
+	sqes           []ioUringSQE
+	pending        uint32 // prepared but not yet submitted
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []ioUringCQE
+}
+
+// newURing sets up a ring with room for at least entries operations
+func newURing(entries uint32) (*uring, error) {
+	var params ioUringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd)}
+
+	mmap := func(offset int64, size uint32) ([]byte, error) {
+		mem, err := unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return nil, os.NewSyscallError("mmap", err)
+		}
+		return mem, nil
+	}
+	var err error
+	if r.sqRing, err = mmap(ioringOffSQRing, params.sqOff.array+params.sqEntries*4); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.cqRing, err = mmap(ioringOffCQRing, params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(ioUringCQE{}))); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.sqMem, err = mmap(ioringOffSQEs, params.sqEntries*uint32(unsafe.Sizeof(ioUringSQE{}))); err != nil {
+		r.close()
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array])), params.sqEntries)
+	r.sqes = unsafe.Slice((*ioUringSQE)(unsafe.Pointer(&r.sqMem[0])), params.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*ioUringCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes])), params.cqEntries)
+	return r, nil
+}
+
+// prepare queues an operation on the single buffer of iov, to be submitted
+// by the next enter. iov must stay in place until the operation completes.
+func (r *uring) prepare(opcode uint8, fd int, iov *unix.Iovec, userData uint64) {
+	tail := *r.sqTail
+	index := tail & r.sqMask
+	r.sqes[index] = ioUringSQE{
+		opcode:   opcode,
+		fd:       int32(fd),
+		addr:     uint64(uintptr(unsafe.Pointer(iov))),
+		len:      1,
+		userData: userData,
+	}
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+}
+
+// enter submits the prepared operations and waits until at least
+// minComplete completions are ready, in a single system call
+func (r *uring) enter(minComplete uint32) error {
+	for {
+		var flags uintptr
+		if minComplete > 0 {
+			flags = ioringEnterGetEvents
+		}
+		submitted, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.pending), uintptr(minComplete), flags, 0, 0)
+		if errno != 0 && errno != unix.EINTR {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+		if errno == 0 {
+			r.pending -= uint32(submitted)
+		}
+		if r.pending == 0 && r.ready() >= minComplete {
+			return nil
+		}
+	}
+}
+
+// ready returns how many completions are waiting to be consumed
+func (r *uring) ready() uint32 {
+	return atomic.LoadUint32(r.cqTail) - *r.cqHead
+}
+
+// complete consumes the next completion, if there is one
+func (r *uring) complete() (ioUringCQE, bool) {
+	head := *r.cqHead
+	if head == atomic.LoadUint32(r.cqTail) {
+		return ioUringCQE{}, false
+	}
+	cqe := r.cqes[head&r.cqMask]
+	atomic.StoreUint32(r.cqHead, head+1)
+	return cqe, true
+}
+
+// close unmaps the queues and closes the ring, which cancels the operations
+// still in flight
+func (r *uring) close() {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqMem} {
+		if mem != nil {
+			unix.Munmap(mem)
+		}
+	}
+	unix.Close(r.fd)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"stealthvpn/pkg/config/wireguard"
+	"stealthvpn/pkg/protocol"
+)
+
+// importWireGuardConfig converts a WireGuard config into a client config and
+// writes it to output. Only the networking parameters carry over; the
+// WireGuard keys are not used because StealthVPN negotiates session keys with
+// its own X25519 exchange.
+func importWireGuardConfig(path, output string) error {
+	wg, err := wireguard.ParseFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	peer := wg.Peers[0]
+	if peer.Endpoint == "" {
+		return fmt.Errorf("%s: first peer has no endpoint", path)
+	}
+	if len(wg.Peers) > 1 {
+		slog.Warn("Only the first peer is imported", "peers", len(wg.Peers))
+	}
+
+	localIP, localIP6 := wg.Addresses()
+	config := &ClientConfig{
+		ServerURL:           fmt.Sprintf("wss://%s/ws", peer.Endpoint),
+		UDPServerAddr:       peer.Endpoint,
+		PreSharedKey:        peer.PresharedKey,
+		DNSServers:          wg.DNSServers(),
+		LocalIP:             localIP,
+		LocalIP6:            localIP6,
+		AllowedIPs:          wg.AllowedIPs(),
+		AutoConnect:         true,
+		ReconnectDelay:      5,
+		HealthCheckInterval: 30,
+		FakeDomainName:      "api.cloudsync-enterprise.com",
+		KeepaliveInterval:   peer.PersistentKeepalive,
+		Transport:           protocol.TransportWebSocket,
+	}
+	if config.PreSharedKey == "" {
+		slog.Warn("No PresharedKey in the WireGuard config; set pre_shared_key or pre_shared_key_file, or STEALTHVPN_PSK, to the server's key", "file", path, "output", output)
+	}
+
+	return writeNewConfig(output, config)
+}
+
+// writeNewConfig writes an imported client config to path
+func writeNewConfig(path string, config *ClientConfig) error {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeNewFile(path, append(data, '\n'))
+}
+
+// writeNewFile writes data to path. Imports never clobber an existing
+// file.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func wintunAvailable() bool {
+	return false
+}
+
+func openWinTUN() (*tunDevice, error) {
+	return nil, errors.New("WinTUN is only available on Windows")
+}
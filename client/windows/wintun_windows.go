@@ -0,0 +1,130 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wintun"
+)
+
+const (
+	// wintunAdapterName is the name of the adapter, as netsh sees it
+	wintunAdapterName = "StealthVPN"
+	// wintunRingCapacity is the size of each of the session's packet rings
+	wintunRingCapacity = 0x800000
+)
+
+// wintunAdapterGUID is the same for every adapter the client creates, so
+// Windows keeps one network profile for it instead of adding a new one
+// each time
+var wintunAdapterGUID = windows.GUID{
+	Data1: 0x5f1b3c2e,
+	Data2: 0x8d4a,
+	Data3: 0x4e71,
+	Data4: [8]byte{0x9c, 0x3d, 0x2a, 0x6b, 0x57, 0x56, 0x50, 0x4e},
+}
+
+// wintunAvailable reports whether wintun.dll can be loaded, from the
+// client's directory or System32. The DLL installs the driver itself when
+// the first adapter is created.
+func wintunAvailable() bool {
+	return wintun.Version() != "unknown"
+}
+
+// openWinTUN creates a WinTUN adapter and starts a session on it
+func openWinTUN() (*tunDevice, error) {
+	adapter, err := wintun.CreateAdapter(wintunAdapterName, "StealthVPN", &wintunAdapterGUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WinTUN adapter: %v", err)
+	}
+	session, err := adapter.StartSession(wintunRingCapacity)
+	if err != nil {
+		adapter.Close()
+		return nil, fmt.Errorf("failed to start WinTUN session: %v", err)
+	}
+
+	queue := &wintunQueue{session: session, readWait: session.ReadWaitEvent()}
+	return &tunDevice{name: wintunAdapterName, iface: adapter, packetQueue: queue}, nil
+}
+
+// wintunQueue moves packets through the rings of a WinTUN session, which
+// the driver shares with the client, without a system call per packet
+type wintunQueue struct {
+	session  wintun.Session
+	readWait windows.Handle // signalled when packets arrive, and by Close
+
+	mu     sync.RWMutex // held for reading while the session is in use, for writing to end it
+	closed atomic.Bool
+}
+
+func (q *wintunQueue) ReadPacket(buf []byte) (int, error) {
+	for {
+		q.mu.RLock()
+		if q.closed.Load() {
+			q.mu.RUnlock()
+			return 0, os.ErrClosed
+		}
+		packet, err := q.session.ReceivePacket()
+		if err == nil {
+			n := copy(buf, packet)
+			q.session.ReleaseReceivePacket(packet)
+			q.mu.RUnlock()
+			return n, nil
+		}
+		q.mu.RUnlock()
+
+		switch {
+		case errors.Is(err, windows.ERROR_NO_MORE_ITEMS):
+			// Sleep until packets arrive or Close wakes us
+			if _, err := windows.WaitForSingleObject(q.readWait, windows.INFINITE); err != nil {
+				return 0, fmt.Errorf("failed to wait for WinTUN packets: %v", err)
+			}
+		case errors.Is(err, windows.ERROR_HANDLE_EOF):
+			return 0, os.ErrClosed
+		default:
+			return 0, fmt.Errorf("failed to read from WinTUN: %v", err)
+		}
+	}
+}
+
+func (q *wintunQueue) WritePacket(packet []byte) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed.Load() {
+		return os.ErrClosed
+	}
+
+	buf, err := q.session.AllocateSendPacket(len(packet))
+	if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+		// The ring is full; drop the packet as a congested link would
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to WinTUN: %v", err)
+	}
+	copy(buf, packet)
+	q.session.SendPacket(buf)
+	return nil
+}
+
+// Close wakes the reader and ends the session once nothing uses it
+func (q *wintunQueue) Close() error {
+	if q.closed.Swap(true) {
+		return nil
+	}
+	windows.SetEvent(q.readWait)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.session.End()
+	return nil
+}
+
+func (q *wintunQueue) Queued() int {
+	return 0
+}
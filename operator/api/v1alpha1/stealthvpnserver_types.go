@@ -0,0 +1,114 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Condition types reported in StealthVPNServerStatus
+const (
+	// ConditionAvailable is true while at least one server pod is ready
+	ConditionAvailable = "Available"
+	// ConditionProgressing is true while a rollout is replacing pods
+	ConditionProgressing = "Progressing"
+	// ConditionUpgradeable is false while a rollout is still in progress, so
+	// the next change should wait for it to finish
+	ConditionUpgradeable = "Upgradeable"
+)
+
+// StealthVPNServerSpec describes a fleet of VPN servers behind one load
+// balancer
+type StealthVPNServerSpec struct {
+	// Replicas is the number of server pods
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Image is the server image
+	// +kubebuilder:default="stealthvpn/server:latest"
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Config holds the settings of the server's config.json. The TLS file
+	// paths are set by the operator, and the pre-shared key comes from
+	// PreSharedKeySecret.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +optional
+	Config *runtime.RawExtension `json:"config,omitempty"`
+
+	// TLSSecretName names a kubernetes.io/tls Secret holding the server's
+	// certificate. A self-signed one for fake_domain_name is created if
+	// empty.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+
+	// PreSharedKeySecret selects the Secret key holding the pre-shared key
+	PreSharedKeySecret corev1.SecretKeySelector `json:"preSharedKeySecret"`
+
+	// ServiceAnnotations are added to the LoadBalancer Service, for cloud
+	// load balancer settings
+	// +optional
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+
+	// Resources of the server container
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// StealthVPNServerStatus is the observed state of the fleet
+type StealthVPNServerStatus struct {
+	// ObservedGeneration is the generation last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// ReadyReplicas is the number of ready server pods
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// UpdatedReplicas is the number of pods running the current spec
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// LoadBalancer is the address clients connect to, once assigned
+	// +optional
+	LoadBalancer string `json:"loadBalancer,omitempty"`
+
+	// Conditions are Available, Progressing and Upgradeable
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// StealthVPNServer is a fleet of StealthVPN servers
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.readyReplicas
+// +kubebuilder:resource:shortName=svpn
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+// +kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.status.loadBalancer`
+// +kubebuilder:printcolumn:name="Upgradeable",type=string,JSONPath=`.status.conditions[?(@.type=="Upgradeable")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type StealthVPNServer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   StealthVPNServerSpec   `json:"spec,omitempty"`
+	Status StealthVPNServerStatus `json:"status,omitempty"`
+}
+
+// StealthVPNServerList is a list of StealthVPNServers
+// +kubebuilder:object:root=true
+type StealthVPNServerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []StealthVPNServer `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&StealthVPNServer{}, &StealthVPNServerList{})
+}
@@ -0,0 +1,450 @@
+// Package controllers reconciles StealthVPNServer resources into the
+// Kubernetes objects that run the servers
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vpnv1alpha1 "stealthvpn/operator/api/v1alpha1"
+)
+
+const (
+	// configDir is where the server's config.json is mounted
+	configDir = "/etc/stealthvpn/operator"
+	// tlsDir is where the TLS Secret is mounted
+	tlsDir = "/etc/stealthvpn/tls"
+	// configHashAnnotation changes whenever the config or certificate does,
+	// so the Deployment rolls its pods to pick them up
+	configHashAnnotation = "vpn.stealthvpn.io/config-hash"
+	// defaultPort is the server's port when the config sets none
+	defaultPort = 443
+	// selfSignedValidity matches the server's own self-signed certificates
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// StealthVPNServerReconciler turns a StealthVPNServer into a ConfigMap, a TLS
+// Secret, a Deployment and a LoadBalancer Service
+type StealthVPNServerReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=vpn.stealthvpn.io,resources=stealthvpnservers,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=vpn.stealthvpn.io,resources=stealthvpnservers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services;configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile brings the objects of one StealthVPNServer in line with its spec
+func (r *StealthVPNServerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var server vpnv1alpha1.StealthVPNServer
+	if err := r.Get(ctx, req.NamespacedName, &server); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	config, err := serverConfig(&server)
+	if err != nil {
+		r.setCondition(&server, vpnv1alpha1.ConditionAvailable, metav1.ConditionFalse, "InvalidConfig", err.Error())
+		return ctrl.Result{}, r.Status().Update(ctx, &server)
+	}
+
+	tlsSecret, err := r.reconcileTLSSecret(ctx, &server, config)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconcile TLS secret: %v", err)
+	}
+	configJSON, err := r.reconcileConfigMap(ctx, &server, config)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconcile config map: %v", err)
+	}
+
+	hash := sha256.New()
+	hash.Write(configJSON)
+	hash.Write([]byte(tlsSecret.ResourceVersion))
+	deployment, err := r.reconcileDeployment(ctx, &server, config, hex.EncodeToString(hash.Sum(nil))[:16])
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconcile deployment: %v", err)
+	}
+	service, err := r.reconcileService(ctx, &server, config)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconcile service: %v", err)
+	}
+
+	r.updateStatus(&server, deployment, service)
+	if err := r.Status().Update(ctx, &server); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// serverConfig returns the server settings with the paths the operator
+// mounts files at. A pre-shared key in the config is dropped: it would end
+// up in a ConfigMap, and the one from preSharedKeySecret overrides it anyway.
+func serverConfig(server *vpnv1alpha1.StealthVPNServer) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	if server.Spec.Config != nil && len(server.Spec.Config.Raw) > 0 {
+		if err := json.Unmarshal(server.Spec.Config.Raw, &config); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	if server.Spec.PreSharedKeySecret.Name == "" || server.Spec.PreSharedKeySecret.Key == "" {
+		return nil, fmt.Errorf("preSharedKeySecret needs a name and a key")
+	}
+
+	delete(config, "pre_shared_key")
+	delete(config, "pre_shared_key_file")
+	delete(config, "pkcs11")
+	config["tls_cert_file"] = tlsDir + "/" + corev1.TLSCertKey
+	config["tls_key_file"] = tlsDir + "/" + corev1.TLSPrivateKeyKey
+	if _, ok := config["host"]; !ok {
+		config["host"] = "0.0.0.0"
+	}
+	if _, ok := config["port"]; !ok {
+		config["port"] = defaultPort
+	}
+	if _, err := configPort(config, "port"); err != nil {
+		return nil, err
+	}
+	if _, err := configPort(config, "udp_port"); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configPort returns a port setting, 0 if unset
+func configPort(config map[string]interface{}, key string) (int32, error) {
+	value, ok := config[key]
+	if !ok {
+		return 0, nil
+	}
+	var port float64
+	switch v := value.(type) {
+	case float64:
+		port = v
+	case int:
+		port = float64(v)
+	default:
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+	if port < 0 || port > 65535 || port != float64(int32(port)) {
+		return 0, fmt.Errorf("invalid %s %v", key, value)
+	}
+	return int32(port), nil
+}
+
+// fakeDomain returns the domain the server pretends to host
+func fakeDomain(server *vpnv1alpha1.StealthVPNServer, config map[string]interface{}) string {
+	if domain, ok := config["fake_domain_name"].(string); ok && domain != "" {
+		return domain
+	}
+	return server.Name
+}
+
+// tlsSecretName returns the name of the Secret the server's certificate is in
+func tlsSecretName(server *vpnv1alpha1.StealthVPNServer) string {
+	if server.Spec.TLSSecretName != "" {
+		return server.Spec.TLSSecretName
+	}
+	return server.Name + "-tls"
+}
+
+// reconcileTLSSecret returns the configured TLS Secret, or creates a
+// self-signed one the first time if none is configured
+func (r *StealthVPNServerReconciler) reconcileTLSSecret(ctx context.Context, server *vpnv1alpha1.StealthVPNServer, config map[string]interface{}) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	key := types.NamespacedName{Namespace: server.Namespace, Name: tlsSecretName(server)}
+	err := r.Get(ctx, key, &secret)
+	if err == nil || server.Spec.TLSSecretName != "" || !apierrors.IsNotFound(err) {
+		return &secret, err
+	}
+
+	certPEM, keyPEM, err := selfSignedCert(fakeDomain(server, config))
+	if err != nil {
+		return nil, err
+	}
+	secret = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name, Labels: labels(server)},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	if err := controllerutil.SetControllerReference(server, &secret, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, &secret); err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Created self-signed certificate", "secret", key.Name)
+	return &secret, nil
+}
+
+// reconcileConfigMap writes the server's config.json and returns it
+func (r *StealthVPNServerReconciler) reconcileConfigMap(ctx context.Context, server *vpnv1alpha1.StealthVPNServer, config map[string]interface{}) ([]byte, error) {
+	configJSON, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: server.Namespace, Name: server.Name + "-config"}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Labels = labels(server)
+		configMap.Data = map[string]string{"config.json": string(configJSON)}
+		return controllerutil.SetControllerReference(server, configMap, r.Scheme)
+	})
+	return configJSON, err
+}
+
+// reconcileDeployment runs the server pods. Rolling updates never take a
+// ready pod away before its replacement is ready, so clients always have a
+// server to reconnect to.
+func (r *StealthVPNServerReconciler) reconcileDeployment(ctx context.Context, server *vpnv1alpha1.StealthVPNServer, config map[string]interface{}, configHash string) (*appsv1.Deployment, error) {
+	port, _ := configPort(config, "port")
+	udpPort, _ := configPort(config, "udp_port")
+
+	ports := []corev1.ContainerPort{{Name: "https", ContainerPort: port, Protocol: corev1.ProtocolTCP}}
+	if udpPort > 0 {
+		ports = append(ports, corev1.ContainerPort{Name: "udp", ContainerPort: udpPort, Protocol: corev1.ProtocolUDP})
+	}
+
+	replicas := int32(1)
+	if server.Spec.Replicas != nil {
+		replicas = *server.Spec.Replicas
+	}
+	image := server.Spec.Image
+	if image == "" {
+		image = "stealthvpn/server:latest"
+	}
+	maxUnavailable := intstr.FromInt32(0)
+	maxSurge := intstr.FromInt32(1)
+	charDevice := corev1.HostPathCharDev
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: server.Namespace, Name: server.Name}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, deployment, func() error {
+		deployment.Labels = labels(server)
+		deployment.Spec.Replicas = &replicas
+		deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels(server)}
+		deployment.Spec.Strategy = appsv1.DeploymentStrategy{
+			Type: appsv1.RollingUpdateDeploymentStrategyType,
+			RollingUpdate: &appsv1.RollingUpdateDeployment{
+				MaxUnavailable: &maxUnavailable,
+				MaxSurge:       &maxSurge,
+			},
+		}
+
+		template := &deployment.Spec.Template
+		template.Labels = labels(server)
+		template.Annotations = map[string]string{configHashAnnotation: configHash}
+		template.Spec.Volumes = []corev1.Volume{
+			{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: server.Name + "-config"},
+			}}},
+			{Name: "tls", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: tlsSecretName(server),
+			}}},
+			{Name: "tun", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+				Path: "/dev/net/tun",
+				Type: &charDevice,
+			}}},
+		}
+		template.Spec.Containers = []corev1.Container{{
+			Name:  "server",
+			Image: image,
+			// Run the server directly: the image's entrypoint writes a
+			// first-run config the operator already provides
+			Command: []string{"stealthvpn-server", "--config", configDir + "/config.json"},
+			Ports:   ports,
+			Env: []corev1.EnvVar{{
+				Name:      "STEALTHVPN_PSK",
+				ValueFrom: &corev1.EnvVarSource{SecretKeyRef: server.Spec.PreSharedKeySecret.DeepCopy()},
+			}},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "config", MountPath: configDir, ReadOnly: true},
+				{Name: "tls", MountPath: tlsDir, ReadOnly: true},
+				{Name: "tun", MountPath: "/dev/net/tun"},
+			},
+			Resources: server.Spec.Resources,
+			ReadinessProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(port)},
+				},
+				PeriodSeconds: 10,
+			},
+			SecurityContext: &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{
+					Add: []corev1.Capability{"NET_ADMIN", "NET_BIND_SERVICE"},
+				},
+			},
+		}}
+		return controllerutil.SetControllerReference(server, deployment, r.Scheme)
+	})
+	return deployment, err
+}
+
+// reconcileService exposes the servers on a LoadBalancer
+func (r *StealthVPNServerReconciler) reconcileService(ctx context.Context, server *vpnv1alpha1.StealthVPNServer, config map[string]interface{}) (*corev1.Service, error) {
+	port, _ := configPort(config, "port")
+	udpPort, _ := configPort(config, "udp_port")
+
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: server.Namespace, Name: server.Name}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, func() error {
+		service.Labels = labels(server)
+		service.Annotations = server.Spec.ServiceAnnotations
+		service.Spec.Type = corev1.ServiceTypeLoadBalancer
+		service.Spec.Selector = labels(server)
+		// Keep each client on one server, so its session survives
+		// reconnects of the underlying connection
+		service.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+
+		ports := []corev1.ServicePort{{Name: "https", Port: port, TargetPort: intstr.FromString("https"), Protocol: corev1.ProtocolTCP}}
+		if udpPort > 0 {
+			ports = append(ports, corev1.ServicePort{Name: "udp", Port: udpPort, TargetPort: intstr.FromString("udp"), Protocol: corev1.ProtocolUDP})
+		}
+		// Keep the node ports already assigned, or every update would
+		// allocate new ones
+		for i := range ports {
+			for _, existing := range service.Spec.Ports {
+				if existing.Name == ports[i].Name {
+					ports[i].NodePort = existing.NodePort
+				}
+			}
+		}
+		service.Spec.Ports = ports
+		return controllerutil.SetControllerReference(server, service, r.Scheme)
+	})
+	return service, err
+}
+
+// updateStatus reports the Deployment's rollout. Upgradeable is false while
+// pods of an older spec still run, so a new image or config is not piled
+// on top of a rollout that has not finished.
+func (r *StealthVPNServerReconciler) updateStatus(server *vpnv1alpha1.StealthVPNServer, deployment *appsv1.Deployment, service *corev1.Service) {
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+
+	server.Status.ObservedGeneration = server.Generation
+	server.Status.ReadyReplicas = status.ReadyReplicas
+	server.Status.UpdatedReplicas = status.UpdatedReplicas
+	server.Status.LoadBalancer = ""
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.Hostname != "" {
+			server.Status.LoadBalancer = ingress.Hostname
+		} else if ingress.IP != "" {
+			server.Status.LoadBalancer = ingress.IP
+		}
+	}
+
+	if status.AvailableReplicas > 0 || desired == 0 {
+		r.setCondition(server, vpnv1alpha1.ConditionAvailable, metav1.ConditionTrue, "ServersReady",
+			fmt.Sprintf("%d of %d servers ready", status.ReadyReplicas, desired))
+	} else {
+		r.setCondition(server, vpnv1alpha1.ConditionAvailable, metav1.ConditionFalse, "NoServersReady", "no server is ready")
+	}
+
+	rollingOut := deployment.Generation != status.ObservedGeneration ||
+		status.UpdatedReplicas < desired ||
+		status.Replicas > status.UpdatedReplicas ||
+		status.AvailableReplicas < desired
+	if rollingOut {
+		message := fmt.Sprintf("%d of %d servers updated", status.UpdatedReplicas, desired)
+		r.setCondition(server, vpnv1alpha1.ConditionProgressing, metav1.ConditionTrue, "RollingUpdate", message)
+		r.setCondition(server, vpnv1alpha1.ConditionUpgradeable, metav1.ConditionFalse, "RolloutInProgress", message)
+	} else {
+		r.setCondition(server, vpnv1alpha1.ConditionProgressing, metav1.ConditionFalse, "RolloutComplete", "all servers run the current spec")
+		r.setCondition(server, vpnv1alpha1.ConditionUpgradeable, metav1.ConditionTrue, "RolloutComplete", "all servers run the current spec")
+	}
+}
+
+// setCondition records a condition for the server's current generation
+func (r *StealthVPNServerReconciler) setCondition(server *vpnv1alpha1.StealthVPNServer, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&server.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: server.Generation,
+	})
+}
+
+// labels returns the labels of a server's objects and pods
+func labels(server *vpnv1alpha1.StealthVPNServer) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       "stealthvpn-server",
+		"app.kubernetes.io/instance":   server.Name,
+		"app.kubernetes.io/managed-by": "stealthvpn-operator",
+	}
+}
+
+// selfSignedCert returns a PEM certificate and key for domain, like the
+// server's own --generate-cert
+func selfSignedCert(domain string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain, "*." + domain},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// SetupWithManager registers the reconciler, watching the objects it owns
+func (r *StealthVPNServerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&vpnv1alpha1.StealthVPNServer{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Complete(r)
+}
@@ -0,0 +1,72 @@
+// Command operator runs StealthVPN servers on Kubernetes from
+// StealthVPNServer resources
+package main
+
+import (
+	"flag"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	vpnv1alpha1 "stealthvpn/operator/api/v1alpha1"
+	"stealthvpn/operator/controllers"
+)
+
+func main() {
+	var metricsAddr = flag.String("metrics-bind-address", ":8080", "Address the metrics endpoint binds to")
+	var probeAddr = flag.String("health-probe-bind-address", ":8081", "Address the health probes bind to")
+	var leaderElection = flag.Bool("leader-elect", false, "Elect a leader, so only one of several operator replicas reconciles")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	setupLog := ctrl.Log.WithName("setup")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		setupLog.Error(err, "Failed to register Kubernetes types")
+		os.Exit(1)
+	}
+	if err := vpnv1alpha1.AddToScheme(scheme); err != nil {
+		setupLog.Error(err, "Failed to register StealthVPNServer types")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: *metricsAddr},
+		HealthProbeBindAddress: *probeAddr,
+		LeaderElection:         *leaderElection,
+		LeaderElectionID:       "operator.vpn.stealthvpn.io",
+	})
+	if err != nil {
+		setupLog.Error(err, "Failed to create manager")
+		os.Exit(1)
+	}
+
+	reconciler := &controllers.StealthVPNServerReconciler{Client: mgr.GetClient(), Scheme: mgr.GetScheme()}
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "Failed to create controller")
+		os.Exit(1)
+	}
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Failed to add health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Failed to add ready check")
+		os.Exit(1)
+	}
+
+	setupLog.Info("Starting operator")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "Operator stopped")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,94 @@
+// Package auth verifies who is connecting to the VPN server. Backends
+// implement Authenticator and can be combined with AndAuthenticator.
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidCredentials is returned when a backend rejects the client
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Credentials is everything a client presented when connecting. Each
+// backend looks only at the fields it needs.
+type Credentials struct {
+	Username string
+	Password string
+	OTP      string // one-time code from an authenticator app
+
+	// PSKProof is the client's proof of the pre-shared key over Transcript,
+	// the server's record of the key exchange
+	PSKProof   []byte
+	Transcript []byte
+	KeyID      string // names the pre-shared key used; not secret
+
+	// PeerCertificates is the TLS client certificate chain, leaf first. It
+	// is not verified by the TLS layer.
+	PeerCertificates []*x509.Certificate
+
+	RemoteAddr string
+}
+
+// Identity is who the client was authenticated as
+type Identity struct {
+	// Username is empty when the backend proves only that the client holds
+	// a shared secret
+	Username string
+	// Tenant is set when the client holds the pre-shared key of a tenant
+	Tenant string
+	// SessionTimeout is how long the session may last, 0 for no limit
+	SessionTimeout time.Duration
+}
+
+// Authenticator verifies a client's credentials. It returns an error
+// wrapping ErrInvalidCredentials when they are wrong, and any other error
+// when they could not be checked.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (Identity, error)
+}
+
+// AndAuthenticator requires every backend to accept the client. Backends
+// that name the user must agree on the name.
+type AndAuthenticator struct {
+	Authenticators []Authenticator
+}
+
+// NewAndAuthenticator combines backends that must all pass
+func NewAndAuthenticator(authenticators ...Authenticator) *AndAuthenticator {
+	return &AndAuthenticator{Authenticators: authenticators}
+}
+
+// Authenticate checks the backends in order and stops at the first failure
+func (a *AndAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	if len(a.Authenticators) == 0 {
+		return Identity{}, errors.New("no authenticators configured")
+	}
+
+	var identity Identity
+	for _, authenticator := range a.Authenticators {
+		result, err := authenticator.Authenticate(ctx, creds)
+		if err != nil {
+			return Identity{}, err
+		}
+
+		if result.Tenant != "" {
+			identity.Tenant = result.Tenant
+		}
+		// The strictest limit applies
+		if result.SessionTimeout > 0 && (identity.SessionTimeout == 0 || result.SessionTimeout < identity.SessionTimeout) {
+			identity.SessionTimeout = result.SessionTimeout
+		}
+		if result.Username == "" {
+			continue
+		}
+		if identity.Username != "" && identity.Username != result.Username {
+			return Identity{}, fmt.Errorf("%w: authenticated as both %q and %q", ErrInvalidCredentials, identity.Username, result.Username)
+		}
+		identity.Username = result.Username
+	}
+	return identity, nil
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// CertificateAuthenticator accepts clients whose TLS client certificate was
+// issued by a trusted CA, and names them by the certificate's common name
+type CertificateAuthenticator struct {
+	roots *x509.CertPool
+	// revoked holds the serial numbers the CAs' CRLs list, by the raw
+	// subject of the CA
+	revoked map[string]map[string]bool
+}
+
+// NewCertificateAuthenticator trusts the PEM CA certificates in caFile. If
+// crlFile is set, the certificates listed by the CRLs in it, PEM or DER,
+// are refused. Each CRL must be signed by one of the CAs.
+func NewCertificateAuthenticator(caFile, crlFile string) (*CertificateAuthenticator, error) {
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	var cas []*x509.Certificate
+	for rest := pemData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %v", caFile, err)
+		}
+		roots.AddCert(ca)
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	a := &CertificateAuthenticator{roots: roots, revoked: make(map[string]map[string]bool)}
+	if crlFile != "" {
+		if err := a.loadCRLs(crlFile, cas); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// loadCRLs reads the CRLs in path, checking each was signed by one of cas
+func (a *CertificateAuthenticator) loadCRLs(path string, cas []*x509.Certificate) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read client CRL file: %v", err)
+	}
+
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("invalid CRL in %s: %v", path, err)
+		}
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
+			return fmt.Errorf("CRL from %s in %s is not signed by a client CA", crl.Issuer, path)
+		}
+
+		serials := a.revoked[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			a.revoked[string(issuer.RawSubject)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+	return nil
+}
+
+// isRevoked reports whether a CRL of cert's issuer lists cert
+func (a *CertificateAuthenticator) isRevoked(cert *x509.Certificate) bool {
+	return a.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()]
+}
+
+// Authenticate verifies the client's certificate chain
+func (a *CertificateAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	if len(creds.PeerCertificates) == 0 {
+		return Identity{}, fmt.Errorf("%w: no client certificate", ErrInvalidCredentials)
+	}
+
+	leaf := creds.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range creds.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	// Every chain to a trusted CA must be free of revoked certificates, the
+	// CA itself aside
+	for _, chain := range chains {
+		for _, cert := range chain[:len(chain)-1] {
+			if a.isRevoked(cert) {
+				return Identity{}, fmt.Errorf("%w: certificate %s of %q is revoked", ErrInvalidCredentials, cert.SerialNumber, cert.Subject.CommonName)
+			}
+		}
+	}
+	if leaf.Subject.CommonName == "" {
+		return Identity{}, fmt.Errorf("%w: client certificate has no common name", ErrInvalidCredentials)
+	}
+	return Identity{Username: leaf.Subject.CommonName}, nil
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate with its key, for issuing others
+type testCertificate struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issueTestCertificate creates a certificate for template, signed by
+// issuer or self-signed if issuer is nil
+func issueTestCertificate(t *testing.T, template *x509.Certificate, issuer *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+// testCA returns a CA certificate named name
+func testCA(t *testing.T, name string, serial int64, issuer *testCertificate) *testCertificate {
+	return issueTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, issuer)
+}
+
+// testClient returns a client certificate for commonName issued by issuer
+func testClient(t *testing.T, commonName string, serial int64, issuer *testCertificate, usage x509.ExtKeyUsage) *testCertificate {
+	return issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, issuer)
+}
+
+// writeTestPEM writes blocks of type blockType to a file in dir
+func writeTestPEM(t *testing.T, dir, name, blockType string, ders ...[]byte) string {
+	t.Helper()
+	var data []byte
+	for _, der := range ders {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testCRL returns a CRL signed by issuer revoking serials
+func testCRL(t *testing.T, issuer *testCertificate, serials ...int64) []byte {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, issuer.cert, issuer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCertificateChains(t *testing.T) {
+	root := testCA(t, "Example Root CA", 1, nil)
+	intermediate := testCA(t, "Example Client CA", 2, root)
+	other := testCA(t, "Other CA", 3, nil)
+	caFile := writeTestPEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", root.cert.Raw)
+
+	a, err := NewCertificateAuthenticator(caFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := testClient(t, "alice", 10, root, x509.ExtKeyUsageClientAuth)
+	bob := testClient(t, "bob", 11, intermediate, x509.ExtKeyUsageClientAuth)
+	for _, test := range []struct {
+		name  string
+		chain []*x509.Certificate
+		want  string // username, or empty for a refusal
+	}{
+		{"issued by the CA", []*x509.Certificate{alice.cert}, "alice"},
+		{"through an intermediate", []*x509.Certificate{bob.cert, intermediate.cert}, "bob"},
+		{"missing intermediate", []*x509.Certificate{bob.cert}, ""},
+		{"untrusted CA", []*x509.Certificate{testClient(t, "mallory", 12, other, x509.ExtKeyUsageClientAuth).cert}, ""},
+		{"self-signed", []*x509.Certificate{testCA(t, "mallory", 13, nil).cert}, ""},
+		{"server certificate", []*x509.Certificate{testClient(t, "vpn.example.com", 14, root, x509.ExtKeyUsageServerAuth).cert}, ""},
+		{"no common name", []*x509.Certificate{testClient(t, "", 15, root, x509.ExtKeyUsageClientAuth).cert}, ""},
+		{"no certificate", nil, ""},
+	} {
+		identity, err := a.Authenticate(context.Background(), Credentials{PeerCertificates: test.chain})
+		if test.want == "" {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("%s: identity %+v, %v, want invalid credentials", test.name, identity, err)
+			}
+		} else if err != nil || identity.Username != test.want {
+			t.Errorf("%s: identity %+v, %v, want %s", test.name, identity, err, test.want)
+		}
+	}
+}
+
+func TestCertificateRevocation(t *testing.T) {
+	dir := t.TempDir()
+	root := testCA(t, "Example Root CA", 1, nil)
+	intermediate := testCA(t, "Example Client CA", 2, root)
+	revokedIntermediate := testCA(t, "Retired Client CA", 3, root)
+	caFile := writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", root.cert.Raw, intermediate.cert.Raw)
+
+	// The root revokes an intermediate CA and a client certificate it
+	// issued; the intermediate, trusted directly as well, revokes one of its
+	// own. One CRL is PEM, the other DER.
+	crlFile := writeTestPEM(t, dir, "crl.pem", "X509 CRL", testCRL(t, root, 3, 20), testCRL(t, intermediate, 31))
+	a, err := NewCertificateAuthenticator(caFile, crlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derFile := filepath.Join(dir, "crl.der")
+	if err := os.WriteFile(derFile, testCRL(t, root, 20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	derOnly, err := NewCertificateAuthenticator(caFile, derFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		authenticator *CertificateAuthenticator
+		chain         []*x509.Certificate
+		revoked       bool
+	}{
+		{"valid", a, []*x509.Certificate{testClient(t, "alice", 21, root, x509.ExtKeyUsageClientAuth).cert}, false},
+		{"revoked by the root", a, []*x509.Certificate{testClient(t, "bob", 20, root, x509.ExtKeyUsageClientAuth).cert}, true},
+		{"revoked in a DER CRL", derOnly, []*x509.Certificate{testClient(t, "bob", 20, root, x509.ExtKeyUsageClientAuth).cert}, true},
+		{"same serial from another CA", a, []*x509.Certificate{testClient(t, "carol", 20, intermediate, x509.ExtKeyUsageClientAuth).cert}, false},
+		{"revoked by the intermediate", a, []*x509.Certificate{testClient(t, "dave", 31, intermediate, x509.ExtKeyUsageClientAuth).cert}, true},
+		{"issued by a revoked intermediate", a, []*x509.Certificate{testClient(t, "erin", 40, revokedIntermediate, x509.ExtKeyUsageClientAuth).cert, revokedIntermediate.cert}, true},
+	} {
+		identity, err := test.authenticator.Authenticate(context.Background(), Credentials{PeerCertificates: test.chain})
+		if test.revoked {
+			if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "revoked") {
+				t.Errorf("%s: identity %+v, %v, want a revoked certificate refused", test.name, identity, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestCertificateCRLMustBeFromCA(t *testing.T) {
+	dir := t.TempDir()
+	root := testCA(t, "Example Root CA", 1, nil)
+	other := testCA(t, "Other CA", 2, nil)
+	caFile := writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", root.cert.Raw)
+
+	crlFile := writeTestPEM(t, dir, "crl.pem", "X509 CRL", testCRL(t, other, 10))
+	if _, err := NewCertificateAuthenticator(caFile, crlFile); err == nil || !strings.Contains(err.Error(), "not signed by a client CA") {
+		t.Errorf("CRL from another CA gave %v", err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.crl")
+	os.WriteFile(garbage, []byte("not a CRL"), 0600)
+	if _, err := NewCertificateAuthenticator(caFile, garbage); err == nil {
+		t.Error("invalid CRL file accepted")
+	}
+	if _, err := NewCertificateAuthenticator(caFile, filepath.Join(dir, "missing.crl")); err == nil {
+		t.Error("missing CRL file accepted")
+	}
+	if _, err := NewCertificateAuthenticator(crlFile, ""); err == nil {
+		t.Error("CA file without certificates accepted")
+	}
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig describes how to find and verify users in an LDAP or Active
+// Directory server
+type LDAPConfig struct {
+	URL          string `json:"url"`     // ldap://host:389 or ldaps://host:636
+	BindDN       string `json:"bind_dn"` // service account used to look users up
+	BindPassword string `json:"bind_password"`
+	BaseDN       string `json:"base_dn"`
+	UserFilter   string `json:"user_filter"` // %s is replaced by the escaped username
+	TLSEnabled   bool   `json:"tls_enabled"` // upgrade ldap:// connections with StartTLS
+	Group        string `json:"group"`       // DN of a group users must be a memberOf; any user if empty
+}
+
+// DefaultUserFilter matches Active Directory accounts by login name
+const DefaultUserFilter = "(sAMAccountName=%s)"
+
+// LDAPAuthenticator verifies usernames and passwords against a directory.
+// Successful logins are remembered for cacheTTL so reconnecting clients do
+// not each cost a round of directory queries.
+type LDAPAuthenticator struct {
+	config   LDAPConfig
+	cacheTTL time.Duration
+	cacheKey []byte // keys the password digests held in the cache
+	dial     func() (ldapConn, error)
+
+	mu    sync.Mutex
+	cache map[string]cachedLogin
+}
+
+// ldapConn is the part of *ldap.Conn the authenticator uses, so tests can
+// stand in for a directory
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SetTimeout(timeout time.Duration)
+	Close() error
+}
+
+// cachedLogin is a recent successful login
+type cachedLogin struct {
+	digest  []byte
+	expires time.Time
+}
+
+// NewLDAPAuthenticator creates an authenticator for config
+func NewLDAPAuthenticator(config LDAPConfig, cacheTTL time.Duration) (*LDAPAuthenticator, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("LDAP url and base_dn are required")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("invalid LDAP url: %v", err)
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = DefaultUserFilter
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, errors.New("LDAP user_filter must contain %s")
+	}
+	if config.Group != "" {
+		if _, err := ldap.ParseDN(config.Group); err != nil {
+			return nil, fmt.Errorf("invalid LDAP group: %v", err)
+		}
+	}
+
+	cacheKey := make([]byte, 32)
+	if _, err := rand.Read(cacheKey); err != nil {
+		return nil, err
+	}
+
+	a := &LDAPAuthenticator{
+		config:   config,
+		cacheTTL: cacheTTL,
+		cacheKey: cacheKey,
+		cache:    make(map[string]cachedLogin),
+	}
+	a.dial = a.dialDirectory
+	return a, nil
+}
+
+// Authenticate checks the username and password against the directory
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	username, password := creds.Username, creds.Password
+	// An empty password would be an unauthenticated bind, which many
+	// directories accept for any DN
+	if username == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	digest := a.digest(username, password)
+	if a.cached(username, digest) {
+		return Identity{Username: username}, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Identity{}, err
+	}
+	if err := a.bindAsUser(ctx, username, password); err != nil {
+		return Identity{}, err
+	}
+
+	if a.cacheTTL > 0 {
+		a.mu.Lock()
+		a.cache[username] = cachedLogin{digest: digest, expires: time.Now().Add(a.cacheTTL)}
+		a.mu.Unlock()
+	}
+	return Identity{Username: username}, nil
+}
+
+// bindAsUser looks the user up with the service account and binds as them.
+// With a group configured the user must also be one of its members.
+func (a *LDAPAuthenticator) bindAsUser(ctx context.Context, username, password string) error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Bound every request by ctx's deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetTimeout(time.Until(deadline))
+	}
+
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return fmt.Errorf("LDAP service bind failed: %v", err)
+		}
+	}
+
+	attributes := []string{"dn"}
+	if a.config.Group != "" {
+		attributes = append(attributes, "memberOf")
+	}
+	search := ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		attributes,
+		nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return fmt.Errorf("LDAP search failed: %v", err)
+	}
+	// Unknown and ambiguous usernames are rejected alike
+	if result == nil || len(result.Entries) != 1 {
+		return ErrInvalidCredentials
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("LDAP bind failed: %v", err)
+	}
+
+	// Checked only once the password is, so it tells nobody else who is in
+	// the group
+	if a.config.Group != "" && !memberOf(entry, a.config.Group) {
+		return fmt.Errorf("%w: not a member of the LDAP group", ErrInvalidCredentials)
+	}
+	return nil
+}
+
+// memberOf reports whether entry lists group, a DN, among its memberOf
+// values. DNs compare as directories compare them, without regard to case
+// or the spacing between their parts.
+func memberOf(entry *ldap.Entry, group string) bool {
+	groupDN, err := ldap.ParseDN(group)
+	if err != nil {
+		return false
+	}
+	for _, value := range entry.GetAttributeValues("memberOf") {
+		if dn, err := ldap.ParseDN(value); err == nil && dn.EqualFold(groupDN) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialDirectory connects to the directory, upgrading to TLS if configured
+func (a *LDAPAuthenticator) dialDirectory() (ldapConn, error) {
+	conn, err := ldap.DialURL(a.config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connection failed: %v", err)
+	}
+
+	if a.config.TLSEnabled && strings.HasPrefix(strings.ToLower(a.config.URL), "ldap://") {
+		u, _ := url.Parse(a.config.URL)
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// digest keys a password so the cache never holds it in the clear
+func (a *LDAPAuthenticator) digest(username, password string) []byte {
+	mac := hmac.New(sha256.New, a.cacheKey)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// cached reports whether the same login succeeded within the cache TTL
+func (a *LDAPAuthenticator) cached(username string, digest []byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	login, ok := a.cache[username]
+	if !ok {
+		return false
+	}
+	if time.Now().After(login.expires) {
+		delete(a.cache, username)
+		return false
+	}
+	return hmac.Equal(login.digest, digest)
+}
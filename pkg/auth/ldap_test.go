@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN = "cn=vpn-service,ou=Services,dc=example,dc=com"
+	testAliceDN   = "uid=alice,ou=People,dc=example,dc=com"
+	testBobDN     = "uid=bob,ou=People,dc=example,dc=com"
+	testVPNGroup  = "cn=VPN Users,ou=Groups,dc=example,dc=com"
+)
+
+// fakeDirectory stands in for an LDAP server. Searches are answered by
+// their exact filter, so tests spell out the filters they expect.
+type fakeDirectory struct {
+	passwords map[string]string        // DN -> password
+	results   map[string][]*ldap.Entry // filter -> entries found
+	errs      map[string]error         // filter -> search error
+	mu        sync.Mutex
+	dials     int
+	searches  []*ldap.SearchRequest
+	timeout   time.Duration
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		passwords: map[string]string{
+			testServiceDN: "service-password",
+			testAliceDN:   "alice-password",
+			testBobDN:     "bob-password",
+		},
+		results: map[string][]*ldap.Entry{
+			"(uid=alice)": {ldap.NewEntry(testAliceDN, map[string][]string{"memberOf": {"CN=vpn users, OU=Groups, DC=example, DC=com"}})},
+			"(uid=bob)":   {ldap.NewEntry(testBobDN, map[string][]string{"memberOf": {"cn=Staff,ou=Groups,dc=example,dc=com"}})},
+		},
+		errs: map[string]error{},
+	}
+}
+
+// authenticator returns an LDAP authenticator whose connections go to d
+func (d *fakeDirectory) authenticator(t *testing.T, config LDAPConfig, cacheTTL time.Duration) *LDAPAuthenticator {
+	t.Helper()
+	config.URL, config.BaseDN = "ldap://ldap.example.com", "dc=example,dc=com"
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	a, err := NewLDAPAuthenticator(config, cacheTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dial = func() (ldapConn, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.dials++
+		return d, nil
+	}
+	return a
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	if want, ok := d.passwords[username]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (d *fakeDirectory) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.searches = append(d.searches, request)
+	return &ldap.SearchResult{Entries: d.results[request.Filter]}, d.errs[request.Filter]
+}
+
+func (d *fakeDirectory) SetTimeout(timeout time.Duration) { d.timeout = timeout }
+func (d *fakeDirectory) Close() error                     { return nil }
+
+// lastSearch returns the last search the directory was sent
+func (d *fakeDirectory) lastSearch() *ldap.SearchRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.searches) == 0 {
+		return nil
+	}
+	return d.searches[len(d.searches)-1]
+}
+
+func TestLDAPBind(t *testing.T) {
+	directory := newFakeDirectory()
+	a := directory.authenticator(t, LDAPConfig{BindDN: testServiceDN, BindPassword: "service-password"}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	identity, err := a.Authenticate(ctx, Credentials{Username: "alice", Password: "alice-password"})
+	if err != nil || identity.Username != "alice" {
+		t.Fatalf("right password: identity %+v, %v", identity, err)
+	}
+	if directory.timeout <= 0 || directory.timeout > time.Minute {
+		t.Errorf("requests time out after %v, want the context's deadline", directory.timeout)
+	}
+
+	for name, creds := range map[string]Credentials{
+		"wrong password": {Username: "alice", Password: "bob-password"},
+		"unknown user":   {Username: "mallory", Password: "alice-password"},
+		"empty password": {Username: "alice"},
+	} {
+		if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: %v, want invalid credentials", name, err)
+		}
+	}
+
+	// A broken service account is the server's fault, not the client's
+	broken := directory.authenticator(t, LDAPConfig{BindDN: testServiceDN, BindPassword: "expired"}, 0)
+	_, err = broken.Authenticate(context.Background(), Credentials{Username: "alice", Password: "alice-password"})
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "service bind failed") {
+		t.Errorf("service bind failure gave %v", err)
+	}
+}
+
+func TestLDAPEscapesFilter(t *testing.T) {
+	directory := newFakeDirectory()
+	a := directory.authenticator(t, LDAPConfig{}, 0)
+
+	// Filter syntax in a username is escaped, so it cannot widen the search
+	for username, want := range map[string]string{
+		"alice)(uid=*": `(uid=alice\29\28uid=\2a)`,
+		"*":            `(uid=\2a)`,
+		`a\b`:          `(uid=a\5cb)`,
+	} {
+		if _, err := a.Authenticate(context.Background(), Credentials{Username: username, Password: "alice-password"}); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("username %q: %v, want invalid credentials", username, err)
+		}
+		if got := directory.lastSearch().Filter; got != want {
+			t.Errorf("username %q searched with %s, want %s", username, got, want)
+		}
+	}
+
+	// Usernames matching more than one entry are refused
+	directory.results["(uid=staff)"] = append(directory.results["(uid=alice)"], directory.results["(uid=bob)"]...)
+	directory.errs["(uid=staff)"] = ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	if _, err := a.Authenticate(context.Background(), Credentials{Username: "staff", Password: "alice-password"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("ambiguous username: %v, want invalid credentials", err)
+	}
+}
+
+func TestLDAPGroup(t *testing.T) {
+	directory := newFakeDirectory()
+	a := directory.authenticator(t, LDAPConfig{Group: testVPNGroup}, 0)
+
+	// memberOf values match the group however the directory spaces and
+	// cases them
+	if _, err := a.Authenticate(context.Background(), Credentials{Username: "alice", Password: "alice-password"}); err != nil {
+		t.Errorf("group member refused: %v", err)
+	}
+	if attributes := directory.lastSearch().Attributes; !slices.Contains(attributes, "memberOf") {
+		t.Errorf("search asked for %v, want memberOf", attributes)
+	}
+
+	_, err := a.Authenticate(context.Background(), Credentials{Username: "bob", Password: "bob-password"})
+	if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "group") {
+		t.Errorf("user outside the group: %v, want invalid credentials", err)
+	}
+
+	if _, err := NewLDAPAuthenticator(LDAPConfig{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", Group: "VPN Users"}, 0); err == nil {
+		t.Error("group that is not a DN accepted")
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	directory := newFakeDirectory()
+	a := directory.authenticator(t, LDAPConfig{}, time.Minute)
+	creds := Credentials{Username: "alice", Password: "alice-password"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.Authenticate(context.Background(), creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if directory.dials != 1 {
+		t.Errorf("%d directory connections for one cached login, want 1", directory.dials)
+	}
+
+	// Another password for the same user is not taken from the cache
+	creds.Password = "bob-password"
+	if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password after a cached login: %v", err)
+	}
+	if directory.dials != 2 {
+		t.Errorf("%d directory connections, want the wrong password checked", directory.dials)
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// PSKAuthenticator accepts clients that prove they hold one of the server's
+// pre-shared keys or the key of a tenant
+type PSKAuthenticator struct {
+	keys    map[string][]byte // key ID -> key material
+	tenants map[string][]byte // tenant name -> key material
+	decoy   []byte            // checked in place of unknown key IDs
+}
+
+// NewPSKAuthenticator creates an authenticator for the key material returned
+// by protocol.MasterKey, by key ID. Clients that send no key ID are checked
+// against the key with the empty ID.
+func NewPSKAuthenticator(keys map[string][]byte) *PSKAuthenticator {
+	copied := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		copied[id] = append([]byte(nil), key...)
+	}
+	decoy := make([]byte, 32)
+	if _, err := rand.Read(decoy); err != nil {
+		panic(err)
+	}
+	return &PSKAuthenticator{keys: copied, tenants: make(map[string][]byte), decoy: decoy}
+}
+
+// AddTenant accepts clients holding key, the key material of the named
+// tenant, and reports the tenant in their identity
+func (a *PSKAuthenticator) AddTenant(name string, key []byte) {
+	a.tenants[name] = append([]byte(nil), key...)
+}
+
+// Authenticate checks the client's proof against the key exchange
+// transcript, which the server's fresh key makes a challenge no recorded
+// proof answers. The proof is compared in constant time with every key, so
+// how long the check takes says neither whether the key ID is known nor
+// which tenant's key, if any, matched.
+func (a *PSKAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	if len(creds.Transcript) == 0 || len(creds.PSKProof) == 0 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	masterKey, ok := a.keys[creds.KeyID]
+	if !ok {
+		masterKey = a.decoy
+	}
+	matched := subtle.ConstantTimeCompare(creds.PSKProof, protocol.PSKProof(masterKey, creds.Transcript))
+
+	// Tenant clients are recognized by their key alone
+	var tenant string
+	for name, tenantKey := range a.tenants {
+		if subtle.ConstantTimeCompare(creds.PSKProof, protocol.PSKProof(tenantKey, creds.Transcript)) == 1 {
+			tenant = name
+		}
+	}
+
+	switch {
+	case ok && matched == 1:
+		return Identity{}, nil
+	case tenant != "":
+		return Identity{Tenant: tenant}, nil
+	case !ok:
+		return Identity{}, fmt.Errorf("%w: unknown pre-shared key %q", ErrInvalidCredentials, creds.KeyID)
+	default:
+		return Identity{}, ErrInvalidCredentials
+	}
+}
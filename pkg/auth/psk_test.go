@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+var (
+	currentKey  = bytes.Repeat([]byte{1}, 32)
+	previousKey = bytes.Repeat([]byte{2}, 32)
+	tenantKey   = bytes.Repeat([]byte{3}, 32)
+	transcript  = []byte("key exchange")
+)
+
+// pskCredentials returns a client's proof of key under keyID
+func pskCredentials(keyID string, key []byte) Credentials {
+	return Credentials{KeyID: keyID, PSKProof: protocol.PSKProof(key, transcript), Transcript: transcript}
+}
+
+func TestPSKAuthenticatorAcceptsKeysByID(t *testing.T) {
+	a := NewPSKAuthenticator(map[string][]byte{"2025-06": currentKey, "": previousKey})
+	a.AddTenant("engineering", tenantKey)
+
+	for name, creds := range map[string]Credentials{
+		"current":  pskCredentials("2025-06", currentKey),
+		"previous": pskCredentials("", previousKey),
+	} {
+		identity, err := a.Authenticate(context.Background(), creds)
+		if err != nil || identity.Tenant != "" {
+			t.Errorf("%s key: identity %+v, %v", name, identity, err)
+		}
+	}
+	identity, err := a.Authenticate(context.Background(), pskCredentials("", tenantKey))
+	if err != nil || identity.Tenant != "engineering" {
+		t.Errorf("tenant key: identity %+v, %v", identity, err)
+	}
+}
+
+func TestPSKAuthenticatorRejects(t *testing.T) {
+	a := NewPSKAuthenticator(map[string][]byte{"2025-06": currentKey, "": previousKey})
+
+	for name, creds := range map[string]Credentials{
+		"key under another ID": pskCredentials("", currentKey),
+		"unknown ID":           pskCredentials("2024-01", currentKey),
+		"no proof":             {KeyID: "2025-06", Transcript: transcript},
+		"no transcript":        {KeyID: "2025-06", PSKProof: protocol.PSKProof(currentKey, transcript)},
+	} {
+		if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: error = %v, want %v", name, err, ErrInvalidCredentials)
+		}
+	}
+
+	// Another session's proof does not answer this one's transcript
+	replayed := pskCredentials("2025-06", currentKey)
+	replayed.Transcript = []byte("another key exchange")
+	if _, err := a.Authenticate(context.Background(), replayed); err == nil {
+		t.Error("replayed proof accepted")
+	}
+}
+
+func TestPSKAuthenticatorChecksEveryKey(t *testing.T) {
+	a := NewPSKAuthenticator(map[string][]byte{"2025-06": currentKey})
+	a.AddTenant("engineering", tenantKey)
+	a.AddTenant("sales", previousKey)
+	proof := protocol.PSKProof(currentKey, transcript)
+
+	// Proofs that share a prefix with the right one, or are cut short, fail
+	// like any other
+	for name, forged := range map[string][]byte{
+		"truncated":     proof[:len(proof)-1],
+		"extended":      append(append([]byte(nil), proof...), 0),
+		"last byte off": append(append([]byte(nil), proof[:len(proof)-1]...), proof[len(proof)-1]^1),
+	} {
+		creds := Credentials{KeyID: "2025-06", PSKProof: forged, Transcript: transcript}
+		if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s proof: error = %v, want %v", name, err, ErrInvalidCredentials)
+		}
+	}
+
+	// An unknown key ID is checked against the decoy, which even a proof
+	// under the decoy does not pass, and tenants are still let in
+	if _, err := a.Authenticate(context.Background(), pskCredentials("2024-01", a.decoy)); err == nil {
+		t.Error("proof under the decoy key accepted")
+	}
+	for _, test := range []struct {
+		key    []byte
+		tenant string
+	}{
+		{tenantKey, "engineering"},
+		{previousKey, "sales"},
+	} {
+		identity, err := a.Authenticate(context.Background(), pskCredentials("2024-01", test.key))
+		if err != nil || identity.Tenant != test.tenant {
+			t.Errorf("tenant key under an unknown ID: identity %+v, %v; want tenant %q", identity, err, test.tenant)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// RADIUS authentication methods for the password
+const (
+	RADIUSMethodPAP  = "pap"  // the password, hidden with the shared secret
+	RADIUSMethodCHAP = "chap" // a hash of the password and a random challenge
+)
+
+// Defaults for RADIUSConfig
+const (
+	defaultRADIUSPort    = "1812"
+	defaultRADIUSTimeout = 10 * time.Second
+)
+
+// RADIUSConfig describes the RADIUS server that checks passwords
+type RADIUSConfig struct {
+	Server        string `json:"server"` // host:port; port 1812 if omitted
+	Secret        string `json:"secret" log:"secret"`
+	NASIdentifier string `json:"nas_identifier"` // names this VPN server to RADIUS. Default stealthvpn
+	Timeout       int    `json:"timeout"`        // seconds to wait for an answer. Default 10
+}
+
+// RADIUSAuthenticator verifies usernames and passwords with a RADIUS
+// server (RFC 2865). When the server challenges the client, as servers
+// asking for a second factor do, the client's one-time code is the answer.
+type RADIUSAuthenticator struct {
+	config  RADIUSConfig
+	method  string
+	timeout time.Duration
+	client  *radius.Client
+}
+
+// NewRADIUSAuthenticator creates an authenticator for config sending
+// passwords by method, pap or chap
+func NewRADIUSAuthenticator(config RADIUSConfig, method string) (*RADIUSAuthenticator, error) {
+	if config.Server == "" || config.Secret == "" {
+		return nil, errors.New("RADIUS server and secret are required")
+	}
+	if _, _, err := net.SplitHostPort(config.Server); err != nil {
+		config.Server = net.JoinHostPort(config.Server, defaultRADIUSPort)
+	}
+	if config.NASIdentifier == "" {
+		config.NASIdentifier = "stealthvpn"
+	}
+
+	method = strings.ToLower(method)
+	switch method {
+	case "":
+		method = RADIUSMethodPAP
+	case RADIUSMethodPAP, RADIUSMethodCHAP:
+	default:
+		return nil, fmt.Errorf("invalid RADIUS auth method %q, want pap or chap", method)
+	}
+
+	timeout := defaultRADIUSTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+
+	return &RADIUSAuthenticator{
+		config:  config,
+		method:  method,
+		timeout: timeout,
+		// Requests are resent each second, as UDP may lose them
+		client: &radius.Client{Retry: time.Second, MaxPacketErrors: 10},
+	}, nil
+}
+
+// Authenticate sends the username and password in an Access-Request. An
+// Access-Challenge is answered once with the client's one-time code.
+func (a *RADIUSAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	if creds.Username == "" || creds.Password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	response, err := a.exchange(ctx, creds, creds.Password, nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	if response.Code == radius.CodeAccessChallenge {
+		if creds.OTP == "" {
+			return Identity{}, fmt.Errorf("%w: RADIUS server asked for a one-time code", ErrInvalidCredentials)
+		}
+		response, err = a.exchange(ctx, creds, creds.OTP, rfc2865.State_Get(response))
+		if err != nil {
+			return Identity{}, err
+		}
+	}
+
+	switch response.Code {
+	case radius.CodeAccessAccept:
+		return Identity{
+			Username:       creds.Username,
+			SessionTimeout: time.Duration(rfc2865.SessionTimeout_Get(response)) * time.Second,
+		}, nil
+	case radius.CodeAccessReject, radius.CodeAccessChallenge:
+		if reply := rfc2865.ReplyMessage_GetString(response); reply != "" {
+			return Identity{}, fmt.Errorf("%w: %s", ErrInvalidCredentials, reply)
+		}
+		return Identity{}, ErrInvalidCredentials
+	default:
+		return Identity{}, fmt.Errorf("unexpected RADIUS response %v", response.Code)
+	}
+}
+
+// exchange sends an Access-Request with password, continuing the exchange
+// named by state if there is one
+func (a *RADIUSAuthenticator) exchange(ctx context.Context, creds Credentials, password string, state []byte) (*radius.Packet, error) {
+	request := radius.New(radius.CodeAccessRequest, []byte(a.config.Secret))
+	if err := rfc2865.UserName_SetString(request, creds.Username); err != nil {
+		return nil, err
+	}
+	if err := a.setPassword(request, password); err != nil {
+		return nil, err
+	}
+	rfc2865.NASIdentifier_SetString(request, a.config.NASIdentifier)
+	rfc2865.NASPortType_Set(request, rfc2865.NASPortType_Value_Virtual)
+	if host, _, err := net.SplitHostPort(creds.RemoteAddr); err == nil {
+		rfc2865.CallingStationID_SetString(request, host)
+	}
+	if state != nil {
+		rfc2865.State_Set(request, state)
+	}
+
+	response, err := a.client.Exchange(ctx, request, a.config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("RADIUS request failed: %v", err)
+	}
+	return response, nil
+}
+
+// setPassword adds password to request as the configured method sends it
+func (a *RADIUSAuthenticator) setPassword(request *radius.Packet, password string) error {
+	if a.method == RADIUSMethodPAP {
+		// User-Password is padded with NULs to a multiple of 16 bytes
+		// (RFC 2865 5.2), which the radius package leaves to its callers
+		padded := make([]byte, (len(password)+15)/16*16)
+		copy(padded, password)
+		return rfc2865.UserPassword_Set(request, padded)
+	}
+
+	// CHAP-Password is an identifier followed by
+	// MD5(identifier + password + challenge), RFC 1994
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	id := request.Identifier
+	hash := md5.New()
+	hash.Write([]byte{id})
+	hash.Write([]byte(password))
+	hash.Write(challenge)
+	if err := rfc2865.CHAPChallenge_Set(request, challenge); err != nil {
+		return err
+	}
+	return rfc2865.CHAPPassword_Set(request, hash.Sum([]byte{id}))
+}
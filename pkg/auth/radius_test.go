@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+const (
+	testRADIUSSecret   = "radius-shared-secret"
+	testRADIUSPassword = "correct horse battery" // 21 bytes, padded to 32
+	testRADIUSOTP      = "123456"
+)
+
+// startFakeRADIUS serves handler over UDP on a loopback port, with secret
+// checking the requests' authenticators, and returns its address
+func startFakeRADIUS(t *testing.T, secret string, handler radius.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte(secret)),
+		Handler:      handler,
+		// A server with the wrong secret reads requests all the same, to
+		// answer them with responses the client must refuse
+		InsecureSkipVerify: secret != testRADIUSSecret,
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return conn.LocalAddr().String()
+}
+
+// radiusPasswordIs reports whether request carries password, by PAP or by
+// CHAP, as a RADIUS server would check it
+func radiusPasswordIs(request *radius.Packet, password string) bool {
+	if attribute, ok := request.Lookup(rfc2865.UserPassword_Type); ok {
+		// The password hidden in User-Password is padded to 16-byte blocks
+		return len(attribute)%16 == 0 && rfc2865.UserPassword_GetString(request) == password
+	}
+
+	chap := rfc2865.CHAPPassword_Get(request)
+	challenge := rfc2865.CHAPChallenge_Get(request)
+	if len(chap) != 17 || len(challenge) == 0 {
+		return false
+	}
+	hash := md5.New()
+	hash.Write(chap[:1])
+	hash.Write([]byte(password))
+	hash.Write(challenge)
+	return bytes.Equal(hash.Sum(nil), chap[1:])
+}
+
+// newTestRADIUS returns an authenticator for the server at addr
+func newTestRADIUS(t *testing.T, addr, method string) *RADIUSAuthenticator {
+	t.Helper()
+	a, err := NewRADIUSAuthenticator(RADIUSConfig{Server: addr, Secret: testRADIUSSecret, Timeout: 2}, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRADIUSAuthenticatesPAPAndCHAP(t *testing.T) {
+	requests := make(chan *radius.Packet, 4)
+	addr := startFakeRADIUS(t, testRADIUSSecret, func(w radius.ResponseWriter, r *radius.Request) {
+		requests <- r.Packet
+		if !radiusPasswordIs(r.Packet, testRADIUSPassword) {
+			response := r.Response(radius.CodeAccessReject)
+			rfc2865.ReplyMessage_SetString(response, "bad password")
+			w.Write(response)
+			return
+		}
+		response := r.Response(radius.CodeAccessAccept)
+		rfc2865.SessionTimeout_Set(response, 3600)
+		w.Write(response)
+	})
+
+	for _, method := range []string{RADIUSMethodPAP, RADIUSMethodCHAP} {
+		a := newTestRADIUS(t, addr, method)
+		creds := Credentials{Username: "alice", Password: testRADIUSPassword, RemoteAddr: "198.51.100.7:40000"}
+
+		identity, err := a.Authenticate(context.Background(), creds)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if identity.Username != "alice" || identity.SessionTimeout != time.Hour {
+			t.Errorf("%s: identity %+v, want alice for the Session-Timeout of an hour", method, identity)
+		}
+		request := <-requests
+		if got := rfc2865.UserName_GetString(request); got != "alice" {
+			t.Errorf("%s: User-Name %q", method, got)
+		}
+		if got := rfc2865.NASIdentifier_GetString(request); got != "stealthvpn" {
+			t.Errorf("%s: NAS-Identifier %q, want the default", method, got)
+		}
+		if got := rfc2865.CallingStationID_GetString(request); got != "198.51.100.7" {
+			t.Errorf("%s: Calling-Station-Id %q, want the client's IP", method, got)
+		}
+
+		creds.Password = "wrong password"
+		_, err = a.Authenticate(context.Background(), creds)
+		if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "bad password") {
+			t.Errorf("%s: wrong password gave %v, want invalid credentials with the Reply-Message", method, err)
+		}
+		<-requests
+	}
+}
+
+func TestRADIUSChallengeTakesOTP(t *testing.T) {
+	addr := startFakeRADIUS(t, testRADIUSSecret, func(w radius.ResponseWriter, r *radius.Request) {
+		switch state := string(rfc2865.State_Get(r.Packet)); {
+		case state == "" && radiusPasswordIs(r.Packet, testRADIUSPassword):
+			response := r.Response(radius.CodeAccessChallenge)
+			rfc2865.State_Set(response, []byte("otp-1"))
+			w.Write(response)
+		case state == "otp-1" && radiusPasswordIs(r.Packet, testRADIUSOTP):
+			w.Write(r.Response(radius.CodeAccessAccept))
+		default:
+			w.Write(r.Response(radius.CodeAccessReject))
+		}
+	})
+	a := newTestRADIUS(t, addr, RADIUSMethodPAP)
+
+	identity, err := a.Authenticate(context.Background(), Credentials{Username: "alice", Password: testRADIUSPassword, OTP: testRADIUSOTP})
+	if err != nil || identity.Username != "alice" || identity.SessionTimeout != 0 {
+		t.Errorf("challenge answered with the OTP: identity %+v, %v", identity, err)
+	}
+
+	_, err = a.Authenticate(context.Background(), Credentials{Username: "alice", Password: testRADIUSPassword})
+	if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "one-time code") {
+		t.Errorf("challenge without an OTP gave %v, want invalid credentials", err)
+	}
+
+	_, err = a.Authenticate(context.Background(), Credentials{Username: "alice", Password: testRADIUSPassword, OTP: "654321"})
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("challenge answered with the wrong OTP gave %v, want invalid credentials", err)
+	}
+}
+
+func TestRADIUSRefusesForgedResponses(t *testing.T) {
+	// A server without the shared secret cannot sign its Access-Accept
+	addr := startFakeRADIUS(t, "not-the-secret", func(w radius.ResponseWriter, r *radius.Request) {
+		w.Write(r.Response(radius.CodeAccessAccept))
+	})
+	a := newTestRADIUS(t, addr, RADIUSMethodPAP)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	identity, err := a.Authenticate(ctx, Credentials{Username: "alice", Password: testRADIUSPassword})
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("forged Access-Accept gave identity %+v, %v, want the request to fail", identity, err)
+	}
+}
+
+func TestNewRADIUSAuthenticator(t *testing.T) {
+	a, err := NewRADIUSAuthenticator(RADIUSConfig{Server: "radius.example.com", Secret: testRADIUSSecret}, "CHAP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.config.Server != "radius.example.com:1812" || a.method != RADIUSMethodCHAP || a.timeout != defaultRADIUSTimeout {
+		t.Errorf("server %s, method %s, timeout %v", a.config.Server, a.method, a.timeout)
+	}
+
+	for _, test := range []struct {
+		config RADIUSConfig
+		method string
+	}{
+		{RADIUSConfig{Server: "radius.example.com"}, ""},
+		{RADIUSConfig{Secret: testRADIUSSecret}, ""},
+		{RADIUSConfig{Server: "radius.example.com", Secret: testRADIUSSecret}, "mschapv2"},
+	} {
+		if _, err := NewRADIUSAuthenticator(test.config, test.method); err == nil {
+			t.Errorf("NewRADIUSAuthenticator(%+v, %q) succeeded", test.config, test.method)
+		}
+	}
+
+	// Empty credentials never reach the server
+	if _, err := a.Authenticate(context.Background(), Credentials{Username: "alice"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password gave %v", err)
+	}
+}
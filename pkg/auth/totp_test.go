@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32 as apps show it
+const rfc6238Secret = "gezd gnbv gy3t qojq gezd gnbv gy3t qojq"
+
+// newTestTOTP returns an authenticator for alice whose clock reads now
+func newTestTOTP(t *testing.T, skew int, now *time.Time) *TOTPAuthenticator {
+	t.Helper()
+	a, err := NewTOTPAuthenticator(TOTPConfig{Users: map[string]string{"alice": rfc6238Secret}, Skew: skew})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+func TestTOTPRFC6238Vectors(t *testing.T) {
+	// The RFC gives 8-digit codes; 6-digit ones are their last 6 digits
+	for _, test := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		now := time.Unix(test.unix, 0)
+		a := newTestTOTP(t, 0, &now)
+		identity, err := a.Authenticate(context.Background(), Credentials{Username: "alice", OTP: test.code})
+		if err != nil || identity.Username != "alice" {
+			t.Errorf("T = %d: code %s gave identity %+v, %v", test.unix, test.code, identity, err)
+		}
+	}
+}
+
+func TestTOTPSkewWindow(t *testing.T) {
+	secret := newTestTOTP(t, 0, new(time.Time)).secrets["alice"]
+	base := time.Unix(1111111111, 0)
+	step := base.Unix() / 30
+
+	for _, test := range []struct {
+		skew   int
+		offset int64 // steps between the code and the server's clock
+		want   bool
+	}{
+		{0, 0, true},
+		{0, -1, false},
+		{0, 1, false},
+		{1, -1, true},
+		{1, 1, true},
+		{1, -2, false},
+		{1, 2, false},
+		{2, -2, true},
+	} {
+		now := base
+		a := newTestTOTP(t, test.skew, &now)
+		_, err := a.Authenticate(context.Background(), Credentials{Username: "alice", OTP: totpCode(secret, step+test.offset)})
+		if got := err == nil; got != test.want {
+			t.Errorf("skew %d, code %+d steps off: accepted %v, want %v (%v)", test.skew, test.offset, got, test.want, err)
+		}
+	}
+}
+
+func TestTOTPRefusesReplays(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := newTestTOTP(t, 1, &now)
+	secret := a.secrets["alice"]
+	step := now.Unix() / 30
+
+	creds := Credentials{Username: "alice", OTP: totpCode(secret, step)}
+	if _, err := a.Authenticate(context.Background(), creds); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.Authenticate(context.Background(), creds)
+	if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("replayed code gave %v", err)
+	}
+
+	// An older code still within the skew is refused once a newer one was used
+	creds.OTP = totpCode(secret, step-1)
+	if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("older code after a newer one gave %v", err)
+	}
+	creds.OTP = totpCode(secret, step+1)
+	if _, err := a.Authenticate(context.Background(), creds); err != nil {
+		t.Errorf("newer code refused: %v", err)
+	}
+}
+
+func TestTOTPRejects(t *testing.T) {
+	now := time.Unix(59, 0)
+	a := newTestTOTP(t, 1, &now)
+	for name, creds := range map[string]Credentials{
+		"unknown user": {Username: "bob", OTP: "287082"},
+		"short code":   {Username: "alice", OTP: "28708"},
+		"8 digits":     {Username: "alice", OTP: "94287082"},
+		"wrong code":   {Username: "alice", OTP: "287083"},
+	} {
+		if _, err := a.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: %v, want invalid credentials", name, err)
+		}
+	}
+
+	for name, config := range map[string]TOTPConfig{
+		"no users":       {},
+		"negative skew":  {Users: map[string]string{"alice": rfc6238Secret}, Skew: -1},
+		"invalid secret": {Users: map[string]string{"alice": "not base32!"}},
+	} {
+		if _, err := NewTOTPAuthenticator(config); err == nil {
+			t.Errorf("%s: config accepted", name)
+		}
+	}
+}
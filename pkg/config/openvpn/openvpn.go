@@ -0,0 +1,375 @@
+// Package openvpn reads OpenVPN client configs (.ovpn files) so users
+// migrating from OpenVPN can reuse their server addresses, credentials and
+// networking settings with StealthVPN.
+package openvpn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultPort and DefaultProto apply to remotes that name neither
+	DefaultPort  = 1194
+	DefaultProto = "udp"
+)
+
+// Remote is a server named by a remote directive
+type Remote struct {
+	Host  string
+	Port  int
+	Proto string // udp or tcp
+}
+
+// Config is a parsed OpenVPN client config
+type Config struct {
+	Remotes           []Remote
+	Cipher            string   // data-channel cipher, from cipher or the first of data-ciphers
+	CA                string   // PEM, inline or read from the named file
+	Cert              string   // PEM client certificate
+	Key               string   // PEM client private key
+	TLSAuth           string   // static key of tls-auth or tls-crypt
+	DNS               []string // from dhcp-option DNS
+	Routes            []string // CIDR notation
+	ExcludedRoutes    []string // CIDR notation, from routes via net_gateway
+	RedirectGateway   bool     // send all traffic through the tunnel
+	LocalIP           string   // from ifconfig
+	Compression       string   // lz4, lzo or stub; empty if off
+	KeepaliveInterval int      // seconds between pings
+	KeepaliveTimeout  int      // seconds without a reply before restarting
+	AuthUserPass      bool     // the server asks for a username and password
+	Proxy             string   // http://host:port or socks5://host:port
+	Unsupported       []string // directives with no StealthVPN equivalent, as "line N: directive"
+}
+
+// ignored are directives that need no equivalent, because StealthVPN
+// always behaves as they ask or they only tune OpenVPN itself
+var ignored = map[string]bool{
+	"client": true, "dev": true, "dev-type": true, "nobind": true,
+	"persist-key": true, "persist-tun": true, "resolv-retry": true,
+	"verb": true, "mute": true, "mute-replay-warnings": true,
+	"remote-cert-tls": true, "ns-cert-type": true, "key-direction": true,
+	"auth-nocache": true, "pull": true, "tls-client": true,
+	"explicit-exit-notify": true, "setenv": true, "remote-random": true,
+	"connect-retry": true, "connect-retry-max": true, "float": true,
+}
+
+// inlineBlocks are the directives whose value may be given inline as
+// <name>...</name>. Other blocks, such as <connection>, are skipped.
+var inlineBlocks = map[string]bool{
+	"ca": true, "cert": true, "key": true, "tls-auth": true, "tls-crypt": true,
+}
+
+// ParseFile reads and parses the OpenVPN config at path. Files it names,
+// such as ca ca.crt, are read relative to its directory.
+func ParseFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parse(f, filepath.Dir(path))
+}
+
+// Parse parses an OpenVPN config. Files it names are read relative to the
+// working directory.
+func Parse(r io.Reader) (*Config, error) {
+	return parse(r, ".")
+}
+
+// parse parses an OpenVPN config, reading the files it names from dir
+func parse(r io.Reader, dir string) (*Config, error) {
+	config := &Config{}
+	port, proto := DefaultPort, DefaultProto
+	dataCiphers := false // data-ciphers overrides the older cipher
+	var remotes [][]string
+	block := ""
+	var blockLines []string
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Inside <ca>...</ca> and the like, collect the lines verbatim
+		if block != "" {
+			if strings.ToLower(line) == "</"+block+">" {
+				if inlineBlocks[block] {
+					config.setPEM(block, strings.Join(blockLines, "\n")+"\n")
+				}
+				block, blockLines = "", nil
+			} else {
+				blockLines = append(blockLines, line)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">") {
+			block = strings.ToLower(line[1 : len(line)-1])
+			if !inlineBlocks[block] {
+				config.unsupported(lineNumber, line)
+			}
+			continue
+		}
+
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		directive, args := strings.ToLower(strings.TrimPrefix(fields[0], "--")), fields[1:]
+
+		var err error
+		switch directive {
+		case "remote":
+			if len(args) == 0 {
+				err = fmt.Errorf("remote needs a host")
+			}
+			remotes = append(remotes, args)
+		case "port":
+			port, err = parsePort(args)
+		case "proto":
+			if len(args) == 0 {
+				err = fmt.Errorf("proto needs a protocol")
+			} else {
+				proto = normalizeProto(args[0])
+			}
+		case "cipher", "data-ciphers", "ncp-ciphers":
+			if len(args) == 0 {
+				err = fmt.Errorf("%s needs a cipher", directive)
+			} else if directive != "cipher" || !dataCiphers {
+				config.Cipher = strings.ToUpper(strings.Split(args[0], ":")[0])
+				dataCiphers = directive != "cipher"
+			}
+		case "ca", "cert", "key", "tls-auth", "tls-crypt":
+			if len(args) == 0 {
+				err = fmt.Errorf("%s needs a file", directive)
+			} else if args[0] != "[inline]" {
+				err = config.readPEM(directive, dir, args[0])
+			}
+		case "dhcp-option":
+			if len(args) == 2 && strings.EqualFold(args[0], "DNS") {
+				if net.ParseIP(args[1]) == nil {
+					err = fmt.Errorf("invalid DNS server %q", args[1])
+				}
+				config.DNS = append(config.DNS, args[1])
+			} else {
+				config.unsupported(lineNumber, line)
+			}
+		case "route":
+			if len(args) > 0 && args[0] == "remote_host" {
+				config.unsupported(lineNumber, line)
+				break
+			}
+			var prefix string
+			var excluded bool
+			prefix, excluded, err = parseRoute(args)
+			if excluded {
+				config.ExcludedRoutes = append(config.ExcludedRoutes, prefix)
+			} else {
+				config.Routes = append(config.Routes, prefix)
+			}
+		case "redirect-gateway":
+			config.RedirectGateway = true
+		case "ifconfig":
+			if len(args) == 0 || net.ParseIP(args[0]) == nil {
+				err = fmt.Errorf("ifconfig needs a local address")
+			} else {
+				config.LocalIP = args[0]
+			}
+		case "comp-lzo":
+			if len(args) == 0 || args[0] != "no" {
+				config.Compression = "lzo"
+			}
+		case "compress":
+			config.Compression = "stub"
+			if len(args) > 0 {
+				config.Compression = args[0]
+			}
+		case "keepalive":
+			if len(args) != 2 {
+				err = fmt.Errorf("keepalive needs an interval and a timeout")
+			} else if config.KeepaliveInterval, err = strconv.Atoi(args[0]); err == nil {
+				config.KeepaliveTimeout, err = strconv.Atoi(args[1])
+			}
+		case "auth-user-pass":
+			config.AuthUserPass = true
+		case "http-proxy", "socks-proxy":
+			if len(args) < 2 {
+				err = fmt.Errorf("%s needs a host and a port", directive)
+			} else {
+				scheme := "http"
+				if directive == "socks-proxy" {
+					scheme = "socks5"
+				}
+				config.Proxy = scheme + "://" + net.JoinHostPort(args[0], args[1])
+			}
+		default:
+			if !ignored[directive] {
+				config.unsupported(lineNumber, line)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if block != "" {
+		return nil, fmt.Errorf("unterminated inline block <%s>", block)
+	}
+
+	// Remotes fall back to the port and proto directives wherever they
+	// come in the file
+	for _, args := range remotes {
+		remote := Remote{Host: args[0], Port: port, Proto: proto}
+		if len(args) > 1 {
+			p, err := parsePort(args[1:2])
+			if err != nil {
+				return nil, fmt.Errorf("remote %s: %v", args[0], err)
+			}
+			remote.Port = p
+		}
+		if len(args) > 2 {
+			remote.Proto = normalizeProto(args[2])
+		}
+		config.Remotes = append(config.Remotes, remote)
+	}
+	if len(config.Remotes) == 0 {
+		return nil, fmt.Errorf("missing remote")
+	}
+
+	return config, nil
+}
+
+// unsupported records a directive with no StealthVPN equivalent
+func (c *Config) unsupported(lineNumber int, line string) {
+	c.Unsupported = append(c.Unsupported, fmt.Sprintf("line %d: %s", lineNumber, line))
+}
+
+// setPEM assigns the contents of an inline block or named file
+func (c *Config) setPEM(directive, contents string) {
+	switch directive {
+	case "ca":
+		c.CA = contents
+	case "cert":
+		c.Cert = contents
+	case "key":
+		c.Key = contents
+	case "tls-auth", "tls-crypt":
+		c.TLSAuth = contents
+	}
+}
+
+// readPEM reads the file a ca, cert, key or tls-auth directive names
+func (c *Config) readPEM(directive, dir, name string) error {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	c.setPEM(directive, string(contents))
+	return nil
+}
+
+// parsePort parses the port a port or remote directive gives
+func parsePort(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, fmt.Errorf("missing port")
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", args[0])
+	}
+	return port, nil
+}
+
+// normalizeProto reduces udp4, tcp6-client and the like to udp or tcp
+func normalizeProto(proto string) string {
+	if strings.HasPrefix(strings.ToLower(proto), "tcp") {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// parseRoute turns a route directive's network and netmask into a CIDR
+// prefix, and reports whether its gateway, net_gateway, keeps the network
+// off the tunnel
+func parseRoute(args []string) (string, bool, error) {
+	if len(args) == 0 {
+		return "", false, fmt.Errorf("route needs a network")
+	}
+	ip := net.ParseIP(args[0]).To4()
+	if ip == nil {
+		return "", false, fmt.Errorf("invalid route network %q", args[0])
+	}
+	mask := net.CIDRMask(32, 32)
+	if len(args) > 1 && args[1] != "default" {
+		maskIP := net.ParseIP(args[1]).To4()
+		if maskIP == nil {
+			return "", false, fmt.Errorf("invalid route netmask %q", args[1])
+		}
+		mask = net.IPMask(maskIP)
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return "", false, fmt.Errorf("invalid route netmask %q", args[1])
+	}
+	excluded := len(args) > 2 && args[2] == "net_gateway"
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: net.CIDRMask(ones, bits)}).String(), excluded, nil
+}
+
+// AllowedIPs returns the prefixes to route through the tunnel, everything
+// if the config redirects the default gateway, less the excluded routes
+func (c *Config) AllowedIPs() []string {
+	routes := c.Routes
+	if c.RedirectGateway {
+		routes = []string{"0.0.0.0/0", "::/0"}
+	}
+	if len(c.ExcludedRoutes) == 0 {
+		return routes
+	}
+
+	var allowed []string
+	for _, route := range routes {
+		prefixes := []netip.Prefix{netip.MustParsePrefix(route)}
+		for _, excluded := range c.ExcludedRoutes {
+			var rest []netip.Prefix
+			for _, prefix := range prefixes {
+				rest = append(rest, excludePrefix(prefix, netip.MustParsePrefix(excluded))...)
+			}
+			prefixes = rest
+		}
+		for _, prefix := range prefixes {
+			allowed = append(allowed, prefix.String())
+		}
+	}
+	return allowed
+}
+
+// excludePrefix returns the prefixes that cover prefix but not excluded
+func excludePrefix(prefix, excluded netip.Prefix) []netip.Prefix {
+	if !prefix.Overlaps(excluded) {
+		return []netip.Prefix{prefix}
+	}
+	if excluded.Bits() <= prefix.Bits() {
+		return nil
+	}
+
+	// Split prefix in two halves and exclude from each
+	bits := prefix.Bits() + 1
+	low := netip.PrefixFrom(prefix.Addr(), bits)
+	addr := prefix.Addr().AsSlice()
+	addr[prefix.Bits()/8] |= 0x80 >> (prefix.Bits() % 8)
+	highAddr, _ := netip.AddrFromSlice(addr)
+	high := netip.PrefixFrom(highAddr, bits)
+	return append(excludePrefix(low, excluded), excludePrefix(high, excluded)...)
+}
@@ -0,0 +1,80 @@
+package wireguard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keySize is the length of a raw Curve25519 key
+const keySize = 32
+
+// Export formats config as a wg-quick .conf file, the inverse of Parse
+func Export(config *Config) (string, error) {
+	if err := checkKey("PrivateKey", config.Interface.PrivateKey); err != nil {
+		return "", err
+	}
+	if _, err := parsePrefixes(strings.Join(config.Interface.Address, ",")); err != nil {
+		return "", err
+	}
+	if len(config.Peers) == 0 {
+		return "", fmt.Errorf("missing [Peer] section")
+	}
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	writeKey(&b, "PrivateKey", config.Interface.PrivateKey)
+	writeKey(&b, "Address", strings.Join(config.Interface.Address, ", "))
+	writeKey(&b, "DNS", strings.Join(config.Interface.DNS, ", "))
+	if config.Interface.ListenPort > 0 {
+		writeKey(&b, "ListenPort", strconv.Itoa(config.Interface.ListenPort))
+	}
+	if config.Interface.MTU > 0 {
+		writeKey(&b, "MTU", strconv.Itoa(config.Interface.MTU))
+	}
+
+	for i, peer := range config.Peers {
+		if err := checkKey("PublicKey", peer.PublicKey); err != nil {
+			return "", fmt.Errorf("peer %d: %v", i+1, err)
+		}
+		if peer.PresharedKey != "" {
+			if err := checkKey("PresharedKey", peer.PresharedKey); err != nil {
+				return "", fmt.Errorf("peer %d: %v", i+1, err)
+			}
+		}
+		if _, err := parsePrefixes(strings.Join(peer.AllowedIPs, ",")); err != nil {
+			return "", fmt.Errorf("peer %d: %v", i+1, err)
+		}
+
+		b.WriteString("\n[Peer]\n")
+		writeKey(&b, "PublicKey", peer.PublicKey)
+		writeKey(&b, "PresharedKey", peer.PresharedKey)
+		writeKey(&b, "Endpoint", peer.Endpoint)
+		writeKey(&b, "AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		if peer.PersistentKeepalive > 0 {
+			writeKey(&b, "PersistentKeepalive", strconv.Itoa(peer.PersistentKeepalive))
+		}
+	}
+	return b.String(), nil
+}
+
+// writeKey writes a key = value line, leaving out empty values
+func writeKey(b *strings.Builder, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, value)
+	}
+}
+
+// checkKey makes sure value is a key in WireGuard's format, base64 of the
+// raw 32-byte Curve25519 key
+func checkKey(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("missing %s", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != keySize {
+		return fmt.Errorf("invalid %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package wireguard reads and writes WireGuard configuration files in the
+// wg-quick format, so their networking parameters can be reused by
+// StealthVPN and its keys by WireGuard.
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Interface is the [Interface] section of a WireGuard config
+type Interface struct {
+	PrivateKey string
+	Address    []string // CIDR notation, e.g. 10.0.0.2/24
+	DNS        []string // servers and search domains
+	ListenPort int
+	MTU        int
+}
+
+// Peer is a [Peer] section of a WireGuard config
+type Peer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// Config is a parsed WireGuard config
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// ParseFile reads and parses the WireGuard config at path
+func ParseFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses a WireGuard config. Keys the importer has no use for, such
+// as PostUp or Table, are ignored; WireGuard keys must be well formed.
+func Parse(r io.Reader) (*Config, error) {
+	config := &Config{}
+	section := ""
+	seenInterface := false
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				if seenInterface {
+					return nil, fmt.Errorf("line %d: duplicate [Interface] section", lineNumber)
+				}
+				seenInterface = true
+			case "peer":
+				config.Peers = append(config.Peers, Peer{})
+			default:
+				return nil, fmt.Errorf("line %d: unknown section [%s]", lineNumber, section)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = config.Interface.set(key, value)
+		case "peer":
+			err = config.Peers[len(config.Peers)-1].set(key, value)
+		default:
+			err = fmt.Errorf("%q outside of a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !seenInterface {
+		return nil, fmt.Errorf("missing [Interface] section")
+	}
+	if len(config.Peers) == 0 {
+		return nil, fmt.Errorf("missing [Peer] section")
+	}
+
+	return config, nil
+}
+
+// set assigns an [Interface] key
+func (i *Interface) set(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		if err = checkKey("PrivateKey", value); err == nil {
+			i.PrivateKey = value
+		}
+	case "address":
+		i.Address, err = parsePrefixes(value)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "listenport":
+		i.ListenPort, err = strconv.Atoi(value)
+	case "mtu":
+		i.MTU, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+// set assigns a [Peer] key
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		if err = checkKey("PublicKey", value); err == nil {
+			p.PublicKey = value
+		}
+	case "presharedkey":
+		if err = checkKey("PresharedKey", value); err == nil {
+			p.PresharedKey = value
+		}
+	case "endpoint":
+		if _, _, err = net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("invalid endpoint %q: %v", value, err)
+		}
+		p.Endpoint = value
+	case "allowedips":
+		var prefixes []string
+		prefixes, err = parsePrefixes(value)
+		p.AllowedIPs = append(p.AllowedIPs, prefixes...)
+	case "persistentkeepalive":
+		if value == "off" {
+			p.PersistentKeepalive = 0
+		} else {
+			p.PersistentKeepalive, err = strconv.Atoi(value)
+		}
+	}
+	return err
+}
+
+// parsePrefixes parses a comma-separated list of CIDR prefixes
+func parsePrefixes(value string) ([]string, error) {
+	prefixes := splitList(value)
+	for _, prefix := range prefixes {
+		if _, _, err := net.ParseCIDR(prefix); err != nil {
+			return nil, fmt.Errorf("invalid prefix %q", prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Addresses returns the first IPv4 and first IPv6 interface address, without
+// their prefix lengths. Either may be empty.
+func (c *Config) Addresses() (ipv4, ipv6 string) {
+	for _, prefix := range c.Interface.Address {
+		ip, _, _ := net.ParseCIDR(prefix)
+		if ip.To4() != nil {
+			if ipv4 == "" {
+				ipv4 = ip.String()
+			}
+		} else if ipv6 == "" {
+			ipv6 = ip.String()
+		}
+	}
+	return ipv4, ipv6
+}
+
+// DNSServers returns the DNS entries that are IP addresses, leaving out
+// search domains
+func (c *Config) DNSServers() []string {
+	var servers []string
+	for _, entry := range c.Interface.DNS {
+		if net.ParseIP(entry) != nil {
+			servers = append(servers, entry)
+		}
+	}
+	return servers
+}
+
+// AllowedIPs returns the allowed IPs of every peer
+func (c *Config) AllowedIPs() []string {
+	var prefixes []string
+	for _, peer := range c.Peers {
+		prefixes = append(prefixes, peer.AllowedIPs...)
+	}
+	return prefixes
+}
@@ -0,0 +1,113 @@
+package wireguard
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	testPublicKey  = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	testPSK        = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+const testConfig = `# Exported from the provider's dashboard
+[Interface]
+PrivateKey = ` + testPrivateKey + `
+Address = 10.14.0.2/16, fd00:14::2/64   # both families
+DNS = 10.14.0.1, vpn.internal
+MTU = 1380
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]  # the exit
+PublicKey = ` + testPublicKey + `
+PresharedKey = ` + testPSK + `
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/1, 128.0.0.0/1
+AllowedIPs = ::/0
+# AllowedIPs = 192.168.0.0/16
+PersistentKeepalive = 25
+
+[peer]
+publickey = ` + testPublicKey + `
+allowedips = 10.99.0.0/24
+persistentkeepalive = off
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Interface.PrivateKey != testPrivateKey || config.Interface.MTU != 1380 {
+		t.Errorf("interface = %+v", config.Interface)
+	}
+	if ipv4, ipv6 := config.Addresses(); ipv4 != "10.14.0.2" || ipv6 != "fd00:14::2" {
+		t.Errorf("Addresses() = %s, %s", ipv4, ipv6)
+	}
+	if got := config.DNSServers(); !slices.Equal(got, []string{"10.14.0.1"}) {
+		t.Errorf("DNSServers() = %v, want the search domain left out", got)
+	}
+
+	if len(config.Peers) != 2 {
+		t.Fatalf("%d peers, want 2", len(config.Peers))
+	}
+	peer := config.Peers[0]
+	if peer.PublicKey != testPublicKey || peer.PresharedKey != testPSK || peer.Endpoint != "vpn.example.com:51820" || peer.PersistentKeepalive != 25 {
+		t.Errorf("peer = %+v", peer)
+	}
+
+	// AllowedIPs lines add up; the commented-out one does not count
+	want := []string{"0.0.0.0/1", "128.0.0.0/1", "::/0", "10.99.0.0/24"}
+	if got := config.AllowedIPs(); !slices.Equal(got, want) {
+		t.Errorf("AllowedIPs() = %v, want %v", got, want)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	peer := "\n[Peer]\nPublicKey = " + testPublicKey + "\nAllowedIPs = 0.0.0.0/0\n"
+	for _, test := range []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"bad private key", "[Interface]\nPrivateKey = not-a-key\n" + peer, "invalid PrivateKey"},
+		{"short public key", "[Interface]\nPrivateKey = " + testPrivateKey + "\n[Peer]\nPublicKey = AAAA\n", "invalid PublicKey"},
+		{"bad preshared key", "[Interface]\nPrivateKey = " + testPrivateKey + peer + "PresharedKey = " + testPSK[:20] + "\n", "invalid PresharedKey"},
+		{"unknown section", "[Interface]\nPrivateKey = " + testPrivateKey + peer + "\n[Relay]\nEndpoint = relay.example.com:51820\n", "unknown section [relay]"},
+		{"duplicate interface", "[Interface]\n[Interface]\n" + peer, "duplicate [Interface]"},
+		{"key outside a section", "MTU = 1380\n[Interface]\n" + peer, "outside of a section"},
+		{"line without a value", "[Interface]\nPrivateKey\n" + peer, "expected key = value"},
+		{"bad prefix", "[Interface]\nAddress = 10.14.0.2\n" + peer, "invalid prefix"},
+		{"bad endpoint", "[Interface]" + peer + "Endpoint = vpn.example.com\n", "invalid endpoint"},
+		{"no interface", peer, "missing [Interface]"},
+		{"no peer", "[Interface]\nPrivateKey = " + testPrivateKey + "\n", "missing [Peer]"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.config))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Parse() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportParsesBack(t *testing.T) {
+	config, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := Export(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(strings.NewReader(exported))
+	if err != nil {
+		t.Fatalf("exported config does not parse: %v\n%s", err, exported)
+	}
+	if !slices.Equal(parsed.AllowedIPs(), config.AllowedIPs()) || parsed.Interface.PrivateKey != config.Interface.PrivateKey {
+		t.Errorf("exported config parses to %+v, want %+v", parsed, config)
+	}
+}
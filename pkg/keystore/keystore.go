@@ -0,0 +1,14 @@
+// Package keystore provides private keys that are held outside the
+// server's config files, such as on hardware tokens.
+package keystore
+
+// PKCS11Config locates a private key on a PKCS#11 token: an HSM, a TPM or a
+// smart card
+type PKCS11Config struct {
+	Module     string `json:"module"`      // the vendor's PKCS#11 library
+	Slot       *uint  `json:"slot"`        // slot holding the token
+	TokenLabel string `json:"token_label"` // alternative to slot
+	PIN        string `json:"pin"`         // user PIN; empty if the token needs none
+	KeyLabel   string `json:"key_label"`   // CKA_LABEL of the private key
+	KeyID      string `json:"key_id"`      // CKA_ID of the private key, in hex
+}
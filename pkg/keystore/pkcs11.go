@@ -0,0 +1,250 @@
+//go:build cgo
+
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Provider holds a logged-in session with a PKCS#11 token
+type PKCS11Provider struct {
+	config  PKCS11Config
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+
+	// A session runs one operation at a time
+	mu sync.Mutex
+}
+
+// NewPKCS11Provider loads the module, opens a session with the configured
+// token and logs in
+func NewPKCS11Provider(config PKCS11Config) (*PKCS11Provider, error) {
+	if config.Module == "" {
+		return nil, errors.New("no PKCS#11 module configured")
+	}
+	if config.KeyLabel == "" && config.KeyID == "" {
+		return nil, errors.New("set key_label or key_id to choose the private key")
+	}
+
+	ctx := pkcs11.New(config.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", config.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %v", err)
+	}
+	p := &PKCS11Provider{config: config, ctx: ctx}
+
+	slot, err := p.findSlot()
+	if err != nil {
+		p.finalize()
+		return nil, err
+	}
+	p.session, err = ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		p.finalize()
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %v", err)
+	}
+
+	if config.PIN != "" {
+		err := ctx.Login(p.session, pkcs11.CKU_USER, config.PIN)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			ctx.CloseSession(p.session)
+			p.finalize()
+			return nil, fmt.Errorf("PKCS#11 login failed: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// findSlot returns the configured slot, the slot whose token has the
+// configured label, or the only slot with a token
+func (p *PKCS11Provider) findSlot() (uint, error) {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %v", err)
+	}
+
+	for _, slot := range slots {
+		if p.config.Slot != nil {
+			if slot == *p.config.Slot {
+				return slot, nil
+			}
+			continue
+		}
+		if p.config.TokenLabel != "" {
+			info, err := p.ctx.GetTokenInfo(slot)
+			if err == nil && strings.TrimSpace(info.Label) == p.config.TokenLabel {
+				return slot, nil
+			}
+			continue
+		}
+		if len(slots) == 1 {
+			return slot, nil
+		}
+		return 0, fmt.Errorf("%d PKCS#11 tokens present; set slot or token_label", len(slots))
+	}
+
+	switch {
+	case p.config.Slot != nil:
+		return 0, fmt.Errorf("no token in PKCS#11 slot %d", *p.config.Slot)
+	case p.config.TokenLabel != "":
+		return 0, fmt.Errorf("no PKCS#11 token labelled %q", p.config.TokenLabel)
+	default:
+		return 0, errors.New("no PKCS#11 token present")
+	}
+}
+
+// Signer returns a crypto.Signer for the configured private key. The key
+// never leaves the token; publicKey is its public half, normally taken from
+// the certificate.
+func (p *PKCS11Provider) Signer(publicKey crypto.PublicKey) (crypto.Signer, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if p.config.KeyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.config.KeyLabel))
+	}
+	if p.config.KeyID != "" {
+		id, err := hex.DecodeString(p.config.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key_id: %v", err)
+		}
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return nil, fmt.Errorf("failed to search for the private key: %v", err)
+	}
+	objects, _, err := p.ctx.FindObjects(p.session, 2)
+	p.ctx.FindObjectsFinal(p.session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for the private key: %v", err)
+	}
+	switch len(objects) {
+	case 0:
+		return nil, errors.New("private key not found on the token")
+	case 1:
+		return &pkcs11Signer{provider: p, key: objects[0], public: publicKey}, nil
+	default:
+		return nil, errors.New("several private keys match; set both key_label and key_id")
+	}
+}
+
+// Close logs out and unloads the module
+func (p *PKCS11Provider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	p.finalize()
+	return nil
+}
+
+func (p *PKCS11Provider) finalize() {
+	p.ctx.Finalize()
+	p.ctx.Destroy()
+}
+
+// sign runs one signing operation on the token
+func (p *PKCS11Provider) sign(key pkcs11.ObjectHandle, mechanism *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{mechanism}, key); err != nil {
+		return nil, err
+	}
+	return p.ctx.Sign(p.session, data)
+}
+
+// pkcs11Signer signs with a private key that stays on the token
+type pkcs11Signer struct {
+	provider *PKCS11Provider
+	key      pkcs11.ObjectHandle
+	public   crypto.PublicKey
+}
+
+// Public returns the public half of the key
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs digest on the token, in the format crypto/tls expects for the
+// key type
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		raw, err := s.provider.sign(s.key, pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest)
+		if err != nil {
+			return nil, err
+		}
+		// PKCS#11 returns r and s concatenated; Go wants ASN.1
+		if len(raw) == 0 || len(raw)%2 != 0 {
+			return nil, fmt.Errorf("invalid ECDSA signature length %d", len(raw))
+		}
+		half := len(raw) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(raw[:half]),
+			new(big.Int).SetBytes(raw[half:]),
+		})
+	}
+
+	hash := opts.HashFunc()
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		params, ok := pssMechanisms[hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v for RSA-PSS", hash)
+		}
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+			saltLength = hash.Size()
+		}
+		mechanism := pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(params[0], params[1], uint(saltLength)))
+		return s.provider.sign(s.key, mechanism, digest)
+	}
+
+	// PKCS#1 v1.5: the token pads, but the DigestInfo is ours to add
+	prefix, ok := digestInfoPrefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v for RSA", hash)
+	}
+	data := append(append([]byte(nil), prefix...), digest...)
+	return s.provider.sign(s.key, pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), data)
+}
+
+// pssMechanisms maps hashes to the PKCS#11 hash and MGF for RSA-PSS
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// digestInfoPrefixes are the DER DigestInfo headers for PKCS#1 v1.5 (RFC 8017)
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
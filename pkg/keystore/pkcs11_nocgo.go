@@ -0,0 +1,30 @@
+//go:build !cgo
+
+package keystore
+
+import (
+	"crypto"
+	"errors"
+)
+
+// errNoPKCS11 is returned by builds without cgo, which the PKCS#11 library
+// is loaded through
+var errNoPKCS11 = errors.New("PKCS#11 support not compiled in")
+
+// PKCS11Provider stands in for the token session in builds without cgo
+type PKCS11Provider struct{}
+
+// NewPKCS11Provider fails, as this build cannot load PKCS#11 modules
+func NewPKCS11Provider(config PKCS11Config) (*PKCS11Provider, error) {
+	return nil, errNoPKCS11
+}
+
+// Signer fails, as this build cannot load PKCS#11 modules
+func (p *PKCS11Provider) Signer(publicKey crypto.PublicKey) (crypto.Signer, error) {
+	return nil, errNoPKCS11
+}
+
+// Close does nothing
+func (p *PKCS11Provider) Close() error {
+	return nil
+}
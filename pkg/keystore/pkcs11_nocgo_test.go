@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package keystore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPKCS11WithoutCgo(t *testing.T) {
+	_, err := NewPKCS11Provider(PKCS11Config{Module: "/usr/lib/softhsm/libsofthsm2.so", KeyLabel: "tls"})
+	if !errors.Is(err, errNoPKCS11) {
+		t.Fatalf("NewPKCS11Provider() error = %v, want %v", err, errNoPKCS11)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build cgo
+
+package keystore
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPKCS11ProviderRejectsConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "libmissing.so")
+	for name, config := range map[string]PKCS11Config{
+		"no module":      {KeyLabel: "tls"},
+		"no key":         {Module: missing},
+		"missing module": {Module: missing, KeyLabel: "tls"},
+	} {
+		if provider, err := NewPKCS11Provider(config); err == nil {
+			provider.Close()
+			t.Errorf("%s: provider created", name)
+		}
+	}
+}
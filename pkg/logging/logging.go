@@ -0,0 +1,56 @@
+// Package logging sets up the structured, leveled logger the server and
+// clients log through, and keeps key material out of what it writes.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Setup makes a logger writing to stderr at level ("debug", "info", "warn"
+// or "error") in format ("text" or "json") the default for slog and the
+// standard log package
+func Setup(level, format string) error {
+	logger, err := New(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// New returns a logger writing to w at level in format. Attributes whose
+// names suggest a secret are written as [REDACTED].
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel, ReplaceAttr: redactAttr}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, want text or json", format)
+	}
+}
+
+// Fatal logs msg at error level and exits, as log.Fatal does
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// redactAttr masks attributes named like secrets, wherever they are logged
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() != slog.KindGroup && sensitive(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
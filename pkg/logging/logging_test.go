@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLevelsAndFormats(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "psk", "0123456789abcdef", "pre_shared_key_id", "2024-01")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("not one JSON entry: %q", buf.String())
+	}
+	if entry["msg"] != "shown" || entry["psk"] != redacted || entry["pre_shared_key_id"] != "2024-01" {
+		t.Errorf("logged %v", entry)
+	}
+
+	if _, err := New(&buf, "loud", "text"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestSensitive(t *testing.T) {
+	for name, want := range map[string]bool{
+		"pre_shared_key":    true,
+		"PreSharedKey":      true,
+		"managementToken":   true,
+		"TOTPSecret":        true,
+		"pkcs11-pin":        true,
+		"pre_shared_key_id": false,
+		"tls_key_file":      false,
+		"session_token_ttl": false,
+		"PublicKey":         false,
+		"keepalive":         false,
+		"monkey":            false,
+	} {
+		if got := sensitive(name); got != want {
+			t.Errorf("sensitive(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	type peer struct {
+		Name    string `json:"name"`
+		Cookie  string `json:"cookie" log:"secret"`
+		RawData []byte `json:"raw"`
+	}
+	config := struct {
+		PreSharedKey string            `json:"pre_shared_key"`
+		KeyFile      string            `json:"pre_shared_key_file"`
+		Password     string            `json:"password"`
+		RedisURL     string            `json:"redis_url"`
+		Timeout      time.Duration     `json:"timeout"`
+		Peers        []peer            `json:"peers"`
+		Env          map[string]string `json:"env"`
+		Hidden       string            `json:"-"`
+	}{
+		PreSharedKey: "0123456789abcdef",
+		KeyFile:      "/etc/stealthvpn/psk",
+		RedisURL:     "redis://:hunter2@redis.internal:6379",
+		Timeout:      time.Second,
+		Peers:        []peer{{Name: "a", Cookie: "c00kie", RawData: []byte{1}}},
+		Env:          map[string]string{"API_TOKEN": "t0ken", "REGION": "eu"},
+		Hidden:       "hidden",
+	}
+
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("config", "config", Redacted(&config))
+	out := buf.String()
+	for _, secret := range []string{"0123456789abcdef", "hunter2", "c00kie", "t0ken", "hidden"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("logged %q: %s", secret, out)
+		}
+	}
+	for _, shown := range []string{"/etc/stealthvpn/psk", "redis.internal:6379", `"timeout":"1s"`, `"REGION":"eu"`, `"password":""`} {
+		if !strings.Contains(out, shown) {
+			t.Errorf("%s missing from %s", shown, out)
+		}
+	}
+}
+
+func TestRedactAttrKeepsGroups(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("login", slog.Group("token", "issued", true), "token", "abc")
+	if out := buf.String(); !strings.Contains(out, "token.issued=true") || strings.Contains(out, "abc") {
+		t.Errorf("logged %q", out)
+	}
+}
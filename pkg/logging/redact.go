@@ -0,0 +1,191 @@
+package logging
+
+import (
+	"encoding"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+// secretWords mark a field or attribute name as holding a secret
+var secretWords = map[string]bool{
+	"key": true, "psk": true, "password": true, "secret": true,
+	"token": true, "pin": true, "otp": true,
+}
+
+// harmlessWords mark a name otherwise holding a secret word as only
+// describing or pointing to one, like pre_shared_key_id or tls_key_file
+var harmlessWords = map[string]bool{
+	"id": true, "file": true, "label": true, "ttl": true, "public": true,
+}
+
+// sensitive reports whether a name, in snake_case, camelCase or
+// PascalCase, suggests its value is a secret
+func sensitive(name string) bool {
+	secret := false
+	for _, word := range splitWords(name) {
+		if harmlessWords[word] {
+			return false
+		}
+		if secretWords[word] {
+			secret = true
+		}
+	}
+	return secret
+}
+
+// splitWords splits a name into lowercase words at underscores, dashes,
+// dots and case changes
+func splitWords(name string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, strings.ToLower(word.String()))
+			word.Reset()
+		}
+	}
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-' || r == '.':
+			flush()
+			continue
+		case r >= 'A' && r <= 'Z' && i > 0:
+			// Split before an upper case letter, except inside an acronym
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && runes[i+1] >= 'a' && runes[i+1] <= 'z'
+			if prev >= 'a' && prev <= 'z' || prev >= 'A' && prev <= 'Z' && nextLower {
+				flush()
+			}
+		}
+		word.WriteRune(r)
+	}
+	flush()
+	return words
+}
+
+// Redacted returns v, usually a configuration, for logging with every
+// secret in it masked. Fields are named as in JSON. Besides fields named
+// like secrets, fields tagged `log:"secret"` are masked, for secrets whose
+// name does not give them away.
+func Redacted(v any) slog.Value {
+	return slog.AnyValue(redactValue(reflect.ValueOf(v)))
+}
+
+// redactValue converts v into maps, slices and plain values, masking secrets
+func redactValue(v reflect.Value) any {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+
+	// Keep types that describe themselves, like durations and addresses
+	if v.CanInterface() {
+		switch value := v.Interface().(type) {
+		case encoding.TextMarshaler:
+			if text, err := value.MarshalText(); err == nil {
+				return string(text)
+			}
+		case fmt.Stringer:
+			if v.Kind() != reflect.Struct {
+				return value.String()
+			}
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]any)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := jsonName(field)
+			if name == "-" {
+				continue
+			}
+			if field.Tag.Get("log") == "secret" || sensitive(name) {
+				fields[name] = maskValue(v.Field(i))
+				continue
+			}
+			fields[name] = redactValue(v.Field(i))
+		}
+		return fields
+	case reflect.Map:
+		entries := make(map[string]any, v.Len())
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, key := range keys {
+			name := fmt.Sprint(key)
+			if sensitive(name) {
+				entries[name] = maskValue(v.MapIndex(key))
+				continue
+			}
+			entries[name] = redactValue(v.MapIndex(key))
+		}
+		return entries
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			// Raw bytes in a configuration are key material more often
+			// than not
+			return maskValue(v)
+		}
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = redactValue(v.Index(i))
+		}
+		return items
+	case reflect.String:
+		return redactURL(v.String())
+	default:
+		if v.CanInterface() {
+			return v.Interface()
+		}
+		return nil
+	}
+}
+
+// maskValue hides a secret, but still shows whether one is set
+func maskValue(v reflect.Value) any {
+	if v.IsZero() {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL masks the password in a URL such as redis://:password@host
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") || !strings.Contains(s, "@") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// jsonName returns the name a struct field has in JSON
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
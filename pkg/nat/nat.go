@@ -0,0 +1,108 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Type describes how a NAT maps a socket's traffic to public endpoints, in
+// the terms of RFC 4787
+type Type string
+
+const (
+	// TypeUnknown is reported when too few STUN servers answered to tell
+	TypeUnknown Type = "unknown"
+	// TypeNone means the socket's own address is public
+	TypeNone Type = "none"
+	// TypeEndpointIndependent keeps one mapping for every destination, as
+	// "cone" NATs do, so a peer can reach the endpoint a STUN server saw
+	TypeEndpointIndependent Type = "endpoint-independent"
+	// TypeEndpointDependent maps each destination anew, as "symmetric" NATs
+	// do, so hole punching to a peer only works if the peer's NAT does not
+	TypeEndpointDependent Type = "endpoint-dependent"
+)
+
+// Mapping is what STUN servers saw of a socket
+type Mapping struct {
+	Local  *net.UDPAddr
+	Public *net.UDPAddr // as seen by the first server that answered
+	Type   Type
+}
+
+// Classify works out the NAT type from the public endpoints that different
+// STUN servers saw for a socket bound to local. Telling the two NAT types
+// apart takes servers at different addresses.
+func Classify(local *net.UDPAddr, mapped []*net.UDPAddr) Type {
+	if len(mapped) == 0 {
+		return TypeUnknown
+	}
+	if local != nil && sameEndpoint(local, mapped[0]) {
+		return TypeNone
+	}
+	if len(mapped) < 2 {
+		return TypeUnknown
+	}
+	for _, addr := range mapped[1:] {
+		if !sameEndpoint(addr, mapped[0]) {
+			return TypeEndpointDependent
+		}
+	}
+	return TypeEndpointIndependent
+}
+
+// DetectNAT asks each of servers, which should be at different addresses,
+// which public endpoint conn is mapped to and classifies the NAT from the
+// answers. Servers that do not answer are skipped; it fails only if none do.
+func DetectNAT(ctx context.Context, conn *net.UDPConn, servers []string) (*Mapping, error) {
+	var mapped []*net.UDPAddr
+	var lastErr error
+	for _, server := range servers {
+		addr, err := Discover(ctx, conn, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		mapped = append(mapped, addr)
+	}
+	if len(mapped) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no STUN servers given")
+		}
+		return nil, lastErr
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	return &Mapping{
+		Local:  local,
+		Public: mapped[0],
+		Type:   Classify(localEndpoint(local, mapped[0]), mapped),
+	}, nil
+}
+
+// localEndpoint returns local with its address filled in from the host's
+// interfaces when the socket is bound to all of them: the public address if
+// an interface has it, so a host outside any NAT is recognised
+func localEndpoint(local, public *net.UDPAddr) *net.UDPAddr {
+	if !local.IP.IsUnspecified() {
+		return local
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if prefix, ok := addr.(*net.IPNet); ok && prefix.IP.Equal(public.IP) {
+			return &net.UDPAddr{IP: prefix.IP, Port: local.Port}
+		}
+	}
+	return nil
+}
+
+// sameEndpoint reports whether a and b are the same address and port
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,55 @@
+package nat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	udp := func(s string) *net.UDPAddr {
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	for _, test := range []struct {
+		name   string
+		local  *net.UDPAddr
+		mapped []*net.UDPAddr
+		want   Type
+	}{
+		{"no answers", udp("192.168.1.2:5000"), nil, TypeUnknown},
+		{"public address", udp("198.51.100.4:5000"), []*net.UDPAddr{udp("198.51.100.4:5000")}, TypeNone},
+		{"public IPv6 address", udp("[2001:db8::4]:5000"), []*net.UDPAddr{udp("[2001:db8::4]:5000"), udp("[2001:db8::4]:5000")}, TypeNone},
+		{"one answer behind a NAT", udp("192.168.1.2:5000"), []*net.UDPAddr{udp("203.0.113.7:40000")}, TypeUnknown},
+		{"same mapping for every server", udp("192.168.1.2:5000"), []*net.UDPAddr{udp("203.0.113.7:40000"), udp("203.0.113.7:40000"), udp("203.0.113.7:40000")}, TypeEndpointIndependent},
+		{"port changes per server", udp("192.168.1.2:5000"), []*net.UDPAddr{udp("203.0.113.7:40000"), udp("203.0.113.7:40001")}, TypeEndpointDependent},
+		{"address changes per server", udp("192.168.1.2:5000"), []*net.UDPAddr{udp("203.0.113.7:40000"), udp("203.0.113.8:40000")}, TypeEndpointDependent},
+		{"unknown local address", nil, []*net.UDPAddr{udp("203.0.113.7:40000"), udp("203.0.113.7:40000")}, TypeEndpointIndependent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Classify(test.local, test.mapped); got != test.want {
+				t.Errorf("Classify() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLocalEndpoint(t *testing.T) {
+	bound := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	if got := localEndpoint(bound, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1}); got != bound {
+		t.Errorf("localEndpoint() = %v, want the bound address kept", got)
+	}
+
+	// A wildcard socket takes the address of the interface that has the
+	// public one, and is unknown when none has
+	wildcard := &net.UDPAddr{IP: net.IPv4zero, Port: 5000}
+	if got := localEndpoint(wildcard, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); got == nil || !got.IP.Equal(net.IPv4(127, 0, 0, 1)) || got.Port != 5000 {
+		t.Errorf("localEndpoint() = %v, want 127.0.0.1:5000", got)
+	}
+	if got := localEndpoint(wildcard, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1}); got != nil {
+		t.Errorf("localEndpoint() = %v, want nil for an address no interface has", got)
+	}
+}
@@ -0,0 +1,240 @@
+package nat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// DirectTimeout is how long a PeerLink tries to reach its peer directly
+	// before relaying through the server
+	DirectTimeout = 5 * time.Second
+	// probeInterval is how often probes are sent to the peer's candidates
+	probeInterval = 200 * time.Millisecond
+	// maxPeerFrameSize bounds the datagrams read from the socket
+	maxPeerFrameSize = 65535
+	// peerQueueSize bounds the packets received from the peer and not yet
+	// read; more are dropped
+	peerQueueSize = 256
+)
+
+// Kinds of frame sent between peers, the first byte of their plaintext
+const (
+	frameData     byte = 0
+	frameProbe    byte = 1 // asks the peer to answer on the path it arrived by
+	frameProbeAck byte = 2 // the path works both ways
+)
+
+// RelayFunc sends a frame to the peer through the server, in a
+// protocol.PeerRelayType message. The frame is encrypted for the peer, so
+// the server passes it on without being able to read it.
+type RelayFunc func(frame []byte) error
+
+// PeerLink carries packets between two clients, encrypted end to end with a
+// key only they hold. It sends directly over a UDP socket once hole
+// punching gets a probe through, and through the server until then or if
+// it never does, as between two endpoint-dependent NATs.
+type PeerLink struct {
+	conn       net.PacketConn // the socket whose mapping was sent as a candidate
+	encryption *protocol.MultiLayerEncryption
+	relay      RelayFunc
+
+	direct atomic.Pointer[net.UDPAddr] // the peer's endpoint once a probe was answered; nil while relaying
+
+	received  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPeerLink creates a link to the peer whose public key, from its
+// PeerCandidates, is peerPublicKey. local is the key pair whose public key
+// this client sent the peer. The link reads conn from then on, so any STUN
+// discovery on it must be done first. Frames are relayed until a direct
+// path is found.
+func NewPeerLink(conn net.PacketConn, local *protocol.KeyExchange, peerPublicKey []byte, relay RelayFunc) (*PeerLink, error) {
+	secret, err := local.ComputeSharedSecret(peerPublicKey, peerTranscript(local.GetPublicKey(), peerPublicKey))
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := protocol.NewMultiLayerEncryption(secret)
+	protocol.ZeroBytes(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &PeerLink{
+		conn:       conn,
+		encryption: encryption,
+		relay:      relay,
+		received:   make(chan []byte, peerQueueSize),
+		done:       make(chan struct{}),
+	}
+	go l.readDirect()
+	return l, nil
+}
+
+// peerTranscript binds a link's key to both public keys, in an order both
+// peers agree on
+func peerTranscript(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return append(append([]byte("stealthvpn v1 peer-link"), a...), b...)
+}
+
+// Connect punches holes towards the peer's candidates, host:port endpoints,
+// until a probe is answered or DirectTimeout passes. The link then sends
+// directly, or falls back to relaying; either way it is usable once Connect
+// returns. It fails only if ctx is done first.
+func (l *PeerLink) Connect(ctx context.Context, candidates []string) error {
+	var addrs []*net.UDPAddr
+	for _, candidate := range candidates {
+		if addr, err := net.ResolveUDPAddr("udp", candidate); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	probe, err := l.seal(frameProbe, nil)
+	if err != nil {
+		return err
+	}
+	timeout := time.NewTimer(DirectTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range addrs {
+			l.conn.WriteTo(probe, addr)
+		}
+		select {
+		case <-ticker.C:
+			if l.direct.Load() != nil {
+				return nil
+			}
+		case <-timeout.C:
+			// Probes the peer answers later still switch the link to direct
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// Relayed reports whether the link sends through the server
+func (l *PeerLink) Relayed() bool {
+	return l.direct.Load() == nil
+}
+
+// Send encrypts a packet for the peer and sends it on the best path
+func (l *PeerLink) Send(packet []byte) error {
+	frame, err := l.seal(frameData, packet)
+	if err != nil {
+		return err
+	}
+	if addr := l.direct.Load(); addr != nil {
+		_, err := l.conn.WriteTo(frame, addr)
+		return err
+	}
+	return l.relay(frame)
+}
+
+// HandleRelayed takes a frame the server relayed from the peer
+func (l *PeerLink) HandleRelayed(frame []byte) error {
+	kind, payload, err := l.open(frame)
+	if err != nil {
+		return err
+	}
+	if kind == frameData {
+		l.deliver(payload)
+	}
+	return nil
+}
+
+// Packets returns the packets received from the peer on either path
+func (l *PeerLink) Packets() <-chan []byte {
+	return l.received
+}
+
+// Close stops the link. The socket is left open for its owner to close.
+func (l *PeerLink) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.encryption.Zeroize()
+	})
+}
+
+// readDirect handles frames arriving on the socket until the link is closed
+// or the socket fails. Datagrams that do not decrypt are ignored, as anyone
+// can send to the socket.
+func (l *PeerLink) readDirect() {
+	buffer := make([]byte, maxPeerFrameSize)
+	for {
+		n, from, err := l.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		kind, payload, err := l.open(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		switch kind {
+		case frameProbe:
+			// The peer reached us; answer so it knows the way back works
+			if ack, err := l.seal(frameProbeAck, nil); err == nil {
+				l.conn.WriteTo(ack, addr)
+			}
+		case frameProbeAck:
+			l.direct.CompareAndSwap(nil, addr)
+		case frameData:
+			l.deliver(payload)
+		}
+	}
+}
+
+// seal encrypts a frame of the given kind
+func (l *PeerLink) seal(kind byte, payload []byte) ([]byte, error) {
+	plaintext := make([]byte, 1+len(payload))
+	plaintext[0] = kind
+	copy(plaintext[1:], payload)
+	return l.encryption.Encrypt(plaintext)
+}
+
+// open decrypts a frame, returning its kind and payload
+func (l *PeerLink) open(frame []byte) (byte, []byte, error) {
+	plaintext, err := l.encryption.Decrypt(frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, errors.New("empty peer frame")
+	}
+	return plaintext[0], plaintext[1:], nil
+}
+
+// deliver queues a packet from the peer, dropping it if the reader is
+// behind
+func (l *PeerLink) deliver(packet []byte) {
+	select {
+	case l.received <- packet:
+	default:
+	}
+}
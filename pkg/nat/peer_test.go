@@ -0,0 +1,187 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// relayed records the frames a link hands to the server
+type relayed struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (r *relayed) relay(frame []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, frame)
+	return nil
+}
+
+func (r *relayed) taken() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frames := r.frames
+	r.frames = nil
+	return frames
+}
+
+// linkPair returns two links to each other, each on its own loopback
+// socket and relaying through its own recorder
+func linkPair(t *testing.T) (a, b *PeerLink, relayA, relayB *relayed) {
+	t.Helper()
+	newLink := func(local, peer *protocol.KeyExchange, r *relayed) *PeerLink {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		link, err := NewPeerLink(conn, local, peer.GetPublicKey(), r.relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(link.Close)
+		return link
+	}
+
+	keyA, err := protocol.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := protocol.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayA, relayB = &relayed{}, &relayed{}
+	return newLink(keyA, keyB, relayA), newLink(keyB, keyA, relayB), relayA, relayB
+}
+
+// receive waits for the next packet link got from its peer
+func receive(t *testing.T, link *PeerLink) []byte {
+	t.Helper()
+	select {
+	case packet := <-link.Packets():
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("no packet from the peer")
+		return nil
+	}
+}
+
+func TestPeerLinkRelaysUntilDirect(t *testing.T) {
+	a, b, relayA, _ := linkPair(t)
+	if !a.Relayed() {
+		t.Fatal("new link sends directly before any probe was answered")
+	}
+
+	if err := a.Send([]byte("through the server")); err != nil {
+		t.Fatal(err)
+	}
+	frames := relayA.taken()
+	if len(frames) != 1 {
+		t.Fatalf("%d frames relayed, want 1", len(frames))
+	}
+	if err := b.HandleRelayed(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if packet := receive(t, b); string(packet) != "through the server" {
+		t.Errorf("peer received %q", packet)
+	}
+}
+
+func TestPeerLinkGoesDirect(t *testing.T) {
+	a, b, relayA, relayB := linkPair(t)
+
+	var wg sync.WaitGroup
+	for _, pair := range []struct{ link, peer *PeerLink }{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// An unreachable candidate ahead of the real one is skipped
+			candidates := []string{"not a host:port", pair.peer.conn.LocalAddr().String()}
+			if err := pair.link.Connect(context.Background(), candidates); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if a.Relayed() || b.Relayed() {
+		t.Fatal("answered probes left the link relaying")
+	}
+
+	if err := a.Send([]byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+	if packet := receive(t, b); string(packet) != "direct" {
+		t.Errorf("peer received %q", packet)
+	}
+	if len(relayA.taken()) != 0 || len(relayB.taken()) != 0 {
+		t.Error("frame relayed although the direct path works")
+	}
+}
+
+func TestPeerLinkRejects(t *testing.T) {
+	a, b, relayA, _ := linkPair(t)
+	stranger, _, relayStranger, _ := linkPair(t)
+
+	if err := stranger.Send([]byte("not for b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.HandleRelayed(relayStranger.taken()[0]); err == nil {
+		t.Error("frame sealed with another link's key accepted")
+	}
+	if err := b.HandleRelayed([]byte("garbage")); err == nil {
+		t.Error("garbage relayed frame accepted")
+	}
+
+	// Probes relayed by the server are not data
+	probe, err := a.seal(frameProbe, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.HandleRelayed(probe); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case packet := <-b.Packets():
+		t.Errorf("relayed probe delivered as %q", packet)
+	default:
+	}
+
+	key, err := protocol.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPeerLink(nil, key, []byte("short"), relayA.relay); err == nil {
+		t.Error("link created with an invalid peer key")
+	}
+}
+
+func TestPeerLinkConnectStops(t *testing.T) {
+	a, _, _, _ := linkPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Connect(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Connect() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	// Closing the link ends a Connect that is still probing
+	result := make(chan error)
+	go func() { result <- a.Connect(context.Background(), nil) }()
+	time.Sleep(20 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Connect() ended by Close = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connect() still probing after Close")
+	}
+}
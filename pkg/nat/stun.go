@@ -0,0 +1,194 @@
+// Package nat discovers how a NAT maps the client's UDP sockets to public
+// addresses, using STUN (RFC 8489), for clients tunneling to each other
+// directly and for clients telling the server their public address.
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// DefaultSTUNPort is the port of a STUN server named without one
+	DefaultSTUNPort = "3478"
+	// initialRTO is the wait before the first retransmission of a request,
+	// doubled after each one as RFC 8489 recommends
+	initialRTO = 500 * time.Millisecond
+	// maxRequests is how many times a request is sent before giving up
+	maxRequests = 7
+	// maxResponseSize bounds the datagrams read while waiting for a response
+	maxResponseSize = 1500
+)
+
+// errNotSTUN marks a datagram that is not the response being waited for
+var errNotSTUN = errors.New("not a STUN response")
+
+// newBindingRequest builds a Binding request with a fresh transaction ID
+func newBindingRequest() (*stun.Message, error) {
+	return stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+}
+
+// ParseBindingResponse returns the public address and port the server saw
+// in a Binding response to the request with transaction ID id. The
+// XOR-MAPPED-ADDRESS attribute is preferred, falling back to the
+// MAPPED-ADDRESS of servers following the older RFC 3489.
+func ParseBindingResponse(raw []byte, id [stun.TransactionIDSize]byte) (*net.UDPAddr, error) {
+	if !stun.IsMessage(raw) {
+		return nil, errNotSTUN
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return nil, fmt.Errorf("invalid STUN message: %v", err)
+	}
+	if msg.TransactionID != id {
+		return nil, errNotSTUN
+	}
+
+	switch msg.Type {
+	case stun.BindingSuccess:
+	case stun.BindingError:
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(msg); err != nil {
+			return nil, errors.New("STUN server rejected the request")
+		}
+		return nil, fmt.Errorf("STUN server rejected the request: %v", code)
+	default:
+		return nil, fmt.Errorf("unexpected STUN message %v", msg.Type)
+	}
+
+	var xorAddr stun.XORMappedAddress
+	if wholeAddress(msg, stun.AttrXORMappedAddress) && xorAddr.GetFrom(msg) == nil {
+		return &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}, nil
+	}
+	var addr stun.MappedAddress
+	if wholeAddress(msg, stun.AttrMappedAddress) && addr.GetFrom(msg) == nil {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+	return nil, errors.New("STUN response has no mapped address")
+}
+
+// wholeAddress reports whether the address attribute t of msg is as long
+// as its family needs. pion pads a truncated address with zeros instead of
+// rejecting it.
+func wholeAddress(msg *stun.Message, t stun.AttrType) bool {
+	value, err := msg.Get(t)
+	if err != nil || len(value) < 4 {
+		return false
+	}
+	switch value[1] {
+	case 0x01:
+		return len(value) == 4+net.IPv4len
+	case 0x02:
+		return len(value) == 4+net.IPv6len
+	}
+	return false
+}
+
+// Discover asks the STUN server, host or host:port, which public address
+// and port conn is mapped to. The request is retransmitted until a
+// response arrives or ctx is done. Datagrams other than the response are
+// discarded, so conn should not be in use for anything else meanwhile.
+func Discover(ctx context.Context, conn net.PacketConn, server string) (*net.UDPAddr, error) {
+	serverAddr, err := resolveServer(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := newBindingRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, maxResponseSize)
+	rto := initialRTO
+	for i := 0; i < maxRequests; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.WriteTo(request.Raw, serverAddr); err != nil {
+			return nil, fmt.Errorf("failed to send STUN request: %v", err)
+		}
+
+		deadline := time.Now().Add(rto)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !sameAddr(from, serverAddr) {
+				continue
+			}
+			mapped, err := ParseBindingResponse(buffer[:n], request.TransactionID)
+			if errors.Is(err, errNotSTUN) {
+				continue
+			}
+			return mapped, err
+		}
+		rto *= 2
+	}
+	return nil, fmt.Errorf("no response from STUN server %s", server)
+}
+
+// DiscoverPublicIP asks the STUN server, host or host:port, which public
+// address this host's traffic leaves from, on a UDP socket of its own
+func DiscoverPublicIP(ctx context.Context, stunServer string) (net.IP, error) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	mapped, err := Discover(ctx, conn, stunServer)
+	if err != nil {
+		return nil, err
+	}
+	return mapped.IP, nil
+}
+
+// resolveServer looks up a STUN server, preferring an IPv4 address as
+// most NATs that need traversing are IPv4 ones
+func resolveServer(ctx context.Context, server string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, DefaultSTUNPort
+	}
+	portNumber, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN server %s: %v", server, err)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %v", server, err)
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: portNumber}, nil
+}
+
+// sameAddr reports whether a datagram came from the STUN server
+func sameAddr(from net.Addr, server *net.UDPAddr) bool {
+	udp, ok := from.(*net.UDPAddr)
+	return ok && udp.Port == server.Port && udp.IP.Equal(server.IP)
+}
@@ -0,0 +1,233 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTransactionID is the transaction ID of the RFC 5769 sample responses
+var testTransactionID = [12]byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+
+const magicCookie = 0x2112a442
+
+// stunPacket builds a STUN message of msgType from already encoded
+// attributes
+func stunPacket(msgType uint16, id [12]byte, attrs ...[]byte) []byte {
+	var body []byte
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	packet := make([]byte, 20, 20+len(body))
+	binary.BigEndian.PutUint16(packet[0:], msgType)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(body)))
+	binary.BigEndian.PutUint32(packet[4:], magicCookie)
+	copy(packet[8:], id[:])
+	return append(packet, body...)
+}
+
+// stunAttr encodes an attribute, padded to four bytes
+func stunAttr(attrType uint16, value []byte) []byte {
+	attr := make([]byte, 4, 4+len(value)+3)
+	binary.BigEndian.PutUint16(attr[0:], attrType)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	attr = append(attr, value...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// addressValue encodes the value of a (XOR-)MAPPED-ADDRESS attribute,
+// XORing it with the cookie and transaction ID if xor is set
+func addressValue(ip net.IP, port int, id [12]byte, xor bool) []byte {
+	family, raw := byte(0x01), []byte(ip.To4())
+	if raw == nil {
+		family, raw = 0x02, []byte(ip.To16())
+	}
+	value := []byte{0, family, byte(port >> 8), byte(port)}
+	address := append([]byte(nil), raw...)
+	if xor {
+		pad := binary.BigEndian.AppendUint32(nil, magicCookie)
+		pad = append(pad, id[:]...)
+		value[2] ^= pad[0]
+		value[3] ^= pad[1]
+		for i := range address {
+			address[i] ^= pad[i]
+		}
+	}
+	return append(value, address...)
+}
+
+const (
+	bindingSuccess = 0x0101
+	bindingError   = 0x0111
+
+	attrMappedAddress    = 0x0001
+	attrErrorCode        = 0x0009
+	attrXORMappedAddress = 0x0020
+	attrSoftware         = 0x8022
+)
+
+func TestParseBindingResponse(t *testing.T) {
+	// The XOR-MAPPED-ADDRESS of RFC 5769's IPv4 sample response
+	rfc5769IPv4 := []byte{0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43}
+	ipv6 := net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")
+	otherID := testTransactionID
+	otherID[11] ^= 1
+
+	for _, test := range []struct {
+		name    string
+		packet  []byte
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "XOR-MAPPED-ADDRESS IPv4",
+			packet: stunPacket(bindingSuccess, testTransactionID, stunAttr(attrSoftware, []byte("test vector")), rfc5769IPv4),
+			want:   "192.0.2.1:32853",
+		},
+		{
+			name:   "XOR-MAPPED-ADDRESS IPv6",
+			packet: stunPacket(bindingSuccess, testTransactionID, stunAttr(attrXORMappedAddress, addressValue(ipv6, 32853, testTransactionID, true))),
+			want:   "[2001:db8:1234:5678:11:2233:4455:6677]:32853",
+		},
+		{
+			name:   "RFC 3489 MAPPED-ADDRESS",
+			packet: stunPacket(bindingSuccess, testTransactionID, stunAttr(attrMappedAddress, addressValue(net.IPv4(203, 0, 113, 7), 4500, testTransactionID, false))),
+			want:   "203.0.113.7:4500",
+		},
+		{
+			name: "XOR-MAPPED-ADDRESS preferred",
+			packet: stunPacket(bindingSuccess, testTransactionID,
+				stunAttr(attrMappedAddress, addressValue(net.IPv4(10, 0, 0, 1), 1000, testTransactionID, false)),
+				rfc5769IPv4),
+			want: "192.0.2.1:32853",
+		},
+		{
+			name: "malformed XOR-MAPPED-ADDRESS falls back",
+			packet: stunPacket(bindingSuccess, testTransactionID,
+				stunAttr(attrXORMappedAddress, []byte{0, 0x07, 0, 0}),
+				stunAttr(attrMappedAddress, addressValue(net.IPv4(203, 0, 113, 7), 4500, testTransactionID, false))),
+			want: "203.0.113.7:4500",
+		},
+		{
+			name:    "no mapped address",
+			packet:  stunPacket(bindingSuccess, testTransactionID, stunAttr(attrSoftware, []byte("test"))),
+			wantErr: "no mapped address",
+		},
+		{
+			name:    "truncated IPv6 address",
+			packet:  stunPacket(bindingSuccess, testTransactionID, stunAttr(attrXORMappedAddress, addressValue(ipv6, 1, testTransactionID, true)[:12])),
+			wantErr: "no mapped address",
+		},
+		{
+			name:    "attribute longer than the message",
+			packet:  stunPacket(bindingSuccess, testTransactionID, []byte{0x00, 0x20, 0x00, 0x40, 0x00, 0x01, 0xa1, 0x47}),
+			wantErr: "invalid STUN message",
+		},
+		{
+			name:    "error response",
+			packet:  stunPacket(bindingError, testTransactionID, stunAttr(attrErrorCode, append([]byte{0, 0, 4, 20}, "Unknown Attribute"...))),
+			wantErr: "rejected",
+		},
+		{
+			name:    "other transaction",
+			packet:  stunPacket(bindingSuccess, otherID, rfc5769IPv4),
+			wantErr: errNotSTUN.Error(),
+		},
+		{
+			name:    "not STUN",
+			packet:  []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			wantErr: errNotSTUN.Error(),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := ParseBindingResponse(test.packet, testTransactionID)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseBindingResponse() = %v, %v; want an error containing %q", addr, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != test.want {
+				t.Errorf("ParseBindingResponse() = %v, want %s", addr, test.want)
+			}
+		})
+	}
+}
+
+// fakeSTUNServer answers Binding requests on loopback with the address
+// they came from, after ignoring the first drop of them
+func fakeSTUNServer(t *testing.T, drop int) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxResponseSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 || drop > 0 {
+				drop--
+				continue
+			}
+			var id [12]byte
+			copy(id[:], buf[8:20])
+			udp := from.(*net.UDPAddr)
+
+			// Stray datagrams first, which the client must skip
+			conn.WriteTo([]byte("noise"), from)
+			conn.WriteTo(stunPacket(bindingSuccess, [12]byte{1}, stunAttr(attrXORMappedAddress, addressValue(net.IPv4(10, 0, 0, 1), 1, [12]byte{1}, true))), from)
+			conn.WriteTo(stunPacket(bindingSuccess, id, stunAttr(attrXORMappedAddress, addressValue(udp.IP, udp.Port, id, true))), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDiscover(t *testing.T) {
+	server := fakeSTUNServer(t, 1)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mapped, err := Discover(ctx, conn, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped.String() != conn.LocalAddr().String() {
+		t.Errorf("Discover() = %v, want %v", mapped, conn.LocalAddr())
+	}
+}
+
+func TestDiscoverGivesUpWithContext(t *testing.T) {
+	server := fakeSTUNServer(t, 1000)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Discover(ctx, conn, server); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Discover() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,80 @@
+// Package profiling serves pprof and expvar for operators debugging
+// performance. It only listens on loopback addresses, never on the ports
+// clients and probes reach.
+package profiling
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+)
+
+var publishOnce sync.Once
+
+// Serve listens on addr, which must be a loopback address, and serves
+// /debug/pprof/ and /debug/vars there until the process exits
+func Serve(addr string) error {
+	_, err := serve(addr)
+	return err
+}
+
+// serve starts serving on addr, returning the listener
+func serve(addr string) (net.Listener, error) {
+	if err := checkLoopback(addr); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	publishOnce.Do(func() {
+		Publish("goroutines", func() interface{} {
+			return runtime.NumGoroutine()
+		})
+	})
+
+	// pprof and expvar also register on http.DefaultServeMux, which must
+	// therefore never be served on a public port
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	slog.Info("Profiling listening", "addr", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Profiling server stopped", "error", err)
+		}
+	}()
+	return listener, nil
+}
+
+// Publish reports fn's result under name in /debug/vars. Each name may only
+// be published once.
+func Publish(name string, fn func() interface{}) {
+	expvar.Publish(name, expvar.Func(fn))
+}
+
+// checkLoopback rejects addresses reachable from other hosts
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid pprof address %q: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("pprof address %q is not a loopback address", addr)
+	}
+	return nil
+}
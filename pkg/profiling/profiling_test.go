@@ -0,0 +1,81 @@
+package profiling
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:6060", true},
+		{"127.0.0.2:6060", true},
+		{"[::1]:6060", true},
+		{"localhost:6060", true},
+		{":6060", false},
+		{"0.0.0.0:6060", false},
+		{"[::]:6060", false},
+		{"192.0.2.1:6060", false},
+		{"example.com:6060", false},
+		{"127.0.0.1", false},
+	} {
+		if err := checkLoopback(test.addr); (err == nil) != test.ok {
+			t.Errorf("checkLoopback(%q) = %v, want ok %v", test.addr, err, test.ok)
+		}
+	}
+}
+
+func TestServeRefusesPublicAddress(t *testing.T) {
+	if err := Serve("0.0.0.0:0"); err == nil {
+		t.Fatal("profiling served on every interface")
+	}
+}
+
+func TestServe(t *testing.T) {
+	listener, err := serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	base := "http://" + listener.Addr().String()
+
+	resp, err := http.Get(base + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/debug/pprof/ answered %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(base + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(body, &vars); err != nil {
+		t.Fatalf("/debug/vars is not JSON: %v", err)
+	}
+	if _, ok := vars["goroutines"]; !ok {
+		t.Error("/debug/vars lacks the goroutine count")
+	}
+
+	// Only the profiling endpoints are served
+	resp, err = http.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/ answered %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchPackets is how many frames fill a batch when none is configured
+	DefaultBatchPackets = 32
+	// maxBatchBytes keeps a batch within a single reasonably sized message
+	maxBatchBytes = 64 * 1024
+	// batchLengthSize is the size of the length prefix before each frame
+	batchLengthSize = 4
+)
+
+// ErrMalformedBatch is returned when a batch message cannot be split into frames
+var ErrMalformedBatch = errors.New("malformed batch")
+
+// BatchWriter collects frames written to a transport and sends them as one
+// message of length-prefixed frames, flushing when maxPackets frames are
+// queued or interval has passed since the first, whichever comes first. At
+// high packet rates this replaces a write per packet with one per batch.
+//
+// Writes report the error of an earlier flush, since a frame may still be
+// queued when WriteMessage returns. Reads pass straight through.
+type BatchWriter struct {
+	Transport
+	interval   time.Duration
+	maxPackets int
+
+	mu    sync.Mutex
+	batch []byte
+	count int
+	timer *time.Timer
+	err   error
+}
+
+// NewBatchWriter batches the frames written to t
+func NewBatchWriter(t Transport, interval time.Duration, maxPackets int) *BatchWriter {
+	if maxPackets <= 0 {
+		maxPackets = DefaultBatchPackets
+	}
+	return &BatchWriter{
+		Transport:  t,
+		interval:   interval,
+		maxPackets: maxPackets,
+		batch:      make([]byte, 0, maxBatchBytes),
+	}
+}
+
+// WriteMessage queues data; it is copied before WriteMessage returns
+func (b *BatchWriter) WriteMessage(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	// Send what is queued first if this frame would not fit
+	if b.count > 0 && len(b.batch)+batchLengthSize+len(data) > maxBatchBytes {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	b.batch = binary.BigEndian.AppendUint32(b.batch, uint32(len(data)))
+	b.batch = append(b.batch, data...)
+	b.count++
+
+	if b.count >= b.maxPackets || b.interval <= 0 {
+		return b.flushLocked()
+	}
+	if b.count == 1 {
+		b.timer = time.AfterFunc(b.interval, func() { b.Flush() })
+	}
+	return nil
+}
+
+// Flush sends the queued frames now
+func (b *BatchWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked sends the queued frames; b.mu must be held
+func (b *BatchWriter) flushLocked() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.count == 0 || b.err != nil {
+		return b.err
+	}
+
+	err := b.Transport.WriteMessage(b.batch)
+	b.batch = b.batch[:0]
+	b.count = 0
+	if err != nil {
+		b.err = err
+	}
+	return err
+}
+
+// QueueDepth returns how many frames wait to be sent, here and in the
+// wrapped transport
+func (b *BatchWriter) QueueDepth() int {
+	b.mu.Lock()
+	count := b.count
+	b.mu.Unlock()
+	return count + QueueDepth(b.Transport)
+}
+
+// Close sends the queued frames and closes the transport
+func (b *BatchWriter) Close() error {
+	b.Flush()
+	return b.Transport.Close()
+}
+
+// BatchReader splits the messages written by a BatchWriter back into frames.
+// Writes pass straight through.
+type BatchReader struct {
+	Transport
+	pending []byte // frames of the current batch not yet returned
+}
+
+// QueueDepth returns how many frames of the unwrapped transport wait for
+// the reader
+func (r *BatchReader) QueueDepth() int {
+	return QueueDepth(r.Transport)
+}
+
+// NewBatchReader splits the batches read from t
+func NewBatchReader(t Transport) *BatchReader {
+	return &BatchReader{Transport: t}
+}
+
+// ReadMessage returns the next frame, reading a new batch when needed
+func (r *BatchReader) ReadMessage() ([]byte, error) {
+	for len(r.pending) == 0 {
+		batch, err := r.Transport.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		r.pending = batch
+	}
+
+	if len(r.pending) < batchLengthSize {
+		r.pending = nil
+		return nil, ErrMalformedBatch
+	}
+	length := binary.BigEndian.Uint32(r.pending)
+	if uint64(length) > uint64(len(r.pending)-batchLengthSize) {
+		r.pending = nil
+		return nil, ErrMalformedBatch
+	}
+
+	frame := r.pending[batchLengthSize : batchLengthSize+int(length)]
+	r.pending = r.pending[batchLengthSize+int(length):]
+	return frame, nil
+}
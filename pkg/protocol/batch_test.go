@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	a, b := memPair()
+	defer a.Close()
+	writer := NewBatchWriter(a, time.Hour, 4)
+	reader := NewBatchReader(b)
+
+	frames := [][]byte{[]byte("one"), {}, bytes.Repeat([]byte{2}, 1500), []byte("four"), []byte("five")}
+	for _, frame := range frames {
+		if err := writer.WriteMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Four frames fill a batch; the fifth waits for a flush
+	if len(b.in) != 1 || writer.QueueDepth() != 1 {
+		t.Fatalf("%d messages sent with %d frames queued, want 1 and 1", len(b.in), writer.QueueDepth())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range frames {
+		if frame, err := reader.ReadMessage(); err != nil || !bytes.Equal(frame, want) {
+			t.Fatalf("ReadMessage() = %q, %v; want %q", frame, err, want)
+		}
+	}
+
+	for _, batch := range [][]byte{{0, 0, 1}, {0, 0, 0, 9, 'x'}} {
+		a.WriteMessage(batch)
+		if _, err := reader.ReadMessage(); !errors.Is(err, ErrMalformedBatch) {
+			t.Errorf("ReadMessage() of %x error = %v, want %v", batch, err, ErrMalformedBatch)
+		}
+	}
+}
+
+// webSocketSink returns a WebSocket transport to a loopback server that
+// discards what it reads
+func webSocketSink(b *testing.B) *WebSocketTransport {
+	b.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return NewWebSocketTransport(conn)
+}
+
+// benchmarkWrites measures writing size-byte packets to a WebSocket, each
+// in its own message or in batches of batchPackets
+func benchmarkWrites(b *testing.B, size, batchPackets int) {
+	var transport Transport = webSocketSink(b)
+	if batchPackets > 1 {
+		transport = NewBatchWriter(transport, time.Hour, batchPackets)
+	}
+	packet := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := transport.WriteMessage(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if batch, ok := transport.(*BatchWriter); ok {
+		if err := batch.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteUnbatched and BenchmarkWriteBatched compare small packets
+// sent as a WebSocket message each with the same packets sent in batches
+func BenchmarkWriteUnbatched(b *testing.B) {
+	for _, size := range []int{64, 512} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) { benchmarkWrites(b, size, 1) })
+	}
+}
+
+func BenchmarkWriteBatched(b *testing.B) {
+	for _, size := range []int{64, 512} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) { benchmarkWrites(b, size, DefaultBatchPackets) })
+	}
+}
@@ -0,0 +1,205 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// benchmarkSizes are a small packet, a full-MTU packet and a large batch
+var benchmarkSizes = []int{64, 1500, 64 * 1024}
+
+// newBenchmarkEncryption returns session encryption with a fixed key
+func newBenchmarkEncryption(b *testing.B) *MultiLayerEncryption {
+	encryption, err := NewMultiLayerEncryption(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return encryption
+}
+
+// benchmarkEncrypt measures both encryption layers on size-byte packets
+func benchmarkEncrypt(b *testing.B, size int) {
+	benchmarkEncryptThreshold(b, size, DefaultParallelThreshold)
+}
+
+// benchmarkEncryptThreshold measures encryption with payloads of at least
+// threshold bytes encrypted in parallel chunks
+func benchmarkEncryptThreshold(b *testing.B, size, threshold int) {
+	encryption := newBenchmarkEncryption(b)
+	encryption.SetParallelThreshold(threshold)
+	plaintext := make([]byte, size)
+	dst := make([]byte, 0, size+size/256+128) // room for the overhead of every chunk
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encryption.EncryptTo(dst, plaintext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncrypt1K(b *testing.B)  { benchmarkEncrypt(b, 1024) }
+func BenchmarkEncrypt64K(b *testing.B) { benchmarkEncrypt(b, 64*1024) }
+
+// BenchmarkEncrypt1M and BenchmarkEncrypt1MSerial compare a large batch
+// encrypted in chunks on every core with the same batch encrypted whole;
+// run with -cpu to vary the cores
+func BenchmarkEncrypt1M(b *testing.B)       { benchmarkEncryptThreshold(b, 1<<20, parallelChunkMin) }
+func BenchmarkEncrypt1MSerial(b *testing.B) { benchmarkEncryptThreshold(b, 1<<20, 0) }
+
+// BenchmarkDecrypt1K measures removing both encryption layers in place, as
+// the receive path does
+func BenchmarkDecrypt1K(b *testing.B) {
+	encryption := newBenchmarkEncryption(b)
+	ciphertext, err := encryption.Encrypt(make([]byte, 1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, len(ciphertext))
+
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(buf, ciphertext)
+		if _, err := encryption.DecryptInPlace(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkObfuscate1K measures wrapping a packet in the fake HTTP framing
+// and padding it
+func BenchmarkObfuscate1K(b *testing.B) {
+	sp := NewStealthProtocol()
+	data := make([]byte, 1024)
+	dst := make([]byte, 0, PacketBufferSize)
+
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sp.ObfuscatePacketTo(dst, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFullPipeline measures a packet's whole trip: encrypt and
+// obfuscate on the sending side, deobfuscate and decrypt on the receiving
+// side
+func BenchmarkFullPipeline(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			sp := NewStealthProtocol()
+			encryption := newBenchmarkEncryption(b)
+			packet := make([]byte, size)
+			encryptBuf := make([]byte, 0, size+128)
+			obfuscateBuf := make([]byte, 0, size+PacketBufferSize)
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encrypted, err := encryption.EncryptTo(encryptBuf, packet)
+				if err != nil {
+					b.Fatal(err)
+				}
+				obfuscated, err := sp.ObfuscatePacketTo(obfuscateBuf, encrypted)
+				if err != nil {
+					b.Fatal(err)
+				}
+				deobfuscated, err := sp.DeobfuscatePacket(obfuscated)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := encryption.DecryptInPlace(deobfuscated); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// receivedPackets returns n obfuscated, encrypted full-MTU packets, each
+// numbered in its first bytes
+func receivedPackets(b *testing.B, sp *StealthProtocol, encryption *MultiLayerEncryption, n int) [][]byte {
+	packets := make([][]byte, n)
+	for i := range packets {
+		packet := make([]byte, 1500)
+		binary.BigEndian.PutUint64(packet, uint64(i))
+		encrypted, err := encryption.Encrypt(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if packets[i], err = sp.ObfuscatePacket(encrypted); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return packets
+}
+
+// openReceived undoes the obfuscation and encryption of a received packet
+func openReceived(sp *StealthProtocol, encryption *MultiLayerEncryption, message []byte) ([]byte, error) {
+	deobfuscated, err := sp.DeobfuscatePacket(message)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.DecryptInPlace(deobfuscated)
+}
+
+// BenchmarkReceiveSerial and BenchmarkReceivePipeline compare a session's
+// packets deobfuscated and decrypted one after another with the same
+// packets spread over a worker per core; run with -cpu to vary the cores
+func BenchmarkReceiveSerial(b *testing.B) {
+	sp := NewStealthProtocol()
+	encryption := newBenchmarkEncryption(b)
+	packets := receivedPackets(b, sp, encryption, 1024)
+	message := make([]byte, 0, PacketBufferSize*2)
+
+	b.SetBytes(1500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		message = append(message[:0], packets[i%len(packets)]...)
+		if _, err := openReceived(sp, encryption, message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReceivePipeline also checks that packets are delivered in the
+// order they were received
+func BenchmarkReceivePipeline(b *testing.B) {
+	sp := NewStealthProtocol()
+	encryption := newBenchmarkEncryption(b)
+	packets := receivedPackets(b, sp, encryption, 1024)
+	workers := NewPacketWorkers(runtime.GOMAXPROCS(0))
+
+	b.SetBytes(1500)
+	b.ResetTimer()
+	pipeline := NewOrderedPipeline(workers)
+	next := 0
+	for i := 0; i < b.N; i++ {
+		message := append([]byte(nil), packets[i%len(packets)]...)
+		pipeline.Submit(func() func() {
+			packet, err := openReceived(sp, encryption, message)
+			return func() {
+				if err != nil {
+					b.Error(err)
+				} else if seq := int(binary.BigEndian.Uint64(packet)); seq != next%len(packets) {
+					b.Errorf("packet %d delivered, want %d", seq, next%len(packets))
+				}
+				next++
+			}
+		})
+	}
+	pipeline.Close()
+	if next != b.N {
+		b.Fatalf("%d packets delivered, want %d", next, b.N)
+	}
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import "sync"
+
+// PacketBufferSize fits an MTU-sized packet after both encryption layers and
+// obfuscation (fake headers plus padding up to the largest default bucket)
+const PacketBufferSize = 4096
+
+var packetBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, PacketBufferSize)
+		return &buf
+	},
+}
+
+// GetPacketBuffer takes a buffer from the shared packet pool. The caller owns
+// it until it is handed back with PutPacketBuffer.
+func GetPacketBuffer() *[]byte {
+	return packetBufferPool.Get().(*[]byte)
+}
+
+// PutPacketBuffer returns a buffer to the pool. Nothing may keep a slice of
+// the buffer afterwards; in particular it must only be returned once the
+// WebSocket or TUN write that consumed it has completed.
+func PutPacketBuffer(buf *[]byte) {
+	if cap(*buf) < PacketBufferSize {
+		return
+	}
+	*buf = (*buf)[:PacketBufferSize]
+	packetBufferPool.Put(buf)
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import "testing"
+
+func TestPutPacketBufferRestoresLength(t *testing.T) {
+	buf := GetPacketBuffer()
+	*buf = (*buf)[:10]
+	PutPacketBuffer(buf)
+	if len(*buf) != PacketBufferSize {
+		t.Errorf("returned buffer has length %d, want %d", len(*buf), PacketBufferSize)
+	}
+
+	// Buffers too small for a packet are not pooled
+	small := make([]byte, 10)
+	PutPacketBuffer(&small)
+	if len(small) != 10 {
+		t.Errorf("small buffer resized to %d", len(small))
+	}
+}
+
+// benchmarkSend measures encrypting and obfuscating full-MTU packets, in
+// pooled buffers or in fresh ones for each packet
+func benchmarkSend(b *testing.B, pooled bool) {
+	sp := NewStealthProtocol()
+	encryption := newBenchmarkEncryption(b)
+	packet := make([]byte, 1500)
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !pooled {
+			encrypted, err := encryption.Encrypt(packet)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := sp.ObfuscatePacket(encrypted); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+
+		encryptBuf, frameBuf := GetPacketBuffer(), GetPacketBuffer()
+		encrypted, err := encryption.EncryptTo((*encryptBuf)[:0], packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := sp.ObfuscatePacketTo((*frameBuf)[:0], encrypted); err != nil {
+			b.Fatal(err)
+		}
+		PutPacketBuffer(encryptBuf)
+		PutPacketBuffer(frameBuf)
+	}
+}
+
+// BenchmarkSendPooled and BenchmarkSendAllocating compare the allocations
+// per packet of the send path with and without the packet buffer pool
+func BenchmarkSendPooled(b *testing.B)     { benchmarkSend(b, true) }
+func BenchmarkSendAllocating(b *testing.B) { benchmarkSend(b, false) }
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChaosConfig degrades connections on purpose, so that reconnection, key
+// exchange and error handling can be tested without a bad network
+type ChaosConfig struct {
+	PacketDropRate float64       // fraction of frames silently dropped, 0 to 1
+	MaxDelay       time.Duration // each frame is held for up to this long
+	CorruptRate    float64       // fraction of frames with one bit flipped, 0 to 1
+}
+
+// ParseChaosConfig parses a --chaos flag such as
+// "drop=0.05,delay=200ms,corrupt=0.01". Settings left out are off.
+func ParseChaosConfig(spec string) (*ChaosConfig, error) {
+	config := &ChaosConfig{}
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos setting %q, want key=value", setting)
+		}
+
+		var err error
+		switch key {
+		case "drop":
+			config.PacketDropRate, err = strconv.ParseFloat(value, 64)
+		case "delay":
+			config.MaxDelay, err = time.ParseDuration(value)
+		case "corrupt":
+			config.CorruptRate, err = strconv.ParseFloat(value, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos %s: %v", key, err)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks that the rates are fractions and the delay is not negative
+func (c *ChaosConfig) Validate() error {
+	if c.PacketDropRate < 0 || c.PacketDropRate > 1 {
+		return fmt.Errorf("chaos drop rate %v is not between 0 and 1", c.PacketDropRate)
+	}
+	if c.CorruptRate < 0 || c.CorruptRate > 1 {
+		return fmt.Errorf("chaos corrupt rate %v is not between 0 and 1", c.CorruptRate)
+	}
+	if c.MaxDelay < 0 {
+		return fmt.Errorf("chaos delay %v is negative", c.MaxDelay)
+	}
+	return nil
+}
+
+// Wrap returns t degraded as configured, or t itself if c is nil
+func (c *ChaosConfig) Wrap(t Transport) Transport {
+	if c == nil {
+		return t
+	}
+	return &ChaosTransport{Transport: t, config: *c, random: randomFloat}
+}
+
+// ChaosTransport drops, delays and corrupts the frames written to the
+// transport it wraps. Reads pass straight through, so both ends must run in
+// chaos mode to degrade both directions.
+type ChaosTransport struct {
+	Transport
+	config ChaosConfig
+	random func() float64 // in [0, 1); tests seed their own
+}
+
+// WriteMessage drops data, or sends it after a random delay, possibly with
+// a bit flipped. Only the settings in use draw random numbers.
+func (c *ChaosTransport) WriteMessage(data []byte) error {
+	if c.config.PacketDropRate > 0 && c.random() < c.config.PacketDropRate {
+		return nil
+	}
+	if c.config.MaxDelay > 0 {
+		time.Sleep(time.Duration(c.random() * float64(c.config.MaxDelay)))
+	}
+	if len(data) > 0 && c.config.CorruptRate > 0 && c.random() < c.config.CorruptRate {
+		// The caller may still need its buffer intact
+		corrupted := append([]byte(nil), data...)
+		bit := int(c.random() * float64(len(corrupted)*8))
+		corrupted[bit/8] ^= 1 << (bit % 8)
+		data = corrupted
+	}
+	return c.Transport.WriteMessage(data)
+}
+
+// Unwrap returns the transport being degraded
+func (c *ChaosTransport) Unwrap() Transport {
+	return c.Transport
+}
+
+// UnwrapWebSocket returns the WebSocket transport under any wrappers of t,
+// if there is one
+func UnwrapWebSocket(t Transport) (*WebSocketTransport, bool) {
+	for {
+		switch wrapped := t.(type) {
+		case *WebSocketTransport:
+			return wrapped, true
+		case interface{ Unwrap() Transport }:
+			t = wrapped.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseChaosConfig(t *testing.T) {
+	for _, test := range []struct {
+		spec    string
+		want    ChaosConfig
+		wantErr string
+	}{
+		{spec: "drop=0.05,delay=200ms,corrupt=0.01", want: ChaosConfig{PacketDropRate: 0.05, MaxDelay: 200 * time.Millisecond, CorruptRate: 0.01}},
+		{spec: " drop=1 , delay=0s", want: ChaosConfig{PacketDropRate: 1}},
+		{spec: "corrupt=0", want: ChaosConfig{}},
+		{spec: "delay=1.5s", want: ChaosConfig{MaxDelay: 1500 * time.Millisecond}},
+
+		{spec: "drop", wantErr: `invalid chaos setting "drop", want key=value`},
+		{spec: "", wantErr: `invalid chaos setting ""`},
+		{spec: "jitter=5ms", wantErr: `unknown chaos setting "jitter"`},
+		{spec: "drop=often", wantErr: "invalid chaos drop"},
+		{spec: "delay=200", wantErr: "invalid chaos delay"},
+		{spec: "corrupt=0.1%", wantErr: "invalid chaos corrupt"},
+
+		{spec: "drop=1.5", wantErr: "chaos drop rate 1.5 is not between 0 and 1"},
+		{spec: "drop=-0.1", wantErr: "chaos drop rate -0.1 is not between 0 and 1"},
+		{spec: "corrupt=2", wantErr: "chaos corrupt rate 2 is not between 0 and 1"},
+		{spec: "delay=-1s", wantErr: "chaos delay -1s is negative"},
+	} {
+		config, err := ParseChaosConfig(test.spec)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ParseChaosConfig(%q) error = %v, want one containing %q", test.spec, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseChaosConfig(%q): %v", test.spec, err)
+		} else if *config != test.want {
+			t.Errorf("ParseChaosConfig(%q) = %+v, want %+v", test.spec, *config, test.want)
+		}
+	}
+}
+
+// frameRecorder is a transport that keeps the frames written to it, in the
+// order they arrive
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (f *frameRecorder) ReadMessage() ([]byte, error) { return nil, net.ErrClosed }
+
+func (f *frameRecorder) WriteMessage(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frames = append(f.frames, append([]byte(nil), data...))
+	return nil
+}
+
+func (f *frameRecorder) SetReadDeadline(time.Time) error  { return nil }
+func (f *frameRecorder) SetWriteDeadline(time.Time) error { return nil }
+func (f *frameRecorder) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (f *frameRecorder) Close() error                     { return nil }
+
+// newSeededChaos wraps a frame recorder in chaos with a seeded source
+func newSeededChaos(config ChaosConfig) (*ChaosTransport, *frameRecorder) {
+	recorder := &frameRecorder{}
+	chaos := config.Wrap(recorder).(*ChaosTransport)
+	chaos.random = seededUniform()
+	return chaos, recorder
+}
+
+func TestChaosWrapNil(t *testing.T) {
+	recorder := &frameRecorder{}
+	var config *ChaosConfig
+	if got := config.Wrap(recorder); got != recorder {
+		t.Errorf("nil chaos config wrapped the transport in %T", got)
+	}
+}
+
+func TestChaosTransportDrops(t *testing.T) {
+	for _, rate := range []float64{0, 0.25, 1} {
+		chaos, recorder := newSeededChaos(ChaosConfig{PacketDropRate: rate})
+		const frames = 10000
+		for i := 0; i < frames; i++ {
+			if err := chaos.WriteMessage([]byte{byte(i)}); err != nil {
+				t.Fatalf("drop rate %v: dropping a frame failed the write: %v", rate, err)
+			}
+		}
+
+		dropped := float64(frames-len(recorder.frames)) / frames
+		if dropped < rate-0.02 || dropped > rate+0.02 {
+			t.Errorf("drop rate %v: dropped %.3f of the frames", rate, dropped)
+		}
+	}
+}
+
+func TestChaosTransportDelays(t *testing.T) {
+	const maxDelay = 20 * time.Millisecond
+	chaos, recorder := newSeededChaos(ChaosConfig{MaxDelay: maxDelay})
+
+	// Drawing from the same seed gives the delays the transport will use
+	uniform := seededUniform()
+	for i := 0; i < 5; i++ {
+		want := time.Duration(uniform() * float64(maxDelay))
+		start := time.Now()
+		if err := chaos.WriteMessage([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < want {
+			t.Errorf("frame %d sent after %v, want a delay of %v", i, elapsed, want)
+		}
+	}
+	if len(recorder.frames) != 5 {
+		t.Errorf("%d of 5 delayed frames sent", len(recorder.frames))
+	}
+}
+
+func TestChaosTransportReorders(t *testing.T) {
+	const maxDelay = 200 * time.Millisecond
+	const frames = 6
+	chaos, recorder := newSeededChaos(ChaosConfig{MaxDelay: maxDelay})
+
+	// Each writer draws its delay before the next starts, so frame i gets
+	// the i-th number from the seed whatever the scheduling
+	drawn := make(chan struct{})
+	random := chaos.random
+	chaos.random = func() float64 {
+		defer func() { drawn <- struct{}{} }()
+		return random()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < frames; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chaos.WriteMessage([]byte{byte(i)})
+		}()
+		<-drawn
+	}
+	wg.Wait()
+
+	// Frames held for less overtake those written before them
+	uniform := seededUniform()
+	delays := make([]float64, frames)
+	want := make([]byte, frames)
+	for i := range delays {
+		delays[i], want[i] = uniform(), byte(i)
+	}
+	slices.SortFunc(want, func(a, b byte) int {
+		if delays[a] < delays[b] {
+			return -1
+		}
+		return 1
+	})
+	got := bytes.Join(recorder.frames, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("frames arrived in order %v, want %v by their delays", got, want)
+	}
+	if slices.IsSorted(got) {
+		t.Error("delays did not reorder the frames")
+	}
+}
+
+func TestChaosTransportCorrupts(t *testing.T) {
+	chaos, recorder := newSeededChaos(ChaosConfig{CorruptRate: 1})
+	data := []byte("a frame worth corrupting")
+	original := append([]byte(nil), data...)
+	for i := 0; i < 100; i++ {
+		if err := chaos.WriteMessage(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(data, original) {
+		t.Error("corruption changed the caller's buffer")
+	}
+	for i, frame := range recorder.frames {
+		flipped := 0
+		for j := range frame {
+			flipped += bits.OnesCount8(frame[j] ^ original[j])
+		}
+		if flipped != 1 {
+			t.Fatalf("frame %d has %d bits flipped, want 1", i, flipped)
+		}
+	}
+
+	// Empty frames have no bit to flip
+	if err := chaos.WriteMessage(nil); err != nil {
+		t.Errorf("empty frame: %v", err)
+	}
+}
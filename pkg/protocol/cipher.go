@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Ciphers a session's packets can be encrypted with
+const (
+	// CipherLayered is ChaCha20-Poly1305 inside AES-256-GCM, the default
+	CipherLayered = "layered"
+	// CipherAESGCM and CipherChaCha20 use one layer only, for CPUs where
+	// the second costs too much
+	CipherAESGCM   = "aes-256-gcm"
+	CipherChaCha20 = "chacha20-poly1305"
+)
+
+// encryptionFormatSingleLayer leads ciphertexts encrypted with a single
+// negotiated cipher
+const encryptionFormatSingleLayer byte = 2
+
+// SingleCiphers are the ciphers a server allowing single_cipher offers
+var SingleCiphers = []string{CipherAESGCM, CipherChaCha20}
+
+// hasAESHardware reports whether the CPU has instructions for AES and for
+// GCM's carry-less multiplication. With them AES-GCM outruns
+// ChaCha20-Poly1305; without them, as on many phones, it is several times
+// slower. A variable so tests can pretend either way.
+var hasAESHardware = func() bool {
+	return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+		cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+		cpu.S390X.HasAES && cpu.S390X.HasGHASH
+}
+
+// HasAESHardware reports whether this CPU accelerates AES-GCM
+func HasAESHardware() bool {
+	return hasAESHardware()
+}
+
+// PreferredCipher returns the single cipher fastest on this CPU
+func PreferredCipher() string {
+	if hasAESHardware() {
+		return CipherAESGCM
+	}
+	return CipherChaCha20
+}
+
+// NegotiateCipher returns requested if the server offered it, and both
+// layers otherwise
+func NegotiateCipher(offered []string, requested string) string {
+	for _, cipher := range offered {
+		if cipher == requested {
+			return cipher
+		}
+	}
+	return CipherLayered
+}
+
+// SetCipher chooses the ciphers new packets are encrypted with and
+// received ones must use. It is set once, right after the key exchange.
+func (m *MultiLayerEncryption) SetCipher(cipher string) error {
+	switch cipher {
+	case "", CipherLayered:
+		cipher = CipherLayered
+	case CipherAESGCM, CipherChaCha20:
+	default:
+		return fmt.Errorf("unknown cipher %q", cipher)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cipher = cipher
+	return nil
+}
+
+// Cipher returns the ciphers in use, CipherLayered unless SetCipher chose one
+func (m *MultiLayerEncryption) Cipher() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cipher == "" {
+		return CipherLayered
+	}
+	return m.cipher
+}
+
+// singleLayer reports whether a single cipher was negotiated. m.mu must be
+// held.
+func (m *MultiLayerEncryption) singleLayer() bool {
+	return m.cipher == CipherAESGCM || m.cipher == CipherChaCha20
+}
+
+// sealSingle appends plaintext encrypted with just cipher to dst
+func (k *layerKeys) sealSingle(cipher string, dst, plaintext []byte) ([]byte, error) {
+	if cipher == CipherAESGCM {
+		return k.aes.seal(dst, plaintext, nil)
+	}
+	return k.chacha.seal(dst, plaintext, nil)
+}
+
+// openSingle decrypts a ciphertext of sealSingle in place
+func (k *layerKeys) openSingle(cipher string, ciphertext []byte) ([]byte, error) {
+	if cipher == CipherAESGCM {
+		return k.aes.openInPlace(ciphertext, nil)
+	}
+	return k.chacha.openInPlace(ciphertext, nil)
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPreferredCipher(t *testing.T) {
+	saved := hasAESHardware
+	t.Cleanup(func() { hasAESHardware = saved })
+
+	hasAESHardware = func() bool { return true }
+	if got := PreferredCipher(); got != CipherAESGCM {
+		t.Errorf("with AES hardware preferred %s", got)
+	}
+	hasAESHardware = func() bool { return false }
+	if got := PreferredCipher(); got != CipherChaCha20 {
+		t.Errorf("without AES hardware preferred %s", got)
+	}
+}
+
+func TestNegotiateCipher(t *testing.T) {
+	if got := NegotiateCipher(SingleCiphers, CipherChaCha20); got != CipherChaCha20 {
+		t.Errorf("offered cipher negotiated as %s", got)
+	}
+	if got := NegotiateCipher(nil, CipherAESGCM); got != CipherLayered {
+		t.Errorf("cipher the server did not offer negotiated as %s", got)
+	}
+	if got := NegotiateCipher(SingleCiphers, "rot13"); got != CipherLayered {
+		t.Errorf("unknown cipher negotiated as %s", got)
+	}
+}
+
+func TestSingleCipherRoundTrip(t *testing.T) {
+	for _, cipher := range SingleCiphers {
+		sender, receiver := newTestEncryption(t), newTestEncryption(t)
+		if err := sender.SetCipher(cipher); err != nil {
+			t.Fatal(err)
+		}
+		if err := receiver.SetCipher(cipher); err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := sender.Encrypt([]byte("packet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ciphertext[0]&0x7f != encryptionFormatSingleLayer {
+			t.Errorf("%s: format %d, want a single layer", cipher, ciphertext[0])
+		}
+		if plaintext, err := receiver.Decrypt(ciphertext); err != nil || !bytes.Equal(plaintext, []byte("packet")) {
+			t.Errorf("%s: decrypted %q, %v", cipher, plaintext, err)
+		}
+
+		// A side that did not negotiate a single cipher refuses one
+		if _, err := newTestEncryption(t).Decrypt(ciphertext); err == nil {
+			t.Errorf("%s: accepted without negotiating it", cipher)
+		}
+	}
+
+	if err := newTestEncryption(t).SetCipher("rot13"); err == nil {
+		t.Error("unknown cipher set")
+	}
+	if got := newTestEncryption(t).Cipher(); got != CipherLayered {
+		t.Errorf("default cipher %s, want %s", got, CipherLayered)
+	}
+}
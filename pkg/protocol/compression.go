@@ -0,0 +1,209 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// CompressionAlgorithm names a packet compression algorithm
+type CompressionAlgorithm string
+
+const (
+	// CompressionNone sends packets as they are
+	CompressionNone CompressionAlgorithm = "none"
+	// CompressionZstd compresses packets with Zstandard
+	CompressionZstd CompressionAlgorithm = "zstd"
+	// CompressionS2 compresses packets with S2, a faster Snappy extension
+	CompressionS2 CompressionAlgorithm = "s2"
+	// CompressionLZ4 compresses packets with LZ4, trading ratio for speed
+	CompressionLZ4 CompressionAlgorithm = "lz4"
+)
+
+// Per-packet flag prepended to every frame when compression is negotiated
+const (
+	packetUncompressed byte = 0
+	packetCompressed   byte = 1
+)
+
+// maxDecompressedSize bounds decompression so a malicious peer cannot send
+// a decompression bomb
+const maxDecompressedSize = 65535
+
+// lz4LengthSize is the original packet length stored before an LZ4 block,
+// which unlike zstd and S2 does not record it
+const lz4LengthSize = 2
+
+// lz4Compressors reuses LZ4 hash tables; an lz4.Compressor is not safe for
+// concurrent use
+var lz4Compressors = sync.Pool{
+	New: func() interface{} { return new(lz4.Compressor) },
+}
+
+// Compressor compresses packets before they reach the encryption layers.
+//
+// Security caveat: compressing data that mixes secrets with attacker-chosen
+// content leaks information through the ciphertext length (CRIME/BREACH).
+// Tunneled plaintext protocols are exposed to this when an attacker can
+// inject traffic into the same flow, so compression is off by default and
+// should only be enabled for links that carry mostly trusted bulk data.
+type Compressor struct {
+	algorithm CompressionAlgorithm
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// NewCompressor creates a compressor for the given algorithm. An empty
+// algorithm means CompressionNone.
+func NewCompressor(algorithm CompressionAlgorithm) (*Compressor, error) {
+	c := &Compressor{algorithm: algorithm}
+
+	switch algorithm {
+	case "", CompressionNone:
+		c.algorithm = CompressionNone
+	case CompressionS2, CompressionLZ4:
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+		if err != nil {
+			return nil, err
+		}
+		c.encoder = encoder
+		c.decoder = decoder
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+
+	return c, nil
+}
+
+// Algorithm returns the algorithm in use
+func (c *Compressor) Algorithm() CompressionAlgorithm {
+	return c.algorithm
+}
+
+// Compress writes the flagged frame for packet into dst's storage. Packets
+// that do not shrink are sent uncompressed so incompressible data is never
+// expanded beyond the one flag byte. With CompressionNone the packet is
+// returned unchanged and no flag is added.
+func (c *Compressor) Compress(dst, packet []byte) []byte {
+	if c.algorithm == CompressionNone {
+		return packet
+	}
+
+	dst = append(dst[:0], packetCompressed)
+	compressed := true
+	switch c.algorithm {
+	case CompressionZstd:
+		dst = c.encoder.EncodeAll(packet, dst)
+	case CompressionS2:
+		dst = append(dst, s2.Encode(nil, packet)...)
+	case CompressionLZ4:
+		dst, compressed = compressLZ4(dst, packet)
+	}
+
+	if !compressed || len(dst)-1 >= len(packet) {
+		dst = append(dst[:0], packetUncompressed)
+		dst = append(dst, packet...)
+	}
+	return dst
+}
+
+// Decompress reverses Compress
+func (c *Compressor) Decompress(frame []byte) ([]byte, error) {
+	if c.algorithm == CompressionNone {
+		return frame, nil
+	}
+
+	if len(frame) < 1 {
+		return nil, errors.New("compressed frame too short")
+	}
+
+	flag, payload := frame[0], frame[1:]
+	if flag == packetUncompressed {
+		return payload, nil
+	}
+	if flag != packetCompressed {
+		return nil, errors.New("invalid compression flag")
+	}
+
+	switch c.algorithm {
+	case CompressionZstd:
+		return c.decoder.DecodeAll(payload, nil)
+	case CompressionS2:
+		size, err := s2.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxDecompressedSize {
+			return nil, errors.New("decompressed packet too large")
+		}
+		return s2.Decode(nil, payload)
+	case CompressionLZ4:
+		return decompressLZ4(payload)
+	}
+
+	return nil, fmt.Errorf("unsupported compression algorithm: %s", c.algorithm)
+}
+
+// compressLZ4 appends the original length and the LZ4 block of packet to
+// dst, reporting false if the block would not be smaller than packet
+func compressLZ4(dst, packet []byte) ([]byte, bool) {
+	if len(packet) > maxDecompressedSize {
+		return dst, false
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(packet)))
+
+	// Give LZ4 no more room than the packet itself; it reports 0 when the
+	// block does not fit
+	start := len(dst)
+	if cap(dst)-start < len(packet) {
+		grown := make([]byte, start, start+len(packet))
+		copy(grown, dst)
+		dst = grown
+	}
+
+	compressor := lz4Compressors.Get().(*lz4.Compressor)
+	n, err := compressor.CompressBlock(packet, dst[start:start+len(packet)])
+	lz4Compressors.Put(compressor)
+	if err != nil || n == 0 {
+		return dst, false
+	}
+	return dst[:start+n], true
+}
+
+// decompressLZ4 reverses compressLZ4
+func decompressLZ4(payload []byte) ([]byte, error) {
+	if len(payload) < lz4LengthSize {
+		return nil, errors.New("compressed frame too short")
+	}
+
+	packet := make([]byte, binary.BigEndian.Uint16(payload))
+	n, err := lz4.UncompressBlock(payload[lz4LengthSize:], packet)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(packet) {
+		return nil, errors.New("decompressed packet length mismatch")
+	}
+	return packet, nil
+}
+
+// NegotiateCompression picks the algorithm the client asked for if the
+// server offered it, and CompressionNone otherwise
+func NegotiateCompression(offered []CompressionAlgorithm, requested CompressionAlgorithm) CompressionAlgorithm {
+	for _, algorithm := range offered {
+		if algorithm == requested {
+			return algorithm
+		}
+	}
+	return CompressionNone
+}
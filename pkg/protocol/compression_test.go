@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+)
+
+var compressionAlgorithms = []CompressionAlgorithm{CompressionNone, CompressionZstd, CompressionS2, CompressionLZ4}
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := make([]byte, 1400)
+	rand.Read(random)
+	packets := map[string][]byte{
+		"compressible":   bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\n"), 50),
+		"incompressible": random,
+		"empty":          {},
+	}
+
+	for _, algorithm := range compressionAlgorithms {
+		c, err := NewCompressor(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, packet := range packets {
+			frame := c.Compress(nil, packet)
+			if algorithm != CompressionNone && len(frame) > len(packet)+1 {
+				t.Errorf("%s: %s packet grew from %d to %d bytes", algorithm, name, len(packet), len(frame))
+			}
+			got, err := c.Decompress(frame)
+			if err != nil {
+				t.Fatalf("%s: %s packet: %v", algorithm, name, err)
+			}
+			if !bytes.Equal(got, packet) {
+				t.Errorf("%s: %s packet changed in the round trip", algorithm, name)
+			}
+		}
+		if algorithm != CompressionNone {
+			if frame := c.Compress(nil, packets["compressible"]); frame[0] != packetCompressed {
+				t.Errorf("%s: compressible packet sent uncompressed", algorithm)
+			}
+		}
+	}
+}
+
+func TestNewCompressorRejectsUnknown(t *testing.T) {
+	if _, err := NewCompressor("brotli"); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+	c, err := NewCompressor("")
+	if err != nil || c.Algorithm() != CompressionNone {
+		t.Errorf("empty algorithm = %v, %v, want %s", c, err, CompressionNone)
+	}
+}
+
+func TestDecompressRejectsInvalidFrames(t *testing.T) {
+	for _, algorithm := range compressionAlgorithms[1:] {
+		c, err := NewCompressor(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, frame := range map[string][]byte{
+			"empty":        {},
+			"unknown flag": {7, 1, 2, 3},
+			"corrupt":      {packetCompressed, 0xff, 0xff, 0xff, 0xff},
+		} {
+			if _, err := c.Decompress(frame); err == nil {
+				t.Errorf("%s: %s frame accepted", algorithm, name)
+			}
+		}
+	}
+}
+
+func TestDecompressRejectsBombs(t *testing.T) {
+	huge := make([]byte, maxDecompressedSize+1)
+	c, err := NewCompressor(CompressionS2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte{packetCompressed}, s2.Encode(nil, huge)...)
+	if _, err := c.Decompress(frame); err == nil {
+		t.Error("S2 packet larger than the limit accepted")
+	}
+
+	c, err = NewCompressor(CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame = append([]byte{packetCompressed}, c.encoder.EncodeAll(huge, nil)...)
+	if _, err := c.Decompress(frame); err == nil {
+		t.Error("zstd packet larger than the limit accepted")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	offered := []CompressionAlgorithm{CompressionZstd, CompressionLZ4}
+	if got := NegotiateCompression(offered, CompressionLZ4); got != CompressionLZ4 {
+		t.Errorf("offered algorithm negotiated to %s", got)
+	}
+	if got := NegotiateCompression(offered, CompressionS2); got != CompressionNone {
+		t.Errorf("algorithm the server did not offer negotiated to %s", got)
+	}
+	if got := NegotiateCompression(nil, CompressionZstd); got != CompressionNone {
+		t.Errorf("server offering nothing negotiated to %s", got)
+	}
+}
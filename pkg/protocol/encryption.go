@@ -5,14 +5,33 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
 
+// Labels of the keys derived with HKDF, in the style of RFC 8446's: each
+// names the protocol, its version and the key's purpose, so that a key
+// derived for one purpose can never be mistaken for another
+const (
+	labelSessionKey = "stealthvpn v1 session-key"
+	labelChaChaKey  = "stealthvpn v1 chacha20-key"
+	labelAESKey     = "stealthvpn v1 aes-key"
+	labelResumeKey  = "stealthvpn v1 resume-key"
+	labelRekey      = "stealthvpn v1 rekey"
+	labelChainKey   = "stealthvpn v1 chain-key"
+)
+
 // EncryptionEngine provides custom encryption on top of TLS
 type EncryptionEngine struct {
 	aead cipher.AEAD
@@ -38,13 +57,26 @@ func NewEncryptionEngine(key []byte) (*EncryptionEngine, error) {
 
 // Encrypt encrypts data with ChaCha20-Poly1305
 func (e *EncryptionEngine) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, e.aead.NonceSize())
+	return e.EncryptTo(nil, plaintext)
+}
+
+// EncryptTo encrypts data with ChaCha20-Poly1305, writing nonce and ciphertext into dst's storage
+func (e *EncryptionEngine) EncryptTo(dst, plaintext []byte) ([]byte, error) {
+	return e.seal(dst[:0], plaintext, nil)
+}
+
+// seal appends the nonce and the ciphertext of plaintext, authenticated
+// with additionalData, to dst
+func (e *EncryptionEngine) seal(dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonceSize := e.aead.NonceSize()
+	start := len(dst)
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[start:]
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 	
-	ciphertext := e.aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return e.aead.Seal(dst, nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts data with ChaCha20-Poly1305
@@ -62,6 +94,36 @@ func (e *EncryptionEngine) Decrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// DecryptInPlace decrypts data with ChaCha20-Poly1305, reusing the ciphertext's storage
+func (e *EncryptionEngine) DecryptInPlace(ciphertext []byte) ([]byte, error) {
+	return e.openInPlace(ciphertext, nil)
+}
+
+// openInPlace decrypts ciphertext authenticated with additionalData,
+// reusing its storage
+func (e *EncryptionEngine) openInPlace(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < e.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	
+	nonce, ciphertext := ciphertext[:e.aead.NonceSize()], ciphertext[e.aead.NonceSize():]
+	return e.aead.Open(ciphertext[:0], nonce, ciphertext, additionalData)
+}
+
+// overhead is how much longer than the plaintext the ciphertext is
+func (e *EncryptionEngine) overhead() int {
+	return e.aead.NonceSize() + e.aead.Overhead()
+}
+
+// Zeroize wipes the raw key and drops the cipher. The cipher keeps a copy
+// of the key that cannot be reached to wipe; it is left to the garbage
+// collector.
+func (e *EncryptionEngine) Zeroize() {
+	ZeroBytes(e.key)
+	e.key = nil
+	e.aead = nil
+}
+
 // KeyExchange implements X25519 key exchange for perfect forward secrecy
 type KeyExchange struct {
 	privateKey []byte
@@ -86,13 +148,59 @@ func NewKeyExchange() (*KeyExchange, error) {
 	}, nil
 }
 
+// NewKeyExchangeFromWireGuardKey creates a key exchange from a private key in
+// WireGuard's format, base64 of the raw 32-byte Curve25519 key, as printed by
+// `wg genkey`
+func NewKeyExchangeFromWireGuardKey(base64key string) (*KeyExchange, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(base64key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WireGuard key: %v", err)
+	}
+	if len(privateKey) != curve25519.ScalarSize {
+		ZeroBytes(privateKey)
+		return nil, fmt.Errorf("invalid WireGuard key: %d bytes, want %d", len(privateKey), curve25519.ScalarSize)
+	}
+	
+	// Clamp as wg genkey does, so the exported key is byte-identical to one
+	// WireGuard would produce; X25519 clamps anyway, so the public key is
+	// the one `wg pubkey` derives either way
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
+	
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		ZeroBytes(privateKey)
+		return nil, fmt.Errorf("invalid WireGuard key: %v", err)
+	}
+	
+	return &KeyExchange{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}, nil
+}
+
+// ExportWireGuardPrivateKey returns the private key in WireGuard's format
+func (kx *KeyExchange) ExportWireGuardPrivateKey() string {
+	return base64.StdEncoding.EncodeToString(kx.privateKey)
+}
+
+// ExportWireGuardPublicKey returns the public key in WireGuard's format
+func (kx *KeyExchange) ExportWireGuardPublicKey() string {
+	return base64.StdEncoding.EncodeToString(kx.publicKey)
+}
+
 // GetPublicKey returns the public key for exchange
 func (kx *KeyExchange) GetPublicKey() []byte {
 	return kx.publicKey
 }
 
-// ComputeSharedSecret computes shared secret from peer's public key
-func (kx *KeyExchange) ComputeSharedSecret(peerPublicKey []byte) ([]byte, error) {
+// ComputeSharedSecret computes the session key shared with the owner of
+// peerPublicKey. The hash of transcript, the handshake messages both sides
+// exchanged, is bound into the key, so the two only agree on a key if they
+// saw the same handshake and a key or option spliced in from another one
+// is noticed at the first message. transcript is nil where there is no
+// handshake, as for rekeying.
+func (kx *KeyExchange) ComputeSharedSecret(peerPublicKey, transcript []byte) ([]byte, error) {
 	if len(peerPublicKey) != 32 {
 		return nil, errors.New("invalid peer public key length")
 	}
@@ -102,9 +210,15 @@ func (kx *KeyExchange) ComputeSharedSecret(peerPublicKey []byte) ([]byte, error)
 		return nil, err
 	}
 	
+	defer ZeroBytes(sharedSecret)
+	
 	// Derive encryption key using HKDF
 	salt := []byte("StealthVPN-2024")
-	info := []byte("session-key")
+	info := []byte(labelSessionKey)
+	if transcript != nil {
+		hash := sha256.Sum256(transcript)
+		info = append(info, hash[:]...)
+	}
 	
 	kdf := hkdf.New(sha256.New, sharedSecret, salt, info)
 	key := make([]byte, 32)
@@ -115,6 +229,21 @@ func (kx *KeyExchange) ComputeSharedSecret(peerPublicKey []byte) ([]byte, error)
 	return key, nil
 }
 
+// KeyExchangeTranscript returns the transcript both sides bind their keys
+// to: the server's hello followed by the client's reply, as sent. It is
+// built in a new slice, so neither message is changed.
+func KeyExchangeTranscript(hello, reply []byte) []byte {
+	transcript := make([]byte, 0, len(hello)+len(reply))
+	transcript = append(transcript, hello...)
+	return append(transcript, reply...)
+}
+
+// Zeroize wipes the private key held by the key exchange
+func (kx *KeyExchange) Zeroize() {
+	ZeroBytes(kx.privateKey)
+	kx.privateKey = nil
+}
+
 // AESEngine provides AES-256-GCM encryption as fallback
 type AESEngine struct {
 	aead cipher.AEAD
@@ -145,13 +274,26 @@ func NewAESEngine(key []byte) (*AESEngine, error) {
 
 // Encrypt encrypts data with AES-256-GCM
 func (a *AESEngine) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, a.aead.NonceSize())
+	return a.EncryptTo(nil, plaintext)
+}
+
+// EncryptTo encrypts data with AES-256-GCM, writing nonce and ciphertext into dst's storage
+func (a *AESEngine) EncryptTo(dst, plaintext []byte) ([]byte, error) {
+	return a.seal(dst[:0], plaintext, nil)
+}
+
+// seal appends the nonce and the ciphertext of plaintext, authenticated
+// with additionalData, to dst
+func (a *AESEngine) seal(dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonceSize := a.aead.NonceSize()
+	start := len(dst)
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[start:]
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 	
-	ciphertext := a.aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return a.aead.Seal(dst, nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts data with AES-256-GCM
@@ -169,10 +311,47 @@ func (a *AESEngine) Decrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// DecryptInPlace decrypts data with AES-256-GCM, reusing the ciphertext's storage
+func (a *AESEngine) DecryptInPlace(ciphertext []byte) ([]byte, error) {
+	return a.openInPlace(ciphertext, nil)
+}
+
+// openInPlace decrypts ciphertext authenticated with additionalData,
+// reusing its storage
+func (a *AESEngine) openInPlace(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < a.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	
+	nonce, ciphertext := ciphertext[:a.aead.NonceSize()], ciphertext[a.aead.NonceSize():]
+	return a.aead.Open(ciphertext[:0], nonce, ciphertext, additionalData)
+}
+
+// overhead is how much longer than the plaintext the ciphertext is
+func (a *AESEngine) overhead() int {
+	return a.aead.NonceSize() + a.aead.Overhead()
+}
+
+// Zeroize wipes the raw key and drops the cipher. The cipher's expanded key
+// schedule cannot be reached to wipe; it is left to the garbage collector.
+func (a *AESEngine) Zeroize() {
+	ZeroBytes(a.key)
+	a.key = nil
+	a.aead = nil
+}
+
 // MultiLayerEncryption combines multiple encryption algorithms for defense in depth
 type MultiLayerEncryption struct {
-	chacha *EncryptionEngine
-	aes    *AESEngine
+	mu                sync.RWMutex // held for reading while keys are in use, for writing to change them
+	keys              [2]*layerKeys // by key phase; both are set only while a rekey completes
+	sendPhase         int // phase of the keys new ciphertexts use
+	newest            int // phase of the most recently derived keys
+	chainKey          []byte // mixed into the next rekey
+	pendingRekey      *KeyExchange // our half of a rekey we started
+	keyedAt           time.Time // when the newest keys were derived
+	processed         atomic.Uint64 // bytes through the newest keys
+	cipher            string // negotiated with SetCipher; empty for both layers
+	parallelThreshold int // payloads this large are encrypted in chunks on several cores; 0 never. Guarded by mu
 }
 
 // NewMultiLayerEncryption creates encryption with multiple algorithms
@@ -181,64 +360,182 @@ func NewMultiLayerEncryption(key []byte) (*MultiLayerEncryption, error) {
 	salt1 := []byte("StealthVPN-ChaCha20")
 	salt2 := []byte("StealthVPN-AES256")
 	
-	kdf1 := hkdf.New(sha256.New, key, salt1, []byte("layer1"))
+	kdf1 := hkdf.New(sha256.New, key, salt1, []byte(labelChaChaKey))
 	key1 := make([]byte, 32)
 	if _, err := io.ReadFull(kdf1, key1); err != nil {
 		return nil, err
 	}
 	
-	kdf2 := hkdf.New(sha256.New, key, salt2, []byte("layer2"))
+	kdf2 := hkdf.New(sha256.New, key, salt2, []byte(labelAESKey))
 	key2 := make([]byte, 32)
 	if _, err := io.ReadFull(kdf2, key2); err != nil {
 		return nil, err
 	}
 	
-	chacha, err := NewEncryptionEngine(key1)
+	return newMultiLayerEncryption(key1, key2)
+}
+
+// ResumedEncryption derives fresh session keys for a resumed session from
+// the secret issued with its session token and the server's nonce
+func ResumedEncryption(secret, nonce []byte) (*MultiLayerEncryption, error) {
+	if len(secret) != ResumeSecretSize || len(nonce) != ResumeNonceSize {
+		return nil, errors.New("invalid resumption secret or nonce")
+	}
+	
+	kdf := hkdf.New(sha256.New, secret, nonce, []byte(labelResumeKey))
+	key := make([]byte, 32)
+	defer ZeroBytes(key)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return NewMultiLayerEncryption(key)
+}
+
+// newMultiLayerEncryption creates encryption from independent keys for the
+// two layers, which it takes ownership of
+func newMultiLayerEncryption(chachaKey, aesKey []byte) (*MultiLayerEncryption, error) {
+	chainKey, err := newChainKey(chachaKey, aesKey)
 	if err != nil {
 		return nil, err
 	}
 	
-	aes, err := NewAESEngine(key2)
+	chacha, err := NewEncryptionEngine(chachaKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	aes, err := NewAESEngine(aesKey)
 	if err != nil {
 		return nil, err
 	}
 	
 	return &MultiLayerEncryption{
-		chacha: chacha,
-		aes:    aes,
+		keys:              [2]*layerKeys{{chacha: chacha, aes: aes}},
+		chainKey:          chainKey,
+		keyedAt:           time.Now(),
+		parallelThreshold: DefaultParallelThreshold,
 	}, nil
 }
 
 // Encrypt applies multiple layers of encryption
 func (m *MultiLayerEncryption) Encrypt(plaintext []byte) ([]byte, error) {
-	// First layer: ChaCha20-Poly1305
-	encrypted1, err := m.chacha.Encrypt(plaintext)
-	if err != nil {
-		return nil, err
+	return m.EncryptTo(nil, plaintext)
+}
+
+// EncryptTo applies multiple layers of encryption, writing the result into
+// dst's storage. The intermediate layer uses a pooled buffer. Payloads of
+// at least the parallel threshold are split into chunks encrypted at once.
+func (m *MultiLayerEncryption) EncryptTo(dst, plaintext []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys, phase := m.keys[m.sendPhase], byte(m.sendPhase)<<7
+	if keys == nil {
+		return nil, errors.New("encryption keys were wiped")
 	}
+	m.processed.Add(uint64(len(plaintext)))
 	
-	// Second layer: AES-256-GCM
-	encrypted2, err := m.aes.Encrypt(encrypted1)
+	// A single negotiated cipher is fast enough not to need chunks
+	if m.singleLayer() {
+		dst = append(dst[:0], encryptionFormatSingleLayer|phase)
+		return keys.sealSingle(m.cipher, dst, plaintext)
+	}
+	
+	if chunks := m.parallelChunks(len(plaintext)); chunks > 1 {
+		return encryptChunked(dst[:0], plaintext, chunks, keys, phase)
+	}
+	
+	buf := GetPacketBuffer()
+	defer PutPacketBuffer(buf)
+	
+	// First layer: ChaCha20-Poly1305
+	encrypted1, err := keys.chacha.EncryptTo(*buf, plaintext)
 	if err != nil {
 		return nil, err
 	}
 	
-	return encrypted2, nil
+	// Second layer: AES-256-GCM
+	dst = append(dst[:0], encryptionFormatSingle|phase)
+	return keys.aes.seal(dst, encrypted1, nil)
 }
 
 // Decrypt removes multiple layers of encryption
 func (m *MultiLayerEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
-	// Remove second layer: AES-256-GCM
-	decrypted1, err := m.aes.Decrypt(ciphertext)
-	if err != nil {
-		return nil, err
+	return m.DecryptInPlace(append([]byte(nil), ciphertext...))
+}
+
+// DecryptInPlace removes multiple layers of encryption, reusing the
+// ciphertext's storage for the plaintext
+func (m *MultiLayerEncryption) DecryptInPlace(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, errors.New("ciphertext too short")
 	}
 	
-	// Remove first layer: ChaCha20-Poly1305
-	decrypted2, err := m.chacha.Decrypt(decrypted1)
+	phase := int(ciphertext[0]&encryptionKeyPhase) >> 7
+	plaintext, err := m.decryptWith(phase, ciphertext)
 	if err != nil {
 		return nil, err
 	}
+	m.processed.Add(uint64(len(plaintext)))
+	m.peerSwitched(phase)
+	return plaintext, nil
+}
+
+// decryptWith decrypts ciphertext with the keys of phase
+func (m *MultiLayerEncryption) decryptWith(phase int, ciphertext []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := m.keys[phase]
+	if keys == nil {
+		return nil, errors.New("ciphertext under replaced keys")
+	}
 	
-	return decrypted2, nil
-} 
\ No newline at end of file
+	switch ciphertext[0] &^ encryptionKeyPhase {
+	case encryptionFormatSingle:
+		// Remove second layer: AES-256-GCM
+		decrypted1, err := keys.aes.DecryptInPlace(ciphertext[1:])
+		if err != nil {
+			return nil, err
+		}
+		
+		// Remove first layer: ChaCha20-Poly1305
+		return keys.chacha.DecryptInPlace(decrypted1)
+	case encryptionFormatChunked:
+		return decryptChunked(ciphertext, keys)
+	case encryptionFormatSingleLayer:
+		if !m.singleLayer() {
+			return nil, errors.New("single cipher was not negotiated")
+		}
+		return keys.openSingle(m.cipher, ciphertext[1:])
+	default:
+		return nil, fmt.Errorf("unknown encryption format %d", ciphertext[0])
+	}
+}
+
+// Zeroize wipes the raw keys of every layer, the chain key and any rekey
+// under way. As with the engines, the ciphers' internal copies of the keys
+// are only dropped.
+func (m *MultiLayerEncryption) Zeroize() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, keys := range m.keys {
+		if keys != nil {
+			keys.zeroize()
+			m.keys[i] = nil
+		}
+	}
+	ZeroBytes(m.chainKey)
+	m.chainKey = nil
+	if m.pendingRekey != nil {
+		m.pendingRekey.Zeroize()
+		m.pendingRekey = nil
+	}
+}
+
+// ZeroBytes overwrites b with zeros. The KeepAlive keeps the compiler from
+// treating the stores as dead and eliding the loop.
+func ZeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
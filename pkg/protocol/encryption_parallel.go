@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+const (
+	// encryptionFormatSingle and encryptionFormatChunked lead every
+	// ciphertext, telling whether the payload was encrypted whole or in
+	// chunks
+	encryptionFormatSingle  byte = 0
+	encryptionFormatChunked byte = 1
+	// DefaultParallelThreshold is 0, encrypting every payload whole. With
+	// -cpu 4, BenchmarkEncrypt1M in chunks runs at about twice the rate of
+	// BenchmarkEncrypt1MSerial, but only because it has the other cores to
+	// itself; a server busy with many sessions has none to spare. The
+	// parallel_threshold setting turns chunks on.
+	DefaultParallelThreshold = 0
+	// parallelChunkMin keeps chunks large enough to be worth a core each
+	parallelChunkMin = 16 << 10
+	// chunkCountSize, payloadIDSize and chunkLengthSize are the sizes of
+	// the chunk count, of the random ID of the payload and of the length
+	// in front of each chunk
+	chunkCountSize  = 2
+	payloadIDSize   = 8
+	chunkLengthSize = 4
+)
+
+// SetParallelThreshold sets the smallest payload that is split into chunks
+// encrypted on several cores at once. 0 encrypts every payload whole.
+// Either way both formats are decrypted.
+func (m *MultiLayerEncryption) SetParallelThreshold(bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parallelThreshold = bytes
+}
+
+// parallelChunks returns how many chunks to encrypt a payload of size
+// bytes in, 1 to encrypt it whole
+func (m *MultiLayerEncryption) parallelChunks(size int) int {
+	if m.parallelThreshold <= 0 || size < m.parallelThreshold {
+		return 1
+	}
+	chunks := (size + parallelChunkMin - 1) / parallelChunkMin
+	return min(chunks, runtime.GOMAXPROCS(0), 1<<16-1)
+}
+
+// chunkAdditionalData binds a chunk to its place in the payload and, by
+// the payload's random ID, to the payload itself, so that chunks cannot be
+// reordered, dropped or moved between payloads undetected
+func chunkAdditionalData(payloadID []byte, index, count int) []byte {
+	ad := make([]byte, payloadIDSize+4)
+	copy(ad, payloadID)
+	binary.BigEndian.PutUint16(ad[payloadIDSize:], uint16(index))
+	binary.BigEndian.PutUint16(ad[payloadIDSize+2:], uint16(count))
+	return ad
+}
+
+// encryptChunked appends plaintext to dst split into count chunks, each
+// with both layers of encryption and its length in front, after a random
+// ID for the payload. The chunks are
+// encrypted in parallel with keys straight into their place in dst.
+func encryptChunked(dst, plaintext []byte, count int, keys *layerKeys, phase byte) ([]byte, error) {
+	chunkSize := (len(plaintext) + count - 1) / count
+	overhead := keys.chacha.overhead() + keys.aes.overhead()
+
+	start := len(dst)
+	total := 1 + chunkCountSize + payloadIDSize + len(plaintext) + count*(chunkLengthSize+overhead)
+	dst = slices.Grow(dst, total)[:start+total]
+	dst[start] = encryptionFormatChunked | phase
+	binary.BigEndian.PutUint16(dst[start+1:], uint16(count))
+	payloadID := dst[start+1+chunkCountSize : start+1+chunkCountSize+payloadIDSize]
+	if _, err := io.ReadFull(rand.Reader, payloadID); err != nil {
+		return nil, err
+	}
+
+	// Lay the chunks out first so each worker knows where its output goes
+	regions := make([][]byte, count)
+	offset := start + 1 + chunkCountSize + payloadIDSize
+	for i := range regions {
+		size := min(chunkSize, len(plaintext)-i*chunkSize) + overhead
+		binary.BigEndian.PutUint32(dst[offset:], uint32(size))
+		offset += chunkLengthSize
+		regions[i] = dst[offset : offset : offset+size]
+		offset += size
+	}
+
+	errs := make([]error, count)
+	parallelCrypto().run(count, func(i int) {
+		// The inner layer goes where the outer one encrypts it in place,
+		// after the outer nonce
+		region := regions[i]
+		nonceSize := keys.aes.aead.NonceSize()
+		nonce := region[:nonceSize]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			errs[i] = err
+			return
+		}
+		chunk := plaintext[i*chunkSize : min((i+1)*chunkSize, len(plaintext))]
+		inner, err := keys.chacha.seal(region[nonceSize:nonceSize], chunk, chunkAdditionalData(payloadID, i, count))
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		keys.aes.aead.Seal(inner[:0], nonce, inner, nil)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// decryptChunked decrypts a ciphertext in the chunked format in parallel
+// with keys, reusing its storage for the plaintext
+func decryptChunked(ciphertext []byte, keys *layerKeys) ([]byte, error) {
+	body := ciphertext[1:]
+	if len(body) < chunkCountSize+payloadIDSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	count := int(binary.BigEndian.Uint16(body))
+	payloadID := body[chunkCountSize : chunkCountSize+payloadIDSize]
+	body = body[chunkCountSize+payloadIDSize:]
+	if count == 0 {
+		return nil, errors.New("chunked ciphertext has no chunks")
+	}
+
+	regions := make([][]byte, count)
+	for i := range regions {
+		if len(body) < chunkLengthSize {
+			return nil, errors.New("truncated chunked ciphertext")
+		}
+		size := binary.BigEndian.Uint32(body)
+		body = body[chunkLengthSize:]
+		if uint64(size) > uint64(len(body)) {
+			return nil, errors.New("truncated chunked ciphertext")
+		}
+		regions[i] = body[:size]
+		body = body[size:]
+	}
+	if len(body) != 0 {
+		return nil, errors.New("trailing data after chunked ciphertext")
+	}
+
+	errs := make([]error, count)
+	parallelCrypto().run(count, func(i int) {
+		inner, err := keys.aes.openInPlace(regions[i], nil)
+		if err == nil {
+			regions[i], err = keys.chacha.openInPlace(inner, chunkAdditionalData(payloadID, i, count))
+		}
+		errs[i] = err
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	// Each chunk's plaintext lies after where it goes, so moving them to
+	// the front in order never overwrites one not yet moved
+	plaintext := ciphertext[:0]
+	for _, chunk := range regions {
+		plaintext = append(plaintext, chunk...)
+	}
+	return plaintext, nil
+}
+
+// cryptoPool runs chunks of encryption on a fixed set of workers shared by
+// every session
+type cryptoPool struct {
+	jobs chan func()
+}
+
+// parallelCrypto returns the pool, starting one worker per core when first
+// needed
+var parallelCrypto = sync.OnceValue(func() *cryptoPool {
+	p := &cryptoPool{jobs: make(chan func())}
+	for range runtime.GOMAXPROCS(0) {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+})
+
+// run calls task for 0 to n-1 and waits for them all. Tasks go to idle
+// workers; when every worker is busy, the caller runs them itself rather
+// than wait for one.
+func (p *cryptoPool) run(n int, task func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		job := func() {
+			defer wg.Done()
+			task(i)
+		}
+		if i == n-1 {
+			job()
+			continue
+		}
+		select {
+		case p.jobs <- job:
+		default:
+			job()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// formatOf returns the format a ciphertext was encrypted in
+func formatOf(ciphertext []byte) byte {
+	return ciphertext[0] &^ encryptionKeyPhase
+}
+
+func TestParallelThreshold(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	sender, receiver := newTestEncryption(t), newTestEncryption(t)
+	payload := bytes.Repeat([]byte("jumbo"), 20000)
+
+	ciphertext, err := sender.Encrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatOf(ciphertext) != encryptionFormatSingle {
+		t.Error("payload split into chunks without a threshold")
+	}
+
+	sender.SetParallelThreshold(len(payload))
+	for _, size := range []int{len(payload) - 1, len(payload)} {
+		ciphertext, err := sender.Encrypt(payload[:size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunked := formatOf(ciphertext) == encryptionFormatChunked; chunked != (size >= len(payload)) {
+			t.Errorf("%d byte payload chunked = %v with a threshold of %d", size, chunked, len(payload))
+		}
+
+		// The receiver decrypts both formats whatever its own threshold
+		plaintext, err := receiver.Decrypt(ciphertext)
+		if err != nil || !bytes.Equal(plaintext, payload[:size]) {
+			t.Fatalf("%d byte payload decrypted to %d bytes, %v", size, len(plaintext), err)
+		}
+	}
+}
+
+func TestChunkedCiphertextRejectsTampering(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	encryption := newTestEncryption(t)
+	encryption.SetParallelThreshold(parallelChunkMin)
+	ciphertext, err := encryption.Encrypt(make([]byte, 4*parallelChunkMin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatOf(ciphertext) != encryptionFormatChunked {
+		t.Fatal("payload not split into chunks")
+	}
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := encryption.Decrypt(tampered); err == nil {
+		t.Error("tampered chunk decrypted")
+	}
+	if _, err := encryption.Decrypt(ciphertext[:len(ciphertext)/2]); err == nil {
+		t.Error("truncated chunked ciphertext decrypted")
+	}
+}
+
+func TestChunkMovedBetweenPayloadsRejected(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	encryption := newTestEncryption(t)
+	encryption.SetParallelThreshold(parallelChunkMin)
+	first, err := encryption.Encrypt(bytes.Repeat([]byte{1}, 4*parallelChunkMin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encryption.Encrypt(bytes.Repeat([]byte{2}, 4*parallelChunkMin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both payloads have the same chunk count and layout, so the first
+	// chunk of one fits exactly in place of the first chunk of the other
+	chunkStart := 1 + chunkCountSize + payloadIDSize
+	chunkEnd := chunkStart + chunkLengthSize + int(binary.BigEndian.Uint32(first[chunkStart:]))
+	spliced := append([]byte(nil), first...)
+	copy(spliced[chunkStart:chunkEnd], second[chunkStart:chunkEnd])
+	if _, err := encryption.Decrypt(spliced); err == nil {
+		t.Error("chunk moved from another payload decrypted")
+	}
+	if _, err := encryption.Decrypt(first); err != nil {
+		t.Errorf("untouched payload failed to decrypt: %v", err)
+	}
+}
+
+func TestSetParallelThresholdWhileEncrypting(t *testing.T) {
+	encryption := newTestEncryption(t)
+	payload := make([]byte, 2*parallelChunkMin)
+
+	// Run with -race: the threshold is changed while sessions encrypt
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			encryption.SetParallelThreshold(i % 2 * parallelChunkMin)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ciphertext, err := encryption.Encrypt(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := encryption.Decrypt(ciphertext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// newTestEncryption returns session encryption with a fixed key
+func newTestEncryption(t *testing.T) *MultiLayerEncryption {
+	t.Helper()
+	encryption, err := NewMultiLayerEncryption(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption
+}
+
+func TestEncryptAfterZeroize(t *testing.T) {
+	encryption := newTestEncryption(t)
+	ciphertext, err := encryption.Encrypt([]byte("packet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption.Zeroize()
+	if _, err := encryption.EncryptTo(nil, []byte("packet")); err == nil {
+		t.Error("encrypted with wiped keys")
+	}
+	if _, err := encryption.Decrypt(ciphertext); err == nil {
+		t.Error("decrypted with wiped keys")
+	}
+}
+
+// isZero reports whether every byte of b is zero
+func isZero(b []byte) bool {
+	return bytes.Equal(b, make([]byte, len(b)))
+}
+
+func TestZeroizeClearsKeys(t *testing.T) {
+	encryption := newTestEncryption(t)
+	keys := encryption.keys[0]
+	chachaKey, aesKey, chainKey := keys.chacha.key, keys.aes.key, encryption.chainKey
+	if isZero(chachaKey) || isZero(aesKey) || isZero(chainKey) {
+		t.Fatal("keys are zero before Zeroize")
+	}
+
+	encryption.Zeroize()
+	if !isZero(chachaKey) || !isZero(aesKey) || !isZero(chainKey) {
+		t.Error("Zeroize left key bytes in memory")
+	}
+	if keys.chacha.key != nil || keys.aes.key != nil || keys.chacha.aead != nil || keys.aes.aead != nil {
+		t.Error("Zeroize kept references to the keys")
+	}
+
+	kx, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := kx.privateKey
+	kx.Zeroize()
+	if !isZero(privateKey) || kx.privateKey != nil {
+		t.Error("Zeroize left the private key in memory")
+	}
+}
+
+// TestZeroizeReleasesKey checks with a finalizer on the key's storage that
+// a wiped engine no longer holds the key, so nothing keeps it reachable
+func TestZeroizeReleasesKey(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+	freed := make(chan struct{})
+	runtime.SetFinalizer(&key[0], func(*byte) { close(freed) })
+
+	engine, err := NewEncryptionEngine(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Zeroize()
+	if !isZero(key) {
+		t.Fatal("Zeroize left key bytes in memory")
+	}
+
+	key = nil
+	for i := 0; i < 20; i++ {
+		runtime.GC()
+		select {
+		case <-freed:
+			runtime.KeepAlive(engine)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	runtime.KeepAlive(engine)
+	t.Fatal("the wiped engine still holds its key")
+}
+
+func TestResumedEncryption(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, ResumeSecretSize)
+	nonce := bytes.Repeat([]byte{2}, ResumeNonceSize)
+	server, err := ResumedEncryption(secret, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ResumedEncryption(secret, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := server.Encrypt([]byte("packet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := client.Decrypt(ciphertext); err != nil || string(plaintext) != "packet" {
+		t.Fatalf("client decrypted %q, %v", plaintext, err)
+	}
+
+	// Each resumption gets its own nonce and so its own keys
+	other, err := ResumedEncryption(secret, bytes.Repeat([]byte{3}, ResumeNonceSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Decrypt(ciphertext); err == nil {
+		t.Error("keys from another nonce decrypted the packet")
+	}
+
+	if _, err := ResumedEncryption(secret[:16], nonce); err == nil {
+		t.Error("short secret accepted")
+	}
+	if _, err := ResumedEncryption(secret, nil); err == nil {
+		t.Error("missing nonce accepted")
+	}
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconnectDelay is the first reconnect delay when none is configured
+	DefaultReconnectDelay = time.Second
+	// MaxReconnectDelay caps the exponential reconnect backoff
+	MaxReconnectDelay = 5 * time.Minute
+)
+
+// ServerList orders a client's servers for failover. Servers that answered
+// are tried first, fastest first; untried servers follow in configured
+// order; servers that failed go last, least recently failed first, so a down
+// or blocked server is not retried ahead of ones that may work.
+type ServerList struct {
+	mu      sync.Mutex
+	servers []*serverState
+}
+
+// serverState is what the client has learned about one server
+type serverState struct {
+	url         string
+	order       int
+	reachable   bool
+	latency     time.Duration
+	lastFailure time.Time
+}
+
+// NewServerList creates a server list in configured order, dropping duplicates
+func NewServerList(urls []string) *ServerList {
+	l := &ServerList{}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		l.servers = append(l.servers, &serverState{url: url, order: len(l.servers)})
+	}
+	return l
+}
+
+// Candidates returns every server in the order it should be tried
+func (l *ServerList) Candidates() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ordered := make([]*serverState, len(l.servers))
+	copy(ordered, l.servers)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		switch {
+		case a.reachable:
+			return a.latency < b.latency
+		case !a.lastFailure.IsZero():
+			return a.lastFailure.Before(b.lastFailure)
+		default:
+			return a.order < b.order
+		}
+	})
+
+	urls := make([]string, len(ordered))
+	for i, server := range ordered {
+		urls[i] = server.url
+	}
+	return urls
+}
+
+// rank groups servers as reachable, untried, then failed
+func rank(s *serverState) int {
+	switch {
+	case s.reachable:
+		return 0
+	case s.lastFailure.IsZero():
+		return 1
+	default:
+		return 2
+	}
+}
+
+// MarkSuccess records that url answered within latency
+func (l *ServerList) MarkSuccess(url string, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if server := l.find(url); server != nil {
+		server.reachable = true
+		server.latency = latency
+	}
+}
+
+// MarkFailure records that url could not be reached
+func (l *ServerList) MarkFailure(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if server := l.find(url); server != nil {
+		server.reachable = false
+		server.lastFailure = time.Now()
+	}
+}
+
+// Reachable returns the servers that answered last time they were tried
+func (l *ServerList) Reachable() []string {
+	var urls []string
+	for _, url := range l.Candidates() {
+		l.mu.Lock()
+		reachable := l.find(url).reachable
+		l.mu.Unlock()
+		if reachable {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// find returns the state for url; l.mu must be held
+func (l *ServerList) find(url string) *serverState {
+	for _, server := range l.servers {
+		if server.url == url {
+			return server
+		}
+	}
+	return nil
+}
+
+// Backoff produces exponentially growing delays between reconnect attempts
+type Backoff struct {
+	base    time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// NewBackoff creates a backoff starting at base and capped at max
+func NewBackoff(base, max time.Duration) *Backoff {
+	if base <= 0 {
+		base = DefaultReconnectDelay
+	}
+	if max < base {
+		max = base
+	}
+	return &Backoff{base: base, max: max}
+}
+
+// Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.base
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+// Reset starts the backoff over after a successful attempt
+func (b *Backoff) Reset() {
+	b.current = 0
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServerListOrder(t *testing.T) {
+	l := NewServerList([]string{"a", "b", "", "c", "a", "d", "e"})
+	if got := l.Candidates(); !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("untried servers in order %v, want configured order without duplicates", got)
+	}
+
+	l.MarkFailure("a")
+	time.Sleep(time.Millisecond)
+	l.MarkFailure("b")
+	l.MarkSuccess("d", 80*time.Millisecond)
+	l.MarkSuccess("e", 20*time.Millisecond)
+	l.MarkSuccess("unknown", time.Millisecond)
+
+	// Reachable fastest first, then untried, then failed least recently first
+	if got := l.Candidates(); !slices.Equal(got, []string{"e", "d", "c", "a", "b"}) {
+		t.Errorf("candidates = %v, want [e d c a b]", got)
+	}
+	if got := l.Reachable(); !slices.Equal(got, []string{"e", "d"}) {
+		t.Errorf("reachable = %v, want [e d]", got)
+	}
+
+	// A reachable server that fails drops behind the untried ones
+	l.MarkFailure("e")
+	if got := l.Candidates(); !slices.Equal(got, []string{"d", "c", "a", "b", "e"}) {
+		t.Errorf("candidates after a failure = %v, want [d c a b e]", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 5*time.Second)
+	for _, want := range []time.Duration{1, 2, 4, 5, 5} {
+		if got := b.Next(); got != want*time.Second {
+			t.Fatalf("Next() = %v, want %v", got, want*time.Second)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Errorf("Next() after Reset = %v, want the base delay", got)
+	}
+
+	if got := NewBackoff(0, 0).Next(); got != DefaultReconnectDelay {
+		t.Errorf("unconfigured backoff starts at %v, want %v", got, DefaultReconnectDelay)
+	}
+}
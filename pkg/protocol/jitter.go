@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// DefaultJitterRTTMultiplier makes the typical delay half a round trip
+	DefaultJitterRTTMultiplier = 0.5
+	// DefaultJitterSpread matches the spread of the gaps between a browser's
+	// requests for a page's resources
+	DefaultJitterSpread = 0.6
+	// DefaultJitterMax caps any single delay unless bounds are configured
+	DefaultJitterMax = 100 * time.Millisecond
+	// unmeasuredJitterMedian is the typical delay before an RTT is measured
+	unmeasuredJitterMedian = 30 * time.Millisecond
+	// rttSmoothing is the weight of each new RTT sample
+	rttSmoothing = 0.125
+)
+
+// JitterProfile shapes the delays AddTimingJitter inserts. Delays follow a
+// log-normal distribution, as the gaps between a browser's requests do,
+// centered on a multiple of the measured round-trip time so they stay in
+// proportion to the link.
+type JitterProfile struct {
+	Disabled      bool    `json:"disabled"`
+	RTTMultiplier float64 `json:"rtt_multiplier"` // median delay as a multiple of the RTT
+	Spread        float64 `json:"spread"`         // sigma of the log-normal distribution
+	TimingProfile string  `json:"timing_profile"` // draw from a browser's gaps instead, see SetTimingProfile
+}
+
+// DefaultJitterProfile is used until SetJitterProfile is called
+var DefaultJitterProfile = JitterProfile{
+	RTTMultiplier: DefaultJitterRTTMultiplier,
+	Spread:        DefaultJitterSpread,
+}
+
+// SetJitterProfile changes how AddTimingJitter delays. Zero fields take
+// their default. It must be called before the protocol is in use.
+func (sp *StealthProtocol) SetJitterProfile(profile JitterProfile) error {
+	if profile.RTTMultiplier < 0 || math.IsNaN(profile.RTTMultiplier) || math.IsInf(profile.RTTMultiplier, 0) {
+		return fmt.Errorf("invalid jitter RTT multiplier %v", profile.RTTMultiplier)
+	}
+	if profile.Spread < 0 || math.IsNaN(profile.Spread) || math.IsInf(profile.Spread, 0) {
+		return fmt.Errorf("invalid jitter spread %v", profile.Spread)
+	}
+	if profile.RTTMultiplier == 0 {
+		profile.RTTMultiplier = DefaultJitterRTTMultiplier
+	}
+	if profile.Spread == 0 {
+		profile.Spread = DefaultJitterSpread
+	}
+	sp.jitter = profile
+	return sp.SetTimingProfile(profile.TimingProfile)
+}
+
+// SetJitterBounds limits the delays AddTimingJitter inserts to between min
+// and max. A max of 0 turns the delays off. It must be called before the
+// protocol is in use.
+func (sp *StealthProtocol) SetJitterBounds(min, max time.Duration) error {
+	if min < 0 || max < 0 || min > max {
+		return fmt.Errorf("invalid jitter bounds %v to %v", min, max)
+	}
+	sp.jitterMin, sp.jitterMax = min, max
+	return nil
+}
+
+// JitterBoundsMs turns the jitter_min_ms and jitter_max_ms settings into
+// bounds, using the defaults for unset ones
+func JitterBoundsMs(minMs, maxMs *int) (min, max time.Duration) {
+	max = DefaultJitterMax
+	if minMs != nil {
+		min = time.Duration(*minMs) * time.Millisecond
+	}
+	if maxMs != nil {
+		max = time.Duration(*maxMs) * time.Millisecond
+	}
+	return min, max
+}
+
+// ObserveRTT feeds a measured round-trip time into the jitter, smoothed the
+// way TCP smooths its RTT estimate
+func (sp *StealthProtocol) ObserveRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	for {
+		old := sp.smoothedRTT.Load()
+		updated := int64(rtt)
+		if old != 0 {
+			updated = old + int64(rttSmoothing*float64(int64(rtt)-old))
+		}
+		if sp.smoothedRTT.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// jitterDelay samples the next delay
+func (sp *StealthProtocol) jitterDelay() time.Duration {
+	return sp.sampleJitter(randomFloat)
+}
+
+// sampleJitter draws a delay, taking uniform random numbers in [0, 1)
+// from uniform
+func (sp *StealthProtocol) sampleJitter(uniform func() float64) time.Duration {
+	if sp.jitter.Disabled || sp.jitterMax == 0 {
+		return 0
+	}
+
+	if sp.timing != nil {
+		return min(max(sp.timing.quantile(uniform()), sp.jitterMin), sp.jitterMax)
+	}
+
+	median := unmeasuredJitterMedian
+	if rtt := time.Duration(sp.smoothedRTT.Load()); rtt > 0 {
+		median = time.Duration(float64(rtt) * sp.jitter.RTTMultiplier)
+	}
+
+	delay := time.Duration(float64(median) * math.Exp(sp.jitter.Spread*randomNormal(uniform)))
+	return min(max(delay, sp.jitterMin), sp.jitterMax)
+}
+
+// randomNormal returns a standard normally distributed float, using the
+// Box-Muller transform on two numbers from uniform
+func randomNormal(uniform func() float64) float64 {
+	u1 := 1 - uniform() // in (0, 1], so the log is finite
+	u2 := uniform()
+	return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
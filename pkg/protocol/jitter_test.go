@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// seededUniform returns a reproducible source of uniform numbers in [0, 1)
+func seededUniform() func() float64 {
+	return rand.New(rand.NewPCG(1, 2)).Float64
+}
+
+// jitterSamples draws n delays from sp with a seeded source, sorted
+func jitterSamples(sp *StealthProtocol, n int) []time.Duration {
+	uniform := seededUniform()
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		delays[i] = sp.sampleJitter(uniform)
+	}
+	slices.Sort(delays)
+	return delays
+}
+
+func TestJitterScalesWithRTT(t *testing.T) {
+	for _, rtt := range []time.Duration{0, 20 * time.Millisecond, 80 * time.Millisecond} {
+		sp := NewStealthProtocol()
+		if err := sp.SetJitterBounds(0, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		sp.ObserveRTT(rtt)
+		wantMedian := unmeasuredJitterMedian
+		if rtt > 0 {
+			wantMedian = time.Duration(float64(rtt) * DefaultJitterRTTMultiplier)
+		}
+
+		delays := jitterSamples(sp, 10000)
+		if delays[0] < 0 || delays[len(delays)-1] > time.Second {
+			t.Errorf("RTT %v: delays from %v to %v, want within the bounds", rtt, delays[0], delays[len(delays)-1])
+		}
+		if median := delays[len(delays)/2]; median < wantMedian*9/10 || median > wantMedian*11/10 {
+			t.Errorf("RTT %v: median delay %v, want about %v", rtt, median, wantMedian)
+		}
+
+		// Log-normal delays spread out: with the default sigma of 0.6, the
+		// 16th and 84th percentiles are about 0.55 and 1.8 times the median
+		low, high := delays[len(delays)*16/100], delays[len(delays)*84/100]
+		if low > wantMedian*65/100 || high < wantMedian*16/10 {
+			t.Errorf("RTT %v: middle of the delays %v to %v, too narrow around %v", rtt, low, high, wantMedian)
+		}
+	}
+}
+
+func TestObserveRTTSmooths(t *testing.T) {
+	sp := NewStealthProtocol()
+	sp.ObserveRTT(100 * time.Millisecond)
+	sp.ObserveRTT(0)
+	if got := time.Duration(sp.smoothedRTT.Load()); got != 100*time.Millisecond {
+		t.Fatalf("smoothed RTT = %v after the first sample, want it taken as is", got)
+	}
+	// One outlier moves the estimate an eighth of the way
+	sp.ObserveRTT(900 * time.Millisecond)
+	if got := time.Duration(sp.smoothedRTT.Load()); got != 200*time.Millisecond {
+		t.Errorf("smoothed RTT = %v, want 200ms", got)
+	}
+}
+
+func TestSetJitterProfileRejectsInvalid(t *testing.T) {
+	for _, profile := range []JitterProfile{
+		{RTTMultiplier: -1},
+		{Spread: -0.5},
+		{TimingProfile: "browser-sleepy"},
+	} {
+		if err := NewStealthProtocol().SetJitterProfile(profile); err == nil {
+			t.Errorf("SetJitterProfile(%+v) accepted", profile)
+		}
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	ms := func(n int) *int { return &n }
+	for _, test := range []struct {
+		name     string
+		minMs    *int
+		maxMs    *int
+		profile  JitterProfile
+		min, max time.Duration
+	}{
+		{"defaults", nil, nil, JitterProfile{}, 0, DefaultJitterMax},
+		{"configured", ms(5), ms(15), JitterProfile{}, 5 * time.Millisecond, 15 * time.Millisecond},
+		{"fixed", ms(10), ms(10), JitterProfile{}, 10 * time.Millisecond, 10 * time.Millisecond},
+		{"zero", nil, ms(0), JitterProfile{}, 0, 0},
+		{"disabled", ms(5), ms(15), JitterProfile{Disabled: true}, 0, 0},
+		{"timing profile", ms(1), ms(200), JitterProfile{TimingProfile: "browser-idle"}, time.Millisecond, 200 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sp := NewStealthProtocol()
+			if err := sp.SetJitterProfile(test.profile); err != nil {
+				t.Fatal(err)
+			}
+			if err := sp.SetJitterBounds(JitterBoundsMs(test.minMs, test.maxMs)); err != nil {
+				t.Fatal(err)
+			}
+			sp.ObserveRTT(30 * time.Millisecond)
+
+			delays := jitterSamples(sp, 1000)
+			if delays[0] < test.min || delays[len(delays)-1] > test.max {
+				t.Errorf("delays from %v to %v, want within %v to %v", delays[0], delays[len(delays)-1], test.min, test.max)
+			}
+			// Unless the bounds pin them, the delays vary
+			if test.min != test.max && delays[0] == delays[len(delays)-1] {
+				t.Errorf("every delay was %v", delays[0])
+			}
+		})
+	}
+}
+
+func TestZeroJitterDoesNotSleep(t *testing.T) {
+	sp := NewStealthProtocol()
+	if err := sp.SetJitterBounds(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		sp.AddTimingJitter()
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("100 calls without jitter took %v", elapsed)
+	}
+}
+
+func TestSetJitterBoundsRejectsInvalid(t *testing.T) {
+	for _, bounds := range [][2]time.Duration{
+		{-time.Millisecond, 10 * time.Millisecond},
+		{0, -time.Millisecond},
+		{20 * time.Millisecond, 10 * time.Millisecond},
+	} {
+		if err := NewStealthProtocol().SetJitterBounds(bounds[0], bounds[1]); err == nil {
+			t.Errorf("SetJitterBounds(%v, %v) accepted", bounds[0], bounds[1])
+		}
+	}
+}
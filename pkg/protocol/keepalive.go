@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultKeepaliveInterval is how often a WebSocket ping is sent
+	DefaultKeepaliveInterval = 15 * time.Second
+	// DefaultDeadPeerIntervals is how many keepalive intervals may pass
+	// without hearing from the peer before the link is declared dead
+	DefaultDeadPeerIntervals = 3
+	// lossSmoothing weighs each ping's outcome in the smoothed loss
+	lossSmoothing = 0.125
+)
+
+// LinkQuality describes a connection as measured by keepalive pings
+type LinkQuality struct {
+	RTT    time.Duration // smoothed round-trip time, 0 until a pong arrives
+	RTTVar time.Duration // smoothed mean deviation of the round-trip time
+	Loss   float64       // smoothed fraction of pings that went unanswered
+}
+
+// DeadPeerDetector notices half-open connections by sending native WebSocket
+// pings and expiring the read deadline when no pong or data arrives within
+// the configured number of keepalive intervals. The blocked ReadMessage call
+// then fails, which tears the session down through the normal error path.
+//
+// Each ping carries a sequence number the peer echoes in its pong, which
+// measures the round-trip time. A ping counts as lost when its pong is over
+// a keepalive interval late or a later ping's pong arrives first.
+type DeadPeerDetector struct {
+	conn     *websocket.Conn
+	interval time.Duration
+	timeout  time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu          sync.Mutex
+	seq         uint64
+	outstanding map[uint64]time.Time // send times of pings awaiting a pong
+	quality     LinkQuality
+	observeRTT  func(time.Duration)
+}
+
+// NewDeadPeerDetector creates a detector for conn. Zero values fall back to
+// DefaultKeepaliveInterval and DefaultDeadPeerIntervals.
+func NewDeadPeerDetector(conn *websocket.Conn, interval time.Duration, missedIntervals int) *DeadPeerDetector {
+	if interval <= 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	if missedIntervals <= 0 {
+		missedIntervals = DefaultDeadPeerIntervals
+	}
+
+	d := &DeadPeerDetector{
+		conn:     conn,
+		interval: interval,
+		timeout:  interval * time.Duration(missedIntervals),
+		done:     make(chan struct{}),
+
+		outstanding: make(map[uint64]time.Time),
+	}
+
+	conn.SetPongHandler(func(data string) error {
+		d.MarkAlive()
+		d.pongReceived([]byte(data), time.Now())
+		return nil
+	})
+
+	return d
+}
+
+// MarkAlive records that the peer was heard from. It must be called from the
+// goroutine that reads from the connection.
+func (d *DeadPeerDetector) MarkAlive() {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+}
+
+// SetRTTObserver has fn called with every round-trip time measured. It must
+// be called before Start.
+func (d *DeadPeerDetector) SetRTTObserver(fn func(time.Duration)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.observeRTT = fn
+}
+
+// Quality returns the link's round-trip time and loss so far
+func (d *DeadPeerDetector) Quality() LinkQuality {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.quality
+}
+
+// Start arms the read deadline and begins sending pings
+func (d *DeadPeerDetector) Start() {
+	d.MarkAlive()
+	go d.pingLoop()
+}
+
+// Stop ends the ping loop
+func (d *DeadPeerDetector) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+	})
+}
+
+// Ping sends a ping now, outside the regular schedule, as when the platform
+// wakes the app briefly and the link must be proven alive before it sleeps
+// again. Its pong is measured like any other.
+func (d *DeadPeerDetector) Ping() error {
+	select {
+	case <-d.done:
+		return net.ErrClosed
+	default:
+	}
+	return d.ping(time.Now())
+}
+
+// pingLoop sends a ping every interval until stopped or the write fails
+func (d *DeadPeerDetector) pingLoop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-ticker.C:
+			if err := d.ping(now); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ping sends a ping stamped with now
+func (d *DeadPeerDetector) ping(now time.Time) error {
+	deadline := now.Add(d.interval)
+	return d.conn.WriteControl(websocket.PingMessage, d.pingSent(now), deadline)
+}
+
+// pingSent records a ping sent at now and returns its payload. Pings still
+// unanswered after a keepalive interval are counted as lost.
+func (d *DeadPeerDetector) pingSent(now time.Time) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for seq, sent := range d.outstanding {
+		if now.Sub(sent) >= d.interval {
+			delete(d.outstanding, seq)
+			d.recordOutcome(true)
+		}
+	}
+
+	d.seq++
+	d.outstanding[d.seq] = now
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, d.seq)
+	return payload
+}
+
+// pongReceived measures the round trip of the ping a pong answers. Pongs
+// come back in order, so pings sent before it that are still unanswered
+// were lost.
+func (d *DeadPeerDetector) pongReceived(payload []byte, now time.Time) {
+	if len(payload) != 8 {
+		return
+	}
+	seq := binary.BigEndian.Uint64(payload)
+
+	d.mu.Lock()
+	sent, ok := d.outstanding[seq]
+	if !ok {
+		// Unsolicited, or already counted as lost
+		d.mu.Unlock()
+		return
+	}
+	delete(d.outstanding, seq)
+	for earlier := range d.outstanding {
+		if earlier < seq {
+			delete(d.outstanding, earlier)
+			d.recordOutcome(true)
+		}
+	}
+	rtt := now.Sub(sent)
+	d.recordRTT(rtt)
+	d.recordOutcome(false)
+	observe := d.observeRTT
+	d.mu.Unlock()
+
+	if observe != nil {
+		observe(rtt)
+	}
+}
+
+// recordRTT smooths a round-trip time sample into the estimate as TCP does
+// (RFC 6298)
+func (d *DeadPeerDetector) recordRTT(rtt time.Duration) {
+	q := &d.quality
+	if q.RTT == 0 {
+		q.RTT = rtt
+		q.RTTVar = rtt / 2
+		return
+	}
+	deviation := q.RTT - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	q.RTTVar = (3*q.RTTVar + deviation) / 4
+	q.RTT = (7*q.RTT + rtt) / 8
+}
+
+// recordOutcome smooths whether a ping was lost into the loss estimate
+func (d *DeadPeerDetector) recordOutcome(lost bool) {
+	sample := 0.0
+	if lost {
+		sample = 1
+	}
+	d.quality.Loss += lossSmoothing * (sample - d.quality.Loss)
+}
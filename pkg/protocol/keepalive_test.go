@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webSocketPair returns both ends of a WebSocket connection over loopback
+func webSocketPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(ts.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestDeadPeerDetectorExpiresSilentPeer(t *testing.T) {
+	server, _ := webSocketPair(t)
+	// The client never reads, so it never answers a ping
+	d := NewDeadPeerDetector(server, 20*time.Millisecond, 2)
+	d.Start()
+	defer d.Stop()
+
+	start := time.Now()
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Fatal("read from a silent peer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("silent peer declared dead after %v", elapsed)
+	}
+}
+
+func TestDeadPeerDetectorMeasuresRTT(t *testing.T) {
+	server, client := webSocketPair(t)
+	// Reading answers pings
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	d := NewDeadPeerDetector(server, 10*time.Millisecond, 50)
+	rtts := make(chan time.Duration, 16)
+	d.SetRTTObserver(func(rtt time.Duration) {
+		select {
+		case rtts <- rtt:
+		default:
+		}
+	})
+	d.Start()
+	defer d.Stop()
+	// Pong handlers run inside the reader
+	go server.ReadMessage()
+
+	select {
+	case <-rtts:
+	case <-time.After(time.Second):
+		t.Fatal("no pong measured")
+	}
+	if q := d.Quality(); q.RTT <= 0 {
+		t.Errorf("Quality().RTT = %v after a pong", q.RTT)
+	}
+}
+
+func TestDeadPeerDetectorCountsLostPings(t *testing.T) {
+	d := &DeadPeerDetector{interval: time.Second, outstanding: make(map[uint64]time.Time)}
+	now := time.Unix(1000, 0)
+
+	first := d.pingSent(now)
+	second := d.pingSent(now.Add(100 * time.Millisecond))
+	// The second ping's pong arriving first means the first was lost
+	d.pongReceived(second, now.Add(150*time.Millisecond))
+	q := d.Quality()
+	if q.RTT != 50*time.Millisecond {
+		t.Errorf("RTT = %v, want 50ms", q.RTT)
+	}
+	if want := lossSmoothing * (1 - lossSmoothing); q.Loss != want {
+		t.Errorf("Loss = %v, want %v after one lost and one answered ping", q.Loss, want)
+	}
+
+	// A late pong for a ping already counted as lost is ignored
+	d.pongReceived(first, now.Add(200*time.Millisecond))
+	if d.Quality() != q {
+		t.Error("late pong changed the link quality")
+	}
+
+	// Pings unanswered for an interval are lost when the next is sent
+	d.pingSent(now.Add(time.Second))
+	d.pingSent(now.Add(3 * time.Second))
+	if d.Quality().Loss <= q.Loss {
+		t.Error("unanswered ping not counted as lost")
+	}
+
+	// Pongs not carrying a sequence number are ignored
+	q = d.Quality()
+	var short [4]byte
+	binary.BigEndian.PutUint32(short[:], 3)
+	d.pongReceived(short[:], now.Add(3*time.Second))
+	if d.Quality() != q {
+		t.Error("malformed pong changed the link quality")
+	}
+}
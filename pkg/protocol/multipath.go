@@ -0,0 +1,380 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// multipathHeaderSize is the sequence number prepended to every frame
+	multipathHeaderSize = 8
+	// multipathReorderWindow is how many frames may wait on a slower path
+	multipathReorderWindow = 1024
+	// multipathReorderTimeout bounds the wait for a frame on a slower path.
+	// Paths are reliable, so frames only go missing when a path fails.
+	multipathReorderTimeout = 500 * time.Millisecond
+	// multipathInboxSize is how many frames the paths may queue for the reader
+	multipathInboxSize = 256
+)
+
+// MultipathTransport bonds several transports to the same peer into one.
+// Frames are numbered and each goes out on the path with the fewest writes
+// in progress, and of those the one with the lowest round-trip time, as
+// MPTCP's default scheduler does; the receiving side puts them back in
+// order. A failed path is dropped and the transport carries on over the
+// others until none is left.
+type MultipathTransport struct {
+	maxPaths          int
+	keepalive         time.Duration
+	deadPeerIntervals int
+	rttObserver       func(time.Duration)
+
+	mu            sync.Mutex
+	paths         []*multipathPath
+	next          int // where the search for an idle path starts, to spread ties
+	remote        net.Addr
+	writeDeadline time.Time
+	err           error // why the transport is done
+	closed        bool
+	done          chan struct{}
+
+	sendSeq  atomic.Uint64
+	incoming chan []byte
+
+	reorder         *reorderBuffer
+	ready           [][]byte
+	readMu          sync.Mutex
+	readDeadline    time.Time // guarded by deadlineMu
+	deadlineMu      sync.Mutex
+	deadlineChanged chan struct{}
+}
+
+// multipathPath is one of the transports bonded into a MultipathTransport
+type multipathPath struct {
+	transport Transport
+	detector  *DeadPeerDetector // nil unless the path is a WebSocket
+	inflight  atomic.Int32      // writes in progress
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMultipathTransport creates a transport with no paths yet, which bonds
+// up to maxPaths of them
+func NewMultipathTransport(maxPaths int) *MultipathTransport {
+	return &MultipathTransport{
+		maxPaths:        maxPaths,
+		done:            make(chan struct{}),
+		incoming:        make(chan []byte, multipathInboxSize),
+		reorder:         newReorderBuffer(multipathReorderWindow, multipathReorderTimeout),
+		deadlineChanged: make(chan struct{}, 1),
+	}
+}
+
+// SetKeepalive configures the dead peer detection of WebSocket paths added
+// afterwards, as NewDeadPeerDetector does
+func (m *MultipathTransport) SetKeepalive(interval time.Duration, missedIntervals int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keepalive = interval
+	m.deadPeerIntervals = missedIntervals
+}
+
+// SetRTTObserver sets a function called with each round-trip time measured
+// on WebSocket paths added afterwards
+func (m *MultipathTransport) SetRTTObserver(fn func(time.Duration)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rttObserver = fn
+}
+
+// AddPath bonds t into the transport, which takes ownership of it. The
+// returned channel is closed once the path is dropped.
+func (m *MultipathTransport) AddPath(t Transport) (<-chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrTransportClosed
+	}
+	if len(m.paths) >= m.maxPaths {
+		return nil, fmt.Errorf("already using %d paths", len(m.paths))
+	}
+
+	path := &multipathPath{transport: t, done: make(chan struct{})}
+	if ws, ok := UnwrapWebSocket(t); ok {
+		path.detector = NewDeadPeerDetector(ws.Conn(), m.keepalive, m.deadPeerIntervals)
+		if m.rttObserver != nil {
+			path.detector.SetRTTObserver(m.rttObserver)
+		}
+	}
+	if !m.writeDeadline.IsZero() {
+		t.SetWriteDeadline(m.writeDeadline)
+	}
+	m.paths = append(m.paths, path)
+	if m.remote == nil {
+		m.remote = t.RemoteAddr()
+	}
+	go m.readPath(path)
+	return path.done, nil
+}
+
+// Paths returns how many paths are bonded
+func (m *MultipathTransport) Paths() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.paths)
+}
+
+// QueueDepth returns how many frames wait for the reader
+func (m *MultipathTransport) QueueDepth() int {
+	return len(m.incoming)
+}
+
+// LinkQualities returns the round-trip time and loss of each path that
+// measures them
+func (m *MultipathTransport) LinkQualities() []LinkQuality {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var qualities []LinkQuality
+	for _, path := range m.paths {
+		if path.detector != nil {
+			qualities = append(qualities, path.detector.Quality())
+		}
+	}
+	return qualities
+}
+
+// readPath queues the frames arriving on path for the reader until the
+// path fails. WebSocket paths are pinged so that one that silently stops
+// responding is noticed and dropped.
+func (m *MultipathTransport) readPath(path *multipathPath) {
+	detector := path.detector
+	if detector != nil {
+		detector.Start()
+		defer detector.Stop()
+	} else {
+		path.transport.SetReadDeadline(time.Time{})
+	}
+
+	for {
+		frame, err := path.transport.ReadMessage()
+		if err != nil {
+			m.dropPath(path, err)
+			return
+		}
+		if detector != nil {
+			detector.MarkAlive()
+		}
+		if len(frame) < multipathHeaderSize {
+			continue
+		}
+
+		select {
+		case m.incoming <- frame:
+		case <-path.done:
+			return
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// dropPath removes a failed path, ending the transport if it was the last
+func (m *MultipathTransport) dropPath(path *multipathPath, err error) {
+	m.mu.Lock()
+	found := false
+	for i, p := range m.paths {
+		if p == path {
+			m.paths = append(m.paths[:i], m.paths[i+1:]...)
+			found = true
+			break
+		}
+	}
+	last := found && len(m.paths) == 0 && !m.closed
+	if last {
+		m.closed = true
+		m.err = err
+	}
+	m.mu.Unlock()
+
+	path.close()
+	if last {
+		close(m.done)
+	}
+}
+
+// close ends the path and closes its transport
+func (p *multipathPath) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.transport.Close()
+	})
+}
+
+// pickPath returns the path with the fewest writes in progress, preferring
+// the lower round-trip time among equals, or nil if there is none
+func (m *MultipathTransport) pickPath() *multipathPath {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var best *multipathPath
+	var bestInflight int32
+	var bestRTT time.Duration
+	for i := range m.paths {
+		path := m.paths[(m.next+i)%len(m.paths)]
+		inflight, rtt := path.inflight.Load(), path.rtt()
+		if best == nil || inflight < bestInflight ||
+			inflight == bestInflight && rtt != 0 && bestRTT != 0 && rtt < bestRTT {
+			best, bestInflight, bestRTT = path, inflight, rtt
+		}
+	}
+	m.next++
+	return best
+}
+
+// rtt returns the path's smoothed round-trip time, 0 if unmeasured
+func (p *multipathPath) rtt() time.Duration {
+	if p.detector == nil {
+		return 0
+	}
+	return p.detector.Quality().RTT
+}
+
+// ReadMessage returns the next frame in sequence order, whichever path it
+// arrived on
+func (m *MultipathTransport) ReadMessage() ([]byte, error) {
+	m.readMu.Lock()
+	defer m.readMu.Unlock()
+
+	for len(m.ready) == 0 {
+		if m.ready = m.reorder.expire(time.Now()); len(m.ready) > 0 {
+			break
+		}
+
+		// Wake for the caller's deadline or to give up on a gap
+		m.deadlineMu.Lock()
+		deadline := m.readDeadline
+		m.deadlineMu.Unlock()
+		wake := deadline
+		if gap, waiting := m.reorder.expiry(); waiting && (wake.IsZero() || gap.Before(wake)) {
+			wake = gap
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			timeout = timer.C
+		}
+
+		select {
+		case frame := <-m.incoming:
+			seq := binary.BigEndian.Uint64(frame[:multipathHeaderSize])
+			m.ready = m.reorder.push(seq, frame[multipathHeaderSize:])
+		case <-timeout:
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return nil, os.ErrDeadlineExceeded
+			}
+		case <-m.deadlineChanged:
+		case <-m.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, m.doneErr()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	frame := m.ready[0]
+	m.ready = m.ready[1:]
+	return frame, nil
+}
+
+// WriteMessage sends data on the least busy path. A frame whose path fails
+// is sent again on another one.
+func (m *MultipathTransport) WriteMessage(data []byte) error {
+	buf := GetPacketBuffer()
+	defer PutPacketBuffer(buf)
+	frame := append((*buf)[:0], make([]byte, multipathHeaderSize)...)
+	binary.BigEndian.PutUint64(frame, m.sendSeq.Add(1)-1)
+	frame = append(frame, data...)
+
+	for {
+		path := m.pickPath()
+		if path == nil {
+			return m.doneErr()
+		}
+		path.inflight.Add(1)
+		err := path.transport.WriteMessage(frame)
+		path.inflight.Add(-1)
+		if err == nil {
+			return nil
+		}
+		m.dropPath(path, err)
+	}
+}
+
+// doneErr returns why the transport ended
+func (m *MultipathTransport) doneErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	return ErrTransportClosed
+}
+
+// SetReadDeadline sets the deadline for the next read, interrupting a read
+// in progress to apply it
+func (m *MultipathTransport) SetReadDeadline(deadline time.Time) error {
+	m.deadlineMu.Lock()
+	m.readDeadline = deadline
+	m.deadlineMu.Unlock()
+
+	select {
+	case m.deadlineChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes on every path
+func (m *MultipathTransport) SetWriteDeadline(deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeDeadline = deadline
+	for _, path := range m.paths {
+		path.transport.SetWriteDeadline(deadline)
+	}
+	return nil
+}
+
+// RemoteAddr returns the peer's address on the first path
+func (m *MultipathTransport) RemoteAddr() net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remote
+}
+
+// Close closes every path
+func (m *MultipathTransport) Close() error {
+	m.mu.Lock()
+	paths := m.paths
+	m.paths = nil
+	wasClosed := m.closed
+	m.closed = true
+	m.mu.Unlock()
+
+	for _, path := range paths {
+		path.close()
+	}
+	if !wasClosed {
+		close(m.done)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTransport is one end of an in-memory connection. Closing either end
+// closes both, as with a network connection.
+type memTransport struct {
+	in, out chan []byte
+	done    chan struct{}
+	once    *sync.Once
+}
+
+// memPair returns the two ends of an in-memory connection
+func memPair() (*memTransport, *memTransport) {
+	a, b := make(chan []byte, 64), make(chan []byte, 64)
+	done, once := make(chan struct{}), &sync.Once{}
+	return &memTransport{in: a, out: b, done: done, once: once},
+		&memTransport{in: b, out: a, done: done, once: once}
+}
+
+func (m *memTransport) ReadMessage() ([]byte, error) {
+	select {
+	case frame := <-m.in:
+		return frame, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *memTransport) WriteMessage(data []byte) error {
+	select {
+	case <-m.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case m.out <- append([]byte(nil), data...):
+		return nil
+	case <-m.done:
+		return net.ErrClosed
+	}
+}
+
+func (m *memTransport) SetReadDeadline(time.Time) error  { return nil }
+func (m *memTransport) SetWriteDeadline(time.Time) error { return nil }
+func (m *memTransport) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+
+func (m *memTransport) Close() error {
+	m.once.Do(func() { close(m.done) })
+	return nil
+}
+
+// multipathPair bonds n in-memory connections into a multipath transport at
+// each end and returns both, with the connections' near ends
+func multipathPair(t *testing.T, n int) (local, remote *MultipathTransport, conns []*memTransport) {
+	t.Helper()
+	local, remote = NewMultipathTransport(n), NewMultipathTransport(n)
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	for i := 0; i < n; i++ {
+		a, b := memPair()
+		if _, err := local.AddPath(a); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remote.AddPath(b); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, a)
+	}
+	return local, remote, conns
+}
+
+// readInOrder reads frames 0 to n-1 from transport
+func readInOrder(t *testing.T, transport Transport, n int) {
+	t.Helper()
+	transport.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		frame, err := transport.ReadMessage()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if want := fmt.Sprint(i); string(frame) != want {
+			t.Fatalf("read %q, want %q", frame, want)
+		}
+	}
+}
+
+func TestMultipathDeliversInOrder(t *testing.T) {
+	local, remote, _ := multipathPair(t, 3)
+	go func() {
+		for i := 0; i < 500; i++ {
+			local.WriteMessage([]byte(fmt.Sprint(i)))
+		}
+	}()
+	readInOrder(t, remote, 500)
+}
+
+// brokenWriter is a connection whose writes fail while reads still wait
+type brokenWriter struct {
+	*memTransport
+}
+
+func (b brokenWriter) WriteMessage([]byte) error { return errors.New("broken pipe") }
+
+func TestMultipathResendsOnFailedPath(t *testing.T) {
+	local, remote := NewMultipathTransport(2), NewMultipathTransport(2)
+	defer local.Close()
+	defer remote.Close()
+
+	// Ties go to the first path, so frames are written to the broken one
+	// first
+	broken, _ := memPair()
+	a, b := memPair()
+	if _, err := local.AddPath(brokenWriter{broken}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.AddPath(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.AddPath(b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := local.WriteMessage([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readInOrder(t, remote, 50)
+	if local.Paths() != 1 {
+		t.Errorf("%d paths left, want the failed one dropped", local.Paths())
+	}
+}
+
+func TestMultipathEndsWithLastPath(t *testing.T) {
+	local, _, conns := multipathPair(t, 2)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if _, err := local.ReadMessage(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read error = %v, want the last path's error", err)
+	}
+	if err := local.WriteMessage([]byte("late")); err == nil {
+		t.Error("wrote with no path left")
+	}
+	if _, err := local.AddPath(&memTransport{}); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("AddPath() after the end = %v, want %v", err, ErrTransportClosed)
+	}
+}
+
+func TestMultipathLimitsPaths(t *testing.T) {
+	local, _, _ := multipathPair(t, 2)
+	a, _ := memPair()
+	if _, err := local.AddPath(a); err == nil {
+		t.Error("path added beyond the limit")
+	}
+}
+
+func TestMultipathReadDeadline(t *testing.T) {
+	local, _, _ := multipathPair(t, 1)
+	local.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := local.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read error = %v, want a deadline error", err)
+	}
+}
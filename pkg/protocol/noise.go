@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/flynn/noise"
+)
+
+// noiseSuite is the Noise_XX_25519_ChaChaPoly_BLAKE2s protocol
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// NoiseSession is the outcome of a Noise handshake
+type NoiseSession struct {
+	Encryption *MultiLayerEncryption
+	// PeerStatic is the other side's long-term public key
+	PeerStatic []byte
+	// Transcript binds PSK proofs to this handshake
+	Transcript []byte
+}
+
+// NoiseStaticKey returns the long-term Noise key pair for a private key in
+// WireGuard's base64 format, or a new random pair if wireGuardKey is empty
+func NoiseStaticKey(wireGuardKey string) (noise.DHKey, error) {
+	if wireGuardKey == "" {
+		return noiseSuite.GenerateKeypair(rand.Reader)
+	}
+
+	kx, err := NewKeyExchangeFromWireGuardKey(wireGuardKey)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{Private: kx.privateKey, Public: kx.publicKey}, nil
+}
+
+// EncodeNoisePublicKey formats a Noise public key like a WireGuard one
+func EncodeNoisePublicKey(publicKey []byte) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+// DecodeNoisePublicKey parses a public key written by EncodeNoisePublicKey
+func DecodeNoisePublicKey(encoded string) ([]byte, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(publicKey) != noise.DH25519.DHLen() {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(publicKey), noise.DH25519.DHLen())
+	}
+	return publicKey, nil
+}
+
+// NoiseHandshake runs a Noise_XX handshake over t, one binary frame per
+// handshake message. The prologue must be identical on both sides; it
+// authenticates whatever was negotiated in the clear beforehand. If
+// peerStatic is set, the handshake is abandoned as soon as the peer shows a
+// different long-term key.
+func NoiseHandshake(t Transport, initiator bool, static noise.DHKey, peerStatic, prologue []byte) (*NoiseSession, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      prologue,
+		StaticKeypair: static,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cs1, cs2 *noise.CipherState
+	for writing := initiator; cs1 == nil; writing = !writing {
+		if writing {
+			var message []byte
+			message, cs1, cs2, err = hs.WriteMessage(nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			if err := t.WriteMessage(message); err != nil {
+				return nil, err
+			}
+		} else {
+			message, err := t.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			if _, cs1, cs2, err = hs.ReadMessage(nil, message); err != nil {
+				return nil, fmt.Errorf("noise handshake failed: %v", err)
+			}
+			if peerStatic != nil && hs.PeerStatic() != nil && !bytes.Equal(hs.PeerStatic(), peerStatic) {
+				return nil, errors.New("noise handshake failed: unexpected peer key")
+			}
+		}
+	}
+
+	encryption, err := NewMultiLayerEncryptionFromNoise(cs1, cs2)
+	if err != nil {
+		return nil, err
+	}
+	return &NoiseSession{
+		Encryption: encryption,
+		PeerStatic: hs.PeerStatic(),
+		Transcript: append([]byte(pskProofLabel), hs.ChannelBinding()...),
+	}, nil
+}
+
+// NewMultiLayerEncryptionFromNoise keys the encryption layers with the
+// cipher states from a completed Noise handshake. Noise has already derived
+// independent keys, so no further key derivation is needed.
+func NewMultiLayerEncryptionFromNoise(cs1, cs2 *noise.CipherState) (*MultiLayerEncryption, error) {
+	if cs1 == nil || cs2 == nil {
+		return nil, errors.New("noise handshake is not complete")
+	}
+	chachaKey, aesKey := cs1.UnsafeKey(), cs2.UnsafeKey()
+	return newMultiLayerEncryption(chachaKey[:], aesKey[:])
+}
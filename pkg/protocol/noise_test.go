@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+// noiseResult is one side's outcome of a handshake
+type noiseResult struct {
+	session *NoiseSession
+	err     error
+}
+
+// runNoiseHandshake runs a handshake between a client and a server with
+// the given keys and prologues. The client pins pinned if it is set.
+func runNoiseHandshake(t *testing.T, client, server noise.DHKey, pinned, clientPrologue, serverPrologue []byte) (noiseResult, noiseResult) {
+	t.Helper()
+	a, b := memPair()
+	serverDone := make(chan noiseResult, 1)
+	go func() {
+		session, err := NoiseHandshake(b, false, server, nil, serverPrologue)
+		serverDone <- noiseResult{session, err}
+	}()
+	session, err := NoiseHandshake(a, true, client, pinned, clientPrologue)
+	if err != nil {
+		// The server waits for a message that will not come
+		a.Close()
+	}
+	return noiseResult{session, err}, <-serverDone
+}
+
+// noiseKey returns a new static key pair
+func noiseKey(t *testing.T) noise.DHKey {
+	t.Helper()
+	key, err := NoiseStaticKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNoiseHandshakeRoundTrip(t *testing.T) {
+	clientKey, serverKey := noiseKey(t), noiseKey(t)
+	client, server := runNoiseHandshake(t, clientKey, serverKey, serverKey.Public, []byte("hello"), []byte("hello"))
+	if client.err != nil || server.err != nil {
+		t.Fatalf("handshake failed: client %v, server %v", client.err, server.err)
+	}
+
+	// Each side learns the other's long-term key and the same transcript
+	if !bytes.Equal(client.session.PeerStatic, serverKey.Public) || !bytes.Equal(server.session.PeerStatic, clientKey.Public) {
+		t.Error("peer static keys not exchanged")
+	}
+	if !bytes.Equal(client.session.Transcript, server.session.Transcript) || !bytes.HasPrefix(client.session.Transcript, []byte(pskProofLabel)) {
+		t.Error("transcripts differ")
+	}
+
+	// Both sides derived the same keys
+	for _, direction := range []struct {
+		name     string
+		from, to *MultiLayerEncryption
+	}{
+		{"client to server", client.session.Encryption, server.session.Encryption},
+		{"server to client", server.session.Encryption, client.session.Encryption},
+	} {
+		ciphertext, err := direction.from.Encrypt([]byte("packet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := direction.to.Decrypt(ciphertext); err != nil || string(plaintext) != "packet" {
+			t.Errorf("%s: Decrypt() = %q, %v", direction.name, plaintext, err)
+		}
+	}
+
+	// Another handshake between the same keys gives other session keys
+	again, _ := runNoiseHandshake(t, clientKey, serverKey, nil, nil, nil)
+	ciphertext, _ := again.session.Encryption.Encrypt([]byte("packet"))
+	if _, err := server.session.Encryption.Decrypt(ciphertext); err == nil {
+		t.Error("packet of one session decrypted by another")
+	}
+}
+
+func TestNoiseHandshakeRejectsWrongStaticKey(t *testing.T) {
+	clientKey, serverKey, impostor := noiseKey(t), noiseKey(t), noiseKey(t)
+
+	// A client pinning the server's key refuses a server holding another
+	client, _ := runNoiseHandshake(t, clientKey, impostor, serverKey.Public, nil, nil)
+	if client.err == nil || !strings.Contains(client.err.Error(), "unexpected peer key") {
+		t.Errorf("handshake with the wrong server key: %v", client.err)
+	}
+
+	// A key pair whose halves do not match cannot complete the handshake
+	mismatched := noise.DHKey{Private: clientKey.Private, Public: impostor.Public}
+	client, server := runNoiseHandshake(t, mismatched, serverKey, nil, nil, nil)
+	if client.err == nil && server.err == nil {
+		t.Error("handshake with a mismatched key pair succeeded")
+	}
+
+	// Nor can sides that saw different negotiation in the clear
+	client, server = runNoiseHandshake(t, clientKey, serverKey, nil, []byte("hello"), []byte("tampered"))
+	if client.err == nil && server.err == nil {
+		t.Error("handshake with different prologues succeeded")
+	}
+}
+
+func TestNoiseStaticKeyFromWireGuardKey(t *testing.T) {
+	generated := noiseKey(t)
+	key, err := NoiseStaticKey(base64.StdEncoding.EncodeToString(generated.Private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Public, generated.Public) {
+		t.Error("public key not derived from the private key")
+	}
+
+	decoded, err := DecodeNoisePublicKey(EncodeNoisePublicKey(key.Public) + "\n")
+	if err != nil || !bytes.Equal(decoded, key.Public) {
+		t.Errorf("DecodeNoisePublicKey() = %x, %v", decoded, err)
+	}
+	if _, err := DecodeNoisePublicKey(base64.StdEncoding.EncodeToString(key.Public[:16])); err == nil {
+		t.Error("short public key accepted")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,8 +19,12 @@ type StealthProtocol struct {
 	hostHeaders   []string
 	fakeDomains   []string
 	tlsConfig     *tls.Config
-	minPadding    int
-	maxPadding    int
+	padding       *paddingBuckets
+	jitter        JitterProfile
+	timing        *timingProfile // nil to center delays on the RTT
+	jitterMin     time.Duration
+	jitterMax     time.Duration // 0 disables the delays
+	smoothedRTT   atomic.Int64 // nanoseconds, 0 until measured
 }
 
 // NewStealthProtocol creates a new stealth protocol instance
@@ -63,27 +68,46 @@ func NewStealthProtocol() *StealthProtocol {
 			SessionTicketsDisabled: true,
 			ClientSessionCache:     tls.NewLRUClientSessionCache(128),
 		},
-		minPadding: 16,
-		maxPadding: 1024,
+		padding:   &paddingBuckets{sizes: DefaultPaddingBuckets, weights: DefaultPaddingWeights},
+		jitter:    DefaultJitterProfile,
+		jitterMax: DefaultJitterMax,
 	}
 }
 
+// SetPaddingBuckets sets the frame sizes obfuscated packets are padded to and
+// how likely each one is, so the size distribution can match the service
+// being impersonated. It must be called before the protocol is in use.
+func (sp *StealthProtocol) SetPaddingBuckets(sizes []int, weights []float64) error {
+	padding, err := newPaddingBuckets(sizes, weights)
+	if err != nil {
+		return err
+	}
+	sp.padding = padding
+	return nil
+}
+
 // ObfuscatePacket disguises VPN data as regular HTTPS traffic
 func (sp *StealthProtocol) ObfuscatePacket(data []byte) ([]byte, error) {
-	// Add random padding to vary packet sizes
-	paddingSize := sp.randomInt(sp.minPadding, sp.maxPadding)
-	padding := make([]byte, paddingSize)
-	rand.Read(padding)
-	
+	return sp.obfuscate(nil, data, nil)
+}
+
+// ObfuscatePacketTo disguises VPN data as regular HTTPS traffic, writing the
+// frame into dst's storage
+func (sp *StealthProtocol) ObfuscatePacketTo(dst, data []byte) ([]byte, error) {
+	return sp.obfuscate(dst, data, nil)
+}
+
+// obfuscate builds the obfuscated frame in dst, adding extra headers to the fake request
+func (sp *StealthProtocol) obfuscate(dst, data []byte, extraHeaders map[string]string) ([]byte, error) {
 	// Create fake HTTP-like header
-	header := sp.createFakeHTTPHeader()
+	header := sp.createFakeHTTPHeader(extraHeaders)
 	
 	// Encode length and add magic bytes to look like WebSocket frame
 	lengthBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(lengthBytes, uint32(len(data)))
 	
 	// WebSocket-like frame structure with obfuscation
-	var buffer bytes.Buffer
+	buffer := bytes.NewBuffer(dst[:0])
 	buffer.Write([]byte(header))
 	buffer.Write([]byte("\r\n\r\n"))
 	
@@ -97,47 +121,61 @@ func (sp *StealthProtocol) ObfuscatePacket(data []byte) ([]byte, error) {
 	// Add obfuscated payload
 	buffer.Write(lengthBytes)
 	buffer.Write(data)
-	buffer.Write(padding)
 	
-	return buffer.Bytes(), nil
+	// Pad in place to a size drawn from the padding buckets
+	frame := buffer.Bytes()
+	payloadEnd := len(frame)
+	frame = append(frame, make([]byte, sp.padding.paddedSize(payloadEnd)-payloadEnd)...)
+	rand.Read(frame[payloadEnd:])
+	
+	return frame, nil
 }
 
 // DeobfuscatePacket extracts original data from obfuscated packet
 func (sp *StealthProtocol) DeobfuscatePacket(obfuscated []byte) ([]byte, error) {
-	// Find the end of HTTP headers
-	headerEnd := bytes.Index(obfuscated, []byte("\r\n\r\n"))
-	if headerEnd == -1 {
+	// Skip HTTP headers
+	payload, err := afterHeaders(obfuscated)
+	if err != nil {
 		return nil, fmt.Errorf("invalid packet format")
 	}
 	
-	// Skip HTTP headers and WebSocket handshake
-	payload := obfuscated[headerEnd+4:]
-	
-	// Find actual WebSocket upgrade response end
-	wsEnd := bytes.Index(payload, []byte("\r\n\r\n"))
-	if wsEnd == -1 {
+	// Skip the WebSocket upgrade response
+	payload, err = afterHeaders(payload)
+	if err != nil {
 		return nil, fmt.Errorf("invalid WebSocket format")
 	}
 	
-	payload = payload[wsEnd+4:]
-	
-	// Extract length
-	if len(payload) < 4 {
+	return readLengthPrefixed(payload)
+}
+
+// afterHeaders returns what follows the blank line ending a block of HTTP headers
+func afterHeaders(data []byte) ([]byte, error) {
+	_, rest, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found {
+		return nil, fmt.Errorf("headers not terminated")
+	}
+	return rest, nil
+}
+
+// readLengthPrefixed returns the data following a big-endian 32-bit length,
+// ignoring anything after it
+func readLengthPrefixed(data []byte) ([]byte, error) {
+	if len(data) < 4 {
 		return nil, fmt.Errorf("packet too short")
 	}
 	
-	length := binary.BigEndian.Uint32(payload[:4])
-	payload = payload[4:]
-	
-	if len(payload) < int(length) {
+	// Compare in 64 bits so large lengths can't wrap where int is 32 bits
+	length := uint64(binary.BigEndian.Uint32(data[:4]))
+	data = data[4:]
+	if uint64(len(data)) < length {
 		return nil, fmt.Errorf("incomplete packet")
 	}
 	
-	return payload[:length], nil
+	return data[:length], nil
 }
 
 // createFakeHTTPHeader generates realistic HTTP headers
-func (sp *StealthProtocol) createFakeHTTPHeader() string {
+func (sp *StealthProtocol) createFakeHTTPHeader(extraHeaders map[string]string) string {
 	userAgent := sp.userAgents[sp.randomInt(0, len(sp.userAgents)-1)]
 	host := sp.hostHeaders[sp.randomInt(0, len(sp.hostHeaders)-1)]
 	
@@ -155,6 +193,10 @@ func (sp *StealthProtocol) createFakeHTTPHeader() string {
 		"Cache-Control: no-cache",
 	}
 	
+	for name, value := range extraHeaders {
+		headers = append(headers, fmt.Sprintf("%s: %s", name, value))
+	}
+	
 	return strings.Join(headers, "\r\n")
 }
 
@@ -177,15 +219,18 @@ func (sp *StealthProtocol) randomInt(min, max int) int {
 	return min + int(n.Int64())
 }
 
-// AddTimingJitter adds random delays to avoid traffic analysis
+// AddTimingJitter adds random delays to avoid traffic analysis. See
+// JitterProfile for how they are drawn.
 func (sp *StealthProtocol) AddTimingJitter() {
-	jitter := time.Duration(sp.randomInt(10, 100)) * time.Millisecond
-	time.Sleep(jitter)
+	if delay := sp.jitterDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
 }
 
-// GetTLSConfig returns optimized TLS configuration for stealth
+// GetTLSConfig returns optimized TLS configuration for stealth. Each call
+// returns a copy, which the caller may set a server name on.
 func (sp *StealthProtocol) GetTLSConfig() *tls.Config {
-	return sp.tlsConfig
+	return sp.tlsConfig.Clone()
 }
 
 // CreateWebSocketUpgradeRequest creates a legitimate-looking WebSocket upgrade request
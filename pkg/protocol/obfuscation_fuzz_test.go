@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzDeobfuscatePacket checks that arbitrary frames are rejected with an
+// error rather than a panic, and that obfuscated data always round-trips
+func FuzzDeobfuscatePacket(f *testing.F) {
+	sp := NewStealthProtocol()
+
+	for _, data := range [][]byte{nil, []byte("x"), bytes.Repeat([]byte{0xab}, 1400)} {
+		frame, err := sp.ObfuscatePacket(data)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+		f.Add(frame[:len(frame)/2])
+
+		// Corrupt the length field, which follows the second blank line
+		first := bytes.Index(frame, []byte("\r\n\r\n")) + 4
+		lengthAt := first + bytes.Index(frame[first:], []byte("\r\n\r\n")) + 4
+		for _, length := range []uint32{0, 1 << 16, 1<<31 - 1, 1 << 31, 1<<32 - 1} {
+			corrupted := append([]byte(nil), frame...)
+			binary.BigEndian.PutUint32(corrupted[lengthAt:], length)
+			f.Add(corrupted)
+		}
+		f.Add(frame[:lengthAt+2])
+	}
+	f.Add([]byte{})
+	f.Add([]byte("\r\n\r\n"))
+	f.Add([]byte("\r\n\r\n\r\n\r\n"))
+	f.Add([]byte("\r\n\r\n\r\n\r\n\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		if data, err := sp.DeobfuscatePacket(frame); err == nil && len(data) > len(frame) {
+			t.Fatalf("extracted %d bytes from a %d-byte frame", len(data), len(frame))
+		}
+
+		obfuscated, err := sp.ObfuscatePacket(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := sp.DeobfuscatePacket(obfuscated)
+		if err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+		if !bytes.Equal(data, frame) {
+			t.Fatal("round trip changed the data")
+		}
+	})
+}
+
+// FuzzMultiLayerDecrypt checks that arbitrary ciphertexts are rejected with
+// an error rather than a panic, by both Decrypt and DecryptInPlace
+func FuzzMultiLayerDecrypt(f *testing.F) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	m, err := NewMultiLayerEncryption(key)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, plaintext := range [][]byte{nil, []byte("x"), bytes.Repeat([]byte{0xab}, 1400)} {
+		ciphertext, err := m.Encrypt(plaintext)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(ciphertext)
+		f.Add(ciphertext[:len(ciphertext)/2])
+		flipped := append([]byte(nil), ciphertext...)
+		flipped[len(flipped)-1] ^= 1
+		f.Add(flipped)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, 12))
+	f.Add(make([]byte, 28))
+
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		plaintext, err := m.Decrypt(ciphertext)
+		inPlace, inPlaceErr := m.DecryptInPlace(append([]byte(nil), ciphertext...))
+		if (err == nil) != (inPlaceErr == nil) {
+			t.Fatalf("Decrypt returned %v but DecryptInPlace %v", err, inPlaceErr)
+		}
+		if err == nil && !bytes.Equal(plaintext, inPlace) {
+			t.Fatal("Decrypt and DecryptInPlace disagree")
+		}
+	})
+}
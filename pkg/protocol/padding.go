@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// DefaultPaddingBuckets are the frame sizes padded to when none are
+// configured. Most frames land on a full-MTU size, as bulk HTTPS transfers do.
+// The fake HTTP headers take about 530 to 570 bytes, so 768 is the smallest size
+// worth having: it fits a frame carrying an ACK or a DNS query, which
+// would otherwise be padded to at least 1 KiB.
+var (
+	DefaultPaddingBuckets = []int{768, 1024, 1500, 2048, 3072, 4096}
+	DefaultPaddingWeights = []float64{0.3, 0.1, 0.35, 0.1, 0.1, 0.05}
+)
+
+// paddingBuckets picks the size an obfuscated frame is padded to
+type paddingBuckets struct {
+	sizes   []int // ascending
+	weights []float64
+}
+
+// newPaddingBuckets validates sizes and their weights. With no weights every
+// bucket is equally likely.
+func newPaddingBuckets(sizes []int, weights []float64) (*paddingBuckets, error) {
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no padding buckets")
+	}
+	if weights == nil {
+		weights = make([]float64, len(sizes))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(sizes) {
+		return nil, fmt.Errorf("%d padding buckets but %d weights", len(sizes), len(weights))
+	}
+
+	buckets := &paddingBuckets{
+		sizes:   append([]int(nil), sizes...),
+		weights: append([]float64(nil), weights...),
+	}
+	var total float64
+	for i, size := range buckets.sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid padding bucket size %d", size)
+		}
+		if buckets.weights[i] < 0 {
+			return nil, fmt.Errorf("negative weight for padding bucket %d", size)
+		}
+		total += buckets.weights[i]
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("padding bucket weights are all zero")
+	}
+	sort.Sort(buckets)
+	return buckets, nil
+}
+
+func (b *paddingBuckets) Len() int           { return len(b.sizes) }
+func (b *paddingBuckets) Less(i, j int) bool { return b.sizes[i] < b.sizes[j] }
+func (b *paddingBuckets) Swap(i, j int) {
+	b.sizes[i], b.sizes[j] = b.sizes[j], b.sizes[i]
+	b.weights[i], b.weights[j] = b.weights[j], b.weights[i]
+}
+
+// paddedSize samples a bucket that fits a frame of frameSize bytes, weighted
+// among the buckets large enough. Frames larger than every bucket are left
+// as they are.
+func (b *paddingBuckets) paddedSize(frameSize int) int {
+	// Sizes are ascending, so the buckets that fit are a suffix
+	first := sort.SearchInts(b.sizes, frameSize)
+
+	var total float64
+	for _, weight := range b.weights[first:] {
+		total += weight
+	}
+	if total == 0 {
+		return frameSize
+	}
+
+	target := randomFloat() * total
+	for i := first; i < len(b.sizes); i++ {
+		target -= b.weights[i]
+		if target < 0 {
+			return b.sizes[i]
+		}
+	}
+	// Rounding left target at or just above zero
+	for i := len(b.sizes) - 1; i >= first; i-- {
+		if b.weights[i] > 0 {
+			return b.sizes[i]
+		}
+	}
+	return frameSize
+}
+
+// randomFloat returns a uniformly distributed float in [0, 1)
+func randomFloat() float64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return float64(binary.BigEndian.Uint64(buf[:])>>11) / (1 << 53)
+}
+
+// CalibratePaddingBuckets chooses count bucket sizes that cover every
+// observed frame size with the least total padding, and weights each bucket
+// by the share of frames that would be padded to it. Padding frames to the
+// result reproduces the observed size distribution as closely as count
+// buckets allow.
+func CalibratePaddingBuckets(frameSizes []int, count int) ([]int, []float64, error) {
+	if len(frameSizes) == 0 {
+		return nil, nil, fmt.Errorf("no frame sizes to calibrate from")
+	}
+	if count <= 0 {
+		return nil, nil, fmt.Errorf("invalid bucket count %d", count)
+	}
+
+	// Histogram of distinct sizes, ascending
+	counts := make(map[int]int)
+	for _, size := range frameSizes {
+		counts[size]++
+	}
+	sizes := make([]int, 0, len(counts))
+	for size := range counts {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	if count > len(sizes) {
+		count = len(sizes)
+	}
+	n := len(sizes)
+
+	// Prefix sums give the padding cost of padding sizes[i..j] up to sizes[j]
+	// in constant time: frames*sizes[j] - bytes
+	frames := make([]int64, n+1)
+	bytes := make([]int64, n+1)
+	for i, size := range sizes {
+		frames[i+1] = frames[i] + int64(counts[size])
+		bytes[i+1] = bytes[i] + int64(counts[size])*int64(size)
+	}
+	cost := func(i, j int) int64 {
+		return (frames[j+1]-frames[i])*int64(sizes[j]) - (bytes[j+1] - bytes[i])
+	}
+
+	// best[k][j] is the least padding covering sizes[0..j] with k+1 buckets,
+	// the last of which is sizes[j]; from[k][j] is where that bucket starts
+	best := make([][]int64, count)
+	from := make([][]int, count)
+	for k := range best {
+		best[k] = make([]int64, n)
+		from[k] = make([]int, n)
+		for j := range best[k] {
+			if k == 0 {
+				best[k][j] = cost(0, j)
+				continue
+			}
+			best[k][j] = -1
+			for i := k; i <= j; i++ {
+				c := best[k-1][i-1] + cost(i, j)
+				if best[k][j] < 0 || c < best[k][j] {
+					best[k][j], from[k][j] = c, i
+				}
+			}
+		}
+	}
+
+	// Walk back from the largest size, which always closes the last bucket
+	buckets := make([]int, count)
+	weights := make([]float64, count)
+	j := n - 1
+	for k := count - 1; k >= 0; k-- {
+		start := 0
+		if k > 0 {
+			start = from[k][j]
+		}
+		buckets[k] = sizes[j]
+		weights[k] = float64(frames[j+1]-frames[start]) / float64(frames[n])
+		j = start - 1
+	}
+	return buckets, weights, nil
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewPaddingBucketsRejectsInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sizes   []int
+		weights []float64
+	}{
+		"no buckets":      {nil, nil},
+		"weight count":    {[]int{512, 1024}, []float64{1}},
+		"zero size":       {[]int{0, 1024}, nil},
+		"negative weight": {[]int{512, 1024}, []float64{1, -1}},
+		"all zero":        {[]int{512, 1024}, []float64{0, 0}},
+	} {
+		if _, err := newPaddingBuckets(tc.sizes, tc.weights); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestPaddedSizeFitsFrame(t *testing.T) {
+	buckets, err := newPaddingBuckets([]int{2048, 512, 1024}, []float64{1, 1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if size := buckets.paddedSize(600); size != 2048 {
+			t.Fatalf("600-byte frame padded to %d, want 2048, the only weighted bucket that fits", size)
+		}
+	}
+	if size := buckets.paddedSize(3000); size != 3000 {
+		t.Errorf("frame larger than every bucket padded to %d", size)
+	}
+}
+
+func TestDefaultPaddingFitsSmallPackets(t *testing.T) {
+	sp := NewStealthProtocol()
+	// A 40-byte ACK once both encryption layers are added
+	ack := make([]byte, 40+57)
+	smallest := false
+	for i := 0; i < 200; i++ {
+		frame, err := sp.ObfuscatePacket(ack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(DefaultPaddingBuckets, len(frame)) {
+			t.Fatalf("frame of %d bytes is not a bucket size", len(frame))
+		}
+		smallest = smallest || len(frame) == DefaultPaddingBuckets[0]
+	}
+	if !smallest {
+		t.Errorf("no ACK was padded to the smallest bucket, %d bytes", DefaultPaddingBuckets[0])
+	}
+}
+
+func TestCalibratePaddingBuckets(t *testing.T) {
+	sizes := []int{100, 100, 120, 1400, 1500, 1500}
+	buckets, weights, err := CalibratePaddingBuckets(sizes, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(buckets, []int{120, 1500}) || !slices.Equal(weights, []float64{0.5, 0.5}) {
+		t.Errorf("calibrated %v %v, want [120 1500] [0.5 0.5]", buckets, weights)
+	}
+	if _, _, err := CalibratePaddingBuckets(nil, 2); err == nil {
+		t.Error("calibrated from no frames")
+	}
+}
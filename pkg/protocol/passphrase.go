@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Minimum Argon2id parameters, after the OWASP recommendation. Weaker
+// settings are rejected rather than silently raised, since the server and
+// clients must derive the same key.
+const (
+	MinPassphraseMemoryKiB = 19 * 1024
+	MinPassphraseTime      = 2
+	MinPassphraseSaltSize  = 16
+)
+
+// Defaults for Argon2id parameters left at zero
+const (
+	DefaultPassphraseMemoryKiB = 64 * 1024
+	DefaultPassphraseTime      = 3
+	DefaultPassphraseThreads   = 4
+)
+
+// PassphraseKDF configures stretching a passphrase used as the pre-shared key
+// into the 32-byte master key with Argon2id. Server and clients need the same
+// settings.
+type PassphraseKDF struct {
+	Salt      string `json:"salt"`       // base64, at least 16 bytes
+	MemoryKiB uint32 `json:"memory_kib"` // default 64 MiB
+	Time      uint32 `json:"time"`       // passes over memory, default 3
+	Threads   uint8  `json:"threads"`    // default 4
+}
+
+// DeriveKey stretches passphrase into a 32-byte key
+func (p *PassphraseKDF) DeriveKey(passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passphrase salt: %v", err)
+	}
+	if len(salt) < MinPassphraseSaltSize {
+		return nil, fmt.Errorf("passphrase salt is %d bytes, need at least %d", len(salt), MinPassphraseSaltSize)
+	}
+
+	memory, time, threads := p.MemoryKiB, p.Time, p.Threads
+	if memory == 0 {
+		memory = DefaultPassphraseMemoryKiB
+	}
+	if time == 0 {
+		time = DefaultPassphraseTime
+	}
+	if threads == 0 {
+		threads = DefaultPassphraseThreads
+	}
+	if memory < MinPassphraseMemoryKiB {
+		return nil, fmt.Errorf("passphrase memory_kib %d is below the minimum of %d", memory, MinPassphraseMemoryKiB)
+	}
+	if time < MinPassphraseTime {
+		return nil, fmt.Errorf("passphrase time %d is below the minimum of %d", time, MinPassphraseTime)
+	}
+
+	return argon2.IDKey([]byte(passphrase), salt, time, memory, threads, 32), nil
+}
+
+// MasterKey returns the key material for NewMultiLayerEncryption: the
+// pre-shared key itself, or the key stretched from it when kdf is set
+func MasterKey(preSharedKey string, kdf *PassphraseKDF) ([]byte, error) {
+	if kdf == nil {
+		return []byte(preSharedKey), nil
+	}
+	return kdf.DeriveKey(preSharedKey)
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// testPassphraseKDF returns the cheapest settings accepted
+func testPassphraseKDF(salt byte) *PassphraseKDF {
+	return &PassphraseKDF{
+		Salt:      base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{salt}, MinPassphraseSaltSize)),
+		MemoryKiB: MinPassphraseMemoryKiB,
+		Time:      MinPassphraseTime,
+		Threads:   1,
+	}
+}
+
+func TestMasterKeyFromPassphrase(t *testing.T) {
+	key, err := MasterKey("correct horse battery staple", testPassphraseKDF(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := MasterKey("correct horse battery staple", testPassphraseKDF(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || !bytes.Equal(key, again) {
+		t.Fatal("passphrase did not stretch to the same 32-byte key twice")
+	}
+
+	other, err := MasterKey("correct horse battery staple", testPassphraseKDF(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, other) {
+		t.Error("salt did not change the key")
+	}
+
+	raw, err := MasterKey("correct horse battery staple", nil)
+	if err != nil || string(raw) != "correct horse battery staple" {
+		t.Errorf("key without a KDF = %q, %v, want the key itself", raw, err)
+	}
+}
+
+func TestPassphraseKDFRejectsWeakSettings(t *testing.T) {
+	for name, modify := range map[string]func(*PassphraseKDF){
+		"salt not base64": func(p *PassphraseKDF) { p.Salt = "not base64!" },
+		"short salt":      func(p *PassphraseKDF) { p.Salt = base64.StdEncoding.EncodeToString([]byte("short")) },
+		"little memory":   func(p *PassphraseKDF) { p.MemoryKiB = MinPassphraseMemoryKiB - 1 },
+		"one pass":        func(p *PassphraseKDF) { p.Time = 1 },
+	} {
+		kdf := testPassphraseKDF(1)
+		modify(kdf)
+		if _, err := kdf.DeriveKey("passphrase"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
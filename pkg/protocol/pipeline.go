@@ -0,0 +1,80 @@
+package protocol
+
+// orderedPipelineDepth is how many of a session's packets may be in flight
+// at once; receiving more waits for the oldest to be delivered
+const orderedPipelineDepth = 128
+
+// PacketWorkers is a fixed set of goroutines, shared by every session, that
+// undo the encryption and obfuscation of received packets
+type PacketWorkers struct {
+	jobs chan func()
+}
+
+// NewPacketWorkers starts workers goroutines, which run for the life of
+// the process
+func NewPacketWorkers(workers int) *PacketWorkers {
+	w := &PacketWorkers{jobs: make(chan func(), workers*orderedPipelineDepth)}
+	for range workers {
+		go func() {
+			for job := range w.jobs {
+				job()
+			}
+		}()
+	}
+	return w
+}
+
+// OrderedPipeline processes one session's packets on PacketWorkers and
+// delivers them in the order they were received, so a session's packets
+// reach the TUN interface in order however the work was spread out
+type OrderedPipeline struct {
+	workers   *PacketWorkers
+	pending   chan *orderedJob // in submission order
+	delivered chan struct{}    // closed once Close has delivered everything
+}
+
+// orderedJob is a packet in flight through a pipeline
+type orderedJob struct {
+	deliver func()
+	ready   chan struct{} // closed once deliver is set
+}
+
+// NewOrderedPipeline creates a pipeline running on workers
+func NewOrderedPipeline(workers *PacketWorkers) *OrderedPipeline {
+	p := &OrderedPipeline{
+		workers:   workers,
+		pending:   make(chan *orderedJob, orderedPipelineDepth),
+		delivered: make(chan struct{}),
+	}
+	go p.deliverLoop()
+	return p
+}
+
+// Submit runs work on a worker, then the function it returns, if not nil,
+// after those of every earlier submission. Submit must not be called from
+// several goroutines, nor after Close.
+func (p *OrderedPipeline) Submit(work func() func()) {
+	job := &orderedJob{ready: make(chan struct{})}
+	p.pending <- job
+	p.workers.jobs <- func() {
+		job.deliver = work()
+		close(job.ready)
+	}
+}
+
+// deliverLoop runs each job's delivery in submission order
+func (p *OrderedPipeline) deliverLoop() {
+	defer close(p.delivered)
+	for job := range p.pending {
+		<-job.ready
+		if job.deliver != nil {
+			job.deliver()
+		}
+	}
+}
+
+// Close waits for every submitted packet to be delivered
+func (p *OrderedPipeline) Close() {
+	close(p.pending)
+	<-p.delivered
+}
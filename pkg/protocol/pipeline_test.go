@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrderedPipelineDeliversInOrder(t *testing.T) {
+	workers := NewPacketWorkers(4)
+	p := NewOrderedPipeline(workers)
+
+	var delivered []int
+	for i := 0; i < 500; i++ {
+		p.Submit(func() func() {
+			// Early packets take longest, so workers finish out of order
+			if i%50 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if i%7 == 0 {
+				return nil // dropped, as a packet that fails to decrypt
+			}
+			return func() { delivered = append(delivered, i) }
+		})
+	}
+	p.Close()
+
+	want := 0
+	for _, i := range delivered {
+		if want%7 == 0 {
+			want++
+		}
+		if i != want {
+			t.Fatalf("delivered %d, want %d", i, want)
+		}
+		want++
+	}
+	if want != 500 {
+		t.Errorf("delivered up to %d before Close returned, want all 500", want)
+	}
+}
+
+func TestOrderedPipelinesShareWorkers(t *testing.T) {
+	workers := NewPacketWorkers(2)
+	a, b := NewOrderedPipeline(workers), NewOrderedPipeline(workers)
+
+	// A session whose packets are slow to process does not hold up another
+	release := make(chan struct{})
+	a.Submit(func() func() {
+		<-release
+		return nil
+	})
+	done := make(chan struct{})
+	b.Submit(func() func() { return func() { close(done) } })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("one session's packet waited on another's")
+	}
+	close(release)
+	a.Close()
+	b.Close()
+}
@@ -1,15 +1,272 @@
 package protocol
 
+import (
+	"crypto/rand"
+	"fmt"
+)
+
 // MessageType represents the type of message being sent
 type MessageType string
 
 const (
 	// PacketType represents a VPN packet message
 	PacketType MessageType = "packet"
+	// KeyExchangeType represents a handshake message
+	KeyExchangeType MessageType = "key_exchange"
+	// SessionTokenType carries an encrypted session token for fast reconnection
+	SessionTokenType MessageType = "session_token"
+	// SessionResumedType tells the client its session was resumed without a key exchange
+	SessionResumedType MessageType = "session_resumed"
+	// HelloType opens a session on a connectionless transport
+	HelloType MessageType = "hello"
+	// StreamOpenType asks the server to open a TCP connection or UDP association for the client
+	StreamOpenType MessageType = "stream_open"
+	// StreamOpenedType answers a StreamOpenType; Error is set if the open failed
+	StreamOpenedType MessageType = "stream_opened"
+	// StreamDataType carries bytes for an open stream, or one datagram for a UDP association
+	StreamDataType MessageType = "stream_data"
+	// StreamCloseType closes a stream from either side
+	StreamCloseType MessageType = "stream_close"
+	// HealthCheckType asks the server to confirm the tunnel is alive
+	HealthCheckType MessageType = "health_check"
+	// HealthCheckAckType answers a HealthCheckType
+	HealthCheckAckType MessageType = "health_check_ack"
+	// TunnelConfigType tells the client its tunnel addresses and DNS servers
+	TunnelConfigType MessageType = "tunnel_config"
+	// AuthType carries the user's credentials, encrypted with the session key
+	AuthType MessageType = "auth"
+	// AuthResultType answers an AuthType; Error is set if it was rejected
+	AuthResultType MessageType = "auth_result"
+	// QuotaExceededType tells the client it has used up its data quota; the
+	// server then closes the session and refuses new ones until it is reset
+	QuotaExceededType MessageType = "quota_exceeded"
+	// SessionLimitType tells the client its user already holds as many
+	// sessions as it may; the server then closes the session
+	SessionLimitType MessageType = "session_limit"
+	// WebRTCOfferType carries the server's SDP offer for the WebRTC transport
+	WebRTCOfferType MessageType = "webrtc_offer"
+	// WebRTCAnswerType carries the client's SDP answer
+	WebRTCAnswerType MessageType = "webrtc_answer"
+	// PathTokenType carries the encrypted token with which a multipath
+	// client bonds further connections into its session
+	PathTokenType MessageType = "path_token"
+	// PathJoinedType tells the client a connection joined its session
+	PathJoinedType MessageType = "path_joined"
+	// RekeyType carries a public key that starts or answers a rekey of the
+	// session's encryption, in Data; an empty one confirms the switch
+	RekeyType MessageType = "rekey"
+	// PeerCandidatesType carries the public UDP endpoints of one client to
+	// another, relayed by the server, so the two can try a direct tunnel
+	PeerCandidatesType MessageType = "peer_candidates"
+	// PeerRelayType carries a frame between two clients, encrypted end to
+	// end, when they cannot reach each other directly
+	PeerRelayType MessageType = "peer_relay"
+)
+
+const (
+	// SessionTokenSize is the length of a session token in bytes
+	SessionTokenSize = 32
+	// ResumeSecretSize is the length of the secret issued with a session
+	// token, from which a resumed session's keys are derived
+	ResumeSecretSize = 32
+	// ResumeNonceSize is the length of the server's nonce that makes each
+	// resumed session's keys fresh
+	ResumeNonceSize = 32
+	// SessionCookieName is the cookie that carries a session token in the WebSocket upgrade request
+	SessionCookieName = "sid"
+	// PathTokenSize is the length of a multipath token in bytes
+	PathTokenSize = 32
+	// PathCookieName is the cookie that carries a multipath token in the
+	// upgrade request of a connection joining a session
+	PathCookieName = "pid"
+	// ProtocolVersion is the version of the handshake and of the key
+	// derivation, the "v1" in the HKDF labels. Peers from before versions
+	// were sent are version 0; their keys are derived differently, so the
+	// two cannot talk to each other.
+	ProtocolVersion = 1
 )
 
+// CheckProtocolVersion returns an error naming both versions when the
+// peer, "server" or "client", speaks another version of the protocol than
+// this one, rather than letting the first message fail to decrypt
+func CheckProtocolVersion(peer string, version int) error {
+	if version == ProtocolVersion {
+		return nil
+	}
+	return fmt.Errorf("%s speaks protocol version %d and this side %d; upgrade the older one", peer, version, ProtocolVersion)
+}
+
 // Message represents a message sent between client and server
 type Message struct {
 	Type MessageType `json:"type"`
 	Data []byte     `json:"data"`
-} 
\ No newline at end of file
+	// StreamID, Network, Target and Error are used by the stream message types
+	StreamID uint32 `json:"stream_id,omitempty"`
+	Network  string `json:"network,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// IsControlMessage reports whether a decrypted tunnel payload is a JSON
+// Message rather than an IP packet. IP packets start with a version nibble
+// of 4 or 6, so a leading '{' can never be mistaken for one.
+func IsControlMessage(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == '{'
+}
+
+// KeyExchangeMessage is sent by both sides during the handshake. The server
+// lists the compression algorithms it accepts; the client answers with the
+// one it picked.
+type KeyExchangeMessage struct {
+	Type        MessageType            `json:"type"`
+	PublicKey   []byte                 `json:"public_key"`
+	Compression []CompressionAlgorithm `json:"compression,omitempty"`
+	// Version is the ProtocolVersion of the sender, checked by the other side
+	Version int `json:"version,omitempty"`
+	// SessionResumption is set by the server when a session token follows the handshake
+	SessionResumption bool `json:"session_resumption,omitempty"`
+	// Batching is offered by a server that reads batches of frames and set
+	// in the client's reply when its frames will arrive batched
+	Batching bool `json:"batching,omitempty"`
+	// AuthRequired is set by the server when the client must send an
+	// AuthRequest before the session starts
+	AuthRequired bool `json:"auth_required,omitempty"`
+	// KeyID is sent by the client to name the pre-shared key its proof uses,
+	// so the server can accept old and new keys while they are rotated
+	KeyID string `json:"key_id,omitempty"`
+	// ResumeNonce is sent with SessionResumedType to derive the resumed
+	// session's keys
+	ResumeNonce []byte `json:"resume_nonce,omitempty"`
+	// Noise is offered by a server that accepts a Noise_XX handshake and
+	// set in the client's reply, instead of a public key, when one follows
+	Noise bool `json:"noise,omitempty"`
+	// Multipath is offered by a server that lets clients bond several
+	// connections into one session and set in the client's reply when it
+	// will open more
+	Multipath bool `json:"multipath,omitempty"`
+	// Ciphers lists the single ciphers a server lets clients use instead of
+	// both layers; the client's reply names the one it picked, if any
+	Ciphers []string `json:"ciphers,omitempty"`
+	// PublicIP is sent by a client that asked a STUN server for its public
+	// address, for servers that only see a CDN's
+	PublicIP string `json:"public_ip,omitempty"`
+}
+
+// SessionStats describes the traffic of one session. BytesIn and BytesOut
+// are counted by the server.
+type SessionStats struct {
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// LatencyMs is the round-trip time of the last health check, measured by the client
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
+
+// HealthCheck is sent by the client through the tunnel
+type HealthCheck struct {
+	Type      MessageType `json:"type"`
+	Timestamp int64       `json:"timestamp"` // client clock, unix nanoseconds
+}
+
+// HealthCheckAck answers a HealthCheck with the server's clock and its view
+// of the session
+type HealthCheckAck struct {
+	Type      MessageType  `json:"type"`
+	Echo      int64        `json:"echo"`      // timestamp of the health check being answered
+	Timestamp int64        `json:"timestamp"` // server clock, unix nanoseconds
+	Stats     SessionStats `json:"stats"`
+}
+
+// SessionLimit is sent with SessionLimitType
+type SessionLimit struct {
+	Type   MessageType `json:"type"`
+	Active int         `json:"active"` // sessions the user holds
+	Max    int         `json:"max"`    // sessions the user may hold
+	Error  string      `json:"error"`
+}
+
+// MaxPeerCandidates is how many endpoints a PeerCandidates message may list
+const MaxPeerCandidates = 8
+
+// PeerCandidates is sent by a client wanting a direct tunnel to the client
+// at tunnel address Peer. The server relays it to that client with Peer
+// set to the sender's tunnel address, and the answer comes back the same
+// way. Each side then punches holes towards the other's candidates over
+// the UDP transport. PublicKey is the sender's X25519 key for the
+// end-to-end encryption between the two.
+type PeerCandidates struct {
+	Type       MessageType `json:"type"`
+	Peer       string      `json:"peer"`
+	Candidates []string    `json:"candidates"`         // host:port, most preferred first
+	NATType    string      `json:"nat_type,omitempty"` // as classified by the nat package
+	PublicKey  []byte      `json:"public_key"`
+}
+
+// PeerRelay carries a frame for the client at tunnel address Peer, which
+// the server relays with Peer set to the sender's tunnel address. Data is
+// encrypted with the key the two clients agreed through PeerCandidates, so
+// the server cannot read it.
+type PeerRelay struct {
+	Type MessageType `json:"type"`
+	Peer string      `json:"peer"`
+	Data []byte      `json:"data"`
+}
+
+// TunnelConfig is sent by the server once a session is registered
+type TunnelConfig struct {
+	Type MessageType `json:"type"`
+	IPv4 string      `json:"ipv4"`
+	IPv6 string      `json:"ipv6"`
+	// DNS lists the resolvers clients should use; when the server runs its
+	// DNS proxy this is its own tunnel address, so queries stay in the tunnel
+	DNS []string `json:"dns,omitempty"`
+	// Routes lists the networks, in CIDR notation, to send through the tunnel
+	Routes []string `json:"routes,omitempty"`
+}
+
+// DefaultTunnelRoutes send all traffic through the tunnel
+var DefaultTunnelRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// MergeTunnelConfig returns the settings a client should use: what the
+// server pushed, falling back to local for anything it did not push and to
+// DefaultTunnelRoutes if neither sets routes. pushed may be nil.
+func MergeTunnelConfig(pushed *TunnelConfig, local TunnelConfig) TunnelConfig {
+	merged := local
+	if pushed != nil {
+		if pushed.IPv4 != "" {
+			merged.IPv4 = pushed.IPv4
+		}
+		if pushed.IPv6 != "" {
+			merged.IPv6 = pushed.IPv6
+		}
+		if len(pushed.DNS) > 0 {
+			merged.DNS = pushed.DNS
+		}
+		if len(pushed.Routes) > 0 {
+			merged.Routes = pushed.Routes
+		}
+	}
+	if len(merged.Routes) == 0 {
+		merged.Routes = DefaultTunnelRoutes
+	}
+	return merged
+}
+
+// AuthRequest holds the user's credentials. It is marshalled, encrypted
+// with the session key and sent as the Data of an AuthType message.
+type AuthRequest struct {
+	Type     MessageType `json:"type"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	OTP      string      `json:"otp,omitempty"` // one-time code from an authenticator app
+	// PSKProof is PSKProof over the HandshakeTranscript of this key exchange
+	PSKProof []byte `json:"psk_proof,omitempty"`
+}
+
+// NewSessionToken generates a random session token
+func NewSessionToken() ([]byte, error) {
+	token := make([]byte, SessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckProtocolVersion(t *testing.T) {
+	if err := CheckProtocolVersion("server", ProtocolVersion); err != nil {
+		t.Errorf("same version rejected: %v", err)
+	}
+	err := CheckProtocolVersion("server", 0)
+	if err == nil || !strings.Contains(err.Error(), "server speaks protocol version 0") {
+		t.Errorf("CheckProtocolVersion(0) = %v, want the versions named", err)
+	}
+}
+
+func TestKeyExchangeTranscript(t *testing.T) {
+	// The hello has room to spare, as a reused buffer would
+	hello := make([]byte, 0, 64)
+	hello = append(hello, `{"type":"key_exchange"}`...)
+	reply := []byte(`{"public_key":"AAAA"}`)
+
+	transcript := KeyExchangeTranscript(hello, reply)
+	if want := `{"type":"key_exchange"}{"public_key":"AAAA"}`; string(transcript) != want {
+		t.Errorf("transcript = %s, want %s", transcript, want)
+	}
+
+	// Neither the hello nor its spare room is written to
+	transcript[0] = 'X'
+	if string(hello) != `{"type":"key_exchange"}` {
+		t.Errorf("hello changed to %s", hello)
+	}
+	if spare := hello[len(hello) : len(hello)+len(reply)]; !bytes.Equal(spare, make([]byte, len(reply))) {
+		t.Errorf("reply appended into the hello's spare room: %q", spare)
+	}
+}
+
+func TestSharedSecretBoundToTranscript(t *testing.T) {
+	server, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := server.ComputeSharedSecret(client.GetPublicKey(), []byte("hello reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := client.ComputeSharedSecret(server.GetPublicKey(), []byte("hello reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverKey, clientKey) {
+		t.Fatal("the two sides derived different keys from the same handshake")
+	}
+
+	tampered, err := client.ComputeSharedSecret(server.GetPublicKey(), []byte("hello tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(serverKey, tampered) {
+		t.Error("key did not change with the handshake")
+	}
+	if _, err := client.ComputeSharedSecret([]byte("short"), nil); err == nil {
+		t.Error("accepted a peer key of the wrong length")
+	}
+}
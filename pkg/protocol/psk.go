@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// PSKEnvVar supplies the pre-shared key without writing it to a config
+	// file or a command line
+	PSKEnvVar = "STEALTHVPN_PSK"
+	// MinPreSharedKeyLength is the shortest pre-shared key accepted
+	MinPreSharedKeyLength = 16
+)
+
+// ResolvePreSharedKey returns the pre-shared key from the first source that
+// sets one: the STEALTHVPN_PSK environment variable, keyFile, then the inline
+// value from the config. Trailing whitespace is trimmed from the file, and
+// missing or short keys are rejected.
+func ResolvePreSharedKey(inline, keyFile string) (string, error) {
+	key, source := inline, "pre_shared_key"
+
+	if env := os.Getenv(PSKEnvVar); env != "" {
+		key, source = env, PSKEnvVar
+	} else if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read pre-shared key file: %v", err)
+		}
+		key, source = strings.TrimRight(string(data), " \t\r\n"), keyFile
+	}
+
+	if key == "" {
+		return "", errors.New("no pre-shared key: set " + PSKEnvVar + ", a key file or pre_shared_key")
+	}
+	if len(key) < MinPreSharedKeyLength {
+		return "", fmt.Errorf("pre-shared key from %s is too short: %d bytes, need at least %d", source, len(key), MinPreSharedKeyLength)
+	}
+	return key, nil
+}
+
+// pskProofLabel separates PSK proofs from other uses of the key
+const pskProofLabel = "StealthVPN-psk-proof"
+
+// HandshakeTranscript binds a PSK proof to one key exchange, so a proof
+// recorded from one session is useless in another
+func HandshakeTranscript(serverPublicKey, clientPublicKey []byte) []byte {
+	transcript := make([]byte, 0, len(pskProofLabel)+len(serverPublicKey)+len(clientPublicKey))
+	transcript = append(transcript, pskProofLabel...)
+	transcript = append(transcript, serverPublicKey...)
+	return append(transcript, clientPublicKey...)
+}
+
+// PSKProof proves knowledge of the pre-shared key material for transcript
+// without revealing it
+func PSKProof(masterKey, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
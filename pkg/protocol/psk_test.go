@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPSK = "0123456789abcdef0123456789abcdef"
+
+func TestResolvePreSharedKeySources(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "psk")
+	if err := os.WriteFile(keyFile, []byte("from-the-key-file-0123\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(PSKEnvVar, "")
+	if key, err := ResolvePreSharedKey(testPSK, ""); err != nil || key != testPSK {
+		t.Errorf("inline key resolved to %q, %v", key, err)
+	}
+	if key, err := ResolvePreSharedKey(testPSK, keyFile); err != nil || key != "from-the-key-file-0123" {
+		t.Errorf("key file resolved to %q, %v, want its trimmed contents ahead of the inline key", key, err)
+	}
+
+	t.Setenv(PSKEnvVar, "from-the-environment-0123")
+	if key, err := ResolvePreSharedKey(testPSK, keyFile); err != nil || key != "from-the-environment-0123" {
+		t.Errorf("environment resolved to %q, %v, want it ahead of the file", key, err)
+	}
+}
+
+func TestResolvePreSharedKeyRejects(t *testing.T) {
+	t.Setenv(PSKEnvVar, "")
+	if _, err := ResolvePreSharedKey("", ""); err == nil {
+		t.Error("missing key accepted")
+	}
+	if _, err := ResolvePreSharedKey("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing key file accepted")
+	}
+
+	_, err := ResolvePreSharedKey("short", "")
+	if err == nil || !strings.Contains(err.Error(), "pre_shared_key is too short") {
+		t.Errorf("short key error = %v, want the source named", err)
+	}
+	t.Setenv(PSKEnvVar, "short")
+	if _, err := ResolvePreSharedKey(testPSK, ""); err == nil || !strings.Contains(err.Error(), PSKEnvVar) {
+		t.Errorf("short environment key error = %v, want %s named", err, PSKEnvVar)
+	}
+}
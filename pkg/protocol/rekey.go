@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DefaultRekeyBytes and DefaultRekeyInterval are how much traffic and
+	// how long a session's keys protect before they are replaced
+	DefaultRekeyBytes    = 100 << 20
+	DefaultRekeyInterval = time.Hour
+	// encryptionKeyPhase is the bit of a ciphertext's format byte telling
+	// which of the two most recent sets of keys encrypted it
+	encryptionKeyPhase byte = 0x80
+	// chainKeySize is the length of the secret carried from one set of
+	// keys to the next
+	chainKeySize = 32
+)
+
+// errRekeyInProgress is returned when a rekey starts before the last ended
+var errRekeyInProgress = errors.New("rekey already in progress")
+
+// layerKeys are the engines of both layers for one key phase
+type layerKeys struct {
+	chacha *EncryptionEngine
+	aes    *AESEngine
+}
+
+// zeroize wipes the raw keys of both layers
+func (k *layerKeys) zeroize() {
+	k.chacha.Zeroize()
+	k.aes.Zeroize()
+}
+
+// Rekeying replaces a session's keys with ones from a fresh X25519
+// exchange, so keys taken from a long-lived session cannot decrypt what
+// was recorded before the exchange, nor what follows the next one. Each new
+// set of keys also depends on a chain key carried over from the last, so a
+// man in the middle holding the current keys cannot take over the exchange.
+//
+// The client starts a rekey by sending a RekeyType message with a new
+// public key. The server answers with its own, still under the old keys,
+// and keeps sending under them until traffic under the new keys arrives.
+// The client switches to the new keys on the answer and confirms with an
+// empty RekeyType message under them. Each side wipes the old keys once it
+// receives traffic under the new ones. Ciphertexts name their keys with
+// encryptionKeyPhase, so both sets decrypt during the switch.
+
+// newChainKey derives the first chain key from a session's layer keys,
+// which both sides hold
+func newChainKey(chachaKey, aesKey []byte) ([]byte, error) {
+	secret := append(append([]byte(nil), chachaKey...), aesKey...)
+	defer ZeroBytes(secret)
+	chainKey := make([]byte, chainKeySize)
+	kdf := hkdf.New(sha256.New, secret, []byte("StealthVPN-rekey"), []byte(labelChainKey))
+	if _, err := io.ReadFull(kdf, chainKey); err != nil {
+		return nil, err
+	}
+	return chainKey, nil
+}
+
+// StartRekey begins replacing the keys, returning the public key to send
+// to the peer in a RekeyType message
+func (m *MultiLayerEncryption) StartRekey() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pendingRekey != nil || m.keys[m.newest^1] != nil {
+		return nil, errRekeyInProgress
+	}
+	kx, err := NewKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	m.pendingRekey = kx
+	return kx.GetPublicKey(), nil
+}
+
+// AcceptRekey answers a rekey the peer started with peerPublicKey,
+// returning the public key to send back. The new keys decrypt at once, and
+// encrypt once the peer's traffic under them arrives.
+func (m *MultiLayerEncryption) AcceptRekey(peerPublicKey []byte) ([]byte, error) {
+	kx, err := NewKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	defer kx.Zeroize()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pendingRekey != nil || m.keys[m.newest^1] != nil {
+		return nil, errRekeyInProgress
+	}
+	if err := m.installRekey(kx, peerPublicKey); err != nil {
+		return nil, err
+	}
+	return kx.GetPublicKey(), nil
+}
+
+// FinishRekey completes a rekey started with StartRekey, given the peer's
+// answer, and switches to the new keys. The caller should then send an
+// empty RekeyType message, so the peer switches too.
+func (m *MultiLayerEncryption) FinishRekey(peerPublicKey []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kx := m.pendingRekey
+	if kx == nil {
+		return errors.New("no rekey in progress")
+	}
+	m.pendingRekey = nil
+	defer kx.Zeroize()
+
+	if err := m.installRekey(kx, peerPublicKey); err != nil {
+		return err
+	}
+	m.sendPhase = m.newest
+	return nil
+}
+
+// installRekey derives the next keys from the exchange and the chain key
+// and makes them the newest. m.mu must be held for writing.
+func (m *MultiLayerEncryption) installRekey(kx *KeyExchange, peerPublicKey []byte) error {
+	shared, err := kx.ComputeSharedSecret(peerPublicKey, nil)
+	if err != nil {
+		return err
+	}
+	defer ZeroBytes(shared)
+
+	material := make([]byte, 32+32+chainKeySize)
+	defer ZeroBytes(material)
+	kdf := hkdf.New(sha256.New, shared, m.chainKey, []byte(labelRekey))
+	if _, err := io.ReadFull(kdf, material); err != nil {
+		return err
+	}
+	chacha, err := NewEncryptionEngine(append([]byte(nil), material[:32]...))
+	if err != nil {
+		return err
+	}
+	aes, err := NewAESEngine(append([]byte(nil), material[32:64]...))
+	if err != nil {
+		return err
+	}
+
+	ZeroBytes(m.chainKey)
+	m.chainKey = append([]byte(nil), material[64:]...)
+	m.newest ^= 1
+	m.keys[m.newest] = &layerKeys{chacha: chacha, aes: aes}
+	m.keyedAt = time.Now()
+	m.processed.Store(0)
+	return nil
+}
+
+// peerSwitched notes that the peer sent a ciphertext under the keys of
+// phase. Once that is the newest keys, the peer has switched to them, so
+// this side does too and wipes the old ones. A packet still in flight
+// under the old keys is lost, as if dropped.
+func (m *MultiLayerEncryption) peerSwitched(phase int) {
+	m.mu.RLock()
+	switched := phase == m.newest && m.keys[phase^1] != nil
+	m.mu.RUnlock()
+	if !switched {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if phase != m.newest || m.keys[phase^1] == nil {
+		return
+	}
+	m.sendPhase = phase
+	m.keys[phase^1].zeroize()
+	m.keys[phase^1] = nil
+}
+
+// RekeyDue reports whether the keys have protected limit bytes or been in
+// use for interval, and no rekey is under way
+func (m *MultiLayerEncryption) RekeyDue(limit uint64, interval time.Duration) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.pendingRekey != nil || m.keys[m.newest^1] != nil {
+		return false
+	}
+	return m.processed.Load() >= limit || time.Since(m.keyedAt) >= interval
+}
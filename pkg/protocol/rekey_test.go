@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rekeyPair returns both ends of a session keyed alike
+func rekeyPair(t *testing.T) (*MultiLayerEncryption, *MultiLayerEncryption) {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewMultiLayerEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewMultiLayerEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// sealPhase encrypts payload and checks the key phase it names
+func sealPhase(t *testing.T, m *MultiLayerEncryption, payload string, wantPhase byte) []byte {
+	t.Helper()
+	ciphertext, err := m.Encrypt([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phase := ciphertext[0] & encryptionKeyPhase; phase != wantPhase {
+		t.Fatalf("%q encrypted under phase %#x, want %#x", payload, phase, wantPhase)
+	}
+	return ciphertext
+}
+
+// openCopy decrypts a copy of ciphertext, so it can be delivered again
+func openCopy(m *MultiLayerEncryption, ciphertext []byte) (string, error) {
+	plaintext, err := m.Decrypt(append([]byte(nil), ciphertext...))
+	return string(plaintext), err
+}
+
+// mustOpen fails unless ciphertext decrypts to want
+func mustOpen(t *testing.T, m *MultiLayerEncryption, ciphertext []byte, want string) {
+	t.Helper()
+	if got, err := openCopy(m, ciphertext); err != nil || got != want {
+		t.Fatalf("Decrypt() = %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestRekeySwitchesKeyPhase(t *testing.T) {
+	client, server := rekeyPair(t)
+	const oldPhase, newPhase = 0, encryptionKeyPhase
+
+	clientPublic, err := client.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateFromClient := sealPhase(t, client, "sent before the switch", oldPhase)
+
+	// The server answers under the old keys and keeps using them until the
+	// client's traffic under the new ones arrives
+	serverPublic, err := server.AcceptRekey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateFromServer := sealPhase(t, server, "answer", oldPhase)
+	mustOpen(t, client, lateFromServer, "answer")
+
+	// The client switches on the answer, and still opens the old phase
+	if err := client.FinishRekey(serverPublic); err != nil {
+		t.Fatal(err)
+	}
+	confirm := sealPhase(t, client, "confirm", newPhase)
+	mustOpen(t, client, lateFromServer, "answer")
+
+	// During the overlap the server opens both phases, and the old phase
+	// does not switch it
+	mustOpen(t, server, lateFromClient, "sent before the switch")
+	sealPhase(t, server, "still old", oldPhase)
+
+	// Traffic under the new keys switches the server, which then wipes the
+	// old ones
+	mustOpen(t, server, confirm, "confirm")
+	fromServer := sealPhase(t, server, "switched", newPhase)
+	if _, err := openCopy(server, lateFromClient); err == nil {
+		t.Error("server opened the old phase after the overlap")
+	}
+
+	// And likewise the client
+	mustOpen(t, client, fromServer, "switched")
+	if _, err := openCopy(client, lateFromServer); err == nil {
+		t.Error("client opened the old phase after the overlap")
+	}
+	sealPhase(t, client, "after", newPhase)
+
+	// The next rekey reuses the first phase bit, under keys the original
+	// ciphertexts do not open with
+	clientPublic, _ = client.StartRekey()
+	serverPublic, _ = server.AcceptRekey(clientPublic)
+	if err := client.FinishRekey(serverPublic); err != nil {
+		t.Fatal(err)
+	}
+	mustOpen(t, server, sealPhase(t, client, "third keys", oldPhase), "third keys")
+	if _, err := openCopy(server, lateFromClient); err == nil {
+		t.Error("ciphertext under the first keys opened by the third")
+	}
+}
+
+func TestRekeyOneAtATime(t *testing.T) {
+	client, server := rekeyPair(t)
+	if err := client.FinishRekey(make([]byte, 32)); err == nil {
+		t.Error("FinishRekey() without StartRekey() succeeded")
+	}
+
+	clientPublic, err := client.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StartRekey(); !errors.Is(err, errRekeyInProgress) {
+		t.Errorf("second StartRekey() error = %v, want %v", err, errRekeyInProgress)
+	}
+	if _, err := client.AcceptRekey(clientPublic); !errors.Is(err, errRekeyInProgress) {
+		t.Errorf("AcceptRekey() during own rekey error = %v, want %v", err, errRekeyInProgress)
+	}
+
+	// Until the peer's traffic under the new keys arrives, the old keys are
+	// still needed, so no other rekey may start
+	if _, err := server.AcceptRekey(clientPublic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.StartRekey(); !errors.Is(err, errRekeyInProgress) {
+		t.Errorf("StartRekey() during the overlap error = %v, want %v", err, errRekeyInProgress)
+	}
+	if server.RekeyDue(0, 0) {
+		t.Error("rekey due during the overlap")
+	}
+}
+
+func TestRekeyDue(t *testing.T) {
+	client, _ := rekeyPair(t)
+	if client.RekeyDue(1000, time.Hour) {
+		t.Error("rekey due before any traffic")
+	}
+	client.Encrypt(make([]byte, 1000))
+	if !client.RekeyDue(1000, time.Hour) {
+		t.Error("rekey not due after the byte limit")
+	}
+	if !client.RekeyDue(1<<30, 0) {
+		t.Error("rekey not due after the interval")
+	}
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import "time"
+
+const (
+	// reorderWindow is how many early datagrams are held while waiting for a gap to fill
+	reorderWindow = 64
+	// reorderTimeout is how long a gap may stay open before the datagrams
+	// missing from it are given up as lost
+	reorderTimeout = 50 * time.Millisecond
+)
+
+// reorderBuffer delivers datagrams in sequence order, holding early arrivals
+// until the gap before them fills. Duplicates and datagrams behind the
+// delivered sequence are dropped. A gap is treated as loss once it has been
+// open for the timeout, or once a full window of datagrams waits on it, so
+// a datagram that never arrives delays delivery only briefly.
+type reorderBuffer struct {
+	window  int
+	timeout time.Duration
+	next    uint64
+	pending map[uint64][]byte
+	// gapSince is when delivery started waiting on next, zero when nothing
+	// is held
+	gapSince time.Time
+}
+
+func newReorderBuffer(window int, timeout time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		window:  window,
+		timeout: timeout,
+		pending: make(map[uint64][]byte),
+	}
+}
+
+// push adds a datagram and returns those now deliverable, in order
+func (b *reorderBuffer) push(seq uint64, data []byte) [][]byte {
+	if seq < b.next {
+		return nil
+	}
+	if _, dup := b.pending[seq]; dup {
+		return nil
+	}
+	b.pending[seq] = data
+
+	if len(b.pending) > b.window {
+		b.skip()
+	}
+	return b.release(time.Now())
+}
+
+// expiry returns when the current gap times out, if datagrams are held
+func (b *reorderBuffer) expiry() (time.Time, bool) {
+	if len(b.pending) == 0 {
+		return time.Time{}, false
+	}
+	return b.gapSince.Add(b.timeout), true
+}
+
+// expire gives up on the current gap if it has timed out and returns the
+// datagrams deliverable after it
+func (b *reorderBuffer) expire(now time.Time) [][]byte {
+	if expiry, ok := b.expiry(); !ok || now.Before(expiry) {
+		return nil
+	}
+	b.skip()
+	return b.release(now)
+}
+
+// skip gives up on the missing datagrams before the lowest held one
+func (b *reorderBuffer) skip() {
+	lowest := uint64(0)
+	first := true
+	for seq := range b.pending {
+		if first || seq < lowest {
+			lowest = seq
+			first = false
+		}
+	}
+	if !first {
+		b.next = lowest
+	}
+}
+
+// release removes the datagrams that continue the sequence and restarts
+// the gap timer if delivery moved on to a new gap
+func (b *reorderBuffer) release(now time.Time) [][]byte {
+	var ready [][]byte
+	for {
+		data, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		delete(b.pending, b.next)
+		ready = append(ready, data)
+		b.next++
+	}
+
+	switch {
+	case len(b.pending) == 0:
+		b.gapSince = time.Time{}
+	case len(ready) > 0 || b.gapSince.IsZero():
+		b.gapSince = now
+	}
+	return ready
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+// frames returns the datagrams as strings
+func frames(datagrams [][]byte) []string {
+	var s []string
+	for _, d := range datagrams {
+		s = append(s, string(d))
+	}
+	return s
+}
+
+func TestReorderBufferHoldsUntilGapFills(t *testing.T) {
+	b := newReorderBuffer(4, time.Minute)
+	if got := frames(b.push(1, []byte("b"))); got != nil {
+		t.Fatalf("delivered %v past the gap", got)
+	}
+	if got := frames(b.push(1, []byte("b"))); got != nil {
+		t.Fatalf("delivered duplicate %v", got)
+	}
+	if got := frames(b.push(0, []byte("a"))); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("delivered %v, want [a b]", got)
+	}
+	if got := b.push(0, []byte("a")); got != nil {
+		t.Errorf("delivered %q behind the sequence", got)
+	}
+	if _, held := b.expiry(); held {
+		t.Error("gap timer running with nothing held")
+	}
+}
+
+func TestReorderBufferGivesUpOnGaps(t *testing.T) {
+	b := newReorderBuffer(4, time.Minute)
+	b.push(1, []byte("b"))
+	expiry, held := b.expiry()
+	if !held {
+		t.Fatal("no gap timer with a datagram held")
+	}
+	if got := b.expire(expiry.Add(-time.Millisecond)); got != nil {
+		t.Fatalf("gap given up early, delivering %q", got)
+	}
+	if got := frames(b.expire(expiry)); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("delivered %v once the gap timed out, want [b]", got)
+	}
+	// The datagram given up on is dropped if it turns up after all
+	if got := b.push(0, []byte("a")); got != nil {
+		t.Errorf("delivered %q after its gap was given up", got)
+	}
+
+	// A full window of datagrams waiting on one gap gives it up at once
+	for seq := uint64(3); seq < 7; seq++ {
+		if got := b.push(seq, []byte{byte('a' + seq)}); got != nil {
+			t.Fatalf("delivered %q before the window filled", got)
+		}
+	}
+	if got := frames(b.push(7, []byte("h"))); len(got) != 5 || got[0] != "d" || got[4] != "h" {
+		t.Errorf("delivered %v when the window overflowed, want [d e f g h]", got)
+	}
+}
+
+func TestReorderBufferRestartsTimerForNextGap(t *testing.T) {
+	b := newReorderBuffer(8, time.Minute)
+	b.push(1, []byte("b"))
+	b.push(3, []byte("d"))
+	first, _ := b.expiry()
+
+	// Filling the first gap moves delivery on to the second, which gets
+	// its own full timeout
+	time.Sleep(time.Millisecond)
+	b.push(0, []byte("a"))
+	second, held := b.expiry()
+	if !held || !second.After(first) {
+		t.Errorf("second gap expires at %v, want later than the first at %v", second, first)
+	}
+}
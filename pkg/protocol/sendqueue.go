@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy says what a SendQueue does with a packet when it is full
+type QueuePolicy string
+
+const (
+	// QueueBlock makes the producer wait for room, stalling the tunnel
+	// interface reads behind a slow peer
+	QueueBlock QueuePolicy = "block"
+	// QueueDropOldest discards the packet that has waited longest, keeping
+	// the queue fresh for latency-sensitive traffic
+	QueueDropOldest QueuePolicy = "drop-oldest"
+	// QueueDropNewest discards the arriving packet, as a router with a full
+	// queue does
+	QueueDropNewest QueuePolicy = "drop-newest"
+)
+
+// DefaultSendQueueSize is how many packets may wait to be sent to a peer
+const DefaultSendQueueSize = 256
+
+// ParseQueuePolicy checks a configured policy, defaulting to
+// QueueDropOldest
+func ParseQueuePolicy(policy string) (QueuePolicy, error) {
+	switch QueuePolicy(policy) {
+	case "":
+		return QueueDropOldest, nil
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+		return QueuePolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown send queue policy %q", policy)
+}
+
+// SendQueue is a bounded queue of packets between the goroutine reading
+// the tunnel interface and the one writing to the peer, so a slow peer or
+// link costs packets under a known policy instead of stalling the tunnel or
+// growing memory without limit. Packets are pooled buffers, owned by the
+// queue from Push until Pop hands them on.
+type SendQueue struct {
+	packets chan *[]byte
+	policy  QueuePolicy
+	dropped atomic.Uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSendQueue creates a queue holding up to size packets, DefaultSendQueueSize
+// if size is not positive
+func NewSendQueue(size int, policy QueuePolicy) *SendQueue {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	return &SendQueue{
+		packets: make(chan *[]byte, size),
+		policy:  policy,
+		done:    make(chan struct{}),
+	}
+}
+
+// Push queues buf, a buffer from GetPacketBuffer sliced to the packet,
+// and returns how many packets the policy dropped: buf itself or, with
+// QueueDropOldest, those it made room by discarding. Packets pushed once
+// the queue is closed are released and not counted.
+func (q *SendQueue) Push(buf *[]byte) (dropped int) {
+	select {
+	case <-q.done:
+		PutPacketBuffer(buf)
+		return 0
+	default:
+	}
+
+	switch q.policy {
+	case QueueBlock:
+		select {
+		case q.packets <- buf:
+		case <-q.done:
+			PutPacketBuffer(buf)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.packets <- buf:
+				q.dropped.Add(uint64(dropped))
+				return dropped
+			default:
+			}
+			// Make room, unless the writer just did
+			select {
+			case oldest := <-q.packets:
+				PutPacketBuffer(oldest)
+				dropped++
+			default:
+			}
+		}
+	default:
+		select {
+		case q.packets <- buf:
+		default:
+			PutPacketBuffer(buf)
+			dropped = 1
+		}
+	}
+	q.dropped.Add(uint64(dropped))
+	return dropped
+}
+
+// Pop waits for the next packet. The caller returns it with
+// PutPacketBuffer once sent. ok is false once the queue is closed.
+func (q *SendQueue) Pop() (buf *[]byte, ok bool) {
+	select {
+	case buf = <-q.packets:
+		return buf, true
+	case <-q.done:
+		return nil, false
+	}
+}
+
+// Close stops the queue, releasing the packets still waiting and any
+// producer blocked in Push. Later pushes are discarded.
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		for {
+			select {
+			case buf := <-q.packets:
+				PutPacketBuffer(buf)
+			default:
+				return
+			}
+		}
+	})
+}
+
+// Dropped returns how many packets the policy has discarded
+func (q *SendQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Len returns how many packets wait to be sent
+func (q *SendQueue) Len() int {
+	return len(q.packets)
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// queuedPacket returns a pooled buffer holding a one-byte packet
+func queuedPacket(b byte) *[]byte {
+	buf := GetPacketBuffer()
+	*buf = append((*buf)[:0], b)
+	return buf
+}
+
+// popAll pops the packets waiting in q, returning their bytes in order
+func popAll(t *testing.T, q *SendQueue) []byte {
+	t.Helper()
+	var got []byte
+	for q.Len() > 0 {
+		buf, ok := q.Pop()
+		if !ok {
+			t.Fatal("queue closed while packets were waiting")
+		}
+		got = append(got, (*buf)[0])
+		PutPacketBuffer(buf)
+	}
+	return got
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueBlock, QueueDropOldest, QueueDropNewest} {
+		if got, err := ParseQueuePolicy(string(policy)); err != nil || got != policy {
+			t.Errorf("ParseQueuePolicy(%q) = %q, %v", policy, got, err)
+		}
+	}
+	if got, err := ParseQueuePolicy(""); err != nil || got != QueueDropOldest {
+		t.Errorf("default policy = %q, %v, want %q", got, err, QueueDropOldest)
+	}
+	if _, err := ParseQueuePolicy("drop-random"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestSendQueueDropNewest(t *testing.T) {
+	q := NewSendQueue(2, QueueDropNewest)
+	defer q.Close()
+	for i := byte(1); i <= 3; i++ {
+		want := 0
+		if i == 3 {
+			want = 1
+		}
+		if dropped := q.Push(queuedPacket(i)); dropped != want {
+			t.Fatalf("push %d dropped %d packets, want %d", i, dropped, want)
+		}
+	}
+	if got := popAll(t, q); !bytes.Equal(got, []byte{1, 2}) {
+		t.Errorf("queue held %v, want [1 2]", got)
+	}
+	if q.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", q.Dropped())
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	q := NewSendQueue(2, QueueDropOldest)
+	defer q.Close()
+	for i := byte(1); i <= 4; i++ {
+		q.Push(queuedPacket(i))
+	}
+	if got := popAll(t, q); !bytes.Equal(got, []byte{3, 4}) {
+		t.Errorf("queue held %v, want [3 4]", got)
+	}
+	if q.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", q.Dropped())
+	}
+}
+
+func TestSendQueueBlockReleasedByClose(t *testing.T) {
+	q := NewSendQueue(1, QueueBlock)
+	q.Push(queuedPacket(1))
+
+	pushed := make(chan int)
+	go func() { pushed <- q.Push(queuedPacket(2)) }()
+	select {
+	case <-pushed:
+		t.Fatal("push into a full blocking queue returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Close()
+	select {
+	case dropped := <-pushed:
+		if dropped != 0 {
+			t.Errorf("push released by Close dropped %d packets", dropped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not release the blocked push")
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("Pop returned a packet after Close")
+	}
+	if q.Push(queuedPacket(3)) != 0 || q.Len() != 0 {
+		t.Error("push after Close was queued or counted")
+	}
+}
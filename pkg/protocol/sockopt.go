@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// SocketOptions tunes the sockets carrying the tunnel. Zero buffer sizes
+// keep the operating system's defaults.
+type SocketOptions struct {
+	NoDelay     *bool // send small writes at once instead of coalescing them; default on
+	ReadBuffer  int   // SO_RCVBUF in bytes
+	WriteBuffer int   // SO_SNDBUF in bytes
+}
+
+// Validate checks the buffer sizes
+func (o SocketOptions) Validate() error {
+	if o.ReadBuffer < 0 {
+		return fmt.Errorf("invalid receive buffer size %d", o.ReadBuffer)
+	}
+	if o.WriteBuffer < 0 {
+		return fmt.Errorf("invalid send buffer size %d", o.WriteBuffer)
+	}
+	return nil
+}
+
+// Apply sets the options on conn. Connections that are not TCP or UDP
+// sockets are left alone, as is TCP_NODELAY on UDP sockets.
+func (o SocketOptions) Apply(conn net.Conn) error {
+	var buffered interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		// Interactive traffic suffers from Nagle's delays, so NODELAY is
+		// on unless turned off
+		if err := c.SetNoDelay(o.NoDelay == nil || *o.NoDelay); err != nil {
+			return fmt.Errorf("failed to set TCP_NODELAY: %v", err)
+		}
+		buffered = c
+	case *net.UDPConn:
+		buffered = c
+	default:
+		return nil
+	}
+
+	if o.ReadBuffer > 0 {
+		if err := buffered.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %v", err)
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := buffered.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("failed to set send buffer: %v", err)
+		}
+	}
+	return nil
+}
+
+// DialContext returns a dial function for dialer that applies the options
+// to each connection it makes, for use as a websocket.Dialer's
+// NetDialContext
+func (o SocketOptions) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.Apply(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// Listener wraps l so the options are applied to each accepted connection
+func (o SocketOptions) Listener(l net.Listener) net.Listener {
+	return &socketOptionsListener{Listener: l, options: o}
+}
+
+// socketOptionsListener applies socket options to accepted connections
+type socketOptionsListener struct {
+	net.Listener
+	options SocketOptions
+}
+
+// Accept waits for the next connection and tunes its socket. A connection
+// whose options cannot be set is still returned, as it works without them.
+func (l *socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.options.Apply(conn); err != nil {
+		slog.Debug("Failed to tune socket", "addr", conn.RemoteAddr().String(), "error", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,137 @@
+//go:build !windows
+
+package protocol
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// sockopt reads an integer socket option of conn
+func sockopt(t *testing.T, conn net.Conn, level, option int) int {
+	t.Helper()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+// checkBuffer fails unless conn's buffer option is the size set. Linux
+// reports double the size, to account for its bookkeeping.
+func checkBuffer(t *testing.T, conn net.Conn, option, size int) {
+	t.Helper()
+	want := size
+	if runtime.GOOS == "linux" {
+		want *= 2
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, option); got != want {
+		t.Errorf("socket option %d = %d, want %d", option, got, want)
+	}
+}
+
+// checkBuffers checks the buffer sizes o sets on conn
+func checkBuffers(t *testing.T, conn net.Conn, o SocketOptions) {
+	t.Helper()
+	if o.ReadBuffer > 0 {
+		checkBuffer(t, conn, syscall.SO_RCVBUF, o.ReadBuffer)
+	}
+	if o.WriteBuffer > 0 {
+		checkBuffer(t, conn, syscall.SO_SNDBUF, o.WriteBuffer)
+	}
+}
+
+func TestSocketOptionsAppliedToTCP(t *testing.T) {
+	off := false
+	for _, test := range []struct {
+		name    string
+		options SocketOptions
+		noDelay bool
+	}{
+		{"defaults", SocketOptions{}, true},
+		{"nagle", SocketOptions{NoDelay: &off}, false},
+		// Under Linux's default net.core.rmem_max and wmem_max, which cap them
+		{"buffers", SocketOptions{ReadBuffer: 96 << 10, WriteBuffer: 80 << 10}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener = test.options.Listener(listener)
+			defer listener.Close()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+				close(accepted)
+			}()
+
+			client, err := test.options.DialContext(&net.Dialer{})(context.Background(), "tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server, ok := <-accepted
+			if !ok {
+				t.Fatal("no connection accepted")
+			}
+			defer server.Close()
+
+			// Both ends of the connection are tuned
+			for side, conn := range map[string]net.Conn{"dialed": client, "accepted": server} {
+				if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != test.noDelay {
+					t.Errorf("%s TCP_NODELAY = %v, want %v", side, got, test.noDelay)
+				}
+				checkBuffers(t, conn, test.options)
+			}
+		})
+	}
+}
+
+func TestSocketOptionsAppliedToUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	options := SocketOptions{ReadBuffer: 96 << 10, WriteBuffer: 80 << 10}
+	if err := options.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkBuffers(t, conn, options)
+
+	// Connections that are not sockets are left alone
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := options.Apply(a); err != nil {
+		t.Errorf("Apply() on a pipe = %v", err)
+	}
+}
+
+func TestSocketOptionsValidate(t *testing.T) {
+	for _, options := range []SocketOptions{{ReadBuffer: -1}, {WriteBuffer: -1}} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%+v accepted", options)
+		}
+	}
+	if err := (SocketOptions{ReadBuffer: 4096}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
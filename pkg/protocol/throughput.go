@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputWindow is how many one-second buckets the rate is averaged over
+const throughputWindow = 5
+
+// ThroughputMeter counts bytes and reports the rate over the last few
+// seconds. The zero value is ready to use.
+type ThroughputMeter struct {
+	mu      sync.Mutex
+	total   uint64
+	buckets [throughputWindow]uint64 // bytes counted in each second
+	seconds [throughputWindow]int64  // the Unix second each bucket holds
+}
+
+// Add counts n bytes
+func (m *ThroughputMeter) Add(n int) {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := now % throughputWindow
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.buckets[i] = 0
+	}
+	m.buckets[i] += uint64(n)
+	m.total += uint64(n)
+}
+
+// Total returns every byte counted since the last reset
+func (m *ThroughputMeter) Total() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the average bytes per second over the sliding window
+func (m *ThroughputMeter) Rate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sum uint64
+	for i, second := range m.seconds {
+		if now-second < throughputWindow {
+			sum += m.buckets[i]
+		}
+	}
+	return float64(sum) / throughputWindow
+}
+
+// Reset starts counting from zero
+func (m *ThroughputMeter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total = 0
+	m.buckets = [throughputWindow]uint64{}
+	m.seconds = [throughputWindow]int64{}
+}
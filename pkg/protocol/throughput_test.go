@@ -0,0 +1,27 @@
+package protocol
+
+import "testing"
+
+func TestThroughputMeter(t *testing.T) {
+	var m ThroughputMeter
+	for i := 0; i < 10; i++ {
+		m.Add(1500)
+	}
+	m.Add(0)
+	if got := m.Total(); got != 15000 {
+		t.Errorf("Total() = %d, want 15000", got)
+	}
+	// Everything was counted within the window, which the rate averages over
+	if got, want := m.Rate(), 15000.0/throughputWindow; got != want {
+		t.Errorf("Rate() = %v, want %v", got, want)
+	}
+
+	m.Reset()
+	if m.Total() != 0 || m.Rate() != 0 {
+		t.Errorf("after Reset() total %d and rate %v, want 0", m.Total(), m.Rate())
+	}
+	m.Add(100)
+	if m.Total() != 100 {
+		t.Errorf("Total() = %d after counting from zero, want 100", m.Total())
+	}
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// timingProfile is the distribution of the gaps between a browser's
+// packets in one kind of activity, as a CDF: delaysMs[i] is the gap in
+// milliseconds that a fraction cdf[i] of gaps do not exceed. Both slices
+// are sorted and cdf runs from 0 to 1.
+type timingProfile struct {
+	delaysMs []float64
+	cdf      []float64
+}
+
+// timingProfiles are the gaps between Chromium's packets during ordinary
+// HTTPS use, by activity
+var timingProfiles = map[string]*timingProfile{
+	// A page left open: sparse keepalives and background polling
+	"browser-idle": {
+		delaysMs: []float64{0, 2, 10, 40, 100, 250, 600, 1500, 5000},
+		cdf:      []float64{0, 0.05, 0.15, 0.30, 0.50, 0.70, 0.85, 0.95, 1},
+	},
+	// Pages loading: bursts of requests for a page's resources
+	"browser-active": {
+		delaysMs: []float64{0, 0.5, 1, 3, 8, 20, 50, 120, 400},
+		cdf:      []float64{0, 0.10, 0.25, 0.45, 0.65, 0.80, 0.90, 0.97, 1},
+	},
+	// Adaptive streaming: back-to-back packets while a segment downloads,
+	// then a pause until the next one
+	"video-stream": {
+		delaysMs: []float64{0, 0.1, 0.3, 1, 5, 50, 500, 2000, 4000},
+		cdf:      []float64{0, 0.30, 0.55, 0.75, 0.85, 0.90, 0.93, 0.98, 1},
+	},
+	// A single-page app calling its API: request, wait for the server,
+	// render, repeat
+	"api-call": {
+		delaysMs: []float64{0, 5, 15, 30, 60, 100, 200, 500, 1000},
+		cdf:      []float64{0, 0.05, 0.20, 0.40, 0.60, 0.75, 0.88, 0.96, 1},
+	},
+}
+
+// TimingProfiles returns the names SetTimingProfile accepts
+func TimingProfiles() []string {
+	names := make([]string, 0, len(timingProfiles))
+	for name := range timingProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetTimingProfile makes AddTimingJitter draw its delays from the gaps
+// between a browser's packets in the named activity instead of around the
+// round-trip time. An empty name goes back to that. Delays stay within the
+// jitter bounds. It must be called before the protocol is in use.
+func (sp *StealthProtocol) SetTimingProfile(name string) error {
+	if name == "" {
+		sp.timing = nil
+		sp.jitter.TimingProfile = ""
+		return nil
+	}
+	profile, ok := timingProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown timing profile %q, want one of %v", name, TimingProfiles())
+	}
+	sp.timing = profile
+	sp.jitter.TimingProfile = name
+	return nil
+}
+
+// quantile returns the gap that a fraction u of gaps do not exceed,
+// interpolating between the two delays around it. Given a uniformly random
+// u it draws a gap.
+func (p *timingProfile) quantile(u float64) time.Duration {
+	i := sort.SearchFloat64s(p.cdf, u)
+	var ms float64
+	switch {
+	case i == 0:
+		ms = p.delaysMs[0]
+	case i == len(p.cdf):
+		ms = p.delaysMs[len(p.delaysMs)-1]
+	default:
+		lo, hi := p.cdf[i-1], p.cdf[i]
+		fraction := (u - lo) / (hi - lo)
+		ms = p.delaysMs[i-1] + fraction*(p.delaysMs[i]-p.delaysMs[i-1])
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
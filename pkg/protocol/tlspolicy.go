@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// ALPN protocols offered when none are configured. Clients offer what
+// browsers do. Servers prefer HTTP/1.1, which WebSocket upgrades need,
+// and speak HTTP/2 to browsers offering only that.
+var (
+	DefaultClientALPN = []string{"h2", "http/1.1"}
+	DefaultServerALPN = []string{"http/1.1", "h2"}
+)
+
+// tlsVersions maps the tls_min_version setting to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetTLSPolicy sets the oldest TLS version and the TLS 1.2 cipher suites to
+// accept, by their IANA names. Empty values keep the defaults, TLS 1.2 and
+// ECDHE suites with AEAD ciphers. Older versions and suites are accepted
+// only so a specific fingerprint can be matched, and are logged as insecure.
+// It must be called before the protocol is in use.
+func (sp *StealthProtocol) SetTLSPolicy(minVersion string, cipherSuites []string) error {
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		if version < tls.VersionTLS12 {
+			slog.Warn("Accepting an insecure TLS version", "version", minVersion)
+		}
+		sp.tlsConfig.MinVersion = version
+	}
+
+	if len(cipherSuites) == 0 {
+		return nil
+	}
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]uint16)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(cipherSuites))
+	for _, name := range cipherSuites {
+		if id, ok := secure[name]; ok {
+			ids = append(ids, id)
+		} else if id, ok := insecure[name]; ok {
+			slog.Warn("Accepting an insecure cipher suite", "cipher_suite", name)
+			ids = append(ids, id)
+		} else {
+			return fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+	sp.tlsConfig.CipherSuites = ids
+	return nil
+}
+
+// SetALPN sets the application protocols offered in the TLS handshake, most
+// preferred first. http/1.1 must be among them, as tunnels start with a
+// WebSocket upgrade. It must be called before the protocol is in use.
+func (sp *StealthProtocol) SetALPN(protocols []string) error {
+	for _, protocol := range protocols {
+		if protocol == "" || len(protocol) > 255 {
+			return fmt.Errorf("invalid ALPN protocol %q", protocol)
+		}
+	}
+	if !slices.Contains(protocols, "http/1.1") {
+		return fmt.Errorf("ALPN protocols must include http/1.1")
+	}
+	sp.tlsConfig.NextProtos = slices.Clone(protocols)
+	return nil
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsHandshake connects client to server over a pipe and returns the
+// client's view of the connection
+func tlsHandshake(t *testing.T, server, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		conn := tls.Server(serverConn, server)
+		conn.Handshake()
+		conn.Close()
+	}()
+	client = client.Clone()
+	client.InsecureSkipVerify = true
+	conn := tls.Client(clientConn, client)
+	err := conn.Handshake()
+	return conn.ConnectionState(), err
+}
+
+func TestSetTLSPolicyNegotiates(t *testing.T) {
+	sp := NewStealthProtocol()
+	if err := sp.SetTLSPolicy("", nil); err != nil {
+		t.Fatal(err)
+	}
+	defaults := sp.GetTLSConfig()
+	if defaults.MinVersion != tls.VersionTLS12 || len(defaults.CipherSuites) == 0 {
+		t.Fatalf("empty policy changed the defaults: %x %v", defaults.MinVersion, defaults.CipherSuites)
+	}
+
+	if err := sp.SetTLSPolicy("1.2", []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}); err != nil {
+		t.Fatal(err)
+	}
+	server := sp.GetTLSConfig()
+	server.Certificates = []tls.Certificate{testCertificate(t)}
+	client := &tls.Config{MaxVersion: tls.VersionTLS12}
+	state, err := tlsHandshake(t, server, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Errorf("negotiated %s, want the only configured suite", tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	if err := sp.SetTLSPolicy("1.3", nil); err != nil {
+		t.Fatal(err)
+	}
+	server = sp.GetTLSConfig()
+	server.Certificates = []tls.Certificate{testCertificate(t)}
+	if _, err := tlsHandshake(t, server, client); err == nil {
+		t.Error("TLS 1.2 client accepted with tls_min_version 1.3")
+	}
+}
+
+func TestSetTLSPolicyRejects(t *testing.T) {
+	sp := NewStealthProtocol()
+	if err := sp.SetTLSPolicy("1.4", nil); err == nil {
+		t.Error("unknown TLS version accepted")
+	}
+	if err := sp.SetTLSPolicy("", []string{"TLS_RSA_WITH_AES_128_GCM_SHA256", "TLS_NOT_A_SUITE"}); err == nil {
+		t.Error("unknown cipher suite accepted")
+	}
+	if config := sp.GetTLSConfig(); config.MinVersion != tls.VersionTLS12 || slices.Contains(config.CipherSuites, tls.TLS_RSA_WITH_AES_128_GCM_SHA256) {
+		t.Error("rejected policy changed the config")
+	}
+
+	// Insecure settings are allowed, only warned about
+	if err := sp.SetTLSPolicy("1.0", []string{"TLS_RSA_WITH_RC4_128_SHA"}); err != nil {
+		t.Errorf("insecure policy refused: %v", err)
+	}
+}
+
+func TestSetALPNNegotiatesHTTP1ForTunnels(t *testing.T) {
+	sp := NewStealthProtocol()
+	if err := sp.SetALPN(DefaultServerALPN); err != nil {
+		t.Fatal(err)
+	}
+	server := sp.GetTLSConfig()
+	server.Certificates = []tls.Certificate{testCertificate(t)}
+
+	// Clients offer h2 first, as browsers do; the server's preference wins
+	state, err := tlsHandshake(t, server, &tls.Config{NextProtos: DefaultClientALPN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated %q, want http/1.1", state.NegotiatedProtocol)
+	}
+	state, err = tlsHandshake(t, server, &tls.Config{NextProtos: []string{"h2"}})
+	if err != nil || state.NegotiatedProtocol != "h2" {
+		t.Errorf("h2-only client negotiated %q, %v", state.NegotiatedProtocol, err)
+	}
+}
+
+func TestSetALPNRejects(t *testing.T) {
+	sp := NewStealthProtocol()
+	for _, protocols := range [][]string{
+		nil,
+		{"h2"},
+		{"http/1.1", ""},
+		{"http/1.1", string(make([]byte, 256))},
+	} {
+		if err := sp.SetALPN(protocols); err == nil {
+			t.Errorf("SetALPN(%q) accepted", protocols)
+		}
+	}
+	if protocols := sp.GetTLSConfig().NextProtos; len(protocols) != 0 {
+		t.Errorf("rejected protocols %q kept", protocols)
+	}
+}
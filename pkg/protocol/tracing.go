@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultTraceSampleRate keeps tracing overhead negligible in production
+const DefaultTraceSampleRate = 0.001
+
+// Tracer returns the tracer used for the packet forwarding pipeline and
+// the connection lifecycle
+func Tracer() trace.Tracer {
+	return otel.Tracer("stealthvpn/pkg/protocol")
+}
+
+// InitTracing exports traces to an OTLP/HTTP endpoint, given here or by the
+// standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// variables. Without one, or with OTEL_SDK_DISABLED=true, the global no-op
+// tracer stays in place. sampleRate is the fraction of packets traced;
+// connections are always traced unless OTEL_TRACES_SAMPLER says otherwise.
+// The returned function flushes and stops the exporter.
+func InitTracing(ctx context.Context, serviceName, endpoint string, sampleRate float64) (func(context.Context) error, error) {
+	if !tracingEnabled(endpoint) {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporterOptions []otlptracehttp.Option
+	if endpoint != "" {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	providerOptions := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	}
+	if os.Getenv("OTEL_TRACES_SAMPLER") == "" {
+		sampler := connectionSampler{packets: sdktrace.TraceIDRatioBased(sampleRate)}
+		providerOptions = append(providerOptions, sdktrace.WithSampler(sdktrace.ParentBased(sampler)))
+	}
+	provider := sdktrace.NewTracerProvider(providerOptions...)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// tracingEnabled reports whether an exporter is configured and not disabled
+func tracingEnabled(endpoint string) bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return endpoint != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// connectionSampler traces every connection, of which there are few, and a
+// fraction of the packets, of which there are many. Connection spans are the
+// only ones of client or server kind.
+type connectionSampler struct {
+	packets sdktrace.Sampler
+}
+
+func (s connectionSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Kind == trace.SpanKindClient || p.Kind == trace.SpanKindServer {
+		return sdktrace.AlwaysSample().ShouldSample(p)
+	}
+	return s.packets.ShouldSample(p)
+}
+
+func (s connectionSampler) Description() string {
+	return fmt.Sprintf("ConnectionSampler{packets:%s}", s.packets.Description())
+}
+
+// EndSpan ends span, marking it failed if err is not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace ctx belongs to, or "" if it is not
+// traced. Both ends log it so their logs of a connection can be matched up.
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// InjectHTTPTraceContext adds the trace context of ctx to the headers of an
+// upgrade request, which only the server sees inside TLS
+func InjectHTTPTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractHTTPTraceContext returns ctx extended with the trace context carried
+// in the headers of an upgrade request, if any
+func ExtractHTTPTraceContext(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// WithTLSHandshakeSpan returns ctx set up so that a dial with it records the
+// TLS handshake as a child of the span in ctx, if that is being recorded
+func WithTLSHandshakeSpan(ctx context.Context) context.Context {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx
+	}
+
+	var span trace.Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			_, span = Tracer().Start(ctx, "tls_handshake")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if span == nil {
+				return
+			}
+			span.SetAttributes(
+				attribute.String("tls.protocol.version", tls.VersionName(state.Version)),
+				attribute.String("tls.cipher", tls.CipherSuiteName(state.CipherSuite)),
+			)
+			EndSpan(span, err)
+		},
+	})
+}
+
+// ObfuscatePacketWithTrace obfuscates a packet into dst's storage and carries
+// the trace context of ctx as a traceparent header in the fake HTTP request
+func (sp *StealthProtocol) ObfuscatePacketWithTrace(ctx context.Context, dst, data []byte) ([]byte, error) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return sp.obfuscate(dst, data, carrier)
+}
+
+// ExtractTraceContext returns ctx extended with the trace context carried in
+// the fake HTTP headers of an obfuscated packet, if any. It is called for
+// every frame, so frames without a traceparent return ctx without their
+// headers being parsed.
+func (sp *StealthProtocol) ExtractTraceContext(ctx context.Context, obfuscated []byte) context.Context {
+	headerEnd := bytes.Index(obfuscated, []byte("\r\n\r\n"))
+	if headerEnd == -1 || !bytes.Contains(obfuscated[:headerEnd], []byte("\r\ntraceparent: ")) {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	for _, line := range strings.Split(string(obfuscated[:headerEnd]), "\r\n") {
+		name, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		carrier[strings.ToLower(name)] = value
+	}
+
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TransportHeader asks the server for a transport other than WebSocket when
+// opening the WebSocket connection
+const TransportHeader = "X-Client-Transport"
+
+// TransportType selects how frames travel between client and server
+type TransportType string
+
+const (
+	// TransportWebSocket carries frames as WebSocket messages over TLS
+	TransportWebSocket TransportType = "websocket"
+	// TransportUDP carries frames as sequenced UDP datagrams, avoiding TCP-in-TCP
+	TransportUDP TransportType = "udp"
+	// TransportWebRTC carries frames on a WebRTC data channel, signaled over WebSocket
+	TransportWebRTC TransportType = "webrtc"
+	// TransportMeek carries frames in HTTP requests to a CDN, fronted by a
+	// domain censors cannot block
+	TransportMeek TransportType = "meek"
+	// TransportDoH carries frames in DNS-over-HTTPS queries for TXT records
+	// and their answers
+	TransportDoH TransportType = "doh"
+)
+
+// Transport carries obfuscated, encrypted frames between client and server.
+// One goroutine may read while any number of others write.
+type Transport interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// ReadJSON reads the next frame from t and decodes it into v
+func ReadJSON(t Transport, v interface{}) error {
+	data, err := t.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteJSON encodes v and writes it to t as a single frame
+func WriteJSON(t Transport, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.WriteMessage(data)
+}
+
+// QueueDepth returns how many frames t holds that were not delivered yet,
+// for transports that queue them, and 0 for others
+func QueueDepth(t Transport) int {
+	if q, ok := t.(interface{ QueueDepth() int }); ok {
+		return q.QueueDepth()
+	}
+	return 0
+}
+
+// WriteMessageContext writes data to t unless ctx is already done, bounding
+// the write by ctx's deadline if it has one
+func WriteMessageContext(ctx context.Context, t Transport, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// A zero deadline clears any earlier one
+	deadline, _ := ctx.Deadline()
+	if err := t.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return t.WriteMessage(data)
+}
+
+// WebSocketTransport sends frames as binary WebSocket messages
+type WebSocketTransport struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex // gorilla/websocket allows only one concurrent writer
+}
+
+// NewWebSocketTransport wraps an established WebSocket connection
+func NewWebSocketTransport(conn *websocket.Conn) *WebSocketTransport {
+	return &WebSocketTransport{conn: conn}
+}
+
+// Conn returns the underlying WebSocket connection
+func (t *WebSocketTransport) Conn() *websocket.Conn {
+	return t.conn
+}
+
+// ReadMessage reads the next WebSocket message
+func (t *WebSocketTransport) ReadMessage() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+// WriteMessage writes data as a binary WebSocket message
+func (t *WebSocketTransport) WriteMessage(data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// SetReadDeadline sets the deadline for the next read
+func (t *WebSocketTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline sets the deadline for writes
+func (t *WebSocketTransport) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
+// RemoteAddr returns the peer's address
+func (t *WebSocketTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// Close closes the WebSocket connection
+func (t *WebSocketTransport) Close() error {
+	return t.conn.Close()
+}
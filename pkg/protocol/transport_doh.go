@@ -0,0 +1,643 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DoHContentType is the media type of DNS messages over HTTPS (RFC 8484)
+	DoHContentType = "application/dns-message"
+	// DefaultDoHQueriesPerSecond keeps a client's queries to a rate a busy
+	// browser might make, well below what resolvers treat as abuse
+	DefaultDoHQueriesPerSecond = 10
+	// dohTXTChunk is how many bytes of frames each TXT string in an answer
+	// carries: 189 bytes are 252 base64 characters, of the 255 allowed
+	dohTXTChunk = 189
+	// dohMaxTXTStrings bounds the strings in an answer, about 4 KB of frames
+	dohMaxTXTStrings = 16
+	// dohMaxName and dohMaxLabel are the longest name and label DNS allows
+	dohMaxName  = 254 // with the trailing dot
+	dohMaxLabel = 63
+	// dohSessionIDSize and dohHeaderSize are the sizes of the session ID and
+	// of the label naming the session and sequence number of a query
+	dohSessionIDSize = 8
+	dohHeaderSize    = dohSessionIDSize + 4
+	// dohMinChunk is the least a query must carry for the transport to be
+	// usable, which rules out tunnel domains that leave too little room
+	dohMinChunk = 32
+	// dohResponseWait is how long the server holds a poll that it has no
+	// frames for, in case some come
+	dohResponseWait = 200 * time.Millisecond
+	// dohQueryPadBlock and dohResponsePadBlock are the sizes queries and
+	// answers are padded to a multiple of, as browsers pad theirs (RFC 8467)
+	dohQueryPadBlock    = 128
+	dohResponsePadBlock = 468
+)
+
+// errDoHSessionGone is returned once the server has ended the session
+var errDoHSessionGone = errors.New("DoH session closed by server")
+
+// DoHConfig describes how a client reaches the server through DNS queries
+// over HTTPS
+type DoHConfig struct {
+	URL              string       // DoH endpoint, such as https://dns.example.com/dns-query
+	Domain           string       // zone the server answers for; queries are for names under it
+	Host             string       // Host header, to front the endpoint through a CDN; the URL's host if empty
+	Header           http.Header  // sent with every request, such as a User-Agent
+	Client           *http.Client // carries the requests; http.DefaultClient if nil
+	QueriesPerSecond float64      // at most this many queries; DefaultDoHQueriesPerSecond if 0
+}
+
+// DoHTransport carries frames in DNS-over-HTTPS queries for TXT records and
+// in their answers, for networks that inspect everything but let DoH
+// through. Frames to the server are encoded into the names queried, a few
+// hundred bytes at a time, and frames from it into the TXT strings of the
+// answers. Queries are numbered and answered in order, so a query that
+// failed is sent again without losing or repeating frames. Clients poll
+// while they have nothing to send, as meek clients do.
+type DoHTransport struct {
+	*queuedTransport
+
+	// Client side
+	config    DoHConfig
+	sessionID [dohSessionIDSize]byte
+	limiter   *rate.Limiter
+
+	// Server side
+	header     http.Header  // of the request that opened the session
+	requestMu  sync.Mutex   // answers one query of the session at a time
+	lastSeen   atomic.Int64 // unix nanoseconds of the last query
+	nextSeq    uint32       // sequence number of the next new query
+	lastAnswer []string     // TXT strings of the last answer, repeated if its query is retried
+	upstream   []byte       // start of a frame from the client
+	downstream []byte       // encoded frames not yet sent to the client
+}
+
+// DialDoH starts a client DoH transport. No query is made until it polls
+// for the server's first frame, so errors surface on reads.
+func DialDoH(config DoHConfig) (*DoHTransport, error) {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.QueriesPerSecond <= 0 {
+		config.QueriesPerSecond = DefaultDoHQueriesPerSecond
+	}
+	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
+	if dohChunkSize(config.Domain) < dohMinChunk {
+		return nil, fmt.Errorf("DoH domain %q is too long", config.Domain)
+	}
+
+	t := &DoHTransport{
+		queuedTransport: newQueuedTransport(meekAddr(config.Domain)),
+		config:          config,
+		limiter:         rate.NewLimiter(rate.Limit(config.QueriesPerSecond), max(int(config.QueriesPerSecond), 1)),
+	}
+	if _, err := rand.Read(t.sessionID[:]); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	go t.poll(ctx)
+	return t, nil
+}
+
+// dohChunkSize returns how many bytes fit in the name of a query under
+// domain, after the label naming the session
+func dohChunkSize(domain string) int {
+	header := base64.RawURLEncoding.EncodedLen(dohHeaderSize)
+	room := dohMaxName - len(domain) - header - 1
+	// Every 63 characters of data need a dot after them
+	chars := room - (room+dohMaxLabel)/(dohMaxLabel+1)
+	return min(chars*3/4, dohTXTChunk)
+}
+
+// poll sends queued frames to the server a chunk per query, or polls for
+// its frames when there are none, until the transport is closed or the
+// server is lost
+func (t *DoHTransport) poll(ctx context.Context) {
+	chunkSize := dohChunkSize(t.config.Domain)
+	var pending, received []byte
+	var seq uint32
+	interval := time.Duration(0)
+	backoff := meekInitialBackoff
+	failures := 0
+
+	for {
+		if len(pending) == 0 {
+			var ok bool
+			if pending, ok = t.nextPayload(interval, chunkSize); !ok {
+				return
+			}
+		}
+		chunk := pending[:min(len(pending), chunkSize)]
+
+		if err := t.limiter.Wait(ctx); err != nil {
+			return
+		}
+		answer, status, retryAfter, err := t.query(ctx, seq, chunk)
+		switch {
+		case err == nil && status == http.StatusOK:
+			pending = pending[len(chunk):]
+			seq++
+			if len(chunk) > 0 || len(answer) > 0 {
+				interval = 0
+			} else {
+				interval = min(max(interval*3/2, meekMinPoll), meekMaxPoll)
+			}
+			backoff = meekInitialBackoff
+			failures = 0
+
+			received = append(received, answer...)
+			var frames [][]byte
+			frames, received, err = splitMeekFrames(received)
+			if err != nil {
+				t.fail(err)
+				return
+			}
+			for _, frame := range frames {
+				select {
+				case t.incoming <- frame:
+				case <-t.done:
+					return
+				}
+			}
+			continue
+		case errors.Is(err, errDoHSessionGone):
+			t.fail(err)
+			return
+		case err == nil && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable):
+			if retryAfter > 0 {
+				backoff = retryAfter
+			}
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			// The server answers a query it has seen again with the same
+			// answer, so the query is simply retried
+			if err == nil {
+				err = fmt.Errorf("DoH query failed: %s", http.StatusText(status))
+			}
+			if failures++; failures >= meekMaxFailures {
+				t.fail(err)
+				return
+			}
+		}
+
+		if !t.sleep(backoff) {
+			return
+		}
+		backoff = min(backoff*2, meekMaxBackoff)
+		interval = 0
+	}
+}
+
+// query sends the query numbered seq carrying chunk and returns the bytes
+// of frames in the answer, the HTTP status and how long the server asks us
+// to wait
+func (t *DoHTransport) query(ctx context.Context, seq uint32, chunk []byte) ([]byte, int, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(t.queryName(seq, chunk), dns.TypeTXT)
+	msg.Id = 0 // as RFC 8484 recommends, for caching
+	padDNSMessage(msg, dohQueryPadBlock)
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.URL, bytes.NewReader(wire))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for name, values := range t.config.Header {
+		req.Header[name] = values
+	}
+	if t.config.Host != "" {
+		req.Host = t.config.Host
+	}
+	req.Header.Set("Content-Type", DoHContentType)
+	req.Header.Set("Accept", DoHContentType)
+
+	resp, err := t.config.Client.Do(req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), nil
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid DoH answer: %v", err)
+	}
+	switch reply.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, 0, 0, errDoHSessionGone
+	default:
+		return nil, 0, 0, fmt.Errorf("DoH query failed: %s", dns.RcodeToString[reply.Rcode])
+	}
+	answer, err := decodeTXTAnswer(reply)
+	return answer, resp.StatusCode, 0, err
+}
+
+// queryName encodes chunk into the name of a query: labels of data, then a
+// label with the session ID and sequence number, then the tunnel domain
+func (t *DoHTransport) queryName(seq uint32, chunk []byte) string {
+	var name strings.Builder
+	data := base64.RawURLEncoding.EncodeToString(chunk)
+	for len(data) > 0 {
+		n := min(len(data), dohMaxLabel)
+		name.WriteString(data[:n])
+		name.WriteByte('.')
+		data = data[n:]
+	}
+
+	header := binary.BigEndian.AppendUint32(t.sessionID[:len(t.sessionID):len(t.sessionID)], seq)
+	name.WriteString(base64.RawURLEncoding.EncodeToString(header))
+	name.WriteByte('.')
+	name.WriteString(t.config.Domain)
+	return name.String()
+}
+
+// decodeTXTAnswer returns the bytes carried in the TXT strings of reply
+func decodeTXTAnswer(reply *dns.Msg) ([]byte, error) {
+	var data []byte
+	for _, rr := range reply.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		for _, s := range txt.Txt {
+			chunk, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DoH answer: %v", err)
+			}
+			data = append(data, chunk...)
+		}
+	}
+	return data, nil
+}
+
+// splitMeekFrames returns the whole length-prefixed frames at the start of
+// data and the start of the next frame, if any
+func splitMeekFrames(data []byte) (frames [][]byte, rest []byte, err error) {
+	for len(data) >= meekFrameHeaderSize {
+		size := binary.BigEndian.Uint32(data)
+		if size > meekMaxFrame {
+			return nil, nil, fmt.Errorf("frame of %d bytes is too large", size)
+		}
+		end := meekFrameHeaderSize + int(size)
+		if len(data) < end {
+			break
+		}
+		frames = append(frames, append([]byte(nil), data[meekFrameHeaderSize:end]...))
+		data = data[end:]
+	}
+	return frames, append([]byte(nil), data...), nil
+}
+
+// Header returns the headers of the request that opened a server-side
+// session
+func (t *DoHTransport) Header() http.Header {
+	return t.header
+}
+
+// DoHListener is the server side of the DoH transport: an HTTP handler
+// answering DNS queries over HTTPS. Queries for TXT records under the
+// tunnel domain carry sessions, which it turns into transports; other
+// queries are answered by forward, so the endpoint works as a resolver.
+type DoHListener struct {
+	domain  string
+	forward func(*dns.Msg) *dns.Msg
+
+	mu       sync.Mutex
+	sessions map[[dohSessionIDSize]byte]*DoHTransport // includes ended sessions until they expire
+	accept   chan *DoHTransport
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewDoHListener creates a listener for sessions under domain, answering
+// other queries with forward, or refusing them if forward is nil
+func NewDoHListener(domain string, forward func(*dns.Msg) *dns.Msg) *DoHListener {
+	l := &DoHListener{
+		domain:   dns.Fqdn(strings.ToLower(domain)),
+		forward:  forward,
+		sessions: make(map[[dohSessionIDSize]byte]*DoHTransport),
+		accept:   make(chan *DoHTransport),
+		done:     make(chan struct{}),
+	}
+	go l.expireSessions()
+	return l
+}
+
+// Accept waits for a query opening a new session
+func (l *DoHListener) Accept() (*DoHTransport, error) {
+	select {
+	case t := <-l.accept:
+		return t, nil
+	case <-l.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Close stops the listener and ends every session
+func (l *DoHListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, t := range l.sessions {
+			t.Close()
+		}
+	})
+	return nil
+}
+
+// expireSessions forgets sessions whose client stopped polling
+func (l *DoHListener) expireSessions() {
+	ticker := time.NewTicker(meekSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+		cutoff := time.Now().Add(-meekSessionTimeout).UnixNano()
+		l.mu.Lock()
+		for id, t := range l.sessions {
+			if t.lastSeen.Load() < cutoff {
+				t.Close()
+				delete(l.sessions, id)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// ReadDoHQuery returns the DNS query in a DoH request, sent either as the
+// body of a POST or in the dns parameter of a GET (RFC 8484)
+func ReadDoHQuery(r *http.Request) (*dns.Msg, error) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil {
+			return nil, err
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DoHContentType {
+			return nil, fmt.Errorf("unsupported content type %q", r.Header.Get("Content-Type"))
+		}
+		var err error
+		if wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(wire); err != nil {
+		return nil, err
+	}
+	if len(query.Question) != 1 {
+		return nil, fmt.Errorf("%d questions in query", len(query.Question))
+	}
+	return query, nil
+}
+
+// ServeHTTP answers a DoH query, passing data under the tunnel domain to
+// its session and answering with the session's frames
+func (l *DoHListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, err := ReadDoHQuery(r)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var reply *dns.Msg
+	if id, seq, data, ok := l.parseQuery(query.Question[0]); ok {
+		reply = l.answer(r, query, id, seq, data)
+	} else if l.forward != nil {
+		reply = l.forward(query)
+	} else {
+		reply = new(dns.Msg).SetRcode(query, dns.RcodeRefused)
+	}
+	if reply == nil {
+		return
+	}
+	if wantsPadding(query) {
+		padDNSMessage(reply, dohResponsePadBlock)
+	}
+
+	wire, err := reply.Pack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DoHContentType)
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Write(wire)
+}
+
+// padDNSMessage adds an EDNS(0) padding option to msg, replacing any it
+// has, that makes its packed length a multiple of block
+func padDNSMessage(msg *dns.Msg, block int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			options = append(options, option)
+		}
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(options, padding)
+	padding.Padding = make([]byte, (block-msg.Len()%block)%block)
+}
+
+// wantsPadding reports whether a query was padded, asking for a padded answer
+func wantsPadding(query *dns.Msg) bool {
+	if opt := query.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0PADDING {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseQuery decodes the session ID, sequence number and data of a query
+// for a TXT record under the tunnel domain
+func (l *DoHListener) parseQuery(question dns.Question) (id [dohSessionIDSize]byte, seq uint32, data []byte, ok bool) {
+	name := strings.ToLower(question.Name)
+	if question.Qtype != dns.TypeTXT || !strings.HasSuffix(name, "."+l.domain) {
+		return id, 0, nil, false
+	}
+	labels := strings.Split(question.Name[:len(name)-len(l.domain)-1], ".")
+
+	header, err := base64.RawURLEncoding.DecodeString(labels[len(labels)-1])
+	if err != nil || len(header) != dohHeaderSize {
+		return id, 0, nil, false
+	}
+	data, err = base64.RawURLEncoding.DecodeString(strings.Join(labels[:len(labels)-1], ""))
+	if err != nil {
+		return id, 0, nil, false
+	}
+	copy(id[:], header)
+	return id, binary.BigEndian.Uint32(header[dohSessionIDSize:]), data, true
+}
+
+// answer passes a query's data to its session and answers with the
+// session's frames. Unknown and ended sessions get NXDOMAIN. A nil answer
+// means the request was abandoned.
+func (l *DoHListener) answer(r *http.Request, query *dns.Msg, id [dohSessionIDSize]byte, seq uint32, data []byte) *dns.Msg {
+	t, err := l.session(r, id, seq)
+	if err != nil {
+		return nil
+	}
+	if t == nil {
+		return new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+	}
+	t.requestMu.Lock()
+	defer t.requestMu.Unlock()
+	t.lastSeen.Store(time.Now().UnixNano())
+
+	switch {
+	case t.closed():
+		return new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+	case t.nextSeq > 0 && seq == t.nextSeq-1:
+		// The client did not get our answer, so it gets it again
+		return txtReply(query, t.lastAnswer)
+	case seq != t.nextSeq:
+		return new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+	}
+
+	frames, rest, err := splitMeekFrames(append(t.upstream, data...))
+	if err != nil {
+		t.Close()
+		return new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+	}
+	t.upstream = rest
+	for _, frame := range frames {
+		select {
+		case t.incoming <- frame:
+		case <-t.done:
+			return new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+		case <-r.Context().Done():
+			// The frames already queued would be queued again with the
+			// retried query, so the session cannot go on
+			t.Close()
+			return nil
+		}
+	}
+
+	// Only polls are held, so data from the client is not slowed down
+	t.lastAnswer = t.takeDownstream(r.Context(), len(data) == 0)
+	t.nextSeq++
+	return txtReply(query, t.lastAnswer)
+}
+
+// takeDownstream returns as many frames as fit in an answer, encoded as
+// TXT strings. If there are none and wait is set, it waits briefly for some.
+func (t *DoHTransport) takeDownstream(ctx context.Context, wait bool) []string {
+	limit := dohMaxTXTStrings * dohTXTChunk
+	if len(t.downstream) == 0 && wait {
+		timer := time.NewTimer(dohResponseWait)
+		select {
+		case frame := <-t.outgoing:
+			t.downstream = appendMeekFrame(t.downstream, frame)
+		case <-timer.C:
+		case <-t.done:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+	for more := true; more && len(t.downstream) < limit; {
+		select {
+		case frame := <-t.outgoing:
+			t.downstream = appendMeekFrame(t.downstream, frame)
+		default:
+			more = false
+		}
+	}
+
+	data := t.downstream[:min(len(t.downstream), limit)]
+	t.downstream = t.downstream[len(data):]
+	var strs []string
+	for len(data) > 0 {
+		n := min(len(data), dohTXTChunk)
+		strs = append(strs, base64.StdEncoding.EncodeToString(data[:n]))
+		data = data[n:]
+	}
+	return strs
+}
+
+// txtReply answers query with one TXT record of strs, or no record if
+// there are none
+func txtReply(query *dns.Msg, strs []string) *dns.Msg {
+	reply := new(dns.Msg).SetReply(query)
+	reply.RecursionAvailable = true
+	if len(strs) > 0 {
+		reply.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: strs,
+		}}
+	}
+	return reply
+}
+
+// session returns the session with id. A query numbered 0 opens a new
+// session, which is handed to Accept; later queries for sessions the
+// listener does not know return nil.
+func (l *DoHListener) session(r *http.Request, id [dohSessionIDSize]byte, seq uint32) (*DoHTransport, error) {
+	l.mu.Lock()
+	t, ok := l.sessions[id]
+	if !ok && seq == 0 {
+		t = &DoHTransport{queuedTransport: newQueuedTransport(meekAddr(r.RemoteAddr)), header: r.Header.Clone()}
+		t.lastSeen.Store(time.Now().UnixNano())
+		l.sessions[id] = t
+	}
+	l.mu.Unlock()
+	if ok || t == nil {
+		return t, nil
+	}
+
+	select {
+	case l.accept <- t:
+		return t, nil
+	case <-l.done:
+	case <-r.Context().Done():
+	}
+	l.mu.Lock()
+	delete(l.sessions, id)
+	l.mu.Unlock()
+	return nil, ErrTransportClosed
+}
@@ -0,0 +1,328 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testDoHDomain = "t.example.com"
+
+// dohTestServer serves a DoHListener for testDoHDomain that answers other
+// queries with forward
+func dohTestServer(t *testing.T, forward func(*dns.Msg) *dns.Msg) (*DoHListener, *httptest.Server) {
+	t.Helper()
+	listener := NewDoHListener(testDoHDomain, forward)
+	server := httptest.NewServer(listener)
+	t.Cleanup(func() {
+		listener.Close()
+		server.Close()
+	})
+	return listener, server
+}
+
+// acceptDoH waits for the listener's next session
+func acceptDoH(t *testing.T, listener *DoHListener) *DoHTransport {
+	t.Helper()
+	accepted := make(chan *DoHTransport, 1)
+	go func() {
+		session, err := listener.Accept()
+		if err == nil {
+			accepted <- session
+		}
+	}()
+	select {
+	case session := <-accepted:
+		return session
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DoH session opened")
+		return nil
+	}
+}
+
+// exchangeDoH posts query to the server and returns the HTTP status and
+// the reply, if there is one
+func exchangeDoH(t *testing.T, url string, query *dns.Msg) (int, *dns.Msg) {
+	t.Helper()
+	wire, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, DoHContentType, bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, reply
+}
+
+func TestDoHRoundTrip(t *testing.T) {
+	listener, server := dohTestServer(t, nil)
+	client, err := DialDoH(DoHConfig{URL: server.URL + "/dns-query", Domain: testDoHDomain, QueriesPerSecond: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Frames larger than a query or an answer are split across several
+	up := bytes.Repeat([]byte("up"), 400)
+	down := bytes.Repeat([]byte("down"), 1500)
+	if err := client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteMessage(up); err != nil {
+		t.Fatal(err)
+	}
+	session := acceptDoH(t, listener)
+	for _, want := range [][]byte{[]byte("hello"), up} {
+		if frame := readWithin(t, session); !bytes.Equal(frame, want) {
+			t.Fatalf("server read %d bytes, want %d", len(frame), len(want))
+		}
+	}
+
+	for _, frame := range [][]byte{[]byte("welcome"), down} {
+		if err := session.WriteMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]byte{[]byte("welcome"), down} {
+		if frame := readWithin(t, client); !bytes.Equal(frame, want) {
+			t.Fatalf("client read %d bytes, want %d", len(frame), len(want))
+		}
+	}
+
+	// Ending the session on the server ends it on the client
+	session.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.ReadMessage(); !errors.Is(err, errDoHSessionGone) {
+		t.Errorf("ReadMessage() error = %v, want %v", err, errDoHSessionGone)
+	}
+}
+
+func TestDoHQueryName(t *testing.T) {
+	client := &DoHTransport{config: DoHConfig{Domain: dns.Fqdn(testDoHDomain)}, sessionID: [dohSessionIDSize]byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	listener := &DoHListener{domain: dns.Fqdn(testDoHDomain)}
+	chunk := bytes.Repeat([]byte{0xfb, 0xff, 0x01}, dohChunkSize(client.config.Domain)/3)
+
+	for _, data := range [][]byte{nil, []byte("frame"), chunk} {
+		name := client.queryName(7, data)
+		if len(name) > dohMaxName {
+			t.Errorf("name of %d characters for %d bytes", len(name), len(data))
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			t.Errorf("%q is not a valid name", name)
+		}
+		for _, label := range dns.SplitDomainName(name) {
+			if len(label) > dohMaxLabel {
+				t.Errorf("label of %d characters in %q", len(label), name)
+			}
+		}
+
+		// Resolvers may randomize the case of the domain (DNS 0x20), but
+		// the data labels are case sensitive
+		mixed := strings.TrimSuffix(name, testDoHDomain+".") + "T.Example.COM."
+		id, seq, decoded, ok := listener.parseQuery(dns.Question{Name: mixed, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		if !ok || id != client.sessionID || seq != 7 || !bytes.Equal(decoded, data) {
+			t.Errorf("parseQuery(%q) = %x, %d, %x, %v", mixed, id, seq, decoded, ok)
+		}
+	}
+
+	for _, question := range []dns.Question{
+		{Name: client.queryName(0, nil), Qtype: dns.TypeA},
+		{Name: "www.example.com.", Qtype: dns.TypeTXT},
+		{Name: "bad!label." + testDoHDomain + ".", Qtype: dns.TypeTXT},
+	} {
+		if _, _, _, ok := listener.parseQuery(question); ok {
+			t.Errorf("parseQuery(%s) accepted", question.String())
+		}
+	}
+
+	if _, err := DialDoH(DoHConfig{URL: "https://dns.example.com/dns-query", Domain: strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." + strings.Repeat("c", 60) + ".example.com"}); err == nil {
+		t.Error("DialDoH() accepted a domain leaving no room for data")
+	}
+}
+
+func TestDoHTXTAnswerEncoding(t *testing.T) {
+	session := &DoHTransport{queuedTransport: newQueuedTransport(meekAddr("test"))}
+	defer session.Close()
+	large := bytes.Repeat([]byte{0xa5}, dohMaxTXTStrings*dohTXTChunk)
+	session.WriteMessage([]byte("x"))
+	session.WriteMessage(large)
+
+	// The first answer is full; the rest follows in the next
+	query := new(dns.Msg).SetQuestion("q."+testDoHDomain+".", dns.TypeTXT)
+	var data []byte
+	for i := 0; i < 2; i++ {
+		strs := session.takeDownstream(t.Context(), false)
+		if i == 0 && len(strs) != dohMaxTXTStrings {
+			t.Fatalf("first answer has %d strings, want %d", len(strs), dohMaxTXTStrings)
+		}
+		for _, s := range strs {
+			if len(s) > 255 {
+				t.Fatalf("TXT string of %d characters", len(s))
+			}
+		}
+		chunk, err := decodeTXTAnswer(txtReply(query, strs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, chunk...)
+	}
+	frames, rest, err := splitMeekFrames(data)
+	if err != nil || len(rest) != 0 || len(frames) != 2 || string(frames[0]) != "x" || !bytes.Equal(frames[1], large) {
+		t.Fatalf("answers decoded to %d frames and %d bytes over, %v", len(frames), len(rest), err)
+	}
+
+	bad := txtReply(query, []string{"not base64!"})
+	if _, err := decodeTXTAnswer(bad); err == nil {
+		t.Error("invalid TXT string decoded")
+	}
+}
+
+func TestDoHPadding(t *testing.T) {
+	_, server := dohTestServer(t, nil)
+	client := &DoHTransport{config: DoHConfig{Domain: dns.Fqdn(testDoHDomain)}}
+
+	for _, data := range [][]byte{nil, []byte("frame"), bytes.Repeat([]byte{1}, 100)} {
+		query := new(dns.Msg).SetQuestion(client.queryName(0, data), dns.TypeTXT)
+		padDNSMessage(query, dohQueryPadBlock)
+		wire, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wire)%dohQueryPadBlock != 0 {
+			t.Errorf("query for %d bytes padded to %d bytes, want a multiple of %d", len(data), len(wire), dohQueryPadBlock)
+		}
+	}
+
+	// A padded query gets a padded answer; an unpadded one does not
+	query := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	_, reply := exchangeDoH(t, server.URL, query)
+	if reply.IsEdns0() != nil {
+		t.Error("answer to an unpadded query padded")
+	}
+	padDNSMessage(query, dohQueryPadBlock)
+	_, reply = exchangeDoH(t, server.URL, query)
+	if wire, _ := reply.Pack(); !wantsPadding(reply) || len(wire)%dohResponsePadBlock != 0 {
+		t.Errorf("answer to a padded query is %d bytes, want padding to a multiple of %d", len(wire), dohResponsePadBlock)
+	}
+
+	// Padding again replaces the old padding
+	padDNSMessage(reply, dohQueryPadBlock)
+	if opt := reply.IsEdns0(); len(opt.Option) != 1 {
+		t.Errorf("%d EDNS options after padding twice, want 1", len(opt.Option))
+	}
+}
+
+func TestDoHListenerAnswers(t *testing.T) {
+	forwarded := 0
+	listener, server := dohTestServer(t, func(query *dns.Msg) *dns.Msg {
+		forwarded++
+		reply := new(dns.Msg).SetReply(query)
+		reply.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{192, 0, 2, 1}}}
+		return reply
+	})
+	client := &DoHTransport{config: DoHConfig{Domain: dns.Fqdn(testDoHDomain)}, sessionID: [dohSessionIDSize]byte{9}}
+	tunnelQuery := func(seq uint32, data []byte) *dns.Msg {
+		return new(dns.Msg).SetQuestion(client.queryName(seq, data), dns.TypeTXT)
+	}
+
+	// Other names are resolved, so the endpoint passes for a resolver
+	if _, reply := exchangeDoH(t, server.URL, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)); forwarded != 1 || len(reply.Answer) != 1 {
+		t.Fatalf("ordinary query answered with %v, forwarded %d times", reply.Answer, forwarded)
+	}
+
+	// Queries after the first must belong to a session
+	if _, reply := exchangeDoH(t, server.URL, tunnelQuery(1, nil)); reply.Rcode != dns.RcodeNameError {
+		t.Errorf("query for an unknown session answered %s", dns.RcodeToString[reply.Rcode])
+	}
+
+	opening, _ := tunnelQuery(0, appendMeekFrame(nil, []byte("hi"))).Pack()
+	go func() {
+		if resp, err := http.Post(server.URL, DoHContentType, bytes.NewReader(opening)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	session := acceptDoH(t, listener)
+	if frame := readWithin(t, session); string(frame) != "hi" {
+		t.Fatalf("server read %q", frame)
+	}
+	session.WriteMessage([]byte("answer"))
+	_, first := exchangeDoH(t, server.URL, tunnelQuery(1, nil))
+
+	// A retried query gets the same answer; one from the future ends nothing
+	// but is refused
+	if _, again := exchangeDoH(t, server.URL, tunnelQuery(1, nil)); fmt.Sprint(again.Answer) != fmt.Sprint(first.Answer) {
+		t.Errorf("retried query answered %v, want %v", again.Answer, first.Answer)
+	}
+	if _, reply := exchangeDoH(t, server.URL, tunnelQuery(5, nil)); reply.Rcode != dns.RcodeNameError {
+		t.Errorf("query out of sequence answered %s", dns.RcodeToString[reply.Rcode])
+	}
+	if data, err := decodeTXTAnswer(first); err != nil || !bytes.Equal(data, appendMeekFrame(nil, []byte("answer"))) {
+		t.Errorf("answer carried %q, %v", data, err)
+	}
+
+	// Without a forwarder, other queries are refused
+	_, refusing := dohTestServer(t, nil)
+	if _, reply := exchangeDoH(t, refusing.URL, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)); reply.Rcode != dns.RcodeRefused {
+		t.Errorf("ordinary query answered %s without a forwarder", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestReadDoHQuery(t *testing.T) {
+	query := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	wire, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoQuestions := query.Copy()
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	twoWire, _ := twoQuestions.Pack()
+
+	get := func(param string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+param, nil)
+	}
+	post := func(contentType string, body []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+	for _, test := range []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"GET", get(base64.RawURLEncoding.EncodeToString(wire)), true},
+		{"POST", post(DoHContentType, wire), true},
+		{"GET padded base64", get(base64.URLEncoding.EncodeToString(wire) + "=="), false},
+		{"POST other content type", post("application/json", wire), false},
+		{"PUT", httptest.NewRequest(http.MethodPut, "/dns-query", bytes.NewReader(wire)), false},
+		{"truncated", post(DoHContentType, wire[:len(wire)-3]), false},
+		{"two questions", post(DoHContentType, twoWire), false},
+	} {
+		got, err := ReadDoHQuery(test.r)
+		if test.ok && (err != nil || got.Question[0] != query.Question[0]) {
+			t.Errorf("%s: ReadDoHQuery() = %v, %v", test.name, got, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
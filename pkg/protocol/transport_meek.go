@@ -0,0 +1,444 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MeekSessionHeader names the session a meek request belongs to, as in
+	// Tor's meek
+	MeekSessionHeader = "X-Session-Id"
+	// meekFrameHeaderSize is the length prepended to every frame in a body
+	meekFrameHeaderSize = 4
+	// meekMaxFrame bounds a single frame, so a bad length cannot exhaust memory
+	meekMaxFrame = 1 << 20
+	// meekMaxPayload is roughly how much data one request or response carries
+	meekMaxPayload = 64 << 10
+	// meekResponseWait is how long the server keeps streaming a response
+	// after the last frame in it, in case more follow
+	meekResponseWait = 50 * time.Millisecond
+	// meekMaxResponseTime bounds a response, so the client gets to send again
+	meekMaxResponseTime = time.Second
+	// meekMinPoll and meekMaxPoll bound how often an idle client polls; the
+	// interval grows between them while nothing flows
+	meekMinPoll = 100 * time.Millisecond
+	meekMaxPoll = 5 * time.Second
+	// meekInitialBackoff and meekMaxBackoff bound the wait after the CDN
+	// rejects or fails a request
+	meekInitialBackoff = time.Second
+	meekMaxBackoff     = time.Minute
+	// meekMaxFailures is how many requests in a row may fail before the
+	// transport gives up. Rate limiting does not count.
+	meekMaxFailures = 5
+	// meekSessionTimeout is how long the server keeps a session nobody polls
+	meekSessionTimeout = 2 * time.Minute
+)
+
+// errMeekSessionGone is returned once the server has ended the session
+var errMeekSessionGone = errors.New("meek session closed by server")
+
+// MeekConfig describes how a client reaches the server through a CDN
+type MeekConfig struct {
+	URL    string       // https URL on the front domain, with the server's path
+	Host   string       // Host header naming the real server to the CDN
+	Header http.Header  // sent with every request, such as a User-Agent
+	Client *http.Client // carries the requests; http.DefaultClient if nil
+}
+
+// MeekTransport carries frames in the bodies of HTTP POST requests and
+// their responses, as Tor's meek does. Requests go to a domain on a CDN
+// that censors cannot block without breaking large commercial services,
+// with a Host header that has the CDN forward them to the real server.
+// Clients poll while they have nothing to send, so that the server can
+// answer with its data; responses are streamed frame by frame.
+type MeekTransport struct {
+	*queuedTransport
+
+	// Client side
+	config    MeekConfig
+	sessionID string
+
+	// Server side
+	header    http.Header  // of the request that opened the session
+	requestMu sync.Mutex   // serves one request of the session at a time
+	lastSeen  atomic.Int64 // unix nanoseconds of the last request
+}
+
+// meekAddr is the address of a meek peer, the real server for clients
+// and the CDN's edge for the server
+type meekAddr string
+
+func (a meekAddr) Network() string { return "meek" }
+func (a meekAddr) String() string  { return string(a) }
+
+// newMeekTransport creates a transport with empty queues
+func newMeekTransport(remote string) *MeekTransport {
+	return &MeekTransport{queuedTransport: newQueuedTransport(meekAddr(remote))}
+}
+
+// DialMeek starts a client meek transport. No request is made until it
+// polls for the server's first frame, so errors surface on reads.
+func DialMeek(config MeekConfig) (*MeekTransport, error) {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	t := newMeekTransport(config.Host)
+	t.config = config
+	t.sessionID = hex.EncodeToString(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	go t.poll(ctx)
+	return t, nil
+}
+
+// poll sends queued frames to the server, or polls for its frames when
+// there are none, until the transport is closed or the server is lost
+func (t *MeekTransport) poll(ctx context.Context) {
+	var payload []byte
+	interval := time.Duration(0)
+	backoff := meekInitialBackoff
+	failures := 0
+
+	for {
+		if len(payload) == 0 {
+			var ok bool
+			if payload, ok = t.nextPayload(interval, meekMaxPayload); !ok {
+				return
+			}
+		}
+
+		received, status, retryAfter, err := t.roundTrip(ctx, payload)
+		switch {
+		case err == nil && status == http.StatusOK:
+			if len(payload) > 0 || received > 0 {
+				interval = 0
+			} else {
+				interval = min(max(interval*3/2, meekMinPoll), meekMaxPoll)
+			}
+			payload = payload[:0]
+			backoff = meekInitialBackoff
+			failures = 0
+			continue
+		case err == nil && status == http.StatusGone:
+			t.fail(errMeekSessionGone)
+			return
+		case err == nil && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable):
+			// The CDN turned the request away without forwarding it, so
+			// the payload is sent again once it lets us
+			if retryAfter > 0 {
+				backoff = retryAfter
+			}
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			// The server may have had the payload, and frames sent twice
+			// would not decrypt, so it is dropped
+			if err == nil {
+				err = fmt.Errorf("meek request failed: %s", http.StatusText(status))
+			}
+			if failures++; failures >= meekMaxFailures {
+				t.fail(err)
+				return
+			}
+			payload = payload[:0]
+		}
+
+		if !t.sleep(backoff) {
+			return
+		}
+		backoff = min(backoff*2, meekMaxBackoff)
+		interval = 0
+	}
+}
+
+// roundTrip posts payload and queues the frames streamed back, returning
+// how many there were, the status and how long the CDN asks us to wait
+func (t *MeekTransport) roundTrip(ctx context.Context, payload []byte) (int, int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for name, values := range t.config.Header {
+		req.Header[name] = values
+	}
+	req.Host = t.config.Host
+	req.Header.Set(MeekSessionHeader, t.sessionID)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := t.config.Client.Do(req)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, meekMaxPayload))
+		return 0, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), nil
+	}
+
+	received := 0
+	body := bufio.NewReader(resp.Body)
+	for {
+		frame, err := readMeekFrame(body)
+		if err == io.EOF {
+			return received, resp.StatusCode, 0, nil
+		}
+		if err != nil {
+			return received, resp.StatusCode, 0, err
+		}
+		select {
+		case t.incoming <- frame:
+			received++
+		case <-t.done:
+			return received, resp.StatusCode, 0, ErrTransportClosed
+		}
+	}
+}
+
+// parseRetryAfter returns the wait a Retry-After header asks for, in
+// seconds or until a date, or 0 if there is none
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, meekMaxBackoff)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(date), 0), meekMaxBackoff)
+	}
+	return 0
+}
+
+// appendMeekFrame appends frame to a body with its length in front
+func appendMeekFrame(body, frame []byte) []byte {
+	body = binary.BigEndian.AppendUint32(body, uint32(len(frame)))
+	return append(body, frame...)
+}
+
+// readMeekFrame reads the next length-prefixed frame of a body, returning
+// io.EOF at its end
+func readMeekFrame(r io.Reader) ([]byte, error) {
+	var header [meekFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated meek frame")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > meekMaxFrame {
+		return nil, fmt.Errorf("meek frame of %d bytes is too large", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("truncated meek frame")
+	}
+	return frame, nil
+}
+
+// Header returns the headers of the request that opened a server-side
+// session
+func (t *MeekTransport) Header() http.Header {
+	return t.header
+}
+
+// MeekListener is the server side of the meek transport, an HTTP handler
+// that turns the requests of each session into a transport
+type MeekListener struct {
+	mu       sync.Mutex
+	sessions map[string]*MeekTransport // includes ended sessions until they expire
+	accept   chan *MeekTransport
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewMeekListener creates a listener to register on the server's HTTPS mux
+func NewMeekListener() *MeekListener {
+	l := &MeekListener{
+		sessions: make(map[string]*MeekTransport),
+		accept:   make(chan *MeekTransport),
+		done:     make(chan struct{}),
+	}
+	go l.expireSessions()
+	return l
+}
+
+// Accept waits for a request opening a new session
+func (l *MeekListener) Accept() (*MeekTransport, error) {
+	select {
+	case t := <-l.accept:
+		return t, nil
+	case <-l.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Close stops the listener and ends every session
+func (l *MeekListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, t := range l.sessions {
+			t.Close()
+		}
+	})
+	return nil
+}
+
+// expireSessions forgets sessions whose client stopped polling
+func (l *MeekListener) expireSessions() {
+	ticker := time.NewTicker(meekSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+		cutoff := time.Now().Add(-meekSessionTimeout).UnixNano()
+		l.mu.Lock()
+		for id, t := range l.sessions {
+			if t.lastSeen.Load() < cutoff {
+				t.Close()
+				delete(l.sessions, id)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// ServeHTTP queues the frames a client posted for its session and streams
+// back what the session has for it
+func (l *MeekListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(MeekSessionHeader)
+	if r.Method != http.MethodPost || id == "" || len(id) > 64 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// Read the whole body first, so a malformed one changes nothing
+	var frames [][]byte
+	body := bufio.NewReader(io.LimitReader(r.Body, meekMaxPayload+meekMaxFrame))
+	for {
+		frame, err := readMeekFrame(body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		frames = append(frames, frame)
+	}
+
+	t, err := l.session(r, id)
+	if err != nil {
+		return
+	}
+	t.requestMu.Lock()
+	defer t.requestMu.Unlock()
+	t.lastSeen.Store(time.Now().UnixNano())
+	if t.closed() {
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+
+	for _, frame := range frames {
+		select {
+		case t.incoming <- frame:
+		case <-t.done:
+			http.Error(w, "Gone", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	t.stream(r.Context(), w)
+}
+
+// session returns the session with id, creating it and handing it to
+// Accept if it is new
+func (l *MeekListener) session(r *http.Request, id string) (*MeekTransport, error) {
+	l.mu.Lock()
+	t, ok := l.sessions[id]
+	if !ok {
+		t = newMeekTransport(r.RemoteAddr)
+		t.header = r.Header.Clone()
+		t.lastSeen.Store(time.Now().UnixNano())
+		l.sessions[id] = t
+	}
+	l.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	select {
+	case l.accept <- t:
+		return t, nil
+	case <-l.done:
+	case <-r.Context().Done():
+	}
+	l.mu.Lock()
+	delete(l.sessions, id)
+	l.mu.Unlock()
+	return nil, ErrTransportClosed
+}
+
+// stream writes queued frames to a response as they come, flushing each,
+// until none has come for a while or the response has run long enough for
+// the client to want to send
+func (t *MeekTransport) stream(ctx context.Context, w http.ResponseWriter) {
+	flusher := http.NewResponseController(w)
+	end := time.Now().Add(meekMaxResponseTime)
+	sent := 0
+	for sent < meekMaxPayload {
+		wait := min(meekResponseWait, time.Until(end))
+		if wait <= 0 {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case frame := <-t.outgoing:
+			timer.Stop()
+			if _, err := w.Write(appendMeekFrame(nil, frame)); err != nil {
+				return
+			}
+			if err := flusher.Flush(); err != nil {
+				return
+			}
+			sent += len(frame)
+		case <-timer.C:
+			return
+		case <-t.done:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
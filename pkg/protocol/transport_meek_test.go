@@ -0,0 +1,224 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// meekTestServer serves a MeekListener behind front, a handler standing in
+// for the CDN that may answer a request itself by returning true
+func meekTestServer(t *testing.T, front func(w http.ResponseWriter, r *http.Request) bool) (*MeekListener, *httptest.Server) {
+	t.Helper()
+	listener := NewMeekListener()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if front != nil && front(w, r) {
+			return
+		}
+		listener.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		listener.Close()
+		server.Close()
+	})
+	return listener, server
+}
+
+// acceptMeek waits for the listener's next session
+func acceptMeek(t *testing.T, listener *MeekListener) *MeekTransport {
+	t.Helper()
+	accepted := make(chan *MeekTransport, 1)
+	go func() {
+		session, err := listener.Accept()
+		if err == nil {
+			accepted <- session
+		}
+	}()
+	select {
+	case session := <-accepted:
+		return session
+	case <-time.After(5 * time.Second):
+		t.Fatal("no meek session opened")
+		return nil
+	}
+}
+
+// readWithin reads the next frame from transport, failing after a few seconds
+func readWithin(t *testing.T, transport Transport) []byte {
+	t.Helper()
+	transport.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := transport.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestMeekRoundTrip(t *testing.T) {
+	var mu sync.Mutex
+	var hosts, sessionIDs []string
+	listener, server := meekTestServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts = append(hosts, r.Host)
+		sessionIDs = append(sessionIDs, r.Header.Get(MeekSessionHeader))
+		return false
+	})
+
+	client, err := DialMeek(MeekConfig{
+		URL:    server.URL + "/assets/sync",
+		Host:   "vpn.example.com",
+		Header: http.Header{"User-Agent": {"Mozilla/5.0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Frames the client sends arrive in order, on one session
+	for i := 0; i < 3; i++ {
+		if err := client.WriteMessage([]byte(fmt.Sprintf("up %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session := acceptMeek(t, listener)
+	for i := 0; i < 3; i++ {
+		if frame := readWithin(t, session); string(frame) != fmt.Sprintf("up %d", i) {
+			t.Fatalf("server read %q, want %q", frame, fmt.Sprintf("up %d", i))
+		}
+	}
+	if got := session.Header().Get("User-Agent"); got != "Mozilla/5.0" {
+		t.Errorf("session opened with User-Agent %q", got)
+	}
+
+	// The server's frames reach the client on its polls, large ones too
+	large := bytes.Repeat([]byte{0xa5}, 3*meekMaxPayload/2)
+	for _, frame := range [][]byte{[]byte("down"), large, []byte("after")} {
+		if err := session.WriteMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]byte{[]byte("down"), large, []byte("after")} {
+		if frame := readWithin(t, client); !bytes.Equal(frame, want) {
+			t.Fatalf("client read %d bytes, want %d", len(frame), len(want))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hosts) < 2 {
+		t.Fatalf("%d requests made, want the client to have polled", len(hosts))
+	}
+	for i := range hosts {
+		if hosts[i] != "vpn.example.com" || sessionIDs[i] != sessionIDs[0] || sessionIDs[0] == "" {
+			t.Fatalf("request %d for host %q, session %q; want every one for vpn.example.com on session %q", i, hosts[i], sessionIDs[i], sessionIDs[0])
+		}
+	}
+}
+
+func TestMeekRetriesWhenRateLimited(t *testing.T) {
+	var mu sync.Mutex
+	limited := false
+	listener, server := meekTestServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if limited {
+			return false
+		}
+		limited = true
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	})
+	client, err := DialMeek(MeekConfig{URL: server.URL, Host: "vpn.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The CDN never forwarded the first request, so its frame is sent again
+	start := time.Now()
+	client.WriteMessage([]byte("hello"))
+	session := acceptMeek(t, listener)
+	if frame := readWithin(t, session); string(frame) != "hello" {
+		t.Fatalf("server read %q, want the frame sent again", frame)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want the wait Retry-After asked for", elapsed)
+	}
+}
+
+func TestMeekSessionClosedByServer(t *testing.T) {
+	listener, server := meekTestServer(t, nil)
+	client, err := DialMeek(MeekConfig{URL: server.URL, Host: "vpn.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.WriteMessage([]byte("hello"))
+	acceptMeek(t, listener).Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.ReadMessage(); !errors.Is(err, errMeekSessionGone) {
+		t.Errorf("ReadMessage() error = %v, want %v", err, errMeekSessionGone)
+	}
+}
+
+func TestMeekListenerRejectsBadRequests(t *testing.T) {
+	_, server := meekTestServer(t, nil)
+	for _, test := range []struct {
+		name      string
+		method    string
+		sessionID string
+		body      []byte
+	}{
+		{"GET", http.MethodGet, "abc", nil},
+		{"no session", http.MethodPost, "", nil},
+		{"long session", http.MethodPost, strings.Repeat("a", 65), nil},
+		{"truncated frame", http.MethodPost, "abc", appendMeekFrame(nil, []byte("frame"))[:6]},
+		{"oversized frame", http.MethodPost, "abc", []byte{0xff, 0xff, 0xff, 0xff}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL, bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.sessionID != "" {
+				req.Header.Set(MeekSessionHeader, test.sessionID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("answered %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"86400", meekMaxBackoff},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	} {
+		if got := parseRetryAfter(test.value); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// queuedTransportSize is how many frames may wait in each direction
+const queuedTransportSize = 256
+
+// queuedTransport is the part of a request-based transport, such as meek,
+// that applications see: frames queued in each direction, which the
+// transport's own loop or handler carries over the wire
+type queuedTransport struct {
+	incoming chan []byte
+	outgoing chan []byte
+	remote   net.Addr
+
+	readDeadline  queueDeadline
+	writeDeadline queueDeadline
+
+	mu        sync.Mutex
+	err       error // why the transport is done
+	done      chan struct{}
+	closeOnce sync.Once
+	cancel    context.CancelFunc // stops a client's loop; nil on the server
+}
+
+// newQueuedTransport creates a transport with empty queues
+func newQueuedTransport(remote net.Addr) *queuedTransport {
+	return &queuedTransport{
+		incoming:      make(chan []byte, queuedTransportSize),
+		outgoing:      make(chan []byte, queuedTransportSize),
+		remote:        remote,
+		readDeadline:  newQueueDeadline(),
+		writeDeadline: newQueueDeadline(),
+		done:          make(chan struct{}),
+	}
+}
+
+// ReadMessage returns the next frame from the peer
+func (t *queuedTransport) ReadMessage() ([]byte, error) {
+	for {
+		timeout, stop := t.readDeadline.timer()
+		select {
+		case frame := <-t.incoming:
+			stop()
+			return frame, nil
+		case <-t.done:
+			stop()
+			return nil, t.doneErr()
+		case <-timeout:
+			return nil, os.ErrDeadlineExceeded
+		case <-t.readDeadline.changed:
+			stop()
+		}
+	}
+}
+
+// WriteMessage queues data for the next request or response, waiting for
+// room while the peer falls behind
+func (t *queuedTransport) WriteMessage(data []byte) error {
+	frame := append([]byte(nil), data...)
+	for {
+		timeout, stop := t.writeDeadline.timer()
+		select {
+		case t.outgoing <- frame:
+			stop()
+			return nil
+		case <-t.done:
+			stop()
+			return t.doneErr()
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-t.writeDeadline.changed:
+			stop()
+		}
+	}
+}
+
+// SetReadDeadline sets the deadline for reads, applying it to a read in
+// progress
+func (t *queuedTransport) SetReadDeadline(deadline time.Time) error {
+	t.readDeadline.set(deadline)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes, applying it to writes in
+// progress
+func (t *queuedTransport) SetWriteDeadline(deadline time.Time) error {
+	t.writeDeadline.set(deadline)
+	return nil
+}
+
+// RemoteAddr returns the real server for clients, and the address the
+// session's first request came from for the server, which may be a CDN's
+// or a resolver's
+func (t *queuedTransport) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+// QueueDepth returns how many frames wait to be sent
+func (t *queuedTransport) QueueDepth() int {
+	return len(t.outgoing)
+}
+
+// Close ends the transport. Clients stop polling; on the server the
+// session is forgotten once the client gives up on it.
+func (t *queuedTransport) Close() error {
+	t.fail(ErrTransportClosed)
+	return nil
+}
+
+// fail ends the transport with err
+func (t *queuedTransport) fail(err error) {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		close(t.done)
+		if t.cancel != nil {
+			t.cancel()
+		}
+	})
+}
+
+// doneErr returns why the transport ended
+func (t *queuedTransport) doneErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// closed reports whether the transport has ended
+func (t *queuedTransport) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextPayload waits up to interval for a frame to send, then encodes it and
+// those queued behind it until the payload reaches limit bytes. The payload
+// is empty if there was none, and ok is false once the transport is closed.
+func (t *queuedTransport) nextPayload(interval time.Duration, limit int) (payload []byte, ok bool) {
+	var frame []byte
+	got := false
+	if interval > 0 {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		select {
+		case frame = <-t.outgoing:
+			got = true
+		case <-timer.C:
+		case <-t.done:
+			return nil, false
+		}
+	} else {
+		select {
+		case frame = <-t.outgoing:
+			got = true
+		case <-t.done:
+			return nil, false
+		default:
+		}
+	}
+
+	for got {
+		payload = appendMeekFrame(payload, frame)
+		if len(payload) >= limit {
+			break
+		}
+		select {
+		case frame = <-t.outgoing:
+		default:
+			got = false
+		}
+	}
+	return payload, true
+}
+
+// sleep waits for d, returning false if the transport is closed first
+func (t *queuedTransport) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// queueDeadline is a deadline that can be moved while a read or write
+// waits on it
+type queueDeadline struct {
+	mu      sync.Mutex
+	at      time.Time
+	changed chan struct{}
+}
+
+func newQueueDeadline() queueDeadline {
+	return queueDeadline{changed: make(chan struct{}, 1)}
+}
+
+// set moves the deadline, waking a waiter to apply it
+func (d *queueDeadline) set(at time.Time) {
+	d.mu.Lock()
+	d.at = at
+	d.mu.Unlock()
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// timer returns a channel that fires at the deadline, nil if there is
+// none, and a function releasing it
+func (d *queueDeadline) timer() (<-chan time.Time, func()) {
+	d.mu.Lock()
+	at := d.at
+	d.mu.Unlock()
+	if at.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(at))
+	return timer.C, func() { timer.Stop() }
+}
@@ -0,0 +1,354 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpHeaderSize is the sequence number prepended to every datagram
+	udpHeaderSize = 8
+	// maxDatagramSize is the largest UDP payload over IPv4
+	maxDatagramSize = 65507
+	// udpInboxSize is how many datagrams may queue for a server-side peer
+	udpInboxSize = 256
+)
+
+// ErrTransportClosed is returned when reading from or writing to a closed transport
+var ErrTransportClosed = errors.New("transport closed")
+
+// UDPTransport carries frames as sequenced datagrams. It provides ordering
+// only; confidentiality and integrity come from the encryption layers, and
+// lost datagrams are left to the tunneled protocols to recover.
+type UDPTransport struct {
+	recv     func() ([]byte, error)
+	send     func([]byte) error
+	close    func() error
+	deadline func(time.Time) error
+	// writeDeadline is nil where writes never block
+	writeDeadline func(time.Time) error
+	remote        net.Addr
+
+	sendSeq atomic.Uint64
+	reorder *reorderBuffer
+	ready   [][]byte
+	readMu  sync.Mutex
+
+	// readDeadline is the caller's read deadline. Reads wait on an earlier
+	// one while a gap is open, to release the datagrams held behind it.
+	readDeadline time.Time
+	deadlineMu   sync.Mutex
+}
+
+// ReadMessage returns the next frame in sequence order
+func (t *UDPTransport) ReadMessage() ([]byte, error) {
+	t.readMu.Lock()
+	defer t.readMu.Unlock()
+
+	for len(t.ready) == 0 {
+		if t.ready = t.reorder.expire(time.Now()); len(t.ready) > 0 {
+			break
+		}
+
+		gap, waiting := t.reorder.expiry()
+		if waiting {
+			if err := t.applyDeadline(gap); err != nil {
+				return nil, err
+			}
+		}
+		datagram, err := t.recv()
+		if waiting {
+			t.applyDeadline(time.Time{})
+		}
+		if err != nil {
+			if waiting && errors.Is(err, os.ErrDeadlineExceeded) && !t.deadlinePassed() {
+				continue
+			}
+			return nil, err
+		}
+		if len(datagram) < udpHeaderSize {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(datagram[:udpHeaderSize])
+		t.ready = t.reorder.push(seq, datagram[udpHeaderSize:])
+	}
+
+	frame := t.ready[0]
+	t.ready = t.ready[1:]
+	return frame, nil
+}
+
+// WriteMessage sends data as a single datagram
+func (t *UDPTransport) WriteMessage(data []byte) error {
+	if len(data)+udpHeaderSize > maxDatagramSize {
+		return errors.New("frame too large for a datagram")
+	}
+
+	datagram := make([]byte, udpHeaderSize+len(data))
+	binary.BigEndian.PutUint64(datagram, t.sendSeq.Add(1)-1)
+	copy(datagram[udpHeaderSize:], data)
+	return t.send(datagram)
+}
+
+// SetReadDeadline sets the deadline for the next read
+func (t *UDPTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	t.readDeadline = deadline
+	return t.deadline(deadline)
+}
+
+// applyDeadline sets the underlying read deadline to gap or the caller's
+// deadline, whichever is sooner. A zero gap restores the caller's.
+func (t *UDPTransport) applyDeadline(gap time.Time) error {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	deadline := t.readDeadline
+	if !gap.IsZero() && (deadline.IsZero() || gap.Before(deadline)) {
+		deadline = gap
+	}
+	return t.deadline(deadline)
+}
+
+// deadlinePassed reports whether the caller's read deadline has passed
+func (t *UDPTransport) deadlinePassed() bool {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	return !t.readDeadline.IsZero() && !time.Now().Before(t.readDeadline)
+}
+
+// SetWriteDeadline sets the deadline for writes
+func (t *UDPTransport) SetWriteDeadline(deadline time.Time) error {
+	if t.writeDeadline == nil {
+		return nil
+	}
+	return t.writeDeadline(deadline)
+}
+
+// RemoteAddr returns the peer's address
+func (t *UDPTransport) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+// Close releases the transport
+func (t *UDPTransport) Close() error {
+	return t.close()
+}
+
+// DialUDP opens a client UDP transport to the server
+func DialUDP(address string) (*UDPTransport, error) {
+	return DialUDPContext(context.Background(), address)
+}
+
+// DialUDPContext opens a client UDP transport to the server, giving up on
+// resolving the address when ctx is done
+func DialUDPContext(ctx context.Context, address string) (*UDPTransport, error) {
+	return DialUDPWithDialer(ctx, &net.Dialer{}, address)
+}
+
+// DialUDPWithDialer opens a client UDP transport using dialer, for callers
+// that need to adjust the socket before it connects
+func DialUDPWithDialer(ctx context.Context, dialer *net.Dialer, address string) (*UDPTransport, error) {
+	return DialUDPWithOptions(ctx, dialer, address, SocketOptions{})
+}
+
+// DialUDPWithOptions opens a client UDP transport using dialer, with the
+// socket's buffers sized by options
+func DialUDPWithOptions(ctx context.Context, dialer *net.Dialer, address string, options SocketOptions) (*UDPTransport, error) {
+	c, err := options.DialContext(dialer)(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UDPConn)
+	raddr := conn.RemoteAddr().(*net.UDPAddr)
+
+	buffer := make([]byte, maxDatagramSize)
+	t := &UDPTransport{
+		recv: func() ([]byte, error) {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return nil, err
+			}
+			datagram := make([]byte, n)
+			copy(datagram, buffer[:n])
+			return datagram, nil
+		},
+		send: func(datagram []byte) error {
+			_, err := conn.Write(datagram)
+			return err
+		},
+		close:         conn.Close,
+		deadline:      conn.SetReadDeadline,
+		writeDeadline: conn.SetWriteDeadline,
+		remote:        raddr,
+		reorder:       newReorderBuffer(reorderWindow, reorderTimeout),
+	}
+	return t, nil
+}
+
+// UDPListener demultiplexes datagrams from many clients on one socket into
+// a transport per client address
+type UDPListener struct {
+	conn   *net.UDPConn
+	peers  map[string]*udpPeer
+	mu     sync.Mutex
+	accept chan *UDPTransport
+	done   chan struct{}
+}
+
+// udpPeer is the server-side state for one client address
+type udpPeer struct {
+	inbox    chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	deadline atomic.Int64 // unix nanoseconds, 0 for none
+}
+
+// ListenUDP starts accepting UDP transports on address
+func ListenUDP(address string) (*UDPListener, error) {
+	return ListenUDPWithOptions(address, SocketOptions{})
+}
+
+// ListenUDPWithOptions starts accepting UDP transports on address, with the
+// socket's buffers sized by options. Every client shares the one socket, so
+// its receive buffer is what absorbs bursts from all of them.
+func ListenUDPWithOptions(address string, options SocketOptions) (*UDPListener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	l := &UDPListener{
+		conn:   conn,
+		peers:  make(map[string]*udpPeer),
+		accept: make(chan *UDPTransport),
+		done:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// Accept waits for a datagram from a new client address
+func (l *UDPListener) Accept() (*UDPTransport, error) {
+	select {
+	case t := <-l.accept:
+		return t, nil
+	case <-l.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Addr returns the address the listener is bound to
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops the listener
+func (l *UDPListener) Close() error {
+	return l.conn.Close()
+}
+
+// readLoop dispatches incoming datagrams to their peer
+func (l *UDPListener) readLoop() {
+	defer close(l.done)
+	buffer := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+
+		l.mu.Lock()
+		peer, ok := l.peers[addr.String()]
+		if !ok {
+			peer = &udpPeer{
+				inbox:  make(chan []byte, udpInboxSize),
+				closed: make(chan struct{}),
+			}
+			l.peers[addr.String()] = peer
+		}
+		l.mu.Unlock()
+
+		if !ok {
+			select {
+			case l.accept <- l.newPeerTransport(addr, peer):
+			case <-l.done:
+				return
+			}
+		}
+
+		// Drop rather than block the whole listener on a slow peer
+		select {
+		case peer.inbox <- datagram:
+		default:
+		}
+	}
+}
+
+// newPeerTransport creates the server-side transport for a client address
+func (l *UDPListener) newPeerTransport(addr *net.UDPAddr, peer *udpPeer) *UDPTransport {
+	t := &UDPTransport{
+		recv: peer.receive,
+		send: func(datagram []byte) error {
+			_, err := l.conn.WriteToUDP(datagram, addr)
+			return err
+		},
+		close: func() error {
+			peer.once.Do(func() {
+				close(peer.closed)
+				l.mu.Lock()
+				delete(l.peers, addr.String())
+				l.mu.Unlock()
+			})
+			return nil
+		},
+		remote:  addr,
+		reorder: newReorderBuffer(reorderWindow, reorderTimeout),
+	}
+	t.deadline = func(deadline time.Time) error {
+		if deadline.IsZero() {
+			peer.deadline.Store(0)
+		} else {
+			peer.deadline.Store(deadline.UnixNano())
+		}
+		return nil
+	}
+	return t
+}
+
+// receive waits for the next datagram, honouring the read deadline
+func (p *udpPeer) receive() ([]byte, error) {
+	var timeout <-chan time.Time
+	if deadline := p.deadline.Load(); deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-p.inbox:
+		return datagram, nil
+	case <-p.closed:
+		return nil, ErrTransportClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
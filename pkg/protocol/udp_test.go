@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// udpPair returns a client transport and the listener's transport for it
+func udpPair(t *testing.T) (client, server *UDPTransport) {
+	t.Helper()
+	listener, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	client, err = DialUDP(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	if frame, err := server.ReadMessage(); err != nil || string(frame) != "hello" {
+		t.Fatalf("server read %q, %v", frame, err)
+	}
+	return client, server
+}
+
+func TestUDPTransportRoundTrip(t *testing.T) {
+	client, server := udpPair(t)
+
+	if err := server.WriteMessage([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if frame, err := client.ReadMessage(); err != nil || string(frame) != "reply" {
+		t.Fatalf("client read %q, %v", frame, err)
+	}
+
+	if err := client.WriteMessage(make([]byte, maxDatagramSize)); err == nil {
+		t.Error("frame larger than a datagram sent")
+	}
+}
+
+// rawUDPPeer sends the given datagrams, each sequence number with a
+// one-letter frame, to a new listener and returns the listener's transport
+func rawUDPPeer(t *testing.T, seqs ...uint64) *UDPTransport {
+	t.Helper()
+	listener, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	for _, seq := range seqs {
+		datagram := binary.BigEndian.AppendUint64(nil, seq)
+		if _, err := conn.Write(append(datagram, byte('a'+seq))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	return server
+}
+
+// readFrames reads len(want) frames from transport and checks them
+func readFrames(t *testing.T, transport Transport, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if frame, err := transport.ReadMessage(); err != nil || string(frame) != w {
+			t.Fatalf("read %q, %v, want %q", frame, err, w)
+		}
+	}
+}
+
+func TestUDPTransportReordersDatagrams(t *testing.T) {
+	// Sequence numbers 1 and 2 arrive before 0, and 1 twice
+	server := rawUDPPeer(t, 1, 2, 1, 0)
+	readFrames(t, server, "a", "b", "c")
+}
+
+func TestUDPTransportSkipsLostDatagrams(t *testing.T) {
+	// 1 never arrives; 2 is delivered once the gap has been open for
+	// reorderTimeout
+	server := rawUDPPeer(t, 0, 2)
+	start := time.Now()
+	readFrames(t, server, "a", "c")
+	if elapsed := time.Since(start); elapsed < reorderTimeout {
+		t.Errorf("gap given up after %v, before the %v timeout", elapsed, reorderTimeout)
+	}
+}
+
+func TestUDPTransportReadDeadline(t *testing.T) {
+	client, server := udpPair(t)
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := server.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("server read error = %v, want a deadline error", err)
+	}
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := client.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("client read error = %v, want a deadline error", err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	server.Close()
+	if _, err := server.ReadMessage(); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("read after Close error = %v, want %v", err, ErrTransportClosed)
+	}
+}
+
+func TestWriteMessageContextCancelled(t *testing.T) {
+	client, _ := udpPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WriteMessageContext(ctx, client, []byte("late")); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteMessageContext() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,31 @@
+// Package routing sets up Linux policy routing so chosen processes bypass
+// the tunnel while everything else goes through it.
+package routing
+
+const (
+	// DefaultTable is the routing table holding the routes that bypass the
+	// tunnel
+	DefaultTable = 200
+	// DefaultMark is the firewall mark of packets that bypass the tunnel
+	DefaultMark = 0x1
+	// BypassClassID is the net_cls class ID given to bypass cgroups, 10:1
+	BypassClassID = 0x00100001
+)
+
+// Config selects the traffic that bypasses the tunnel
+type Config struct {
+	Table         int      // routing table of the bypass routes; DefaultTable if zero
+	Mark          uint32   // firewall mark of bypassing packets; DefaultMark if zero
+	BypassCgroups []string // net_cls cgroups whose processes bypass the tunnel
+}
+
+// withDefaults returns the config with unset fields filled in
+func (c Config) withDefaults() Config {
+	if c.Table == 0 {
+		c.Table = DefaultTable
+	}
+	if c.Mark == 0 {
+		c.Mark = DefaultMark
+	}
+	return c
+}
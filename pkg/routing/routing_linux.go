@@ -0,0 +1,256 @@
+//go:build linux
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netClsRoot is where the cgroup v1 net_cls hierarchy is mounted
+	netClsRoot = "/sys/fs/cgroup/net_cls"
+	// rulePriority puts the bypass rule ahead of the main table's
+	rulePriority = 100
+	// srcValidMark makes reverse path filtering honor the mark restored on
+	// replies, which arrive on the physical interface
+	srcValidMark = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+)
+
+// PolicyRouter routes marked packets through the physical interface instead
+// of the tunnel. The tunnel's routes stay in the main table; the bypass
+// table, 200 by default, gets copies of the default routes outside the
+// tunnel, and a rule sends packets carrying the mark to it. Processes in the bypass cgroups get the mark from
+// iptables.
+type PolicyRouter struct {
+	config  Config
+	tunName string
+
+	routes       []netlink.Route
+	rules        []*netlink.Rule
+	iptables     [][]string // rules added, with the command as first element
+	cgroups      []string   // cgroup directories created
+	oldValidMark []byte     // the src_valid_mark setting to restore, if changed
+}
+
+// NewPolicyRouter prepares policy routing around the tunnel interface
+// tunName. Nothing changes until Apply.
+func NewPolicyRouter(tunName string, config Config) (*PolicyRouter, error) {
+	config = config.withDefaults()
+	if config.Table <= 0 || config.Table == unix.RT_TABLE_MAIN || config.Table == unix.RT_TABLE_LOCAL || config.Table == unix.RT_TABLE_DEFAULT {
+		return nil, fmt.Errorf("routing table %d is reserved", config.Table)
+	}
+	for _, name := range config.BypassCgroups {
+		if name == "" || strings.Contains(name, "..") || filepath.IsAbs(name) {
+			return nil, fmt.Errorf("invalid cgroup name %q", name)
+		}
+	}
+	return &PolicyRouter{config: config, tunName: tunName}, nil
+}
+
+// Apply installs the bypass table, rule and marks. On failure whatever was
+// installed is removed again.
+func (r *PolicyRouter) Apply() error {
+	if err := r.apply(); err != nil {
+		r.Close()
+		return err
+	}
+	return nil
+}
+
+func (r *PolicyRouter) apply() error {
+	tun, err := netlink.LinkByName(r.tunName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", r.tunName, err)
+	}
+
+	physical := make(map[int]string) // outgoing interfaces by family
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := defaultRoutes(family, tun.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			route.Table = r.config.Table
+			if err := netlink.RouteReplace(&route); err != nil {
+				return fmt.Errorf("failed to add bypass route: %v", err)
+			}
+			r.routes = append(r.routes, route)
+			if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+				physical[family] = link.Attrs().Name
+			}
+		}
+		if len(routes) == 0 {
+			continue
+		}
+
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Mark = r.config.Mark
+		rule.Table = r.config.Table
+		rule.Priority = rulePriority
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add rule for mark %#x: %v", r.config.Mark, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if len(r.routes) == 0 {
+		return errors.New("no default route outside the tunnel to bypass it with")
+	}
+
+	if len(r.config.BypassCgroups) == 0 {
+		return nil
+	}
+	if err := r.markCgroups(physical); err != nil {
+		return err
+	}
+	return r.enableValidMark()
+}
+
+// defaultRoutes returns the main table's default routes of family that do
+// not go through the tunnel
+func defaultRoutes(family, tunIndex int) ([]netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil && !errors.Is(err, netlink.ErrDumpInterrupted) {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	var defaults []netlink.Route
+	for _, route := range routes {
+		if route.LinkIndex == tunIndex || !isDefault(route.Dst) {
+			continue
+		}
+		defaults = append(defaults, netlink.Route{
+			Family:    route.Family,
+			LinkIndex: route.LinkIndex,
+			Gw:        route.Gw,
+			Priority:  route.Priority,
+		})
+	}
+	return defaults, nil
+}
+
+// isDefault reports whether dst covers every address
+func isDefault(dst *net.IPNet) bool {
+	if dst == nil {
+		return true
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// markCgroups gives the bypass cgroups their class ID and has iptables mark
+// their packets. Marked connections keep the mark on their replies, and
+// leave with the physical interface's address rather than the tunnel's,
+// which the kernel picked before the mark rerouted them.
+func (r *PolicyRouter) markCgroups(physical map[int]string) error {
+	if _, err := os.Stat(netClsRoot); err != nil {
+		return fmt.Errorf("net_cls cgroups are not mounted at %s", netClsRoot)
+	}
+	classID := strconv.FormatUint(BypassClassID, 10)
+	for _, name := range r.config.BypassCgroups {
+		dir := filepath.Join(netClsRoot, name)
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create cgroup %s: %v", name, err)
+			}
+			r.cgroups = append(r.cgroups, dir)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "net_cls.classid"), []byte(classID), 0644); err != nil {
+			return fmt.Errorf("failed to set class of cgroup %s: %v", name, err)
+		}
+	}
+
+	mark := fmt.Sprintf("%#x", r.config.Mark)
+	commands := map[int]string{netlink.FAMILY_V4: "iptables", netlink.FAMILY_V6: "ip6tables"}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		iface, ok := physical[family]
+		if !ok {
+			continue
+		}
+		rules := [][]string{
+			{"-t", "mangle", "-A", "OUTPUT", "-m", "cgroup", "--cgroup", fmt.Sprintf("%#x", BypassClassID), "-j", "MARK", "--set-mark", mark},
+			{"-t", "mangle", "-A", "OUTPUT", "-m", "mark", "--mark", mark, "-j", "CONNMARK", "--save-mark"},
+			{"-t", "mangle", "-A", "PREROUTING", "-m", "connmark", "--mark", mark, "-j", "CONNMARK", "--restore-mark"},
+			{"-t", "nat", "-A", "POSTROUTING", "-m", "mark", "--mark", mark, "-o", iface, "-j", "MASQUERADE"},
+		}
+		for _, rule := range rules {
+			if err := runCommand(commands[family], rule...); err != nil {
+				return err
+			}
+			r.iptables = append(r.iptables, append([]string{commands[family]}, rule...))
+		}
+	}
+	return nil
+}
+
+// enableValidMark lets replies to marked connections pass reverse path
+// filtering
+func (r *PolicyRouter) enableValidMark() error {
+	old, err := os.ReadFile(srcValidMark)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(old)) == "1" {
+		return nil
+	}
+	if err := os.WriteFile(srcValidMark, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable src_valid_mark: %v", err)
+	}
+	r.oldValidMark = old
+	return nil
+}
+
+// Close removes everything Apply installed. Processes still in a bypass
+// cgroup keep it, so only cgroups that are empty are removed.
+func (r *PolicyRouter) Close() error {
+	var errs []error
+	if r.oldValidMark != nil {
+		errs = append(errs, os.WriteFile(srcValidMark, r.oldValidMark, 0644))
+		r.oldValidMark = nil
+	}
+	for i := len(r.iptables) - 1; i >= 0; i-- {
+		rule := append([]string(nil), r.iptables[i]...)
+		for j, arg := range rule {
+			if arg == "-A" {
+				rule[j] = "-D"
+			}
+		}
+		errs = append(errs, runCommand(rule[0], rule[1:]...))
+	}
+	r.iptables = nil
+	for _, dir := range r.cgroups {
+		os.Remove(dir)
+	}
+	r.cgroups = nil
+	for _, rule := range r.rules {
+		if err := netlink.RuleDel(rule); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove rule for mark %#x: %v", rule.Mark, err))
+		}
+	}
+	r.rules = nil
+	for _, route := range r.routes {
+		if err := netlink.RouteDel(&route); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove bypass route: %v", err))
+		}
+	}
+	r.routes = nil
+	return errors.Join(errs...)
+}
+
+// runCommand runs an iptables command
+func runCommand(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run %s %v: %v: %s", name, args, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
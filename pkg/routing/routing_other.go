@@ -0,0 +1,24 @@
+//go:build !linux
+
+package routing
+
+import "errors"
+
+// PolicyRouter routes marked packets around the tunnel. It is only
+// available on Linux.
+type PolicyRouter struct{}
+
+// NewPolicyRouter fails outside Linux
+func NewPolicyRouter(tunName string, config Config) (*PolicyRouter, error) {
+	return nil, errors.New("policy routing is only available on Linux")
+}
+
+// Apply does nothing outside Linux
+func (r *PolicyRouter) Apply() error {
+	return nil
+}
+
+// Close does nothing outside Linux
+func (r *PolicyRouter) Close() error {
+	return nil
+}
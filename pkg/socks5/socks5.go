@@ -0,0 +1,220 @@
+// Package socks5 implements the server side of the SOCKS5 wire protocol
+// (RFC 1928) without authentication, for use as a local proxy front-end.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion = 0x05
+
+	// CmdConnect asks the proxy to open a TCP connection
+	CmdConnect byte = 0x01
+	// CmdUDPAssociate asks the proxy to relay UDP datagrams
+	CmdUDPAssociate byte = 0x03
+
+	// ReplySucceeded reports success
+	ReplySucceeded byte = 0x00
+	// ReplyGeneralFailure reports an unspecified failure
+	ReplyGeneralFailure byte = 0x01
+	// ReplyHostUnreachable reports that the target could not be reached
+	ReplyHostUnreachable byte = 0x04
+	// ReplyCommandNotSupported reports an unsupported command
+	ReplyCommandNotSupported byte = 0x07
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xFF
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Request is a parsed SOCKS5 client request
+type Request struct {
+	Command byte
+	Target  string // host:port
+}
+
+// Handshake negotiates the no-authentication method and reads the client's
+// request from conn
+func Handshake(conn io.ReadWriter) (*Request, error) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	noAuth := false
+	for _, method := range methods {
+		if method == methodNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return nil, errors.New("client does not offer no-authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, methodNoAuth}); err != nil {
+		return nil, err
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", request[0])
+	}
+
+	target, err := readAddress(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{Command: request[1], Target: target}, nil
+}
+
+// WriteReply sends a reply with the given code and bound address
+func WriteReply(conn io.Writer, reply byte, bound net.Addr) error {
+	address := "0.0.0.0:0"
+	if bound != nil {
+		address = bound.String()
+	}
+
+	encoded, err := encodeAddress(address)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append([]byte{socksVersion, reply, 0x00}, encoded...))
+	return err
+}
+
+// ParseUDPDatagram splits a SOCKS5 UDP request into its target and payload.
+// Fragmented datagrams are not supported.
+func ParseUDPDatagram(datagram []byte) (string, []byte, error) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	if len(datagram) < 4 {
+		return "", nil, errors.New("UDP datagram too short")
+	}
+	if datagram[2] != 0 {
+		return "", nil, errors.New("fragmented UDP datagrams are not supported")
+	}
+
+	reader := &sliceReader{data: datagram[3:]}
+	target, err := readAddress(reader)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, reader.data, nil
+}
+
+// BuildUDPDatagram wraps payload from source in a SOCKS5 UDP header
+func BuildUDPDatagram(source string, payload []byte) ([]byte, error) {
+	encoded, err := encodeAddress(source)
+	if err != nil {
+		return nil, err
+	}
+
+	datagram := append([]byte{0x00, 0x00, 0x00}, encoded...)
+	return append(datagram, payload...), nil
+}
+
+// readAddress reads ATYP DST.ADDR DST.PORT and returns host:port
+func readAddress(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type: %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// encodeAddress encodes host:port as ATYP DST.ADDR DST.PORT
+func encodeAddress(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("domain name too long")
+		}
+		encoded = append([]byte{atypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		encoded = append([]byte{atypIPv4}, ip4...)
+	} else {
+		encoded = append([]byte{atypIPv6}, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(encoded, uint16(port)), nil
+}
+
+// sliceReader reads from a byte slice, leaving the unread remainder in data
+type sliceReader struct {
+	data []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// conn replays a client's bytes and records the proxy's answers
+type conn struct {
+	*bytes.Reader
+	written bytes.Buffer
+}
+
+func newConn(client ...byte) *conn {
+	return &conn{Reader: bytes.NewReader(client)}
+}
+
+func (c *conn) Write(p []byte) (int, error) { return c.written.Write(p) }
+
+func TestHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		address []byte
+		target  string
+	}{
+		{[]byte{atypIPv4, 192, 0, 2, 1, 0x01, 0xbb}, "192.0.2.1:443"},
+		{append([]byte{atypDomain, 11}, "example.com\x00\x50"...), "example.com:80"},
+		{append(append([]byte{atypIPv6}, net.ParseIP("2001:db8::1")...), 0, 53), "[2001:db8::1]:53"},
+	} {
+		c := newConn(append([]byte{socksVersion, 2, 0x02, methodNoAuth, socksVersion, CmdConnect, 0}, tc.address...)...)
+		request, err := Handshake(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.Command != CmdConnect || request.Target != tc.target {
+			t.Errorf("request = %+v, want a connect to %s", request, tc.target)
+		}
+		if !bytes.Equal(c.written.Bytes(), []byte{socksVersion, methodNoAuth}) {
+			t.Errorf("proxy answered the greeting with %x", c.written.Bytes())
+		}
+	}
+}
+
+func TestHandshakeRejectsClients(t *testing.T) {
+	c := newConn(socksVersion, 1, 0x02)
+	if _, err := Handshake(c); err == nil {
+		t.Error("client without no-authentication accepted")
+	}
+	if !bytes.Equal(c.written.Bytes(), []byte{socksVersion, methodNoAcceptable}) {
+		t.Errorf("proxy answered %x, want no acceptable methods", c.written.Bytes())
+	}
+
+	for name, client := range map[string][]byte{
+		"SOCKS4":               {0x04, 1, methodNoAuth},
+		"unknown address type": {socksVersion, 1, methodNoAuth, socksVersion, CmdConnect, 0, 0x09},
+		"truncated":            {socksVersion, 1, methodNoAuth, socksVersion, CmdConnect, 0, atypIPv4, 10},
+	} {
+		if _, err := Handshake(newConn(client...)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteReply(&buf, ReplySucceeded, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{socksVersion, ReplySucceeded, 0, atypIPv4, 10, 0, 0, 1, 0x04, 0x38}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("reply = %x, want %x", buf.Bytes(), want)
+	}
+}
+
+func TestUDPDatagramRoundTrip(t *testing.T) {
+	datagram, err := BuildUDPDatagram("example.com:53", []byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, payload, err := ParseUDPDatagram(datagram)
+	if err != nil || target != "example.com:53" || string(payload) != "query" {
+		t.Errorf("parsed %q %q, %v", target, payload, err)
+	}
+
+	fragment := append([]byte(nil), datagram...)
+	fragment[2] = 1
+	if _, _, err := ParseUDPDatagram(fragment); err == nil {
+		t.Error("fragmented datagram accepted")
+	}
+	if _, _, err := ParseUDPDatagram([]byte{0, 0}); err == nil {
+		t.Error("short datagram accepted")
+	}
+}
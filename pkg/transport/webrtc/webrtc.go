@@ -0,0 +1,368 @@
+// Package webrtc carries the tunnel on a WebRTC data channel. It is kept
+// out of the protocol package because pion links github.com/wlynxg/anet,
+// which Android builds can only link with -ldflags=-checklinkname=0.
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
+	"github.com/pion/webrtc/v3"
+
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// maxDataChannelMessage is the largest message a data channel carries
+	maxDataChannelMessage = 65535
+	// vpnDataChannelID is the pre-negotiated stream both peers open
+	vpnDataChannelID = 0
+)
+
+// ICEServer is a STUN or TURN server the server tells clients to use
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Signal carries the SDP offer or answer over the WebSocket
+// connection before traffic moves to the data channel
+type Signal struct {
+	Type       protocol.MessageType `json:"type"`
+	SDP        string               `json:"sdp"`
+	ICEServers []ICEServer          `json:"ice_servers,omitempty"` // sent with the offer
+}
+
+// Transport carries frames as messages on a WebRTC data channel, so
+// the tunnel looks like a video call's DTLS traffic and can be relayed by
+// the TURN servers firewalls allow for conferencing.
+type Transport struct {
+	pc         *webrtc.PeerConnection
+	channel    datachannel.ReadWriteCloser
+	remoteAddr net.Addr
+	readBuf    []byte
+	readMu     sync.Mutex
+	closeOnce  sync.Once
+}
+
+// SocketControl is run on every socket WebRTC opens, like net.Dialer's
+// Control hook. Android clients use it to keep the sockets out of the tunnel.
+type SocketControl func(network, address string, c syscall.RawConn) error
+
+// newWebRTCAPI returns an API whose data channels can be used as plain
+// readers and writers
+func newWebRTCAPI(control SocketControl) (*webrtc.API, error) {
+	var settings webrtc.SettingEngine
+	settings.DetachDataChannels()
+	if control != nil {
+		std, err := stdnet.NewNet()
+		if err != nil {
+			return nil, err
+		}
+		settings.SetNet(&controlledNet{Net: std, control: control})
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings)), nil
+}
+
+// controlledNet opens sockets with a control hook applied
+type controlledNet struct {
+	*stdnet.Net
+	control SocketControl
+}
+
+func (n *controlledNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	config := net.ListenConfig{Control: n.control}
+	return config.ListenPacket(context.Background(), network, address)
+}
+
+func (n *controlledNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	address := ""
+	if locAddr != nil {
+		address = locAddr.String()
+	}
+	conn, err := n.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (n *controlledNet) Dial(network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Control: n.control}
+	return dialer.Dial(network, address)
+}
+
+func (n *controlledNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	dialer := net.Dialer{Control: n.control}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (n *controlledNet) DialTCP(network string, laddr, raddr *net.TCPAddr) (transport.TCPConn, error) {
+	dialer := net.Dialer{Control: n.control}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+func (n *controlledNet) CreateDialer(dialer *net.Dialer) transport.Dialer {
+	controlled := *dialer
+	controlled.Control = n.control
+	return n.Net.CreateDialer(&controlled)
+}
+
+// newVPNDataChannel opens the data channel both peers agreed on in advance,
+// so neither has to wait for the other to announce it
+func newVPNDataChannel(pc *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	negotiated := true
+	id := uint16(vpnDataChannelID)
+	return pc.CreateDataChannel("vpn", &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+}
+
+// Accept offers a data channel to the client over signaling, using
+// iceServers for relaying, and returns the transport once it is open
+func Accept(ctx context.Context, signaling protocol.Transport, iceServers []ICEServer) (*Transport, error) {
+	api, err := newWebRTCAPI(nil)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: pionICEServers(iceServers)})
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := func() (*Transport, error) {
+		channel, err := newVPNDataChannel(pc)
+		if err != nil {
+			return nil, err
+		}
+		opened := detachOnOpen(channel)
+
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return nil, err
+		}
+		local, err := setLocalDescription(ctx, pc, offer)
+		if err != nil {
+			return nil, err
+		}
+		if err := protocol.WriteJSON(signaling, Signal{Type: protocol.WebRTCOfferType, SDP: local.SDP, ICEServers: iceServers}); err != nil {
+			return nil, err
+		}
+
+		var answer Signal
+		if err := protocol.ReadJSON(signaling, &answer); err != nil {
+			return nil, err
+		}
+		if answer.Type != protocol.WebRTCAnswerType {
+			return nil, fmt.Errorf("expected %s message, got %q", protocol.WebRTCAnswerType, answer.Type)
+		}
+		if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+			return nil, err
+		}
+		return waitForDataChannel(ctx, pc, opened, signaling.RemoteAddr())
+	}()
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return transport, nil
+}
+
+// Dial answers the server's offer on signaling and returns the
+// transport once the data channel is open. control may be nil.
+func Dial(ctx context.Context, signaling protocol.Transport, control SocketControl) (*Transport, error) {
+	var offer Signal
+	if err := protocol.ReadJSON(signaling, &offer); err != nil {
+		return nil, err
+	}
+	if offer.Type != protocol.WebRTCOfferType {
+		return nil, fmt.Errorf("expected %s message, got %q", protocol.WebRTCOfferType, offer.Type)
+	}
+
+	api, err := newWebRTCAPI(control)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: pionICEServers(offer.ICEServers)})
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := func() (*Transport, error) {
+		channel, err := newVPNDataChannel(pc)
+		if err != nil {
+			return nil, err
+		}
+		opened := detachOnOpen(channel)
+
+		if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+			return nil, err
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return nil, err
+		}
+		local, err := setLocalDescription(ctx, pc, answer)
+		if err != nil {
+			return nil, err
+		}
+		if err := protocol.WriteJSON(signaling, Signal{Type: protocol.WebRTCAnswerType, SDP: local.SDP}); err != nil {
+			return nil, err
+		}
+		return waitForDataChannel(ctx, pc, opened, signaling.RemoteAddr())
+	}()
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return transport, nil
+}
+
+// setLocalDescription applies description and waits for ICE gathering, so
+// the description sent to the peer lists every candidate
+func setLocalDescription(ctx context.Context, pc *webrtc.PeerConnection, description webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(description); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-gathered:
+		return pc.LocalDescription(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dataChannelResult is the outcome of detaching an opened data channel
+type dataChannelResult struct {
+	channel datachannel.ReadWriteCloser
+	err     error
+}
+
+// detachOnOpen detaches channel once it opens
+func detachOnOpen(channel *webrtc.DataChannel) <-chan dataChannelResult {
+	opened := make(chan dataChannelResult, 1)
+	channel.OnOpen(func() {
+		detached, err := channel.Detach()
+		opened <- dataChannelResult{detached, err}
+	})
+	return opened
+}
+
+// waitForDataChannel waits until the data channel opens or the connection
+// fails
+func waitForDataChannel(ctx context.Context, pc *webrtc.PeerConnection, opened <-chan dataChannelResult, remoteAddr net.Addr) (*Transport, error) {
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			failOnce.Do(func() { close(failed) })
+		}
+	})
+
+	select {
+	case result := <-opened:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return &Transport{
+			pc:         pc,
+			channel:    result.channel,
+			remoteAddr: remoteAddr,
+			readBuf:    make([]byte, maxDataChannelMessage),
+		}, nil
+	case <-failed:
+		return nil, errors.New("WebRTC connection failed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pionICEServers converts the ICE servers for pion
+func pionICEServers(servers []ICEServer) []webrtc.ICEServer {
+	converted := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		iceServer := webrtc.ICEServer{URLs: server.URLs, Username: server.Username}
+		if server.Credential != "" {
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		converted = append(converted, iceServer)
+	}
+	return converted
+}
+
+// ReadMessage reads the next data channel message
+func (t *Transport) ReadMessage() ([]byte, error) {
+	t.readMu.Lock()
+	defer t.readMu.Unlock()
+
+	n, err := t.channel.Read(t.readBuf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), t.readBuf[:n]...), nil
+}
+
+// WriteMessage sends data as one data channel message
+func (t *Transport) WriteMessage(data []byte) error {
+	if len(data) > maxDataChannelMessage {
+		return fmt.Errorf("message of %d bytes exceeds the data channel limit", len(data))
+	}
+	_, err := t.channel.Write(data)
+	return err
+}
+
+// SetReadDeadline sets the deadline for the next read
+func (t *Transport) SetReadDeadline(deadline time.Time) error {
+	if channel, ok := t.channel.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return channel.SetReadDeadline(deadline)
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing: data channel writes are queued for SCTP
+// and never block
+func (t *Transport) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
+
+// RemoteAddr returns the address the peer signaled from
+func (t *Transport) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+// Close closes the data channel and the peer connection
+func (t *Transport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.channel.Close()
+		err = t.pc.Close()
+	})
+	return err
+}
@@ -0,0 +1,122 @@
+// Package vpnerr classifies connection failures so that callers, such as a
+// mobile UI, can tell an unreachable server from a rejected handshake.
+//
+// Failures are *Error values. Match a category with errors.Is against one of
+// the Err* sentinels, or use errors.As to reach the underlying cause.
+package vpnerr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// Category names a kind of connection failure
+type Category string
+
+const (
+	CategoryDial      Category = "dial"
+	CategoryHandshake Category = "handshake"
+	CategoryAuth      Category = "auth"
+	CategoryTLSPin    Category = "tls_pin"
+	CategoryTunSetup  Category = "tun_setup"
+)
+
+var (
+	// ErrDial matches failures to reach the server
+	ErrDial = &Error{Category: CategoryDial}
+	// ErrHandshake matches failures of the WebSocket upgrade or key exchange
+	ErrHandshake = &Error{Category: CategoryHandshake}
+	// ErrAuth matches the server refusing the client's credentials
+	ErrAuth = &Error{Category: CategoryAuth}
+	// ErrTLSPin matches the server's certificate failing verification
+	ErrTLSPin = &Error{Category: CategoryTLSPin}
+	// ErrTunSetup matches failures to create or configure the TUN interface
+	ErrTunSetup = &Error{Category: CategoryTunSetup}
+)
+
+// descriptions are the messages shown for each category
+var descriptions = map[Category]string{
+	CategoryDial:      "server unreachable",
+	CategoryHandshake: "handshake failed",
+	CategoryAuth:      "authentication rejected",
+	CategoryTLSPin:    "server certificate rejected",
+	CategoryTunSetup:  "TUN interface setup failed",
+}
+
+// Error is a connection failure of a known category
+type Error struct {
+	Category Category
+	Err      error // the underlying cause, nil for the sentinels
+}
+
+func (e *Error) Error() string {
+	description := descriptions[e.Category]
+	if description == "" {
+		description = string(e.Category)
+	}
+	if e.Err == nil {
+		return description
+	}
+	return description + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel for e's category
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Err == nil && t.Category == e.Category
+}
+
+// Wrap returns err as a failure of the given category. An error that is
+// already categorized keeps its category, so the most specific one wins
+// when failures are wrapped on their way up.
+func Wrap(category Category, err error) error {
+	if err == nil {
+		return nil
+	}
+	var categorized *Error
+	if errors.As(err, &categorized) {
+		return err
+	}
+	return &Error{Category: category, Err: err}
+}
+
+// CategoryOf returns the category of err, or "" if it has none
+func CategoryOf(err error) Category {
+	var categorized *Error
+	if errors.As(err, &categorized) {
+		return categorized.Category
+	}
+	return ""
+}
+
+// FromDial categorizes the error of a WebSocket dial. resp is the HTTP
+// response to the upgrade request, if the server sent one.
+func FromDial(err error, resp *http.Response) error {
+	if err == nil {
+		return nil
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return Wrap(CategoryTLSPin, err)
+	case resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		return Wrap(CategoryAuth, err)
+	case resp != nil:
+		// The server answered but refused the upgrade
+		return Wrap(CategoryHandshake, err)
+	default:
+		return Wrap(CategoryDial, err)
+	}
+}
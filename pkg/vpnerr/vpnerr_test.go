@@ -0,0 +1,54 @@
+package vpnerr
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestWrapKeepsMostSpecificCategory(t *testing.T) {
+	if Wrap(CategoryDial, nil) != nil {
+		t.Error("Wrap(nil) is not nil")
+	}
+
+	auth := Wrap(CategoryAuth, io.EOF)
+	err := Wrap(CategoryHandshake, fmt.Errorf("connect: %w", auth))
+	if !errors.Is(err, ErrAuth) || errors.Is(err, ErrHandshake) {
+		t.Errorf("rewrapped auth failure matches %s, want %s", CategoryOf(err), CategoryAuth)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Error("cause lost in wrapping")
+	}
+	if got := auth.Error(); got != "authentication rejected: EOF" {
+		t.Errorf("Error() = %q", got)
+	}
+	if CategoryOf(io.EOF) != "" {
+		t.Error("plain error has a category")
+	}
+}
+
+func TestFromDial(t *testing.T) {
+	cause := errors.New("dial failed")
+	for _, tc := range []struct {
+		name string
+		err  error
+		resp *http.Response
+		want error
+	}{
+		{"refused", cause, nil, ErrDial},
+		{"certificate", x509.UnknownAuthorityError{}, nil, ErrTLSPin},
+		{"unauthorized", cause, &http.Response{StatusCode: http.StatusUnauthorized}, ErrAuth},
+		{"forbidden", cause, &http.Response{StatusCode: http.StatusForbidden}, ErrAuth},
+		{"upgrade refused", cause, &http.Response{StatusCode: http.StatusNotFound}, ErrHandshake},
+	} {
+		if err := FromDial(tc.err, tc.resp); !errors.Is(err, tc.want) {
+			t.Errorf("%s: categorized as %s, want %s", tc.name, CategoryOf(err), tc.want.(*Error).Category)
+		}
+	}
+	if FromDial(nil, nil) != nil {
+		t.Error("FromDial(nil) is not nil")
+	}
+}
@@ -0,0 +1,40 @@
+#!/bin/bash
+set -e
+
+# Runs the protocol benchmarks and writes the results to PERFORMANCE.md.
+# CI runs this on every push to main, so the file's history shows when a
+# change made encryption or obfuscation slower.
+
+SCRIPT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )"
+PROJECT_ROOT="$(dirname "$SCRIPT_DIR")"
+OUTPUT="$PROJECT_ROOT/PERFORMANCE.md"
+BENCHTIME="${BENCHTIME:-1s}"
+
+cd "$PROJECT_ROOT"
+echo "⏱️  Running protocol benchmarks..."
+RESULTS="$(go test -run '^$' -bench . -benchmem -benchtime "$BENCHTIME" ./pkg/protocol)"
+echo "$RESULTS"
+
+CPU="$(echo "$RESULTS" | sed -n 's/^cpu: //p')"
+{
+    echo "# Performance"
+    echo ""
+    echo "Throughput of the packet pipeline in \`pkg/protocol\`, written by"
+    echo "\`scripts/benchmark.sh\` (\`make bench\`). CI updates this file on every push"
+    echo "to main; compare its history to spot regressions."
+    echo ""
+    echo "- Commit: \`$(git rev-parse --short HEAD)\`"
+    echo "- Go: \`$(go env GOVERSION)\` on \`$(go env GOOS)/$(go env GOARCH)\`"
+    echo "- CPU: ${CPU:-unknown}"
+    echo ""
+    echo "| Benchmark | ns/op | MB/s | B/op | allocs/op |"
+    echo "|-----------|------:|-----:|-----:|----------:|"
+    echo "$RESULTS" | awk '/^Benchmark/ {
+        name = $1
+        sub(/^Benchmark/, "", name)
+        sub(/-[0-9]+$/, "", name)
+        printf "| %s | %s | %s | %s | %s |\n", name, $3, $5, $7, $9
+    }'
+} > "$OUTPUT"
+
+echo "✅ Results written to PERFORMANCE.md"
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// AccessConfig limits which addresses may attempt the handshake. Denied
+// addresses get a 403 from the fake site, as an nginx deny rule would give.
+type AccessConfig struct {
+	Allow          []string `json:"allow"`           // addresses or CIDRs; if set, no others may connect
+	Deny           []string `json:"deny"`            // addresses or CIDRs that may not connect, even if allowed
+	GeoIPDatabase  string   `json:"geoip_database"`  // MaxMind GeoLite2 or GeoIP2 Country database, for the country lists
+	AllowCountries []string `json:"allow_countries"` // ISO 3166 country codes; if set, no others may connect
+	DenyCountries  []string `json:"deny_countries"`
+}
+
+// countryLookup finds the country an address is in
+type countryLookup interface {
+	// Country returns the ISO 3166 code of ip's country, or "" if unknown
+	Country(ip net.IP) (string, error)
+}
+
+// accessControl is an AccessConfig parsed for checking addresses
+type accessControl struct {
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+	countries      countryLookup // nil unless a country list is set
+	allowCountries []string
+	denyCountries  []string
+}
+
+// newAccessControl parses config, loading its GeoIP database, or returns
+// nil if there is none
+func newAccessControl(config *AccessConfig) (*accessControl, error) {
+	if config == nil {
+		return nil, nil
+	}
+	a := &accessControl{
+		allowCountries: upperAll(config.AllowCountries),
+		denyCountries:  upperAll(config.DenyCountries),
+	}
+	var err error
+	if a.allow, err = parseAddressList(config.Allow); err != nil {
+		return nil, fmt.Errorf("access allow: %v", err)
+	}
+	if a.deny, err = parseAddressList(config.Deny); err != nil {
+		return nil, fmt.Errorf("access deny: %v", err)
+	}
+
+	if len(a.allowCountries) > 0 || len(a.denyCountries) > 0 {
+		if config.GeoIPDatabase == "" {
+			return nil, fmt.Errorf("access country lists need geoip_database")
+		}
+		if a.countries, err = openGeoIP(config.GeoIPDatabase); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// parseAddressList parses addresses and CIDRs
+func parseAddressList(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", entry)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// upperAll returns country codes in upper case, as the database has them
+func upperAll(codes []string) []string {
+	upper := make([]string, len(codes))
+	for i, code := range codes {
+		upper[i] = strings.ToUpper(code)
+	}
+	return upper
+}
+
+// check reports why ip may not connect, or "" if it may
+func (a *accessControl) check(ip net.IP) string {
+	if containsIP(a.deny, ip) {
+		return "deny list"
+	}
+	if len(a.allow) > 0 && !containsIP(a.allow, ip) {
+		return "not on allow list"
+	}
+	if a.countries == nil {
+		return ""
+	}
+
+	country, err := a.countries.Country(ip)
+	if err != nil {
+		slog.Warn("GeoIP lookup failed", "addr", ip, "error", err)
+	}
+	if slices.Contains(a.denyCountries, country) {
+		return "country " + country
+	}
+	// Addresses of unknown countries are turned away by an allow list
+	if len(a.allowCountries) > 0 && !slices.Contains(a.allowCountries, country) {
+		return "country " + country + " not allowed"
+	}
+	return ""
+}
+
+// containsIP reports whether any of networks contains ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoIP looks countries up in a MaxMind database held in memory, so a
+// reload can replace it while lookups are under way
+type geoIP struct {
+	reader *maxminddb.Reader
+}
+
+// openGeoIP loads a MaxMind country or city database
+func openGeoIP(filename string) (*geoIP, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %v", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database %s: %v", filename, err)
+	}
+	return &geoIP{reader: reader}, nil
+}
+
+// Country returns the ISO code of the country ip is registered in
+func (g *geoIP) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// accessAllowed reports whether the client of r may attempt the handshake,
+// answering it as the fake site would if not
+func (s *VPNServer) accessAllowed(w http.ResponseWriter, r *http.Request) bool {
+	access := s.access.Load()
+	if access == nil {
+		return true
+	}
+	reason := access.check(net.ParseIP(probeHost(r.RemoteAddr)))
+	if reason == "" {
+		return true
+	}
+	slog.Debug("Access denied", "addr", r.RemoteAddr, "reason", reason)
+	s.audit(r.RemoteAddr, s.clientHelloFingerprint(r.RemoteAddr), auditAccessDenied, nil)
+	s.writeNginxError(w, r, http.StatusForbidden)
+	return false
+}
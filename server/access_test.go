@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCountries looks countries up in a map
+type fakeCountries map[string]string
+
+func (f fakeCountries) Country(ip net.IP) (string, error) {
+	if country, ok := f[ip.String()]; ok {
+		return country, nil
+	}
+	return "", errors.New("address not found")
+}
+
+func TestAccessCheck(t *testing.T) {
+	a, err := newAccessControl(&AccessConfig{
+		Allow: []string{"192.0.2.0/24", "2001:db8::1"},
+		Deny:  []string{"192.0.2.66"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.countries = fakeCountries{"192.0.2.1": "NL", "192.0.2.2": "KP", "192.0.2.3": "US"}
+	a.allowCountries = upperAll([]string{"nl", "us"})
+	a.denyCountries = upperAll([]string{"us"})
+
+	for ip, want := range map[string]string{
+		"192.0.2.1":    "",
+		"192.0.2.66":   "deny list",
+		"198.51.100.1": "not on allow list",
+		"192.0.2.3":    "country US",
+		"192.0.2.2":    "country KP not allowed",
+		"192.0.2.4":    "country  not allowed", // unknown country
+		"2001:db8::1":  "country  not allowed",
+	} {
+		if got := a.check(net.ParseIP(ip)); got != want {
+			t.Errorf("check(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestNewAccessControlRejects(t *testing.T) {
+	badDatabase := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	if err := os.WriteFile(badDatabase, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range map[string]*AccessConfig{
+		"bad address":      {Allow: []string{"192.0.2.0/33"}},
+		"bad deny":         {Deny: []string{"example.com"}},
+		"no database":      {DenyCountries: []string{"US"}},
+		"missing database": {AllowCountries: []string{"NL"}, GeoIPDatabase: filepath.Join(t.TempDir(), "missing.mmdb")},
+		"invalid database": {AllowCountries: []string{"NL"}, GeoIPDatabase: badDatabase},
+	} {
+		if _, err := newAccessControl(config); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAccessDeniedLooksLikeNginx(t *testing.T) {
+	s := newTestServer(t)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "192.0.2.1:40000"
+	if !s.accessAllowed(httptest.NewRecorder(), request) {
+		t.Fatal("denied without access settings")
+	}
+
+	if err := reloadWith(t, s, `"access": {"deny": ["192.0.2.0/24"]}`); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	if s.accessAllowed(recorder, request) {
+		t.Fatal("denied address allowed after reload")
+	}
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "nginx") {
+		t.Errorf("denied with %d %q, want nginx's 403", recorder.Code, recorder.Body.String())
+	}
+
+	// A reload with bad settings keeps the ones in force
+	if err := reloadWith(t, s, `"access": {"deny": ["nowhere"]}`); err == nil {
+		t.Error("reload with a bad address accepted")
+	}
+	if s.accessAllowed(httptest.NewRecorder(), request) {
+		t.Error("failed reload dropped the access settings")
+	}
+}
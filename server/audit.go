@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of a connection attempt in the audit log
+const (
+	auditSuccess          = "success"
+	auditAuthFailure      = "auth_failure"
+	auditRateLimited      = "rate_limited"
+	auditHandshakeFailure = "handshake_failure"
+	auditRejected         = "rejected" // the server was full
+	auditQuotaExceeded    = "quota_exceeded"
+	auditSessionLimit     = "session_limit" // the user held as many sessions as client_session_limits allows
+	auditAccessDenied     = "access_denied" // by the access allow or deny lists
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time           string `json:"time"`
+	ClientIP       string `json:"client_ip"`
+	TLSFingerprint string `json:"tls_fingerprint,omitempty"`
+	Outcome        string `json:"outcome"`
+	User           string `json:"user,omitempty"`
+	BytesIn        uint64 `json:"bytes_in"`
+	BytesOut       uint64 `json:"bytes_out"`
+	DurationMs     int64  `json:"duration_ms"`
+	// Chain is the HMAC of the previous entry's chain value and this entry
+	// without Chain, so removing or editing an entry breaks every later one
+	Chain string `json:"chain,omitempty"`
+}
+
+// auditLog appends HMAC-chained entries to a file
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	key  []byte
+	prev []byte // chain value of the last entry
+}
+
+// validateAuditLog requires the audit log's HMAC key to be configured
+// explicitly. A key kept beside the log by default would let anyone who can
+// rewrite the log re-sign it too.
+func validateAuditLog(config *ServerConfig) error {
+	if config.AuditLogFile == "" {
+		return nil
+	}
+	if config.AuditLogKeyFile == "" {
+		return fmt.Errorf("audit_log_file needs audit_log_key_file, somewhere whoever can write the log cannot")
+	}
+	if filepath.Clean(config.AuditLogKeyFile) == filepath.Clean(config.AuditLogFile) {
+		return fmt.Errorf("audit_log_key_file must not be the audit log itself")
+	}
+	return nil
+}
+
+// openAuditLog opens the audit log for appending, continuing the chain of
+// any entries already in it. The HMAC key is created on first use.
+func openAuditLog(logFile, keyFile string) (*auditLog, error) {
+	key, err := loadAuditKey(keyFile, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Continue from the last entry's chain value
+	prev := make([]byte, sha256.Size)
+	if data, err := os.ReadFile(logFile); err == nil {
+		lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+		if last := lines[len(lines)-1]; len(last) > 0 {
+			var entry auditEntry
+			if err := json.Unmarshal(last, &entry); err != nil {
+				return nil, fmt.Errorf("audit log %s has a corrupt last entry: %v", logFile, err)
+			}
+			if prev, err = hex.DecodeString(entry.Chain); err != nil {
+				return nil, fmt.Errorf("audit log %s has a corrupt last entry: %v", logFile, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, key: key, prev: prev}, nil
+}
+
+// loadAuditKey reads the hex HMAC key from keyFile, generating it if create
+// is set and the file does not exist
+func loadAuditKey(keyFile string, create bool) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write audit key: %v", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit key: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid audit key in %s", keyFile)
+	}
+	return key, nil
+}
+
+// auditChain computes an entry's chain value from the previous one
+func auditChain(key, prev []byte, entry auditEntry) ([]byte, error) {
+	entry.Chain = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// Record chains entry to the previous one and appends it
+func (a *auditLog) Record(entry auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	chain, err := auditChain(a.key, a.prev, entry)
+	if err != nil {
+		return err
+	}
+	entry.Chain = hex.EncodeToString(chain)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.prev = chain
+	return nil
+}
+
+// audit records a connection attempt if the audit log is enabled. session
+// is nil if the attempt failed before one was set up.
+func (s *VPNServer) audit(remoteAddr, tlsFingerprint, outcome string, session *ClientSession) {
+	if s.auditLog == nil {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	entry := auditEntry{
+		Time:           time.Now().UTC().Format(time.RFC3339Nano),
+		ClientIP:       host,
+		TLSFingerprint: tlsFingerprint,
+		Outcome:        outcome,
+	}
+	if session != nil {
+		entry.User = session.username
+		entry.BytesIn = atomic.LoadUint64(&session.bytesIn)
+		entry.BytesOut = atomic.LoadUint64(&session.bytesOut)
+		if !session.connectedAt.IsZero() {
+			entry.DurationMs = time.Since(session.connectedAt).Milliseconds()
+		}
+	}
+
+	if err := s.auditLog.Record(entry); err != nil {
+		slog.Error("Failed to write audit log", "error", err)
+	}
+}
+
+// tlsFingerprint returns the JA3 fingerprint of a TLS client hello: the MD5
+// of its version, cipher suites, extensions, curves and point formats, with
+// GREASE values left out
+func tlsFingerprint(hello *tls.ClientHelloInfo) string {
+	// JA3 uses the legacy version field, which TLS 1.3 clients set to 1.2
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if v > version && !isGREASE(v) {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+
+	join := func(values []uint16) string {
+		var parts []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				parts = append(parts, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, curve := range hello.SupportedCurves {
+		curves[i] = uint16(curve)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = uint16(point)
+	}
+
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", version, join(hello.CipherSuites), join(hello.Extensions), join(curves), join(points))
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientHelloFingerprint returns the fingerprint recorded for a TLS
+// connection's client hello, or "" if there is none
+func (s *VPNServer) clientHelloFingerprint(remoteAddr string) string {
+	if fingerprint, ok := s.tlsFingerprints.Load(remoteAddr); ok {
+		return fingerprint.(string)
+	}
+	return ""
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// runAudit implements `stealthvpn-server audit verify`, which checks that
+// the audit log's chain is intact
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: stealthvpn-server audit verify --log-file FILE --key-file FILE")
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	logFile := flags.String("log-file", "", "Audit log to verify")
+	keyFile := flags.String("key-file", "", "HMAC key of the audit log")
+	flags.Parse(args[1:])
+
+	if *logFile == "" || *keyFile == "" {
+		return errors.New("--log-file and --key-file are required")
+	}
+
+	key, err := loadAuditKey(*keyFile, false)
+	if err != nil {
+		return err
+	}
+	entries, err := verifyAuditLog(*logFile, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d entries, chain intact\n", *logFile, entries)
+	return nil
+}
+
+// verifyAuditLog checks the chain of every entry in logFile against key
+// and returns how many there are
+func verifyAuditLog(logFile string, key []byte) (int, error) {
+	file, err := os.Open(logFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	prev := make([]byte, sha256.Size)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	entries := 0
+	for scanner.Scan() {
+		entries++
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return 0, fmt.Errorf("line %d is not a valid entry: %v", entries, err)
+		}
+		recorded, err := hex.DecodeString(entry.Chain)
+		if err != nil {
+			return 0, fmt.Errorf("line %d has an invalid chain value", entries)
+		}
+
+		expected, err := auditChain(key, prev, entry)
+		if err != nil {
+			return 0, err
+		}
+		if !hmac.Equal(recorded, expected) {
+			return 0, fmt.Errorf("chain broken at line %d: it or an earlier entry was modified or removed", entries)
+		}
+		prev = recorded
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAuditLog records entries for each outcome in a new audit log and
+// returns its path and key
+func writeAuditLog(t *testing.T, outcomes ...string) (string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	logFile, keyFile := filepath.Join(dir, "audit.log"), filepath.Join(dir, "keys", "audit.key")
+	if err := os.Mkdir(filepath.Dir(keyFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Half the entries are written after reopening, continuing the chain
+	for _, batch := range [][]string{outcomes[:len(outcomes)/2], outcomes[len(outcomes)/2:]} {
+		log, err := openAuditLog(logFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, outcome := range batch {
+			if err := log.Record(auditEntry{ClientIP: "192.0.2.1", Outcome: outcome}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		log.file.Close()
+	}
+
+	key, err := loadAuditKey(keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logFile, key
+}
+
+func TestAuditLogVerifies(t *testing.T) {
+	logFile, key := writeAuditLog(t, auditSuccess, auditAuthFailure, auditRateLimited, auditSuccess)
+	entries, err := verifyAuditLog(logFile, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != 4 {
+		t.Errorf("%d entries verified, want 4", entries)
+	}
+
+	if _, err := verifyAuditLog(logFile, bytes.Repeat([]byte{1}, 32)); err == nil {
+		t.Error("log verified with another key")
+	}
+}
+
+func TestAuditLogDetectsTampering(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+	}{
+		{"flipped byte", func(lines [][]byte) [][]byte {
+			// auth_failure becomes auth_failurf, still valid JSON
+			i := bytes.Index(lines[1], []byte(auditAuthFailure))
+			lines[1][i+len(auditAuthFailure)-1] ^= 0x03
+			return lines
+		}},
+		{"deleted record", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}},
+		{"reordered records", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logFile, key := writeAuditLog(t, auditSuccess, auditAuthFailure, auditRateLimited, auditSuccess)
+			data, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := test.tamper(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+			if err := os.WriteFile(logFile, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := verifyAuditLog(logFile, key); err == nil {
+				t.Error("tampered log verified")
+			}
+		})
+	}
+}
+
+func TestAuditLogNeedsSeparateKey(t *testing.T) {
+	for _, config := range []*ServerConfig{
+		{AuditLogFile: "/var/log/stealthvpn/audit.log"},
+		{AuditLogFile: "/var/log/stealthvpn/audit.log", AuditLogKeyFile: "/var/log/stealthvpn/../stealthvpn/audit.log"},
+	} {
+		if err := validateAuditLog(config); err == nil {
+			t.Errorf("audit log %q accepted with key file %q", config.AuditLogFile, config.AuditLogKeyFile)
+		}
+	}
+	if err := validateAuditLog(&ServerConfig{AuditLogFile: "/var/log/stealthvpn/audit.log", AuditLogKeyFile: "/etc/stealthvpn/audit.key"}); err != nil {
+		t.Error(err)
+	}
+}
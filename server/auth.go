@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"stealthvpn/pkg/auth"
+	"stealthvpn/pkg/protocol"
+)
+
+// authTimeout bounds how long the backends may take to check a client
+const authTimeout = 30 * time.Second
+
+// Names of the authentication backends in the authenticators setting
+const (
+	authPSK         = "psk"
+	authLDAP        = "ldap"
+	authRADIUS      = "radius"
+	authTOTP        = "totp"
+	authCertificate = "certificate"
+)
+
+// authenticateClient reads the client's credentials and checks them with the
+// configured backends. The client is told the result either way; on failure
+// the session must be dropped.
+func (s *VPNServer) authenticateClient(session *ClientSession) error {
+	var message protocol.Message
+	if err := protocol.ReadJSON(session.transport, &message); err != nil {
+		return err
+	}
+	if message.Type != protocol.AuthType {
+		return fmt.Errorf("expected %s message, got %q", protocol.AuthType, message.Type)
+	}
+
+	decrypted, err := session.encryption.Decrypt(message.Data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt credentials: %v", err)
+	}
+	var request protocol.AuthRequest
+	err = json.Unmarshal(decrypted, &request)
+	protocol.ZeroBytes(decrypted)
+	if err != nil {
+		return fmt.Errorf("invalid credentials message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	identity, authErr := s.authenticator.Authenticate(ctx, auth.Credentials{
+		Username:         request.Username,
+		Password:         request.Password,
+		OTP:              request.OTP,
+		PSKProof:         request.PSKProof,
+		Transcript:       session.transcript,
+		KeyID:            session.pskKeyID,
+		PeerCertificates: session.peerCertificates,
+		RemoteAddr:       session.id,
+	})
+
+	result := protocol.Message{Type: protocol.AuthResultType}
+	if authErr != nil {
+		// Backend failures are logged, not shown to the client
+		result.Error = auth.ErrInvalidCredentials.Error()
+		if !errors.Is(authErr, auth.ErrInvalidCredentials) {
+			slog.Error("Authentication error", "user", request.Username, "error", authErr)
+			result.Error = "authentication unavailable"
+		}
+	}
+	if err := protocol.WriteJSON(session.transport, result); err != nil {
+		return err
+	}
+	if authErr != nil {
+		return fmt.Errorf("user %q: %v", request.Username, authErr)
+	}
+
+	session.username = identity.Username
+	session.tenant = identity.Tenant
+	if identity.SessionTimeout > 0 {
+		session.endsAt = time.Now().Add(identity.SessionTimeout)
+	}
+	return nil
+}
+
+// authenticatorNames returns the backends to use. Configs from before the
+// authenticators setting enable LDAP just by configuring it.
+func authenticatorNames(config *ServerConfig) []string {
+	names := config.Authenticators
+	if len(names) == 0 && config.LDAP != nil {
+		names = []string{authLDAP}
+	}
+
+	// Tenants are told apart by their pre-shared keys
+	if len(config.Tenants) > 0 && !slices.Contains(names, authPSK) {
+		names = append([]string{authPSK}, names...)
+	}
+	return names
+}
+
+// newAuthenticator creates the backends named in the config, all of which
+// must accept a client, or returns nil when authentication is not
+// configured. masterKey is the pre-shared key material.
+func newAuthenticator(config *ServerConfig, masterKey []byte) (auth.Authenticator, error) {
+	names := authenticatorNames(config)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var authenticators []auth.Authenticator
+	for _, name := range names {
+		var authenticator auth.Authenticator
+		var err error
+		switch name {
+		case authPSK:
+			var keys map[string][]byte
+			keys, err = pskMasterKeys(config, masterKey)
+			if err == nil {
+				psk := auth.NewPSKAuthenticator(keys)
+				for _, key := range keys {
+					protocol.ZeroBytes(key)
+				}
+				err = addTenantKeys(psk, config)
+				authenticator = psk
+			}
+		case authLDAP:
+			if config.LDAP == nil {
+				return nil, errors.New("the ldap authenticator needs an ldap section")
+			}
+			ttl := time.Duration(config.LDAPCacheTTL) * time.Second
+			authenticator, err = auth.NewLDAPAuthenticator(*config.LDAP, ttl)
+		case authRADIUS:
+			if config.RADIUS == nil {
+				return nil, errors.New("the radius authenticator needs a radius section")
+			}
+			authenticator, err = auth.NewRADIUSAuthenticator(*config.RADIUS, config.RADIUSAuthMethod)
+		case authTOTP:
+			if config.TOTP == nil {
+				return nil, errors.New("the totp authenticator needs a totp section")
+			}
+			authenticator, err = auth.NewTOTPAuthenticator(*config.TOTP)
+		case authCertificate:
+			if config.ClientCAFile == "" {
+				return nil, errors.New("the certificate authenticator needs client_ca_file")
+			}
+			authenticator, err = auth.NewCertificateAuthenticator(config.ClientCAFile, config.ClientCRLFile)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure %s authentication: %v", name, err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if len(authenticators) == 1 {
+		return authenticators[0], nil
+	}
+	return auth.NewAndAuthenticator(authenticators...), nil
+}
+
+// usesAuthenticator reports whether the named backend is configured
+func usesAuthenticator(config *ServerConfig, name string) bool {
+	for _, configured := range authenticatorNames(config) {
+		if configured == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestsClientCertificate reports whether TLS clients are asked for a
+// certificate for the certificate authenticator
+func requestsClientCertificate(config *ServerConfig) bool {
+	return usesAuthenticator(config, authCertificate)
+}
+
+// addTenantKeys lets the PSK authenticator recognize tenants' clients
+func addTenantKeys(psk *auth.PSKAuthenticator, config *ServerConfig) error {
+	for _, tenant := range config.Tenants {
+		key, err := protocol.MasterKey(tenant.PreSharedKey, config.PassphraseKDF)
+		if err != nil {
+			return fmt.Errorf("pre-shared key of tenant %q: %v", tenant.Name, err)
+		}
+		psk.AddTenant(tenant.Name, key)
+		protocol.ZeroBytes(key)
+	}
+	return nil
+}
+
+// PreviousPreSharedKey is a pre-shared key being rotated out, accepted from
+// clients that name it by ID
+type PreviousPreSharedKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// pskMasterKeys returns the key material for the current and previous
+// pre-shared keys by key ID. masterKey is the current key's material.
+func pskMasterKeys(config *ServerConfig, masterKey []byte) (map[string][]byte, error) {
+	keys := map[string][]byte{config.PreSharedKeyID: append([]byte(nil), masterKey...)}
+	for _, previous := range config.PreviousPreSharedKeys {
+		if _, exists := keys[previous.ID]; exists {
+			return nil, fmt.Errorf("pre-shared key ID %q is used twice", previous.ID)
+		}
+		if len(previous.Key) < protocol.MinPreSharedKeyLength {
+			return nil, fmt.Errorf("previous pre-shared key %q is too short: need at least %d bytes", previous.ID, protocol.MinPreSharedKeyLength)
+		}
+		key, err := protocol.MasterKey(previous.Key, config.PassphraseKDF)
+		if err != nil {
+			return nil, fmt.Errorf("previous pre-shared key %q: %v", previous.ID, err)
+		}
+		keys[previous.ID] = key
+	}
+	return keys, nil
+}
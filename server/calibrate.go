@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// pcap link types understood by readPcapPayloadSizes
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// calibratePadding reads a capture of the traffic the server impersonates and
+// prints padding_buckets and padding_weights settings that reproduce its
+// packet sizes
+func calibratePadding(pcapFile string, buckets int, port int) error {
+	sizes, err := readPcapPayloadSizes(pcapFile, port)
+	if err != nil {
+		return err
+	}
+
+	sizesOut, weights, err := protocol.CalibratePaddingBuckets(sizes, buckets)
+	if err != nil {
+		return err
+	}
+
+	output, err := json.MarshalIndent(map[string]interface{}{
+		"padding_buckets": sizesOut,
+		"padding_weights": weights,
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", output)
+	fmt.Fprintf(os.Stderr, "Calibrated from %d packets\n", len(sizes))
+	return nil
+}
+
+// readPcapPayloadSizes returns the TCP and UDP payload sizes of the packets
+// in a classic pcap file, skipping empty segments such as bare ACKs. If port
+// is non-zero only packets to or from it are counted.
+func readPcapPayloadSizes(path string, port int) ([]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var header [24]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+
+	// The magic number tells the byte order; pcapng files are not supported
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header[:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a pcap file (pcapng must be converted first)")
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0fffffff
+
+	var sizes []int
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(reader, record[:]); err != nil {
+			if err == io.EOF {
+				return sizes, nil
+			}
+			return nil, fmt.Errorf("truncated pcap record: %v", err)
+		}
+
+		packet := make([]byte, order.Uint32(record[8:12]))
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return nil, fmt.Errorf("truncated pcap record: %v", err)
+		}
+
+		size, ok := transportPayloadSize(linkType, packet, port)
+		if ok && size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+}
+
+// transportPayloadSize returns the TCP or UDP payload size of a captured
+// frame. The size is taken from the IP header, so it is right even for
+// captures truncated by a snap length.
+func transportPayloadSize(linkType uint32, frame []byte, port int) (int, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return 0, false
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		// Skip VLAN tags
+		for etherType == 0x8100 && len(frame) >= 4 {
+			etherType, frame = binary.BigEndian.Uint16(frame[2:4]), frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return 0, false
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[14:16]), frame[16:]
+	case linkTypeRaw:
+		if len(frame) == 0 {
+			return 0, false
+		}
+		etherType = 0x0800
+		if frame[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	default:
+		return 0, false
+	}
+
+	var proto byte
+	var ipPayload []byte
+	var ipPayloadLen int
+	switch etherType {
+	case 0x0800:
+		if len(frame) < 20 {
+			return 0, false
+		}
+		headerLen := int(frame[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(frame[2:4]))
+		if headerLen < 20 || len(frame) < headerLen || totalLen < headerLen {
+			return 0, false
+		}
+		proto, ipPayload, ipPayloadLen = frame[9], frame[headerLen:], totalLen-headerLen
+	case 0x86dd:
+		// Extension headers are rare on the traffic being measured and skipped
+		if len(frame) < 40 {
+			return 0, false
+		}
+		proto, ipPayload, ipPayloadLen = frame[6], frame[40:], int(binary.BigEndian.Uint16(frame[4:6]))
+	default:
+		return 0, false
+	}
+
+	var headerLen int
+	switch proto {
+	case 6: // TCP
+		if len(ipPayload) < 20 {
+			return 0, false
+		}
+		headerLen = int(ipPayload[12]>>4) * 4
+	case 17: // UDP
+		if len(ipPayload) < 8 {
+			return 0, false
+		}
+		headerLen = 8
+	default:
+		return 0, false
+	}
+
+	srcPort := int(binary.BigEndian.Uint16(ipPayload[0:2]))
+	dstPort := int(binary.BigEndian.Uint16(ipPayload[2:4]))
+	if port != 0 && srcPort != port && dstPort != port {
+		return 0, false
+	}
+	if ipPayloadLen < headerLen {
+		return 0, false
+	}
+	return ipPayloadLen - headerLen, true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// writeConfig writes a server config file and returns its path
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// reloadWith reloads s from a minimal valid config with the given settings
+// added
+func reloadWith(t *testing.T, s *VPNServer, settings string) error {
+	t.Helper()
+	s.configFile = writeConfig(t, `{"port": 443, "tls_cert_file": "cert.pem", "tls_key_file": "key.pem",
+		"pre_shared_key": "0123456789abcdef0123456789abcdef", `+settings+`}`)
+	_, err := s.ReloadConfig()
+	return err
+}
+
+func TestLoadConfigReadsKeyFile(t *testing.T) {
+	t.Setenv(protocol.PSKEnvVar, "")
+	keyFile := filepath.Join(t.TempDir(), "psk")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(writeConfig(t, `{"pre_shared_key_file": "`+keyFile+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PreSharedKey != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("pre-shared key = %q, want the key file's", config.PreSharedKey)
+	}
+}
+
+func TestLoadConfigRejectsShortKey(t *testing.T) {
+	t.Setenv(protocol.PSKEnvVar, "")
+	if _, err := loadConfig(writeConfig(t, `{"pre_shared_key": "short"}`)); err == nil {
+		t.Error("config with a short key loaded")
+	}
+	if _, err := loadConfig(writeConfig(t, `{}`)); err == nil {
+		t.Error("config without a key loaded")
+	}
+}
+
+func TestPassphraseKDFNeedsRestart(t *testing.T) {
+	if _, err := NewVPNServer(&ServerConfig{
+		PreSharedKey:  "0123456789abcdef0123456789abcdef",
+		PassphraseKDF: &protocol.PassphraseKDF{Salt: "c2hvcnQ="},
+	}); err == nil {
+		t.Error("server started with a salt too short")
+	}
+
+	running := &ServerConfig{PassphraseKDF: &protocol.PassphraseKDF{Salt: "old"}}
+	loaded := &ServerConfig{PassphraseKDF: &protocol.PassphraseKDF{Salt: "new"}}
+	changed := keepStartupSettings(running, loaded)
+	if !slices.Contains(changed, "passphrase_kdf") || loaded.PassphraseKDF.Salt != "old" {
+		t.Errorf("reload changed the passphrase KDF: %v", changed)
+	}
+}
+
+func TestPSKMasterKeysByID(t *testing.T) {
+	config := &ServerConfig{
+		PreSharedKeyID:        "2025-06",
+		PreviousPreSharedKeys: []PreviousPreSharedKey{{ID: "", Key: "QbIWJrl+X6GZoYFFXdxRXxEA/v3ntf51UWdiyTNewss="}},
+	}
+	keys, err := pskMasterKeys(config, []byte("current key material"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(keys["2025-06"]) != "current key material" || string(keys[""]) != config.PreviousPreSharedKeys[0].Key {
+		t.Errorf("keys by ID = %q", keys)
+	}
+
+	for name, previous := range map[string]PreviousPreSharedKey{
+		"ID used twice": {ID: "2025-06", Key: "QbIWJrl+X6GZoYFFXdxRXxEA/v3ntf51UWdiyTNewss="},
+		"short key":     {ID: "2024-01", Key: "old-key"},
+	} {
+		config.PreviousPreSharedKeys = []PreviousPreSharedKey{previous}
+		if _, err := pskMasterKeys(config, []byte("current key material")); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestSanitizedConfigRedactsPreviousKeys(t *testing.T) {
+	s := newTestServer(t)
+	config := s.currentConfig()
+	config.PreviousPreSharedKeys = []PreviousPreSharedKey{{ID: "2024-01", Key: "QbIWJrl+X6GZoYFFXdxRXxEA/v3ntf51UWdiyTNewss="}}
+
+	data, err := json.Marshal(s.SanitizedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("QbIWJrl")) || bytes.Contains(data, []byte(config.PreSharedKey)) {
+		t.Errorf("sanitized config shows a key: %s", data)
+	}
+	if !bytes.Contains(data, []byte("2024-01")) {
+		t.Errorf("sanitized config hides the key ID: %s", data)
+	}
+}
+
+func TestParallelThresholdMustNotBeNegative(t *testing.T) {
+	if _, err := NewVPNServer(&ServerConfig{PreSharedKey: "0123456789abcdef0123456789abcdef", ParallelThreshold: -1}); err == nil {
+		t.Error("server started with a negative parallel_threshold")
+	}
+	s := newTestServer(t)
+	if err := reloadWith(t, s, `"parallel_threshold": -1`); err == nil {
+		t.Error("reload accepted a negative parallel_threshold")
+	}
+	if err := reloadWith(t, s, `"parallel_threshold": 32768`); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.currentConfig().ParallelThreshold; got != 32768 {
+		t.Errorf("parallel_threshold after reload = %d", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// configSettleDelay lets an editor finish saving the config file before it
+// is read, as one save often arrives as several events
+const configSettleDelay = 500 * time.Millisecond
+
+// WatchConfig reloads the config file whenever it changes, until ctx is
+// done. The directory is watched rather than the file, so files replaced
+// by editors or by Kubernetes ConfigMap updates are still seen. Invalid
+// configs are logged and ignored, and settings that need a restart keep
+// their running values.
+func (s *VPNServer) WatchConfig(ctx context.Context, filename string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", filename, err)
+	}
+
+	lastSum := fileSum(filename)
+	settle := time.NewTimer(configSettleDelay)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			settle.Reset(configSettleDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Config watcher error", "file", filename, "error", err)
+		case <-settle.C:
+			// Other files in the directory change too; only a new config
+			// is worth reloading
+			sum := fileSum(filename)
+			if sum == nil || bytes.Equal(sum, lastSum) {
+				continue
+			}
+			lastSum = sum
+
+			s.reloadAndLog(filename)
+		}
+	}
+}
+
+// reloadOnSignal reloads the config file whenever the server gets SIGHUP,
+// for service managers that reload that way. Windows never sends it.
+func (s *VPNServer) reloadOnSignal(filename string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			s.reloadAndLog(filename)
+		}
+	}()
+}
+
+// reloadAndLog reloads the config file, logging the outcome
+func (s *VPNServer) reloadAndLog(filename string) {
+	restartRequired, err := s.reloadConfig(filename)
+	if err != nil {
+		slog.Error("Ignoring changed config", "file", filename, "error", err)
+		return
+	}
+	slog.Info("Reloaded config", "file", filename)
+	if len(restartRequired) > 0 {
+		slog.Warn("Config changes need a restart to take effect", "file", filename, "settings", restartRequired)
+	}
+}
+
+// fileSum returns a hash of the file's contents, nil if it cannot be read
+func fileSum(filename string) []byte {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// validateConfig checks a changed config before it replaces the running one
+func validateConfig(config *ServerConfig) error {
+	if config.Port <= 0 || config.Port > 65535 {
+		return fmt.Errorf("invalid port %d", config.Port)
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return fmt.Errorf("tls_cert_file and tls_key_file are required")
+	}
+	for _, prefix := range config.AllowedIPs {
+		if _, _, err := net.ParseCIDR(prefix); err != nil {
+			return fmt.Errorf("invalid allowed_ips entry %q", prefix)
+		}
+	}
+	for _, server := range config.DNSServers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid dns_servers entry %q", server)
+		}
+	}
+	if err := validateDomainFronting(config); err != nil {
+		return err
+	}
+	if _, err := protocol.ParseQueuePolicy(config.SendQueuePolicy); err != nil {
+		return err
+	}
+	if config.ParallelThreshold < 0 {
+		return fmt.Errorf("parallel_threshold must not be negative")
+	}
+	if err := validateSocketOptions(config); err != nil {
+		return err
+	}
+	if err := validateSessionLimits(config); err != nil {
+		return err
+	}
+	return validateTrustedNetworks(config.TrustedNetworks)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsUpstreamTimeout bounds each query forwarded to an upstream resolver
+	dnsUpstreamTimeout = 5 * time.Second
+	// dnsOverrideTTL is the TTL of answers from dns_overrides
+	dnsOverrideTTL = 60
+)
+
+// serveDNS runs the DNS proxy on the server's tunnel addresses, so that
+// clients resolve names through the tunnel instead of leaking queries to
+// their local network. It serves UDP and TCP until the server exits.
+func (s *VPNServer) serveDNS() {
+	handler := dns.HandlerFunc(s.handleDNS)
+
+	for _, ip := range []net.IP{s.ipPool.ServerIPv4(), s.ipPool.ServerIPv6()} {
+		addr := net.JoinHostPort(ip.String(), "53")
+		for _, network := range []string{"udp", "tcp"} {
+			server := &dns.Server{Addr: addr, Net: network, Handler: handler}
+			go func() {
+				slog.Info("DNS proxy listening", "addr", addr, "network", network)
+				if err := server.ListenAndServe(); err != nil {
+					slog.Error("DNS proxy failed", "addr", addr, "network", network, "error", err)
+				}
+			}()
+		}
+	}
+}
+
+// tunnelDNSServers returns the resolvers pushed to clients
+func (s *VPNServer) tunnelDNSServers() []string {
+	config := s.currentConfig()
+	if config.EnableDNSProxy {
+		return []string{s.ipPool.ServerIPv4().String(), s.ipPool.ServerIPv6().String()}
+	}
+	return config.DNSServers
+}
+
+// handleDNS answers a query from dns_overrides or forwards it upstream
+func (s *VPNServer) handleDNS(w dns.ResponseWriter, query *dns.Msg) {
+	// Forward over the same protocol the client used, so large TCP answers
+	// are not truncated
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	w.WriteMsg(s.resolve(query, network))
+}
+
+// resolve answers a query from dns_overrides or by forwarding it to the
+// upstream resolvers over network
+func (s *VPNServer) resolve(query *dns.Msg, network string) *dns.Msg {
+	config := s.currentConfig()
+
+	if reply := overrideReply(query, config.DNSOverrides); reply != nil {
+		return reply
+	}
+
+	client := &dns.Client{Net: network, Timeout: dnsUpstreamTimeout}
+
+	for _, upstream := range config.DNSServers {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+
+		reply, _, err := client.Exchange(query, upstream)
+		if err != nil {
+			slog.Warn("DNS upstream failed", "upstream", upstream, "error", err)
+			continue
+		}
+		return reply
+	}
+
+	failure := new(dns.Msg)
+	failure.SetRcode(query, dns.RcodeServerFailure)
+	return failure
+}
+
+// overrideReply answers a query for a name in overrides, which maps names to
+// IPv4 or IPv6 addresses for split-horizon DNS. It returns nil for names that
+// are not overridden.
+func overrideReply(query *dns.Msg, overrides map[string]string) *dns.Msg {
+	if len(overrides) == 0 || len(query.Question) != 1 {
+		return nil
+	}
+	question := query.Question[0]
+
+	var ip net.IP
+	for name, value := range overrides {
+		if strings.EqualFold(dns.Fqdn(name), question.Name) {
+			ip = net.ParseIP(value)
+			break
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Authoritative = true
+
+	header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: dnsOverrideTTL}
+	switch {
+	case question.Qtype == dns.TypeA && ip.To4() != nil:
+		header.Rrtype = dns.TypeA
+		reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: ip.To4()})
+	case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+		header.Rrtype = dns.TypeAAAA
+		reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+	}
+	// Other record types get an empty answer rather than the public one
+	return reply
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/miekg/dns"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// dohHandler passes DNS-over-HTTPS queries to listener and answers
+// anything else as the web server would
+func (s *VPNServer) dohHandler(listener *protocol.DoHListener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isQuery := r.Method == http.MethodPost && r.Header.Get("Content-Type") == protocol.DoHContentType ||
+			r.Method == http.MethodGet && r.URL.Query().Has("dns")
+		if !isQuery {
+			s.probeNotFound(r)
+			s.writeNginxError(w, r, http.StatusNotFound)
+			return
+		}
+		listener.ServeHTTP(w, r)
+	})
+}
+
+// newDoHListener returns a listener for sessions under doh_domain that
+// resolves other names as the DNS proxy does, so the endpoint works as an
+// ordinary DoH resolver
+func (s *VPNServer) newDoHListener(domain string) *protocol.DoHListener {
+	return protocol.NewDoHListener(domain, func(query *dns.Msg) *dns.Msg {
+		return s.resolve(query, "tcp")
+	})
+}
+
+// serveDoH accepts clients on the DoH transport
+func (s *VPNServer) serveDoH(listener *protocol.DoHListener) {
+	for {
+		transport, err := listener.Accept()
+		if err != nil {
+			slog.Error("DoH transport error", "error", err)
+			return
+		}
+		go s.handleRequestClient(transport, "DoH")
+	}
+}
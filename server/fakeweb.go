@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// nginxVersion is the web server the fake site claims to be
+const nginxVersion = "nginx/1.18.0"
+
+// fakePage is a static page of the fake site, served the way nginx serves
+// files: with Last-Modified, an ETag derived from it, and range support
+type fakePage struct {
+	contentType string
+	body        []byte
+	modified    time.Time
+	etag        string
+}
+
+// newFakePage creates a page last modified at modified
+func newFakePage(contentType, body string, modified time.Time) *fakePage {
+	modified = modified.UTC().Truncate(time.Second)
+	return &fakePage{
+		contentType: contentType,
+		body:        []byte(body),
+		modified:    modified,
+		// nginx's ETag is the file's mtime and size in hex
+		etag: fmt.Sprintf(`"%x-%x"`, modified.Unix(), len(body)),
+	}
+}
+
+// serveFakePage serves a static page of the fake site
+func (s *VPNServer) serveFakePage(w http.ResponseWriter, r *http.Request, page *fakePage) {
+	s.setNginxHeaders(w, r)
+	w.Header().Set("Content-Type", page.contentType)
+	// Set directly: Header.Set would send it as "Etag", unlike nginx
+	w.Header()["ETag"] = []string{page.etag}
+
+	// ServeContent only sees the canonical key, so answer If-None-Match here
+	if etagMatches(r.Header.Get("If-None-Match"), page.etag) {
+		w.Header().Set("Last-Modified", page.modified.Format(http.TimeFormat))
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	http.ServeContent(w, r, "", page.modified, bytes.NewReader(page.body))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFakeJSON answers as an API behind nginx would, after a delay like
+// that of a proxied application
+func (s *VPNServer) serveFakeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	time.Sleep(upstreamDelay())
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		s.writeNginxError(w, r, http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	s.setNginxHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// writeNginxError writes nginx's built-in error page for status
+func (s *VPNServer) writeNginxError(w http.ResponseWriter, r *http.Request, status int) {
+	title := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	html := "<html>\r\n<head><title>" + title + "</title></head>\r\n<body>\r\n" +
+		"<center><h1>" + title + "</h1></center>\r\n<hr><center>" + nginxVersion + "</center>\r\n</body>\r\n</html>\r\n"
+
+	s.setNginxHeaders(w, r)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(len(html)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(html))
+	}
+}
+
+// upgradeError answers a WebSocket upgrade the server refused with nginx's
+// page for status. The reason would name the WebSocket library, so it is
+// only logged, by handleWebSocket.
+func (s *VPNServer) upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	w.Header().Del("Sec-Websocket-Version")
+	s.writeNginxError(w, r, status)
+}
+
+// setServerALPN sets the application protocols offered in TLS, alpn or by
+// default HTTP/1.1 then HTTP/2. The server's preference decides, and
+// clients offer both as browsers do, so h2 must come after http/1.1 or
+// every tunnel would be negotiated as HTTP/2 and fail to upgrade.
+func setServerALPN(stealth *protocol.StealthProtocol, alpn []string) error {
+	if len(alpn) == 0 {
+		alpn = protocol.DefaultServerALPN
+	}
+	if h2 := slices.Index(alpn, "h2"); h2 >= 0 && h2 < slices.Index(alpn, "http/1.1") {
+		return fmt.Errorf("alpn must list http/1.1 before h2")
+	}
+	if err := stealth.SetALPN(alpn); err != nil {
+		return fmt.Errorf("invalid alpn: %v", err)
+	}
+	return nil
+}
+
+// setNginxHeaders sets the headers nginx sends with every response. Plain
+// web requests from outside trusted_networks get their connection closed,
+// so probes cannot hold one open to measure the server.
+func (s *VPNServer) setNginxHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", nginxVersion)
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if s.trustedPeer(r.RemoteAddr) {
+		w.Header().Set("Connection", "keep-alive")
+	} else {
+		w.Header().Set("Connection", "close")
+	}
+}
+
+// trustedPeer reports whether remoteAddr is in trusted_networks
+func (s *VPNServer) trustedPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.currentConfig().TrustedNetworks {
+		if _, ipNet, err := net.ParseCIDR(network); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(network); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTrustedNetworks checks that every entry is an address or a CIDR
+func validateTrustedNetworks(networks []string) error {
+	for _, network := range networks {
+		if _, _, err := net.ParseCIDR(network); err != nil && net.ParseIP(network) == nil {
+			return fmt.Errorf("invalid trusted network %q", network)
+		}
+	}
+	return nil
+}
+
+// upstreamDelay returns how long an application behind nginx takes to
+// answer a small API request: a few milliseconds, occasionally more
+func upstreamDelay() time.Duration {
+	const median = 4 * time.Millisecond
+	delay := time.Duration(float64(median) * math.Exp(0.5*rand.NormFloat64()))
+	return min(delay, 50*time.Millisecond)
+}
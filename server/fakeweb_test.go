@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+func TestSetServerALPN(t *testing.T) {
+	stealth := protocol.NewStealthProtocol()
+	if err := setServerALPN(stealth, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := stealth.GetTLSConfig().NextProtos; !slices.Equal(got, []string{"http/1.1", "h2"}) {
+		t.Errorf("default ALPN %q, want http/1.1 then h2", got)
+	}
+
+	// h2 first would turn every tunnel's upgrade request into HTTP/2
+	if err := setServerALPN(stealth, []string{"h2", "http/1.1"}); err == nil {
+		t.Error("h2 before http/1.1 accepted")
+	}
+	if err := setServerALPN(stealth, []string{"h2"}); err == nil {
+		t.Error("ALPN without http/1.1 accepted")
+	}
+}
+
+func TestProfilingNotOnPublicPort(t *testing.T) {
+	s := newTestServer(t)
+	s.setupFakeWebHandlers()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine", "/debug/vars"} {
+		// Importing pprof and expvar registers them on the default mux
+		if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern == "" {
+			t.Fatalf("%s not registered on the default mux, so this test proves nothing", path)
+		}
+
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s answered %d on the public port, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRefusedUpgradesLookLikeNginx(t *testing.T) {
+	s := newTestServer(t)
+	s.setupFakeWebHandlers()
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+
+	upgrade := func(method string, header map[string]string) *http.Request {
+		r := httptest.NewRequest(method, "/ws", nil)
+		for name, value := range map[string]string{
+			"Upgrade":               "websocket",
+			"Connection":            "Upgrade",
+			"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			"Sec-WebSocket-Version": "13",
+			"Origin":                "https://example.com",
+		} {
+			r.Header.Set(name, value)
+		}
+		for name, value := range header {
+			if value == "" {
+				r.Header.Del(name)
+			} else {
+				r.Header.Set(name, value)
+			}
+		}
+		return r
+	}
+	for _, test := range []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"no origin", upgrade(http.MethodGet, map[string]string{"Origin": ""}), http.StatusForbidden},
+		{"no key", upgrade(http.MethodGet, map[string]string{"Sec-WebSocket-Key": ""}), http.StatusBadRequest},
+		{"old version", upgrade(http.MethodGet, map[string]string{"Sec-WebSocket-Version": "8"}), http.StatusBadRequest},
+		{"no connection upgrade", upgrade(http.MethodGet, map[string]string{"Connection": "keep-alive"}), http.StatusBadRequest},
+		{"POST", upgrade(http.MethodPost, nil), http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, test.r)
+		body := w.Body.String()
+		if w.Code != test.want {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.want)
+		}
+		if w.Header().Get("Server") != nginxVersion || w.Header().Get("Content-Type") != "text/html" ||
+			!strings.Contains(body, "<center>"+nginxVersion+"</center>") {
+			t.Errorf("%s: answered with headers %v and body %q, want nginx's error page", test.name, w.Header(), body)
+		}
+		if w.Header().Get("Sec-Websocket-Version") != "" || strings.Contains(strings.ToLower(body), "websocket") {
+			t.Errorf("%s: answer names WebSocket: %v %q", test.name, w.Header(), body)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// FirewallConfig restricts where clients' packets may go. Rules are tried
+// in order and the first that matches decides. Packets no rule matches are
+// allowed, unless they are for a private, link-local or multicast address
+// outside the tunnel networks, which keeps clients off the server's LAN.
+type FirewallConfig struct {
+	Rules        []FirewallRule `json:"rules"`
+	AllowPrivate bool           `json:"allow_private"` // let unmatched packets reach private and multicast addresses
+}
+
+// FirewallRule allows or denies the packets matching all of its fields.
+// Fields left empty match anything.
+type FirewallRule struct {
+	Action      string `json:"action"`      // allow or deny
+	Destination string `json:"destination"` // address or CIDR
+	Protocol    string `json:"protocol"`    // tcp, udp or icmp
+	Ports       string `json:"ports"`       // destination port or range, such as 25 or 8000-8080; tcp and udp only
+}
+
+// privateNetworks are denied by default: RFC 1918 and unique local
+// addresses, link-local ones such as cloud metadata services, and multicast
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"169.254.0.0/16", "224.0.0.0/4",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// mustParseCIDRs parses CIDRs known to be valid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// IP protocol numbers the firewall knows by name
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// IPv6 extension headers parsePacketFlow walks past to find the transport
+// header
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6NoNext      = 59
+	ipv6DestOptions = 60
+)
+
+// firewall is a FirewallConfig parsed for matching packets
+type firewall struct {
+	rules        []firewallRule
+	allowPrivate bool
+	denies       bool // some rule denies, so packets that cannot be parsed are dropped
+}
+
+// firewallRule is a FirewallRule parsed for matching packets
+type firewallRule struct {
+	allow       bool
+	destination *net.IPNet // nil for any
+	protocol    string     // empty for any
+	portLow     uint16
+	portHigh    uint16 // 0 for any port
+}
+
+// packetFlow is what the firewall matches in a packet
+type packetFlow struct {
+	destination net.IP
+	protocol    uint8
+	port        uint16
+	hasPort     bool
+}
+
+// newFirewall parses config, returning nil if there is none
+func newFirewall(config *FirewallConfig) (*firewall, error) {
+	if config == nil {
+		return nil, nil
+	}
+	f := &firewall{allowPrivate: config.AllowPrivate}
+	for i, rule := range config.Rules {
+		parsed, err := parseFirewallRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("firewall rule %d: %v", i+1, err)
+		}
+		f.rules = append(f.rules, parsed)
+		f.denies = f.denies || !parsed.allow
+	}
+	return f, nil
+}
+
+// parseFirewallRule checks and parses a rule
+func parseFirewallRule(rule FirewallRule) (firewallRule, error) {
+	var parsed firewallRule
+	switch strings.ToLower(rule.Action) {
+	case "allow":
+		parsed.allow = true
+	case "deny":
+	default:
+		return parsed, fmt.Errorf("invalid action %q, want allow or deny", rule.Action)
+	}
+
+	if rule.Destination != "" {
+		_, network, err := net.ParseCIDR(rule.Destination)
+		if err != nil {
+			ip := net.ParseIP(rule.Destination)
+			if ip == nil {
+				return parsed, fmt.Errorf("invalid destination %q", rule.Destination)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		parsed.destination = network
+	}
+
+	parsed.protocol = strings.ToLower(rule.Protocol)
+	switch parsed.protocol {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return parsed, fmt.Errorf("invalid protocol %q, want tcp, udp or icmp", rule.Protocol)
+	}
+
+	if rule.Ports != "" {
+		if parsed.protocol != "tcp" && parsed.protocol != "udp" {
+			return parsed, fmt.Errorf("ports need protocol tcp or udp")
+		}
+		low, high, isRange := strings.Cut(rule.Ports, "-")
+		if !isRange {
+			high = low
+		}
+		lowPort, errLow := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+		highPort, errHigh := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+		if errLow != nil || errHigh != nil || lowPort == 0 || lowPort > highPort {
+			return parsed, fmt.Errorf("invalid ports %q", rule.Ports)
+		}
+		parsed.portLow, parsed.portHigh = uint16(lowPort), uint16(highPort)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the rule applies to flow
+func (r *firewallRule) matches(flow packetFlow) bool {
+	if r.destination != nil && !r.destination.Contains(flow.destination) {
+		return false
+	}
+	switch r.protocol {
+	case "tcp":
+		if flow.protocol != protocolTCP {
+			return false
+		}
+	case "udp":
+		if flow.protocol != protocolUDP {
+			return false
+		}
+	case "icmp":
+		if flow.protocol != protocolICMP && flow.protocol != protocolICMPv6 {
+			return false
+		}
+	}
+	if r.portHigh != 0 && (!flow.hasPort || flow.port < r.portLow || flow.port > r.portHigh) {
+		return false
+	}
+	return true
+}
+
+// allows reports whether flow may pass. Tunnel addresses are exempt from
+// the default on private networks, as client isolation governs them.
+func (f *firewall) allows(flow packetFlow, inTunnel bool) bool {
+	for i := range f.rules {
+		if f.rules[i].matches(flow) {
+			return f.rules[i].allow
+		}
+	}
+	if f.allowPrivate || inTunnel {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(flow.destination) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePacketFlow reads the destination, protocol and destination port of
+// an IPv4 or IPv6 packet, following IPv6 extension headers to the
+// transport header. Later fragments have no port. A packet whose headers
+// are cut short is not parsed.
+func parsePacketFlow(packet []byte) (packetFlow, bool) {
+	var flow packetFlow
+	if len(packet) == 0 {
+		return flow, false
+	}
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || len(packet) < headerLen {
+			return flow, false
+		}
+		flow.destination = net.IP(packet[16:20])
+		flow.protocol = packet[9]
+		if packet[6]&0x1f == 0 && packet[7] == 0 {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return flow, false
+		}
+		flow.destination = net.IP(packet[24:40])
+		var ok bool
+		flow.protocol, transport, ok = ipv6Transport(packet[6], packet[40:])
+		if !ok {
+			return flow, false
+		}
+	default:
+		return flow, false
+	}
+
+	if (flow.protocol == protocolTCP || flow.protocol == protocolUDP) && len(transport) >= 4 {
+		flow.port = uint16(transport[2])<<8 | uint16(transport[3])
+		flow.hasPort = true
+	}
+	return flow, true
+}
+
+// ipv6Transport skips the extension headers starting with next in payload,
+// returning the transport protocol and header, which is nil for a later
+// fragment. It fails if an extension header is cut short.
+func ipv6Transport(next uint8, payload []byte) (uint8, []byte, bool) {
+	for {
+		var length int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(payload) < 2 {
+				return next, nil, false
+			}
+			length = (int(payload[1]) + 1) * 8
+		case ipv6AuthHeader:
+			if len(payload) < 2 {
+				return next, nil, false
+			}
+			length = (int(payload[1]) + 2) * 4
+		case ipv6Fragment:
+			if len(payload) < 8 {
+				return next, nil, false
+			}
+			if payload[2] != 0 || payload[3]&0xf8 != 0 {
+				// Only the first fragment carries the transport header
+				return payload[0], nil, true
+			}
+			length = 8
+		case ipv6NoNext:
+			return next, nil, true
+		default:
+			return next, payload, true
+		}
+		if len(payload) < length {
+			return next, nil, false
+		}
+		next, payload = payload[0], payload[length:]
+	}
+}
+
+// inTunnelNetwork reports whether ip is in the default network's or a
+// tenant's tunnel subnets
+func (s *VPNServer) inTunnelNetwork(ip net.IP) bool {
+	if s.ipPool.Contains(ip) {
+		return true
+	}
+	for _, t := range s.tenants {
+		if t.pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firewallAllows reports whether the firewall lets a packet from session
+// through, logging packets it drops at a limited rate
+func (s *VPNServer) firewallAllows(session *ClientSession, packet []byte) bool {
+	f := s.firewall.Load()
+	if f == nil {
+		return true
+	}
+	flow, ok := parsePacketFlow(packet)
+	if ok && f.allows(flow, s.inTunnelNetwork(flow.destination)) {
+		return true
+	}
+	// A packet the firewall cannot read might be one its rules would deny
+	if !ok && !f.denies {
+		return true
+	}
+
+	s.metrics.firewallDrops.Inc()
+	if s.firewallLog.Allow() {
+		slog.Debug("Firewall dropped packet", "client", session.clientIP, "destination", flow.destination,
+			"protocol", flow.protocol, "port", flow.port)
+	}
+	return false
+}
+
+// newFirewallLogLimiter allows a few logged drops a second, so a client
+// hammering a blocked port cannot flood the log
+func newFirewallLogLimiter() *rate.Limiter {
+	return rate.NewLimiter(5, 10)
+}
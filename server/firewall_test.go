@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// flowPacket returns a packet to dst with IP protocol and destination port
+func flowPacket(dst net.IP, protocol uint8, port uint16) []byte {
+	packet := packetTo(dst)
+	if packet[0]>>4 == 4 {
+		packet[9] = protocol
+	} else {
+		packet[6] = protocol
+	}
+	return append(packet, 0x9c, 0x40, byte(port>>8), byte(port))
+}
+
+func TestFirewallRules(t *testing.T) {
+	f, err := newFirewall(&FirewallConfig{Rules: []FirewallRule{
+		{Action: "deny", Protocol: "tcp", Ports: "25"},
+		{Action: "allow", Destination: "10.1.2.3", Protocol: "udp", Ports: "5000-5010"},
+		{Action: "deny", Destination: "2001:db8::/32"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"SMTP", flowPacket(net.IPv4(198, 51, 100, 1), protocolTCP, 25), false},
+		{"HTTPS", flowPacket(net.IPv4(198, 51, 100, 1), protocolTCP, 443), true},
+		{"allowed private port", flowPacket(net.IPv4(10, 1, 2, 3), protocolUDP, 5005), true},
+		{"other private port", flowPacket(net.IPv4(10, 1, 2, 3), protocolUDP, 5011), false},
+		{"metadata service", flowPacket(net.IPv4(169, 254, 169, 254), protocolTCP, 80), false},
+		{"denied IPv6 network", flowPacket(net.ParseIP("2001:db8::1"), protocolUDP, 53), false},
+		{"link-local IPv6", flowPacket(net.ParseIP("fe80::1"), protocolUDP, 53), false},
+	} {
+		flow, ok := parsePacketFlow(tc.packet)
+		if !ok {
+			t.Fatalf("%s: not parsed", tc.name)
+		}
+		if got := f.allows(flow, false); got != tc.want {
+			t.Errorf("%s: allowed %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Tunnel addresses and allow_private lift the private network default
+	flow, _ := parsePacketFlow(flowPacket(net.IPv4(10, 8, 0, 3), protocolUDP, 53))
+	if !f.allows(flow, true) {
+		t.Error("packet to a tunnel address denied")
+	}
+	f.allowPrivate = true
+	if !f.allows(flow, false) {
+		t.Error("private address denied with allow_private")
+	}
+}
+
+func TestParsePacketFlow(t *testing.T) {
+	fragment := flowPacket(net.IPv4(198, 51, 100, 1), protocolTCP, 25)
+	fragment[7] = 1 // later fragment, carrying no ports
+	if flow, ok := parsePacketFlow(fragment); !ok || flow.hasPort {
+		t.Errorf("later fragment parsed as %+v, %v", flow, ok)
+	}
+
+	f := &firewall{rules: []firewallRule{{protocol: "tcp", portLow: 25, portHigh: 25}}}
+	if flow, _ := parsePacketFlow(fragment); !f.allows(flow, false) {
+		t.Error("port rule matched a packet without a port")
+	}
+
+	for _, packet := range [][]byte{nil, {0x45, 0}, {0x60, 0}, {0x10}} {
+		if _, ok := parsePacketFlow(packet); ok {
+			t.Errorf("parsed %x", packet)
+		}
+	}
+}
+
+// ipv6WithHeaders returns an IPv6 packet to dst carrying a transport
+// header with port behind the given extension headers, each given as its
+// type and body; the next-header fields are filled in
+func ipv6WithHeaders(dst net.IP, protocol uint8, port uint16, headers ...[]byte) []byte {
+	packet := packetTo(dst)
+	next := &packet[6]
+	for _, header := range headers {
+		*next = header[0]
+		packet = append(packet, header[1:]...)
+		next = &packet[len(packet)-len(header)+1]
+	}
+	*next = protocol
+	return append(packet, 0x9c, 0x40, byte(port>>8), byte(port))
+}
+
+func TestParsePacketFlowIPv6ExtensionHeaders(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+	hopByHop := []byte{ipv6HopByHop, 0, 0, 1, 4, 0, 0, 0, 0}                                            // 8 bytes of PadN
+	destOptions := []byte{ipv6DestOptions, 0, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // 16 bytes
+	firstFragment := []byte{ipv6Fragment, 0, 0, 0, 1, 0, 0, 0, 7}                                       // offset 0, more fragments
+	laterFragment := []byte{ipv6Fragment, 0, 0, 0x05, 0x01, 0, 0, 0, 7}                                 // offset 160
+	auth := []byte{ipv6AuthHeader, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}                                  // 12 bytes
+
+	for _, test := range []struct {
+		name     string
+		packet   []byte
+		protocol uint8
+		port     uint16
+		hasPort  bool
+	}{
+		{"hop-by-hop", ipv6WithHeaders(dst, protocolTCP, 25, hopByHop), protocolTCP, 25, true},
+		{"first fragment", ipv6WithHeaders(dst, protocolTCP, 25, firstFragment), protocolTCP, 25, true},
+		{"chain", ipv6WithHeaders(dst, protocolUDP, 53, hopByHop, destOptions, auth, firstFragment), protocolUDP, 53, true},
+		{"later fragment", ipv6WithHeaders(dst, protocolTCP, 25, laterFragment), protocolTCP, 0, false},
+		{"no next header", ipv6WithHeaders(dst, ipv6NoNext, 25, hopByHop), ipv6NoNext, 0, false},
+	} {
+		flow, ok := parsePacketFlow(test.packet)
+		if !ok || !flow.destination.Equal(dst) || flow.protocol != test.protocol || flow.port != test.port || flow.hasPort != test.hasPort {
+			t.Errorf("%s: parsed as %+v, %v", test.name, flow, ok)
+		}
+	}
+
+	// An extension header running past the packet leaves nothing to match
+	truncated := ipv6WithHeaders(dst, protocolTCP, 25, destOptions)[:40+10]
+	if _, ok := parsePacketFlow(truncated); ok {
+		t.Error("truncated extension header parsed")
+	}
+}
+
+func TestFirewallDropsUnparsedPackets(t *testing.T) {
+	s := newTestServer(t)
+	leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	session := s.clients["192.0.2.1:40000"]
+	truncated := ipv6WithHeaders(net.ParseIP("2001:db8::1"), protocolTCP, 25, []byte{ipv6Routing, 0, 4, 0, 0, 0, 0, 0, 0})
+
+	// Without deny rules nothing could be denied anyway
+	if err := reloadWith(t, s, `"firewall": {"rules": [{"action": "allow", "protocol": "udp"}]}`); err != nil {
+		t.Fatal(err)
+	}
+	if !s.firewallAllows(session, truncated) {
+		t.Error("unparsed packet dropped without deny rules")
+	}
+
+	if err := reloadWith(t, s, `"firewall": {"rules": [{"action": "deny", "protocol": "tcp", "ports": "25"}]}`); err != nil {
+		t.Fatal(err)
+	}
+	if s.firewallAllows(session, truncated) {
+		t.Error("unparsed packet passed a deny rule")
+	}
+	if s.firewallAllows(session, ipv6WithHeaders(net.ParseIP("2001:db8::1"), protocolTCP, 25, []byte{ipv6HopByHop, 0, 0, 1, 4, 0, 0, 0, 0})) {
+		t.Error("port hidden behind an extension header passed a deny rule")
+	}
+}
+
+func TestFirewallExemptsTunnelWithRedisStore(t *testing.T) {
+	s := newTestServer(t)
+	leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	session := s.clients["192.0.2.1:40000"]
+	// The store allocates in Redis, but answers for the pool it wraps
+	s.ipPool = &RedisSessionStore{pool: s.ipPool.(*IPAddressPool)}
+	if err := reloadWith(t, s, `"firewall": {"rules": [{"action": "deny", "protocol": "tcp", "ports": "25"}]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other clients and the server's end of the tunnel, where the DNS proxy
+	// listens, are reached through private addresses the default denies
+	for _, dst := range []net.IP{net.IPv4(10, 8, 0, 9), s.ipPool.ServerIPv4(), s.ipPool.ServerIPv6()} {
+		if !s.firewallAllows(session, flowPacket(dst, protocolUDP, 53)) {
+			t.Errorf("packet to tunnel address %v dropped", dst)
+		}
+	}
+	if s.firewallAllows(session, flowPacket(net.IPv4(192, 168, 1, 1), protocolUDP, 53)) {
+		t.Error("packet to the server's LAN allowed")
+	}
+}
+
+func TestFirewallRejectsRules(t *testing.T) {
+	for _, rule := range []FirewallRule{
+		{Action: "maybe"},
+		{Action: "deny", Destination: "example.com"},
+		{Action: "deny", Protocol: "sctp"},
+		{Action: "deny", Ports: "25"},
+		{Action: "deny", Protocol: "tcp", Ports: "0"},
+		{Action: "deny", Protocol: "tcp", Ports: "9000-8000"},
+		{Action: "deny", Protocol: "tcp", Ports: "70000"},
+	} {
+		_, err := newFirewall(&FirewallConfig{Rules: []FirewallRule{{Action: "allow"}, rule}})
+		if err == nil || !strings.Contains(err.Error(), "firewall rule 2") {
+			t.Errorf("rule %+v: error %v, want rule 2 named", rule, err)
+		}
+	}
+}
+
+func TestFirewallDropsAndCounts(t *testing.T) {
+	s := newTestServer(t)
+	leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	session := s.clients["192.0.2.1:40000"]
+	if !s.firewallAllows(session, flowPacket(net.IPv4(192, 168, 1, 1), protocolTCP, 22)) {
+		t.Fatal("packet filtered without a firewall")
+	}
+
+	if err := reloadWith(t, s, `"firewall": {"rules": [{"action": "deny", "protocol": "tcp", "ports": "22"}]}`); err != nil {
+		t.Fatal(err)
+	}
+	if s.firewallAllows(session, flowPacket(net.IPv4(198, 51, 100, 1), protocolTCP, 22)) {
+		t.Error("reloaded rule not applied")
+	}
+	if !s.firewallAllows(session, flowPacket(session.lease.IPv4, protocolUDP, 53)) {
+		t.Error("packet to the client's own tunnel address dropped")
+	}
+	if got := metricValue(t, s, "stealthvpn_firewall_dropped_packets_total"); got != 1 {
+		t.Errorf("counted %v drops, want 1", got)
+	}
+
+	// A reload with a bad rule keeps the rules in force
+	if err := reloadWith(t, s, `"firewall": {"rules": [{"action": "maybe"}]}`); err == nil {
+		t.Error("reload with a bad rule accepted")
+	}
+	if s.firewallAllows(session, flowPacket(net.IPv4(198, 51, 100, 1), protocolTCP, 22)) {
+		t.Error("failed reload dropped the rules")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// frontedHost returns the name clients put in the Host header when
+// connecting through a CDN: fronted_host, or else fake_domain_name
+func frontedHost(config *ServerConfig) string {
+	if config.FrontedHost != "" {
+		return config.FrontedHost
+	}
+	return config.FakeDomainName
+}
+
+// validateDomainFronting checks that domain fronting has a host to route on
+func validateDomainFronting(config *ServerConfig) error {
+	if config.EnableDomainFronting && frontedHost(config) == "" {
+		return fmt.Errorf("enable_domain_fronting needs fronted_host or fake_domain_name")
+	}
+	return nil
+}
+
+// frontedHostAllowed reports whether a tunnel request is for this server.
+// With domain fronting the TLS server name is the CDN's front domain and
+// says nothing; the CDN routes on the Host header, so that is what is
+// checked. Requests for other hosts reached the server by mistake or come
+// from a prober, and see only the fake site.
+func (s *VPNServer) frontedHostAllowed(r *http.Request) bool {
+	config := s.currentConfig()
+	if !config.EnableDomainFronting {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if strings.EqualFold(host, frontedHost(config)) {
+		return true
+	}
+	slog.Debug("Request for another host", "addr", r.RemoteAddr, "host", r.Host)
+	return false
+}
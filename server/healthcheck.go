@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// answerHealthCheck replies to a client health check with the server's clock
+// and the session's traffic counters
+func (s *VPNServer) answerHealthCheck(session *ClientSession, payload []byte) {
+	var check protocol.HealthCheck
+	if err := json.Unmarshal(payload, &check); err != nil {
+		slog.Warn("Invalid health check", "client", session.clientIP, "error", err)
+		return
+	}
+
+	ack := protocol.HealthCheckAck{
+		Type:      protocol.HealthCheckAckType,
+		Echo:      check.Timestamp,
+		Timestamp: time.Now().UnixNano(),
+		Stats: protocol.SessionStats{
+			BytesIn:  atomic.LoadUint64(&session.bytesIn),
+			BytesOut: atomic.LoadUint64(&session.bytesOut),
+		},
+	}
+
+	if err := s.sendControl(session, ack); err != nil {
+		slog.Error("Failed to answer health check", "client", session.clientIP, "error", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	// DefaultTunnelSubnet is the IPv4 pool used when none is configured
+	DefaultTunnelSubnet = "10.8.0.0/24"
+	// DefaultTunnelSubnet6 is the IPv6 ULA prefix used when none is configured
+	DefaultTunnelSubnet6 = "fd00::/64"
+)
+
+// errPoolExhausted is returned when no address is left to lease
+var errPoolExhausted = errors.New("tunnel address pool exhausted")
+
+// IPLease is the pair of tunnel addresses assigned to one client
+type IPLease struct {
+	IPv4 net.IP `json:"ipv4"`
+	IPv6 net.IP `json:"ipv6"`
+}
+
+// LeaseAllocator hands out tunnel addresses. IPAddressPool allocates for
+// one server; RedisSessionStore allocates across a fleet.
+type LeaseAllocator interface {
+	// Allocate leases addresses to a client, preferring its previous ones
+	Allocate(clientID string) (*IPLease, error)
+	// Release returns a lease
+	Release(lease *IPLease)
+	// ServerIPv4 and ServerIPv6 return the server's end of the tunnel
+	ServerIPv4() net.IP
+	ServerIPv6() net.IP
+	// Contains reports whether ip is in the tunnel subnets leases come from
+	Contains(ip net.IP) bool
+}
+
+// IPAddressPool leases dual-stack tunnel addresses to clients from an IPv4
+// subnet and an IPv6 ULA prefix. The first host address of each is kept for
+// the server's end of the tunnel. Clients get their previous addresses
+// back when they are free.
+type IPAddressPool struct {
+	mu       sync.Mutex
+	subnet4  *net.IPNet
+	subnet6  *net.IPNet
+	leased4  map[uint32]bool
+	leased6  map[uint64]bool
+	next6    uint64
+	previous map[string]*IPLease // client ID -> last lease
+}
+
+// NewIPAddressPool creates a pool over the given IPv4 subnet and IPv6 prefix
+func NewIPAddressPool(subnet4, subnet6 string) (*IPAddressPool, error) {
+	if subnet4 == "" {
+		subnet4 = DefaultTunnelSubnet
+	}
+	if subnet6 == "" {
+		subnet6 = DefaultTunnelSubnet6
+	}
+
+	_, ipNet4, err := net.ParseCIDR(subnet4)
+	if err != nil || ipNet4.IP.To4() == nil {
+		return nil, errors.New("invalid IPv4 tunnel subnet: " + subnet4)
+	}
+
+	_, ipNet6, err := net.ParseCIDR(subnet6)
+	if err != nil || ipNet6.IP.To4() != nil {
+		return nil, errors.New("invalid IPv6 tunnel prefix: " + subnet6)
+	}
+	if ones, _ := ipNet6.Mask.Size(); ones > 64 {
+		return nil, errors.New("IPv6 tunnel prefix must be /64 or shorter")
+	}
+
+	return &IPAddressPool{
+		subnet4:  ipNet4,
+		subnet6:  ipNet6,
+		leased4:  make(map[uint32]bool),
+		leased6:  make(map[uint64]bool),
+		next6:    2,
+		previous: make(map[string]*IPLease),
+	}, nil
+}
+
+// ServerIPv4 returns the server's IPv4 address inside the tunnel
+func (p *IPAddressPool) ServerIPv4() net.IP {
+	return p.ipv4At(1)
+}
+
+// ServerIPv6 returns the server's IPv6 address inside the tunnel
+func (p *IPAddressPool) ServerIPv6() net.IP {
+	return p.ipv6At(1)
+}
+
+// Remember records the leases clients held before, such as before a
+// restart, so they get the same addresses again
+func (p *IPAddressPool) Remember(leases map[string]*IPLease) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for clientID, lease := range leases {
+		p.previous[clientID] = lease
+	}
+}
+
+// Allocate leases an IPv4 and an IPv6 address to a client
+func (p *IPAddressPool) Allocate(clientID string) (*IPLease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Reuse the client's last addresses unless someone else holds them now
+	if lease, ok := p.previous[clientID]; ok {
+		host4, ok4 := p.host4(lease.IPv4)
+		host6, ok6 := p.host6(lease.IPv6)
+		if ok4 && ok6 && !p.leased4[host4] && !p.leased6[host6] {
+			p.leased4[host4] = true
+			p.leased6[host6] = true
+			return &IPLease{IPv4: p.ipv4At(host4), IPv6: p.ipv6At(host6)}, nil
+		}
+	}
+
+	var host4 uint32
+	first, last := p.hostRange4()
+	for host := first; host <= last; host++ {
+		if !p.leased4[host] {
+			host4 = host
+			break
+		}
+	}
+	if host4 == 0 {
+		return nil, errPoolExhausted
+	}
+
+	// Hand out interface identifiers sequentially, reusing released ones later
+	for p.leased6[p.next6] {
+		p.next6++
+	}
+	host6 := p.next6
+	p.next6++
+
+	p.leased4[host4] = true
+	p.leased6[host6] = true
+
+	lease := &IPLease{
+		IPv4: p.ipv4At(host4),
+		IPv6: p.ipv6At(host6),
+	}
+	p.previous[clientID] = lease
+	return lease, nil
+}
+
+// Release returns a lease to the pool
+func (p *IPAddressPool) Release(lease *IPLease) {
+	if lease == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	base4 := binary.BigEndian.Uint32(p.subnet4.IP.To4())
+	delete(p.leased4, binary.BigEndian.Uint32(lease.IPv4.To4())-base4)
+
+	host6 := binary.BigEndian.Uint64(lease.IPv6.To16()[8:])
+	delete(p.leased6, host6)
+	if host6 < p.next6 {
+		p.next6 = host6
+	}
+}
+
+// host4 returns the offset of a client address within the IPv4 subnet. It
+// fails for addresses outside it, such as leases from before the subnet
+// changed, and for reserved addresses.
+func (p *IPAddressPool) host4(ip net.IP) (uint32, bool) {
+	if ip.To4() == nil || !p.subnet4.Contains(ip) {
+		return 0, false
+	}
+	first, last := p.hostRange4()
+	host := binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(p.subnet4.IP.To4())
+	return host, host >= first && host <= last
+}
+
+// hostRange4 returns the offsets of the IPv4 addresses clients may lease:
+// all but the network address, the server address and the broadcast address
+func (p *IPAddressPool) hostRange4() (first, last uint32) {
+	ones, bits := p.subnet4.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if size < 4 {
+		return 2, 1 // no room for clients
+	}
+	return 2, size - 2
+}
+
+// host6 returns the interface identifier of a client address within the
+// IPv6 prefix
+func (p *IPAddressPool) host6(ip net.IP) (uint64, bool) {
+	if ip.To4() != nil || !p.subnet6.Contains(ip) {
+		return 0, false
+	}
+	host := binary.BigEndian.Uint64(ip.To16()[8:])
+	return host, host >= 2
+}
+
+// ipv4At returns the address at offset host within the IPv4 subnet
+func (p *IPAddressPool) ipv4At(host uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(p.subnet4.IP.To4())+host)
+	return ip
+}
+
+// ipv6At returns the address with interface identifier host within the IPv6 prefix
+func (p *IPAddressPool) ipv6At(host uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.subnet6.IP.To16())
+	binary.BigEndian.PutUint64(ip[8:], host)
+	return ip
+}
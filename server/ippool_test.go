@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// newStatsDirServer returns a server keeping its stats and leases in dir
+func newStatsDirServer(t *testing.T, dir string) *VPNServer {
+	t.Helper()
+	s, err := NewVPNServer(&ServerConfig{PreSharedKey: "0123456789abcdef0123456789abcdef", StatsDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// leaseFor registers a session from ip and returns its lease
+func leaseFor(t *testing.T, s *VPNServer, ip net.IP) *IPLease {
+	t.Helper()
+	session := newTestSession(t, newPipeTransport())
+	session.id = ip.String() + ":40000"
+	session.clientIP = ip
+	session.sendQueue = protocol.NewSendQueue(16, protocol.QueueDropNewest)
+	if err := s.addSession(session); err != nil {
+		t.Fatal(err)
+	}
+	return session.lease
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := newStatsDirServer(t, dir)
+	leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	lease := leaseFor(t, s, net.IPv4(192, 0, 2, 2))
+
+	// After a restart the second client reconnects first, but still gets
+	// the addresses it had
+	s = newStatsDirServer(t, dir)
+	if got := leaseFor(t, s, net.IPv4(192, 0, 2, 2)); !got.IPv4.Equal(lease.IPv4) || !got.IPv6.Equal(lease.IPv6) {
+		t.Errorf("lease after restart = %v %v, want %v %v", got.IPv4, got.IPv6, lease.IPv4, lease.IPv6)
+	}
+}
+
+func TestRememberedLeaseTakenOrOutsidePool(t *testing.T) {
+	pool, err := NewIPAddressPool("10.9.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Remember(map[string]*IPLease{
+		"a": {IPv4: net.ParseIP("10.9.0.2"), IPv6: net.ParseIP("fd00::2")},
+		"b": {IPv4: net.ParseIP("10.9.0.2"), IPv6: net.ParseIP("fd00::3")},
+		"c": {IPv4: net.ParseIP("10.8.0.7"), IPv6: net.ParseIP("fd00::7")},
+	})
+
+	a, err := pool.Allocate("a")
+	if err != nil || !a.IPv4.Equal(net.ParseIP("10.9.0.2")) {
+		t.Fatalf("a leased %v, %v", a, err)
+	}
+	// b's address is a's now, and c's is from a subnet no longer in use
+	for _, client := range []string{"b", "c"} {
+		lease, err := pool.Allocate(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.IPv4.Equal(a.IPv4) || !pool.subnet4.Contains(lease.IPv4) {
+			t.Errorf("%s leased %v, want a free address in the pool", client, lease.IPv4)
+		}
+	}
+}
+
+func TestCorruptLeasesFileRefused(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, leasesFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVPNServer(&ServerConfig{PreSharedKey: "0123456789abcdef0123456789abcdef", StatsDir: dir}); err == nil {
+		t.Error("server started with a corrupt leases file")
+	}
+}
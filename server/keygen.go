@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"stealthvpn/pkg/config/wireguard"
+	"stealthvpn/pkg/protocol"
+)
+
+// wireGuardExportNote heads exported WireGuard configs, which only
+// StealthVPN clients can use
+const wireGuardExportNote = "# For stealthvpn-client -import-wg. The server has no WireGuard listener,\n" +
+	"# so wg-quick and the WireGuard apps cannot connect with this config.\n"
+
+// runKeygen implements `stealthvpn-server keygen`, which prints a new X25519
+// key pair. With -pubkey it instead reads a private key from stdin and
+// prints its public key, as `wg pubkey` does, so keys can be checked
+// against the WireGuard tools. With -export-wireguard it prints a
+// WireGuard-format config for a new client of the server instead, for the
+// clients' -import-wg.
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	format := flags.String("format", "wireguard", "Key format (only wireguard is supported)")
+	pubkey := flags.Bool("pubkey", false, "Read a private key from stdin and print its public key")
+	exportWireGuard := flags.Bool("export-wireguard", false, "Print a WireGuard-format config for a new client with a new key pair, for stealthvpn-client -import-wg. wg-quick cannot use it")
+	configFile := flags.String("config", "config.json", "Server config to export from")
+	address := flags.String("address", "", "Client tunnel addresses for the exported config, comma-separated CIDRs such as 10.8.0.2/32")
+	endpoint := flags.String("endpoint", "", "Server host:port for the exported config. Default fake_domain_name and port")
+	flags.Parse(args)
+
+	if *format != "wireguard" {
+		return fmt.Errorf("unsupported key format %q", *format)
+	}
+
+	if *exportWireGuard {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+		client, err := protocol.NewKeyExchange()
+		if err != nil {
+			return err
+		}
+		defer client.Zeroize()
+		conf, err := exportWireGuardConfig(config, client, *address, *endpoint)
+		if err != nil {
+			return err
+		}
+		// The client's public key goes to stderr, so the config alone can
+		// be redirected to a file
+		fmt.Fprintf(os.Stderr, "Client PublicKey = %s\n", client.ExportWireGuardPublicKey())
+		fmt.Print(conf)
+		return nil
+	}
+
+	if *pubkey {
+		input, err := io.ReadAll(io.LimitReader(os.Stdin, 1024))
+		if err != nil {
+			return err
+		}
+		kx, err := protocol.NewKeyExchangeFromWireGuardKey(string(input))
+		if err != nil {
+			return err
+		}
+		defer kx.Zeroize()
+		fmt.Println(kx.ExportWireGuardPublicKey())
+		return nil
+	}
+
+	generated, err := protocol.NewKeyExchange()
+	if err != nil {
+		return err
+	}
+	defer generated.Zeroize()
+
+	// Round-trip the key through the WireGuard format and make sure it still
+	// derives the same public key before handing it out
+	kx, err := protocol.NewKeyExchangeFromWireGuardKey(generated.ExportWireGuardPrivateKey())
+	if err != nil {
+		return err
+	}
+	defer kx.Zeroize()
+	if !bytes.Equal(kx.GetPublicKey(), generated.GetPublicKey()) {
+		return errors.New("exported private key does not derive the generated public key")
+	}
+
+	fmt.Printf("PrivateKey = %s\n", kx.ExportWireGuardPrivateKey())
+	fmt.Printf("PublicKey = %s\n", kx.ExportWireGuardPublicKey())
+	return nil
+}
+
+// exportWireGuardConfig formats a WireGuard config for a client holding the
+// key pair client, with the server's noise_private_key as its peer. Both use
+// raw Curve25519 keys, so they carry over unchanged. The routes and DNS
+// servers are those the server pushes to its clients.
+//
+// The server has no WireGuard listener: the endpoint is its TLS WebSocket
+// listener, so wg-quick can never complete a handshake with the config. It
+// is meant for stealthvpn-client -import-wg, and says so in its first line.
+func exportWireGuardConfig(config *ServerConfig, client *protocol.KeyExchange, address, endpoint string) (string, error) {
+	if config.NoisePrivateKey == "" {
+		return "", errors.New("noise_private_key is required to export a WireGuard config")
+	}
+	server, err := protocol.NewKeyExchangeFromWireGuardKey(config.NoisePrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid noise_private_key: %v", err)
+	}
+	defer server.Zeroize()
+
+	var addresses []string
+	for _, prefix := range strings.Split(address, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			addresses = append(addresses, prefix)
+		}
+	}
+	if len(addresses) == 0 {
+		return "", errors.New("--address is required to export a WireGuard config")
+	}
+	if endpoint == "" {
+		endpoint = net.JoinHostPort(config.FakeDomainName, strconv.Itoa(config.Port))
+	}
+
+	// WireGuard takes DNS servers without ports
+	var dns []string
+	for _, server := range config.DNSServers {
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			server = host
+		}
+		dns = append(dns, server)
+	}
+
+	// Without allowed_ips clients send everything through the tunnel
+	allowedIPs := config.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+
+	conf, err := wireguard.Export(&wireguard.Config{
+		Interface: wireguard.Interface{
+			PrivateKey: client.ExportWireGuardPrivateKey(),
+			Address:    addresses,
+			DNS:        dns,
+			MTU:        config.TunnelMTU,
+		},
+		Peers: []wireguard.Peer{{
+			PublicKey:           server.ExportWireGuardPublicKey(),
+			Endpoint:            endpoint,
+			AllowedIPs:          allowedIPs,
+			PersistentKeepalive: config.KeepaliveInterval,
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return wireGuardExportNote + conf, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"stealthvpn/pkg/config/wireguard"
+	"stealthvpn/pkg/protocol"
+)
+
+// newTestKeyPair returns a new key pair, zeroized when the test ends
+func newTestKeyPair(t *testing.T) *protocol.KeyExchange {
+	t.Helper()
+	kx, err := protocol.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(kx.Zeroize)
+	return kx
+}
+
+func TestExportWireGuardConfig(t *testing.T) {
+	server, client := newTestKeyPair(t), newTestKeyPair(t)
+	config := &ServerConfig{
+		Port:              443,
+		FakeDomainName:    "cdn.example.com",
+		NoisePrivateKey:   server.ExportWireGuardPrivateKey(),
+		DNSServers:        []string{"10.8.0.1:53", "1.1.1.1"},
+		TunnelMTU:         1380,
+		KeepaliveInterval: 25,
+	}
+
+	conf, err := exportWireGuardConfig(config, client, "10.8.0.2/32, fd00:8::2/128", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wg-quick users are told the config is not for them
+	if !strings.HasPrefix(conf, wireGuardExportNote) {
+		t.Errorf("exported config does not start with the note:\n%s", conf)
+	}
+
+	parsed, err := wireguard.Parse(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("exported config does not parse: %v\n%s", err, conf)
+	}
+	if parsed.Interface.PrivateKey != client.ExportWireGuardPrivateKey() || parsed.Interface.MTU != 1380 {
+		t.Errorf("interface = %+v", parsed.Interface)
+	}
+	if ipv4, ipv6 := parsed.Addresses(); ipv4 != "10.8.0.2" || ipv6 != "fd00:8::2" {
+		t.Errorf("Addresses() = %s, %s", ipv4, ipv6)
+	}
+	if got, want := parsed.DNSServers(), []string{"10.8.0.1", "1.1.1.1"}; !slices.Equal(got, want) {
+		t.Errorf("DNSServers() = %v, want %v without ports", got, want)
+	}
+	peer := parsed.Peers[0]
+	if peer.PublicKey != server.ExportWireGuardPublicKey() {
+		t.Errorf("peer key %s, want the server's Noise public key %s", peer.PublicKey, server.ExportWireGuardPublicKey())
+	}
+	if peer.Endpoint != "cdn.example.com:443" || peer.PersistentKeepalive != 25 {
+		t.Errorf("peer = %+v", peer)
+	}
+
+	// Without allowed_ips the server's clients send everything to it
+	if got, want := parsed.AllowedIPs(), []string{"0.0.0.0/0", "::/0"}; !slices.Equal(got, want) {
+		t.Errorf("AllowedIPs() = %v, want %v", got, want)
+	}
+}
+
+func TestExportWireGuardConfigEndpointAndRoutes(t *testing.T) {
+	config := &ServerConfig{
+		Port:            443,
+		FakeDomainName:  "cdn.example.com",
+		NoisePrivateKey: newTestKeyPair(t).ExportWireGuardPrivateKey(),
+		AllowedIPs:      []string{"10.0.0.0/8"},
+	}
+	conf, err := exportWireGuardConfig(config, newTestKeyPair(t), "10.8.0.2/32", "vpn.example.com:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := wireguard.Parse(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := parsed.Peers[0]; peer.Endpoint != "vpn.example.com:8443" || !slices.Equal(peer.AllowedIPs, config.AllowedIPs) {
+		t.Errorf("peer = %+v, want the given endpoint and the server's allowed_ips", peer)
+	}
+}
+
+func TestExportWireGuardConfigRejects(t *testing.T) {
+	key := newTestKeyPair(t).ExportWireGuardPrivateKey()
+	for _, test := range []struct {
+		name    string
+		config  ServerConfig
+		address string
+		wantErr string
+	}{
+		{"no noise key", ServerConfig{}, "10.8.0.2/32", "noise_private_key is required"},
+		{"bad noise key", ServerConfig{NoisePrivateKey: "not-a-key"}, "10.8.0.2/32", "invalid noise_private_key"},
+		{"no address", ServerConfig{NoisePrivateKey: key}, " , ", "--address is required"},
+		{"bad address", ServerConfig{NoisePrivateKey: key}, "10.8.0.2", "invalid prefix"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := exportWireGuardConfig(&test.config, newTestKeyPair(t), test.address, "")
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("exportWireGuardConfig() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
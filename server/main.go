@@ -1,19 +1,35 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/flynn/noise"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"stealthvpn/pkg/auth"
+	"stealthvpn/pkg/keystore"
+	"stealthvpn/pkg/logging"
+	"stealthvpn/pkg/profiling"
 	"stealthvpn/pkg/protocol"
 )
 
@@ -23,48 +39,202 @@ type ServerConfig struct {
 	Port              int    `json:"port"`
 	TLSCertFile       string `json:"tls_cert_file"`
 	TLSKeyFile        string `json:"tls_key_file"`
+	PKCS11Config      *keystore.PKCS11Config `json:"pkcs11"` // keep the TLS key on a hardware token instead of tls_key_file
+	AutoGenerateCert  bool   `json:"auto_generate_cert"` // create a self-signed pair if the files are missing
 	PreSharedKey      string `json:"pre_shared_key"`
+	PreSharedKeyFile  string `json:"pre_shared_key_file"` // read instead of pre_shared_key; STEALTHVPN_PSK overrides both
+	PreSharedKeyID    string `json:"pre_shared_key_id"` // names pre_shared_key in handshakes
+	PreviousPreSharedKeys []PreviousPreSharedKey `json:"previous_pre_shared_keys"` // still accepted while clients rotate
+	PassphraseKDF     *protocol.PassphraseKDF `json:"passphrase_kdf"` // treat the pre-shared key as a passphrase
 	MaxClients        int    `json:"max_clients"`
 	TunnelInterface   string `json:"tunnel_interface"`
+	TunnelMTU         int    `json:"tunnel_mtu"` // largest packet the tunnel carries; TCP handshakes are clamped to fit. Default 1440
 	DNSServers        []string `json:"dns_servers"`
-	AllowedIPs        []string `json:"allowed_ips"`
+	AllowedIPs        []string `json:"allowed_ips"` // routes pushed to clients
 	FakeDomainName    string `json:"fake_domain_name"`
-	EnableDomainFronting bool `json:"enable_domain_fronting"`
+	EnableDomainFronting bool `json:"enable_domain_fronting"` // accept tunnels only for fronted_host
+	FrontedHost       string `json:"fronted_host"` // Host header clients send through the CDN. Default fake_domain_name
+	OTLPEndpoint      string `json:"otlp_endpoint"`
+	KeepaliveInterval int    `json:"keepalive_interval"`
+	DeadPeerIntervals int    `json:"dead_peer_intervals"`
+	MaxConnectionsPerIPPerSecond int `json:"max_connections_per_ip_per_second"`
+	MaxKeyExchangesPerMinute int `json:"max_key_exchanges_per_minute"` // per client IP; 0 for no limit
+	Compression       []protocol.CompressionAlgorithm `json:"compression"`
+	SessionTokenTTL   int    `json:"session_token_ttl"`
+	UDPPort           int    `json:"udp_port"`
+	TunnelSubnet      string `json:"tunnel_subnet"`
+	TunnelSubnet6     string `json:"tunnel_subnet6"`
+	ManagementPort    int    `json:"management_port"`
+	ManagementToken   string `json:"management_token"`
+	StatsDir          string `json:"stats_dir"`
+	RedisURL          string `json:"redis_url"` // share leases, usage and revocations with other servers instead of stats_dir
+	EnableDNSProxy    bool   `json:"enable_dns_proxy"`
+	DNSOverrides      map[string]string `json:"dns_overrides"` // name -> address, answered by the DNS proxy
+	Authenticators    []string `json:"authenticators"` // psk, ldap, radius, totp, certificate; all must pass
+	LDAP              *auth.LDAPConfig `json:"ldap"` // also enables LDAP if authenticators is empty
+	LDAPCacheTTL      int    `json:"ldap_cache_ttl"` // seconds a successful login is remembered
+	TOTP              *auth.TOTPConfig `json:"totp"`
+	RADIUS            *auth.RADIUSConfig `json:"radius"`
+	RADIUSAuthMethod  string `json:"radius_auth_method"` // pap or chap. Default pap
+	ClientCAFile      string `json:"client_ca_file"` // CAs trusted to issue client certificates
+	ClientCRLFile     string `json:"client_crl_file"` // CRLs of those CAs; client certificates they list are refused
+	PaddingBuckets    []int  `json:"padding_buckets"` // frame sizes to pad to; defaults if empty
+	PaddingWeights    []float64 `json:"padding_weights"` // likelihood of each bucket
+	Jitter            *protocol.JitterProfile `json:"jitter"` // shape of the delays added to disguise timing; set disabled to turn them off
+	JitterMinMs       *int `json:"jitter_min_ms"` // shortest added delay; default 0
+	JitterMaxMs       *int `json:"jitter_max_ms"` // longest added delay; default 100, 0 turns the delays off
+	TLSMinVersion     string `json:"tls_min_version"` // "1.2" (default) or "1.3"; older versions only to match a fingerprint
+	TLSCipherSuites   []string `json:"tls_cipher_suites"` // IANA names of the TLS 1.2 suites to offer; modern AEAD suites if empty
+	ALPN              []string `json:"alpn"` // TLS application protocols, most preferred first. Default http/1.1, h2
+	EnableNoise       bool   `json:"enable_noise"` // offer a Noise_XX handshake
+	NoisePrivateKey   string `json:"noise_private_key"` // WireGuard format; a new key each start if empty
+	AuditLogFile      string `json:"audit_log_file"` // hash-chained record of connection attempts
+	AuditLogKeyFile   string `json:"audit_log_key_file"` // HMAC key for the chain, required with audit_log_file and kept apart from it
+	QuotaBytes        uint64 `json:"quota_bytes"` // total traffic each client may use; 0 for no limit
+	ClientQuotas      map[string]uint64 `json:"client_quotas"` // user name or IP -> quota_bytes for that client
+	ClientSessionLimits map[string]int `json:"client_session_limits"` // user name -> sessions it may hold at once; no limit if absent
+	EnableWebRTC      bool   `json:"enable_webrtc"` // let clients move to a WebRTC data channel
+	MeekPath          string `json:"meek_path"` // e.g. /meek/, where clients fronted by a CDN post their traffic; off if empty
+	DoHPath           string `json:"doh_path"` // e.g. /dns-query, where clients send DNS-over-HTTPS queries; off if empty
+	DoHDomain         string `json:"doh_domain"` // zone whose TXT queries carry DoH sessions, e.g. t.example.com
+	TURNServer        string `json:"turn_server"` // e.g. turn:turn.example.com:443?transport=tcp, given to clients for relaying
+	TURNUsername      string `json:"turn_username"`
+	TURNPassword      string `json:"turn_password"`
+	TrustedNetworks   []string `json:"trusted_networks"` // addresses or CIDRs whose web requests may keep their connection open
+	TrustClientPublicIP bool   `json:"trust_client_public_ip"` // take the public address a client learned with STUN as its own, behind a CDN; clients can claim any address
+	Tenants           []TenantConfig `json:"tenants"` // separate virtual networks, chosen by the client's pre-shared key
+	Firewall          *FirewallConfig `json:"firewall"` // restricts where clients' packets may go; no filtering if unset
+	ClientIsolation   bool   `json:"client_isolation"` // drop packets from one client to another's tunnel address
+	EnablePeerSignaling bool `json:"enable_peer_signaling"` // relay clients' public endpoints to each other, for direct tunnels
+	MaxPaths          int    `json:"max_paths"` // connections a client may bond into one session; multipath is off unless above 1
+	ProbeBanFile      string `json:"probe_ban_file"` // addresses seen probing the server are appended here, one per line
+	SingleCipher      bool   `json:"single_cipher"` // let clients that ask encrypt with AES-GCM or ChaCha20 alone instead of both
+	ParallelThreshold int    `json:"parallel_threshold"` // payloads of at least this many bytes are encrypted in chunks on several cores. Default 0, never
+	CryptoWorkers     int    `json:"crypto_workers"` // goroutines, shared by all sessions, decrypting clients' packets. Default one per core; 1 decrypts in each session's reader
+	SendQueueSize     int    `json:"send_queue_size"` // packets from the tunnel interface that may wait for each client. Default 256
+	SendQueuePolicy   string `json:"send_queue_policy"` // what to do when a client's queue is full: drop-oldest (default), drop-newest or block
+	TCPNoDelay        *bool  `json:"tcp_nodelay"` // send small writes to clients at once; default true, false to coalesce them
+	SocketSendBuffer  int    `json:"socket_send_buffer"` // SO_SNDBUF of each client's TCP connection in bytes; system default if 0
+	SocketReceiveBuffer int  `json:"socket_receive_buffer"` // SO_RCVBUF of each client's TCP connection in bytes; system default if 0
+	UDPSendBuffer     int    `json:"udp_send_buffer"` // SO_SNDBUF of the UDP transport's socket, shared by all its clients
+	UDPReceiveBuffer  int    `json:"udp_receive_buffer"` // SO_RCVBUF of the UDP transport's socket, shared by all its clients
+	Access            *AccessConfig `json:"access"` // limits which addresses and countries may connect; all may if unset
 }
 
 // VPNServer represents the stealth VPN server
 type VPNServer struct {
-	config       *ServerConfig
+	config       *ServerConfig // replaced on reload; read through currentConfig
+	configMu     sync.RWMutex
+	configFile   string
 	stealth      *protocol.StealthProtocol
 	encryption   *protocol.MultiLayerEncryption
 	clients      map[string]*ClientSession
+	clientsMu    sync.RWMutex
 	upgrader     websocket.Upgrader
-	tunInterface *TunnelInterface
+	mux          *http.ServeMux // the site on the HTTPS port; never DefaultServeMux, where pprof and expvar register
+	tunInterface *TunnelInterface // nil unless tunnel_interface is set
+	tunnelRoutes sync.Map // tunnel address -> *ClientSession
+	connLimiter  *ipRateLimiter
+	kxLimiter    *ipRateLimiter // nil unless max_key_exchanges_per_minute is set
+	rejectSlots  chan struct{} // one per rejected key exchange being made to wait
+	ipPool       LeaseAllocator
+	resumableSessions sync.Map // session token -> *resumableSession
+	multipathSessions sync.Map // multipath token -> *ClientSession
+	statsStore   StatsStore // nil unless stats_dir or redis_url is set
+	leaseStore   LeaseStore // nil unless stats_dir is set
+	revocations  RevocationBus // nil unless redis_url is set
+	tenants      map[string]*tenant // by name; nil unless tenants are configured
+	statsMu      sync.Mutex
+	authenticator auth.Authenticator // nil unless authentication is configured
+	noiseEnabled bool
+	noiseStatic  noise.DHKey // long-term key for Noise handshakes
+	auditLog     *auditLog // nil unless audit_log_file is set
+	tlsFingerprints sync.Map // remote address -> JA3 fingerprint of its TLS client hello
+	metrics      *serverMetrics
+	metricsPort  int    // serve metrics on their own port instead of the HTTPS one
+	metricsToken string // bearer token required to read metrics
+	chaos        *protocol.ChaosConfig // degrades client connections on purpose; nil normally
+	firewall     atomic.Pointer[firewall] // replaced on reload; nil for no filtering
+	firewallLog  *rate.Limiter // limits logging of dropped packets
+	probes       *probeDetector
+	access       atomic.Pointer[accessControl] // replaced on reload; nil to let all connect
+	packetWorkers *protocol.PacketWorkers // decrypt received packets; nil to decrypt in each session's reader
+	userSessions map[string]int // user name -> sessions open, for client_session_limits
+	userSessionsMu sync.Mutex
 }
 
 // ClientSession represents a connected client
 type ClientSession struct {
-	conn         *websocket.Conn
+	id           string
+	transport    protocol.Transport
+	deadPeer     *protocol.DeadPeerDetector
 	clientIP     net.IP
+	reportedIP   net.IP // the public address the client reported, unverified; nil if none
+	lease        *IPLease
+	connectedAt  time.Time
 	keyExchange  *protocol.KeyExchange
+	transcript   []byte // the key exchange, for PSK proofs
+	pskKeyID     string // the pre-shared key the client says it holds
+	peerCertificates []*x509.Certificate // TLS client certificates, unverified
 	encryption   *protocol.MultiLayerEncryption
-	lastActivity time.Time
+	compressor   *protocol.Compressor
+	sessionToken []byte
+	resumeSecret []byte // issued with sessionToken
+	batching     bool // the client sends batches of frames
+	multipath    bool // the client bonds further connections into the session
+	paths        *protocol.MultipathTransport // nil unless the session is multipath
+	pathToken    []byte // presented by connections joining the session
+	username     string // set when the user logged in
+	endsAt       time.Time // when the session must end, zero for no limit
+	countedSession bool // counted against its user's client_session_limits entry
+	streams      sessionStreams
+	sendQueue    *protocol.SendQueue // packets from the tunnel interface, waiting to be sent
+	lastActivity atomic.Int64 // UnixNano of the client's last frame; read by the cleanup routine
 	bytesIn      uint64
 	bytesOut     uint64
-}
-
-// TunnelInterface manages the TUN interface
-type TunnelInterface struct {
-	name   string
-	subnet *net.IPNet
+	inRate       protocol.ThroughputMeter
+	outRate      protocol.ThroughputMeter
+	history      protocol.SessionStats // client totals as last stored; guarded by statsMu
+	savedIn      uint64 // bytesIn already added to the stored totals
+	savedOut     uint64
+	quota        uint64 // the client's data cap, 0 for none
+	quotaEnd     uint64 // bytesIn+bytesOut at which the client reaches its quota
+	revoked      atomic.Bool // the client was revoked; the session must not be resumed
+	tenant       string // the client's tenant, empty for the default network
 }
 
 // NewVPNServer creates a new stealth VPN server
 func NewVPNServer(config *ServerConfig) (*VPNServer, error) {
 	stealth := protocol.NewStealthProtocol()
 	
+	// Shape frame sizes like the traffic being impersonated
+	if len(config.PaddingBuckets) > 0 {
+		if err := stealth.SetPaddingBuckets(config.PaddingBuckets, config.PaddingWeights); err != nil {
+			return nil, fmt.Errorf("invalid padding buckets: %v", err)
+		}
+	}
+	if config.Jitter != nil {
+		if err := stealth.SetJitterProfile(*config.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	if err := stealth.SetJitterBounds(protocol.JitterBoundsMs(config.JitterMinMs, config.JitterMaxMs)); err != nil {
+		return nil, err
+	}
+	if err := stealth.SetTLSPolicy(config.TLSMinVersion, config.TLSCipherSuites); err != nil {
+		return nil, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+	if err := setServerALPN(stealth, config.ALPN); err != nil {
+		return nil, err
+	}
+	
 	// Initialize pre-shared key encryption
-	encryption, err := protocol.NewMultiLayerEncryption([]byte(config.PreSharedKey))
+	masterKey, err := protocol.MasterKey(config.PreSharedKey, config.PassphraseKDF)
+	if err != nil {
+		return nil, err
+	}
+	defer protocol.ZeroBytes(masterKey)
+	encryption, err := protocol.NewMultiLayerEncryption(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize encryption: %v", err)
 	}
@@ -82,33 +252,200 @@ func NewVPNServer(config *ServerConfig) (*VPNServer, error) {
 		ReadBufferSize:  8192,  // Increased buffer size
 		WriteBufferSize: 8192,  // Increased buffer size
 		EnableCompression: true,
-		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
-			// Don't expose internal errors
-			if status == http.StatusInternalServerError {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
-			http.Error(w, reason.Error(), status)
-		},
 	}
 	
-	return &VPNServer{
+	// Lease dual-stack tunnel addresses to clients
+	ipPool, err := NewIPAddressPool(config.TunnelSubnet, config.TunnelSubnet6)
+	if err != nil {
+		return nil, err
+	}
+	
+	server := &VPNServer{
 		config:     config,
 		stealth:    stealth,
 		encryption: encryption,
 		clients:    make(map[string]*ClientSession),
+		userSessions: make(map[string]int),
 		upgrader:   upgrader,
-	}, nil
+		mux:        http.NewServeMux(),
+		ipPool:     ipPool,
+	}
+	server.upgrader.Error = server.upgradeError
+	
+	// Give each tenant its own virtual network
+	server.tenants, err = newTenants(config, ipPool)
+	if err != nil {
+		return nil, err
+	}
+	
+	server.metrics = newServerMetrics(func() int {
+		server.clientsMu.RLock()
+		defer server.clientsMu.RUnlock()
+		return len(server.clients)
+	}, server.sendQueueDepths)
+	
+	if err := validateTrustedNetworks(config.TrustedNetworks); err != nil {
+		return nil, err
+	}
+	if config.DoHPath != "" && config.DoHDomain == "" {
+		return nil, fmt.Errorf("doh_path needs doh_domain")
+	}
+	if err := validateDomainFronting(config); err != nil {
+		return nil, err
+	}
+	if _, err := protocol.ParseQueuePolicy(config.SendQueuePolicy); err != nil {
+		return nil, err
+	}
+	if config.ParallelThreshold < 0 {
+		return nil, fmt.Errorf("parallel_threshold must not be negative")
+	}
+	if err := validateSocketOptions(config); err != nil {
+		return nil, err
+	}
+	if err := validateSessionLimits(config); err != nil {
+		return nil, err
+	}
+	
+	// Restrict where clients' packets may go
+	rules, err := newFirewall(config.Firewall)
+	if err != nil {
+		return nil, err
+	}
+	server.firewall.Store(rules)
+	server.firewallLog = newFirewallLogLimiter()
+	server.probes = newProbeDetector(config.ProbeBanFile)
+	
+	// Spread decryption of received packets over the cores
+	workers := config.CryptoWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > 1 {
+		server.packetWorkers = protocol.NewPacketWorkers(workers)
+	}
+	
+	// Turn away addresses and countries the operator excludes
+	access, err := newAccessControl(config.Access)
+	if err != nil {
+		return nil, err
+	}
+	server.access.Store(access)
+	
+	// Limit connection floods from a single IP
+	if config.MaxConnectionsPerIPPerSecond > 0 {
+		server.connLimiter = newConnectionLimiter(config.MaxConnectionsPerIPPerSecond)
+	}
+	
+	// Limit how often a single IP can make us do the expensive part
+	if config.MaxKeyExchangesPerMinute > 0 {
+		server.kxLimiter = newKeyExchangeLimiter(config.MaxKeyExchangesPerMinute)
+		server.rejectSlots = make(chan struct{}, maxDelayedRejects)
+	}
+	
+	// Share addresses, traffic totals and revocations with the rest of the
+	// fleet, or keep the totals across restarts of this server alone
+	if config.RedisURL != "" {
+		store, err := NewRedisSessionStore(config.RedisURL, ipPool)
+		if err != nil {
+			return nil, err
+		}
+		server.ipPool = store
+		server.statsStore = store
+		server.revocations = store
+		store.SubscribeRevocations(server.revokeLocal)
+	} else if config.StatsDir != "" {
+		store, err := NewFileStatsStore(config.StatsDir)
+		if err != nil {
+			return nil, err
+		}
+		server.statsStore = store
+		server.leaseStore = store
+		
+		// Give clients back the addresses they had before a restart
+		leases, err := store.LoadLeases()
+		if err != nil {
+			return nil, err
+		}
+		ipPool.Remember(leases)
+	} else if config.QuotaBytes > 0 || len(config.ClientQuotas) > 0 {
+		return nil, errors.New("quotas need stats_dir or redis_url so usage survives reconnects")
+	}
+	
+	// Offer the Noise handshake under a long-term key clients can pin
+	if config.EnableNoise {
+		server.noiseStatic, err = protocol.NoiseStaticKey(config.NoisePrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid noise_private_key: %v", err)
+		}
+		server.noiseEnabled = true
+		slog.Info("Noise handshakes enabled", "public_key", protocol.EncodeNoisePublicKey(server.noiseStatic.Public))
+	}
+	
+	// Require clients to authenticate with the configured backends
+	server.authenticator, err = newAuthenticator(config, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Keep a tamper-evident record of connection attempts
+	if err := validateAuditLog(config); err != nil {
+		return nil, err
+	}
+	if config.AuditLogFile != "" {
+		server.auditLog, err = openAuditLog(config.AuditLogFile, config.AuditLogKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+	}
+	
+	// Route client packets through the host's network stack
+	if config.TunnelInterface != "" {
+		server.tunInterface, err = openTunnel(config.TunnelInterface, tunnelNetworks(ipPool, server.tenants))
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Routing client packets", "interface", server.tunInterface.name)
+	}
+	
+	return server, nil
 }
 
 // Start starts the VPN server
 func (s *VPNServer) Start() error {
+	config := s.currentConfig()
+	
 	// Setup HTTP handlers to mimic a real web service
 	s.setupFakeWebHandlers()
 	
 	// Setup WebSocket handler for VPN traffic
-	http.HandleFunc("/ws", s.handleWebSocket)
-	http.HandleFunc("/api/status", s.handleStatus)
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+	s.mux.HandleFunc("/api/status", s.handleStatus)
+	
+	// Accept clients that reach us through a CDN
+	if config.MeekPath != "" {
+		meek := protocol.NewMeekListener()
+		s.mux.Handle(config.MeekPath, s.meekHandler(meek))
+		go s.serveMeek(meek)
+	}
+	
+	// Accept clients hidden in DNS-over-HTTPS queries
+	if config.DoHPath != "" {
+		doh := s.newDoHListener(config.DoHDomain)
+		s.mux.Handle(config.DoHPath, s.dohHandler(doh))
+		go s.serveDoH(doh)
+	}
+	
+	if s.tunInterface != nil {
+		go s.forwardFromTunnel()
+	}
+	
+	// Metrics go on their own port if given one; on the HTTPS port they must
+	// not be readable by probes, so they need a token there
+	if s.metricsPort > 0 {
+		go s.serveMetrics(s.metricsPort, s.metricsToken)
+	} else if s.metricsToken != "" {
+		s.mux.Handle("/metrics", s.publicMetricsHandler())
+	}
 	
 	// Add HTTP to HTTPS redirect
 	go func() {
@@ -117,7 +454,8 @@ func (s *VPNServer) Start() error {
 			if len(r.URL.RawQuery) > 0 {
 				target += "?" + r.URL.RawQuery
 			}
-			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			w.Header().Set("Location", target)
+			s.writeNginxError(w, r, http.StatusMovedPermanently)
 		})
 		
 		redirectServer := &http.Server{
@@ -126,7 +464,7 @@ func (s *VPNServer) Start() error {
 		}
 		
 		if err := redirectServer.ListenAndServe(); err != nil {
-			log.Printf("HTTP redirect server error: %v", err)
+			slog.Error("HTTP redirect server error", "error", err)
 		}
 	}()
 	
@@ -134,45 +472,141 @@ func (s *VPNServer) Start() error {
 	tlsConfig := s.stealth.GetTLSConfig()
 	tlsConfig.Certificates = make([]tls.Certificate, 1)
 	
-	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	// Let a first run work without a real certificate
+	if config.AutoGenerateCert && config.PKCS11Config == nil {
+		if err := ensureSelfSignedCert(config); err != nil {
+			return err
+		}
+	}
+	
+	// Sign with a hardware token if configured, so the key never touches disk
+	var cert tls.Certificate
+	var err error
+	if config.PKCS11Config != nil {
+		cert, err = loadPKCS11Certificate(config)
+	} else {
+		cert, err = tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to load TLS certificate: %v", err)
 	}
 	tlsConfig.Certificates[0] = cert
 	
+	// Ask for client certificates; the certificate authenticator verifies them
+	if requestsClientCertificate(config) {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	
+	// Fingerprint client hellos for the audit log
+	if s.auditLog != nil {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.tlsFingerprints.Store(hello.Conn.RemoteAddr().String(), tlsFingerprint(hello))
+			return nil, nil
+		}
+	}
+	
 	// Create server with custom error handling
 	server := &http.Server{
-		Addr:      fmt.Sprintf("%s:%d", s.config.Host, s.config.Port),
+		Addr:      fmt.Sprintf("%s:%d", config.Host, config.Port),
 		TLSConfig: tlsConfig,
 		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.TLS == nil {
 				http.Error(w, "HTTPS Required", http.StatusBadRequest)
 				return
 			}
-			http.DefaultServeMux.ServeHTTP(w, r)
+			s.mux.ServeHTTP(w, r)
 		}),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				s.tlsFingerprints.Delete(conn.RemoteAddr().String())
+			}
+		},
 	}
 	
-	log.Printf("Starting StealthVPN server on %s:%d", s.config.Host, s.config.Port)
-	log.Printf("Fake domain: %s", s.config.FakeDomainName)
+	slog.Info("Starting StealthVPN server", "host", config.Host, "port", config.Port, "domain", config.FakeDomainName)
+	
+	// Accept clients on the UDP transport alongside HTTPS
+	if config.UDPPort > 0 {
+		go s.serveUDP()
+	}
+	
+	// Serve the management API on localhost only
+	if config.ManagementPort > 0 {
+		go s.serveManagement()
+	}
 	
-	// Start cleanup routine
+	// Resolve clients' DNS queries inside the tunnel
+	if config.EnableDNSProxy {
+		s.serveDNS()
+	}
+	
+	// Start cleanup routines
 	go s.cleanupRoutine()
+	if s.connLimiter != nil {
+		go s.connLimiter.cleanupRoutine()
+	}
+	if s.kxLimiter != nil {
+		go s.kxLimiter.cleanupRoutine()
+	}
 	
-	return server.ListenAndServeTLS("", "")
+	listener, err := listenDualStack(server.Addr)
+	if err != nil {
+		return err
+	}
+	listener = tcpSocketOptions(config).Listener(listener)
+	
+	return server.ServeTLS(listener, "", "")
+}
+
+// listenDualStack listens on addr. A wildcard host binds [::] with
+// IPV6_V6ONLY cleared so one socket accepts both IPv4 and IPv6 clients.
+func listenDualStack(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return net.Listen("tcp", addr)
+	}
+	
+	listenConfig := net.ListenConfig{Control: clearV6Only}
+	return listenConfig.Listen(context.Background(), "tcp6", net.JoinHostPort("::", port))
+}
+
+// tcpSocketOptions returns the options for clients' TCP connections
+func tcpSocketOptions(config *ServerConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		NoDelay:     config.TCPNoDelay,
+		ReadBuffer:  config.SocketReceiveBuffer,
+		WriteBuffer: config.SocketSendBuffer,
+	}
+}
+
+// udpSocketOptions returns the options for the UDP transport's socket
+func udpSocketOptions(config *ServerConfig) protocol.SocketOptions {
+	return protocol.SocketOptions{
+		ReadBuffer:  config.UDPReceiveBuffer,
+		WriteBuffer: config.UDPSendBuffer,
+	}
+}
+
+// validateSocketOptions checks the configured socket buffer sizes
+func validateSocketOptions(config *ServerConfig) error {
+	if err := tcpSocketOptions(config).Validate(); err != nil {
+		return err
+	}
+	return udpSocketOptions(config).Validate()
 }
 
 // setupFakeWebHandlers creates fake web endpoints to look like a real service
 func (s *VPNServer) setupFakeWebHandlers() {
-	// Fake landing page
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Add timing jitter
-		s.stealth.AddTimingJitter()
-		
-		html := `<!DOCTYPE html>
+	// Pages last changed when the server started, as if just deployed
+	deployed := time.Now()
+	landing := newFakePage("text/html", `<!DOCTYPE html>
 <html>
 <head>
     <title>CloudSync API Gateway</title>
@@ -200,43 +634,62 @@ func (s *VPNServer) setupFakeWebHandlers() {
         <p>For API documentation, visit <a href="/docs">/docs</a></p>
     </div>
 </body>
-</html>`
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Server", "nginx/1.18.0")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(html))
+</html>`, deployed)
+	docs := newFakePage("text/html", "<h1>API Documentation</h1><p>Documentation coming soon...</p>", deployed)
+	
+	// Fake landing page; like nginx, anything else is not found
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			s.probeNotFound(r)
+			s.writeNginxError(w, r, http.StatusNotFound)
+			return
+		}
+		s.serveFakePage(w, r, landing)
 	})
 	
 	// Fake API endpoints
-	http.HandleFunc("/api/v1/sync", func(w http.ResponseWriter, r *http.Request) {
-		s.stealth.AddTimingJitter()
-		response := map[string]interface{}{
+	s.mux.HandleFunc("/api/v1/sync", func(w http.ResponseWriter, r *http.Request) {
+		s.serveFakeJSON(w, r, map[string]interface{}{
 			"status": "success",
 			"data":   map[string]string{"message": "Sync completed"},
 			"timestamp": time.Now().Unix(),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Server", "nginx/1.18.0")
-		json.NewEncoder(w).Encode(response)
+		})
 	})
 	
-	http.HandleFunc("/docs", func(w http.ResponseWriter, r *http.Request) {
-		s.stealth.AddTimingJitter()
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Server", "nginx/1.18.0")
-		w.Write([]byte("<h1>API Documentation</h1><p>Documentation coming soon...</p>"))
+	s.mux.HandleFunc("/docs", func(w http.ResponseWriter, r *http.Request) {
+		s.serveFakePage(w, r, docs)
 	})
 }
 
 // handleWebSocket handles WebSocket connections (actual VPN traffic)
 func (s *VPNServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Log connection attempt
-	log.Printf("WebSocket connection attempt from %s", r.RemoteAddr)
+	slog.Debug("WebSocket connection attempt", "addr", r.RemoteAddr)
+	
+	if !s.accessAllowed(w, r) {
+		return
+	}
+	
+	// Reject connection floods before doing any expensive work
+	if s.connLimiter != nil {
+		if allowed, retryAfter := s.connLimiter.allow(r.RemoteAddr); !allowed {
+			slog.Warn("Connection rate limit exceeded", "addr", r.RemoteAddr)
+			s.audit(r.RemoteAddr, s.clientHelloFingerprint(r.RemoteAddr), auditRateLimited, nil)
+			s.writeTooManyRequests(w, r, retryAfter)
+			return
+		}
+	}
 	
 	// Verify this looks like a legitimate WebSocket upgrade
 	if r.Header.Get("Upgrade") != "websocket" {
-		log.Printf("Invalid upgrade header from %s", r.RemoteAddr)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		slog.Warn("Invalid upgrade header", "addr", r.RemoteAddr)
+		s.reportProbe(r, probeBadUpgrade)
+		s.writeNginxError(w, r, http.StatusBadRequest)
+		return
+	}
+	if !s.frontedHostAllowed(r) {
+		s.reportProbe(r, probeWrongHost)
+		s.writeNginxError(w, r, http.StatusNotFound)
 		return
 	}
 	
@@ -245,170 +698,641 @@ func (s *VPNServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	
 	// Log TLS version and cipher suite
 	if r.TLS != nil {
-		log.Printf("TLS Version: %x, Cipher Suite: %x from %s", r.TLS.Version, r.TLS.CipherSuite, r.RemoteAddr)
+		slog.Debug("TLS connection", "addr", r.RemoteAddr, "version", tls.VersionName(r.TLS.Version), "cipher_suite", tls.CipherSuiteName(r.TLS.CipherSuite))
 	}
 	
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed from %s: %v", r.RemoteAddr, err)
+		slog.Warn("WebSocket upgrade failed", "addr", r.RemoteAddr, "error", err)
+		s.reportProbe(r, probeMalformedUpgrade)
 		return
 	}
 	
-	// Set read/write deadlines
+	// Bound the handshake; the dead-peer detector manages the read deadline afterwards
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	
 	defer conn.Close()
 	
-	// Perform key exchange
-	session, err := s.performKeyExchange(conn, r.RemoteAddr)
-	if err != nil {
-		log.Printf("Key exchange failed with %s: %v", r.RemoteAddr, err)
+	// Further connections of a multipath client join its session
+	if token := pathTokenFromRequest(r); token != nil {
+		s.joinPath(protocol.NewWebSocketTransport(conn), r.RemoteAddr, token)
+		return
+	}
+	
+	var peerCertificates []*x509.Certificate
+	if r.TLS != nil {
+		peerCertificates = r.TLS.PeerCertificates
+	}
+	
+	// Clients behind restrictive firewalls move to a WebRTC data channel
+	var transport protocol.Transport = protocol.NewWebSocketTransport(conn)
+	if r.Header.Get(protocol.TransportHeader) == string(protocol.TransportWebRTC) {
+		rtc, err := s.acceptWebRTC(transport)
+		if err != nil {
+			slog.Warn("WebRTC setup failed", "addr", r.RemoteAddr, "error", err)
+			return
+		}
+		defer rtc.Close()
+		conn.Close()
+		rtc.SetReadDeadline(time.Now().Add(60 * time.Second))
+		transport = rtc
+	}
+	
+	// Continue the client's trace of the connection, if it sent one
+	ctx := protocol.ExtractHTTPTraceContext(r.Context(), r.Header)
+	s.serveSession(ctx, transport, r.RemoteAddr, s.clientHelloFingerprint(r.RemoteAddr), peerCertificates, s.resumeSession(sessionTokenFromRequest(r)))
+}
+
+// serveSession runs the handshake and packet loop for a client on any transport.
+// A non-nil resumable continues a previous session without a key exchange.
+func (s *VPNServer) serveSession(ctx context.Context, transport protocol.Transport, remoteAddr, tlsFingerprint string, peerCertificates []*x509.Certificate, resumable *resumableSession) {
+	var session *ClientSession
+	transport = s.chaos.Wrap(transport)
+	
+	// Trace the handshake up to the client's first packet
+	ctx, span := protocol.Tracer().Start(ctx, "handshake", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", remoteAddr)))
+	if traceID := protocol.TraceID(ctx); traceID != "" {
+		slog.Info("Handshake traced", "addr", remoteAddr, "trace_id", traceID)
+	}
+	
+	// Record how the attempt ended, with the session's totals if it got that far
+	outcome := auditHandshakeFailure
+	defer func() {
+		if outcome != auditSuccess {
+			span.SetStatus(codes.Error, outcome)
+		}
+		span.End()
+		s.audit(remoteAddr, tlsFingerprint, outcome, session)
+	}()
+	
+	if resumable != nil {
+		encryption, nonce, err := resumedEncryption(resumable)
+		if err != nil {
+			slog.Warn("Session resumption failed", "addr", remoteAddr, "error", err)
+			return
+		}
+		encryption.SetParallelThreshold(s.currentConfig().ParallelThreshold)
+		session = s.newResumedSession(transport, remoteAddr, resumable, encryption)
+		if err := protocol.WriteJSON(transport, protocol.KeyExchangeMessage{
+			Type:        protocol.SessionResumedType,
+			Version:     protocol.ProtocolVersion,
+			ResumeNonce: nonce,
+		}); err != nil {
+			slog.Warn("Session resumption failed", "addr", remoteAddr, "error", err)
+			session.encryption.Zeroize()
+			return
+		}
+		slog.Info("Resumed session", "addr", remoteAddr)
+		span.SetAttributes(attribute.Bool("session.resumed", true))
+	} else {
+		if s.kxLimiter != nil {
+			if allowed, _ := s.kxLimiter.allow(remoteAddr); !allowed {
+				slog.Warn("Key exchange rate limit exceeded", "addr", remoteAddr)
+				outcome = auditRateLimited
+				s.rejectKeyExchange(transport)
+				return
+			}
+		}
+		
+		var err error
+		_, kxSpan := protocol.Tracer().Start(ctx, "key_exchange")
+		session, err = s.performKeyExchange(transport, remoteAddr)
+		protocol.EndSpan(kxSpan, err)
+		s.metrics.keyExchange(err)
+		if err != nil {
+			slog.Warn("Key exchange failed", "addr", remoteAddr, "error", err)
+			return
+		}
+	}
+	
+	// Park or wipe session key material once the session ends
+	defer s.releaseSession(session)
+	
+	// Checking the client's proof of the key and sending it the first
+	// encrypted messages confirm both sides derived the same keys
+	_, confirmSpan := protocol.Tracer().Start(ctx, "key_confirmation")
+	
+	// Resumed sessions authenticated when they were first established
+	if resumable == nil && s.authenticator != nil {
+		session.peerCertificates = peerCertificates
+		if err := s.authenticateClient(session); err != nil {
+			slog.Warn("Authentication failed", "addr", remoteAddr, "error", err)
+			protocol.EndSpan(confirmSpan, err)
+			outcome = auditAuthFailure
+			return
+		}
+		attrs := []any{"addr", remoteAddr, "user", session.username}
+		if usesAuthenticator(s.currentConfig(), authPSK) {
+			attrs = append(attrs, "psk_id", session.pskKeyID)
+		}
+		slog.Info("Authenticated client", attrs...)
+	}
+	
+	// Hand out a fresh single-use token for the next reconnect
+	if s.sessionTokenTTL() > 0 {
+		if err := s.issueSessionToken(session); err != nil {
+			slog.Error("Failed to issue session token", "addr", remoteAddr, "error", err)
+			protocol.EndSpan(confirmSpan, err)
+			return
+		}
+	}
+	confirmSpan.End()
+	
+	// Let the client bond further connections into the session
+	if session.multipath {
+		if err := s.startMultipath(session); err != nil {
+			slog.Error("Failed to start multipath", "addr", remoteAddr, "error", err)
+			return
+		}
+		defer s.stopMultipath(session)
+	}
+	
+	// Split the client's batches back into frames. This must happen before
+	// the session is registered, when packets routed to it start arriving.
+	if session.batching {
+		session.transport = protocol.NewBatchReader(session.transport)
+	}
+	
+	slog.Info("Client connected", "addr", remoteAddr)
+	
+	// Refuse clients that used up their quota until an operator resets it
+	if s.quotaExhausted(session) {
+		s.refuseOverQuota(session)
+		outcome = auditQuotaExceeded
+		return
+	}
+	
+	// Refuse users that already hold as many sessions as they may
+	if active, limit, ok := s.acquireSessionSlot(session); !ok {
+		s.refuseOverSessionLimit(session, active, limit)
+		outcome = auditSessionLimit
 		return
 	}
+	defer s.releaseSessionSlot(session)
 	
-	log.Printf("Client connected successfully from %s", r.RemoteAddr)
+	// Queue packets routed to the session, so a client that falls behind
+	// costs its own packets rather than stalling everyone's
+	policy, _ := protocol.ParseQueuePolicy(s.currentConfig().SendQueuePolicy)
+	session.sendQueue = protocol.NewSendQueue(s.currentConfig().SendQueueSize, policy)
+	defer s.startSending(session)()
+	
+	// Register the session and release its slot and addresses as soon as it ends
+	if err := s.addSession(session); err != nil {
+		slog.Warn("Cannot accept client", "addr", remoteAddr, "error", err)
+		outcome = auditRejected
+		return
+	}
+	defer s.removeSession(session)
+	outcome = auditSuccess
+	
+	// Pick up the client's traffic from earlier sessions and record this one's
+	s.loadHistoricalStats(session)
+	defer s.persistStats(session)
+	s.startQuota(session)
+	
+	// Close any SOCKS5 egress streams when the tunnel goes away
+	defer session.streams.closeAll()
+	
+	slog.Info("Assigned tunnel addresses", "addr", remoteAddr, "ipv4", session.lease.IPv4, "ipv6", session.lease.IPv6)
+	
+	// Tell the client its addresses, which resolvers to use and what to route
+	if err := s.sendControl(session, s.tunnelConfig(session)); err != nil {
+		slog.Error("Failed to send tunnel config", "addr", remoteAddr, "error", err)
+		return
+	}
+	
+	// Clear the handshake write deadline
+	transport.SetWriteDeadline(time.Time{})
+	
+	if session.paths != nil {
+		// Each bonded connection detects a dead peer on its own
+	} else if ws, ok := protocol.UnwrapWebSocket(transport); ok {
+		// Detect peers that silently stop responding. Sessions reads the
+		// detector's link quality measurements under clientsMu.
+		deadPeer := protocol.NewDeadPeerDetector(ws.Conn(),
+			time.Duration(s.currentConfig().KeepaliveInterval)*time.Second, s.currentConfig().DeadPeerIntervals)
+		s.clientsMu.Lock()
+		session.deadPeer = deadPeer
+		s.clientsMu.Unlock()
+		session.deadPeer.Start()
+		defer session.deadPeer.Stop()
+	} else {
+		transport.SetReadDeadline(time.Time{})
+	}
 	
 	// Handle client session
-	s.handleClientSession(session)
+	_, firstPacket := protocol.Tracer().Start(ctx, "first_packet")
+	span.End()
+	s.handleClientSession(session, firstPacket)
+}
+
+// addSession registers an active client session
+func (s *VPNServer) addSession(session *ClientSession) error {
+	id := clientIdentity(session)
+	lease, err := s.allocatorFor(session).Allocate(id)
+	if err != nil {
+		return err
+	}
+	if s.leaseStore != nil {
+		if err := s.leaseStore.SaveLease(id, lease); err != nil {
+			slog.Error("Failed to save lease", "client", session.clientIP, "error", err)
+		}
+	}
+	session.lease = lease
+	session.connectedAt = time.Now()
+	
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clients[session.id] = session
+	s.routeToSession(session)
+	return nil
+}
+
+// removeSession releases the slot held by a client session
+func (s *VPNServer) removeSession(session *ClientSession) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if s.clients[session.id] == session {
+		delete(s.clients, session.id)
+		s.unrouteSession(session)
+		s.allocatorFor(session).Release(session.lease)
+		s.endTenantSession(session)
+	}
+}
+
+// writeTooManyRequests rejects a request the way nginx's limit_req would
+func (s *VPNServer) writeTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	s.writeNginxError(w, r, http.StatusTooManyRequests)
 }
 
-// performKeyExchange performs X25519 key exchange with the client
-func (s *VPNServer) performKeyExchange(conn *websocket.Conn, remoteAddr string) (*ClientSession, error) {
+// performKeyExchange performs X25519 key exchange with the client, or a
+// Noise_XX handshake if both sides enable it
+func (s *VPNServer) performKeyExchange(transport protocol.Transport, remoteAddr string) (*ClientSession, error) {
+	config := s.currentConfig()
+	
 	// Create key exchange
 	kx, err := protocol.NewKeyExchange()
 	if err != nil {
 		return nil, err
 	}
 	
-	// Send our public key
-	publicKeyMsg := map[string]interface{}{
-		"type": "key_exchange",
-		"public_key": kx.GetPublicKey(),
+	// Send our public key and the compression algorithms we accept
+	publicKeyMsg := protocol.KeyExchangeMessage{
+		Type:              protocol.KeyExchangeType,
+		Version:           protocol.ProtocolVersion,
+		PublicKey:         kx.GetPublicKey(),
+		Compression:       config.Compression,
+		SessionResumption: s.sessionTokenTTL() > 0,
+		Batching:          true,
+		AuthRequired:      s.authenticator != nil,
+		Noise:             s.noiseEnabled,
+		Multipath:         s.maxPaths() > 1,
+	}
+	if config.SingleCipher {
+		publicKeyMsg.Ciphers = protocol.SingleCiphers
 	}
 	
-	if err := conn.WriteJSON(publicKeyMsg); err != nil {
+	// Both messages are kept raw to authenticate them in a Noise handshake
+	hello, err := json.Marshal(publicKeyMsg)
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.WriteMessage(hello); err != nil {
 		return nil, err
 	}
 	
 	// Receive client's public key
-	var clientKeyMsg map[string]interface{}
-	if err := conn.ReadJSON(&clientKeyMsg); err != nil {
+	reply, err := transport.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var clientKeyMsg protocol.KeyExchangeMessage
+	if err := json.Unmarshal(reply, &clientKeyMsg); err != nil {
 		return nil, err
 	}
 	
-	clientPublicKey, ok := clientKeyMsg["public_key"].([]byte)
-	if !ok {
+	if clientKeyMsg.Type != protocol.KeyExchangeType {
+		return nil, fmt.Errorf("unexpected message type: %s", clientKeyMsg.Type)
+	}
+	if err := protocol.CheckProtocolVersion("client", clientKeyMsg.Version); err != nil {
+		return nil, err
+	}
+	if clientKeyMsg.Noise && !s.noiseEnabled {
+		return nil, fmt.Errorf("client requested a Noise handshake, which is not enabled")
+	}
+	if !clientKeyMsg.Noise && len(clientKeyMsg.PublicKey) == 0 {
 		return nil, fmt.Errorf("invalid client public key")
 	}
 	
-	// Compute shared secret
-	sharedSecret, err := kx.ComputeSharedSecret(clientPublicKey)
+	// Agree on packet compression
+	var requested protocol.CompressionAlgorithm
+	if len(clientKeyMsg.Compression) > 0 {
+		requested = clientKeyMsg.Compression[0]
+	}
+	compressor, err := protocol.NewCompressor(protocol.NegotiateCompression(config.Compression, requested))
 	if err != nil {
 		return nil, err
 	}
 	
-	// Create session encryption
-	sessionEncryption, err := protocol.NewMultiLayerEncryption(sharedSecret)
-	if err != nil {
+	// Agree on the ciphers, both layers unless the client picked one we offered
+	cipher := protocol.CipherLayered
+	if len(clientKeyMsg.Ciphers) > 0 {
+		cipher = protocol.NegotiateCipher(publicKeyMsg.Ciphers, clientKeyMsg.Ciphers[0])
+	}
+	
+	var sessionEncryption *protocol.MultiLayerEncryption
+	var transcript []byte
+	if clientKeyMsg.Noise {
+		// The client's Noise handshake replaces our ephemeral key
+		kx.Zeroize()
+		kx = nil
+		
+		noiseSession, err := protocol.NoiseHandshake(transport, false, s.noiseStatic, nil, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Noise handshake", "addr", remoteAddr, "client_public_key", protocol.EncodeNoisePublicKey(noiseSession.PeerStatic))
+		sessionEncryption, transcript = noiseSession.Encryption, noiseSession.Transcript
+	} else {
+		// Compute shared secret, bound to both messages of the handshake
+		sharedSecret, err := kx.ComputeSharedSecret(clientKeyMsg.PublicKey, protocol.KeyExchangeTranscript(hello, reply))
+		if err != nil {
+			return nil, err
+		}
+		
+		// Create session encryption
+		sessionEncryption, err = protocol.NewMultiLayerEncryption(sharedSecret)
+		protocol.ZeroBytes(sharedSecret)
+		if err != nil {
+			return nil, err
+		}
+		transcript = protocol.HandshakeTranscript(kx.GetPublicKey(), clientKeyMsg.PublicKey)
+	}
+	if err := sessionEncryption.SetCipher(cipher); err != nil {
 		return nil, err
 	}
+	sessionEncryption.SetParallelThreshold(s.currentConfig().ParallelThreshold)
+	slog.Debug("Session cipher", "addr", remoteAddr, "cipher", cipher)
 	
 	// Parse client IP
 	host, _, _ := net.SplitHostPort(remoteAddr)
 	clientIP := net.ParseIP(host)
 	
-	return &ClientSession{
-		conn:         conn,
+	// Behind a CDN the connection comes from the CDN, so the address the
+	// client reports is the only one known for it
+	reportedIP := reportedPublicIP(clientKeyMsg.PublicIP)
+	if reportedIP == nil && clientKeyMsg.PublicIP != "" {
+		slog.Debug("Ignoring invalid public address", "addr", remoteAddr, "public_ip", clientKeyMsg.PublicIP)
+	}
+	if reportedIP != nil && config.TrustClientPublicIP {
+		clientIP = reportedIP
+	}
+	
+	session := &ClientSession{
+		id:           remoteAddr,
+		transport:    transport,
 		clientIP:     clientIP,
+		reportedIP:   reportedIP,
 		keyExchange:  kx,
+		transcript:   transcript,
+		pskKeyID:     clientKeyMsg.KeyID,
 		encryption:   sessionEncryption,
-		lastActivity: time.Now(),
-	}, nil
+		compressor:   compressor,
+		batching:     clientKeyMsg.Batching,
+		multipath:    clientKeyMsg.Multipath && s.maxPaths() > 1,
+	}
+	session.markActive(time.Now())
+	return session, nil
 }
 
-// handleClientSession handles an active client session
-func (s *VPNServer) handleClientSession(session *ClientSession) {
+// reportedPublicIP parses the public address a client reported in its key
+// exchange. Private, loopback and other addresses its traffic cannot come
+// from on the internet are rejected.
+func reportedPublicIP(reported string) net.IP {
+	ip := net.ParseIP(reported)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	return ip
+}
+
+// newResumedSession creates a session that continues a previous session
+// under fresh keys
+func (s *VPNServer) newResumedSession(transport protocol.Transport, remoteAddr string, resumable *resumableSession, encryption *protocol.MultiLayerEncryption) *ClientSession {
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	
+	session := &ClientSession{
+		id:           remoteAddr,
+		transport:    transport,
+		clientIP:     net.ParseIP(host),
+		encryption:   encryption,
+		compressor:   resumable.compressor,
+		batching:     resumable.batching,
+		multipath:    resumable.multipath && s.maxPaths() > 1,
+		username:     resumable.username,
+		tenant:       resumable.tenant,
+		endsAt:       resumable.endsAt,
+	}
+	session.markActive(time.Now())
+	return session
+}
+
+// markActive records that the client was heard from at t
+func (session *ClientSession) markActive(t time.Time) {
+	session.lastActivity.Store(t.UnixNano())
+}
+
+// lastActive returns when the client was last heard from
+func (session *ClientSession) lastActive() time.Time {
+	return time.Unix(0, session.lastActivity.Load())
+}
+
+// handleClientSession handles an active client session, ending firstPacket
+// once the first message arrives
+func (s *VPNServer) handleClientSession(session *ClientSession, firstPacket trace.Span) {
+	tracer := protocol.Tracer()
+	defer firstPacket.End()
+	
+	// Packets are decrypted on the shared workers and handled in order
+	var pipeline *protocol.OrderedPipeline
+	if s.packetWorkers != nil {
+		pipeline = protocol.NewOrderedPipeline(s.packetWorkers)
+		defer pipeline.Close()
+	}
+	
 	for {
 		// Read message from client
-		_, message, err := session.conn.ReadMessage()
+		message, err := session.transport.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from client: %v", err)
+			slog.Info("Client disconnected", "client", session.clientIP, "error", err)
+			protocol.EndSpan(firstPacket, err)
 			break
 		}
+		firstPacket.End()
 		
-		session.lastActivity = time.Now()
-		session.bytesIn += uint64(len(message))
-		
-		// Deobfuscate the packet
-		deobfuscated, err := s.stealth.DeobfuscatePacket(message)
-		if err != nil {
-			log.Printf("Failed to deobfuscate packet: %v", err)
-			continue
+		start := time.Now()
+		session.markActive(start)
+		if session.deadPeer != nil {
+			session.deadPeer.MarkAlive()
 		}
+		atomic.AddUint64(&session.bytesIn, uint64(len(message)))
+		session.inRate.Add(len(message))
+		s.metrics.addBytes("in", session.clientIP, len(message))
 		
-		// Decrypt the packet
-		decrypted, err := session.encryption.Decrypt(deobfuscated)
-		if err != nil {
-			log.Printf("Failed to decrypt packet: %v", err)
-			continue
+		// Cut the client off once it reaches its quota
+		if s.overQuota(session) {
+			s.refuseOverQuota(session)
+			break
 		}
 		
-		// Process the decrypted VPN packet
-		s.processVPNPacket(session, decrypted)
+		// Continue the trace started by the client, if it was sampled
+		ctx, span := tracer.Start(s.stealth.ExtractTraceContext(context.Background(), message), "handleClientSession")
+		
+		work := func() func() {
+			payload, err := s.openPacket(ctx, session, message)
+			if err != nil {
+				span.End()
+				return nil
+			}
+			return func() {
+				// SOCKS5 clients send stream messages instead of IP packets
+				if protocol.IsControlMessage(payload) {
+					s.handleControlMessage(session, payload)
+				} else {
+					s.processVPNPacket(session, payload)
+				}
+				s.metrics.observePacket(start)
+				span.End()
+			}
+		}
+		if pipeline != nil {
+			pipeline.Submit(work)
+		} else if deliver := work(); deliver != nil {
+			deliver()
+		}
 	}
 }
 
-// processVPNPacket processes a decrypted VPN packet
-func (s *VPNServer) processVPNPacket(session *ClientSession, packet []byte) {
-	// TODO: Implement actual packet routing logic
-	// This would typically involve:
-	// 1. Parsing the IP packet
-	// 2. Routing to the appropriate destination
-	// 3. Handling return traffic
+// openPacket deobfuscates, decrypts and decompresses a message from the
+// client, logging any failure
+func (s *VPNServer) openPacket(ctx context.Context, session *ClientSession, message []byte) ([]byte, error) {
+	tracer := protocol.Tracer()
 	
-	log.Printf("Processing VPN packet of %d bytes from %s", len(packet), session.clientIP)
+	// Deobfuscate the packet
+	_, deobfuscateSpan := tracer.Start(ctx, "DeobfuscatePacket")
+	deobfuscated, err := s.stealth.DeobfuscatePacket(message)
+	deobfuscateSpan.End()
+	if err != nil {
+		slog.Warn("Failed to deobfuscate packet", "client", session.clientIP, "error", err)
+		return nil, err
+	}
 	
-	// For now, just echo back a response to keep the connection alive
-	response := []byte("VPN packet processed")
+	// Decrypt the packet
+	_, decryptSpan := tracer.Start(ctx, "MultiLayerEncryption.Decrypt")
+	decrypted, err := session.encryption.DecryptInPlace(deobfuscated)
+	decryptSpan.End()
+	if err != nil {
+		slog.Warn("Failed to decrypt packet", "client", session.clientIP, "error", err)
+		s.metrics.encryptionErrors.Inc()
+		return nil, err
+	}
 	
-	// Encrypt response
-	encrypted, err := session.encryption.Encrypt(response)
+	// Decompress the packet
+	decompressed, err := session.compressor.Decompress(decrypted)
 	if err != nil {
-		log.Printf("Failed to encrypt response: %v", err)
+		slog.Warn("Failed to decompress packet", "client", session.clientIP, "error", err)
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+// processVPNPacket processes a decrypted VPN packet
+func (s *VPNServer) processVPNPacket(session *ClientSession, packet []byte) {
+	// Keep tenants' virtual networks apart
+	if s.crossesTenants(session, packet) {
+		slog.Warn("Dropped packet to another tenant's network", "client", session.clientIP)
 		return
 	}
 	
-	// Obfuscate response
-	obfuscated, err := s.stealth.ObfuscatePacket(encrypted)
-	if err != nil {
-		log.Printf("Failed to obfuscate response: %v", err)
+	// Clients may only reach each other if the operator allows it
+	if s.currentConfig().ClientIsolation && s.toOtherClient(session, packet) {
+		slog.Debug("Dropped packet to another client", "client", session.clientIP)
 		return
 	}
+	if !s.firewallAllows(session, packet) {
+		return
+	}
+	
+	// Keep the client's TCP connections to segments that fit the tunnel
+	s.clampMSS(packet)
 	
-	// Send response
-	if err := session.conn.WriteMessage(websocket.BinaryMessage, obfuscated); err != nil {
-		log.Printf("Failed to send response: %v", err)
+	// Hand the packet to the host to route; replies come back through
+	// forwardFromTunnel
+	if s.tunInterface != nil {
+		if _, err := s.tunInterface.Write(packet); err != nil {
+			slog.Error("Failed to write packet", "client", session.clientIP, "interface", s.tunInterface.name, "error", err)
+		}
 		return
 	}
 	
-	session.bytesOut += uint64(len(obfuscated))
+	// Without a tunnel interface there is nowhere to route to
+	slog.Debug("Processing VPN packet", "client", session.clientIP, "bytes", len(packet))
+	
+	// For now, just echo back a response to keep the connection alive.
+	// It waits in the send queue like any other packet, so a congested
+	// client does not stall this reader.
+	buf := protocol.GetPacketBuffer()
+	*buf = append((*buf)[:0], "VPN packet processed"...)
+	s.queueToClient(session, buf)
 }
 
-// handleStatus provides server status (fake endpoint)
-func (s *VPNServer) handleStatus(w http.ResponseWriter, r *http.Request) {
-	s.stealth.AddTimingJitter()
+// sendToClient compresses, encrypts and obfuscates a payload and sends it to
+// the client. It is safe to call from several goroutines.
+func (s *VPNServer) sendToClient(session *ClientSession, payload []byte) error {
+	// Compress payload if negotiated
+	compressBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(compressBuf)
+	compressed := session.compressor.Compress(*compressBuf, payload)
+	
+	// Encrypt payload into a pooled buffer
+	encryptBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(encryptBuf)
+	encrypted, err := session.encryption.EncryptTo(*encryptBuf, compressed)
+	if err != nil {
+		s.metrics.encryptionErrors.Inc()
+		return fmt.Errorf("failed to encrypt: %v", err)
+	}
+	
+	// Obfuscate payload
+	obfuscateBuf := protocol.GetPacketBuffer()
+	defer protocol.PutPacketBuffer(obfuscateBuf)
+	obfuscated, err := s.stealth.ObfuscatePacketTo(*obfuscateBuf, encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to obfuscate: %v", err)
+	}
+	
+	if err := session.transport.WriteMessage(obfuscated); err != nil {
+		return err
+	}
 	
-	status := map[string]interface{}{
+	atomic.AddUint64(&session.bytesOut, uint64(len(obfuscated)))
+	session.outRate.Add(len(obfuscated))
+	s.metrics.addBytes("out", session.clientIP, len(obfuscated))
+	return nil
+}
+
+// handleStatus provides server status (fake endpoint). It must not reveal
+// anything about the VPN, such as how many clients are connected.
+func (s *VPNServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.serveFakeJSON(w, r, map[string]interface{}{
 		"status": "healthy",
 		"version": "2.4.1",
 		"uptime": time.Now().Unix(),
-		"active_connections": len(s.clients),
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Server", "nginx/1.18.0")
-	json.NewEncoder(w).Encode(status)
+	})
 }
 
 // cleanupRoutine periodically cleans up inactive sessions
@@ -418,13 +1342,36 @@ func (s *VPNServer) cleanupRoutine() {
 	
 	for range ticker.C {
 		now := time.Now()
+		var removed []*ClientSession
+		s.clientsMu.Lock()
 		for id, session := range s.clients {
-			if now.Sub(session.lastActivity) > 5*time.Minute {
-				log.Printf("Cleaning up inactive session: %s", id)
-				session.conn.Close()
+			inactive := now.Sub(session.lastActive()) > 5*time.Minute
+			expired := !session.endsAt.IsZero() && now.After(session.endsAt)
+			if inactive || expired {
+				if expired {
+					// The user must log in again
+					slog.Info("Session timeout reached", "session", id, "user", session.username)
+					session.revoked.Store(true)
+				} else {
+					slog.Info("Cleaning up inactive session", "session", id)
+				}
+				session.transport.Close()
 				delete(s.clients, id)
+				s.allocatorFor(session).Release(session.lease)
+				s.endTenantSession(session)
+				removed = append(removed, session)
 			}
 		}
+		s.clientsMu.Unlock()
+		
+		// Save traffic outside the sessions lock; unchanged sessions are skipped
+		for _, session := range removed {
+			s.persistStats(session)
+		}
+		s.persistAllStats()
+		
+		s.purgeExpiredSessionTokens(now)
+		s.probes.purge(now)
 	}
 }
 
@@ -440,24 +1387,106 @@ func loadConfig(filename string) (*ServerConfig, error) {
 		return nil, err
 	}
 	
+	// Prefer a key kept out of the config file
+	config.PreSharedKey, err = protocol.ResolvePreSharedKey(config.PreSharedKey, config.PreSharedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	
 	return &config, nil
 }
 
 func main() {
+	// Subcommands come before the server's own flags
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		if err := runKeygen(os.Args[2:]); err != nil {
+			logging.Fatal("keygen failed", "error", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := runAudit(os.Args[2:]); err != nil {
+			logging.Fatal("audit failed", "error", err)
+		}
+		return
+	}
+	
 	var configFile = flag.String("config", "config.json", "Configuration file path")
+	var generateCert = flag.Bool("generate-cert", false, "Generate a self-signed certificate if the configured one is missing")
+	var calibrateFile = flag.String("calibrate-padding", "", "Print padding buckets matching the packet sizes in this pcap file and exit")
+	var calibrateBuckets = flag.Int("calibrate-buckets", 5, "Number of padding buckets to calibrate")
+	var calibratePort = flag.Int("calibrate-port", 443, "Only calibrate from packets to or from this port (0 for all)")
+	var metricsPort = flag.Int("metrics-port", 0, "Serve Prometheus metrics on this port instead of the HTTPS port")
+	var metricsToken = flag.String("metrics-bearer-token", "", "Bearer token required to read metrics; metrics are only served on the HTTPS port if set")
+	var pprofAddr = flag.String("pprof", "", "Serve pprof and expvar on this loopback address, such as 127.0.0.1:6060")
+	var chaosSpec = flag.String("chaos", "", "Drop, delay and corrupt frames sent to clients for testing, such as drop=0.05,delay=200ms,corrupt=0.01")
+	var logLevel = flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	var logFormat = flag.String("log-format", "text", "Log as text or json")
 	flag.Parse()
 	
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		logging.Fatal("Invalid logging flags", "error", err)
+	}
+	
+	if *calibrateFile != "" {
+		if err := calibratePadding(*calibrateFile, *calibrateBuckets, *calibratePort); err != nil {
+			logging.Fatal("Calibration failed", "error", err)
+		}
+		return
+	}
+	
 	// Load configuration
 	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		logging.Fatal("Failed to load config", "error", err)
+	}
+	slog.Debug("Loaded configuration", "file", *configFile, "config", logging.Redacted(config))
+	if *generateCert {
+		config.AutoGenerateCert = true
+	}
+	
+	// Set up tracing; the server only samples packets the client traced
+	shutdownTracing, err := protocol.InitTracing(context.Background(), "stealthvpn-server", config.OTLPEndpoint, 0)
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
 	}
 	
 	// Create server
 	server, err := NewVPNServer(config)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		logging.Fatal("Failed to create server", "error", err)
 	}
+	server.configFile = *configFile
+	server.metricsPort = *metricsPort
+	server.metricsToken = *metricsToken
+	if *chaosSpec != "" {
+		server.chaos, err = protocol.ParseChaosConfig(*chaosSpec)
+		if err != nil {
+			logging.Fatal("Invalid --chaos", "error", err)
+		}
+		slog.Warn("Chaos mode: degrading connections", "chaos", *chaosSpec)
+	}
+	
+	// Let operators profile the server, never on the stealth port
+	if *pprofAddr != "" {
+		if err := profiling.Serve(*pprofAddr); err != nil {
+			logging.Fatal("Failed to start profiling", "error", err)
+		}
+		server.publishPipelineStats()
+	}
+	
+	// Apply edits to the config file without a restart
+	go func() {
+		if err := server.WatchConfig(context.Background(), *configFile); err != nil {
+			slog.Error("Not watching config file for changes", "file", *configFile, "error", err)
+		}
+	}()
+	
+	// Reload the config file on SIGHUP too, for service managers
+	server.reloadOnSignal(*configFile)
+	
+	// Log a snapshot of the sessions on SIGUSR1
+	server.dumpStatsOnSignal(slog.Default())
 	
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -465,12 +1494,14 @@ func main() {
 	
 	go func() {
 		<-sigChan
-		log.Println("Shutting down server...")
+		slog.Info("Shutting down server")
+		server.persistAllStats()
+		shutdownTracing(context.Background())
 		os.Exit(0)
 	}()
 	
 	// Start server
 	if err := server.Start(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+		logging.Fatal("Server failed", "error", err)
 	}
 } 
\ No newline at end of file
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// pipeTransport is an in-memory Transport. Written frames are handed to
+// the test on written; until Close, a write waits for the test to take it.
+type pipeTransport struct {
+	written chan []byte
+	read    chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeTransport() *pipeTransport {
+	return &pipeTransport{
+		written: make(chan []byte),
+		read:    make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *pipeTransport) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-p.read:
+		return data, nil
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (p *pipeTransport) WriteMessage(data []byte) error {
+	select {
+	case p.written <- append([]byte(nil), data...):
+		return nil
+	case <-p.done:
+		return net.ErrClosed
+	}
+}
+
+func (p *pipeTransport) SetReadDeadline(time.Time) error  { return nil }
+func (p *pipeTransport) SetWriteDeadline(time.Time) error { return nil }
+func (p *pipeTransport) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+}
+
+func (p *pipeTransport) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+// newTestServer returns a server with the defaults of an empty config
+func newTestServer(t *testing.T) *VPNServer {
+	t.Helper()
+	server, err := NewVPNServer(&ServerConfig{PreSharedKey: "0123456789abcdef0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newTestSession returns a session on transport with a fixed key and no
+// compression
+func newTestSession(t *testing.T, transport protocol.Transport) *ClientSession {
+	t.Helper()
+	encryption, err := protocol.NewMultiLayerEncryption(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressor, err := protocol.NewCompressor(protocol.CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ClientSession{
+		id:         "192.0.2.1:40000",
+		transport:  transport,
+		clientIP:   net.IPv4(192, 0, 2, 1),
+		encryption: encryption,
+		compressor: compressor,
+	}
+}
+
+// queuePacket queues a packet for session as the tunnel reader does
+func queuePacket(s *VPNServer, session *ClientSession, packet []byte) {
+	buf := protocol.GetPacketBuffer()
+	*buf = append((*buf)[:0], packet...)
+	s.queueToClient(session, buf)
+}
+
+func TestStartSendingDeliversQueuedPackets(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	session := newTestSession(t, transport)
+	session.sendQueue = protocol.NewSendQueue(4, protocol.QueueDropNewest)
+	stop := s.startSending(session)
+	defer stop()
+
+	queuePacket(s, session, []byte("hello"))
+	if packet := clientReceive(t, s, session, transport); string(packet) != "hello" {
+		t.Fatalf("client received %q", packet)
+	}
+}
+
+// clientReceive waits for the next frame sent to session's client and
+// returns its payload as the client sees it
+func clientReceive(t *testing.T, s *VPNServer, session *ClientSession, transport *pipeTransport) []byte {
+	t.Helper()
+	select {
+	case frame := <-transport.written:
+		return clientOpen(t, s, session, frame)
+	case <-time.After(time.Second):
+		t.Fatal("nothing was sent to the client")
+		return nil
+	}
+}
+
+// clientOpen returns the payload of a frame sent to session's client
+func clientOpen(t *testing.T, s *VPNServer, session *ClientSession, frame []byte) []byte {
+	t.Helper()
+	obfuscated, err := s.stealth.DeobfuscatePacket(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := session.encryption.Decrypt(obfuscated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err = session.compressor.Decompress(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestStartSendingStopsBeforeKeysAreWiped(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	session := newTestSession(t, transport)
+	session.sendQueue = protocol.NewSendQueue(16, protocol.QueueDropNewest)
+	stop := s.startSending(session)
+
+	// The client never reads, so the sender is stuck writing the first
+	// packet while the rest wait in the queue
+	for i := 0; i < 8; i++ {
+		queuePacket(s, session, []byte("packet"))
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stopping the sender waited on a client that stopped reading")
+	}
+
+	// As releaseSession does once the session ends; the sender must not
+	// touch the keys any more
+	session.encryption.Zeroize()
+	queuePacket(s, session, []byte("late"))
+	if err := s.sendToClient(session, []byte("late")); err == nil {
+		t.Error("sent a packet with wiped keys")
+	}
+}
+
+func TestLastActivityIsSafeToReadWhileMarked(t *testing.T) {
+	session := newTestSession(t, newPipeTransport())
+	start := time.Unix(1700000000, 0)
+	session.markActive(start)
+
+	// The session's reader marks it while the cleanup routine and the
+	// management API read it; run with -race
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 1000; i++ {
+			session.markActive(start.Add(time.Duration(i) * time.Millisecond))
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if session.lastActive().Before(start) {
+			t.Fatal("last activity went back in time")
+		}
+	}
+	wg.Wait()
+
+	if want := start.Add(time.Second); !session.lastActive().Equal(want) {
+		t.Errorf("lastActive() = %v, want %v", session.lastActive(), want)
+	}
+}
+
+// metricValue returns the value of the named counter in s's registry
+func metricValue(t *testing.T, s *VPNServer, name string) float64 {
+	t.Helper()
+	families, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not registered", name)
+	return 0
+}
+
+func TestQueueToClientCountsDrops(t *testing.T) {
+	s := newTestServer(t)
+	session := newTestSession(t, newPipeTransport())
+	policy, err := protocol.ParseQueuePolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.sendQueue = protocol.NewSendQueue(2, policy)
+	defer session.sendQueue.Close()
+
+	for _, packet := range []string{"first", "second", "third"} {
+		queuePacket(s, session, []byte(packet))
+	}
+	if got := metricValue(t, s, "stealthvpn_packet_drops_total"); got != 1 {
+		t.Errorf("stealthvpn_packet_drops_total = %v, want 1", got)
+	}
+
+	// The default policy keeps the newest packets
+	buf, _ := session.sendQueue.Pop()
+	if string(*buf) != "second" {
+		t.Errorf("queue starts with %q, want the oldest packet dropped", *buf)
+	}
+	protocol.PutPacketBuffer(buf)
+}
+
+// clientHandshake runs a client's side of the key exchange against
+// performKeyExchange on transport, replying with version and asking for
+// ciphers, and returns the server's result and the key the client derived
+func clientHandshake(t *testing.T, s *VPNServer, transport *pipeTransport, version int, ciphers ...string) (*ClientSession, []byte, error) {
+	t.Helper()
+	type result struct {
+		session *ClientSession
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		session, err := s.performKeyExchange(transport, "192.0.2.1:40000")
+		done <- result{session, err}
+	}()
+
+	key := clientKeyExchange(t, transport, version, ciphers...)
+	res := <-done
+	return res.session, key, res.err
+}
+
+// clientKeyExchange runs a client's side of the key exchange on transport,
+// replying with version and asking for ciphers, and returns the key it
+// derived
+func clientKeyExchange(t *testing.T, transport *pipeTransport, version int, ciphers ...string) []byte {
+	t.Helper()
+	hello := <-transport.written
+	var serverKeyMsg protocol.KeyExchangeMessage
+	if err := json.Unmarshal(hello, &serverKeyMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.CheckProtocolVersion("server", serverKeyMsg.Version); err != nil {
+		t.Fatal(err)
+	}
+	kx, err := protocol.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kx.Zeroize()
+	reply, err := json.Marshal(protocol.KeyExchangeMessage{
+		Type:      protocol.KeyExchangeType,
+		Version:   version,
+		PublicKey: kx.GetPublicKey(),
+		Ciphers:   ciphers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.read <- reply
+
+	key, err := kx.ComputeSharedSecret(serverKeyMsg.PublicKey, protocol.KeyExchangeTranscript(hello, reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeyExchangeAgreesOnKeys(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	defer transport.Close()
+	session, key, err := clientHandshake(t, s, transport, protocol.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.encryption.Zeroize()
+
+	clientEncryption, err := protocol.NewMultiLayerEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := clientEncryption.Encrypt([]byte("packet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := session.encryption.Decrypt(ciphertext); err != nil || string(plaintext) != "packet" {
+		t.Fatalf("server decrypted %q, %v", plaintext, err)
+	}
+}
+
+func TestKeyExchangeNegotiatesCipher(t *testing.T) {
+	for _, tc := range []struct {
+		singleCipher bool
+		requested    string
+		want         string
+	}{
+		{true, protocol.CipherAESGCM, protocol.CipherAESGCM},
+		{true, protocol.CipherChaCha20, protocol.CipherChaCha20},
+		{true, "rot13", protocol.CipherLayered},
+		{false, protocol.CipherAESGCM, protocol.CipherLayered},
+	} {
+		s := newTestServer(t)
+		s.currentConfig().SingleCipher = tc.singleCipher
+		transport := newPipeTransport()
+		session, _, err := clientHandshake(t, s, transport, protocol.ProtocolVersion, tc.requested)
+		transport.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := session.encryption.Cipher(); got != tc.want {
+			t.Errorf("single_cipher %v, client asking for %s: negotiated %s, want %s", tc.singleCipher, tc.requested, got, tc.want)
+		}
+		session.encryption.Zeroize()
+	}
+}
+
+func TestKeyExchangeAppliesParallelThreshold(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	s := newTestServer(t)
+	s.currentConfig().ParallelThreshold = 32 << 10
+	transport := newPipeTransport()
+	defer transport.Close()
+	session, _, err := clientHandshake(t, s, transport, protocol.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.encryption.Zeroize()
+
+	// The low bits of the first byte give the format; 1 is chunked
+	for _, tc := range []struct {
+		size    int
+		chunked bool
+	}{{1 << 10, false}, {1 << 20, true}} {
+		ciphertext, err := session.encryption.Encrypt(make([]byte, tc.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunked := ciphertext[0]&0x7f == 1; chunked != tc.chunked {
+			t.Errorf("%d byte payload chunked = %v with parallel_threshold 32768", tc.size, chunked)
+		}
+	}
+}
+
+func TestKeyExchangeRejectsOldClients(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	defer transport.Close()
+
+	// Clients from before versions were sent leave the field out
+	_, _, err := clientHandshake(t, s, transport, 0)
+	if err == nil || !strings.Contains(err.Error(), "protocol version 0") {
+		t.Fatalf("performKeyExchange() error = %v, want the versions named", err)
+	}
+}
+
+func TestTunnelConfigPushedAfterHandshake(t *testing.T) {
+	s, err := NewVPNServer(&ServerConfig{
+		PreSharedKey: "0123456789abcdef0123456789abcdef",
+		DNSServers:   []string{"9.9.9.9", "2620:fe::fe"},
+		AllowedIPs:   []string{"10.20.0.0/16", "fd00:20::/64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newPipeTransport()
+	defer transport.Close()
+	go s.serveSession(t.Context(), transport, "192.0.2.1:40000", "", nil, nil)
+
+	// The first message the client reads under the new key is its config
+	key := clientKeyExchange(t, transport, protocol.ProtocolVersion)
+	client := newTestSession(t, transport)
+	client.encryption, err = protocol.NewMultiLayerEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config protocol.TunnelConfig
+	if err := json.Unmarshal(clientReceive(t, s, client, transport), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Type != protocol.TunnelConfigType {
+		t.Fatalf("first message type = %q, want %q", config.Type, protocol.TunnelConfigType)
+	}
+	if net.ParseIP(config.IPv4).To4() == nil || net.ParseIP(config.IPv6) == nil {
+		t.Errorf("addresses = %q, %q; want a lease of each family", config.IPv4, config.IPv6)
+	}
+	if want := []string{"9.9.9.9", "2620:fe::fe"}; !slices.Equal(config.DNS, want) {
+		t.Errorf("DNS = %q, want %q", config.DNS, want)
+	}
+	if want := []string{"10.20.0.0/16", "fd00:20::/64"}; !slices.Equal(config.Routes, want) {
+		t.Errorf("routes = %q, want %q", config.Routes, want)
+	}
+}
+
+// tracedFrame encrypts and obfuscates payload as session's client does,
+// carrying a trace with traceID that the client sampled or not
+func tracedFrame(t *testing.T, s *VPNServer, session *ClientSession, traceID byte, sampled bool) []byte {
+	t.Helper()
+	config := trace.SpanContextConfig{
+		TraceID: trace.TraceID{traceID},
+		SpanID:  trace.SpanID{1},
+	}
+	if sampled {
+		config.TraceFlags = trace.FlagsSampled
+	}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(config))
+	encrypted, err := session.encryption.Encrypt(session.compressor.Compress(nil, []byte("packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := s.stealth.ObfuscatePacketWithTrace(ctx, nil, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// recordSpans installs a tracer provider that samples with sampler and
+// keeps finished spans in memory
+func recordSpans(t *testing.T, sampler sdktrace.Sampler) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sampler),
+	)
+	savedProvider, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(savedProvider)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+	return exporter
+}
+
+func TestEachFrameTracedUnderItsOwnContext(t *testing.T) {
+	// Follow the client's sampling decision
+	exporter := recordSpans(t, sdktrace.ParentBased(sdktrace.NeverSample()))
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	session := newTestSession(t, transport)
+	session.sendQueue = protocol.NewSendQueue(8, protocol.QueueDropNewest)
+	s.startQuota(session)
+
+	done := make(chan struct{})
+	go func() {
+		s.handleClientSession(session, trace.SpanFromContext(context.Background()))
+		close(done)
+	}()
+
+	// An unsampled frame between two sampled ones neither stops the second
+	// from being traced nor joins the first one's trace
+	transport.read <- tracedFrame(t, s, session, 1, true)
+	transport.read <- tracedFrame(t, s, session, 2, false)
+	transport.read <- tracedFrame(t, s, session, 3, true)
+	transport.read <- clientFrame(t, s, session, []byte("packet"))
+	for deadline := time.Now().Add(time.Second); session.sendQueue.Len() < 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 4 packets handled", session.sendQueue.Len())
+		}
+	}
+	transport.Close()
+	<-done
+
+	var traces []trace.TraceID
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "handleClientSession" {
+			traces = append(traces, span.SpanContext.TraceID())
+		}
+	}
+	want := []trace.TraceID{{1}, {3}}
+	if len(traces) != len(want) || traces[0] != want[0] || traces[1] != want[1] {
+		t.Errorf("frames traced under %v, want %v", traces, want)
+	}
+}
+
+func TestHandshakeSpans(t *testing.T) {
+	exporter := recordSpans(t, sdktrace.AlwaysSample())
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	done := make(chan struct{})
+	go func() {
+		s.serveSession(context.Background(), transport, "192.0.2.1:40000", "", nil, nil)
+		close(done)
+	}()
+
+	key := clientKeyExchange(t, transport, protocol.ProtocolVersion)
+	client := newTestSession(t, transport)
+	var err error
+	client.encryption, err = protocol.NewMultiLayerEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientReceive(t, s, client, transport)
+	transport.read <- clientFrame(t, s, client, []byte("packet"))
+	for deadline := time.Now().Add(time.Second); len(exporter.GetSpans()) < 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d spans finished, want the handshake's and the first frame's", len(exporter.GetSpans()))
+		}
+	}
+	transport.Close()
+	<-done
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	handshake, ok := spans["handshake"]
+	if !ok {
+		t.Fatal("no handshake span")
+	}
+	if handshake.Parent.IsValid() || handshake.SpanKind != trace.SpanKindServer {
+		t.Errorf("handshake span has parent %v and kind %v, want a server root", handshake.Parent.SpanID(), handshake.SpanKind)
+	}
+	if handshake.Status.Code != codes.Unset {
+		t.Errorf("successful handshake has status %v", handshake.Status)
+	}
+
+	// The steps of the handshake are its children, in order
+	var last time.Time
+	for _, name := range []string{"key_exchange", "key_confirmation", "first_packet"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != handshake.SpanContext.SpanID() || span.SpanContext.TraceID() != handshake.SpanContext.TraceID() {
+			t.Errorf("%s span is not a child of the handshake", name)
+		}
+		if span.StartTime.Before(last) {
+			t.Errorf("%s span started before the previous step ended", name)
+		}
+		last = span.EndTime
+	}
+	if first := spans["first_packet"]; first.EndTime.Before(handshake.EndTime) {
+		t.Error("first_packet span ended before the handshake it waits after")
+	}
+}
+
+// clientFrame compresses, encrypts and obfuscates payload as session's
+// client does
+func clientFrame(t *testing.T, s *VPNServer, session *ClientSession, payload []byte) []byte {
+	t.Helper()
+	encrypted, err := session.encryption.Encrypt(session.compressor.Compress(nil, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := s.stealth.ObfuscatePacketTo(nil, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestPacketWorkersHandleEveryPacket(t *testing.T) {
+	s := newTestServer(t)
+	s.packetWorkers = protocol.NewPacketWorkers(4)
+	transport := newPipeTransport()
+	session := newTestSession(t, transport)
+	session.sendQueue = protocol.NewSendQueue(64, protocol.QueueDropNewest)
+	s.startQuota(session)
+
+	done := make(chan struct{})
+	go func() {
+		s.handleClientSession(session, trace.SpanFromContext(context.Background()))
+		close(done)
+	}()
+
+	// A packet that fails to decrypt is dropped without holding up the rest
+	encrypted, err := session.encryption.Encrypt([]byte("packet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted[len(encrypted)-1] ^= 0xff
+	corrupt, err := s.stealth.ObfuscatePacketTo(nil, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			transport.read <- corrupt
+		}
+		transport.read <- clientFrame(t, s, session, []byte("packet"))
+	}
+
+	// Without a tunnel interface each packet is answered with a reply
+	for deadline := time.Now().Add(time.Second); session.sendQueue.Len() < 20; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 20 packets handled", session.sendQueue.Len())
+		}
+	}
+	transport.Close()
+	<-done
+	if session.sendQueue.Len() != 20 {
+		t.Errorf("%d packets handled, want 20", session.sendQueue.Len())
+	}
+	if got := metricValue(t, s, "stealthvpn_encryption_errors_total"); got != 1 {
+		t.Errorf("counted %v decryption failures, want 1", got)
+	}
+}
+
+func TestListenDualStackAcceptsBothFamilies(t *testing.T) {
+	listener, err := listenDualStack(":0")
+	if err != nil {
+		t.Skipf("no IPv6 on this host: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("dialing %s: %v", host, err)
+			continue
+		}
+		conn.Close()
+	}
+}
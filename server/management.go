@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/server/mgmt"
+)
+
+// redacted replaces secrets in the config returned by the management API
+const redacted = "[REDACTED]"
+
+// currentConfig returns the active configuration. The returned value is
+// never modified; a reload swaps in a new one.
+func (s *VPNServer) currentConfig() *ServerConfig {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
+// serveManagement runs the management API until the server exits
+func (s *VPNServer) serveManagement() {
+	config := s.currentConfig()
+	management, err := mgmt.NewManagementServer(config.ManagementPort, config.ManagementToken, s)
+	if err != nil {
+		slog.Error("Management API disabled", "error", err)
+		return
+	}
+
+	if err := management.ListenAndServe(); err != nil {
+		slog.Error("Management API error", "error", err)
+	}
+}
+
+// Sessions lists the active client sessions
+func (s *VPNServer) Sessions() []mgmt.Session {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	now := time.Now()
+	sessions := make([]mgmt.Session, 0, len(s.clients))
+	for _, session := range s.clients {
+		info := mgmt.Session{
+			ID:               session.id,
+			ClientIP:         session.clientIP.String(),
+			User:             session.username,
+			Tenant:           session.tenant,
+			Cipher:           session.encryption.Cipher(),
+			BytesIn:          atomic.LoadUint64(&session.bytesIn),
+			BytesOut:         atomic.LoadUint64(&session.bytesOut),
+			TotalBytesIn:     session.history.BytesIn + atomic.LoadUint64(&session.bytesIn) - session.savedIn,
+			TotalBytesOut:    session.history.BytesOut + atomic.LoadUint64(&session.bytesOut) - session.savedOut,
+			InRateBps:        session.inRate.Rate() * 8,
+			OutRateBps:       session.outRate.Rate() * 8,
+			SendQueueDepth:   session.sendQueue.Len(),
+			SendQueueDropped: session.sendQueue.Dropped(),
+			ConnectedAt:      session.connectedAt,
+			ConnectedSeconds: now.Sub(session.connectedAt).Seconds(),
+			LastActivity:     session.lastActive(),
+		}
+		if session.reportedIP != nil {
+			info.ReportedIP = session.reportedIP.String()
+		}
+		if session.quota > 0 {
+			remaining := quotaRemaining(session.quota, info.TotalBytesIn+info.TotalBytesOut)
+			info.QuotaBytes = session.quota
+			info.QuotaRemaining = &remaining
+		}
+		if session.lease != nil {
+			info.TunnelIPv4 = session.lease.IPv4.String()
+			info.TunnelIPv6 = session.lease.IPv6.String()
+		}
+		for _, quality := range linkQualities(session) {
+			info.Links = append(info.Links, mgmt.Link{
+				RTTMs:    float64(quality.RTT) / float64(time.Millisecond),
+				RTTVarMs: float64(quality.RTTVar) / float64(time.Millisecond),
+				Loss:     quality.Loss,
+			})
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions
+}
+
+// linkQualities returns the measured quality of each of a session's
+// connections. The caller must hold clientsMu.
+func linkQualities(session *ClientSession) []protocol.LinkQuality {
+	if session.paths != nil {
+		return session.paths.LinkQualities()
+	}
+	if session.deadPeer != nil {
+		return []protocol.LinkQuality{session.deadPeer.Quality()}
+	}
+	return nil
+}
+
+// KickSession disconnects a session; its read loop then tears it down
+func (s *VPNServer) KickSession(id string) bool {
+	s.clientsMu.RLock()
+	session, ok := s.clients[id]
+	s.clientsMu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	session.transport.Close()
+	return true
+}
+
+// RevokeClient disconnects every session of a client, by user name or IP,
+// and discards their session tokens so they cannot be resumed. With Redis
+// the revocation reaches every server in the fleet.
+func (s *VPNServer) RevokeClient(client string) error {
+	identity := identityForKey(client)
+	if s.revocations != nil {
+		return s.revocations.PublishRevocation(identity)
+	}
+	s.revokeLocal(identity)
+	return nil
+}
+
+// revokeLocal revokes a client identity on this server
+func (s *VPNServer) revokeLocal(identity string) {
+	s.clientsMu.RLock()
+	var sessions []*ClientSession
+	for _, session := range s.clients {
+		if clientIdentity(session) == identity {
+			sessions = append(sessions, session)
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	for _, session := range sessions {
+		session.revoked.Store(true)
+		session.transport.Close()
+	}
+
+	s.resumableSessions.Range(func(key, value interface{}) bool {
+		resumable := value.(*resumableSession)
+		if resumable.clientID == identity {
+			if _, ok := s.resumableSessions.LoadAndDelete(key); ok {
+				protocol.ZeroBytes(resumable.secret)
+			}
+		}
+		return true
+	})
+
+	if len(sessions) > 0 {
+		slog.Info("Revoked client", "client", identity, "sessions", len(sessions))
+	}
+}
+
+// redactURLPassword hides the password in a URL such as redis_url
+func redactURLPassword(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	return parsed.Redacted()
+}
+
+// SanitizedConfig returns a copy of the active config with secrets redacted
+func (s *VPNServer) SanitizedConfig() interface{} {
+	config := *s.currentConfig()
+	if config.PreSharedKey != "" {
+		config.PreSharedKey = redacted
+	}
+	if len(config.PreviousPreSharedKeys) > 0 {
+		previous := make([]PreviousPreSharedKey, len(config.PreviousPreSharedKeys))
+		for i, key := range config.PreviousPreSharedKeys {
+			previous[i] = PreviousPreSharedKey{ID: key.ID, Key: redacted}
+		}
+		config.PreviousPreSharedKeys = previous
+	}
+	if config.ManagementToken != "" {
+		config.ManagementToken = redacted
+	}
+	if config.PKCS11Config != nil && config.PKCS11Config.PIN != "" {
+		pkcs11 := *config.PKCS11Config
+		pkcs11.PIN = redacted
+		config.PKCS11Config = &pkcs11
+	}
+	if len(config.Tenants) > 0 {
+		config.Tenants = append([]TenantConfig(nil), config.Tenants...)
+		for i := range config.Tenants {
+			config.Tenants[i].PreSharedKey = redacted
+		}
+	}
+	if config.RedisURL != "" {
+		config.RedisURL = redactURLPassword(config.RedisURL)
+	}
+	if config.TURNPassword != "" {
+		config.TURNPassword = redacted
+	}
+	if config.NoisePrivateKey != "" {
+		config.NoisePrivateKey = redacted
+	}
+	if config.LDAP != nil && config.LDAP.BindPassword != "" {
+		ldap := *config.LDAP
+		ldap.BindPassword = redacted
+		config.LDAP = &ldap
+	}
+	if config.RADIUS != nil && config.RADIUS.Secret != "" {
+		radius := *config.RADIUS
+		radius.Secret = redacted
+		config.RADIUS = &radius
+	}
+	if config.TOTP != nil {
+		totp := *config.TOTP
+		totp.Users = make(map[string]string, len(config.TOTP.Users))
+		for username := range config.TOTP.Users {
+			totp.Users[username] = redacted
+		}
+		config.TOTP = &totp
+	}
+	return config
+}
+
+// ReloadConfig re-reads the config file. Settings used by each new session
+// apply immediately; listeners, certificates and address pools keep their
+// startup values, and the ones that changed are returned.
+func (s *VPNServer) ReloadConfig() ([]string, error) {
+	if s.configFile == "" {
+		return nil, errors.New("server was not started from a config file")
+	}
+	return s.reloadConfig(s.configFile)
+}
+
+// reloadConfig applies the config in filename as ReloadConfig does. Rate
+// limits change for clients already seen, and connected clients are sent
+// changed DNS servers and routes without reconnecting.
+func (s *VPNServer) reloadConfig(filename string) ([]string, error) {
+	loaded, err := loadConfig(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", filename, err)
+	}
+	if err := validateConfig(loaded); err != nil {
+		return nil, err
+	}
+
+	rules, err := newFirewall(loaded.Firewall)
+	if err != nil {
+		return nil, err
+	}
+	access, err := newAccessControl(loaded.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	s.configMu.Lock()
+	previous := s.config
+	restartRequired := keepStartupSettings(previous, loaded)
+	s.config = loaded
+	s.firewall.Store(rules)
+	s.access.Store(access)
+	s.configMu.Unlock()
+
+	if s.connLimiter != nil {
+		s.connLimiter.setRate(loaded.MaxConnectionsPerIPPerSecond)
+	}
+	if s.kxLimiter != nil {
+		s.kxLimiter.setRate(loaded.MaxKeyExchangesPerMinute)
+	}
+	if !slices.Equal(previous.DNSServers, loaded.DNSServers) || !slices.Equal(previous.AllowedIPs, loaded.AllowedIPs) {
+		s.pushTunnelConfigs()
+	}
+	return restartRequired, nil
+}
+
+// pushTunnelConfigs sends every connected client its tunnel config again,
+// which clients apply without reconnecting
+func (s *VPNServer) pushTunnelConfigs() {
+	s.clientsMu.RLock()
+	sessions := make([]*ClientSession, 0, len(s.clients))
+	for _, session := range s.clients {
+		sessions = append(sessions, session)
+	}
+	s.clientsMu.RUnlock()
+
+	for _, session := range sessions {
+		if err := s.sendControl(session, s.tunnelConfig(session)); err != nil {
+			slog.Warn("Failed to send new tunnel config", "session", session.id, "error", err)
+		}
+	}
+}
+
+// keepStartupSettings copies the settings that only take effect at startup
+// from running into loaded, returning the names of those that differed
+func keepStartupSettings(running, loaded *ServerConfig) []string {
+	var changed []string
+	keepString := func(name string, running string, loaded *string) {
+		if *loaded != running {
+			changed = append(changed, name)
+			*loaded = running
+		}
+	}
+	keepInt := func(name string, running int, loaded *int) {
+		if *loaded != running {
+			changed = append(changed, name)
+			*loaded = running
+		}
+	}
+	keepBool := func(name string, running bool, loaded *bool) {
+		if *loaded != running {
+			changed = append(changed, name)
+			*loaded = running
+		}
+	}
+	// Limits can change while running, but not be turned on or off
+	keepEnabled := func(name string, running int, loaded *int) {
+		if (*loaded > 0) != (running > 0) {
+			changed = append(changed, name)
+			*loaded = running
+		}
+	}
+
+	keepString("host", running.Host, &loaded.Host)
+	keepInt("port", running.Port, &loaded.Port)
+	keepString("tls_cert_file", running.TLSCertFile, &loaded.TLSCertFile)
+	keepString("tls_key_file", running.TLSKeyFile, &loaded.TLSKeyFile)
+	keepString("tunnel_interface", running.TunnelInterface, &loaded.TunnelInterface)
+	keepString("otlp_endpoint", running.OTLPEndpoint, &loaded.OTLPEndpoint)
+	keepEnabled("max_connections_per_ip_per_second", running.MaxConnectionsPerIPPerSecond, &loaded.MaxConnectionsPerIPPerSecond)
+	keepEnabled("max_key_exchanges_per_minute", running.MaxKeyExchangesPerMinute, &loaded.MaxKeyExchangesPerMinute)
+	keepString("meek_path", running.MeekPath, &loaded.MeekPath)
+	keepString("doh_path", running.DoHPath, &loaded.DoHPath)
+	keepString("doh_domain", running.DoHDomain, &loaded.DoHDomain)
+	keepInt("udp_port", running.UDPPort, &loaded.UDPPort)
+	keepString("tunnel_subnet", running.TunnelSubnet, &loaded.TunnelSubnet)
+	keepString("tunnel_subnet6", running.TunnelSubnet6, &loaded.TunnelSubnet6)
+	keepInt("management_port", running.ManagementPort, &loaded.ManagementPort)
+	keepString("management_token", running.ManagementToken, &loaded.ManagementToken)
+	keepString("stats_dir", running.StatsDir, &loaded.StatsDir)
+	keepString("redis_url", running.RedisURL, &loaded.RedisURL)
+	keepBool("enable_dns_proxy", running.EnableDNSProxy, &loaded.EnableDNSProxy)
+	keepInt("ldap_cache_ttl", running.LDAPCacheTTL, &loaded.LDAPCacheTTL)
+	keepString("radius_auth_method", running.RADIUSAuthMethod, &loaded.RADIUSAuthMethod)
+	keepString("client_ca_file", running.ClientCAFile, &loaded.ClientCAFile)
+	keepString("client_crl_file", running.ClientCRLFile, &loaded.ClientCRLFile)
+	keepBool("enable_noise", running.EnableNoise, &loaded.EnableNoise)
+	keepString("noise_private_key", running.NoisePrivateKey, &loaded.NoisePrivateKey)
+	keepString("pre_shared_key", running.PreSharedKey, &loaded.PreSharedKey)
+	keepString("pre_shared_key_id", running.PreSharedKeyID, &loaded.PreSharedKeyID)
+	keepString("audit_log_file", running.AuditLogFile, &loaded.AuditLogFile)
+	keepString("audit_log_key_file", running.AuditLogKeyFile, &loaded.AuditLogKeyFile)
+	keepString("probe_ban_file", running.ProbeBanFile, &loaded.ProbeBanFile)
+	keepInt("crypto_workers", running.CryptoWorkers, &loaded.CryptoWorkers)
+	keepString("tls_min_version", running.TLSMinVersion, &loaded.TLSMinVersion)
+	keepInt("socket_send_buffer", running.SocketSendBuffer, &loaded.SocketSendBuffer)
+	keepInt("socket_receive_buffer", running.SocketReceiveBuffer, &loaded.SocketReceiveBuffer)
+	keepInt("udp_send_buffer", running.UDPSendBuffer, &loaded.UDPSendBuffer)
+	keepInt("udp_receive_buffer", running.UDPReceiveBuffer, &loaded.UDPReceiveBuffer)
+	if !reflect.DeepEqual(loaded.TCPNoDelay, running.TCPNoDelay) {
+		changed = append(changed, "tcp_nodelay")
+		loaded.TCPNoDelay = running.TCPNoDelay
+	}
+	if !reflect.DeepEqual(loaded.PreviousPreSharedKeys, running.PreviousPreSharedKeys) {
+		changed = append(changed, "previous_pre_shared_keys")
+		loaded.PreviousPreSharedKeys = running.PreviousPreSharedKeys
+	}
+	if !reflect.DeepEqual(loaded.Authenticators, running.Authenticators) {
+		changed = append(changed, "authenticators")
+		loaded.Authenticators = running.Authenticators
+	}
+	if !reflect.DeepEqual(loaded.TOTP, running.TOTP) {
+		changed = append(changed, "totp")
+		loaded.TOTP = running.TOTP
+	}
+	if !reflect.DeepEqual(loaded.PKCS11Config, running.PKCS11Config) {
+		changed = append(changed, "pkcs11")
+		loaded.PKCS11Config = running.PKCS11Config
+	}
+	if !reflect.DeepEqual(loaded.LDAP, running.LDAP) {
+		changed = append(changed, "ldap")
+		loaded.LDAP = running.LDAP
+	}
+	if !reflect.DeepEqual(loaded.RADIUS, running.RADIUS) {
+		changed = append(changed, "radius")
+		loaded.RADIUS = running.RADIUS
+	}
+	if !reflect.DeepEqual(loaded.PassphraseKDF, running.PassphraseKDF) {
+		changed = append(changed, "passphrase_kdf")
+		loaded.PassphraseKDF = running.PassphraseKDF
+	}
+	if !reflect.DeepEqual(loaded.PaddingBuckets, running.PaddingBuckets) || !reflect.DeepEqual(loaded.PaddingWeights, running.PaddingWeights) {
+		changed = append(changed, "padding_buckets")
+		loaded.PaddingBuckets, loaded.PaddingWeights = running.PaddingBuckets, running.PaddingWeights
+	}
+	if !reflect.DeepEqual(loaded.ALPN, running.ALPN) {
+		changed = append(changed, "alpn")
+		loaded.ALPN = running.ALPN
+	}
+	if !reflect.DeepEqual(loaded.TLSCipherSuites, running.TLSCipherSuites) {
+		changed = append(changed, "tls_cipher_suites")
+		loaded.TLSCipherSuites = running.TLSCipherSuites
+	}
+	if !reflect.DeepEqual(loaded.Tenants, running.Tenants) {
+		changed = append(changed, "tenants")
+		loaded.Tenants = running.Tenants
+	}
+	if !reflect.DeepEqual(loaded.Jitter, running.Jitter) {
+		changed = append(changed, "jitter")
+		loaded.Jitter = running.Jitter
+	}
+	if !reflect.DeepEqual(loaded.JitterMinMs, running.JitterMinMs) || !reflect.DeepEqual(loaded.JitterMaxMs, running.JitterMaxMs) {
+		changed = append(changed, "jitter_min_ms", "jitter_max_ms")
+		loaded.JitterMinMs, loaded.JitterMaxMs = running.JitterMinMs, running.JitterMaxMs
+	}
+	return changed
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"stealthvpn/pkg/protocol"
+)
+
+func TestSessionsCountTraffic(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	session := newTestSession(t, transport)
+	session.sendQueue = protocol.NewSendQueue(64, protocol.QueueDropNewest)
+	session.connectedAt = time.Now()
+	s.startQuota(session)
+	s.clientsMu.Lock()
+	s.clients[session.id] = session
+	s.clientsMu.Unlock()
+	stop := s.startSending(session)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.handleClientSession(session, trace.SpanFromContext(context.Background()))
+		close(done)
+	}()
+	defer func() {
+		transport.Close()
+		<-done
+	}()
+
+	// Without a tunnel interface each packet is answered, so traffic flows
+	// both ways; the counters see it as framed on the wire
+	var sent, received uint64
+	for i := 0; i < 20; i++ {
+		frame := clientFrame(t, s, session, make([]byte, 100+i*50))
+		sent += uint64(len(frame))
+		transport.read <- frame
+		select {
+		case reply := <-transport.written:
+			received += uint64(len(reply))
+		case <-time.After(time.Second):
+			t.Fatalf("no reply to packet %d", i)
+		}
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions listed, want 1", len(sessions))
+	}
+	got := sessions[0]
+	if got.BytesIn != sent || got.BytesOut != received {
+		t.Errorf("bytes in %d and out %d, want %d and %d", got.BytesIn, got.BytesOut, sent, received)
+	}
+	if got.TotalBytesIn != sent || got.TotalBytesOut != received {
+		t.Errorf("total bytes in %d and out %d, want %d and %d", got.TotalBytesIn, got.TotalBytesOut, sent, received)
+	}
+	// Rates are averaged over five seconds, all of which the transfer fits in
+	if wantIn, wantOut := float64(sent)*8/5, float64(received)*8/5; got.InRateBps != wantIn || got.OutRateBps != wantOut {
+		t.Errorf("rates in %v and out %v bits/s, want %v and %v", got.InRateBps, got.OutRateBps, wantIn, wantOut)
+	}
+	if !got.ConnectedAt.Equal(session.connectedAt) || got.ConnectedSeconds < 0 {
+		t.Errorf("connected at %v for %vs, want since %v", got.ConnectedAt, got.ConnectedSeconds, session.connectedAt)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// meekHandler passes meek requests to listener and answers anything else
+// as the web server would
+func (s *VPNServer) meekHandler(listener *protocol.MeekListener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get(protocol.MeekSessionHeader) == "" || !s.frontedHostAllowed(r) {
+			s.probeNotFound(r)
+			s.writeNginxError(w, r, http.StatusNotFound)
+			return
+		}
+		listener.ServeHTTP(w, r)
+	})
+}
+
+// serveMeek accepts clients on the meek transport, which reach the HTTPS
+// port through a CDN
+func (s *VPNServer) serveMeek(listener *protocol.MeekListener) {
+	for {
+		transport, err := listener.Accept()
+		if err != nil {
+			slog.Error("Meek transport error", "error", err)
+			return
+		}
+		go s.handleRequestClient(transport, "Meek")
+	}
+}
+
+// requestTransport is a transport carried in HTTP requests, such as meek
+// or DoH, whose opening request stands in for the WebSocket upgrade
+type requestTransport interface {
+	protocol.Transport
+	Header() http.Header
+}
+
+// handleRequestClient runs a session for a client on a transport carried
+// in HTTP requests. The remote address is the CDN's or resolver's the
+// requests came through, so the rate limit applies per CDN edge.
+func (s *VPNServer) handleRequestClient(transport requestTransport, name string) {
+	defer transport.Close()
+	remoteAddr := transport.RemoteAddr().String()
+
+	if s.connLimiter != nil {
+		if allowed, _ := s.connLimiter.allow(remoteAddr); !allowed {
+			slog.Warn("Connection rate limit exceeded", "addr", remoteAddr)
+			s.audit(remoteAddr, "", auditRateLimited, nil)
+			return
+		}
+	}
+
+	// The request opening the session carries the session token and trace
+	// context, as a WebSocket upgrade would
+	opening := &http.Request{Header: transport.Header()}
+	ctx := protocol.ExtractHTTPTraceContext(context.Background(), opening.Header)
+
+	slog.Info(name+" transport connection", "addr", remoteAddr)
+	s.serveSession(ctx, transport, remoteAddr, "", nil, s.resumeSession(sessionTokenFromRequest(opening)))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"stealthvpn/pkg/profiling"
+	"stealthvpn/pkg/protocol"
+)
+
+// serverMetrics are the server's Prometheus metrics
+type serverMetrics struct {
+	registry         *prometheus.Registry
+	bytes            *prometheus.CounterVec
+	keyExchanges     *prometheus.CounterVec
+	packetProcessing prometheus.Histogram
+	encryptionErrors prometheus.Counter
+	firewallDrops    prometheus.Counter
+	sendQueueDrops   prometheus.Counter
+	probes           *prometheus.CounterVec
+}
+
+// newServerMetrics registers the server's metrics. activeSessions and
+// sendQueueDepths are read on each scrape.
+func newServerMetrics(activeSessions func() int, sendQueueDepths func() (total, deepest int)) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stealthvpn_bytes_total",
+			Help: "Bytes carried through the tunnel, by direction and client subnet.",
+		}, []string{"direction", "client_ip"}),
+		keyExchanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stealthvpn_key_exchanges_total",
+			Help: "Key exchanges with clients, by result.",
+		}, []string{"result"}),
+		packetProcessing: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "stealthvpn_packet_processing_duration_seconds",
+			Help:    "Time to deobfuscate, decrypt and handle a packet from a client.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		encryptionErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stealthvpn_encryption_errors_total",
+			Help: "Packets that failed to encrypt or decrypt.",
+		}),
+		firewallDrops: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stealthvpn_firewall_dropped_packets_total",
+			Help: "Packets from clients dropped by the firewall rules.",
+		}),
+		sendQueueDrops: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stealthvpn_packet_drops_total",
+			Help: "Packets to clients dropped because a client's send queue was full.",
+		}),
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stealthvpn_probes_total",
+			Help: "Requests that look like probing for a tunnel, by kind.",
+		}, []string{"kind"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "stealthvpn_active_sessions",
+			Help: "Client sessions currently connected.",
+		}, func() float64 { return float64(activeSessions()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "stealthvpn_send_queue_packets",
+			Help: "Packets waiting in all clients' send queues.",
+		}, func() float64 {
+			total, _ := sendQueueDepths()
+			return float64(total)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "stealthvpn_send_queue_max_depth_packets",
+			Help: "Packets waiting in the fullest client send queue; near send_queue_size, queues overflow.",
+		}, func() float64 {
+			_, deepest := sendQueueDepths()
+			return float64(deepest)
+		}),
+		m.bytes,
+		m.keyExchanges,
+		m.packetProcessing,
+		m.encryptionErrors,
+		m.firewallDrops,
+		m.sendQueueDrops,
+		m.probes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// metricsSubnet returns the label for a client address: its /24 for IPv4
+// and /48 for IPv6, so the number of series stays bounded
+func metricsSubnet(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// addBytes counts traffic for a client
+func (m *serverMetrics) addBytes(direction string, ip net.IP, n int) {
+	m.bytes.WithLabelValues(direction, metricsSubnet(ip)).Add(float64(n))
+}
+
+// keyExchange counts a finished key exchange
+func (m *serverMetrics) keyExchange(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.keyExchanges.WithLabelValues(result).Inc()
+}
+
+// observePacket records how long a packet took to handle since start
+func (m *serverMetrics) observePacket(start time.Time) {
+	m.packetProcessing.Observe(time.Since(start).Seconds())
+}
+
+// handler serves the metrics, requiring token as a bearer token if it is
+// set. Requests without it get a 401, or are passed to unauthorized if set.
+func (m *serverMetrics) handler(token string, unauthorized http.HandlerFunc) http.Handler {
+	metrics := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return metrics
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			if unauthorized != nil {
+				unauthorized(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// publishPipelineStats reports the load on the packet pipeline in the
+// profiling server's /debug/vars
+func (s *VPNServer) publishPipelineStats() {
+	profiling.Publish("sessions", func() interface{} {
+		s.clientsMu.RLock()
+		defer s.clientsMu.RUnlock()
+		return len(s.clients)
+	})
+	profiling.Publish("queued_frames", func() interface{} {
+		s.clientsMu.RLock()
+		defer s.clientsMu.RUnlock()
+		queued := 0
+		for _, session := range s.clients {
+			queued += protocol.QueueDepth(session.transport)
+		}
+		return queued
+	})
+}
+
+// publicMetricsHandler serves the metrics on the HTTPS port. Requests
+// without the token are not found, like any other path of the fake site.
+func (s *VPNServer) publicMetricsHandler() http.Handler {
+	return s.metrics.handler(s.metricsToken, func(w http.ResponseWriter, r *http.Request) {
+		s.probeNotFound(r)
+		s.writeNginxError(w, r, http.StatusNotFound)
+	})
+}
+
+// serveMetrics serves /metrics on its own port until the server exits
+func (s *VPNServer) serveMetrics(port int, token string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler(token, nil))
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	slog.Info("Metrics listening", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Metrics server error", "error", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublicMetricsNeedToken(t *testing.T) {
+	s := newTestServer(t)
+	s.setupFakeWebHandlers()
+	s.metricsToken = "metrics-s3cret"
+	s.mux.Handle("/metrics", s.publicMetricsHandler())
+
+	get := func(path, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without the token the path looks like any the site does not have
+	notFound := get("/no-such-page", "")
+	for _, authorization := range []string{"", "Bearer wrong", "Basic metrics-s3cret", "metrics-s3cret"} {
+		w := get("/metrics", authorization)
+		if w.Code != http.StatusNotFound || w.Body.String() != notFound.Body.String() ||
+			w.Header().Get("Content-Type") != notFound.Header().Get("Content-Type") || w.Header().Get("Server") != nginxVersion {
+			t.Errorf("%q: answered %d %v %q, want the fake site's 404", authorization, w.Code, w.Header(), w.Body.String())
+		}
+		if w.Header().Get("WWW-Authenticate") != "" {
+			t.Errorf("%q: answer asks for authentication", authorization)
+		}
+	}
+
+	w := get("/metrics", "Bearer metrics-s3cret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "stealthvpn_active_sessions") {
+		t.Errorf("with the token: answered %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSeparateMetricsPortAsksForToken(t *testing.T) {
+	s := newTestServer(t)
+	handler := s.metrics.handler("metrics-s3cret", nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("without the token: answered %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,244 @@
+// Package mgmt serves the operator management API of a running VPN server
+// on a localhost-only port.
+package mgmt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session describes an active client session
+type Session struct {
+	ID               string    `json:"id"`
+	ClientIP         string    `json:"client_ip"`
+	ReportedIP       string    `json:"reported_ip,omitempty"` // the public address the client reported, unverified
+	User             string    `json:"user,omitempty"`        // set when the client authenticated as a user
+	Tenant           string    `json:"tenant,omitempty"`
+	TunnelIPv4       string    `json:"tunnel_ipv4,omitempty"`
+	TunnelIPv6       string    `json:"tunnel_ipv6,omitempty"`
+	Cipher           string    `json:"cipher"` // layered, or the single cipher negotiated
+	BytesIn          uint64    `json:"bytes_in"`
+	BytesOut         uint64    `json:"bytes_out"`
+	TotalBytesIn     uint64    `json:"total_bytes_in"`  // including earlier sessions
+	TotalBytesOut    uint64    `json:"total_bytes_out"` // including earlier sessions
+	InRateBps        float64   `json:"in_rate_bps"`     // over the last few seconds
+	OutRateBps       float64   `json:"out_rate_bps"`
+	SendQueueDepth   int       `json:"send_queue_depth"`   // packets waiting to be sent to the client
+	SendQueueDropped uint64    `json:"send_queue_dropped"` // packets to the client dropped because the queue was full
+	ConnectedAt      time.Time `json:"connected_at"`
+	ConnectedSeconds float64   `json:"connected_seconds"`
+	LastActivity     time.Time `json:"last_activity"`
+	QuotaBytes       uint64    `json:"quota_bytes,omitempty"`     // 0 if the client has no quota
+	QuotaRemaining   *uint64   `json:"quota_remaining,omitempty"` // set if the client has a quota
+	Links            []Link    `json:"links,omitempty"`           // one per connection that measures its quality
+}
+
+// Link describes the quality of one of a session's connections, measured
+// with keepalive pings
+type Link struct {
+	RTTMs    float64 `json:"rtt_ms"`     // smoothed round-trip time, 0 until measured
+	RTTVarMs float64 `json:"rtt_var_ms"` // smoothed mean deviation of the round-trip time
+	Loss     float64 `json:"loss"`       // smoothed fraction of pings that went unanswered
+}
+
+// Tenant describes the traffic of a tenant's clients since the server
+// started, including sessions that have ended
+type Tenant struct {
+	Name           string `json:"name"`
+	IPSubnet       string `json:"ip_subnet"`
+	ActiveSessions int    `json:"active_sessions"`
+	BytesIn        uint64 `json:"bytes_in"`
+	BytesOut       uint64 `json:"bytes_out"`
+}
+
+// Usage describes a client's stored traffic against its quota
+type Usage struct {
+	Client         string  `json:"client"`
+	BytesIn        uint64  `json:"bytes_in"`
+	BytesOut       uint64  `json:"bytes_out"`
+	QuotaBytes     uint64  `json:"quota_bytes,omitempty"`
+	QuotaRemaining *uint64 `json:"quota_remaining,omitempty"`
+}
+
+// Backend is the VPN server as seen by the management API
+type Backend interface {
+	// Sessions lists the active client sessions
+	Sessions() []Session
+	// KickSession disconnects a session, reporting whether it existed
+	KickSession(id string) bool
+	// SanitizedConfig returns the current config with secrets redacted
+	SanitizedConfig() interface{}
+	// ReloadConfig re-reads the config file without dropping sessions and
+	// returns the changed settings that only take effect after a restart
+	ReloadConfig() ([]string, error)
+	// ClientUsage returns a client's traffic and quota by user name or IP
+	ClientUsage(client string) (Usage, error)
+	// ResetUsage clears a client's traffic, lifting a quota block
+	ResetUsage(client string) error
+	// RevokeClient disconnects a client by user name or IP and invalidates
+	// its session tokens
+	RevokeClient(client string) error
+	// Tenants returns per-tenant traffic
+	Tenants() []Tenant
+}
+
+// ManagementServer serves the management API
+type ManagementServer struct {
+	backend Backend
+	token   string
+	server  *http.Server
+}
+
+// NewManagementServer creates a management API on 127.0.0.1:port that
+// requires token as a bearer token
+func NewManagementServer(port int, token string, backend Backend) (*ManagementServer, error) {
+	if token == "" {
+		return nil, errors.New("management token is required")
+	}
+
+	m := &ManagementServer{backend: backend, token: token}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", m.handleListSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", m.handleKickSession)
+	mux.HandleFunc("GET /config", m.handleGetConfig)
+	mux.HandleFunc("POST /config/reload", m.handleReloadConfig)
+	mux.HandleFunc("GET /usage/{client}", m.handleGetUsage)
+	mux.HandleFunc("DELETE /usage/{client}", m.handleResetUsage)
+	mux.HandleFunc("DELETE /clients/{client}/sessions", m.handleRevokeClient)
+	mux.HandleFunc("GET /tenants", m.handleListTenants)
+
+	m.server = &http.Server{
+		Addr:         net.JoinHostPort("127.0.0.1", fmt.Sprint(port)),
+		Handler:      m.authenticate(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return m, nil
+}
+
+// ListenAndServe serves the API until Close is called
+func (m *ManagementServer) ListenAndServe() error {
+	slog.Info("Management API listening", "addr", m.server.Addr)
+	err := m.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the API
+func (m *ManagementServer) Close() error {
+	return m.server.Close()
+}
+
+// authenticate rejects requests without the bearer token
+func (m *ManagementServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(m.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *ManagementServer) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := m.backend.Sessions()
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (m *ManagementServer) handleKickSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !m.backend.KickSession(id) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	slog.Info("Management API disconnected session", "session", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *ManagementServer) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.backend.SanitizedConfig())
+}
+
+func (m *ManagementServer) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	restartRequired, err := m.backend.ReloadConfig()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info("Management API reloaded the configuration")
+	if restartRequired == nil {
+		restartRequired = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"reloaded":         true,
+		"restart_required": restartRequired,
+	})
+}
+
+func (m *ManagementServer) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := m.backend.ClientUsage(r.PathValue("client"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func (m *ManagementServer) handleResetUsage(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	if err := m.backend.ResetUsage(client); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info("Management API reset usage", "client", client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *ManagementServer) handleRevokeClient(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	if err := m.backend.RevokeClient(client); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("Management API revoked client", "client", client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *ManagementServer) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants := m.backend.Tenants()
+	if tenants == nil {
+		tenants = []Tenant{}
+	}
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,241 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "s3cret-token"
+
+// fakeBackend serves fixed sessions and records what it was asked to do
+type fakeBackend struct {
+	sessions []Session
+
+	mu     sync.Mutex
+	kicked []string
+	calls  int
+}
+
+func (b *fakeBackend) record() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+}
+
+func (b *fakeBackend) Sessions() []Session {
+	b.record()
+	return b.sessions
+}
+
+func (b *fakeBackend) KickSession(id string) bool {
+	b.record()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, session := range b.sessions {
+		if session.ID == id {
+			b.kicked = append(b.kicked, id)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeBackend) SanitizedConfig() interface{} {
+	b.record()
+	return map[string]string{"pre_shared_key": "[REDACTED]"}
+}
+
+func (b *fakeBackend) ReloadConfig() ([]string, error) {
+	b.record()
+	return nil, nil
+}
+
+func (b *fakeBackend) ClientUsage(client string) (Usage, error) {
+	b.record()
+	return Usage{}, errors.New("unknown client")
+}
+
+func (b *fakeBackend) ResetUsage(client string) error {
+	b.record()
+	return nil
+}
+
+func (b *fakeBackend) RevokeClient(client string) error {
+	b.record()
+	return nil
+}
+
+func (b *fakeBackend) Tenants() []Tenant {
+	b.record()
+	return nil
+}
+
+// managementTestServer serves the API for backend
+func managementTestServer(t *testing.T, backend Backend) *httptest.Server {
+	t.Helper()
+	m, err := NewManagementServer(0, testToken, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(m.server.Handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call makes an API request with authorization as its Authorization
+// header, returning the status and body
+func call(t *testing.T, server *httptest.Server, method, path, authorization string) (int, []byte) {
+	t.Helper()
+	r, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) > 0 && resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("%s %s answered with content type %q", method, path, resp.Header.Get("Content-Type"))
+	}
+	return resp.StatusCode, body
+}
+
+func TestNewManagementServerNeedsToken(t *testing.T) {
+	if _, err := NewManagementServer(0, "", &fakeBackend{}); err == nil {
+		t.Error("management API created without a token")
+	}
+}
+
+func TestManagementRejectsUnauthenticated(t *testing.T) {
+	backend := &fakeBackend{sessions: []Session{{ID: "a"}}}
+	server := managementTestServer(t, backend)
+
+	for _, authorization := range []string{
+		"",
+		"Bearer wrong-token",
+		"Bearer " + testToken[:len(testToken)-1],
+		"Bearer " + testToken + "x",
+		"Basic " + testToken,
+		testToken,
+	} {
+		for _, request := range []struct{ method, path string }{
+			{http.MethodGet, "/sessions"},
+			{http.MethodDelete, "/sessions/a"},
+			{http.MethodGet, "/config"},
+			{http.MethodPost, "/config/reload"},
+		} {
+			status, body := call(t, server, request.method, request.path, authorization)
+			var reply map[string]string
+			if status != http.StatusUnauthorized || json.Unmarshal(body, &reply) != nil || reply["error"] != "unauthorized" {
+				t.Errorf("%s %s with %q answered %d %s", request.method, request.path, authorization, status, body)
+			}
+		}
+	}
+	if backend.calls != 0 || len(backend.kicked) != 0 {
+		t.Errorf("backend called %d times for unauthenticated requests", backend.calls)
+	}
+}
+
+func TestManagementListSessions(t *testing.T) {
+	remaining := uint64(0)
+	connected := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend := &fakeBackend{sessions: []Session{
+		{ID: "192.0.2.1:40000", ClientIP: "192.0.2.1", Cipher: "layered", BytesIn: 1500, BytesOut: 3000, ConnectedAt: connected, LastActivity: connected},
+		{ID: "192.0.2.2:40000", ClientIP: "192.0.2.2", User: "alice", TunnelIPv4: "10.8.0.2", QuotaBytes: 1 << 30, QuotaRemaining: &remaining,
+			Links: []Link{{RTTMs: 20, RTTVarMs: 2, Loss: 0.01}}},
+	}}
+	server := managementTestServer(t, backend)
+
+	status, body := call(t, server, http.MethodGet, "/sessions", "Bearer "+testToken)
+	if status != http.StatusOK {
+		t.Fatalf("GET /sessions answered %d %s", status, body)
+	}
+	var sessions []map[string]any
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions listed, want 2", len(sessions))
+	}
+
+	// Optional fields are left out when unset; a quota used up still shows
+	// zero remaining
+	var fields []string
+	for field := range sessions[0] {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	want := []string{"bytes_in", "bytes_out", "cipher", "client_ip", "connected_at", "connected_seconds", "id", "in_rate_bps",
+		"last_activity", "out_rate_bps", "send_queue_depth", "send_queue_dropped", "total_bytes_in", "total_bytes_out"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("session fields %q, want %q", fields, want)
+	}
+	if sessions[0]["bytes_in"] != 1500.0 || sessions[0]["connected_at"] != "2025-06-01T12:00:00Z" {
+		t.Errorf("first session = %v", sessions[0])
+	}
+	second := sessions[1]
+	if second["user"] != "alice" || second["tunnel_ipv4"] != "10.8.0.2" || second["quota_remaining"] != 0.0 || second["quota_bytes"] != float64(1<<30) {
+		t.Errorf("second session = %v", second)
+	}
+	if links, _ := second["links"].([]any); len(links) != 1 || links[0].(map[string]any)["rtt_ms"] != 20.0 {
+		t.Errorf("links = %v", second["links"])
+	}
+
+	// No sessions is an empty list, not null
+	empty := managementTestServer(t, &fakeBackend{})
+	if status, body := call(t, empty, http.MethodGet, "/sessions", "Bearer "+testToken); status != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("GET /sessions without sessions answered %d %s", status, body)
+	}
+}
+
+func TestManagementKickSession(t *testing.T) {
+	backend := &fakeBackend{sessions: []Session{{ID: "192.0.2.1:40000"}}}
+	server := managementTestServer(t, backend)
+
+	if status, body := call(t, server, http.MethodDelete, "/sessions/192.0.2.1:40000", "Bearer "+testToken); status != http.StatusNoContent || len(body) != 0 {
+		t.Errorf("DELETE of a session answered %d %s", status, body)
+	}
+	status, body := call(t, server, http.MethodDelete, "/sessions/192.0.2.9:40000", "Bearer "+testToken)
+	var reply map[string]string
+	if status != http.StatusNotFound || json.Unmarshal(body, &reply) != nil || reply["error"] != "session not found" {
+		t.Errorf("DELETE of an unknown session answered %d %s", status, body)
+	}
+	if !slices.Equal(backend.kicked, []string{"192.0.2.1:40000"}) {
+		t.Errorf("kicked %q", backend.kicked)
+	}
+}
+
+func TestManagementReportsBackendErrors(t *testing.T) {
+	server := managementTestServer(t, &fakeBackend{})
+
+	status, body := call(t, server, http.MethodGet, "/usage/bob", "Bearer "+testToken)
+	var reply map[string]string
+	if status != http.StatusBadRequest || json.Unmarshal(body, &reply) != nil || reply["error"] != "unknown client" {
+		t.Errorf("GET /usage/bob answered %d %s", status, body)
+	}
+
+	status, body = call(t, server, http.MethodPost, "/config/reload", "Bearer "+testToken)
+	var reload map[string]any
+	if status != http.StatusOK || json.Unmarshal(body, &reload) != nil || reload["reloaded"] != true {
+		t.Errorf("POST /config/reload answered %d %s", status, body)
+	}
+	if restart, ok := reload["restart_required"].([]any); !ok || len(restart) != 0 {
+		t.Errorf("restart_required = %v, want an empty list", reload["restart_required"])
+	}
+}
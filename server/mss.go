@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// defaultTunnelMTU leaves room within a 1500-byte path for the WebSocket
+	// framing, TLS and encryption around each packet
+	defaultTunnelMTU = 1440
+	// ipv4TCPHeaderSize and ipv6TCPHeaderSize are the IP and TCP headers
+	// without options, which the MSS does not count
+	ipv4TCPHeaderSize = 40
+	ipv6TCPHeaderSize = 60
+)
+
+// tunnelMTU returns the largest packet the tunnel carries without
+// fragmenting its frames
+func (s *VPNServer) tunnelMTU() int {
+	if mtu := s.currentConfig().TunnelMTU; mtu > 0 {
+		return mtu
+	}
+	return defaultTunnelMTU
+}
+
+// clampMSS lowers the MSS a TCP SYN or SYN-ACK advertises so that neither
+// end of the connection sends segments too large for the tunnel, as
+// iptables' TCPMSS target does. The packet is rewritten in place.
+func (s *VPNServer) clampMSS(packet []byte) {
+	firstLayer, headerSize, ok := tcpSYN(packet)
+	if !ok {
+		return
+	}
+	clampMSS(packet, firstLayer, s.tunnelMTU()-headerSize)
+}
+
+// tcpSYN reports whether packet is an unfragmented TCP segment with the SYN
+// flag set, and if so how to decode it and the size of its headers without
+// options. It only looks at fixed offsets, so that other packets cost next
+// to nothing.
+func tcpSYN(packet []byte) (gopacket.LayerType, int, bool) {
+	if len(packet) < 1 {
+		return 0, 0, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLen+20 || packet[9] != byte(layers.IPProtocolTCP) {
+			return 0, 0, false
+		}
+		// Later fragments carry no TCP header, and the first one too
+		// little of the payload to checksum
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		return layers.LayerTypeIPv4, ipv4TCPHeaderSize, packet[headerLen+13]&0x02 != 0
+	case 6:
+		// SYNs behind extension headers are left alone
+		if len(packet) < 60 || packet[6] != byte(layers.IPProtocolTCP) {
+			return 0, 0, false
+		}
+		return layers.LayerTypeIPv6, ipv6TCPHeaderSize, packet[53]&0x02 != 0
+	}
+	return 0, 0, false
+}
+
+// clampMSS lowers the MSS option of the TCP segment in packet to maxMSS if
+// it is above it, and reports whether it did
+func clampMSS(packet []byte, firstLayer gopacket.LayerType, maxMSS int) bool {
+	if maxMSS <= 0 {
+		return false
+	}
+	decoded := gopacket.NewPacket(packet, firstLayer, gopacket.NoCopy)
+	tcp, ok := decoded.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !tcp.SYN || decoded.NetworkLayer() == nil || decoded.Metadata().Truncated {
+		return false
+	}
+
+	for _, option := range tcp.Options {
+		if option.OptionType != layers.TCPOptionKindMSS || len(option.OptionData) != 2 {
+			continue
+		}
+		if int(binary.BigEndian.Uint16(option.OptionData)) <= maxMSS {
+			return false
+		}
+
+		// The option data is a slice of packet, so this rewrites it
+		if err := tcp.SetNetworkLayerForChecksum(decoded.NetworkLayer()); err != nil {
+			return false
+		}
+		binary.BigEndian.PutUint16(option.OptionData, uint16(maxMSS))
+		binary.BigEndian.PutUint16(tcp.Contents[16:18], 0)
+		checksum, err := tcp.ComputeChecksum()
+		if err != nil {
+			return false
+		}
+		binary.BigEndian.PutUint16(tcp.Contents[16:18], checksum)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpSegment builds an IPv4 or IPv6 TCP segment with the given flags and
+// MSS option, 0 for none
+func tcpSegment(t *testing.T, ipv6, syn bool, mss uint16) []byte {
+	t.Helper()
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: syn, ACK: !syn, Window: 65535}
+	if mss != 0 {
+		tcp.Options = []layers.TCPOption{{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   binary.BigEndian.AppendUint16(nil, mss),
+		}}
+	}
+
+	var network gopacket.SerializableLayer
+	if ipv6 {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("2001:db8::1")}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	} else {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IPv4(10, 8, 0, 2), DstIP: net.IPv4(192, 0, 2, 1)}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, options, network, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// segmentMSS returns the MSS a segment advertises and whether its TCP
+// checksum is valid
+func segmentMSS(t *testing.T, packet []byte) (uint16, bool) {
+	t.Helper()
+	first := layers.LayerTypeIPv4
+	if packet[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	decoded := gopacket.NewPacket(packet, first, gopacket.Default)
+	tcp := decoded.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	var mss uint16
+	for _, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindMSS {
+			mss = binary.BigEndian.Uint16(option.OptionData)
+		}
+	}
+	want := tcp.Checksum
+	tcp.SetNetworkLayerForChecksum(decoded.NetworkLayer())
+	binary.BigEndian.PutUint16(tcp.Contents[16:18], 0)
+	got, err := tcp.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mss, got == want
+}
+
+func TestClampMSS(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		name      string
+		ipv6, syn bool
+		mss, want uint16
+	}{
+		{"IPv4 SYN", false, true, 1460, defaultTunnelMTU - ipv4TCPHeaderSize},
+		{"IPv6 SYN", true, true, 1440, defaultTunnelMTU - ipv6TCPHeaderSize},
+		{"small MSS", false, true, 536, 536},
+		{"ACK", false, false, 1460, 1460},
+	} {
+		packet := tcpSegment(t, tc.ipv6, tc.syn, tc.mss)
+		s.clampMSS(packet)
+		if mss, valid := segmentMSS(t, packet); mss != tc.want || !valid {
+			t.Errorf("%s: MSS %d, valid checksum %v, want %d", tc.name, mss, valid, tc.want)
+		}
+	}
+
+	s.currentConfig().TunnelMTU = 1280
+	packet := tcpSegment(t, false, true, 1460)
+	s.clampMSS(packet)
+	if mss, _ := segmentMSS(t, packet); mss != 1240 {
+		t.Errorf("MSS %d with tunnel_mtu 1280, want 1240", mss)
+	}
+}
+
+func TestClampMSSLeavesOtherPacketsAlone(t *testing.T) {
+	s := newTestServer(t)
+
+	fragment := tcpSegment(t, false, true, 1460)
+	binary.BigEndian.PutUint16(fragment[6:8], 0x2000) // more fragments
+	for name, packet := range map[string][]byte{
+		"fragment":  fragment,
+		"no MSS":    tcpSegment(t, false, true, 0),
+		"truncated": tcpSegment(t, false, true, 1460)[:30],
+		"empty":     {},
+	} {
+		original := bytes.Clone(packet)
+		s.clampMSS(packet)
+		if !bytes.Equal(packet, original) {
+			t.Errorf("%s rewritten", name)
+		}
+	}
+}
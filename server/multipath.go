@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// maxPaths returns how many connections a client may bond into a session
+func (s *VPNServer) maxPaths() int {
+	return s.currentConfig().MaxPaths
+}
+
+// startMultipath sends the client the token for joining further connections
+// to its session, encrypted with the session key, and moves the session onto
+// a multipath transport with its current connection as the first path
+func (s *VPNServer) startMultipath(session *ClientSession) error {
+	token := make([]byte, protocol.PathTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	encrypted, err := session.encryption.Encrypt(token)
+	if err != nil {
+		return err
+	}
+	if err := protocol.WriteJSON(session.transport, protocol.Message{
+		Type: protocol.PathTokenType,
+		Data: encrypted,
+	}); err != nil {
+		return err
+	}
+
+	config := s.currentConfig()
+	paths := protocol.NewMultipathTransport(config.MaxPaths)
+	paths.SetKeepalive(time.Duration(config.KeepaliveInterval)*time.Second, config.DeadPeerIntervals)
+	if _, err := paths.AddPath(session.transport); err != nil {
+		return err
+	}
+
+	session.paths = paths
+	session.transport = paths
+	session.pathToken = token
+	s.multipathSessions.Store(string(token), session)
+	return nil
+}
+
+// stopMultipath stops connections joining an ended session and closes the
+// ones that did
+func (s *VPNServer) stopMultipath(session *ClientSession) {
+	s.multipathSessions.Delete(string(session.pathToken))
+	session.paths.Close()
+}
+
+// pathTokenFromRequest returns the multipath token carried in the upgrade
+// request's cookie, if any
+func pathTokenFromRequest(r *http.Request) []byte {
+	cookie, err := r.Cookie(protocol.PathCookieName)
+	if err != nil {
+		return nil
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(token) != protocol.PathTokenSize {
+		return nil
+	}
+	return token
+}
+
+// joinPath bonds a connection presenting a multipath token into the session
+// it belongs to, and keeps it open until the path is dropped
+func (s *VPNServer) joinPath(transport protocol.Transport, remoteAddr string, token []byte) {
+	transport = s.chaos.Wrap(transport)
+	value, ok := s.multipathSessions.Load(string(token))
+	if !ok {
+		slog.Warn("Rejected connection joining an unknown session", "addr", remoteAddr)
+		return
+	}
+	session := value.(*ClientSession)
+
+	if err := protocol.WriteJSON(transport, protocol.Message{Type: protocol.PathJoinedType}); err != nil {
+		slog.Warn("Failed to join connection to session", "addr", remoteAddr, "session", session.id, "error", err)
+		return
+	}
+	transport.SetWriteDeadline(time.Time{})
+
+	done, err := session.paths.AddPath(transport)
+	if err != nil {
+		slog.Warn("Failed to join connection to session", "addr", remoteAddr, "session", session.id, "error", err)
+		return
+	}
+	slog.Info("Connection joined session", "addr", remoteAddr, "session", session.id)
+	<-done
+	slog.Info("Connection left session", "addr", remoteAddr, "session", session.id)
+}
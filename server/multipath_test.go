@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// startTestMultipath moves session onto a multipath transport and returns
+// the path token its client decrypts
+func startTestMultipath(t *testing.T, s *VPNServer, session *ClientSession, transport *pipeTransport) []byte {
+	t.Helper()
+	s.currentConfig().MaxPaths = 2
+	done := make(chan error, 1)
+	go func() { done <- s.startMultipath(session) }()
+
+	var msg protocol.Message
+	if err := json.Unmarshal(<-transport.written, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != protocol.PathTokenType {
+		t.Fatalf("client sent %s, want %s", msg.Type, protocol.PathTokenType)
+	}
+	token, err := session.encryption.Decrypt(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJoinPathBondsConnection(t *testing.T) {
+	s := newTestServer(t)
+	first := newPipeTransport()
+	session := newTestSession(t, first)
+	token := startTestMultipath(t, s, session, first)
+
+	second := newPipeTransport()
+	joined := make(chan struct{})
+	go func() {
+		s.joinPath(second, "192.0.2.1:40001", token)
+		close(joined)
+	}()
+	var msg protocol.Message
+	if err := json.Unmarshal(<-second.written, &msg); err != nil || msg.Type != protocol.PathJoinedType {
+		t.Fatalf("joining connection got %+v, %v", msg, err)
+	}
+	for deadline := time.Now().Add(time.Second); session.paths.Paths() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d paths, want 2", session.paths.Paths())
+		}
+	}
+
+	// Once the session ends its token is void and its paths close
+	s.stopMultipath(session)
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("joined connection still open after the session ended")
+	}
+	if _, ok := s.multipathSessions.Load(string(token)); ok {
+		t.Error("token of an ended session still joins it")
+	}
+}
+
+func TestJoinPathRejectsUnknownToken(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	defer transport.Close()
+
+	joined := make(chan struct{})
+	go func() {
+		s.joinPath(transport, "192.0.2.1:40001", make([]byte, protocol.PathTokenSize))
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case frame := <-transport.written:
+		t.Fatalf("connection with an unknown token was answered with %s", frame)
+	}
+}
+
+func TestPathTokenFromRequest(t *testing.T) {
+	token := make([]byte, protocol.PathTokenSize)
+	token[0] = 1
+	for _, tc := range []struct {
+		cookie string
+		want   bool
+	}{
+		{base64.RawURLEncoding.EncodeToString(token), true},
+		{base64.RawURLEncoding.EncodeToString(token[:16]), false},
+		{"not base64!", false},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: protocol.PathCookieName, Value: tc.cookie})
+		if got := pathTokenFromRequest(r); (got != nil) != tc.want {
+			t.Errorf("cookie %q gave token %x", tc.cookie, got)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// relayPeerCandidates passes a client's public endpoints and key on to the
+// client it wants a direct tunnel with
+func (s *VPNServer) relayPeerCandidates(session *ClientSession, payload []byte) {
+	var msg protocol.PeerCandidates
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid peer candidates", "client", session.clientIP, "error", err)
+		return
+	}
+	if len(msg.Candidates) == 0 || len(msg.Candidates) > protocol.MaxPeerCandidates {
+		slog.Warn("Invalid peer candidates", "client", session.clientIP, "candidates", len(msg.Candidates))
+		return
+	}
+	for _, candidate := range msg.Candidates {
+		if _, _, err := net.SplitHostPort(candidate); err != nil {
+			slog.Warn("Invalid peer candidate", "client", session.clientIP, "candidate", candidate)
+			return
+		}
+	}
+
+	peer, sender := s.peerFor(session, msg.Peer)
+	if peer == nil {
+		return
+	}
+	msg.Peer = sender
+	if err := s.sendControl(peer, msg); err != nil {
+		slog.Error("Failed to relay peer candidates", "client", session.clientIP, "peer", peer.clientIP, "error", err)
+	}
+}
+
+// relayPeerFrame passes a frame between two clients that cannot reach each
+// other directly. The frame is encrypted end to end and forwarded as it is.
+func (s *VPNServer) relayPeerFrame(session *ClientSession, payload []byte) {
+	var msg protocol.PeerRelay
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid peer relay frame", "client", session.clientIP, "error", err)
+		return
+	}
+
+	peer, sender := s.peerFor(session, msg.Peer)
+	if peer == nil {
+		return
+	}
+	msg.Peer = sender
+	if err := s.sendControl(peer, msg); err != nil {
+		slog.Debug("Failed to relay peer frame", "client", session.clientIP, "peer", peer.clientIP, "error", err)
+	}
+}
+
+// peerFor returns the session of the client at tunnel address peer, which
+// session is writing to, and session's own tunnel address of the same
+// family, by which the peer knows it. Clients that may not reach each other
+// through the server, because of client_isolation or different tenants, are
+// not introduced either, and peer is nil.
+func (s *VPNServer) peerFor(session *ClientSession, peer string) (*ClientSession, string) {
+	config := s.currentConfig()
+	if !config.EnablePeerSignaling || config.ClientIsolation {
+		slog.Debug("Ignoring peer message", "client", session.clientIP)
+		return nil, ""
+	}
+
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil {
+		slog.Warn("Invalid peer address", "client", session.clientIP, "peer", peer)
+		return nil, ""
+	}
+	target := s.sessionFor(peerIP)
+	if target == nil || target == session || target.tenant != session.tenant {
+		slog.Debug("No client at peer address", "client", session.clientIP, "peer", peer)
+		return nil, ""
+	}
+
+	if session.lease == nil {
+		return nil, ""
+	}
+	sender := session.lease.IPv6
+	if peerIP.To4() != nil {
+		sender = session.lease.IPv4
+	}
+	if sender == nil {
+		return nil, ""
+	}
+	return target, sender.String()
+}
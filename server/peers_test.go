@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// relayedTo hands from's peer frame for tunnel address peer to the server
+// and returns what the server sent to, or nil if it sent nothing
+func relayedTo(t *testing.T, s *VPNServer, from, to *ClientSession, peer net.IP) *protocol.PeerRelay {
+	t.Helper()
+	payload, err := json.Marshal(protocol.PeerRelay{Type: protocol.PeerRelayType, Peer: peer.String(), Data: []byte("sealed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.relayPeerFrame(from, payload)
+	}()
+
+	// A relayed frame is written before relayPeerFrame returns
+	select {
+	case frame := <-to.transport.(*pipeTransport).written:
+		<-done
+		var msg protocol.PeerRelay
+		if err := json.Unmarshal(clientOpen(t, s, to, frame), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	case <-done:
+		return nil
+	}
+}
+
+func TestRelayPeerFrame(t *testing.T) {
+	s := newTestServer(t)
+	sender := leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	peer := leaseFor(t, s, net.IPv4(192, 0, 2, 2))
+	from, to := s.clients["192.0.2.1:40000"], s.clients["192.0.2.2:40000"]
+
+	if relayedTo(t, s, from, to, peer.IPv4) != nil {
+		t.Error("frame relayed without enable_peer_signaling")
+	}
+	s.currentConfig().EnablePeerSignaling = true
+
+	// The peer learns the sender by its tunnel address of the same family
+	for _, tc := range []struct{ peer, sender net.IP }{
+		{peer.IPv4, sender.IPv4},
+		{peer.IPv6, sender.IPv6},
+	} {
+		msg := relayedTo(t, s, from, to, tc.peer)
+		if msg == nil {
+			t.Fatalf("frame for %s not relayed", tc.peer)
+		}
+		if msg.Type != protocol.PeerRelayType || msg.Peer != tc.sender.String() || string(msg.Data) != "sealed" {
+			t.Errorf("peer received %+v, want the frame from %s", msg, tc.sender)
+		}
+	}
+
+	if relayedTo(t, s, from, from, sender.IPv4) != nil {
+		t.Error("frame relayed back to its sender")
+	}
+	if relayedTo(t, s, from, to, net.IPv4(192, 0, 2, 99)) != nil {
+		t.Error("frame for an unknown peer relayed")
+	}
+	s.currentConfig().ClientIsolation = true
+	if relayedTo(t, s, from, to, peer.IPv4) != nil {
+		t.Error("frame relayed with client_isolation")
+	}
+}
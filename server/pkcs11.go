@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"stealthvpn/pkg/keystore"
+)
+
+// loadPKCS11Certificate pairs the certificate chain in tls_cert_file with a
+// private key that stays on a PKCS#11 token. The token session is held for
+// the life of the process.
+func loadPKCS11Certificate(config *ServerConfig) (tls.Certificate, error) {
+	pemData, err := os.ReadFile(config.TLSCertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificates found in " + config.TLSCertFile)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	provider, err := keystore.NewPKCS11Provider(*config.PKCS11Config)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert.PrivateKey, err = provider.Signer(cert.Leaf.PublicKey)
+	if err != nil {
+		provider.Close()
+		return tls.Certificate{}, fmt.Errorf("failed to use the PKCS#11 key: %v", err)
+	}
+	return cert, nil
+}
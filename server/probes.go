@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of probing the server recognizes
+const (
+	probeBadUpgrade       = "bad_upgrade"       // the tunnel path without a WebSocket upgrade
+	probeMalformedUpgrade = "malformed_upgrade" // a WebSocket upgrade the server could not accept
+	probeWrongHost        = "wrong_host"        // a tunnel request for another host behind the CDN
+	probePathScan         = "path_scan"         // many unknown paths in a short time
+)
+
+const (
+	// probeWindow is how long a client's requests are remembered, and how
+	// often each kind of probe from one address is logged at most
+	probeWindow = 10 * time.Minute
+	// probeScanPaths is how many distinct unknown paths within probeWindow
+	// make a path scan
+	probeScanPaths = 10
+	// probeMaxAddresses bounds the memory held for addresses; beyond it
+	// new addresses are not tracked until old ones expire
+	probeMaxAddresses = 10000
+)
+
+// probeDetector watches requests to the fake site for censors probing
+// whether the server is a tunnel. It only observes: probers are answered
+// exactly as before, so detection cannot be detected. Each probe is logged
+// with its source and kind, counted in the metrics and, if probe_ban_file
+// is set, the source is appended to that file for a firewall to block.
+type probeDetector struct {
+	banFile string
+
+	mu      sync.Mutex
+	clients map[string]*probeClient // by address
+}
+
+// probeClient is what the detector remembers of one address
+type probeClient struct {
+	since    time.Time           // start of the current window
+	paths    map[string]struct{} // unknown paths requested in the window
+	reported map[string]time.Time
+	listed   bool // written to the ban file
+}
+
+// newProbeDetector creates a detector appending probers to banFile, if set
+func newProbeDetector(banFile string) *probeDetector {
+	return &probeDetector{banFile: banFile, clients: make(map[string]*probeClient)}
+}
+
+// probeHost returns the address of a request's client without its port
+func probeHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// client returns the record for host, starting a new window if the last
+// has passed; nil if too many addresses are tracked. p.mu must be held.
+func (p *probeDetector) client(host string, now time.Time) *probeClient {
+	c, ok := p.clients[host]
+	if !ok {
+		if len(p.clients) >= probeMaxAddresses {
+			return nil
+		}
+		c = &probeClient{reported: make(map[string]time.Time)}
+		p.clients[host] = c
+	}
+	if now.Sub(c.since) > probeWindow {
+		c.since = now
+		c.paths = make(map[string]struct{})
+	}
+	return c
+}
+
+// notFound records a request for a path the site does not have, reporting
+// a path scan once an address has asked for enough of them
+func (p *probeDetector) notFound(r *http.Request) (string, bool) {
+	host := probeHost(r.RemoteAddr)
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.client(host, now)
+	if c == nil {
+		return "", false
+	}
+	if len(c.paths) < probeScanPaths {
+		c.paths[r.URL.Path] = struct{}{}
+	}
+	if len(c.paths) < probeScanPaths {
+		return "", false
+	}
+	return probePathScan, p.shouldReport(c, probePathScan, now)
+}
+
+// observe records a probe of kind from host, reporting whether it should
+// be logged, which it is once per kind and window
+func (p *probeDetector) observe(host, kind string) bool {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.client(host, now)
+	if c == nil {
+		return false
+	}
+	return p.shouldReport(c, kind, now)
+}
+
+// shouldReport reports whether kind was not yet logged for c in this
+// window, marking it logged. p.mu must be held.
+func (p *probeDetector) shouldReport(c *probeClient, kind string, now time.Time) bool {
+	if last, ok := c.reported[kind]; ok && now.Sub(last) < probeWindow {
+		return false
+	}
+	c.reported[kind] = now
+	return true
+}
+
+// ban appends host to the ban file the first time it is seen probing
+func (p *probeDetector) ban(host string) {
+	if p.banFile == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[host]
+	if !ok || c.listed {
+		return
+	}
+	c.listed = true
+
+	file, err := os.OpenFile(p.banFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("Failed to open probe ban file", "file", p.banFile, "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, host); err != nil {
+		slog.Error("Failed to write probe ban file", "file", p.banFile, "error", err)
+	}
+}
+
+// purge forgets addresses not seen probing for a window. Listed addresses
+// are kept, so the ban file gets each address once.
+func (p *probeDetector) purge(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host, c := range p.clients {
+		if !c.listed && now.Sub(c.since) > probeWindow {
+			delete(p.clients, host)
+		}
+	}
+}
+
+// reportProbe records a probe of kind in r, unless it comes from
+// trusted_networks, such as the operator's monitoring
+func (s *VPNServer) reportProbe(r *http.Request, kind string) {
+	if s.trustedPeer(r.RemoteAddr) {
+		return
+	}
+	host := probeHost(r.RemoteAddr)
+	s.metrics.probes.WithLabelValues(kind).Inc()
+	if !s.probes.observe(host, kind) {
+		return
+	}
+	s.logProbe(r, host, kind)
+}
+
+// probeNotFound records a request for an unknown path, reporting a path
+// scan once there have been enough
+func (s *VPNServer) probeNotFound(r *http.Request) {
+	if s.trustedPeer(r.RemoteAddr) {
+		return
+	}
+	kind, report := s.probes.notFound(r)
+	if kind == "" {
+		return
+	}
+	s.metrics.probes.WithLabelValues(kind).Inc()
+	if report {
+		s.logProbe(r, probeHost(r.RemoteAddr), kind)
+	}
+}
+
+// logProbe logs a probe and hands its source to the ban file
+func (s *VPNServer) logProbe(r *http.Request, host, kind string) {
+	slog.Warn("Probe detected", "addr", host, "kind", kind, "method", r.Method, "path", r.URL.Path,
+		"host", r.Host, "user_agent", r.UserAgent(), "tls_fingerprint", s.clientHelloFingerprint(r.RemoteAddr))
+	s.probes.ban(host)
+}
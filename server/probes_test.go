@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// captureProbeLogs sends the default logger's records to a buffer for the
+// rest of the test
+func captureProbeLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &out
+}
+
+// probeEvents returns the addr and kind of each probe logged to out
+func probeEvents(t *testing.T, out *bytes.Buffer) []string {
+	t.Helper()
+	var events []string
+	decoder := json.NewDecoder(bytes.NewReader(out.Bytes()))
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "Probe detected" {
+			events = append(events, record["addr"].(string)+" "+record["kind"].(string))
+		}
+	}
+	return events
+}
+
+// probeCount returns how many probes of kind s has counted
+func probeCount(t *testing.T, s *VPNServer, kind string) float64 {
+	t.Helper()
+	families, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "stealthvpn_probes_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "kind" && label.GetValue() == kind {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestProbesLogged(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "probers")
+	s, err := NewVPNServer(&ServerConfig{
+		PreSharedKey:         "0123456789abcdef0123456789abcdef",
+		FakeDomainName:       "cdn.example.com",
+		EnableDomainFronting: true,
+		ProbeBanFile:         banFile,
+		TrustedNetworks:      []string{"198.51.100.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setupFakeWebHandlers()
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+	out := captureProbeLogs(t)
+
+	request := func(addr, host, path string, header http.Header) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = addr + ":40000"
+		r.Host = host
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	upgrade := http.Header{"Upgrade": {"websocket"}}
+
+	// Each prober is answered as anyone else would be
+	for _, test := range []struct {
+		addr   string
+		host   string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"192.0.2.1", "cdn.example.com", "/ws", nil, http.StatusBadRequest},
+		{"192.0.2.1", "cdn.example.com", "/ws", nil, http.StatusBadRequest},
+		{"192.0.2.2", "cdn.example.com", "/ws", upgrade, http.StatusBadRequest},
+		{"192.0.2.3", "other.example.com", "/ws", upgrade, http.StatusNotFound},
+		{"192.0.2.1", "cdn.example.com", "/", nil, http.StatusOK},
+		{"198.51.100.7", "cdn.example.com", "/ws", nil, http.StatusBadRequest},
+	} {
+		if code := request(test.addr, test.host, test.path, test.header); code != test.want {
+			t.Errorf("%s for %s%s answered %d, want %d", test.addr, test.host, test.path, code, test.want)
+		}
+	}
+
+	// Unknown paths are a scan only once there are enough of them
+	for i := 0; i < probeScanPaths-1; i++ {
+		request("192.0.2.4", "cdn.example.com", "/admin"+strconv.Itoa(i), nil)
+	}
+	if events := probeEvents(t, out); strings.Contains(strings.Join(events, ","), probePathScan) {
+		t.Fatalf("path scan reported after %d paths", probeScanPaths-1)
+	}
+	for i := probeScanPaths - 1; i < 2*probeScanPaths; i++ {
+		if code := request("192.0.2.4", "cdn.example.com", "/admin"+strconv.Itoa(i), nil); code != http.StatusNotFound {
+			t.Errorf("unknown path answered %d, want %d", code, http.StatusNotFound)
+		}
+	}
+
+	// Each kind is logged once per address, but counted every time, and
+	// trusted networks are neither
+	want := []string{
+		"192.0.2.1 " + probeBadUpgrade,
+		"192.0.2.2 " + probeMalformedUpgrade,
+		"192.0.2.3 " + probeWrongHost,
+		"192.0.2.4 " + probePathScan,
+	}
+	if events := probeEvents(t, out); strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("probes logged %q, want %q", events, want)
+	}
+	for kind, count := range map[string]float64{
+		probeBadUpgrade:       2,
+		probeMalformedUpgrade: 1,
+		probeWrongHost:        1,
+		probePathScan:         probeScanPaths + 1,
+	} {
+		if got := probeCount(t, s, kind); got != count {
+			t.Errorf("%s counted %v times, want %v", kind, got, count)
+		}
+	}
+
+	// Each prober is banned once
+	banned, err := os.ReadFile(banFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(banned), "192.0.2.1\n192.0.2.2\n192.0.2.3\n192.0.2.4\n"; got != want {
+		t.Errorf("ban file = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"sync/atomic"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/server/mgmt"
+)
+
+// quotaKey names a client in client_quotas and the usage API: its user
+// name if it logged in, otherwise its IP address
+func quotaKey(session *ClientSession) string {
+	if session.username != "" {
+		return session.username
+	}
+	return session.clientIP.String()
+}
+
+// identityForKey turns a quota key back into the identity the stats store
+// uses
+func identityForKey(client string) string {
+	if net.ParseIP(client) != nil {
+		return net.ParseIP(client).String()
+	}
+	return "user:" + client
+}
+
+// clientQuota returns the data cap for a client, 0 if it has none
+func clientQuota(config *ServerConfig, client string) uint64 {
+	if quota, ok := config.ClientQuotas[client]; ok {
+		return quota
+	}
+	return config.QuotaBytes
+}
+
+// quotaExhausted reports whether a client has used up its quota in earlier
+// sessions, so a new session must be refused
+func (s *VPNServer) quotaExhausted(session *ClientSession) bool {
+	quota := clientQuota(s.currentConfig(), quotaKey(session))
+	if quota == 0 || s.statsStore == nil {
+		return false
+	}
+
+	stats, err := s.statsStore.Load(clientIdentity(session))
+	if err != nil {
+		slog.Error("Failed to load stats", "client", session.clientIP, "error", err)
+		return false
+	}
+	return stats.BytesIn+stats.BytesOut >= quota
+}
+
+// startQuota sets the session's cap from the config. Must be called after
+// the stored totals are loaded.
+func (s *VPNServer) startQuota(session *ClientSession) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	// Without stored totals there is nothing to count against
+	if s.statsStore != nil {
+		session.quota = clientQuota(s.currentConfig(), quotaKey(session))
+	}
+	s.updateQuotaEnd(session)
+}
+
+// updateQuotaEnd recomputes how many bytes the session may carry before its
+// client reaches the quota. The caller must hold statsMu.
+func (s *VPNServer) updateQuotaEnd(session *ClientSession) {
+	if session.quota == 0 {
+		atomic.StoreUint64(&session.quotaEnd, math.MaxUint64)
+		return
+	}
+
+	// Stored totals already include what this session saved
+	stored := session.history.BytesIn + session.history.BytesOut
+	saved := session.savedIn + session.savedOut
+	end := uint64(0)
+	if session.quota+saved > stored {
+		end = session.quota + saved - stored
+	}
+	atomic.StoreUint64(&session.quotaEnd, end)
+}
+
+// overQuota reports whether the session's client has used up its quota.
+// It only loads counters, so it is cheap enough to call for every packet.
+func (s *VPNServer) overQuota(session *ClientSession) bool {
+	used := atomic.LoadUint64(&session.bytesIn) + atomic.LoadUint64(&session.bytesOut)
+	return used >= atomic.LoadUint64(&session.quotaEnd)
+}
+
+// refuseOverQuota tells the client it has used up its quota; the caller then
+// drops the session
+func (s *VPNServer) refuseOverQuota(session *ClientSession) {
+	slog.Info("Client used up its data quota", "client", quotaKey(session))
+	if err := s.sendControl(session, protocol.Message{
+		Type:  protocol.QuotaExceededType,
+		Error: "data quota exceeded",
+	}); err != nil {
+		slog.Error("Failed to notify client of its quota", "client", session.clientIP, "error", err)
+	}
+}
+
+// ClientUsage returns the stored traffic and quota of a client, which need
+// not be connected
+func (s *VPNServer) ClientUsage(client string) (mgmt.Usage, error) {
+	if s.statsStore == nil {
+		return mgmt.Usage{}, errors.New("usage is only tracked when stats_dir or redis_url is set")
+	}
+
+	// Count traffic active sessions have not saved yet
+	s.persistAllStats()
+	stats, err := s.statsStore.Load(identityForKey(client))
+	if err != nil {
+		return mgmt.Usage{}, err
+	}
+
+	usage := mgmt.Usage{
+		Client:     client,
+		BytesIn:    stats.BytesIn,
+		BytesOut:   stats.BytesOut,
+		QuotaBytes: clientQuota(s.currentConfig(), client),
+	}
+	if usage.QuotaBytes > 0 {
+		remaining := quotaRemaining(usage.QuotaBytes, stats.BytesIn+stats.BytesOut)
+		usage.QuotaRemaining = &remaining
+	}
+	return usage, nil
+}
+
+// ResetUsage clears a client's stored traffic, restoring access if it was
+// over quota
+func (s *VPNServer) ResetUsage(client string) error {
+	if s.statsStore == nil {
+		return errors.New("usage is only tracked when stats_dir or redis_url is set")
+	}
+	identity := identityForKey(client)
+
+	s.clientsMu.RLock()
+	var sessions []*ClientSession
+	for _, session := range s.clients {
+		if clientIdentity(session) == identity {
+			sessions = append(sessions, session)
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if err := s.statsStore.Save(identity, protocol.SessionStats{}); err != nil {
+		return err
+	}
+
+	// Active sessions count again from what they have carried so far
+	for _, session := range sessions {
+		session.history = protocol.SessionStats{}
+		session.savedIn = atomic.LoadUint64(&session.bytesIn)
+		session.savedOut = atomic.LoadUint64(&session.bytesOut)
+		s.updateQuotaEnd(session)
+	}
+	return nil
+}
+
+// quotaRemaining returns how much of quota is left after used bytes
+func quotaRemaining(quota, used uint64) uint64 {
+	if used >= quota {
+		return 0
+	}
+	return quota - used
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// newQuotaServer returns a server storing stats in a temporary directory
+// with quota bytes for every client and 1000 for alice
+func newQuotaServer(t *testing.T, quota uint64) *VPNServer {
+	t.Helper()
+	s := newTestServer(t)
+	store, err := NewFileStatsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.statsStore = store
+	s.currentConfig().QuotaBytes = quota
+	s.currentConfig().ClientQuotas = map[string]uint64{"alice": 1000}
+	return s
+}
+
+// startQuotaSession starts quota accounting for a new session as
+// handleClientSession does
+func startQuotaSession(t *testing.T, s *VPNServer, username string) *ClientSession {
+	t.Helper()
+	session := newTestSession(t, newPipeTransport())
+	session.username = username
+	s.loadHistoricalStats(session)
+	s.startQuota(session)
+	return session
+}
+
+func TestQuotaCountsEarlierSessions(t *testing.T) {
+	s := newQuotaServer(t, 100)
+	if err := s.statsStore.Save("192.0.2.1", protocol.SessionStats{BytesIn: 50, BytesOut: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	session := startQuotaSession(t, s, "")
+	atomic.AddUint64(&session.bytesIn, 30)
+	if s.overQuota(session) {
+		t.Fatal("over quota after 90 of 100 bytes")
+	}
+	// Saving mid-session must not count the saved traffic twice
+	s.persistStats(session)
+	if s.overQuota(session) {
+		t.Fatal("over quota after saving 90 of 100 bytes")
+	}
+	atomic.AddUint64(&session.bytesOut, 10)
+	if !s.overQuota(session) {
+		t.Fatal("not over quota after 100 of 100 bytes")
+	}
+
+	s.persistStats(session)
+	if !s.quotaExhausted(newTestSession(t, newPipeTransport())) {
+		t.Error("new session accepted for a client over its quota")
+	}
+	// A user's own quota replaces the default
+	if alice := startQuotaSession(t, s, "alice"); s.quotaExhausted(alice) || s.overQuota(alice) {
+		t.Error("alice limited by the default quota")
+	}
+}
+
+func TestResetUsageRestoresAccess(t *testing.T) {
+	s := newQuotaServer(t, 100)
+	session := startQuotaSession(t, s, "")
+	s.clients[session.id] = session
+	atomic.AddUint64(&session.bytesIn, 120)
+	if !s.overQuota(session) {
+		t.Fatal("not over quota")
+	}
+
+	usage, err := s.ClientUsage("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.BytesIn != 120 || usage.QuotaBytes != 100 || usage.QuotaRemaining == nil || *usage.QuotaRemaining != 0 {
+		t.Errorf("usage = %+v, want 120 bytes in and none of 100 left", usage)
+	}
+
+	if err := s.ResetUsage("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.overQuota(session) || s.quotaExhausted(session) {
+		t.Error("still over quota after a reset")
+	}
+	atomic.AddUint64(&session.bytesIn, 100)
+	if !s.overQuota(session) {
+		t.Error("reset session not limited by the quota again")
+	}
+}
+
+func TestUsageNeedsStatsStore(t *testing.T) {
+	s := newTestServer(t)
+	s.currentConfig().QuotaBytes = 100
+	if _, err := s.ClientUsage("192.0.2.1"); err == nil {
+		t.Error("usage reported without a stats store")
+	}
+	if err := s.ResetUsage("192.0.2.1"); err == nil {
+		t.Error("usage reset without a stats store")
+	}
+
+	// Without stored totals the quota cannot be enforced
+	session := startQuotaSession(t, s, "")
+	atomic.AddUint64(&session.bytesIn, 1000)
+	if s.overQuota(session) {
+		t.Error("quota enforced without a stats store")
+	}
+}
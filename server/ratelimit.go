@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// ipLimiterCapacity bounds how many addresses a limiter tracks, so spoofed
+// addresses cannot exhaust memory
+const ipLimiterCapacity = 10000
+
+// keyExchangePenalty is how long a rate-limited client waits before its
+// connection is closed, so an attacker cannot quickly try again
+const keyExchangePenalty = 5 * time.Second
+
+// ipv6PrefixBits is the prefix by which IPv6 clients are limited. A client
+// is usually given a whole /64, so limiting single addresses would let it
+// take a fresh bucket for every connection and flush everyone else's.
+const ipv6PrefixBits = 64
+
+// maxDelayedRejects bounds how many rate-limited clients wait out the
+// penalty at once. Each holds a goroutine and a connection, so beyond this
+// they are closed at once rather than let a flood tie up the server.
+const maxDelayedRejects = 256
+
+// ipRateLimiter gives each client IP, or IPv6 /64, a token bucket of a number of events
+// per interval, all of which may happen at once. The least recently
+// seen addresses are forgotten once capacity are tracked, and cleanupRoutine
+// forgets those whose bucket has refilled, as a new one would be full too.
+type ipRateLimiter struct {
+	interval time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	buckets map[string]*list.Element // client IP -> element of recent
+	recent  *list.List               // *ipBucket, most recently seen first
+}
+
+// ipBucket is the token bucket of one client IP
+type ipBucket struct {
+	host    string
+	limiter *rate.Limiter
+}
+
+// newIPRateLimiter allows each IP events per interval, tracking at most
+// capacity addresses
+func newIPRateLimiter(events int, interval time.Duration, capacity int) *ipRateLimiter {
+	return &ipRateLimiter{
+		interval: interval,
+		capacity: capacity,
+		limit:    rate.Limit(float64(events) / interval.Seconds()),
+		burst:    events,
+		buckets:  make(map[string]*list.Element),
+		recent:   list.New(),
+	}
+}
+
+// newConnectionLimiter allows perSecond new connections per IP
+func newConnectionLimiter(perSecond int) *ipRateLimiter {
+	return newIPRateLimiter(perSecond, time.Second, ipLimiterCapacity)
+}
+
+// newKeyExchangeLimiter allows perMinute key exchanges per IP. Key
+// exchanges cost the server far more than the client, so without a limit
+// bogus connections could exhaust its CPU.
+func newKeyExchangeLimiter(perMinute int) *ipRateLimiter {
+	return newIPRateLimiter(perMinute, time.Minute, ipLimiterCapacity)
+}
+
+// allow reports whether remoteAddr may go ahead now and, if not, how long
+// it should wait before retrying
+func (l *ipRateLimiter) allow(remoteAddr string) (bool, time.Duration) {
+	return l.allowAt(remoteAddr, time.Now())
+}
+
+// allowAt is allow at the time now
+func (l *ipRateLimiter) allowAt(remoteAddr string, now time.Time) (bool, time.Duration) {
+	host := limiterKey(remoteAddr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.buckets[host]
+	if ok {
+		l.recent.MoveToFront(element)
+	} else {
+		if l.recent.Len() >= l.capacity {
+			l.remove(l.recent.Back())
+		}
+		element = l.recent.PushFront(&ipBucket{
+			host:    host,
+			limiter: rate.NewLimiter(l.limit, l.burst),
+		})
+		l.buckets[host] = element
+	}
+
+	reservation := element.Value.(*ipBucket).limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+	reservation.CancelAt(now)
+	return false, delay
+}
+
+// limiterKey returns the bucket key of remoteAddr: the IP for IPv4 and its
+// /64 prefix for IPv6
+func limiterKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix := net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6PrefixBits, 128)), Mask: net.CIDRMask(ipv6PrefixBits, 128)}
+	return prefix.String()
+}
+
+// remove forgets the bucket of element. l.mu must be held.
+func (l *ipRateLimiter) remove(element *list.Element) {
+	delete(l.buckets, element.Value.(*ipBucket).host)
+	l.recent.Remove(element)
+}
+
+// tracked returns how many addresses have a bucket
+func (l *ipRateLimiter) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.recent.Len()
+}
+
+// setRate changes the limit to events per interval, for IPs already seen
+// too
+func (l *ipRateLimiter) setRate(events int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = rate.Limit(float64(events)/l.interval.Seconds()), events
+	for element := l.recent.Front(); element != nil; element = element.Next() {
+		limiter := element.Value.(*ipBucket).limiter
+		limiter.SetLimit(l.limit)
+		limiter.SetBurst(l.burst)
+	}
+}
+
+// forgetRefilled forgets the IPs whose bucket is full again at now
+func (l *ipRateLimiter) forgetRefilled(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for element := l.recent.Back(); element != nil; {
+		previous := element.Prev()
+		if element.Value.(*ipBucket).limiter.TokensAt(now) >= float64(l.burst) {
+			l.remove(element)
+		}
+		element = previous
+	}
+}
+
+// cleanupRoutine periodically forgets IPs whose bucket has refilled
+func (l *ipRateLimiter) cleanupRoutine() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		l.forgetRefilled(now)
+	}
+}
+
+// rejectKeyExchange makes a rate-limited client wait, unless too many
+// already are, then closes a WebSocket connection with a policy violation.
+// Other transports are just closed by the caller.
+func (s *VPNServer) rejectKeyExchange(transport protocol.Transport) {
+	select {
+	case s.rejectSlots <- struct{}{}:
+		time.Sleep(keyExchangePenalty)
+		<-s.rejectSlots
+	default:
+	}
+	if ws, ok := protocol.UnwrapWebSocket(transport); ok {
+		message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limited")
+		ws.Conn().WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiterBurstAndRefill(t *testing.T) {
+	limiter := newIPRateLimiter(3, time.Second, ipLimiterCapacity)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allowAt("192.0.2.1:1000", now); !allowed {
+			t.Fatalf("event %d of a burst of 3 refused", i+1)
+		}
+	}
+	allowed, retryAfter := limiter.allowAt("192.0.2.1:1001", now)
+	if allowed {
+		t.Fatal("fourth event of a burst of 3 allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second/3 {
+		t.Errorf("retry after %v, want up to a third of a second", retryAfter)
+	}
+
+	// Other addresses have their own bucket
+	if allowed, _ := limiter.allowAt("192.0.2.2:1000", now); !allowed {
+		t.Error("another IP limited by the first one's burst")
+	}
+
+	// A refused event takes no token, so waiting as told is enough
+	if allowed, _ := limiter.allowAt("192.0.2.1:1002", now.Add(retryAfter)); !allowed {
+		t.Error("event refused after waiting as told")
+	}
+	if allowed, _ := limiter.allowAt("192.0.2.1:1003", now.Add(retryAfter)); allowed {
+		t.Error("refill allowed more than one event")
+	}
+}
+
+func TestIPRateLimiterSetRate(t *testing.T) {
+	limiter := newIPRateLimiter(1, time.Minute, ipLimiterCapacity)
+	now := time.Now()
+	limiter.allowAt("192.0.2.1:1000", now)
+	if allowed, _ := limiter.allowAt("192.0.2.1:1000", now); allowed {
+		t.Fatal("second event of a burst of 1 allowed")
+	}
+
+	limiter.setRate(60)
+	if allowed, _ := limiter.allowAt("192.0.2.1:1000", now.Add(2*time.Second)); !allowed {
+		t.Error("raised rate not applied to an IP already seen")
+	}
+}
+
+func TestIPRateLimiterEviction(t *testing.T) {
+	limiter := newIPRateLimiter(1, time.Minute, 3)
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		limiter.allowAt(fmt.Sprintf("192.0.2.%d:1000", i), now)
+	}
+
+	// Seeing the first address again makes the second the least recent,
+	// so it goes to make room for a fourth
+	limiter.allowAt("192.0.2.1:1000", now)
+	limiter.allowAt("192.0.2.4:1000", now)
+	if got := limiter.tracked(); got != 3 {
+		t.Fatalf("%d addresses tracked, want at most 3", got)
+	}
+	if allowed, _ := limiter.allowAt("192.0.2.1:1000", now); allowed {
+		t.Error("recently seen address forgotten")
+	}
+	if allowed, _ := limiter.allowAt("192.0.2.2:1000", now); !allowed {
+		t.Error("least recently seen address not forgotten")
+	}
+
+	// Buckets that have refilled are forgotten; the rest are kept
+	limiter.allowAt("192.0.2.5:1000", now.Add(59*time.Second))
+	limiter.forgetRefilled(now.Add(time.Minute))
+	if got := limiter.tracked(); got != 1 {
+		t.Errorf("%d addresses tracked after cleanup, want 1", got)
+	}
+}
+
+func TestIPRateLimiterKeysIPv6ByPrefix(t *testing.T) {
+	limiter := newIPRateLimiter(1, time.Minute, 3)
+	now := time.Now()
+	limiter.allowAt("192.0.2.1:1000", now)
+	limiter.allowAt("[2001:db8:1::1]:1000", now)
+
+	// Every address of a /64 shares one bucket, so cycling through them
+	// neither gets past the limit nor evicts other clients
+	for i := 2; i < 100; i++ {
+		addr := fmt.Sprintf("[2001:db8:1::%x:%x]:1000", i, i)
+		if allowed, _ := limiter.allowAt(addr, now); allowed {
+			t.Fatalf("%s of a limited /64 allowed", addr)
+		}
+	}
+	if got := limiter.tracked(); got != 2 {
+		t.Errorf("%d buckets tracked, want 2", got)
+	}
+	if allowed, _ := limiter.allowAt("192.0.2.1:1000", now); allowed {
+		t.Error("IPv4 client's bucket evicted by one /64")
+	}
+
+	// Another /64 is another client
+	if allowed, _ := limiter.allowAt("[2001:db8:2::1]:1000", now); !allowed {
+		t.Error("another /64 limited by the first one's bucket")
+	}
+
+	// IPv4-mapped addresses share the IPv4 address's bucket
+	if allowed, _ := limiter.allowAt("[::ffff:192.0.2.1]:1000", now); allowed {
+		t.Error("IPv4-mapped address not limited as the IPv4 one")
+	}
+}
+
+// webSocketAttempt makes a request to the WebSocket endpoint from addr and
+// returns the response
+func webSocketAttempt(s *VPNServer, addr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	s.handleWebSocket(w, r)
+	return w
+}
+
+func TestConnectionFloodRejectedUntilClientWaits(t *testing.T) {
+	s := newTestServer(t)
+	s.connLimiter = newConnectionLimiter(20)
+
+	// The burst gets past the limiter, to fail later for want of an upgrade
+	for i := 0; i < 20; i++ {
+		if w := webSocketAttempt(s, "192.0.2.1:40000"); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("connection %d of a burst of 20 rate limited", i+1)
+		}
+	}
+	w := webSocketAttempt(s, "192.0.2.1:40001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("connection over the limit answered %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+	if got := w.Header().Get("Server"); !strings.HasPrefix(got, "nginx") {
+		t.Errorf("Server = %q, want the nginx disguise", got)
+	}
+
+	time.Sleep(time.Second / 20)
+	if w := webSocketAttempt(s, "192.0.2.1:40002"); w.Code == http.StatusTooManyRequests {
+		t.Error("client still rate limited after waiting")
+	}
+}
+
+func TestRejectKeyExchangeClosesAtOnceWhenBusy(t *testing.T) {
+	s := newTestServer(t)
+	s.rejectSlots = make(chan struct{}, 1)
+	s.rejectSlots <- struct{}{}
+
+	// With every slot taken the client is not made to wait
+	done := make(chan struct{})
+	go func() {
+		s.rejectKeyExchange(newPipeTransport())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(keyExchangePenalty / 2):
+		t.Fatal("rejected key exchange held while the delayed rejects were full")
+	}
+	if len(s.rejectSlots) != 1 {
+		t.Errorf("%d delayed rejects counted, want the 1 already waiting", len(s.rejectSlots))
+	}
+}
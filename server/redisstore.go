@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// redisPrefix namespaces every key the server uses
+	redisPrefix = "stealthvpn:"
+	// redisRevocations is the channel revocations are published on
+	redisRevocations = redisPrefix + "revocations"
+	// redisLeaseTTL is how long a lease survives without its instance
+	// refreshing it, so a crashed instance's leases are freed
+	redisLeaseTTL = 2 * time.Minute
+	// redisTimeout bounds each call to Redis
+	redisTimeout = 5 * time.Second
+)
+
+// redisAllocate claims a free IPv4 address and a free IPv6 interface
+// identifier, trying the client's previous ones first. The scan runs inside
+// Redis so two instances can never claim the same address.
+//
+// KEYS[1]: hash of client ID -> previous lease, KEYS[2]: IPv6 counter
+// ARGV: IPv4 key prefix, IPv6 key prefix, first and last IPv4 host, owner,
+// lease TTL in ms, client ID
+var redisAllocate = redis.NewScript(`
+local prefix4, prefix6 = ARGV[1], ARGV[2]
+local first, last = tonumber(ARGV[3]), tonumber(ARGV[4])
+local owner, ttl, client = ARGV[5], ARGV[6], ARGV[7]
+local function claim(key)
+	return redis.call('SET', key, owner, 'NX', 'PX', ttl)
+end
+
+local prev4, prev6
+local previous = redis.call('HGET', KEYS[1], client)
+if previous then
+	prev4, prev6 = string.match(previous, '^(%d+),(%d+)$')
+end
+
+local host4
+if prev4 and tonumber(prev4) >= first and tonumber(prev4) <= last and claim(prefix4 .. prev4) then
+	host4 = prev4
+else
+	for host = first, last do
+		if claim(prefix4 .. host) then
+			host4 = tostring(host)
+			break
+		end
+	end
+end
+if not host4 then
+	return {'', ''}
+end
+
+local host6
+if prev6 and tonumber(prev6) >= 2 and claim(prefix6 .. prev6) then
+	host6 = prev6
+else
+	redis.call('SETNX', KEYS[2], 1)
+	repeat
+		host6 = tostring(redis.call('INCR', KEYS[2]))
+	until claim(prefix6 .. host6)
+end
+
+redis.call('HSET', KEYS[1], client, host4 .. ',' .. host6)
+return {host4, host6}
+`)
+
+// redisRelease deletes the lease keys still owned by ARGV[1]
+var redisRelease = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('GET', key) == ARGV[1] then
+		redis.call('DEL', key)
+	end
+end
+return 0
+`)
+
+// redisRefresh extends the lease keys still owned by ARGV[1] to ARGV[2] ms
+var redisRefresh = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('GET', key) == ARGV[1] then
+		redis.call('PEXPIRE', key, ARGV[2])
+	end
+end
+return 0
+`)
+
+// RevocationBus tells every server sharing a store to drop a client
+type RevocationBus interface {
+	// PublishRevocation revokes clientID on every server, this one included
+	PublishRevocation(clientID string) error
+	// SubscribeRevocations calls revoke for each revoked client ID
+	SubscribeRevocations(revoke func(clientID string))
+}
+
+// SessionStore is client state shared by a fleet of servers behind a load
+// balancer, so a client can reconnect to any of them: traffic totals and
+// quota usage, tunnel address leases and revocations
+type SessionStore interface {
+	StatsStore
+	LeaseAllocator
+	RevocationBus
+}
+
+// RedisSessionStore keeps the shared state in Redis. Addresses are still
+// computed from this server's pool settings, which must match across the
+// fleet.
+type RedisSessionStore struct {
+	client *redis.Client
+	pool   *IPAddressPool
+	owner  string // identifies this server as the holder of its leases
+
+	mu   sync.Mutex
+	held map[string]*IPLease // leases this server refreshes, by IPv4 address
+}
+
+// NewRedisSessionStore connects to the Redis server at url, such as
+// redis://:password@host:6379/0, and allocates addresses in pool's subnets
+func NewRedisSessionStore(url string, pool *IPAddressPool) (*RedisSessionStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis_url: %v", err)
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to reach Redis: %v", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	store := &RedisSessionStore{
+		client: client,
+		pool:   pool,
+		owner:  hex.EncodeToString(id),
+		held:   make(map[string]*IPLease),
+	}
+	go store.refreshLeases()
+	return store, nil
+}
+
+// statsKey returns the hash holding a client's totals
+func statsKey(clientID string) string {
+	return redisPrefix + "stats:" + clientID
+}
+
+// Save replaces the stored totals for clientID
+func (r *RedisSessionStore) Save(clientID string, stats protocol.SessionStats) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.HSet(ctx, statsKey(clientID), "bytes_in", stats.BytesIn, "bytes_out", stats.BytesOut).Err()
+}
+
+// Load returns the stored totals for clientID
+func (r *RedisSessionStore) Load(clientID string) (protocol.SessionStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	var stats protocol.SessionStats
+	values, err := r.client.HMGet(ctx, statsKey(clientID), "bytes_in", "bytes_out").Result()
+	if err != nil {
+		return stats, err
+	}
+	if stats.BytesIn, err = redisUint(values[0]); err != nil {
+		return stats, fmt.Errorf("corrupt stats for %s: %v", clientID, err)
+	}
+	if stats.BytesOut, err = redisUint(values[1]); err != nil {
+		return stats, fmt.Errorf("corrupt stats for %s: %v", clientID, err)
+	}
+	return stats, nil
+}
+
+// Add increments the stored totals atomically, so servers adding to the same
+// client at once do not lose each other's traffic
+func (r *RedisSessionStore) Add(clientID string, delta protocol.SessionStats) (protocol.SessionStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	var bytesIn, bytesOut *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		bytesIn = pipe.HIncrBy(ctx, statsKey(clientID), "bytes_in", int64(delta.BytesIn))
+		bytesOut = pipe.HIncrBy(ctx, statsKey(clientID), "bytes_out", int64(delta.BytesOut))
+		return nil
+	})
+	if err != nil {
+		return protocol.SessionStats{}, err
+	}
+	return protocol.SessionStats{BytesIn: uint64(bytesIn.Val()), BytesOut: uint64(bytesOut.Val())}, nil
+}
+
+// redisUint parses a hash field, treating a missing one as zero
+func redisUint(value interface{}) (uint64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %v", value)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// leaseKeys returns the keys marking a lease's addresses as taken
+func (r *RedisSessionStore) leaseKeys(lease *IPLease) ([]string, bool) {
+	host4, ok4 := r.pool.host4(lease.IPv4)
+	host6, ok6 := r.pool.host6(lease.IPv6)
+	if !ok4 || !ok6 {
+		return nil, false
+	}
+	return []string{
+		redisPrefix + "lease4:" + strconv.FormatUint(uint64(host4), 10),
+		redisPrefix + "lease6:" + strconv.FormatUint(host6, 10),
+	}, true
+}
+
+// Allocate claims addresses for a client in Redis
+func (r *RedisSessionStore) Allocate(clientID string) (*IPLease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	first, last := r.pool.hostRange4()
+	result, err := redisAllocate.Run(ctx, r.client,
+		[]string{redisPrefix + "previous", redisPrefix + "next6"},
+		redisPrefix+"lease4:", redisPrefix+"lease6:", first, last,
+		r.owner, redisLeaseTTL.Milliseconds(), clientID,
+	).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate addresses: %v", err)
+	}
+	if len(result) != 2 || result[0] == "" {
+		return nil, errPoolExhausted
+	}
+
+	host4, err4 := strconv.ParseUint(result[0], 10, 32)
+	host6, err6 := strconv.ParseUint(result[1], 10, 64)
+	if err4 != nil || err6 != nil {
+		return nil, errors.New("invalid lease from Redis")
+	}
+	lease := &IPLease{IPv4: r.pool.ipv4At(uint32(host4)), IPv6: r.pool.ipv6At(host6)}
+
+	r.mu.Lock()
+	r.held[lease.IPv4.String()] = lease
+	r.mu.Unlock()
+	return lease, nil
+}
+
+// Release frees a lease's addresses unless another server has taken them
+// after this one's claim expired
+func (r *RedisSessionStore) Release(lease *IPLease) {
+	if lease == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.held, lease.IPv4.String())
+	r.mu.Unlock()
+
+	keys, ok := r.leaseKeys(lease)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := redisRelease.Run(ctx, r.client, keys, r.owner).Err(); err != nil {
+		slog.Error("Failed to release lease", "ipv4", lease.IPv4, "error", err)
+	}
+}
+
+// ServerIPv4 returns the server's IPv4 address inside the tunnel
+func (r *RedisSessionStore) ServerIPv4() net.IP {
+	return r.pool.ServerIPv4()
+}
+
+// ServerIPv6 returns the server's IPv6 address inside the tunnel
+func (r *RedisSessionStore) ServerIPv6() net.IP {
+	return r.pool.ServerIPv6()
+}
+
+// Contains reports whether ip is in the subnets of the pool addresses are
+// allocated in
+func (r *RedisSessionStore) Contains(ip net.IP) bool {
+	return r.pool.Contains(ip)
+}
+
+// refreshLeases keeps this server's leases from expiring while it runs
+func (r *RedisSessionStore) refreshLeases() {
+	ticker := time.NewTicker(redisLeaseTTL / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		var keys []string
+		for _, lease := range r.held {
+			if leaseKeys, ok := r.leaseKeys(lease); ok {
+				keys = append(keys, leaseKeys...)
+			}
+		}
+		r.mu.Unlock()
+		if len(keys) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		if err := redisRefresh.Run(ctx, r.client, keys, r.owner, redisLeaseTTL.Milliseconds()).Err(); err != nil {
+			slog.Error("Failed to refresh leases", "error", err)
+		}
+		cancel()
+	}
+}
+
+// PublishRevocation revokes clientID on every server
+func (r *RedisSessionStore) PublishRevocation(clientID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.Publish(ctx, redisRevocations, clientID).Err()
+}
+
+// SubscribeRevocations calls revoke for every revocation published by any
+// server. The subscription reconnects by itself if Redis goes away.
+func (r *RedisSessionStore) SubscribeRevocations(revoke func(clientID string)) {
+	subscription := r.client.Subscribe(context.Background(), redisRevocations)
+	go func() {
+		for message := range subscription.Channel() {
+			revoke(message.Payload)
+		}
+	}()
+}
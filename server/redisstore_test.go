@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// loopbackRevocations delivers published revocations straight back, as
+// Redis does to every subscribed server
+type loopbackRevocations struct {
+	published []string
+	revoke    func(clientID string)
+}
+
+func (l *loopbackRevocations) PublishRevocation(clientID string) error {
+	l.published = append(l.published, clientID)
+	l.revoke(clientID)
+	return nil
+}
+
+func (l *loopbackRevocations) SubscribeRevocations(revoke func(clientID string)) {
+	l.revoke = revoke
+}
+
+func TestRevokeClientDropsSessionsAndTokens(t *testing.T) {
+	s := newTestServer(t)
+	s.currentConfig().SessionTokenTTL = 60
+	bus := &loopbackRevocations{}
+	bus.SubscribeRevocations(s.revokeLocal)
+	s.revocations = bus
+
+	// One of alice's sessions has ended and could be resumed; the other is
+	// still connected
+	transport := newPipeTransport()
+	defer transport.Close()
+	ended := newTestSession(t, transport)
+	ended.username = "alice"
+	token, _ := issueTestToken(t, s, ended, transport)
+	s.releaseSession(ended)
+
+	active := newTestSession(t, newPipeTransport())
+	active.username = "alice"
+	s.clients[active.id] = active
+	other := newTestSession(t, newPipeTransport())
+	other.id = "192.0.2.2:40000"
+	s.clients[other.id] = other
+
+	if err := s.RevokeClient("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.published) != 1 || bus.published[0] != "user:alice" {
+		t.Errorf("published %v, want alice's identity", bus.published)
+	}
+	if s.resumeSession(token) != nil {
+		t.Error("revoked client's session resumed")
+	}
+	if !active.revoked.Load() {
+		t.Error("revoked client's active session not marked")
+	}
+	if _, err := active.transport.ReadMessage(); err == nil {
+		t.Error("revoked client's active session still open")
+	}
+	if other.revoked.Load() {
+		t.Error("another client revoked")
+	}
+}
+
+func TestRedisUint(t *testing.T) {
+	if v, err := redisUint(nil); err != nil || v != 0 {
+		t.Errorf("missing field = %d, %v, want 0", v, err)
+	}
+	if v, err := redisUint("1234"); err != nil || v != 1234 {
+		t.Errorf("redisUint(\"1234\") = %d, %v", v, err)
+	}
+	for _, value := range []interface{}{"-1", "lots", int64(5)} {
+		if _, err := redisUint(value); err == nil {
+			t.Errorf("redisUint(%#v) accepted", value)
+		}
+	}
+}
+
+func TestRedisLeaseKeysOutsidePool(t *testing.T) {
+	pool, err := NewIPAddressPool("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RedisSessionStore{pool: pool}
+	keys, ok := r.leaseKeys(&IPLease{IPv4: net.ParseIP("10.8.0.5"), IPv6: net.ParseIP("fd00::9")})
+	if !ok || len(keys) != 2 || keys[0] != "stealthvpn:lease4:5" || keys[1] != "stealthvpn:lease6:9" {
+		t.Errorf("leaseKeys() = %v, %v", keys, ok)
+	}
+	// Leases from before the subnet changed are not this pool's to release
+	if _, ok := r.leaseKeys(&IPLease{IPv4: net.ParseIP("10.9.0.5"), IPv6: net.ParseIP("fd00::9")}); ok {
+		t.Error("lease outside the pool has keys")
+	}
+}
+
+func TestNewRedisSessionStoreErrors(t *testing.T) {
+	pool, err := NewIPAddressPool("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRedisSessionStore("http://localhost", pool); err == nil || !strings.Contains(err.Error(), "invalid redis_url") {
+		t.Errorf("bad URL error = %v", err)
+	}
+
+	// Take a free port and leave nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if _, err := NewRedisSessionStore("redis://"+addr, pool); err == nil || !strings.Contains(err.Error(), "failed to reach Redis") {
+		t.Errorf("unreachable Redis error = %v", err)
+	}
+}
+
+func TestSanitizedConfigRedactsRedisPassword(t *testing.T) {
+	s := newTestServer(t)
+	s.currentConfig().RedisURL = "redis://:hunter2@redis.internal:6379/0"
+	config := s.SanitizedConfig().(ServerConfig)
+	if strings.Contains(config.RedisURL, "hunter2") || !strings.Contains(config.RedisURL, "redis.internal:6379") {
+		t.Errorf("redis_url shown as %q", config.RedisURL)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// answerRekey handles a client's RekeyType message. One with a public key
+// starts a rekey, answered with the server's; an empty one confirms the
+// client switched, which decrypting it already took care of.
+func (s *VPNServer) answerRekey(session *ClientSession, msg protocol.Message) {
+	if len(msg.Data) == 0 {
+		slog.Debug("Session rekeyed", "client", session.clientIP)
+		return
+	}
+
+	publicKey, err := session.encryption.AcceptRekey(msg.Data)
+	if err != nil {
+		slog.Warn("Failed to rekey session", "client", session.clientIP, "error", err)
+		return
+	}
+	if err := s.sendControl(session, protocol.Message{Type: protocol.RekeyType, Data: publicKey}); err != nil {
+		slog.Error("Failed to answer rekey", "client", session.clientIP, "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 3 * 365 * 24 * time.Hour
+
+// ensureSelfSignedCert writes a self-signed certificate for the fake domain
+// to the configured cert and key files unless they already exist. An
+// existing pair is never touched, and a lone cert or key is an error rather
+// than something to overwrite.
+func ensureSelfSignedCert(config *ServerConfig) error {
+	certExists, err := fileExists(config.TLSCertFile)
+	if err != nil {
+		return err
+	}
+	keyExists, err := fileExists(config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	if certExists && keyExists {
+		return nil
+	}
+	if certExists || keyExists {
+		return fmt.Errorf("only one of %s and %s exists; remove it or supply both", config.TLSCertFile, config.TLSKeyFile)
+	}
+	if config.FakeDomainName == "" {
+		return errors.New("fake_domain_name is required to generate a certificate")
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert(config.FakeDomainName, config.Host)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate: %v", err)
+	}
+
+	for _, file := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(config.TLSKeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(config.TLSCertFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	slog.Info("Generated self-signed certificate", "domain", config.FakeDomainName, "file", config.TLSCertFile)
+	return nil
+}
+
+// generateSelfSignedCert returns a PEM certificate and key for domain. The
+// certificate also covers the wildcard subdomain and, if host is a specific
+// address, that IP.
+func generateSelfSignedCert(domain, host string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain, "*." + domain},
+		NotBefore:             now.Add(-time.Hour), // tolerate clients with slow clocks
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		template.IPAddresses = []net.IP{ip}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// selfSignedConfig returns a config naming cert and key files, in a
+// directory that does not exist yet
+func selfSignedConfig(t *testing.T, host string) *ServerConfig {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "tls")
+	return &ServerConfig{
+		Host:           host,
+		FakeDomainName: "cdn.example.com",
+		TLSCertFile:    filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:     filepath.Join(dir, "key.pem"),
+	}
+}
+
+// loadCert loads the pair config names and parses its certificate
+func loadCert(t *testing.T, config *ServerConfig) *x509.Certificate {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSelfSignedCertGenerated(t *testing.T) {
+	for _, test := range []struct {
+		host    string
+		wantIPs []string
+	}{
+		{"0.0.0.0", nil},
+		{"203.0.113.9", []string{"203.0.113.9"}},
+		{"2001:db8::9", []string{"2001:db8::9"}},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			config := selfSignedConfig(t, test.host)
+			if err := ensureSelfSignedCert(config); err != nil {
+				t.Fatal(err)
+			}
+			cert := loadCert(t, config)
+
+			if want := []string{"cdn.example.com", "*.cdn.example.com"}; !slices.Equal(cert.DNSNames, want) {
+				t.Errorf("DNS names = %q, want %q", cert.DNSNames, want)
+			}
+			var ips []string
+			for _, ip := range cert.IPAddresses {
+				ips = append(ips, ip.String())
+			}
+			if !slices.Equal(ips, test.wantIPs) {
+				t.Errorf("IP addresses = %q, want %q", ips, test.wantIPs)
+			}
+			for _, name := range []string{"cdn.example.com", "static.cdn.example.com"} {
+				if err := cert.VerifyHostname(name); err != nil {
+					t.Error(err)
+				}
+			}
+
+			now := time.Now()
+			if cert.NotBefore.After(now) || cert.NotAfter.Before(now.Add(selfSignedValidity-time.Hour)) || cert.NotAfter.After(now.Add(selfSignedValidity)) {
+				t.Errorf("valid from %v to %v, want about %v from now", cert.NotBefore, cert.NotAfter, selfSignedValidity)
+			}
+			if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+				t.Errorf("certificate not self-signed: %v", err)
+			}
+
+			if info, err := os.Stat(config.TLSKeyFile); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("key file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func TestSelfSignedCertReusesExistingPair(t *testing.T) {
+	config := selfSignedConfig(t, "0.0.0.0")
+	if err := ensureSelfSignedCert(config); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := os.ReadFile(config.TLSCertFile)
+	keyPEM, _ := os.ReadFile(config.TLSKeyFile)
+
+	// Restarting keeps the certificate clients may have pinned
+	if err := ensureSelfSignedCert(config); err != nil {
+		t.Fatal(err)
+	}
+	newCertPEM, _ := os.ReadFile(config.TLSCertFile)
+	newKeyPEM, _ := os.ReadFile(config.TLSKeyFile)
+	if !bytes.Equal(certPEM, newCertPEM) || !bytes.Equal(keyPEM, newKeyPEM) {
+		t.Error("existing certificate and key replaced")
+	}
+}
+
+func TestSelfSignedCertRefusesLoneFile(t *testing.T) {
+	config := selfSignedConfig(t, "0.0.0.0")
+	if err := ensureSelfSignedCert(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(config.TLSKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := os.ReadFile(config.TLSCertFile)
+
+	if err := ensureSelfSignedCert(config); err == nil {
+		t.Fatal("certificate without its key accepted")
+	}
+	if newCertPEM, _ := os.ReadFile(config.TLSCertFile); !bytes.Equal(certPEM, newCertPEM) {
+		t.Error("lone certificate overwritten")
+	}
+	if _, err := os.Stat(config.TLSKeyFile); err == nil {
+		t.Error("key written for a certificate it does not match")
+	}
+}
+
+func TestSelfSignedCertNeedsDomain(t *testing.T) {
+	config := selfSignedConfig(t, "0.0.0.0")
+	config.FakeDomainName = ""
+	if err := ensureSelfSignedCert(config); err == nil {
+		t.Error("certificate generated without a domain")
+	}
+}
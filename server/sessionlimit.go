@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// sessionLimit returns how many sessions a user may hold at once, 0 for no
+// limit
+func sessionLimit(config *ServerConfig, username string) int {
+	return config.ClientSessionLimits[username]
+}
+
+// acquireSessionSlot counts a new session of a logged-in user, reporting
+// how many the user now holds and whether that is within its limit. Sessions
+// are counted whether or not a limit is set, so a limit added on reload
+// takes the sessions already open into account. A counted session must be
+// given back with releaseSessionSlot when it ends.
+func (s *VPNServer) acquireSessionSlot(session *ClientSession) (active, limit int, ok bool) {
+	if session.username == "" {
+		return 0, 0, true
+	}
+	limit = sessionLimit(s.currentConfig(), session.username)
+
+	s.userSessionsMu.Lock()
+	defer s.userSessionsMu.Unlock()
+	active = s.userSessions[session.username]
+	if limit > 0 && active >= limit {
+		return active, limit, false
+	}
+	s.userSessions[session.username] = active + 1
+	session.countedSession = true
+	return active + 1, limit, true
+}
+
+// releaseSessionSlot gives back a session counted by acquireSessionSlot, so
+// the user can reconnect at once
+func (s *VPNServer) releaseSessionSlot(session *ClientSession) {
+	if !session.countedSession {
+		return
+	}
+	s.userSessionsMu.Lock()
+	defer s.userSessionsMu.Unlock()
+	if s.userSessions[session.username] <= 1 {
+		delete(s.userSessions, session.username)
+	} else {
+		s.userSessions[session.username]--
+	}
+	session.countedSession = false
+}
+
+// refuseOverSessionLimit tells the client its user already holds as many
+// sessions as it may; the caller then drops the session
+func (s *VPNServer) refuseOverSessionLimit(session *ClientSession, active, limit int) {
+	slog.Info("Client reached its session limit", "user", session.username, "sessions", active, "limit", limit)
+	if err := s.sendControl(session, protocol.SessionLimit{
+		Type:   protocol.SessionLimitType,
+		Active: active,
+		Max:    limit,
+		Error:  fmt.Sprintf("session limit reached: %d of %d sessions open", active, limit),
+	}); err != nil {
+		slog.Error("Failed to notify client of its session limit", "client", session.clientIP, "error", err)
+	}
+}
+
+// validateSessionLimits checks client_session_limits
+func validateSessionLimits(config *ServerConfig) error {
+	for user, limit := range config.ClientSessionLimits {
+		if limit <= 0 {
+			return fmt.Errorf("invalid client_session_limits entry for %q: %d", user, limit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// resumableSession holds what is needed to continue a disconnected session
+// until its session token is redeemed or expires
+type resumableSession struct {
+	secret     []byte // resumption secret shared with the client
+	compressor *protocol.Compressor
+	cipher     string
+	batching   bool
+	multipath  bool
+	username   string
+	clientID   string // identity of the client, for revocation
+	tenant     string
+	endsAt     time.Time // when the session must end, zero for no limit
+	expires    time.Time
+}
+
+// sessionTokenTTL returns how long a disconnected session stays resumable
+func (s *VPNServer) sessionTokenTTL() time.Duration {
+	return time.Duration(s.currentConfig().SessionTokenTTL) * time.Second
+}
+
+// issueSessionToken sends the client a fresh single-use session token and
+// the secret to resume with, encrypted with the session key
+func (s *VPNServer) issueSessionToken(session *ClientSession) error {
+	token, err := protocol.NewSessionToken()
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, protocol.ResumeSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	plaintext := append(append([]byte(nil), token...), secret...)
+	encrypted, err := session.encryption.Encrypt(plaintext)
+	protocol.ZeroBytes(plaintext)
+	if err != nil {
+		protocol.ZeroBytes(secret)
+		return err
+	}
+
+	if err := protocol.WriteJSON(session.transport, protocol.Message{
+		Type: protocol.SessionTokenType,
+		Data: encrypted,
+	}); err != nil {
+		protocol.ZeroBytes(secret)
+		return err
+	}
+
+	session.sessionToken = token
+	session.resumeSecret = secret
+	return nil
+}
+
+// sessionTokenFromRequest returns the session token carried in the upgrade
+// request's cookie, if any
+func sessionTokenFromRequest(r *http.Request) []byte {
+	cookie, err := r.Cookie(protocol.SessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// resumeSession redeems a session token presented by a reconnecting client.
+// Tokens are removed when looked up so each one can only be used once.
+func (s *VPNServer) resumeSession(token []byte) *resumableSession {
+	if s.sessionTokenTTL() <= 0 || len(token) != protocol.SessionTokenSize {
+		return nil
+	}
+
+	value, ok := s.resumableSessions.LoadAndDelete(string(token))
+	if !ok {
+		return nil
+	}
+
+	resumable := value.(*resumableSession)
+	if time.Now().After(resumable.expires) {
+		protocol.ZeroBytes(resumable.secret)
+		return nil
+	}
+
+	return resumable
+}
+
+// resumedEncryption derives fresh keys for a resumed session, returning the
+// nonce the client needs to derive the same keys. The resumption secret is
+// wiped; the client gets a new one with its next session token.
+func resumedEncryption(resumable *resumableSession) (*protocol.MultiLayerEncryption, []byte, error) {
+	defer protocol.ZeroBytes(resumable.secret)
+
+	nonce := make([]byte, protocol.ResumeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	encryption, err := protocol.ResumedEncryption(resumable.secret, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := encryption.SetCipher(resumable.cipher); err != nil {
+		return nil, nil, err
+	}
+	return encryption, nonce, nil
+}
+
+// releaseSession wipes the keys of an ended session and parks its
+// resumption secret under its token so the client can resume it
+func (s *VPNServer) releaseSession(session *ClientSession) {
+	if session.keyExchange != nil {
+		session.keyExchange.Zeroize()
+	}
+	session.encryption.Zeroize()
+
+	if session.sessionToken == nil || s.sessionTokenTTL() <= 0 || session.revoked.Load() {
+		protocol.ZeroBytes(session.resumeSecret)
+		return
+	}
+
+	s.resumableSessions.Store(string(session.sessionToken), &resumableSession{
+		secret:     session.resumeSecret,
+		compressor: session.compressor,
+		cipher:     session.encryption.Cipher(),
+		batching:   session.batching,
+		multipath:  session.multipath,
+		username:   session.username,
+		clientID:   clientIdentity(session),
+		tenant:     session.tenant,
+		endsAt:     session.endsAt,
+		expires:    time.Now().Add(s.sessionTokenTTL()),
+	})
+}
+
+// purgeExpiredSessionTokens drops resumable sessions whose token has expired
+func (s *VPNServer) purgeExpiredSessionTokens(now time.Time) {
+	s.resumableSessions.Range(func(key, value interface{}) bool {
+		if !now.After(value.(*resumableSession).expires) {
+			return true
+		}
+		// Only wipe the state if a concurrent resume did not claim it first
+		if _, loaded := s.resumableSessions.LoadAndDelete(key); loaded {
+			protocol.ZeroBytes(value.(*resumableSession).secret)
+		}
+		return true
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// issueTestToken issues a session token to session and returns the token
+// and resumption secret the client decrypts from it
+func issueTestToken(t *testing.T, s *VPNServer, session *ClientSession, transport *pipeTransport) (token, secret []byte) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.issueSessionToken(session) }()
+
+	var msg protocol.Message
+	if err := json.Unmarshal(<-transport.written, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := session.encryption.Decrypt(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) != protocol.SessionTokenSize+protocol.ResumeSecretSize {
+		t.Fatalf("session token message carries %d bytes", len(plaintext))
+	}
+	return plaintext[:protocol.SessionTokenSize], plaintext[protocol.SessionTokenSize:]
+}
+
+func TestResumedSessionGetsFreshKeys(t *testing.T) {
+	s := newTestServer(t)
+	s.currentConfig().SessionTokenTTL = 60
+	transport := newPipeTransport()
+	defer transport.Close()
+	session := newTestSession(t, transport)
+	if err := session.encryption.SetCipher(protocol.CipherChaCha20); err != nil {
+		t.Fatal(err)
+	}
+	token, secret := issueTestToken(t, s, session, transport)
+	oldCiphertext, err := session.encryption.Encrypt([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.releaseSession(session)
+
+	resumable := s.resumeSession(token)
+	if resumable == nil {
+		t.Fatal("issued token not redeemed")
+	}
+	if s.resumeSession(token) != nil {
+		t.Error("token redeemed twice")
+	}
+
+	encryption, nonce, err := resumedEncryption(resumable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resumable.secret, make([]byte, protocol.ResumeSecretSize)) {
+		t.Error("resumption secret left in memory")
+	}
+	if got := encryption.Cipher(); got != protocol.CipherChaCha20 {
+		t.Errorf("resumed session encrypts with %s, want the negotiated cipher kept", got)
+	}
+	client, err := protocol.ResumedEncryption(secret, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetCipher(protocol.CipherChaCha20); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := client.Encrypt([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := encryption.Decrypt(ciphertext); err != nil || string(plaintext) != "new" {
+		t.Fatalf("server decrypted %q, %v", plaintext, err)
+	}
+	if _, err := encryption.Decrypt(oldCiphertext); err == nil {
+		t.Error("resumed session decrypted a packet under the previous keys")
+	}
+}
+
+func TestResumeSessionRejects(t *testing.T) {
+	s := newTestServer(t)
+	s.currentConfig().SessionTokenTTL = 60
+	transport := newPipeTransport()
+	defer transport.Close()
+	session := newTestSession(t, transport)
+	token, _ := issueTestToken(t, s, session, transport)
+	s.releaseSession(session)
+
+	if s.resumeSession([]byte("short")) != nil {
+		t.Error("malformed token redeemed")
+	}
+	if s.resumeSession(bytes.Repeat([]byte{9}, protocol.SessionTokenSize)) != nil {
+		t.Error("unknown token redeemed")
+	}
+
+	value, _ := s.resumableSessions.Load(string(token))
+	value.(*resumableSession).expires = time.Now().Add(-time.Second)
+	if s.resumeSession(token) != nil {
+		t.Error("expired token redeemed")
+	}
+}
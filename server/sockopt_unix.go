@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// clearV6Only lets an IPv6 socket accept IPv4 clients too
+func clearV6Only(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
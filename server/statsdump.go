@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"stealthvpn/server/mgmt"
+)
+
+// dumpStats logs a snapshot of every active session and the totals across
+// them, for operators debugging a server without the management API. Only
+// the fields named here are logged, so no key material can slip in.
+func (s *VPNServer) dumpStats(logger *slog.Logger) {
+	sessions := s.Sessions()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	now := time.Now()
+	var bytesIn, bytesOut uint64
+	for _, session := range sessions {
+		bytesIn += session.BytesIn
+		bytesOut += session.BytesOut
+		logger.Info("Session stats",
+			"session", session.ID,
+			"client", session.ClientIP,
+			"tunnel_ipv4", session.TunnelIPv4,
+			"tunnel_ipv6", session.TunnelIPv6,
+			"cipher", session.Cipher,
+			"bytes_in", session.BytesIn,
+			"bytes_out", session.BytesOut,
+			"send_queue_dropped", session.SendQueueDropped,
+			"idle", now.Sub(session.LastActivity).Round(time.Second),
+			"rtt", sessionRTT(session))
+	}
+	logger.Info("Server stats",
+		"sessions", len(sessions),
+		"bytes_in", bytesIn,
+		"bytes_out", bytesOut)
+}
+
+// sessionRTT returns the lowest round-trip time measured on the session's
+// connections, 0 if none has been measured
+func sessionRTT(session mgmt.Session) time.Duration {
+	var best float64
+	for _, link := range session.Links {
+		if link.RTTMs > 0 && (best == 0 || link.RTTMs < best) {
+			best = link.RTTMs
+		}
+	}
+	return time.Duration(best * float64(time.Millisecond)).Round(time.Microsecond)
+}
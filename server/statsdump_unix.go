@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpStatsOnSignal logs a stats snapshot to logger whenever the server
+// gets SIGUSR1, until stop is called
+func (s *VPNServer) dumpStatsOnSignal(logger *slog.Logger) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			s.dumpStats(logger)
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the signal goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStatsDumpedOnSIGUSR1(t *testing.T) {
+	s := newTestServer(t)
+	session := newTestSession(t, newPipeTransport())
+	session.sendQueue = protocol.NewSendQueue(4, protocol.QueueDropNewest)
+	session.lease = &IPLease{IPv4: net.IPv4(10, 8, 0, 7), IPv6: net.ParseIP("fd00:8::7")}
+	session.bytesIn, session.bytesOut = 1500, 3000
+	session.markActive(time.Now())
+	s.clientsMu.Lock()
+	s.clients[session.id] = session
+	s.clientsMu.Unlock()
+
+	var out syncBuffer
+	stop := s.dumpStatsOnSignal(slog.New(slog.NewJSONHandler(&out, nil)))
+	defer stop()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !bytes.Contains([]byte(out.String()), []byte("Server stats")); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no stats logged after SIGUSR1")
+		}
+	}
+
+	var records []map[string]any
+	decoder := json.NewDecoder(bytes.NewReader([]byte(out.String())))
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records logged, want the session's and the totals", len(records))
+	}
+	// Only the listed fields are logged
+	sessionRecord, totals := records[0], records[1]
+	var fields []string
+	for field := range sessionRecord {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	if want := []string{"bytes_in", "bytes_out", "cipher", "client", "idle", "level", "msg", "rtt", "send_queue_dropped", "session", "time", "tunnel_ipv4", "tunnel_ipv6"}; !slices.Equal(fields, want) {
+		t.Errorf("session logged with fields %q, want %q", fields, want)
+	}
+	for field, want := range map[string]any{
+		"msg":         "Session stats",
+		"session":     session.id,
+		"client":      "192.0.2.1",
+		"tunnel_ipv4": "10.8.0.7",
+		"tunnel_ipv6": "fd00:8::7",
+		"bytes_in":    1500.0,
+		"bytes_out":   3000.0,
+	} {
+		if sessionRecord[field] != want {
+			t.Errorf("session %s = %v, want %v", field, sessionRecord[field], want)
+		}
+	}
+	if totals["sessions"] != 1.0 || totals["bytes_in"] != 1500.0 || totals["bytes_out"] != 3000.0 {
+		t.Errorf("totals = %v", totals)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "log/slog"
+
+// dumpStatsOnSignal does nothing, as Windows has no SIGUSR1
+func (s *VPNServer) dumpStatsOnSignal(logger *slog.Logger) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// StatsStore keeps each client's cumulative traffic across server restarts
+type StatsStore interface {
+	// Save replaces the stored totals for clientID
+	Save(clientID string, stats protocol.SessionStats) error
+	// Load returns the stored totals for clientID, zero if none were saved
+	Load(clientID string) (protocol.SessionStats, error)
+	// Add adds delta to the stored totals for clientID and returns the new
+	// totals
+	Add(clientID string, delta protocol.SessionStats) (protocol.SessionStats, error)
+}
+
+// LeaseStore remembers the tunnel addresses each client was last given, so
+// clients keep them across server restarts
+type LeaseStore interface {
+	// SaveLease records the lease given to clientID
+	SaveLease(clientID string, lease *IPLease) error
+	// LoadLeases returns every recorded lease by client ID
+	LoadLeases() (map[string]*IPLease, error)
+}
+
+// leasesFile holds all leases in a FileStatsStore's directory. Client stats
+// files never have this name: "leases" is not valid unpadded base64.
+const leasesFile = "leases.json"
+
+// FileStatsStore stores one JSON file per client in a directory, and the
+// clients' leases in one more
+type FileStatsStore struct {
+	dir     string
+	leaseMu sync.Mutex
+}
+
+// NewFileStatsStore creates a store in dir, creating the directory if needed
+func NewFileStatsStore(dir string) (*FileStatsStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create stats directory: %v", err)
+	}
+	return &FileStatsStore{dir: dir}, nil
+}
+
+// path returns the file holding clientID's stats. Client IDs are encoded so
+// IPv6 colons and other separators never reach the filesystem.
+func (f *FileStatsStore) path(clientID string) string {
+	return filepath.Join(f.dir, base64.RawURLEncoding.EncodeToString([]byte(clientID))+".json")
+}
+
+// Save writes the stats for clientID
+func (f *FileStatsStore) Save(clientID string, stats protocol.SessionStats) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return f.writeFile(f.path(clientID), data)
+}
+
+// writeFile writes data to a temporary file and renames it into place, so a
+// crash never leaves a truncated file behind
+func (f *FileStatsStore) writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(f.dir, ".stats-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the stats saved for clientID
+func (f *FileStatsStore) Load(clientID string) (protocol.SessionStats, error) {
+	var stats protocol.SessionStats
+	data, err := os.ReadFile(f.path(clientID))
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("corrupt stats for %s: %v", clientID, err)
+	}
+	return stats, nil
+}
+
+// Add reads, updates and rewrites the client's stats file. Callers must not
+// add to the same client concurrently.
+func (f *FileStatsStore) Add(clientID string, delta protocol.SessionStats) (protocol.SessionStats, error) {
+	stats, err := f.Load(clientID)
+	if err != nil {
+		return stats, err
+	}
+	stats.BytesIn += delta.BytesIn
+	stats.BytesOut += delta.BytesOut
+	return stats, f.Save(clientID, stats)
+}
+
+// SaveLease records a client's lease, rewriting the leases file only when
+// the client got different addresses than last time
+func (f *FileStatsStore) SaveLease(clientID string, lease *IPLease) error {
+	f.leaseMu.Lock()
+	defer f.leaseMu.Unlock()
+
+	leases, err := f.LoadLeases()
+	if err != nil {
+		return err
+	}
+	if previous, ok := leases[clientID]; ok && previous.IPv4.Equal(lease.IPv4) && previous.IPv6.Equal(lease.IPv6) {
+		return nil
+	}
+	leases[clientID] = lease
+
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	return f.writeFile(filepath.Join(f.dir, leasesFile), data)
+}
+
+// LoadLeases reads the recorded leases
+func (f *FileStatsStore) LoadLeases() (map[string]*IPLease, error) {
+	leases := make(map[string]*IPLease)
+	data, err := os.ReadFile(filepath.Join(f.dir, leasesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return leases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("corrupt leases file: %v", err)
+	}
+	return leases, nil
+}
+
+// clientIdentity names the client a session's stats are recorded under:
+// the user when they logged in, otherwise the client's address as the most
+// stable identity available across reconnects.
+func clientIdentity(session *ClientSession) string {
+	if session.username != "" {
+		return "user:" + session.username
+	}
+	return session.clientIP.String()
+}
+
+// loadHistoricalStats fetches what the session's client transferred before
+func (s *VPNServer) loadHistoricalStats(session *ClientSession) {
+	if s.statsStore == nil {
+		return
+	}
+
+	stats, err := s.statsStore.Load(clientIdentity(session))
+	if err != nil {
+		slog.Error("Failed to load stats", "client", session.clientIP, "error", err)
+		return
+	}
+	s.statsMu.Lock()
+	session.history = stats
+	s.statsMu.Unlock()
+}
+
+// persistStats adds the traffic a session carried since it was last saved to
+// its client's stored totals. Clients may hold several sessions at once, on
+// this server or another sharing the store, so the store adds to its totals
+// rather than having them overwritten from memory.
+func (s *VPNServer) persistStats(session *ClientSession) {
+	if s.statsStore == nil {
+		return
+	}
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	bytesIn := atomic.LoadUint64(&session.bytesIn)
+	bytesOut := atomic.LoadUint64(&session.bytesOut)
+	if bytesIn == session.savedIn && bytesOut == session.savedOut {
+		return
+	}
+
+	stats, err := s.statsStore.Add(clientIdentity(session), protocol.SessionStats{
+		BytesIn:  bytesIn - session.savedIn,
+		BytesOut: bytesOut - session.savedOut,
+	})
+	if err != nil {
+		slog.Error("Failed to save stats", "client", session.clientIP, "error", err)
+		return
+	}
+	session.savedIn = bytesIn
+	session.savedOut = bytesOut
+	session.history = stats
+	s.updateQuotaEnd(session)
+}
+
+// persistAllStats saves the stats of every active session
+func (s *VPNServer) persistAllStats() {
+	s.clientsMu.RLock()
+	sessions := make([]*ClientSession, 0, len(s.clients))
+	for _, session := range s.clients {
+		sessions = append(sessions, session)
+	}
+	s.clientsMu.RUnlock()
+
+	for _, session := range sessions {
+		s.persistStats(session)
+	}
+}
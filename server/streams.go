@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+const (
+	// streamReadSize is how much egress data is carried per stream message
+	streamReadSize = 16 * 1024
+	// streamDialTimeout bounds how long opening an egress connection may take
+	streamDialTimeout = 15 * time.Second
+	// streamWriteTimeout bounds how long a slow egress peer may stall the session
+	streamWriteTimeout = 30 * time.Second
+)
+
+// errForbiddenTarget is returned for egress to the server's own addresses
+var errForbiddenTarget = errors.New("target address not allowed")
+
+// egressStream is a TCP connection or UDP association opened on behalf of a
+// client running in SOCKS5 mode
+type egressStream struct {
+	conn net.Conn     // TCP streams
+	udp  *net.UDPConn // UDP associations
+}
+
+// close releases the stream's socket
+func (e *egressStream) close() {
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	if e.udp != nil {
+		e.udp.Close()
+	}
+}
+
+// sessionStreams tracks the egress streams of one client session
+type sessionStreams struct {
+	mu      sync.Mutex
+	streams map[uint32]*egressStream
+	closed  bool
+}
+
+// add registers a stream, failing if the ID is taken or the session has ended
+func (t *sessionStreams) add(id uint32, stream *egressStream) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.streams[id] != nil {
+		return false
+	}
+	if t.streams == nil {
+		t.streams = make(map[uint32]*egressStream)
+	}
+	t.streams[id] = stream
+	return true
+}
+
+// get returns the stream with the given ID, or nil
+func (t *sessionStreams) get(id uint32) *egressStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[id]
+}
+
+// remove unregisters and closes a stream, reporting whether it was open
+func (t *sessionStreams) remove(id uint32, stream *egressStream) bool {
+	t.mu.Lock()
+	current := t.streams[id]
+	if current != nil && (stream == nil || current == stream) {
+		delete(t.streams, id)
+	} else {
+		current = nil
+	}
+	t.mu.Unlock()
+
+	if current == nil {
+		return false
+	}
+	current.close()
+	return true
+}
+
+// closeAll closes every stream and refuses new ones
+func (t *sessionStreams) closeAll() {
+	t.mu.Lock()
+	streams := t.streams
+	t.streams = nil
+	t.closed = true
+	t.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.close()
+	}
+}
+
+// handleControlMessage dispatches a JSON message received inside the tunnel
+func (s *VPNServer) handleControlMessage(session *ClientSession, payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("Invalid control message", "client", session.clientIP, "error", err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.StreamOpenType:
+		// Dialing may block, so keep it off the session's read loop
+		go s.openStream(session, msg)
+	case protocol.StreamDataType:
+		s.writeStream(session, msg)
+	case protocol.StreamCloseType:
+		session.streams.remove(msg.StreamID, nil)
+	case protocol.HealthCheckType:
+		s.answerHealthCheck(session, payload)
+	case protocol.RekeyType:
+		s.answerRekey(session, msg)
+	case protocol.PeerCandidatesType:
+		s.relayPeerCandidates(session, payload)
+	case protocol.PeerRelayType:
+		s.relayPeerFrame(session, payload)
+	default:
+		slog.Warn("Unexpected control message", "client", session.clientIP, "type", msg.Type)
+	}
+}
+
+// openStream opens an egress stream for the client and relays its replies
+func (s *VPNServer) openStream(session *ClientSession, msg protocol.Message) {
+	reply := protocol.Message{Type: protocol.StreamOpenedType, StreamID: msg.StreamID}
+
+	stream, err := dialEgress(msg.Network, msg.Target)
+	if err != nil {
+		reply.Error = err.Error()
+		if err := s.sendControl(session, reply); err != nil {
+			slog.Error("Failed to reject stream", "client", session.clientIP, "error", err)
+		}
+		return
+	}
+
+	if !session.streams.add(msg.StreamID, stream) {
+		stream.close()
+		return
+	}
+
+	if err := s.sendControl(session, reply); err != nil {
+		slog.Error("Failed to confirm stream", "client", session.clientIP, "error", err)
+		session.streams.remove(msg.StreamID, stream)
+		return
+	}
+
+	s.relayStream(session, msg.StreamID, stream)
+}
+
+// dialEgress opens a TCP connection to target, or a UDP socket for an association
+func dialEgress(network, target string) (*egressStream, error) {
+	switch network {
+	case "tcp":
+		dialer := net.Dialer{
+			Timeout: streamDialTimeout,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !egressAllowed(net.ParseIP(host)) {
+					return errForbiddenTarget
+				}
+				return nil
+			},
+		}
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		return &egressStream{conn: conn}, nil
+	case "udp":
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		return &egressStream{udp: conn}, nil
+	default:
+		return nil, fmt.Errorf("unsupported network: %q", network)
+	}
+}
+
+// egressAllowed keeps clients from reaching services bound to the server itself
+func egressAllowed(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsUnspecified()
+}
+
+// writeStream forwards client data to an egress stream
+func (s *VPNServer) writeStream(session *ClientSession, msg protocol.Message) {
+	stream := session.streams.get(msg.StreamID)
+	if stream == nil {
+		return
+	}
+
+	var err error
+	if stream.udp != nil {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp", msg.Target)
+		if err == nil && !egressAllowed(addr.IP) {
+			err = errForbiddenTarget
+		}
+		if err == nil {
+			_, err = stream.udp.WriteToUDP(msg.Data, addr)
+		}
+		if err != nil {
+			// A bad datagram does not end the association
+			slog.Warn("Failed to relay datagram", "target", msg.Target, "error", err)
+		}
+		return
+	}
+
+	stream.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err = stream.conn.Write(msg.Data); err != nil {
+		s.closeStream(session, msg.StreamID, stream)
+	}
+}
+
+// relayStream sends everything received on an egress stream back to the client
+func (s *VPNServer) relayStream(session *ClientSession, id uint32, stream *egressStream) {
+	buffer := make([]byte, streamReadSize)
+
+	for {
+		reply := protocol.Message{Type: protocol.StreamDataType, StreamID: id}
+		if stream.udp != nil {
+			n, addr, err := stream.udp.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			reply.Data = buffer[:n]
+			reply.Target = addr.String()
+		} else {
+			n, err := stream.conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			reply.Data = buffer[:n]
+		}
+
+		if err := s.sendControl(session, reply); err != nil {
+			break
+		}
+	}
+
+	s.closeStream(session, id, stream)
+}
+
+// closeStream closes an egress stream and tells the client, unless the client closed it first
+func (s *VPNServer) closeStream(session *ClientSession, id uint32, stream *egressStream) {
+	if !session.streams.remove(id, stream) {
+		return
+	}
+	s.sendControl(session, protocol.Message{Type: protocol.StreamCloseType, StreamID: id})
+}
+
+// sendControl sends a JSON message to the client through the tunnel
+func (s *VPNServer) sendControl(session *ClientSession, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.sendToClient(session, payload)
+}
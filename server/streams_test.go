@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"stealthvpn/pkg/protocol"
+)
+
+func TestDialEgressRefusesServerAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, err := dialEgress("tcp", listener.Addr().String()); !errors.Is(err, errForbiddenTarget) {
+		t.Errorf("dial to loopback error = %v, want %v", err, errForbiddenTarget)
+	}
+	if _, err := dialEgress("sctp", "192.0.2.1:80"); err == nil {
+		t.Error("unsupported network dialed")
+	}
+	stream, err := dialEgress("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.close()
+}
+
+func TestOpenStreamReportsFailure(t *testing.T) {
+	s := newTestServer(t)
+	transport := newPipeTransport()
+	defer transport.Close()
+	session := newTestSession(t, transport)
+
+	go s.openStream(session, protocol.Message{Type: protocol.StreamOpenType, StreamID: 7, Network: "tcp", Target: "127.0.0.1:1"})
+	var reply protocol.Message
+	if err := json.Unmarshal(clientReceive(t, s, session, transport), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != protocol.StreamOpenedType || reply.StreamID != 7 || reply.Error == "" {
+		t.Errorf("reply = %+v, want stream 7 refused", reply)
+	}
+	if session.streams.get(7) != nil {
+		t.Error("refused stream was registered")
+	}
+}
+
+func TestSessionStreams(t *testing.T) {
+	var streams sessionStreams
+	first, second := &egressStream{}, &egressStream{}
+	if !streams.add(1, first) || streams.add(1, second) {
+		t.Fatal("stream ID taken twice")
+	}
+	if streams.remove(1, second) {
+		t.Error("removed another stream under the same ID")
+	}
+	if !streams.remove(1, nil) || streams.get(1) != nil {
+		t.Error("stream not removed")
+	}
+
+	streams.add(2, first)
+	streams.closeAll()
+	if streams.get(2) != nil || streams.add(3, second) {
+		t.Error("streams kept or added after closeAll")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/server/mgmt"
+)
+
+// TenantConfig is a team with its own virtual network. Clients holding the
+// tenant's pre-shared key get addresses from its subnets and cannot reach
+// other tenants' networks.
+type TenantConfig struct {
+	Name         string   `json:"name"`
+	PreSharedKey string   `json:"pre_shared_key"`
+	IPSubnet     string   `json:"ip_subnet"`
+	IPSubnet6    string   `json:"ip_subnet6"` // defaults to fd00:0:0:N::/64 for the Nth tenant
+	DNSServers   []string `json:"dns_servers"`
+	AllowedIPs   []string `json:"allowed_ips"` // routes pushed to the tenant's clients
+}
+
+// tenant is a configured tenant and its address pool
+type tenant struct {
+	config   TenantConfig
+	pool     *IPAddressPool
+	bytesIn  uint64 // traffic of ended sessions; accessed atomically
+	bytesOut uint64
+}
+
+// newTenants creates the tenants' pools and checks that no two virtual
+// networks, the default one included, overlap
+func newTenants(config *ServerConfig, defaultPool *IPAddressPool) (map[string]*tenant, error) {
+	if len(config.Tenants) == 0 {
+		return nil, nil
+	}
+	if config.RedisURL != "" {
+		return nil, errors.New("tenants cannot be combined with redis_url")
+	}
+
+	tenants := make(map[string]*tenant, len(config.Tenants))
+	pools := []*IPAddressPool{defaultPool}
+	for i, tenantConfig := range config.Tenants {
+		if tenantConfig.Name == "" {
+			return nil, fmt.Errorf("tenant %d has no name", i+1)
+		}
+		if _, exists := tenants[tenantConfig.Name]; exists {
+			return nil, fmt.Errorf("tenant %q is configured twice", tenantConfig.Name)
+		}
+		if len(tenantConfig.PreSharedKey) < protocol.MinPreSharedKeyLength {
+			return nil, fmt.Errorf("pre-shared key of tenant %q is too short: need at least %d bytes", tenantConfig.Name, protocol.MinPreSharedKeyLength)
+		}
+		if tenantConfig.IPSubnet == "" {
+			return nil, fmt.Errorf("tenant %q has no ip_subnet", tenantConfig.Name)
+		}
+
+		subnet6 := tenantConfig.IPSubnet6
+		if subnet6 == "" {
+			subnet6 = fmt.Sprintf("fd00:0:0:%x::/64", i+1)
+		}
+		pool, err := NewIPAddressPool(tenantConfig.IPSubnet, subnet6)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", tenantConfig.Name, err)
+		}
+		for _, other := range pools {
+			if pool.overlaps(other) {
+				return nil, fmt.Errorf("subnets of tenant %q overlap another network", tenantConfig.Name)
+			}
+		}
+		pools = append(pools, pool)
+		tenants[tenantConfig.Name] = &tenant{config: tenantConfig, pool: pool}
+	}
+	return tenants, nil
+}
+
+// overlaps reports whether either subnet of p overlaps the same family's
+// subnet of other
+func (p *IPAddressPool) overlaps(other *IPAddressPool) bool {
+	return subnetsOverlap(p.subnet4, other.subnet4) || subnetsOverlap(p.subnet6, other.subnet6)
+}
+
+// subnetsOverlap reports whether two subnets share any address
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Contains reports whether ip is in either of the pool's subnets
+func (p *IPAddressPool) Contains(ip net.IP) bool {
+	return p.subnet4.Contains(ip) || p.subnet6.Contains(ip)
+}
+
+// sessionTenant returns the tenant a session belongs to, nil for the
+// default network
+func (s *VPNServer) sessionTenant(session *ClientSession) *tenant {
+	if session.tenant == "" {
+		return nil
+	}
+	return s.tenants[session.tenant]
+}
+
+// allocatorFor returns the pool a session's addresses come from
+func (s *VPNServer) allocatorFor(session *ClientSession) LeaseAllocator {
+	if t := s.sessionTenant(session); t != nil {
+		return t.pool
+	}
+	return s.ipPool
+}
+
+// sessionDNSServers returns the resolvers pushed to a session's client
+func (s *VPNServer) sessionDNSServers(session *ClientSession) []string {
+	if t := s.sessionTenant(session); t != nil && len(t.config.DNSServers) > 0 {
+		return t.config.DNSServers
+	}
+	return s.tunnelDNSServers()
+}
+
+// tunnelConfig returns the addresses, resolvers and routes pushed to a
+// session's client
+func (s *VPNServer) tunnelConfig(session *ClientSession) protocol.TunnelConfig {
+	return protocol.TunnelConfig{
+		Type:   protocol.TunnelConfigType,
+		IPv4:   session.lease.IPv4.String(),
+		IPv6:   session.lease.IPv6.String(),
+		DNS:    s.sessionDNSServers(session),
+		Routes: s.sessionRoutes(session),
+	}
+}
+
+// sessionRoutes returns the routes pushed to a session's client
+func (s *VPNServer) sessionRoutes(session *ClientSession) []string {
+	if t := s.sessionTenant(session); t != nil {
+		return t.config.AllowedIPs
+	}
+	return s.currentConfig().AllowedIPs
+}
+
+// crossesTenants reports whether a packet from a session is addressed to
+// the virtual network of another tenant, or of the default network if the
+// session belongs to a tenant. Such packets must be dropped.
+func (s *VPNServer) crossesTenants(session *ClientSession, packet []byte) bool {
+	if len(s.tenants) == 0 {
+		return false
+	}
+	dst := packetDestination(packet)
+	if dst == nil {
+		return false
+	}
+
+	own := s.sessionTenant(session)
+	for _, t := range s.tenants {
+		if t != own && t.pool.Contains(dst) {
+			return true
+		}
+	}
+	if own != nil && s.ipPool.Contains(dst) {
+		return true
+	}
+	return false
+}
+
+// packetDestination returns the destination address of an IPv4 or IPv6
+// packet, or nil if it is neither
+func packetDestination(packet []byte) net.IP {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return net.IP(packet[16:20])
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return net.IP(packet[24:40])
+		}
+	}
+	return nil
+}
+
+// endTenantSession adds an ended session's traffic to its tenant's totals
+func (s *VPNServer) endTenantSession(session *ClientSession) {
+	if t := s.sessionTenant(session); t != nil {
+		atomic.AddUint64(&t.bytesIn, atomic.LoadUint64(&session.bytesIn))
+		atomic.AddUint64(&t.bytesOut, atomic.LoadUint64(&session.bytesOut))
+	}
+}
+
+// Tenants returns the traffic of each tenant since the server started
+func (s *VPNServer) Tenants() []mgmt.Tenant {
+	stats := make(map[string]*mgmt.Tenant, len(s.tenants))
+	tenants := make([]mgmt.Tenant, 0, len(s.tenants))
+	for name, t := range s.tenants {
+		stats[name] = &mgmt.Tenant{
+			Name:     name,
+			IPSubnet: t.pool.subnet4.String(),
+			BytesIn:  atomic.LoadUint64(&t.bytesIn),
+			BytesOut: atomic.LoadUint64(&t.bytesOut),
+		}
+	}
+
+	s.clientsMu.RLock()
+	for _, session := range s.clients {
+		if tenantStats, ok := stats[session.tenant]; ok {
+			tenantStats.ActiveSessions++
+			tenantStats.BytesIn += atomic.LoadUint64(&session.bytesIn)
+			tenantStats.BytesOut += atomic.LoadUint64(&session.bytesOut)
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	for _, tenantStats := range stats {
+		tenants = append(tenants, *tenantStats)
+	}
+	return tenants
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// TunnelInterface is the server's TUN device. Packets from clients are
+// written to it for the host to route, and packets the host routes to a
+// client's tunnel address are read from it and sent to that client.
+type TunnelInterface struct {
+	io.ReadWriteCloser
+	name string
+}
+
+// tunnelNetworks returns the server's address in the default network and
+// in each tenant's, which the tunnel interface is given
+func tunnelNetworks(ipPool *IPAddressPool, tenants map[string]*tenant) []*net.IPNet {
+	pools := []*IPAddressPool{ipPool}
+	for _, t := range tenants {
+		pools = append(pools, t.pool)
+	}
+
+	var networks []*net.IPNet
+	for _, pool := range pools {
+		networks = append(networks,
+			&net.IPNet{IP: pool.ServerIPv4(), Mask: pool.subnet4.Mask},
+			&net.IPNet{IP: pool.ServerIPv6(), Mask: pool.subnet6.Mask})
+	}
+	return networks
+}
+
+// tunnelAddr returns the lookup key for a tunnel address
+func tunnelAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+// routeToSession sends packets for the session's tunnel addresses to it
+func (s *VPNServer) routeToSession(session *ClientSession) {
+	for _, ip := range []net.IP{session.lease.IPv4, session.lease.IPv6} {
+		if addr, ok := tunnelAddr(ip); ok {
+			s.tunnelRoutes.Store(addr, session)
+		}
+	}
+}
+
+// unrouteSession stops sending packets to the session's tunnel addresses,
+// unless they already belong to another session
+func (s *VPNServer) unrouteSession(session *ClientSession) {
+	for _, ip := range []net.IP{session.lease.IPv4, session.lease.IPv6} {
+		if addr, ok := tunnelAddr(ip); ok {
+			s.tunnelRoutes.CompareAndDelete(addr, session)
+		}
+	}
+}
+
+// sessionFor returns the session holding a tunnel address, or nil
+func (s *VPNServer) sessionFor(ip net.IP) *ClientSession {
+	addr, ok := tunnelAddr(ip)
+	if !ok {
+		return nil
+	}
+	session, ok := s.tunnelRoutes.Load(addr)
+	if !ok {
+		return nil
+	}
+	return session.(*ClientSession)
+}
+
+// toOtherClient reports whether a packet from session is addressed to the
+// tunnel address of another client
+func (s *VPNServer) toOtherClient(session *ClientSession, packet []byte) bool {
+	dst := packetDestination(packet)
+	if dst == nil {
+		return false
+	}
+	peer := s.sessionFor(dst)
+	return peer != nil && peer != session
+}
+
+// forwardFromTunnel sends each packet the host routes into the tunnel
+// interface to the client holding its destination address, until the
+// interface is closed
+func (s *VPNServer) forwardFromTunnel() {
+	for {
+		buf := protocol.GetPacketBuffer()
+		n, err := s.tunInterface.Read(*buf)
+		if err != nil {
+			protocol.PutPacketBuffer(buf)
+			slog.Error("Error reading from tunnel", "interface", s.tunInterface.name, "error", err)
+			return
+		}
+
+		session := s.sessionFor(packetDestination((*buf)[:n]))
+		if session == nil {
+			protocol.PutPacketBuffer(buf)
+			continue
+		}
+		*buf = (*buf)[:n]
+		s.clampMSS(*buf)
+		s.queueToClient(session, buf)
+	}
+}
+
+// queueToClient queues a packet, in a buffer from GetPacketBuffer, to be
+// sent to the client without waiting, counting any the queue drops
+func (s *VPNServer) queueToClient(session *ClientSession, buf *[]byte) {
+	if dropped := session.sendQueue.Push(buf); dropped > 0 {
+		s.metrics.sendQueueDrops.Add(float64(dropped))
+	}
+}
+
+// sendQueueDepths returns how many packets wait in all clients' send queues
+// together and in the fullest one
+func (s *VPNServer) sendQueueDepths() (total, deepest int) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	for _, session := range s.clients {
+		depth := session.sendQueue.Len()
+		total += depth
+		deepest = max(deepest, depth)
+	}
+	return total, deepest
+}
+
+// startSending sends the packets queued for a client on a goroutine of its
+// own. The returned function stops it and waits for it to finish, which
+// must happen before the session's keys are wiped; it closes the transport
+// to end a write to a client that stopped reading.
+func (s *VPNServer) startSending(session *ClientSession) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.sendQueued(session)
+	}()
+	return func() {
+		session.sendQueue.Close()
+		session.transport.Close()
+		<-done
+	}
+}
+
+// sendQueued sends the packets queued for a client until its session ends
+func (s *VPNServer) sendQueued(session *ClientSession) {
+	for {
+		buf, ok := session.sendQueue.Pop()
+		if !ok {
+			return
+		}
+		if err := s.sendToClient(session, *buf); err != nil {
+			slog.Warn("Failed to send packet", "client", session.clientIP, "error", err)
+		}
+		protocol.PutPacketBuffer(buf)
+	}
+}
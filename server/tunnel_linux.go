@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+)
+
+// openTunnel creates the TUN device called name, gives it the server's
+// address in each of networks and brings it up
+func openTunnel(name string, networks []*net.IPNet) (*TunnelInterface, error) {
+	iface, err := water.New(water.Config{
+		DeviceType:             water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{Name: name},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", name, err)
+	}
+
+	link, err := netlink.LinkByName(iface.Name())
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+	for _, network := range networks {
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: network}); err != nil {
+			iface.Close()
+			return nil, fmt.Errorf("failed to add %s to %s: %v", network, name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		iface.Close()
+		return nil, fmt.Errorf("failed to bring up %s: %v", name, err)
+	}
+
+	return &TunnelInterface{ReadWriteCloser: iface, name: iface.Name()}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// openTunnel fails outside Linux
+func openTunnel(name string, networks []*net.IPNet) (*TunnelInterface, error) {
+	return nil, errors.New("tunnel_interface is only supported on Linux")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// packetTo returns a minimal IP packet addressed to dst
+func packetTo(dst net.IP) []byte {
+	if ip4 := dst.To4(); ip4 != nil {
+		packet := make([]byte, 20)
+		packet[0] = 0x45
+		copy(packet[16:], ip4)
+		return packet
+	}
+	packet := make([]byte, 40)
+	packet[0] = 0x60
+	copy(packet[24:], dst.To16())
+	return packet
+}
+
+func TestClientIsolation(t *testing.T) {
+	s := newTestServer(t)
+	leaseFor(t, s, net.IPv4(192, 0, 2, 1))
+	peer := leaseFor(t, s, net.IPv4(192, 0, 2, 2))
+	session := s.clients["192.0.2.1:40000"]
+
+	// processVPNPacket queues a reply for each packet it accepts while
+	// there is no tunnel interface
+	forwarded := func(dst net.IP) bool {
+		before := session.sendQueue.Len()
+		s.processVPNPacket(session, packetTo(dst))
+		return session.sendQueue.Len() > before
+	}
+
+	if !forwarded(peer.IPv4) {
+		t.Error("packet to another client dropped without client_isolation")
+	}
+	s.currentConfig().ClientIsolation = true
+	if forwarded(peer.IPv4) || forwarded(peer.IPv6) {
+		t.Error("packet to another client forwarded with client_isolation")
+	}
+	if !forwarded(net.IPv4(198, 51, 100, 1)) || !forwarded(session.lease.IPv4) {
+		t.Error("packet to the client itself or beyond the tunnel dropped with client_isolation")
+	}
+}
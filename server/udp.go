@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+// serveUDP accepts clients on the UDP datagram transport
+func (s *VPNServer) serveUDP() {
+	config := s.currentConfig()
+
+	address := fmt.Sprintf("%s:%d", config.Host, config.UDPPort)
+	listener, err := protocol.ListenUDPWithOptions(address, udpSocketOptions(config))
+	if err != nil {
+		slog.Error("UDP transport error", "error", err)
+		return
+	}
+	defer listener.Close()
+
+	slog.Info("Listening for UDP transport", "addr", address)
+
+	for {
+		transport, err := listener.Accept()
+		if err != nil {
+			slog.Error("UDP transport error", "error", err)
+			return
+		}
+		go s.handleUDPClient(transport)
+	}
+}
+
+// handleUDPClient runs a session for a client on the UDP transport
+func (s *VPNServer) handleUDPClient(transport *protocol.UDPTransport) {
+	defer transport.Close()
+	remoteAddr := transport.RemoteAddr().String()
+
+	// Apply the same flood protection as WebSocket connections
+	if s.connLimiter != nil {
+		if allowed, _ := s.connLimiter.allow(remoteAddr); !allowed {
+			slog.Warn("Connection rate limit exceeded", "addr", remoteAddr)
+			s.audit(remoteAddr, "", auditRateLimited, nil)
+			return
+		}
+	}
+
+	// The client opens with a hello so the server learns its address; the
+	// hello carries its session token when it is reconnecting
+	transport.SetReadDeadline(time.Now().Add(60 * time.Second))
+	var hello protocol.Message
+	if err := protocol.ReadJSON(transport, &hello); err != nil || hello.Type != protocol.HelloType {
+		slog.Warn("Invalid UDP hello", "addr", remoteAddr)
+		return
+	}
+
+	slog.Info("UDP transport connection", "addr", remoteAddr)
+	s.serveSession(context.Background(), transport, remoteAddr, "", nil, s.resumeSession(hello.Data))
+}
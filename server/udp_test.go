@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+)
+
+func TestUDPClientWithoutHelloRefused(t *testing.T) {
+	s := newTestServer(t)
+	listener, err := protocol.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A frame in sequence, but not a hello
+	datagram := binary.BigEndian.AppendUint64(nil, 0)
+	if _, err := conn.Write(append(datagram, `{"type":"packet"}`...)); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.handleUDPClient(transport)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client without a hello was served")
+	}
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	if len(s.clients) != 0 {
+		t.Error("client without a hello was registered")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"stealthvpn/pkg/protocol"
+	"stealthvpn/pkg/transport/webrtc"
+)
+
+// webRTCSetupTimeout bounds signaling and connecting the data channel
+const webRTCSetupTimeout = 30 * time.Second
+
+// acceptWebRTC offers the client a data channel over its WebSocket
+// connection and returns the data channel transport once it is open
+func (s *VPNServer) acceptWebRTC(signaling protocol.Transport) (*webrtc.Transport, error) {
+	config := s.currentConfig()
+	if !config.EnableWebRTC {
+		return nil, errors.New("WebRTC transport is not enabled")
+	}
+
+	var iceServers []webrtc.ICEServer
+	if config.TURNServer != "" {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       []string{config.TURNServer},
+			Username:   config.TURNUsername,
+			Credential: config.TURNPassword,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webRTCSetupTimeout)
+	defer cancel()
+	signaling.SetReadDeadline(time.Now().Add(webRTCSetupTimeout))
+	signaling.SetWriteDeadline(time.Now().Add(webRTCSetupTimeout))
+	return webrtc.Accept(ctx, signaling, iceServers)
+}
@@ -0,0 +1,306 @@
+//go:build integration && linux
+
+// Package integration runs the server and client binaries against each other
+// on real TUN interfaces. The tests need CAP_NET_ADMIN and run with
+//
+//	sudo -E env "PATH=$PATH" go test -tags integration ./test/integration/
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+)
+
+// startupTimeout bounds building, starting and connecting the binaries
+const startupTimeout = 2 * time.Minute
+
+// requireTUN skips the test unless TUN interfaces can be created
+func requireTUN(t *testing.T) {
+	t.Helper()
+	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		t.Skipf("cannot create TUN interfaces (needs CAP_NET_ADMIN): %v", err)
+	}
+	iface.Close()
+}
+
+// repoRoot returns the top of the repository
+func repoRoot(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// buildBinary builds the main package in dir into the test's temporary
+// directory and returns its path
+func buildBinary(t *testing.T, dir, name string) string {
+	t.Helper()
+	output := filepath.Join(t.TempDir(), name)
+	cmd := exec.Command("go", "build", "-o", output, ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build %s: %v\n%s", name, err, out)
+	}
+	return output
+}
+
+// writeJSON writes v as a JSON file in dir and returns its path
+func writeJSON(t *testing.T, dir, name string, v interface{}) string {
+	t.Helper()
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// freePort returns a TCP port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// process is a binary running for the length of a test, whose log is kept
+// for waiting on and for reporting failures
+type process struct {
+	name   string
+	cmd    *exec.Cmd
+	exited chan struct{}
+
+	mu  sync.Mutex
+	log bytes.Buffer
+}
+
+// startProcess runs a binary until the test ends
+func startProcess(t *testing.T, name, binary string, args ...string) *process {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &process{
+		name:   name,
+		cmd:    exec.CommandContext(ctx, binary, args...),
+		exited: make(chan struct{}),
+	}
+	p.cmd.Dir = filepath.Dir(binary)
+	p.cmd.Stdout = p
+	p.cmd.Stderr = p
+	if err := p.cmd.Start(); err != nil {
+		cancel()
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+	go func() {
+		p.cmd.Wait()
+		close(p.exited)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-p.exited
+		if t.Failed() {
+			t.Logf("%s log:\n%s", name, p.output())
+		}
+	})
+	return p
+}
+
+func (p *process) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.log.Write(data)
+}
+
+func (p *process) output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.log.String()
+}
+
+// waitForLog waits for a line matching pattern and returns its submatches
+func (p *process) waitForLog(t *testing.T, pattern string) []string {
+	t.Helper()
+	re := regexp.MustCompile(pattern)
+	deadline := time.Now().Add(startupTimeout)
+	for time.Now().Before(deadline) {
+		if match := re.FindStringSubmatch(p.output()); match != nil {
+			return match
+		}
+		select {
+		case <-p.exited:
+			t.Fatalf("%s exited before logging %q", p.name, pattern)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("%s never logged %q", p.name, pattern)
+	return nil
+}
+
+// waitForIPv4 waits for the interface to be given an IPv4 address
+func waitForIPv4(t *testing.T, name string) net.IP {
+	t.Helper()
+	deadline := time.Now().Add(startupTimeout)
+	for time.Now().Before(deadline) {
+		if iface, err := net.InterfaceByName(name); err == nil {
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+					return ipNet.IP.To4()
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s never got an IPv4 address", name)
+	return nil
+}
+
+// tcpPacket builds an IPv4 TCP segment carrying payload, with valid
+// checksums so the kernel passes it on unchanged
+func tcpPacket(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	const ipHeaderLen, tcpHeaderLen = 20, 20
+	packet := make([]byte, ipHeaderLen+tcpHeaderLen+len(payload))
+
+	ip := packet[:ipHeaderLen]
+	ip[0] = 0x45 // version 4, 5-word header
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[4:], 0x5356) // a fixed ID, which the kernel keeps
+	ip[8] = 64                                 // TTL
+	ip[9] = unix.IPPROTO_TCP
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := packet[ipHeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], 1)      // sequence number
+	binary.BigEndian.PutUint32(tcp[8:], 1)      // acknowledgment number
+	tcp[12] = tcpHeaderLen / 4 << 4             // data offset
+	tcp[13] = 0x18                              // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[tcpHeaderLen:], payload)
+
+	// The TCP checksum covers a pseudo-header of the addresses, protocol
+	// and segment length
+	var pseudo uint32
+	for i := 12; i < 20; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	pseudo += unix.IPPROTO_TCP + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+	return packet
+}
+
+// checksum returns the Internet checksum of data added to sum
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// sendOnInterface sends an IPv4 packet out of the named interface, so that
+// whoever reads the interface receives exactly these bytes
+func sendOnInterface(t *testing.T, name string, packet []byte) {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := unix.BindToDevice(fd, name); err != nil {
+		t.Fatal(err)
+	}
+
+	var dst unix.SockaddrInet4
+	copy(dst.Addr[:], packet[16:20])
+	if err := unix.Sendto(fd, packet, 0, &dst); err != nil {
+		t.Fatalf("failed to send on %s: %v", name, err)
+	}
+}
+
+// packetCapture receives the packets the host receives on an interface
+type packetCapture struct {
+	fd int
+}
+
+// capturePackets starts capturing on the named interface
+func capturePackets(t *testing.T, name string) *packetCapture {
+	t.Helper()
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protocol := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(protocol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index}); err != nil {
+		t.Fatal(err)
+	}
+	return &packetCapture{fd: fd}
+}
+
+// waitFor returns the first captured packet for which match is true, or
+// nil if none arrives before the timeout
+func (c *packetCapture) waitFor(t *testing.T, timeout time.Duration, match func([]byte) bool) []byte {
+	t.Helper()
+	tv := unix.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(c.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match(buf[:n]) {
+			return append([]byte(nil), buf[:n]...)
+		}
+	}
+	return nil
+}
+
+// htons converts a short to network byte order, as AF_PACKET sockets take
+// their protocol
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
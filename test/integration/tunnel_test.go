@@ -0,0 +1,138 @@
+//go:build integration && linux
+
+package integration
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// serverTunnel is the server's TUN interface
+	serverTunnel = "svtest0"
+	// tunnelSubnet is the tunnel network, kept clear of common LAN ranges
+	tunnelSubnet = "10.213.0.0/24"
+)
+
+// tunnel is a server and a client connected to it, each with its own TUN
+// interface
+type tunnel struct {
+	server         *process
+	client         *process
+	keys           string                 // directory of the config files and key material
+	serverSettings map[string]interface{} // contents of the server's server.json
+	clientTunnel   string
+	clientIP       net.IP
+}
+
+// startTunnel builds and starts the server and client and waits for the
+// client to be given its tunnel address
+func startTunnel(t *testing.T) *tunnel {
+	t.Helper()
+	root := repoRoot(t)
+	serverBinary := buildBinary(t, filepath.Join(root, "server"), "stealthvpn-server")
+	clientBinary := buildBinary(t, filepath.Join(root, "client", "windows"), "stealthvpn-client")
+
+	// Key material lives only as long as the test
+	keys := t.TempDir()
+	psk := make([]byte, 16)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	pskFile := filepath.Join(keys, "psk")
+	if err := os.WriteFile(pskFile, []byte(hex.EncodeToString(psk)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	noJitter := 0
+	serverSettings := map[string]interface{}{
+		"host":                "127.0.0.1",
+		"port":                port,
+		"tls_cert_file":       filepath.Join(keys, "server.crt"),
+		"tls_key_file":        filepath.Join(keys, "server.key"),
+		"auto_generate_cert":  true,
+		"fake_domain_name":    "localhost",
+		"pre_shared_key_file": pskFile,
+		"tunnel_interface":    serverTunnel,
+		"tunnel_subnet":       tunnelSubnet,
+		"tunnel_subnet6":      "fd00:213::/64",
+		"allowed_ips":         []string{tunnelSubnet},
+		"jitter_max_ms":       noJitter,
+	}
+	serverConfig := writeJSON(t, keys, "server.json", serverSettings)
+	clientConfig := writeJSON(t, keys, "client.json", map[string]interface{}{
+		"server_url":          fmt.Sprintf("wss://127.0.0.1:%d/ws", port),
+		"pre_shared_key_file": pskFile,
+		"jitter_max_ms":       noJitter,
+	})
+
+	server := startProcess(t, "server", serverBinary, "-config", serverConfig)
+	server.waitForLog(t, `msg="Routing client packets" interface=`+serverTunnel)
+
+	client := startProcess(t, "client", clientBinary, "-config", clientConfig)
+	clientTunnel := client.waitForLog(t, `msg="Created TUN interface" name=(\S+)`)[1]
+	client.waitForLog(t, `msg="Successfully connected to VPN server"`)
+	return &tunnel{
+		server:         server,
+		client:         client,
+		keys:           keys,
+		serverSettings: serverSettings,
+		clientTunnel:   clientTunnel,
+		clientIP:       waitForIPv4(t, clientTunnel),
+	}
+}
+
+// TestPacketReachesServerTunnel sends a TCP segment into the client's TUN
+// interface and checks that the server writes the same bytes to its own
+// once the segment has been encrypted, obfuscated, sent over the WebSocket
+// connection and unwrapped again.
+func TestPacketReachesServerTunnel(t *testing.T) {
+	requireTUN(t)
+	tun := startTunnel(t)
+	capture := capturePackets(t, serverTunnel)
+
+	// Address the segment to another host in the tunnel network, so the
+	// host hands it to the interface instead of delivering it locally
+	dst := net.ParseIP("10.213.0.200").To4()
+	packet := tcpPacket(tun.clientIP, dst, 40000, 8080, []byte("stealthvpn integration payload"))
+	sendOnInterface(t, tun.clientTunnel, packet)
+
+	received := capture.waitFor(t, 10*time.Second, func(p []byte) bool {
+		return len(p) >= 20 && p[0]>>4 == 4 && bytes.Equal(p[16:20], dst)
+	})
+	if received == nil {
+		t.Fatalf("packet from %s never reached %s", tun.clientTunnel, serverTunnel)
+	}
+	if !bytes.Equal(received, packet) {
+		t.Fatalf("packet changed in the tunnel:\nsent     %x\nreceived %x", packet, received)
+	}
+}
+
+// TestConfigReloadPushesRoutes edits the server's config file while the
+// client is connected and checks that the client is sent the new routes
+// without reconnecting
+func TestConfigReloadPushesRoutes(t *testing.T) {
+	requireTUN(t)
+	tun := startTunnel(t)
+
+	const addedRoute = "10.214.0.0/24"
+	tun.serverSettings["allowed_ips"] = []string{tunnelSubnet, addedRoute}
+	writeJSON(t, tun.keys, "server.json", tun.serverSettings)
+	tun.server.waitForLog(t, `msg="Reloaded config"`)
+
+	routes := regexp.QuoteMeta(fmt.Sprintf(`routes="[%s %s]"`, tunnelSubnet, addedRoute))
+	tun.client.waitForLog(t, `msg="Server assigned tunnel addresses".*`+routes)
+	if connects := strings.Count(tun.client.output(), `msg="Successfully connected to VPN server"`); connects != 1 {
+		t.Fatalf("client connected %d times, want once", connects)
+	}
+}